@@ -17,18 +17,31 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/provenance"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/secrets"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/tracing"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/stringset"
 
@@ -38,80 +51,311 @@ import (
 type buildCmd struct {
 	*cobra.Command
 
+	// stdout and stderr are where the result of the build and the layer
+	// report are printed.
+	stdout io.Writer
+	stderr io.Writer
+
 	dockerfilePath string
 	tag            string
+	specFile       string
+	stageResources map[string]*context.StageResources
+	target         string
+
+	// buildOptions are the settings of the build, set from the flags by
+	// processFlags.
+	buildOptions *context.BuildOptions
+
+	// stdinDockerfile is the dockerfile read from stdin with "-f -", kept
+	// for the retries of the build.
+	stdinDockerfile []byte
+	// noContext is true if the build has no build context, see Build.
+	noContext bool
+
+	pushRegistries   []string
+	replicas         []string
+	registryConfig   string
+	registryRewrites []string
+	allowRegistries  []string
+	denyRegistries   []string
+	offline          bool
+	dockerConfig     string
+	helperTimeout    time.Duration
+	helperRetries    int
+	helperBackoff    time.Duration
+	helperDirs       []string
+	userAgent        string
+	destination      string
+	rootfsFile       string
+	iidFile          string
+	digestFile       string
+	digestMapFile    string
+	ociDigestFile    string
+	quiet            bool
+	manifestFormat   string
+	annotations      []string
+	canonicalJSON    bool
+	digestOnly       bool
+	verifyPush       bool
+
+	provenanceFile      string
+	pushProvenance      bool
+	provenanceBuilderID string
+	sbomOutput          string
+
+	otelEndpoint string
+
+	pullConcurrency  int
+	pullRetries      int
+	pullRetryBackoff float64
+	pushRetries      int
+	pushRetryBackoff float64
+	verifyBlobs      bool
+	buildRetries     int
+	buildTimeout     time.Duration
 
-	pushRegistries []string
-	replicas       []string
-	registryConfig string
-	destination    string
+	// deadline is when the build times out, set from --build-timeout once
+	// for all the attempts of the build.
+	deadline time.Time
 
-	buildArgs     []string
-	allowModifyFS bool
-	commit        string
-	blacklists    []string
+	buildArgs             []string
+	argDefaults           string
+	globalArgs            []string
+	extraEnvs             []string
+	buildContexts         []string
+	dockerignore          string
+	policy                []string
+	addHosts              []string
+	platform              string
+	platforms             []image.Platform
+	allowPlatformMismatch bool
+	variant               string
+	osVersion             string
+	dnsServers            []string
+	dnsSearches           []string
+	buildCACerts          []string
+	buildUmask            string
+	runShell              string
+	ulimits               []string
+	secrets               []string
+	vaultAddr             string
+	allowModifyFS         bool
+	commit                string
+	blacklists            []string
+	layerExcludes         []string
+	remapOwner            string
+	sourceDateEpoch       string
+	copyAllowMissing      bool
+
+	author        string
+	layerComments []string
+	stripHistory  bool
+	keepHistory   []string
+	emptyLayers   bool
+	created       string
+
+	clearEntrypoint bool
+	labelGit        bool
+	labels          []string
+	labelFiles      []string
+	setCmd          string
 
 	localCacheTTL     time.Duration
+	cacheBaseDigest   bool
+	explainCache      bool
+	cacheHash         string
 	redisCacheAddress string
 	redisCacheTTL     time.Duration
 	httpCacheAddress  string
 	httpCacheHeaders  []string
+	cacheRepo         string
+	cacheBackends     []string
+	cacheInline       bool
+	cacheFrom         []string
+	cachePushWorkers  int
+	cacheReadThrough  bool
 
 	dockerHost    string
 	dockerVersion string
 	dockerScheme  string
 	doLoad        bool
 
-	storageDir       string
-	compressionLevel string
+	storageDir            string
+	tmpDir                string
+	lockTimeout           time.Duration
+	fileDedup             string
+	compressionLevel      string
+	layerCompression      string
+	layerPostProcessors   []string
+	verifyDiffIDs         bool
+	incompressibleEntropy float64
+	sparseFiles           bool
+	tarBlockingFactor     int
+	keepSpecialFiles      bool
+	copyOntoItself        string
+	filesystemCase        string
+	maxImageSize          string
+	maxLayerSize          string
+	maxLayers             int
+	stageWorkers          int
+	preflight             bool
+	incrementalFrom       string
+	minFreeDisk           string
+	diskQuota             string
+	maxOpenFiles          int
+	layerReport           string
+	reportFiles           int
 
-	preserveRoot bool
+	preserveRoot  bool
+	keepOnFailure bool
+	assertCleanup bool
+	debugShell    bool
+	rootless      string
+	checkPrivs    bool
+	progress      string
+	runPrefix     bool
+	runScript     int
 }
 
 func getBuildCmd() *buildCmd {
 	buildCmd := &buildCmd{
 		Command: &cobra.Command{
-			Use:                   "build -t=<image_tag> [flags] <context_path>",
+			Use:                   "build -t=<image_tag> [flags] [<context_path>]",
 			DisableFlagsInUseLine: true,
 			Short:                 "Build docker image, optionally push to registries and/or load into docker daemon",
 		},
+		stdout: os.Stdout,
+		stderr: os.Stderr,
 	}
 	buildCmd.Args = func(cmd *cobra.Command, args []string) error {
-		if len(args) != 1 {
-			return errors.New("Requires build context as argument")
+		if len(args) > 1 {
+			return errors.New("Accepts at most one build context as argument")
 		}
 		return nil
 	}
 	buildCmd.Run = func(cmd *cobra.Command, args []string) {
+		var contextDir string
+		if len(args) == 1 {
+			contextDir = args[0]
+		}
+		contextDir, err := buildCmd.applySpec(contextDir)
+		if err != nil {
+			log.Errorf("failed to apply spec: %s", err)
+			os.Exit(1)
+		}
 		if err := buildCmd.processFlags(); err != nil {
 			log.Errorf("failed to process flags: %s", err)
 			os.Exit(1)
 		}
 
-		if err := buildCmd.Build(args[0]); err != nil {
+		err = buildCmd.buildWithRetries(contextDir, buildCmd.Build)
+		if err := tracing.Flush(); err != nil {
+			log.Errorf("Failed to export traces: %s", err)
+		}
+		if err != nil {
 			log.Error(err)
 			os.Exit(1)
 		}
 	}
 
-	buildCmd.PersistentFlags().StringVarP(&buildCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
-	buildCmd.PersistentFlags().StringVarP(&buildCmd.tag, "tag", "t", "", "Image tag (required)")
+	buildCmd.PersistentFlags().StringVarP(&buildCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile, or - to read it from stdin")
+	buildCmd.PersistentFlags().StringVarP(&buildCmd.tag, "tag", "t", "", "Image tag (required, unless set in --spec). May contain the placeholders {git_sha}, {git_short_sha}, {git_branch}, {date}, {timestamp} and {arg:<build arg>}, which also apply to --replica")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.specFile, "spec", "", "Path to a JSON or YAML build spec with the context, dockerfile, target, tag, build args, labels, push targets, cache config and stage resources of the build. Flags override its fields")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.target, "target", "", "Alias of the stage to build, with the stages before it, instead of the last stage")
 
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.pushRegistries, "push", nil, "Registry to push image to")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.registryConfig, "registry-config", "", "Set build-time variables")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.registryRewrites, "registry-rewrite", nil, "Rewrite rule for the images of FROM and COPY --from, applied to their <registry>/<repo>. Format is \"--registry-rewrite <regexp>=<registry>/<repo>\", where the target can refer to capture groups like $1")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.allowRegistries, "allow-registry", nil, "Registry host that the build may pull from and push to, like \"registry.example.com\" or \"*.example.com\". If set, requests to other registries fail")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.denyRegistries, "deny-registry", nil, "Registry host that the build may not pull from or push to, even if it is allowed with --allow-registry")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.offline, "offline", false, "Forbid any network access: base images must be in the storage dir already, flags that need a registry, a remote cache or another server fail, and RUN steps are executed without network access, which requires linux and CAP_SYS_ADMIN")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerConfig, "docker-config", "", "Docker config.json to read credentials from for registries without security config")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.helperTimeout, "credential-helper-timeout", security.CredentialHelperTimeout, "Maximum time to wait for a registry credential helper")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.helperRetries, "credential-helper-retries", security.CredentialHelperRetries, "Number of times to retry a failed registry credential helper call")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.helperBackoff, "credential-helper-backoff", security.CredentialHelperBackoff, "Wait before the first retry of a registry credential helper call, doubled after each retry")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.helperDirs, "credential-helper-dir", nil, "Absolute dir to search for docker-credential-<helper> binaries, in the order of the flags. Default to /makisu-internal")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.userAgent, "user-agent", security.UserAgent, "User-Agent header of registry requests")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.destination, "dest", "", "Destination of the image tar")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.rootfsFile, "export-rootfs", "", "Write the filesystem of the image as a single tar, without its manifest and config, to the file")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.iidFile, "iidfile", "", "Write the image ID to the file")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.digestFile, "digestfile", "", "Write the digest of the image manifest to the file")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.digestMapFile, "digest-map-file", "", "Write a JSON map of each --push and --replica reference to the digest of the manifest pushed under it to the file")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.ociDigestFile, "oci-digestfile", "", "Write the digest of the OCI image manifest to the file, if --manifest-format is 'oci' or 'both'")
+	buildCmd.PersistentFlags().BoolVarP(&buildCmd.quiet, "quiet", "q", false, "Only log errors, to stderr, and print the pushed image names with the digest of the image manifest, or only the digest if the image isn't pushed, to stdout")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.manifestFormat, "manifest-format", "docker", "Format of the pushed image manifest, could be 'docker', 'oci' or 'both'. With 'both' the OCI manifest is pushed by digest")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.annotations, "manifest-annotation", nil, "Annotation of the pushed OCI manifest, if --manifest-format is 'oci' or 'both'. Format is \"--manifest-annotation <key>=<value>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.canonicalJSON, "canonical-manifest", false, "Push manifests serialized as canonical JSON, with sorted keys and no whitespace, instead of indented. Image configs are always canonical")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.digestOnly, "push-digest-only", false, "Push the image by digest, without creating or updating tags in the registries")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.verifyPush, "verify-push", false, "Fail the build if a pushed image does not resolve to the manifest digest computed by makisu")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.provenanceFile, "provenance-file", "", "Write the SLSA provenance of the image, an in-toto statement with the resolved base image digests, the context hash and the build parameters, to the file")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.pushProvenance, "push-provenance", false, "Push the SLSA provenance of the image as an OCI referrer of the pushed manifests. Requires registries supporting the subject field of OCI manifests")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.provenanceBuilderID, "provenance-builder-id", "https://github.com/uber/makisu@"+utils.BuildHash, "Builder ID recorded in the SLSA provenance, which identifies the build platform")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sbomOutput, "sbom-output", "", "Write a CycloneDX SBOM of the image, listing the packages of its apk, dpkg and rpm databases, to the file")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.otelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint of an OpenTelemetry collector, e.g. http://localhost:4318, to export spans of the build, its stages, steps, pulls and pushes to")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pullConcurrency, "pull-concurrency", registry.DefaultPullConcurrency, "Number of layers of base images pulled in parallel, unless set in the registry config")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pullRetries, "pull-retries", registry.DefaultPullRetries, "Number of retries of failed registry pull requests, unless set in the registry config")
+	buildCmd.PersistentFlags().Float64Var(&buildCmd.pullRetryBackoff, "pull-retry-backoff", registry.DefaultPullRetryBackoff, "Backoff factor applied to the interval between pull retries, unless set in the registry config")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.pushRetries, "push-retries", registry.DefaultPushRetries, "Number of retries of failed registry push requests, unless set in the registry config")
+	buildCmd.PersistentFlags().Float64Var(&buildCmd.pushRetryBackoff, "push-retry-backoff", registry.DefaultPushRetryBackoff, "Backoff factor applied to the interval between push retries, unless set in the registry config")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.verifyBlobs, "verify-blobs", false, "Check that the registry serves back every layer and config of the image over new connections, before pushing its manifest, and fail the push otherwise")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.buildRetries, "build-retries", 0, "Number of times the whole build is re-run from a clean state if it failed because of a transient registry or network error")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.buildTimeout, "build-timeout", 0, "Maximum duration of the whole build, including its retries. Once it is exceeded, the running RUN command is killed and no further step or push is started; pulls, pushes and other steps in flight aren't interrupted")
 
-	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\", or \"--build-arg <arg>\" for the value of the environment variable <arg>")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.argDefaults, "arg-defaults", "", "Path to a YAML map of ARG names to values, used for the ARGs that neither --build-arg nor the dockerfile give a value")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.globalArgs, "global-arg", nil, "Argument declared in every stage as if by ARG, which the dockerfile can override. Format is \"--global-arg <arg>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.extraEnvs, "extra-env", nil, "Environment variable set in every stage as if by ENV, which the dockerfile can override. Format is \"--extra-env <key>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildContexts, "build-context", nil, "Named context that COPY --from=<name> copies from, either a directory or an image. Format is \"--build-context <name>=<dir>\" or \"--build-context <name>=docker-image://<image>\"")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerignore, "dockerignore", "", "Ignore file of the paths of the build context that ADD and COPY don't copy. Default to <dockerfile>.dockerignore next to the dockerfile, else .dockerignore at the root of the build context, if they exist")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.policy, "policy", nil, "Rule checked against the dockerfile, one of add-local, latest-tag, maintainer, missing-user or all, logging violations with their line or failing the build on them. Format is \"--policy <rule>[=warn|error]\", defaults to warn")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.platform, "platform", "", "Target platform of the image formatted as <os>/<architecture>[/<variant>], which FROM images must match and which is pulled from manifest lists. Defaults to linux on the host architecture. A comma separated list builds the image for each platform and pushes an image index referencing them")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowPlatformMismatch, "allow-platform-mismatch", false, "Only warn about FROM images whose platform doesn't match the target platform")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.variant, "variant", "", "Architecture variant set in the image config, like 'v7' for arm, instead of the one of --platform or of the base image")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.osVersion, "os-version", "", "OS version set in the image config, like '10.0.17763.1817' for Windows, instead of the one of the base image")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.addHosts, "add-host", nil, "Entry added to /etc/hosts while RUN steps are executed, without being committed to layers. Format is \"--add-host <name>:<ip>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.dnsServers, "dns", nil, "DNS server used while RUN steps are executed, without being committed to layers")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildCACerts, "build-ca-cert", nil, "PEM file of CA certificates trusted by RUN steps, which are added to the CA bundles of the root filesystem while they are executed, without being committed to layers")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.buildUmask, "build-umask", "", "Octal umask RUN steps are executed with, e.g. \"022\", so that the permissions of the files they create don't depend on the host. It is set by the umask builtin of the RUN shell. Defaults to the umask of makisu")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.runShell, "run-shell", "", "Shell that RUN commands, and CMD and ENTRYPOINT in shell form, are run with, as a JSON array or words separated by spaces, e.g. \"/usr/bin/env bash -c\". Defaults to \"sh -c\" for RUN")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.ulimits, "ulimit", nil, "Resource limit RUN steps are executed with, like docker run --ulimit, without being persisted into the image. It is set with the ulimit builtin of the RUN shell, with sizes rounded down to its units. Format is \"--ulimit <name>=<soft>[:<hard>]\", e.g. \"nofile=65536:65536\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.secrets, "secret", nil, "Secret that RUN steps can mount with --mount=type=secret,id=<id>, without it being committed to layers. Format is \"id=<id>,source=<file|env|vault>:<ref>\", e.g. \"id=npmrc,source=vault:secret/data/npm#npmrc\"")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.vaultAddr, "vault-addr", "", "Address of the Vault server of vault secrets. Defaults to $VAULT_ADDR; the token is read from $VAULT_TOKEN, or obtained with $VAULT_ROLE_ID and $VAULT_SECRET_ID")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.dnsSearches, "dns-search", nil, "DNS search domain used while RUN steps are executed, without being committed to layers")
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowModifyFS, "modifyfs", false, "Allow makisu to modify files outside of its internal storage dir")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.commit, "commit", "implicit", "Set to explicit to only commit at steps with '#!COMMIT' annotations; Set to implicit to commit at every ADD/COPY/RUN step")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.blacklists, "blacklist", nil, "Makisu will ignore all changes to these locations in the resulting docker images")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.layerExcludes, "layer-exclude", nil, "Glob pattern of paths to never add to layers created by RUN, COPY or ADD, e.g. '.git' or '/root/.cache'. Patterns without '/' match base names")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.remapOwner, "remap-owner", "", "Set the owner of all files in layers created by the build to '<uid>:<gid>', or shift owners in a range with '<from>:<to>:<size>'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sourceDateEpoch, "source-date-epoch", "", "Clamp the mtimes of files copied by COPY and ADD, which otherwise keep the mtimes of their sources, to this unix time, e.g. \"--source-date-epoch $SOURCE_DATE_EPOCH\" for reproducible builds")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.copyAllowMissing, "copy-allow-missing", false, "Skip the sources of COPY and ADD that don't exist in the build context with a warning, instead of failing the build")
+
+	buildCmd.PersistentFlags().StringVar(&buildCmd.author, "author", "", "Author of the image and its history entries")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.layerComments, "layer-comment", nil, "Comment added to the history of the layer committed by a step of the final stage. Format is \"--layer-comment <step number>=<comment>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.stripHistory, "strip-history", false, "Redact the commands from the history of the resulting image, layers are left untouched")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.keepHistory, "keep-history", nil, "Regex of history commands to keep when --strip-history is set")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.emptyLayers, "empty-layer-history", false, "Add history entries marked as empty layers for the steps that don't commit a layer, like ENV and LABEL, as docker does")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.created, "created", "now", "Created time of the resulting image and of the history entries of its new layers: 'now', 'latest-mtime' for the newest mtime of the files in its layers, or a unix time")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.clearEntrypoint, "clear-entrypoint", false, "Remove the entrypoint from the config of the resulting image")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.setCmd, "set-cmd", "", "Replace the cmd in the config of the resulting image with a JSON array, e.g. '[\"sh\"]'. '[]' clears it")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.labels, "label", nil, "Label of the resulting image, replacing the label of the same key from the dockerfile. Format is \"--label <key>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.labelFiles, "label-file", nil, "Path to a file of KEY=VALUE labels of the resulting image, one per line. Its labels replace the ones from the dockerfile and --label-git, and are replaced by --label")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.labelGit, "label-git", false, "Label the resulting image with the revision, branch, tag, remote URL and dirty state of the git checkout of the context")
 
 	buildCmd.PersistentFlags().DurationVar(&buildCmd.localCacheTTL, "local-cache-ttl", time.Hour*168, "Time-To-Live for local cache")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.cacheBaseDigest, "cache-base-digest", true, "Include the digest of base images in cache IDs, so that updated base images invalidate the cache of the following steps")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.explainCache, "explain-cache", false, "Log the inputs of the cache ID of every step, to diff the logs of builds that missed the cache")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.cacheHash, "cache-hash", "sha256", "Hash algorithm that cache IDs are derived from, one of sha256 and sha512. Changing it invalidates the existing cache")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping")
 	buildCmd.PersistentFlags().DurationVar(&buildCmd.redisCacheTTL, "redis-cache-ttl", time.Hour*168, "Time-To-Live for redis cache")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.httpCacheAddress, "http-cache-addr", "", "The address of the http server for cacheID to layer sha mapping")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.httpCacheHeaders, "http-cache-header", nil, "Request header for http cache server. Format is \"--http-cache-header <header>:<value>\"")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.cacheRepo, "cache-repo", "", "Registry repository that stores cache layers and the cacheID to layer sha mapping, instead of a key-value store. Format is \"--cache-repo <registry>/<repo>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.cacheBackends, "cache-backend", nil, "Key-value store for cacheID to layer sha mapping, one of \"redis=<addr>\", \"http=<addr>\" and \"local\". Can be repeated to write the mappings to all of them and read them from the first one that has them, skipping the ones that fail")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.cacheInline, "cache-inline", false, "Record the cacheID to layer sha mapping of the final stage in the config of the resulting image, so that it can be used with --cache-from")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.cacheFrom, "cache-from", nil, "Image whose inline cache is looked up before the cache storage, see --cache-inline. Can be repeated")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.cachePushWorkers, "cache-push-workers", 1, "Number of cache layers pushed concurrently. The cacheID to layer sha mappings are stored together once the layers are pushed")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.cacheReadThrough, "cache-read-through", false, "Pull the layers of locally committed steps that are gone from the storage dir from the registry if it has them, instead of executing the steps again")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerHost, "docker-host", utils.DefaultEnv("DOCKER_HOST", "unix:///var/run/docker.sock"), "Docker host to load images to")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerVersion, "docker-version", utils.DefaultEnv("DOCKER_VERSION", "1.21"), "Version string for loading images to docker")
@@ -119,11 +363,41 @@ func getBuildCmd() *buildCmd {
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.doLoad, "load", false, "Load image into docker daemon after build. Requires access to docker socket at location defined by ${DOCKER_HOST}")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.storageDir, "storage", "", "Directory that makisu uses for temp files and cached layers. Mount this path for better caching performance. If modifyfs is set, default to /makisu-storage; Otherwise default to /tmp/makisu-storage")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.tmpDir, "tmp-dir", utils.DefaultEnv("TMPDIR", ""), "Directory that makisu uses for temp files, can be on a different filesystem than the storage dir. Default to the storage dir")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.lockTimeout, "storage-lock-timeout", storage.DefaultLockTimeout, "Maximum time to wait for other builds sharing the storage dir to release a lock")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.fileDedup, "file-dedup", string(storage.DedupNone), "Files copied to the tmp dir, like the stage checkpoints of COPY --from, that share a single copy per content. Can be none, content (non-empty files) or all (including empty files)")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionLevel, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default'")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.layerPostProcessors, "layer-postprocessor", nil, "Name of a layer post-processor that the layers of the image are piped through before they are pushed, in the order of the flags: 'normalize-ownership', or one registered by programs embedding makisu. Their digests and diff IDs are computed from the output")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.verifyDiffIDs, "verify-diff-ids", false, "Check that the diff IDs of the config of the image are the digests of the uncompressed content of its layers once it is built, before it is pushed, and fail the build otherwise")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.layerCompression, "layer-compression", "", "Convert the layers of the image with another compression, like the ones of its base image, to 'gzip', 'none' (plain tars) or 'zstd', which requires --manifest-format 'oci'. Their diff IDs are kept, but their digests and media types change")
+	buildCmd.PersistentFlags().Float64Var(&buildCmd.incompressibleEntropy, "incompressible-entropy", 0, "Store layers whose sampled entropy is at least this many bits per byte as uncompressed tars instead of gzipping them, e.g. 7.5 to skip layers of videos and archives. 0 always gzips layers")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.sparseFiles, "sparse-files", true, "Keep the holes of sparse files, by writing them as GNU PAX sparse entries in layers and skipping blocks of zeros when extracting layers. Disable if the tools reading the images don't support sparse entries")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.tarBlockingFactor, "tar-blocking-factor", 1, "Number of 512-byte blocks per record of layer tars, which are padded with zeros to a whole number of records. 1 matches docker, 20 matches GNU tar")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.keepSpecialFiles, "keep-special-files", false, "Keep device nodes and named pipes in layers, as tar entries with their device numbers, instead of skipping them with a warning. Sockets are always skipped")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.copyOntoItself, "copy-onto-itself", "skip", "What COPY and ADD do with a source that is the same file as its destination, e.g. with --modifyfs and a context under the root: \"skip\" leaves it as is, \"error\" fails the build")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.filesystemCase, "filesystem-case", "auto", "Case sensitivity of the filesystem of the root, which decides if names that only differ by case are the same file when diffing it: \"auto\" probes it, \"sensitive\" or \"insensitive\" overrides it")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.maxImageSize, "max-image-size", "", "Fail the build if the total compressed size of the image layers exceeds this size, e.g. '2GB'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.maxLayerSize, "max-layer-size", "", "Fail the build if the compressed size of any image layer exceeds this size, e.g. '500MB'")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.maxLayers, "max-layers", 0, "Max number of layers of the image, including the ones of its base image. Trailing layers of the final stage are squashed into its last layer to stay under it. 0 means no limit")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.stageWorkers, "stage-workers", 1, "Number of stages whose cache layers, and of images referenced by COPY --from whose files, are pulled concurrently before the build. Stages are still built one after another")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.preflight, "preflight", false, "Check that the images of all FROM and COPY --from steps exist, can be pulled and are for the target platform before executing any step")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.incrementalFrom, "incremental-from", "", "Push the image as the layers of this prior image followed by a single layer of the files that changed since it, for fast iterative pushes")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.minFreeDisk, "min-free-disk", "", "Fail the build before it starts if the disk of the storage dir, the tmp dir or, with --modifyfs, the root has less free space than this size, e.g. '20GB'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.diskQuota, "disk-quota", "", "Kill RUN commands that use more than this size of the disk of the root, e.g. '10GB'. The decrease of free space is measured, so other processes writing to the same disk count too")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.maxOpenFiles, "max-open-files", fileio.DefaultMaxOpenFiles, "Max number of files that the whole build opens at the same time to hash the sources of COPY and ADD and to write layers, to stay below the limit of file descriptors")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.layerReport, "layer-report", "", "Print the size and file count of each layer at the end of the build, to stderr with --quiet, could be 'text' or 'json'")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.reportFiles, "layer-report-files", 0, "Number of largest files to list per layer in the layer report")
 
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.preserveRoot, "preserve-root", false, "Copy / in the storage dir and copy it back after build.")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.assertCleanup, "assert-cleanup", false, "Fail the build if what RUN steps set up, like extra hosts, secrets and processes left running by commands, or the build filesystem and sandbox can't be cleaned up, instead of only logging it")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.keepOnFailure, "keep-on-failure", false, "Leave the filesystem of the build in place for debugging if a step fails")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.debugShell, "debug-shell", false, "Start an interactive shell in the build filesystem when a RUN step fails, if a terminal is attached")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.rootless, "rootless", "auto", "Set to true to build without changing file owners on disk, for non-root users without CAP_CHOWN; auto detects it at startup")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.checkPrivs, "check-privileges", true, "Check at startup that makisu has the capabilities and writable dirs that the build needs, and fail with how to fix it otherwise")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.progress, "progress", "auto", "Output format of RUN steps. Valid values are \"plain\", for one line per update without control characters, \"tty\" to pass it through as is, and \"auto\", for plain unless stdout is a terminal")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.runPrefix, "run-output-prefix", true, "Prefix each line of the output of RUN steps with the stage and position of the step")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.runScript, "run-script-threshold", context.DefaultRunScriptThreshold, "Length in bytes above which RUN commands are written to a script that the shell sources, instead of being passed as an argument that exceeds the limit of the OS. 0 always passes them as arguments")
 
-	buildCmd.MarkFlagRequired("tag")
 	buildCmd.Flags().SortFlags = false
 	buildCmd.PersistentFlags().SortFlags = false
 
@@ -131,24 +405,220 @@ func getBuildCmd() *buildCmd {
 }
 
 func (cmd *buildCmd) processFlags() error {
+	// The tag can come from the spec, so it isn't a required flag.
+	if cmd.tag == "" {
+		return errors.New("--tag is required, on the command line or in --spec")
+	}
+	cmd.buildOptions = context.DefaultBuildOptions()
+	if cmd.quiet {
+		format, err := cmd.InheritedFlags().GetString("log-fmt")
+		if err != nil {
+			return fmt.Errorf("get log format: %s", err)
+		}
+		logger, err := getQuietLogger(format)
+		if err != nil {
+			return fmt.Errorf("configure quiet logger: %s", err)
+		}
+		log.SetLogger(logger.Sugar())
+	}
+
+	if err := cmd.expandPathFlags(); err != nil {
+		return err
+	}
+
 	if err := maybeBlacklistVarRun(); err != nil {
 		return fmt.Errorf("failed to extend blacklist: %s", err)
 	}
 
+	if err := step.SetBuildContexts(cmd.buildOptions, cmd.buildContexts); err != nil {
+		return err
+	}
+	// Like the build context, the dirs of named contexts aren't part of the
+	// image.
+	for _, dir := range cmd.buildOptions.BuildContextDirs {
+		pathutils.DefaultBlacklist = stringset.FromSlice(
+			append(pathutils.DefaultBlacklist, dir)).ToSlice()
+	}
+
 	if len(cmd.blacklists) != 0 {
 		newBlacklist := append(pathutils.DefaultBlacklist, cmd.blacklists...)
 		pathutils.DefaultBlacklist = stringset.FromSlice(newBlacklist).ToSlice()
 		log.Infof("Added %d new items to blacklist: %v", len(cmd.blacklists), cmd.blacklists)
 	}
 
-	if err := tario.SetCompressionLevel(cmd.compressionLevel); err != nil {
+	if err := image.SetRewriteRules(cmd.registryRewrites); err != nil {
+		return fmt.Errorf("set registry rewrites: %s", err)
+	}
+	if err := setRegistryPolicy(&cmd.buildOptions.Registry, cmd.allowRegistries, cmd.denyRegistries); err != nil {
+		return err
+	}
+	if cmd.offline {
+		if err := cmd.checkOffline(); err != nil {
+			return err
+		}
+	}
+	cmd.buildOptions.Registry.Offline = cmd.offline
+	cmd.buildOptions.NoNetwork = cmd.offline
+
+	if err := snapshot.SetLayerExcludes(&cmd.buildOptions.Snapshot, cmd.layerExcludes); err != nil {
+		return fmt.Errorf("set layer excludes: %s", err)
+	}
+
+	if cmd.remapOwner != "" {
+		mapping, err := snapshot.ParseOwnerMapping(cmd.remapOwner)
+		if err != nil {
+			return fmt.Errorf("parse owner mapping: %s", err)
+		}
+		cmd.buildOptions.Snapshot.OwnerRemap = mapping
+	}
+
+	if cmd.sourceDateEpoch != "" {
+		epoch, err := snapshot.ParseSourceDateEpoch(cmd.sourceDateEpoch)
+		if err != nil {
+			return err
+		}
+		cmd.buildOptions.Snapshot.SourceDateEpoch = epoch
+	}
+
+	if compression, err := builder.ParseLayerCompression(cmd.layerCompression); err != nil {
+		return err
+	} else if compression == builder.LayerCompressionZstd && cmd.manifestFormat != "oci" {
+		return fmt.Errorf("--layer-compression 'zstd' requires --manifest-format 'oci', as docker manifests can't reference zstd layers")
+	}
+	if err := tario.SetCompressionLevel(&cmd.buildOptions.Snapshot.Tar, cmd.compressionLevel); err != nil {
 		return fmt.Errorf("set compression level: %s", err)
 	}
+	if err := tario.SetIncompressibleEntropy(&cmd.buildOptions.Snapshot.Tar, cmd.incompressibleEntropy); err != nil {
+		return fmt.Errorf("set incompressible entropy: %s", err)
+	}
+	cmd.buildOptions.Snapshot.Tar.SparseFiles = cmd.sparseFiles
+	cmd.buildOptions.Snapshot.Tar.BlockingFactor = cmd.tarBlockingFactor
+	cmd.buildOptions.Snapshot.Tar.KeepSpecialFiles = cmd.keepSpecialFiles
+	switch cmd.copyOntoItself {
+	case "skip", "error":
+		cmd.buildOptions.Snapshot.FailCopyOntoItself = cmd.copyOntoItself == "error"
+	default:
+		return fmt.Errorf("invalid copy-onto-itself option: %s", cmd.copyOntoItself)
+	}
+	filesystemCase, err := snapshot.ParseCaseSensitivity(cmd.filesystemCase)
+	if err != nil {
+		return err
+	}
+	cmd.buildOptions.Snapshot.FilesystemCase = filesystemCase
+
+	if err := fileio.SetMaxOpenFiles(cmd.maxOpenFiles); err != nil {
+		return err
+	}
+
+	if _, _, err := cmd.getMaxSizes(); err != nil {
+		return fmt.Errorf("invalid max size: %s", err)
+	}
+
+	if _, err := cmd.getMinFreeDisk(); err != nil {
+		return fmt.Errorf("invalid min free disk: %s", err)
+	}
+
+	diskQuota, err := cmd.getDiskQuota()
+	if err != nil {
+		return fmt.Errorf("invalid disk quota: %s", err)
+	}
+	cmd.buildOptions.DiskQuota = diskQuota
+
+	if _, err := cmd.getCacheRepo(); err != nil {
+		return fmt.Errorf("invalid cache repo: %s", err)
+	}
+	if err := cmd.checkCacheBackends(); err != nil {
+		return fmt.Errorf("invalid cache backend: %s", err)
+	}
+
+	if cmd.incrementalFrom != "" {
+		if _, err := image.ParseNameForPull(cmd.incrementalFrom); err != nil {
+			return fmt.Errorf("invalid incremental-from image: %s", err)
+		}
+	}
+
+	if cmd.layerReport != "" && cmd.layerReport != "text" && cmd.layerReport != "json" {
+		return fmt.Errorf("invalid layer report format: %s", cmd.layerReport)
+	}
+
+	if cmd.manifestFormat != "docker" && cmd.manifestFormat != "oci" && cmd.manifestFormat != "both" {
+		return fmt.Errorf("invalid manifest format: %s", cmd.manifestFormat)
+	}
+	annotations, err := cmd.getManifestAnnotations()
+	if err != nil {
+		return fmt.Errorf("invalid manifest annotation: %s", err)
+	} else if len(annotations) > 0 && cmd.manifestFormat == "docker" {
+		return fmt.Errorf("--manifest-annotation requires --manifest-format 'oci' or 'both'")
+	}
+	cmd.buildOptions.Registry.OCIAnnotations = annotations
 
 	if cmd.commit != "explicit" && cmd.commit != "implicit" {
 		return fmt.Errorf("invalid commit option: %s", cmd.commit)
 	}
 
+	if _, err := cmd.getLayerComments(); err != nil {
+		return fmt.Errorf("invalid layer comment: %s", err)
+	}
+
+	if _, err := cmd.getKeepHistoryPatterns(); err != nil {
+		return fmt.Errorf("invalid keep-history pattern: %s", err)
+	}
+
+	if _, err := cmd.getCmdOverride(); err != nil {
+		return fmt.Errorf("invalid set-cmd: %s", err)
+	}
+
+	if cmd.maxLayers < 0 {
+		return fmt.Errorf("max layers cannot be negative")
+	}
+
+	if cmd.stageWorkers < 1 {
+		return fmt.Errorf("stage workers must be at least 1")
+	}
+
+	if cmd.cachePushWorkers < 1 {
+		return fmt.Errorf("cache push workers must be at least 1")
+	}
+
+	if cmd.runScript < 0 {
+		return fmt.Errorf("run script threshold must be at least 0")
+	}
+
+	if cmd.tarBlockingFactor < 1 {
+		return fmt.Errorf("tar blocking factor must be at least 1")
+	}
+
+	if cmd.otelEndpoint != "" {
+		u, err := url.Parse(cmd.otelEndpoint)
+		if err != nil {
+			return fmt.Errorf("invalid otel endpoint: %s", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid otel endpoint %s: must be an http or https url", cmd.otelEndpoint)
+		}
+		tracing.SetTracer(tracing.NewTracer(cmd.otelEndpoint, "makisu"))
+	}
+
+	if cmd.buildTimeout < 0 {
+		return fmt.Errorf("invalid build timeout: %s", cmd.buildTimeout)
+	}
+	if cmd.pullConcurrency < 1 {
+		return fmt.Errorf("pull concurrency must be at least 1")
+	}
+	if cmd.pullRetries < 0 || cmd.pushRetries < 0 || cmd.buildRetries < 0 {
+		return fmt.Errorf("retries cannot be negative")
+	} else if cmd.pullRetryBackoff < 1 || cmd.pushRetryBackoff < 1 {
+		return fmt.Errorf("retry backoff cannot be lower than 1")
+	}
+	if cmd.buildRetries > 0 && cmd.keepOnFailure {
+		return fmt.Errorf("--build-retries can't be used with --keep-on-failure")
+	}
+	registry.DefaultPullConcurrency = cmd.pullConcurrency
+	registry.DefaultPullRetries = cmd.pullRetries
+	registry.DefaultPullRetryBackoff = cmd.pullRetryBackoff
+	registry.DefaultPushRetries = cmd.pushRetries
+	registry.DefaultPushRetryBackoff = cmd.pushRetryBackoff
+	cmd.buildOptions.Registry.VerifyPushedBlobs = cmd.verifyBlobs
+
 	if err := cmd.initRegistryConfig(); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
@@ -172,6 +642,110 @@ func (cmd *buildCmd) processFlags() error {
 		return fmt.Errorf("storage dir cannot be under internal dir %s",
 			pathutils.DefaultInternalDir)
 	}
+
+	switch cmd.rootless {
+	case "auto":
+		utils.Rootless = utils.DetectRootless()
+	case "true", "false":
+		utils.Rootless = cmd.rootless == "true"
+	default:
+		return fmt.Errorf("invalid rootless option: %s", cmd.rootless)
+	}
+	if utils.Rootless {
+		log.Infof("Running in rootless mode: file owners are recorded in layers but not applied on disk")
+	}
+
+	switch cmd.progress {
+	case "auto":
+		shell.PlainOutput = !shell.IsOutputTerminal()
+	case "plain", "tty":
+		shell.PlainOutput = cmd.progress == "plain"
+	default:
+		return fmt.Errorf("invalid progress option: %s", cmd.progress)
+	}
+
+	storage.DefaultLockTimeout = cmd.lockTimeout
+	switch mode := storage.DedupMode(cmd.fileDedup); mode {
+	case storage.DedupNone, storage.DedupContent, storage.DedupAll:
+		storage.FileDedup = mode
+	default:
+		return fmt.Errorf("invalid file dedup option: %s", cmd.fileDedup)
+	}
+	cmd.buildOptions.DebugShell = cmd.debugShell
+	cmd.buildOptions.AssertCleanup = cmd.assertCleanup
+	platforms, err := parsePlatforms(cmd.platform)
+	if err != nil {
+		return err
+	}
+	cmd.platforms = platforms
+	cmd.setPlatform(platforms[0])
+	if err := step.LoadEmulators(platforms); err != nil {
+		return err
+	}
+	if len(platforms) > 1 {
+		if err := cmd.checkMultiPlatformFlags(); err != nil {
+			return err
+		}
+	}
+	cmd.buildOptions.AllowPlatformMismatch = cmd.allowPlatformMismatch
+	if err := step.SetExtraHosts(cmd.buildOptions, cmd.addHosts); err != nil {
+		return err
+	}
+	if err := step.SetDNS(cmd.buildOptions, cmd.dnsServers, cmd.dnsSearches); err != nil {
+		return err
+	}
+	if err := step.SetBuildCACerts(cmd.buildOptions, cmd.buildCACerts); err != nil {
+		return err
+	}
+	if err := step.SetRunShell(cmd.buildOptions, cmd.runShell); err != nil {
+		return err
+	}
+	if err := step.SetBuildUmask(cmd.buildOptions, cmd.buildUmask); err != nil {
+		return err
+	}
+	if err := step.SetUlimits(cmd.buildOptions, cmd.ulimits); err != nil {
+		return err
+	}
+	vault := secrets.NewVaultSourceFromEnv()
+	if cmd.vaultAddr != "" {
+		vault.Address = cmd.vaultAddr
+	}
+	secrets.RegisterSource("vault", vault)
+	if err := step.SetSecrets(cmd.buildOptions, cmd.secrets); err != nil {
+		return err
+	}
+	cmd.buildOptions.CacheBaseDigest = cmd.cacheBaseDigest
+	cmd.buildOptions.ExplainCache = cmd.explainCache
+	cmd.buildOptions.PrefixRunOutput = cmd.runPrefix
+	cmd.buildOptions.RunScriptThreshold = cmd.runScript
+	if err := step.SetCacheHash(cmd.buildOptions, cmd.cacheHash); err != nil {
+		return err
+	}
+	cmd.buildOptions.CopyAllowMissing = cmd.copyAllowMissing
+	security.DockerConfigFile = cmd.dockerConfig
+	cmd.buildOptions.Registry.CanonicalManifests = cmd.canonicalJSON
+	security.CredentialHelperTimeout = cmd.helperTimeout
+	if cmd.helperRetries < 0 {
+		return fmt.Errorf("--credential-helper-retries must not be negative")
+	}
+	security.CredentialHelperRetries = cmd.helperRetries
+	security.CredentialHelperBackoff = cmd.helperBackoff
+	if err := security.SetCredentialHelperDirs(cmd.helperDirs); err != nil {
+		return err
+	}
+	security.UserAgent = cmd.userAgent
+
+	// Temp files are always written to a dir owned by makisu, since it gets
+	// removed after build.
+	if cmd.tmpDir == "" {
+		cmd.tmpDir = cmd.storageDir
+	} else {
+		cmd.tmpDir = filepath.Join(cmd.tmpDir, "makisu-tmp")
+	}
+	if pathutils.IsDescendantOfAny(cmd.tmpDir, []string{pathutils.DefaultInternalDir}) {
+		return fmt.Errorf("tmp dir cannot be under internal dir %s",
+			pathutils.DefaultInternalDir)
+	}
 	return nil
 }
 
@@ -180,10 +754,25 @@ func (cmd *buildCmd) newBuildPlan(
 	replicas []image.Name) (*builder.BuildPlan, error) {
 
 	// Read in and parse dockerfile.
-	dockerfile, err := cmd.getDockerfile(buildContext.ContextDir)
+	dockerfile, lines, err := cmd.getDockerfile(buildContext.ContextDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get dockerfile: %s", err)
 	}
+	if srcs := builder.ContextSources(dockerfile); cmd.noContext && len(srcs) > 0 {
+		return nil, fmt.Errorf(
+			"no build context given, but the dockerfile copies %s from it", strings.Join(srcs, ", "))
+	}
+	for _, hint := range builder.CheckStepOrdering(dockerfile, buildContext.ContextDir) {
+		log.Warnf("%s", hint)
+	}
+	if err := cmd.checkPolicy(dockerfile, lines, buildContext.ContextDir); err != nil {
+		return nil, err
+	}
+	if hasRunSteps(dockerfile) {
+		if err := step.CheckEmulation(buildContext.Options.TargetPlatform); err != nil {
+			return nil, err
+		}
+	}
 
 	// Remove image manifest if an image with the same name already exists.
 	if err := cleanManifest(buildContext, imageName); err != nil {
@@ -195,8 +784,19 @@ func (cmd *buildCmd) newBuildPlan(
 		}
 	}
 
+	dockerignore, err := cmd.getDockerignore(buildContext.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := step.SetDockerignore(buildContext.Options, dockerignore); err != nil {
+		return nil, fmt.Errorf("failed to read dockerignore: %s", err)
+	}
+
 	// Init cache manager.
 	cacheMgr := cmd.newCacheManager(buildContext, imageName)
+	if len(cmd.cacheFrom) > 0 {
+		cacheMgr = cmd.newInlineCacheManager(buildContext, cacheMgr)
+	}
 
 	// forceCommit will make every step attempt to commit a layer.
 	// Commit is noop for steps other than ADD/COPY/RUN if they are not after an
@@ -204,79 +804,315 @@ func (cmd *buildCmd) newBuildPlan(
 	forceCommit := cmd.commit == "implicit"
 
 	// Create BuildPlan and validate it.
-	return builder.NewBuildPlan(
+	plan, err := builder.NewBuildPlan(
 		buildContext, imageName, replicas, cacheMgr, dockerfile, cmd.allowModifyFS, forceCommit)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := cmd.getLayerComments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layer comments: %s", err)
+	}
+	plan.SetHistory(cmd.author, comments)
+	created, err := builder.ParseCreated(cmd.created)
+	if err != nil {
+		return nil, err
+	}
+	plan.SetCreated(created)
+	plan.SetEmptyLayerHistory(cmd.emptyLayers)
+	plan.SetMaxLayers(cmd.maxLayers)
+	plan.SetStageWorkers(cmd.stageWorkers)
+	plan.SetPreflight(cmd.preflight)
+	plan.SetIncrementalFrom(cmd.incrementalFrom)
+	layerCompression, err := builder.ParseLayerCompression(cmd.layerCompression)
+	if err != nil {
+		return nil, err
+	}
+	plan.SetLayerCompression(layerCompression)
+	if err := plan.SetLayerPostProcessors(cmd.layerPostProcessors); err != nil {
+		return nil, err
+	}
+	plan.SetVerifyDiffIDs(cmd.verifyDiffIDs)
+	plan.SetInlineCache(cmd.cacheInline)
+	plan.SetVariant(cmd.getVariant(buildContext.Options.TargetPlatform))
+	plan.SetOSVersion(cmd.osVersion)
+	if err := plan.SetStageResources(cmd.stageResources); err != nil {
+		return nil, fmt.Errorf("invalid spec stages: %s", err)
+	}
+	if cmd.clearEntrypoint {
+		plan.ClearEntrypoint()
+	}
+	if cmd.setCmd != "" {
+		override, err := cmd.getCmdOverride()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cmd override: %s", err)
+		}
+		plan.SetCmd(override)
+	}
+	if cmd.labelGit {
+		plan.AddLabels(getGitLabels(buildContext.ContextDir))
+	}
+	if len(cmd.labelFiles) > 0 {
+		labels, err := cmd.readLabelFiles()
+		if err != nil {
+			return nil, err
+		}
+		plan.AddLabels(labels)
+	}
+	if len(cmd.labels) > 0 {
+		labels, err := parseKeyValues("label", cmd.labels)
+		if err != nil {
+			return nil, err
+		}
+		plan.AddLabels(labels)
+	}
+	if cmd.stripHistory {
+		keep, err := cmd.getKeepHistoryPatterns()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keep-history patterns: %s", err)
+		}
+		plan.StripHistory(keep)
+	}
+	return plan, nil
+}
+
+// buildWithRetries calls build, which is Build outside of tests, and calls it
+// again up to --build-retries times while it fails because of transient
+// errors. Build starts from a clean state every time, as the build context and
+// the filesystem are cleaned up when it returns.
+func (cmd *buildCmd) buildWithRetries(contextDir string, build func(string) error) error {
+	if cmd.buildTimeout > 0 {
+		cmd.deadline = time.Now().Add(cmd.buildTimeout)
+	}
+	err := build(contextDir)
+	for retry := 1; retry <= cmd.buildRetries && isTransientError(err) && !cmd.timedOut(); retry++ {
+		log.Errorf("Build failed with transient error, retrying (%d/%d): %s", retry, cmd.buildRetries, err)
+		err = build(contextDir)
+	}
+	if errors.Is(err, context.ErrBuildTimeout) {
+		return fmt.Errorf("build exceeded --build-timeout of %s: %w", cmd.buildTimeout, err)
+	}
+	return err
+}
+
+// timedOut returns true if the deadline of --build-timeout passed.
+func (cmd *buildCmd) timedOut() bool {
+	return !cmd.deadline.IsZero() && !time.Now().Before(cmd.deadline)
 }
 
 // Build image from the specified dockerfile.
 // If --push is specified, will also push the image to those registries.
 // If --load is specified, will load the image into the local docker daemon.
-func (cmd *buildCmd) Build(contextDir string) error {
+func (cmd *buildCmd) Build(contextDir string) (err error) {
 	log.Infof("Starting Makisu build (version=%s)", utils.BuildHash)
+	started := time.Now()
+	span := tracing.StartRoot("build")
+	span.SetAttribute("makisu.tag", cmd.tag)
+	span.SetAttribute("makisu.version", utils.BuildHash)
+	defer func() { span.End(err) }()
+
+	// Without build context, the build uses an empty dir in the tmp dir as
+	// context, and fails if the dockerfile copies files from it.
+	cmd.noContext = contextDir == ""
+	if cmd.noContext {
+		contextDir = filepath.Join(cmd.tmpDir, "empty-context")
+	}
 
 	// Create BuildContext.
-	contextDirAbs, err := filepath.Abs(contextDir)
+	expandedContextDir, err := utils.ExpandEnvStrict(contextDir)
 	if err != nil {
-		return fmt.Errorf("failed to resolve context dir: %s", err)
+		return fmt.Errorf("failed to expand build context %s: %w", contextDir, err)
+	}
+	contextDirAbs, err := filepath.Abs(expandedContextDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve context dir: %w", err)
 	}
 	if contextDirAbs == "/" {
 		return fmt.Errorf("the absolute path for context directory %s is /. Cannot use root as context", contextDir)
 	}
-	imageStore, err := storage.NewImageStore(cmd.storageDir)
+	// Nothing is written to the context, so that it can be mounted read-only.
+	for _, dir := range []string{cmd.storageDir, cmd.tmpDir} {
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve absolute path of %s: %w", dir, err)
+		}
+		if pathutils.IsDescendantOfAny(dirAbs, []string{contextDirAbs}) {
+			return fmt.Errorf("storage and tmp dirs cannot be under the build context %s: %s", contextDir, dir)
+		}
+	}
+	if cmd.checkPrivs {
+		if err := cmd.checkPrivileges(); err != nil {
+			return err
+		}
+	}
+	imageStore, err := storage.NewImageStoreWithTmpDir(cmd.storageDir, cmd.tmpDir)
 	if err != nil {
-		return fmt.Errorf("failed to init image store: %s", err)
+		return fmt.Errorf("failed to init image store: %w", err)
 	}
-	buildContext, err := context.NewBuildContext("/", contextDirAbs, imageStore)
+	if cmd.noContext {
+		if err := os.MkdirAll(contextDirAbs, 0755); err != nil {
+			return fmt.Errorf("failed to create empty build context: %w", err)
+		}
+	}
+	buildContext, err := context.NewBuildContext("/", contextDirAbs, imageStore, cmd.buildOptions)
 	if err != nil {
-		return fmt.Errorf("failed to create initial build context: %s", err)
+		return fmt.Errorf("failed to create initial build context: %w", err)
+	}
+	buildContext.Deadline = cmd.deadline
+	if err := cmd.checkFreeDisk(); err != nil {
+		return fmt.Errorf("not enough free disk space: %w", err)
 	}
-	defer buildContext.Cleanup()
+
+	// If --keep-on-failure is set and a step fails, the filesystem of the
+	// build is left as is for debugging.
+	// Cleanup failures fail the build if --assert-cleanup is set, as the state
+	// would leak into the next builds of a reused builder.
+	var stepFailed bool
+	cleanup := func(f func() error) {
+		if stepFailed {
+			return
+		}
+		if cleanupErr := f(); cleanupErr == nil {
+			return
+		} else if cmd.assertCleanup && err == nil {
+			err = fmt.Errorf("failed to clean up: %s", cleanupErr)
+		} else {
+			log.Errorf("Failed to clean up: %s", cleanupErr)
+		}
+	}
+	defer cleanup(buildContext.Cleanup)
 
 	// Make sure sandbox is cleaned after build.
 	// Optionally remove everything before and after build.
-	defer storage.CleanupSandbox(cmd.storageDir)
+	defer cleanup(imageStore.CleanupSandbox)
+	var savedRootDir string
 	if cmd.allowModifyFS {
 		if cmd.preserveRoot {
 			rootPreserver, err := storage.NewRootPreserver("/", cmd.storageDir, pathutils.DefaultBlacklist)
 			if err != nil {
-				return fmt.Errorf("failed to preserve root: %s", err)
+				return fmt.Errorf("failed to preserve root: %w", err)
 			}
-			defer rootPreserver.RestoreRoot()
+			savedRootDir = rootPreserver.SavedRootDir
+			defer cleanup(rootPreserver.RestoreRoot)
 		}
 		log.Debugf("build.Cmd.Build() first call")
 		buildContext.MemFS.Remove()
-		defer buildContext.MemFS.Remove()
+		defer cleanup(buildContext.MemFS.Remove)
+	}
+
+	// Resolve the placeholders of templated tags.
+	if err := cmd.expandTags(contextDirAbs); err != nil {
+		return fmt.Errorf("failed to expand tags: %w", err)
 	}
 
 	// Create and execute build plan.
 	imageName, err := cmd.getTargetImageName()
 	if err != nil {
-		return fmt.Errorf("failed to get target image name: %s", err)
+		return fmt.Errorf("failed to get target image name: %w", err)
 	}
 	var parsedReplicas []image.Name
 	for _, replica := range cmd.replicas {
 		parsedReplicas = append(parsedReplicas, image.MustParseName(replica))
 	}
-	buildPlan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
+	var targets []image.Name
+	for _, registry := range cmd.pushRegistries {
+		targets = append(targets, imageName.WithRegistry(registry))
+	}
+	for _, replica := range cmd.replicas {
+		targets = append(targets, image.MustParseName(replica))
+	}
+	// Fail before building instead of when pushing the result.
+	for _, target := range targets {
+		if err := cmd.buildOptions.Registry.CheckRegistryAllowed(target.GetRegistry()); err != nil {
+			return fmt.Errorf("push target %s: %w", target, err)
+		}
+	}
+
+	// execute builds the image for the current target platform.
+	var buildPlan *builder.BuildPlan
+	execute := func(buildContext *context.BuildContext) (*image.DistributionManifest, error) {
+		plan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create build plan: %w", err)
+		}
+		buildPlan = plan
+		manifest, err := plan.Execute()
+		if err != nil {
+			if cmd.keepOnFailure {
+				stepFailed = true
+				log.Infof("Keeping filesystem of failed build at %s, and its sandbox at %s",
+					buildContext.RootDir, imageStore.SandboxDir)
+				if savedRootDir != "" {
+					log.Infof("Original root is saved at %s", savedRootDir)
+				}
+			}
+			return nil, fmt.Errorf("failed to execute build plan: %w", err)
+		}
+		log.Infof("Successfully built image %s", imageName.ShortName())
+
+		if err := cmd.checkImageSize(manifest); err != nil {
+			return nil, fmt.Errorf("image too large: %w", err)
+		}
+		return manifest, nil
+	}
+
+	if len(cmd.platforms) > 1 {
+		if err := cmd.buildIndex(buildContext, targets, execute); err != nil {
+			return err
+		}
+		log.Infof("Finished building %s", imageName.ShortName())
+		return nil
+	}
+
+	manifest, err := execute(buildContext)
 	if err != nil {
-		return fmt.Errorf("failed to create build plan: %s", err)
+		return err
 	}
-	if _, err = buildPlan.Execute(); err != nil {
-		return fmt.Errorf("failed to execute build plan: %s", err)
+	digests, err := cmd.getManifestDigests(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to compute manifest digest: %w", err)
 	}
-	log.Infof("Successfully built image %s", imageName.ShortName())
 
-	// Push image to registries that were specified in the --push flag.
-	for _, registry := range cmd.pushRegistries {
-		target := imageName.WithRegistry(registry)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+	// Optionally generate the provenance of the image, before pushing it so
+	// that a failure doesn't leave images without provenance in registries.
+	var statement *provenance.Statement
+	if cmd.provenanceFile != "" || cmd.pushProvenance {
+		statement, err = cmd.newProvenance(buildPlan, contextDirAbs, started, imageName, targets, digests)
+		if err != nil {
+			return fmt.Errorf("failed to generate provenance: %w", err)
 		}
 	}
-	for _, replica := range cmd.replicas {
-		target := image.MustParseName(replica)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+
+	// Push image to registries that were specified in the --push and
+	// --replica flags.
+	if err := buildContext.Err(); err != nil {
+		return err
+	}
+	pushed := make(map[string]image.Digest)
+	for _, target := range targets {
+		references, err := cmd.pushImage(buildContext, target, digests)
+		if err != nil {
+			return fmt.Errorf("failed to push image: %w", err)
+		}
+		for reference, digest := range references {
+			pushed[reference] = digest
+		}
+		if cmd.pushProvenance {
+			if err := cmd.pushImageProvenance(buildContext, target, manifest, statement); err != nil {
+				return fmt.Errorf("failed to push provenance: %w", err)
+			}
+		}
+	}
+	if cmd.provenanceFile != "" {
+		if err := cmd.writeProvenance(statement); err != nil {
+			return fmt.Errorf("failed to write provenance: %w", err)
+		}
+	}
+
+	// Optionally write the SBOM of the image.
+	if cmd.sbomOutput != "" {
+		if err := cmd.writeSBOM(buildContext, imageName, manifest, digests); err != nil {
+			return fmt.Errorf("failed to write sbom: %w", err)
 		}
 	}
 
@@ -287,6 +1123,13 @@ func (cmd *buildCmd) Build(contextDir string) error {
 		}
 	}
 
+	// Optionally export the filesystem of the image as a tar file.
+	if cmd.rootfsFile != "" {
+		if err := cmd.exportRootFS(buildContext, manifest); err != nil {
+			return fmt.Errorf("failed to export rootfs: %s", err)
+		}
+	}
+
 	// Optionally load image to local docker daemon.
 	if cmd.doLoad {
 		if err := cmd.loadImage(buildContext, imageName); err != nil {
@@ -294,6 +1137,52 @@ func (cmd *buildCmd) Build(contextDir string) error {
 		}
 	}
 
+	// Optionally write the image ID, i.e. the digest of the image config.
+	if cmd.iidFile != "" {
+		if err := ioutil.WriteFile(cmd.iidFile, []byte(manifest.Config.Digest), 0644); err != nil {
+			return fmt.Errorf("failed to write image ID to %s: %s", cmd.iidFile, err)
+		}
+	}
+
+	// Optionally write the digest of the manifest, which the image can be
+	// pulled by.
+	digest := digests.docker
+	if cmd.manifestFormat == "oci" {
+		digest = digests.oci
+	}
+	if cmd.digestFile != "" {
+		if err := ioutil.WriteFile(cmd.digestFile, []byte(digest), 0644); err != nil {
+			return fmt.Errorf("failed to write manifest digest to %s: %s", cmd.digestFile, err)
+		}
+	}
+	if cmd.digestMapFile != "" {
+		if err := cmd.writeDigestMap(pushed); err != nil {
+			return fmt.Errorf("failed to write digest map: %s", err)
+		}
+	}
+	if cmd.ociDigestFile != "" && digests.oci != "" {
+		if err := ioutil.WriteFile(cmd.ociDigestFile, []byte(digests.oci), 0644); err != nil {
+			return fmt.Errorf("failed to write OCI manifest digest to %s: %s", cmd.ociDigestFile, err)
+		}
+	}
+
+	// Optionally report layer sizes, to help keeping images small.
+	if cmd.layerReport != "" {
+		if err := cmd.writeLayerReport(buildContext, manifest); err != nil {
+			return fmt.Errorf("failed to write layer report: %s", err)
+		}
+	}
+
+	// With --quiet, the pushed images and the digest are the only output.
+	if cmd.quiet {
+		if len(targets) == 0 {
+			fmt.Fprintln(cmd.stdout, digest)
+		}
+		for _, target := range targets {
+			fmt.Fprintf(cmd.stdout, "%s@%s\n", target, digest)
+		}
+	}
+
 	log.Infof("Finished building %s", imageName.ShortName())
 	return nil
 }
@@ -0,0 +1,316 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		desc      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"network", &registry.Error{Kind: registry.ErrNetwork, Err: errors.New("connection reset")}, true},
+		{"rate limited", &registry.Error{Kind: registry.ErrRateLimited, Err: errors.New("429")}, true},
+		{"unavailable", &registry.Error{Kind: registry.ErrUnavailable, Err: errors.New("503")}, true},
+		{"wrapped", fmt.Errorf("failed to push image: %w",
+			&registry.Error{Kind: registry.ErrUnavailable, Err: errors.New("502")}), true},
+		{"unauthorized", &registry.Error{Kind: registry.ErrUnauthorized, Err: errors.New("401")}, false},
+		{"not found", &registry.Error{Kind: registry.ErrNotFound, Err: errors.New("404")}, false},
+		{"too large", &registry.Error{Kind: registry.ErrTooLarge, Err: errors.New("too large")}, false},
+		{"dockerfile", errors.New("failed to parse dockerfile"), false},
+		{"timeout", fmt.Errorf("build node: %w", context.ErrBuildTimeout), false},
+		{"message only", errors.New("network error"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.transient, isTransientError(test.err))
+		})
+	}
+}
+
+// buildFixture returns a build func that returns the errors in order, and
+// nil once they were all returned, and the number of calls to it.
+func buildFixture(errs ...error) (func(string) error, *int) {
+	calls := 0
+	return func(string) error {
+		calls++
+		if calls > len(errs) {
+			return nil
+		}
+		return errs[calls-1]
+	}, &calls
+}
+
+func TestBuildWithRetries(t *testing.T) {
+	transient := &registry.Error{Kind: registry.ErrNetwork, Err: errors.New("connection reset")}
+	permanent := errors.New("RUN failed")
+
+	t.Run("success", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture()
+		cmd := &buildCmd{buildRetries: 2}
+		require.NoError(cmd.buildWithRetries("", build))
+		require.Equal(1, *calls)
+	})
+
+	t.Run("transient then success", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture(transient, transient)
+		cmd := &buildCmd{buildRetries: 2}
+		require.NoError(cmd.buildWithRetries("", build))
+		require.Equal(3, *calls)
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture(transient, transient, transient, transient)
+		cmd := &buildCmd{buildRetries: 2}
+		require.Equal(transient, cmd.buildWithRetries("", build))
+		require.Equal(3, *calls)
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture(transient)
+		cmd := &buildCmd{}
+		require.Equal(transient, cmd.buildWithRetries("", build))
+		require.Equal(1, *calls)
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture(transient, permanent)
+		cmd := &buildCmd{buildRetries: 5}
+		require.Equal(permanent, cmd.buildWithRetries("", build))
+		require.Equal(2, *calls)
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		require := require.New(t)
+		build, calls := buildFixture(transient)
+		cmd := &buildCmd{buildRetries: 2, buildTimeout: time.Nanosecond}
+		require.Equal(transient, cmd.buildWithRetries("", build))
+		require.Equal(1, *calls)
+	})
+
+	t.Run("timeout error", func(t *testing.T) {
+		require := require.New(t)
+		build, _ := buildFixture(fmt.Errorf("build node: %w", context.ErrBuildTimeout))
+		cmd := &buildCmd{buildTimeout: time.Minute}
+		err := cmd.buildWithRetries("", build)
+		require.True(errors.Is(err, context.ErrBuildTimeout))
+		require.Contains(err.Error(), "--build-timeout of 1m0s")
+	})
+}
+
+// buildContextFixture returns a build context in dir whose dockerfile copies
+// a file.
+func buildContextFixture(t *testing.T, dir string) string {
+	contextDir := filepath.Join(dir, "context")
+	require.NoError(t, os.MkdirAll(contextDir, 0755))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY file /file\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextDir, "file"), []byte("content"), 0644))
+	return contextDir
+}
+
+// buildCmdFixture returns a build command of test/repo:tag with the given
+// flags, which stores images in dir.
+func buildCmdFixture(t *testing.T, dir string, args ...string) *buildCmd {
+	// The log format is a flag of the root command.
+	cmd := getBuildCmd()
+	getRootCmd().AddCommand(cmd.Command)
+	args = append([]string{"--storage", filepath.Join(dir, "storage"), "-t", "test/repo:tag"}, args...)
+	require.NoError(t, cmd.ParseFlags(args))
+	require.NoError(t, cmd.processFlags())
+	return cmd
+}
+
+// storedManifest returns the manifest of test/repo:tag in the storage dir of
+// the build command fixture.
+func storedManifest(t *testing.T, dir string) *image.DistributionManifest {
+	store, err := storage.NewImageStore(filepath.Join(dir, "storage"))
+	require.NoError(t, err)
+	r, err := store.Manifests.GetStoreFileReader("test/repo", "tag")
+	require.NoError(t, err)
+	defer r.Close()
+	manifest := new(image.DistributionManifest)
+	require.NoError(t, json.NewDecoder(r).Decode(manifest))
+	return manifest
+}
+
+func TestBuildIIDFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "makisu-build-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	iidFile := filepath.Join(dir, "iid")
+	contextDir := buildContextFixture(t, dir)
+	require.NoError(buildCmdFixture(t, dir, "--iidfile", iidFile).Build(contextDir))
+
+	iid, err := ioutil.ReadFile(iidFile)
+	require.NoError(err)
+	require.Equal(string(storedManifest(t, dir).Config.Digest), string(iid))
+	require.Regexp("^sha256:[0-9a-f]{64}$", string(iid))
+}
+
+func TestBuildMaxSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "makisu-build-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The image has a single layer, so the image and the layer have the
+	// same size. The next builds reuse the cached layer.
+	contextDir := buildContextFixture(t, dir)
+	require.NoError(t, buildCmdFixture(t, dir).Build(contextDir))
+	manifest := storedManifest(t, dir)
+	require.Len(t, manifest.Layers, 1)
+	size := manifest.Layers[0].Size
+
+	tests := []struct {
+		desc     string
+		flag     string
+		max      int64
+		expected string
+	}{
+		{"image at max", "--max-image-size", size, ""},
+		{"image over max", "--max-image-size", size - 1, "over the max image size"},
+		{"layer at max", "--max-layer-size", size, ""},
+		{"layer over max", "--max-layer-size", size - 1, "over the max layer size"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			cmd := buildCmdFixture(t, dir, test.flag, fmt.Sprintf("%d", test.max))
+			err := cmd.Build(contextDir)
+			if test.expected == "" {
+				require.NoError(err)
+				return
+			}
+			require.Error(err)
+			require.Contains(err.Error(), "image too large")
+			require.Contains(err.Error(), test.expected)
+		})
+	}
+}
+
+// registryFixture is a registry that has every blob, so that pushes only
+// upload manifests, and that keeps the manifests pushed to it.
+type registryFixture struct {
+	sync.Mutex
+	manifests map[string][]byte
+}
+
+func (f *registryFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "HEAD" && strings.Contains(r.URL.Path, "/blobs/"):
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "PUT" && strings.Contains(r.URL.Path, "/manifests/"):
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.manifests[r.URL.Path] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestBuildQuiet(t *testing.T) {
+	// The quiet logger replaces the global one.
+	defer log.SetLogger(log.GetLogger())
+
+	t.Run("push", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("", "makisu-build-test")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		fixture := &registryFixture{manifests: make(map[string][]byte)}
+		server := httptest.NewServer(fixture)
+		defer server.Close()
+		host := strings.TrimPrefix(server.URL, "http://")
+		defer delete(registry.ConfigurationMap, host)
+
+		contextDir := buildContextFixture(t, dir)
+		cmd := buildCmdFixture(t, dir, "--quiet", "--layer-report", "text", "--push", host,
+			"--registry-config", fmt.Sprintf(`{%q: {".*": {"security": {"plainHTTP": true}}}}`, host))
+		var stdout, stderr bytes.Buffer
+		cmd.stdout, cmd.stderr = &stdout, &stderr
+		require.NoError(cmd.Build(contextDir))
+
+		manifest, ok := fixture.manifests["/v2/test/repo/manifests/tag"]
+		require.True(ok)
+		digest, err := image.NewDigester().FromBytes(manifest)
+		require.NoError(err)
+		require.Equal(fmt.Sprintf("%s/test/repo:tag@%s\n", host, digest), stdout.String())
+		require.True(strings.HasPrefix(stderr.String(), "LAYER "))
+		require.Contains(stderr.String(), string(storedManifest(t, dir).Layers[0].Digest))
+	})
+
+	t.Run("no push", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("", "makisu-build-test")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		digestFile := filepath.Join(dir, "digest")
+		contextDir := buildContextFixture(t, dir)
+		cmd := buildCmdFixture(t, dir, "--quiet", "--layer-report", "json", "--digestfile", digestFile)
+		var stdout, stderr bytes.Buffer
+		cmd.stdout, cmd.stderr = &stdout, &stderr
+		require.NoError(cmd.Build(contextDir))
+
+		digest, err := ioutil.ReadFile(digestFile)
+		require.NoError(err)
+		require.Equal(string(digest)+"\n", stdout.String())
+		require.True(json.Valid(stderr.Bytes()))
+	})
+}
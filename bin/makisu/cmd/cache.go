@@ -0,0 +1,286 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/storage"
+
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// cacheStoreFlags select the cacheID store of the builds, like the flags of
+// makisu build.
+type cacheStoreFlags struct {
+	storageDir        string
+	redisCacheAddress string
+	redisCacheTTL     time.Duration
+	localCacheTTL     time.Duration
+}
+
+func (f *cacheStoreFlags) register(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.storageDir, "storage", "/tmp/makisu-storage", "Storage directory of the builds")
+	cmd.PersistentFlags().StringVar(&f.redisCacheAddress, "redis-cache-addr", "", "The address of the redis server used by the builds for cacheID to layer sha mapping. Local file cache is used if not set")
+	cmd.PersistentFlags().DurationVar(&f.redisCacheTTL, "redis-cache-ttl", time.Hour*168, "Time-To-Live for redis cache")
+	cmd.PersistentFlags().DurationVar(&f.localCacheTTL, "local-cache-ttl", time.Hour*168, "Time-To-Live for local cache")
+}
+
+type cacheExportCmd struct {
+	*cobra.Command
+	cacheStoreFlags
+
+	destination string
+}
+
+type cacheImportCmd struct {
+	*cobra.Command
+	cacheStoreFlags
+}
+
+type cacheGCCmd struct {
+	*cobra.Command
+
+	storageDir        string
+	redisCacheAddress string
+	redisCacheTTL     time.Duration
+	ttl               time.Duration
+	dryRun            bool
+}
+
+func getCacheCmd() *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the build cache",
+	}
+	cacheCmd.AddCommand(getCacheGCCmd().Command)
+	cacheCmd.AddCommand(getCacheExportCmd().Command)
+	cacheCmd.AddCommand(getCacheImportCmd().Command)
+	return cacheCmd
+}
+
+func getCacheGCCmd() *cacheGCCmd {
+	gcCmd := &cacheGCCmd{
+		Command: &cobra.Command{
+			Use:   "gc",
+			Short: "Remove expired cache entries and the layers no longer referenced from the storage directory",
+			Long: "Remove the cache entries older than --ttl, then the layers of the storage " +
+				"directory that are referenced neither by the remaining cache entries nor by " +
+				"the images in the storage directory. It must not run while builds use the " +
+				"same storage directory.",
+		},
+	}
+	gcCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := gcCmd.GC(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	gcCmd.PersistentFlags().StringVar(&gcCmd.storageDir, "storage", "/tmp/makisu-storage", "Storage directory of the builds to collect garbage from")
+	gcCmd.PersistentFlags().StringVar(&gcCmd.redisCacheAddress, "redis-cache-addr", "", "The address of the redis server used by the builds for cacheID to layer sha mapping. Local file cache is used if not set")
+	gcCmd.PersistentFlags().DurationVar(&gcCmd.redisCacheTTL, "redis-cache-ttl", time.Hour*168, "Time-To-Live for redis cache used by the builds, needed to know when entries were written")
+	gcCmd.PersistentFlags().DurationVar(&gcCmd.ttl, "ttl", time.Hour*168, "Remove cache entries written longer ago than this. Set to 0 to only remove unreferenced layers")
+	gcCmd.PersistentFlags().BoolVar(&gcCmd.dryRun, "dry-run", false, "Only print what would be removed")
+	return gcCmd
+}
+
+func getCacheExportCmd() *cacheExportCmd {
+	exportCmd := &cacheExportCmd{
+		Command: &cobra.Command{
+			Use:   "export --dest <tar>",
+			Short: "Write the cache entries and their layers to a tar",
+			Long: "Write the cache entries and the layers of the storage directory they " +
+				"reference to a tar, which makisu cache import adds to the cache of another " +
+				"environment. Entries whose layers are not in the storage directory are skipped.",
+		},
+	}
+	exportCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := exportCmd.Export(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	exportCmd.cacheStoreFlags.register(exportCmd.Command)
+	exportCmd.PersistentFlags().StringVar(&exportCmd.destination, "dest", "", "Destination of the tar (required)")
+	return exportCmd
+}
+
+// Export writes the cache entries and their layers to the destination.
+func (cmd *cacheExportCmd) Export() (err error) {
+	if cmd.destination == "" {
+		return errors.New("--dest is required")
+	}
+	imageStore, kvStore, err := cmd.open()
+	if err != nil {
+		return err
+	}
+	defer imageStore.CleanupSandbox()
+
+	f, err := os.Create(cmd.destination)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", cmd.destination, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("close %s: %s", cmd.destination, closeErr)
+		}
+	}()
+	result, err := cache.Export(imageStore, kvStore, f)
+	if err != nil {
+		return fmt.Errorf("export cache: %s", err)
+	}
+	log.Infof("Exported %d cache entries and %d layers (%s) to %s", len(result.Entries),
+		len(result.Layers), units.HumanSize(float64(result.Bytes)), cmd.destination)
+	return nil
+}
+
+func getCacheImportCmd() *cacheImportCmd {
+	importCmd := &cacheImportCmd{
+		Command: &cobra.Command{
+			Use:   "import <tar>",
+			Short: "Add the cache entries and layers of a tar written by makisu cache export",
+			Long: "Add the layers of a tar written by makisu cache export to the storage " +
+				"directory, and its entries to the cache. The digests of the layers are " +
+				"verified before any entry is added.",
+		},
+	}
+	importCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires a tar as argument")
+		}
+		return nil
+	}
+	importCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := importCmd.Import(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	importCmd.cacheStoreFlags.register(importCmd.Command)
+	return importCmd
+}
+
+// Import adds the cache entries and layers of the tar to the cache.
+func (cmd *cacheImportCmd) Import(path string) error {
+	imageStore, kvStore, err := cmd.open()
+	if err != nil {
+		return err
+	}
+	defer imageStore.CleanupSandbox()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result, err := cache.Import(imageStore, kvStore, f)
+	if err != nil {
+		return fmt.Errorf("import cache: %s", err)
+	}
+	log.Infof("Imported %d cache entries and %d layers (%s) from %s", len(result.Entries),
+		len(result.Layers), units.HumanSize(float64(result.Bytes)), path)
+	return nil
+}
+
+// open returns the image store of the storage dir and the cacheID store.
+func (f *cacheStoreFlags) open() (*storage.ImageStore, keyvalue.Store, error) {
+	imageStore, err := storage.NewImageStore(f.storageDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("init image store: %s", err)
+	}
+	kvStore, err := newCacheKVStore(
+		imageStore, f.redisCacheAddress, f.redisCacheTTL, f.localCacheTTL)
+	if err != nil {
+		imageStore.CleanupSandbox()
+		return nil, nil, err
+	}
+	return imageStore, kvStore, nil
+}
+
+// newCacheKVStore returns the redis store at redisAddr if it is set, and the
+// local file store of the storage dir otherwise.
+func newCacheKVStore(
+	imageStore *storage.ImageStore, redisAddr string,
+	redisTTL, localTTL time.Duration) (keyvalue.Store, error) {
+
+	if redisAddr != "" {
+		log.Infof("Using redis at %s for cacheID storage", redisAddr)
+		kvStore, err := keyvalue.NewRedisStore(redisAddr, redisTTL)
+		if err != nil {
+			return nil, fmt.Errorf("connect to redis store: %s", err)
+		}
+		return kvStore, nil
+	}
+	fullpath := path.Join(imageStore.RootDir, pathutils.CacheKeyValueFileName)
+	log.Infof("Using local file at %s for cacheID storage", fullpath)
+	kvStore, err := keyvalue.NewFSStore(fullpath, imageStore.SandboxDir, localTTL)
+	if err != nil {
+		return nil, fmt.Errorf("init local cache ID store: %s", err)
+	}
+	return kvStore, nil
+}
+
+// GC removes expired cache entries and unreferenced layers.
+func (cmd *cacheGCCmd) GC() error {
+	imageStore, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("init image store: %s", err)
+	}
+	defer imageStore.CleanupSandbox()
+
+	kvStore, err := newCacheKVStore(imageStore, cmd.redisCacheAddress, cmd.redisCacheTTL, cmd.ttl)
+	if err != nil {
+		return err
+	}
+
+	// The layers committed by builds but not pushed are kept as long as the
+	// cache entries.
+	committedPath := path.Join(imageStore.RootDir, pathutils.CommittedLayersFileName)
+	committedStore, err := keyvalue.NewFSStore(committedPath, imageStore.SandboxDir, cmd.ttl)
+	if err != nil {
+		return fmt.Errorf("init local committed layers store: %s", err)
+	}
+
+	result, err := cache.GC(imageStore, []keyvalue.Store{kvStore, committedStore}, cmd.ttl, cmd.dryRun)
+	if err != nil {
+		return fmt.Errorf("collect garbage: %s", err)
+	}
+
+	action := "Removed"
+	if cmd.dryRun {
+		action = "Would remove"
+	}
+	for _, entry := range result.Entries {
+		log.Infof("%s cache entry %s", action, entry)
+	}
+	for _, layer := range result.Layers {
+		log.Infof("%s layer %s", action, layer)
+	}
+	log.Infof("%s %d cache entries and %d layers, reclaiming %s",
+		action, len(result.Entries), len(result.Layers), units.HumanSize(float64(result.Bytes)))
+	return nil
+}
@@ -58,6 +58,18 @@ func (cmd *rootCmd) getLogger() (*zap.Logger, error) {
 	return config.Build()
 }
 
+// getQuietLogger returns a logger that only logs errors, to stderr, so that
+// stdout only contains the output of the command.
+func getQuietLogger(format string) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(zap.ErrorLevel)
+	config.OutputPaths = []string{"stderr"}
+	config.Encoding = format
+	config.DisableStacktrace = true
+	config.DisableCaller = true
+	return config.Build()
+}
+
 func setupProfiler() error {
 	f, err := os.Create("/tmp/makisu.prof")
 	if err != nil {
@@ -0,0 +1,324 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+type inspectCmd struct {
+	*cobra.Command
+
+	storageDir     string
+	registryConfig string
+	dockerConfig   string
+	format         string
+}
+
+// inspectLayer describes a layer of an inspected image. Layers of docker tars
+// have the ID of their directory in the tar instead of a digest.
+type inspectLayer struct {
+	Digest    image.Digest `json:"digest,omitempty"`
+	ID        string       `json:"id,omitempty"`
+	DiffID    image.Digest `json:"diff_id,omitempty"`
+	MediaType string       `json:"media_type,omitempty"`
+	Size      int64        `json:"size"`
+}
+
+// inspectResult is what makisu inspect prints. Manifest is the distribution
+// manifest of images pulled from registries or read from OCI layouts, as they
+// serve it, and the manifest.json entry of docker tars.
+type inspectResult struct {
+	Manifest json.RawMessage `json:"manifest"`
+	Config   json.RawMessage `json:"config"`
+	Layers   []inspectLayer  `json:"layers"`
+}
+
+func getInspectCmd() *inspectCmd {
+	inspectCmd := &inspectCmd{
+		Command: &cobra.Command{
+			Use:                   "inspect [flags] <image|tar|oci layout>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Print the manifest, config and layers of an image",
+			Long: "Print the manifest, config and layers of an image. The argument is read as " +
+				"a docker tar, like the ones written by --dest, if it is a file, as an OCI " +
+				"image layout if it is a directory, in which case the first manifest of its " +
+				"index is inspected, and otherwise as an image name to pull from its registry.",
+		},
+	}
+	inspectCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires an image, a tar or an OCI layout as argument")
+		}
+		return nil
+	}
+	inspectCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := inspectCmd.Inspect(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for the manifests and configs pulled from registries")
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.registryConfig, "registry-config", "", "Registry configuration, like the one of makisu build")
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.dockerConfig, "docker-config", "", "Docker config.json to read credentials from for registries without security config")
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.format, "format", "text", "Output format, could be 'text' or 'json'")
+	return inspectCmd
+}
+
+// Inspect prints the manifest, config and layers of the image.
+func (cmd *inspectCmd) Inspect(ref string) error {
+	if cmd.format != "text" && cmd.format != "json" {
+		return fmt.Errorf("invalid format: %s", cmd.format)
+	}
+
+	var result *inspectResult
+	fi, err := os.Stat(ref)
+	if err == nil && fi.IsDir() {
+		result, err = inspectOCILayout(ref)
+	} else if err == nil {
+		result, err = inspectDockerTar(ref)
+	} else if os.IsNotExist(err) {
+		result, err = cmd.inspectRemote(ref)
+	}
+	if err != nil {
+		return fmt.Errorf("inspect %s: %s", ref, err)
+	}
+
+	if cmd.format == "json" {
+		return result.WriteJSON(os.Stdout)
+	}
+	return result.WriteText(os.Stdout)
+}
+
+// inspectRemote pulls the manifest and config of the image from its registry.
+func (cmd *inspectCmd) inspectRemote(ref string) (*inspectResult, error) {
+	if cmd.registryConfig != "" {
+		if err := registry.UpdateGlobalConfig(os.ExpandEnv(cmd.registryConfig)); err != nil {
+			return nil, fmt.Errorf("init registry config: %s", err)
+		}
+	}
+	if err := registry.UpdateGlobalConfigFromEnv(); err != nil {
+		return nil, fmt.Errorf("init registry config from env: %s", err)
+	}
+	security.DockerConfigFile = cmd.dockerConfig
+
+	name, err := image.ParseNameForPull(ref)
+	if err != nil || !name.IsValid() {
+		return nil, fmt.Errorf("invalid image name: %s", ref)
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return nil, fmt.Errorf("init image store: %s", err)
+	}
+	client := registry.New(store, name.GetRegistry(), name.GetRepository())
+	manifest, manifestJSON, err := client.PullRawManifest(name.GetTag())
+	if err != nil {
+		return nil, fmt.Errorf("pull manifest: %s", err)
+	}
+	if _, err := client.PullImageConfig(manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("pull image config: %s", err)
+	}
+	reader, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %s", err)
+	}
+	defer reader.Close()
+	config, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read image config: %s", err)
+	}
+	return newInspectResult(manifestJSON, config, descriptorLayers(manifest.Layers))
+}
+
+// inspectOCILayout reads the first image of the index of an OCI image layout.
+func inspectOCILayout(dir string) (*inspectResult, error) {
+	readBlob := func(digest image.Digest) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(dir, "blobs", digest.Algorithm(), digest.Hex()))
+	}
+
+	indexJSON, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read index: %s", err)
+	}
+	var index struct {
+		Manifests []image.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return nil, fmt.Errorf("unmarshal index: %s", err)
+	} else if len(index.Manifests) == 0 {
+		return nil, errors.New("index has no manifest")
+	}
+	descriptor := index.Manifests[0]
+	manifestJSON, err := readBlob(descriptor.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %s", err)
+	}
+	manifest, _, err := image.UnmarshalDistributionManifest(descriptor.MediaType, manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %s", err)
+	}
+	config, err := readBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("read image config: %s", err)
+	}
+	return newInspectResult(manifestJSON, config, descriptorLayers(manifest.Layers))
+}
+
+// inspectDockerTar reads an image tar in the format of docker save.
+func inspectDockerTar(path string) (*inspectResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Tars written by makisu build --dest are gzipped.
+	dr, err := tario.NewDecompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	files := make(map[string][]byte)
+	sizes := make(map[string]int64)
+	r := tar.NewReader(dr)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read tar: %s", err)
+		}
+		name := filepath.Clean(header.Name)
+		sizes[name] = header.Size
+		if filepath.Ext(name) == ".json" {
+			if files[name], err = ioutil.ReadAll(r); err != nil {
+				return nil, fmt.Errorf("read %s: %s", name, err)
+			}
+		}
+	}
+
+	data, ok := files[image.ExportManifestFileName]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", image.ExportManifestFileName)
+	}
+	var manifests []json.RawMessage
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %s", image.ExportManifestFileName, err)
+	} else if len(manifests) == 0 {
+		return nil, fmt.Errorf("%s has no image", image.ExportManifestFileName)
+	}
+	var manifest image.ExportManifest
+	if err := json.Unmarshal(manifests[0], &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %s", image.ExportManifestFileName, err)
+	}
+	config, ok := files[filepath.Clean(manifest.Config.String())]
+	if !ok {
+		return nil, fmt.Errorf("image config %s not found", manifest.Config)
+	}
+	var layers []inspectLayer
+	for _, layer := range manifest.Layers {
+		layers = append(layers, inspectLayer{
+			ID:   layer.ID(),
+			Size: sizes[filepath.Clean(layer.String())],
+		})
+	}
+	return newInspectResult(manifests[0], config, layers)
+}
+
+// descriptorLayers returns the layers of the descriptors of a manifest.
+func descriptorLayers(descriptors []image.Descriptor) []inspectLayer {
+	var layers []inspectLayer
+	for _, descriptor := range descriptors {
+		layers = append(layers, inspectLayer{
+			Digest:    descriptor.Digest,
+			MediaType: descriptor.MediaType,
+			Size:      descriptor.Size,
+		})
+	}
+	return layers
+}
+
+// newInspectResult returns the result of the image, matching its layers with
+// the diff IDs of its config.
+func newInspectResult(manifest, config []byte, layers []inspectLayer) (*inspectResult, error) {
+	var imageConfig image.Config
+	if err := json.Unmarshal(config, &imageConfig); err != nil {
+		return nil, fmt.Errorf("unmarshal image config: %s", err)
+	}
+	result := &inspectResult{Manifest: manifest, Config: config, Layers: layers}
+	for i := range result.Layers {
+		if i < len(imageConfig.RootFS.DiffIDs) {
+			result.Layers[i].DiffID = imageConfig.RootFS.DiffIDs[i]
+		}
+	}
+	return result, nil
+}
+
+// WriteText writes the manifest as it was read, so that its digest can be
+// checked, and the config as indented JSON, followed by a table of the layers.
+func (r *inspectResult) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "MANIFEST\n%s\n\n", bytes.TrimSpace(r.Manifest))
+	indented, err := json.MarshalIndent(r.Config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("indent config: %s", err)
+	}
+	fmt.Fprintf(w, "CONFIG\n%s\n\n", indented)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	column := "DIGEST"
+	if len(r.Layers) > 0 && r.Layers[0].Digest == "" {
+		column = "ID"
+	}
+	fmt.Fprintf(tw, "LAYER\t%s\tSIZE\tDIFF ID\n", column)
+	var total int64
+	for i, layer := range r.Layers {
+		id := string(layer.Digest)
+		if id == "" {
+			id = layer.ID
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i, id,
+			units.BytesSize(float64(layer.Size)), layer.DiffID)
+		total += layer.Size
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%s\t\n", units.BytesSize(float64(total)))
+	return tw.Flush()
+}
+
+// WriteJSON writes the result as JSON.
+func (r *inspectResult) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
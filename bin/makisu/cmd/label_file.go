@@ -0,0 +1,113 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readLabelFiles reads the --label-file flags in order, the labels of a file
+// replacing the ones of the same keys from the files before it.
+func (cmd *buildCmd) readLabelFiles() (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, p := range cmd.labelFiles {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open label file: %s", err)
+		}
+		err = parseLabelFile(f, labels)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label file %s: %s", p, err)
+		}
+	}
+	return labels, nil
+}
+
+// parseLabelFile adds the KEY=VALUE pairs of the file to labels. Blank lines
+// and lines starting with # are ignored, and so is an "export " prefix.
+// Values can be followed by a # comment, which must be preceded by a space or
+// a tab for unquoted values, e.g. "KEY=a#b" is "a#b" but "KEY=a #b" is "a".
+// Unquoted values are trimmed and kept as is otherwise. Values in single
+// quotes are kept literally, and values in double quotes support the \", \\,
+// \n and \t escapes.
+func parseLabelFile(r io.Reader, labels map[string]string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("line %d: expected KEY=VALUE", lineno)
+		}
+		value, err := parseLabelValue(parts[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineno, err)
+		}
+		labels[key] = value
+	}
+	return scanner.Err()
+}
+
+// parseLabelValue unquotes the value of a line of a label file, and removes
+// the comment following it.
+func parseLabelValue(s string) (string, error) {
+	if trimmed := strings.TrimSpace(s); trimmed == "" || (trimmed[0] != '"' && trimmed[0] != '\'') {
+		for i := 1; i < len(s); i++ {
+			if s[i] == '#' && (s[i-1] == ' ' || s[i-1] == '\t') {
+				s = s[:i]
+				break
+			}
+		}
+		return strings.TrimSpace(s), nil
+	}
+	s = strings.TrimSpace(s)
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after quoted value", rest)
+			}
+			return b.String(), nil
+		case c == '\\' && quote == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				return "", fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
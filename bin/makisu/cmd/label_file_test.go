@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabelFile(t *testing.T) {
+	tests := []struct {
+		desc     string
+		content  string
+		expected map[string]string
+	}{
+		{"unquoted", "KEY=value", map[string]string{"KEY": "value"}},
+		{"trimmed", "  KEY =  some value  \t", map[string]string{"KEY": "some value"}},
+		{"empty", "KEY=", map[string]string{"KEY": ""}},
+		{"equal sign in value", "KEY=a=b", map[string]string{"KEY": "a=b"}},
+		{"export", "export KEY=value", map[string]string{"KEY": "value"}},
+		{"blank lines and comments", "\n# comment\n  # indented\nA=1\n\nB=2\n",
+			map[string]string{"A": "1", "B": "2"}},
+		{"unquoted comment", "KEY=value # note", map[string]string{"KEY": "value"}},
+		{"unquoted comment after tab", "KEY=value\t# note", map[string]string{"KEY": "value"}},
+		{"unquoted hash", "KEY=http://example.com/#top", map[string]string{"KEY": "http://example.com/#top"}},
+		{"leading hash", "KEY=#1", map[string]string{"KEY": "#1"}},
+		{"only comment", "KEY= # note", map[string]string{"KEY": ""}},
+		{"double quotes", `KEY="some value"`, map[string]string{"KEY": "some value"}},
+		{"double quotes keep spaces", `KEY=" padded "`, map[string]string{"KEY": " padded "}},
+		{"escapes", `KEY="a \"b\" c\\d\ne\tf"`, map[string]string{"KEY": "a \"b\" c\\d\ne\tf"}},
+		{"double quoted hash", `KEY="a # b"`, map[string]string{"KEY": "a # b"}},
+		{"double quoted comment", `KEY="value" # note`, map[string]string{"KEY": "value"}},
+		{"single quotes", `KEY='a \n "b"'`, map[string]string{"KEY": `a \n "b"`}},
+		{"single quoted comment", `KEY='value'   # note`, map[string]string{"KEY": "value"}},
+		{"empty quotes", `KEY=""`, map[string]string{"KEY": ""}},
+		{"later lines replace", "KEY=1\nKEY=2", map[string]string{"KEY": "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			labels := make(map[string]string)
+			require.NoError(parseLabelFile(strings.NewReader(test.content), labels))
+			require.Equal(test.expected, labels)
+		})
+	}
+}
+
+func TestParseLabelFileErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		content  string
+		expected string
+	}{
+		{"no equal sign", "A=1\nKEY", "line 2: expected KEY=VALUE"},
+		{"empty key", "=value", "line 1: expected KEY=VALUE"},
+		{"space in key", "MY KEY=value", "line 1: expected KEY=VALUE"},
+		{"unterminated double quotes", `KEY="value`, "line 1: unterminated quoted value"},
+		{"unterminated single quotes", `KEY='value`, "line 1: unterminated quoted value"},
+		{"trailing backslash", `KEY="value\`, "line 1: unterminated quoted value"},
+		{"invalid escape", `KEY="\x41"`, `line 1: invalid escape \x`},
+		{"text after quotes", `KEY="a" b`, `line 1: unexpected "b" after quoted value`},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			err := parseLabelFile(strings.NewReader(test.content), make(map[string]string))
+			require.EqualError(err, test.expected)
+		})
+	}
+}
+
+func TestReadLabelFiles(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "makisu-label-file")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	require.NoError(ioutil.WriteFile(first, []byte("A=1\nB=1\n"), 0644))
+	require.NoError(ioutil.WriteFile(second, []byte("B=2\n"), 0644))
+
+	cmd := &buildCmd{labelFiles: []string{first, second}}
+	labels, err := cmd.readLabelFiles()
+	require.NoError(err)
+	require.Equal(map[string]string{"A": "1", "B": "2"}, labels)
+
+	cmd.labelFiles = []string{filepath.Join(dir, "missing")}
+	_, err = cmd.readLabelFiles()
+	require.Error(err)
+}
@@ -0,0 +1,272 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+)
+
+// parsePlatforms parses the comma separated list of --platform. The host
+// platform is returned if the list is empty.
+func parsePlatforms(list string) ([]image.Platform, error) {
+	if list == "" {
+		return []image.Platform{image.DefaultPlatform()}, nil
+	}
+	var platforms []image.Platform
+	seen := make(map[image.Platform]bool)
+	for _, s := range strings.Split(list, ",") {
+		platform, err := image.ParsePlatform(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		} else if seen[platform] {
+			return nil, fmt.Errorf("platform %s is listed more than once", platform)
+		}
+		seen[platform] = true
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// setPlatform makes the platform the target of the build.
+func (cmd *buildCmd) setPlatform(platform image.Platform) {
+	cmd.buildOptions.TargetPlatform = platform
+	cmd.buildOptions.Registry.ManifestListPlatform = platform
+}
+
+// getVariant returns the architecture variant of the image built for the
+// platform, which is the one of the platform unless --variant is set. It is
+// empty if the variant of the base image should be kept.
+func (cmd *buildCmd) getVariant(platform image.Platform) string {
+	if cmd.variant != "" {
+		return cmd.variant
+	}
+	return platform.Variant
+}
+
+// checkMultiPlatformFlags returns an error if flags that don't support building
+// several platforms are set. The image index is only assembled in registries,
+// so the image must be pushed.
+func (cmd *buildCmd) checkMultiPlatformFlags() error {
+	if len(cmd.pushRegistries) == 0 && len(cmd.replicas) == 0 {
+		return errors.New("building multiple platforms requires --push or --replica")
+	} else if cmd.manifestFormat == "both" {
+		return errors.New("building multiple platforms requires --manifest-format 'docker' or 'oci'")
+	}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"dest", cmd.destination != ""},
+		{"export-rootfs", cmd.rootfsFile != ""},
+		{"load", cmd.doLoad},
+		{"iidfile", cmd.iidFile != ""},
+		{"oci-digestfile", cmd.ociDigestFile != ""},
+		{"provenance-file", cmd.provenanceFile != ""},
+		{"push-provenance", cmd.pushProvenance},
+		{"sbom-output", cmd.sbomOutput != ""},
+		{"layer-report", cmd.layerReport != ""},
+	} {
+		if flag.set {
+			return fmt.Errorf("--%s can't be used when building multiple platforms", flag.name)
+		}
+	}
+	return nil
+}
+
+// buildIndex builds the image for each platform of --platform in turn, pushes
+// their manifests by digest to the targets, and then pushes the manifest list,
+// or OCI index with --manifest-format 'oci', referencing them under the tag.
+// execute builds the image of the current target platform with the given
+// build context, which is reset between platforms.
+func (cmd *buildCmd) buildIndex(
+	buildContext *context.BuildContext, targets []image.Name,
+	execute func(*context.BuildContext) (*image.DistributionManifest, error)) error {
+
+	mediaType := image.MediaTypeManifestList
+	if cmd.manifestFormat == "oci" {
+		mediaType = image.MediaTypeOCIIndex
+	}
+	index := image.NewManifestList(mediaType)
+
+	// Check that all the platforms can be emulated first, instead of failing
+	// after the first ones were built.
+	stages, _, err := cmd.getDockerfile(buildContext.ContextDir)
+	if err != nil {
+		return fmt.Errorf("failed to get dockerfile: %s", err)
+	}
+	if hasRunSteps(stages) {
+		for _, platform := range cmd.platforms {
+			if err := step.CheckEmulation(platform); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, platform := range cmd.platforms {
+		log.Infof("Building platform %s (%d/%d)", platform, i+1, len(cmd.platforms))
+		cmd.setPlatform(platform)
+		if i > 0 {
+			if buildContext, err = cmd.resetBuildContext(buildContext); err != nil {
+				return fmt.Errorf("failed to reset build context: %w", err)
+			}
+		}
+		manifest, err := execute(buildContext)
+		if err != nil {
+			return fmt.Errorf("failed to build platform %s: %w", platform, err)
+		}
+		descriptor, err := cmd.pushPlatformImage(buildContext, targets, manifest)
+		if err != nil {
+			return fmt.Errorf("failed to push platform %s: %w", platform, err)
+		}
+		log.Infof("Manifest digest of platform %s is %s", platform, descriptor.Digest)
+		platform.Variant = cmd.getVariant(platform)
+		index.Add(descriptor, platform)
+	}
+
+	digest, err := buildContext.Options.Registry.ManifestListDigest(index)
+	if err != nil {
+		return fmt.Errorf("failed to compute image index digest: %w", err)
+	}
+	log.Infof("Image index digest is %s", digest)
+	pushed := make(map[string]image.Digest)
+	for _, target := range targets {
+		reference, pushedDigest, err := cmd.pushIndex(buildContext, target, index, digest)
+		if err != nil {
+			return fmt.Errorf("failed to push image index: %w", err)
+		}
+		pushed[pushedName(target, reference)] = pushedDigest
+	}
+
+	if cmd.digestFile != "" {
+		if err := ioutil.WriteFile(cmd.digestFile, []byte(digest), 0644); err != nil {
+			return fmt.Errorf("failed to write image index digest to %s: %s", cmd.digestFile, err)
+		}
+	}
+	if cmd.digestMapFile != "" {
+		if err := cmd.writeDigestMap(pushed); err != nil {
+			return fmt.Errorf("failed to write digest map: %s", err)
+		}
+	}
+	if cmd.quiet {
+		for _, target := range targets {
+			fmt.Fprintf(cmd.stdout, "%s@%s\n", target, digest)
+		}
+	}
+	return nil
+}
+
+// resetBuildContext removes the files of the build of the previous platform,
+// and returns a new build context for the next one.
+func (cmd *buildCmd) resetBuildContext(ctx *context.BuildContext) (*context.BuildContext, error) {
+	if err := ctx.Cleanup(); err != nil {
+		return nil, err
+	}
+	if cmd.allowModifyFS {
+		if err := ctx.MemFS.Remove(); err != nil {
+			return nil, err
+		}
+	}
+	next, err := context.NewBuildContext(ctx.RootDir, ctx.ContextDir, ctx.ImageStore, ctx.Options)
+	if err != nil {
+		return nil, err
+	}
+	next.Deadline = ctx.Deadline
+	next.Reporter = ctx.Reporter
+	return next, nil
+}
+
+// pushPlatformImage pushes the image of one platform by digest to the targets,
+// and returns the descriptor of its manifest in the format of
+// --manifest-format.
+func (cmd *buildCmd) pushPlatformImage(
+	buildContext *context.BuildContext, targets []image.Name,
+	manifest *image.DistributionManifest) (image.Descriptor, error) {
+
+	pushed := manifest
+	if cmd.manifestFormat == "oci" {
+		oci := buildContext.Options.Registry.OCIManifest(manifest)
+		pushed = &oci
+	}
+	descriptor, err := buildContext.Options.Registry.ManifestDescriptor(pushed)
+	if err != nil {
+		return image.Descriptor{}, err
+	}
+	for _, target := range targets {
+		registryClient := registry.New(
+			buildContext.ImageStore, target.GetRegistry(), target.GetRepository()).
+			WithOptions(buildContext.Options.Registry)
+		if cmd.manifestFormat == "oci" {
+			_, err = registryClient.PushOCI(target.GetTag(), true)
+		} else {
+			_, err = registryClient.PushDigest(target.GetTag())
+		}
+		if err != nil {
+			return image.Descriptor{}, err
+		}
+		if err := cmd.verifyPushed(registryClient, string(descriptor.Digest), descriptor.Digest); err != nil {
+			return image.Descriptor{}, err
+		}
+		cmd.logPushed(target, string(descriptor.Digest))
+	}
+	return descriptor, nil
+}
+
+// pushIndex pushes the image index to the target, under its tag unless
+// --push-digest-only is set. It returns the reference the index was pushed
+// under, and the digest of the pushed index.
+func (cmd *buildCmd) pushIndex(
+	buildContext *context.BuildContext, target image.Name, index *image.ManifestList,
+	digest image.Digest) (string, image.Digest, error) {
+
+	registryClient := registry.New(
+		buildContext.ImageStore, target.GetRegistry(), target.GetRepository()).
+		WithOptions(buildContext.Options.Registry)
+	reference := target.GetTag()
+	if cmd.digestOnly {
+		reference = string(digest)
+	}
+	pushed, err := registryClient.PushManifestList(reference, index)
+	if err != nil {
+		return "", "", err
+	}
+	if err := cmd.verifyPushed(registryClient, reference, digest); err != nil {
+		return "", "", err
+	}
+	cmd.logPushed(target, reference)
+	return reference, pushed, nil
+}
+
+// hasRunSteps returns true if a stage of the dockerfile has a RUN directive,
+// which executes binaries of the target platform.
+func hasRunSteps(stages []*dockerfile.Stage) bool {
+	for _, stage := range stages {
+		for _, directive := range stage.Directives {
+			if _, ok := directive.(*dockerfile.RunDirective); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
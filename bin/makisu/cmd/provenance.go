@@ -0,0 +1,124 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/provenance"
+	"github.com/uber/makisu/lib/registry"
+)
+
+// newProvenance returns the SLSA provenance of the built image, whose
+// materials are the resolved base images and the build context, and whose
+// subjects are the image and its push targets.
+func (cmd *buildCmd) newProvenance(
+	plan *builder.BuildPlan, contextDir string, started time.Time,
+	imageName image.Name, targets []image.Name, digests manifestDigests) (*provenance.Statement, error) {
+
+	baseImages, err := plan.BaseImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get base images: %s", err)
+	}
+	var materials []provenance.Material
+	for _, baseImage := range baseImages {
+		materials = append(materials, provenance.BaseImageMaterial(baseImage.Name, baseImage.Digest))
+	}
+	contextMaterial, err := provenance.ContextMaterial(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	materials = append(materials, contextMaterial)
+
+	params := provenance.Parameters{
+		Dockerfile: cmd.dockerfilePath,
+		Platform:   cmd.buildOptions.TargetPlatform.String(),
+		Commit:     cmd.commit,
+	}
+	if params.BuildArgs, err = cmd.getBuildArgs(); err != nil {
+		return nil, err
+	}
+	if params.ArgDefaults, err = cmd.getArgDefaults(); err != nil {
+		return nil, err
+	}
+	if params.GlobalArgs, err = parseKeyValues("global-arg", cmd.globalArgs); err != nil {
+		return nil, err
+	}
+	if params.ExtraEnvs, err = parseKeyValues("extra-env", cmd.extraEnvs); err != nil {
+		return nil, err
+	}
+
+	statement := provenance.New(cmd.provenanceBuilderID, params, materials, started, time.Now())
+	for _, name := range append([]image.Name{imageName}, targets...) {
+		for _, digest := range []image.Digest{digests.docker, digests.oci} {
+			if digest != "" {
+				statement.AddSubject(name, digest)
+			}
+		}
+	}
+	return statement, nil
+}
+
+// writeProvenance writes the provenance to the file of --provenance-file.
+func (cmd *buildCmd) writeProvenance(statement *provenance.Statement) error {
+	content, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal provenance: %s", err)
+	}
+	if err := ioutil.WriteFile(cmd.provenanceFile, content, 0644); err != nil {
+		return fmt.Errorf("failed to write provenance to %s: %s", cmd.provenanceFile, err)
+	}
+	return nil
+}
+
+// pushImageProvenance pushes the provenance as a referrer of each manifest
+// pushed to the registry, in the formats selected by --manifest-format.
+func (cmd *buildCmd) pushImageProvenance(
+	buildContext *context.BuildContext, imageName image.Name,
+	manifest *image.DistributionManifest, statement *provenance.Statement) error {
+
+	content, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("failed to marshal provenance: %s", err)
+	}
+	var subjects []*image.DistributionManifest
+	if cmd.manifestFormat != "oci" {
+		subjects = append(subjects, manifest)
+	}
+	if cmd.manifestFormat != "docker" {
+		oci := buildContext.Options.Registry.OCIManifest(manifest)
+		subjects = append(subjects, &oci)
+	}
+
+	registryClient := registry.New(
+		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository()).
+		WithOptions(buildContext.Options.Registry)
+	for _, subject := range subjects {
+		descriptor, err := buildContext.Options.Registry.ManifestDescriptor(subject)
+		if err != nil {
+			return fmt.Errorf("failed to get manifest descriptor: %s", err)
+		}
+		if _, err := registryClient.PushReferrer(descriptor, provenance.MediaType, content); err != nil {
+			return fmt.Errorf("failed to push provenance of %s: %s", descriptor.Digest, err)
+		}
+	}
+	return nil
+}
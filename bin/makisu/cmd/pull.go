@@ -61,6 +61,9 @@ func (cmd *pullCmd) Pull(repository string) {
 	registry.DefaultDockerHubConfiguration.Security.TLS.CA.Cert.Path = cmd.cacerts
 	registry.ConfigurationMap[image.DockerHubRegistry] = make(registry.RepositoryMap)
 	registry.ConfigurationMap[image.DockerHubRegistry]["library/*"] = registry.DefaultDockerHubConfiguration
+	if err := registry.UpdateGlobalConfigFromEnv(); err != nil {
+		panic(err)
+	}
 
 	client := registry.New(store, cmd.registry, repository)
 	manifest, err := client.Pull(cmd.tag)
@@ -92,7 +95,7 @@ func (cmd *pullCmd) Extract(store *storage.ImageStore, manifest *image.Distribut
 		panic(fmt.Errorf("failed to create destination rootfs directory: %s", err))
 	}
 
-	memfs, err := snapshot.NewMemFS(clock.New(), cmd.extract, nil)
+	memfs, err := snapshot.NewMemFS(clock.New(), cmd.extract, nil, snapshot.DefaultOptions())
 	if err != nil {
 		panic(err)
 	}
@@ -102,9 +105,9 @@ func (cmd *pullCmd) Extract(store *storage.ImageStore, manifest *image.Distribut
 		if err != nil {
 			panic(fmt.Errorf("get reader from layer: %s", err))
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		gzipReader, err := tario.NewLayerReader(reader)
 		if err != nil {
-			panic(fmt.Errorf("create gzip reader for layer: %s", err))
+			panic(fmt.Errorf("create layer reader: %s", err))
 		}
 		if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), true); err != nil {
 			panic(fmt.Errorf("untar reader: %s", err))
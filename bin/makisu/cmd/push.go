@@ -0,0 +1,131 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/cli"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type pushCmd struct {
+	*cobra.Command
+
+	storageDir      string
+	registryConfig  string
+	dockerConfig    string
+	digestFile      string
+	canonicalJSON   bool
+	verifyBlobs     bool
+	allowRegistries []string
+	denyRegistries  []string
+}
+
+func getPushCmd() *pushCmd {
+	pushCmd := &pushCmd{
+		Command: &cobra.Command{
+			Use:                   "push [flags] <tar|oci layout> <registry>/<repo>:<tag>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Push an exported image to a registry",
+			Long: "Push an image exported by a previous build to a registry. The first argument " +
+				"is read as a docker tar, like the ones written by --dest, if it is a file, and " +
+				"as an OCI image layout if it is a directory, in which case the first manifest " +
+				"of its index is pushed. Blobs that already exist in the registry are skipped.",
+		},
+	}
+	pushCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("Requires a tar or an OCI layout, and an image name as arguments")
+		}
+		return nil
+	}
+	pushCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := pushCmd.Push(args[0], args[1]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	pushCmd.PersistentFlags().StringVar(&pushCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses to stage the blobs of the image before pushing them")
+	pushCmd.PersistentFlags().StringVar(&pushCmd.registryConfig, "registry-config", "", "Registry configuration, like the one of makisu build")
+	pushCmd.PersistentFlags().StringVar(&pushCmd.dockerConfig, "docker-config", "", "Docker config.json to read credentials from for registries without security config")
+	pushCmd.PersistentFlags().StringVar(&pushCmd.digestFile, "digestfile", "", "Write the digest of the pushed manifest to the file")
+	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.allowRegistries, "allow-registry", nil, "Registry host that may be pushed to, like makisu build")
+	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.denyRegistries, "deny-registry", nil, "Registry host that may not be pushed to, like makisu build")
+	pushCmd.PersistentFlags().BoolVar(&pushCmd.canonicalJSON, "canonical-manifest", false, "Push the manifest serialized as canonical JSON, with sorted keys and no whitespace, instead of indented")
+	pushCmd.PersistentFlags().BoolVar(&pushCmd.verifyBlobs, "verify-blobs", false, "Check that the registry serves back every blob of the image before pushing its manifest, like makisu build")
+	return pushCmd
+}
+
+// Push imports the image at path into the storage dir and pushes it.
+func (cmd *pushCmd) Push(path, ref string) error {
+	if cmd.registryConfig != "" {
+		if err := registry.UpdateGlobalConfig(os.ExpandEnv(cmd.registryConfig)); err != nil {
+			return fmt.Errorf("init registry config: %s", err)
+		}
+	}
+	if err := registry.UpdateGlobalConfigFromEnv(); err != nil {
+		return fmt.Errorf("init registry config from env: %s", err)
+	}
+	security.DockerConfigFile = cmd.dockerConfig
+	opts := registry.DefaultOptions()
+	opts.CanonicalManifests = cmd.canonicalJSON
+	opts.VerifyPushedBlobs = cmd.verifyBlobs
+	if err := setRegistryPolicy(&opts, cmd.allowRegistries, cmd.denyRegistries); err != nil {
+		return err
+	}
+
+	name, err := image.ParseNameForPull(ref)
+	if err != nil || !name.IsValid() {
+		return fmt.Errorf("invalid image name: %s", ref)
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("init image store: %s", err)
+	}
+
+	log.Infof("Importing image from %s", path)
+	manifest, err := cli.ImportImage(store, path, name)
+	if err != nil {
+		return fmt.Errorf("import %s: %s", path, err)
+	}
+	digest, err := opts.ManifestDigest(manifest)
+	if err != nil {
+		return fmt.Errorf("compute manifest digest: %s", err)
+	}
+
+	client := registry.New(store, name.GetRegistry(), name.GetRepository()).WithOptions(opts)
+	if err := client.Push(name.GetTag()); err != nil {
+		return fmt.Errorf("push %s: %s", name, err)
+	}
+	log.Infof("Successfully pushed %s to %s with digest %s", name, name.GetRegistry(), digest)
+
+	if cmd.digestFile != "" {
+		if err := ioutil.WriteFile(cmd.digestFile, []byte(digest), 0644); err != nil {
+			return fmt.Errorf("write manifest digest to %s: %s", cmd.digestFile, err)
+		}
+	}
+	return nil
+}
@@ -75,6 +75,9 @@ func Execute() {
 	rootCmd.AddCommand(getBuildCmd().Command)
 	rootCmd.AddCommand(getVersionCmd())
 	rootCmd.AddCommand(getPullCmd().Command)
+	rootCmd.AddCommand(getCacheCmd())
+	rootCmd.AddCommand(getInspectCmd().Command)
+	rootCmd.AddCommand(getPushCmd().Command)
 	if err := rootCmd.Execute(); err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/sbom"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// writeSBOM writes the CycloneDX SBOM of the image, with the packages found in
+// its filesystem, to the file of --sbom-output. The image is referenced by the
+// digest of its docker manifest, or of its OCI one with --manifest-format oci.
+func (cmd *buildCmd) writeSBOM(
+	buildContext *context.BuildContext, imageName image.Name,
+	manifest *image.DistributionManifest, digests manifestDigests) error {
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(builder.ExportRootFS(buildContext.ImageStore, manifest, pw))
+	}()
+	packages, unread, err := sbom.ReadPackages(pr)
+	// Closing the reader stops the export if reading failed.
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read packages: %s", err)
+	}
+
+	digest := digests.docker
+	if digest == "" {
+		digest = digests.oci
+	}
+	bom, err := sbom.New(imageName, digest, packages, unread, time.Now(), utils.BuildHash)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sbom: %s", err)
+	}
+	if err := ioutil.WriteFile(cmd.sbomOutput, content, 0644); err != nil {
+		return fmt.Errorf("failed to write sbom to %s: %s", cmd.sbomOutput, err)
+	}
+	for _, db := range unread {
+		log.Warnf("Packages of the rpm database %s are not listed in the SBOM, which is marked incomplete", db)
+	}
+	log.Infof("Wrote SBOM with %d packages to %s", len(packages), cmd.sbomOutput)
+	return nil
+}
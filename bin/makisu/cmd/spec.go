@@ -0,0 +1,236 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// buildSpec is a build described by the JSON or YAML file of --spec, for
+// orchestrators to drive builds without composing flags. The flags given on
+// the command line override its fields.
+type buildSpec struct {
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Target     string            `yaml:"target"`
+	Tag        string            `yaml:"tag"`
+	BuildArgs  map[string]string `yaml:"build_args"`
+	Labels     map[string]string `yaml:"labels"`
+	Push       []string          `yaml:"push"`
+	Replicas   []string          `yaml:"replicas"`
+	Cache      buildSpecCache    `yaml:"cache"`
+
+	// Stages override the resources and isolation of the RUN steps of the
+	// stages, keyed by alias.
+	Stages map[string]buildSpecStage `yaml:"stages"`
+}
+
+// buildSpecCache is the cache config of a buildSpec. Unset fields keep the
+// defaults of their flags.
+type buildSpecCache struct {
+	LocalTTL    *time.Duration `yaml:"local_ttl"`
+	RedisAddr   string         `yaml:"redis_addr"`
+	RedisTTL    *time.Duration `yaml:"redis_ttl"`
+	HTTPAddr    string         `yaml:"http_addr"`
+	HTTPHeaders []string       `yaml:"http_headers"`
+	Repo        string         `yaml:"repo"`
+	Backends    []string       `yaml:"backends"`
+	Inline      *bool          `yaml:"inline"`
+	From        []string       `yaml:"from"`
+}
+
+// buildSpecStage overrides the resources and isolation of the RUN steps of a
+// stage. Unset fields keep the global defaults.
+type buildSpecStage struct {
+	Memory  string        `yaml:"memory"`
+	CPUTime time.Duration `yaml:"cpu_time"`
+	Network string        `yaml:"network"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// resources converts the overrides to the ones of the build context.
+func (s buildSpecStage) resources() (*context.StageResources, error) {
+	r := &context.StageResources{CPUTime: s.CPUTime, Network: s.Network, Timeout: s.Timeout}
+	if s.Memory != "" {
+		// Limiting memory requires a cgroup, which RUN commands aren't
+		// executed in, and the address space limit isn't one.
+		return nil, fmt.Errorf("memory %s: memory limits of stages are not supported", s.Memory)
+	}
+	switch s.Network {
+	case "", context.NetworkHost, context.NetworkNone:
+	default:
+		return nil, fmt.Errorf("invalid network %s: must be %s or %s",
+			s.Network, context.NetworkHost, context.NetworkNone)
+	}
+	if s.CPUTime < 0 {
+		return nil, fmt.Errorf("negative cpu_time %s", s.CPUTime)
+	} else if s.Timeout < 0 {
+		return nil, fmt.Errorf("negative timeout %s", s.Timeout)
+	}
+	return r, nil
+}
+
+// stageResources returns the resources of the stages of the spec, keyed by
+// lowercased alias.
+func (s *buildSpec) stageResources() (map[string]*context.StageResources, error) {
+	resources := make(map[string]*context.StageResources, len(s.Stages))
+	for name, stage := range s.Stages {
+		if name == "" {
+			return nil, fmt.Errorf("empty stage name")
+		}
+		key := strings.ToLower(name)
+		if _, ok := resources[key]; ok {
+			return nil, fmt.Errorf("duplicate stage %s", name)
+		}
+		r, err := stage.resources()
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %s", name, err)
+		}
+		resources[key] = r
+	}
+	return resources, nil
+}
+
+// loadBuildSpec reads and validates the spec at path. JSON specs are parsed as
+// YAML, which is a superset of JSON. Unknown fields are errors.
+func loadBuildSpec(path string) (*buildSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read spec: %s", err)
+	}
+	spec := &buildSpec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("parse spec %s: %s", path, err)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("invalid spec %s: %s", path, err)
+	}
+	return spec, nil
+}
+
+func (s *buildSpec) validate() error {
+	for key := range s.BuildArgs {
+		if key == "" {
+			return fmt.Errorf("empty build arg name")
+		}
+	}
+	for key := range s.Labels {
+		if key == "" {
+			return fmt.Errorf("empty label key")
+		}
+	}
+	for _, lists := range []struct {
+		field  string
+		values []string
+	}{
+		{"push", s.Push},
+		{"replicas", s.Replicas},
+		{"cache.http_headers", s.Cache.HTTPHeaders},
+		{"cache.from", s.Cache.From},
+		{"cache.backends", s.Cache.Backends},
+	} {
+		for _, v := range lists.values {
+			if v == "" {
+				return fmt.Errorf("empty value in %s", lists.field)
+			}
+		}
+	}
+	for _, ttl := range []*time.Duration{s.Cache.LocalTTL, s.Cache.RedisTTL} {
+		if ttl != nil && *ttl < 0 {
+			return fmt.Errorf("negative cache ttl %s", ttl)
+		}
+	}
+	if _, err := s.stageResources(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// applySpec sets the flags that weren't given on the command line from the
+// --spec file, and returns the build context, which is the one of the spec if
+// contextDir is empty. Build args and labels of the spec are kept unless the
+// flags set the same keys.
+func (cmd *buildCmd) applySpec(contextDir string) (string, error) {
+	if cmd.specFile == "" {
+		return contextDir, nil
+	}
+	spec, err := loadBuildSpec(cmd.specFile)
+	if err != nil {
+		return "", err
+	}
+
+	flags := cmd.Flags()
+	setString := func(name string, value *string, v string) {
+		if v != "" && !flags.Changed(name) {
+			*value = v
+		}
+	}
+	setStrings := func(name string, value *[]string, v []string) {
+		if len(v) > 0 && !flags.Changed(name) {
+			*value = v
+		}
+	}
+	setDuration := func(name string, value *time.Duration, v *time.Duration) {
+		if v != nil && !flags.Changed(name) {
+			*value = *v
+		}
+	}
+	setString("file", &cmd.dockerfilePath, spec.Dockerfile)
+	setString("target", &cmd.target, spec.Target)
+	setString("tag", &cmd.tag, spec.Tag)
+	setStrings("push", &cmd.pushRegistries, spec.Push)
+	setStrings("replica", &cmd.replicas, spec.Replicas)
+	setDuration("local-cache-ttl", &cmd.localCacheTTL, spec.Cache.LocalTTL)
+	setString("redis-cache-addr", &cmd.redisCacheAddress, spec.Cache.RedisAddr)
+	setDuration("redis-cache-ttl", &cmd.redisCacheTTL, spec.Cache.RedisTTL)
+	setString("http-cache-addr", &cmd.httpCacheAddress, spec.Cache.HTTPAddr)
+	setStrings("http-cache-header", &cmd.httpCacheHeaders, spec.Cache.HTTPHeaders)
+	setString("cache-repo", &cmd.cacheRepo, spec.Cache.Repo)
+	setStrings("cache-backend", &cmd.cacheBackends, spec.Cache.Backends)
+	if spec.Cache.Inline != nil && !flags.Changed("cache-inline") {
+		cmd.cacheInline = *spec.Cache.Inline
+	}
+	setStrings("cache-from", &cmd.cacheFrom, spec.Cache.From)
+	if cmd.stageResources, err = spec.stageResources(); err != nil {
+		return "", err
+	}
+
+	// The last value of a key wins, so the flags come after the spec.
+	cmd.buildArgs = append(keyValuePairs(spec.BuildArgs), cmd.buildArgs...)
+	cmd.labels = append(keyValuePairs(spec.Labels), cmd.labels...)
+
+	if contextDir == "" {
+		contextDir = spec.Context
+	}
+	return contextDir, nil
+}
+
+// keyValuePairs formats the map as "<key>=<value>" strings, sorted by key.
+func keyValuePairs(m map[string]string) []string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,230 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSpecFixture writes a spec file with the given content, and returns its
+// path.
+func writeSpecFixture(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "makisu-spec-test")
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadBuildSpec(t *testing.T) {
+	inline := true
+	localTTL := 2 * time.Hour
+	expected := &buildSpec{
+		Context:    "/context",
+		Dockerfile: "Dockerfile.prod",
+		Target:     "release",
+		Tag:        "repo:tag",
+		BuildArgs:  map[string]string{"VERSION": "1.2"},
+		Labels:     map[string]string{"team": "infra"},
+		Push:       []string{"registry.example.com"},
+		Cache:      buildSpecCache{LocalTTL: &localTTL, Inline: &inline, From: []string{"repo:cache"}},
+		Stages: map[string]buildSpecStage{
+			"builder": {CPUTime: time.Minute, Network: "none", Timeout: 10 * time.Minute},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"spec.yaml", `
+context: /context
+dockerfile: Dockerfile.prod
+target: release
+tag: repo:tag
+build_args:
+  VERSION: "1.2"
+labels:
+  team: infra
+push: [registry.example.com]
+cache:
+  local_ttl: 2h
+  inline: true
+  from: [repo:cache]
+stages:
+  builder:
+    cpu_time: 1m
+    network: none
+    timeout: 10m
+`},
+		{"spec.json", `{
+  "context": "/context",
+  "dockerfile": "Dockerfile.prod",
+  "target": "release",
+  "tag": "repo:tag",
+  "build_args": {"VERSION": "1.2"},
+  "labels": {"team": "infra"},
+  "push": ["registry.example.com"],
+  "cache": {"local_ttl": "2h", "inline": true, "from": ["repo:cache"]},
+  "stages": {"builder": {"cpu_time": "1m", "network": "none", "timeout": "10m"}}
+}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require := require.New(t)
+			path, cleanup := writeSpecFixture(t, test.name, test.content)
+			defer cleanup()
+
+			spec, err := loadBuildSpec(path)
+			require.NoError(err)
+			require.Equal(expected, spec)
+		})
+	}
+}
+
+func TestLoadBuildSpecErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		content  string
+		expected string
+	}{
+		{"unknown field", "tag: repo:tag\nbuildargs: {A: b}\n", "field buildargs not found"},
+		{"unknown cache field", "cache: {ttl: 1h}\n", "field ttl not found"},
+		{"wrong type", "push: registry.example.com\n", "cannot unmarshal"},
+		{"empty build arg", "build_args: {'': b}\n", "empty build arg name"},
+		{"empty push", "push: ['']\n", "empty value in push"},
+		{"negative ttl", "cache: {redis_ttl: -1h}\n", "negative cache ttl"},
+		{"invalid network", "stages: {builder: {network: bridge}}\n", "stage builder: invalid network bridge"},
+		{"memory", "stages: {builder: {memory: 1g}}\n", "memory limits of stages are not supported"},
+		{"cpu share", "stages: {builder: {cpu: 1}}\n", "field cpu not found"},
+		{"negative cpu time", "stages: {builder: {cpu_time: -1m}}\n", "negative cpu_time"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			path, cleanup := writeSpecFixture(t, "spec.yaml", test.content)
+			defer cleanup()
+
+			_, err := loadBuildSpec(path)
+			require.Error(err)
+			require.Contains(err.Error(), test.expected)
+		})
+	}
+
+	_, err := loadBuildSpec(filepath.Join(os.TempDir(), "makisu-missing-spec.yaml"))
+	require.Error(t, err)
+}
+
+func TestApplySpec(t *testing.T) {
+	path, cleanup := writeSpecFixture(t, "spec.yaml", `
+context: /spec/context
+tag: spec:tag
+target: release
+build_args: {B: spec, A: spec}
+labels: {team: spec}
+push: [spec.example.com]
+cache: {inline: true, redis_ttl: 1h}
+stages: {Builder: {network: none}}
+`)
+	defer cleanup()
+
+	t.Run("spec fields", func(t *testing.T) {
+		require := require.New(t)
+
+		cmd := getBuildCmd()
+		require.NoError(cmd.ParseFlags([]string{"--spec", path}))
+		contextDir, err := cmd.applySpec("")
+		require.NoError(err)
+		require.Equal("/spec/context", contextDir)
+		require.Equal("spec:tag", cmd.tag)
+		require.Equal("release", cmd.target)
+		require.Equal([]string{"spec.example.com"}, cmd.pushRegistries)
+		require.True(cmd.cacheInline)
+		require.Equal(time.Hour, cmd.redisCacheTTL)
+		require.Equal([]string{"A=spec", "B=spec"}, cmd.buildArgs)
+		require.Equal([]string{"team=spec"}, cmd.labels)
+		require.Equal(map[string]*context.StageResources{
+			"builder": {Network: context.NetworkNone},
+		}, cmd.stageResources)
+	})
+
+	t.Run("flags override spec", func(t *testing.T) {
+		require := require.New(t)
+
+		cmd := getBuildCmd()
+		require.NoError(cmd.ParseFlags([]string{
+			"--spec", path, "--tag", "flag:tag", "--push", "flag.example.com",
+			"--cache-inline=false", "--redis-cache-ttl", "5m",
+			"--build-arg", "A=flag", "--label", "team=flag",
+		}))
+		contextDir, err := cmd.applySpec("/flag/context")
+		require.NoError(err)
+		require.Equal("/flag/context", contextDir)
+		require.Equal("flag:tag", cmd.tag)
+		require.Equal("release", cmd.target)
+		require.Equal([]string{"flag.example.com"}, cmd.pushRegistries)
+		require.False(cmd.cacheInline)
+		require.Equal(5*time.Minute, cmd.redisCacheTTL)
+		// The values of the flags come last, so they win.
+		require.Equal([]string{"A=spec", "B=spec", "A=flag"}, cmd.buildArgs)
+		require.Equal([]string{"team=spec", "team=flag"}, cmd.labels)
+	})
+
+	t.Run("no spec", func(t *testing.T) {
+		require := require.New(t)
+
+		cmd := getBuildCmd()
+		require.NoError(cmd.ParseFlags([]string{"--tag", "flag:tag"}))
+		contextDir, err := cmd.applySpec("/flag/context")
+		require.NoError(err)
+		require.Equal("/flag/context", contextDir)
+		require.Equal("flag:tag", cmd.tag)
+		require.Empty(cmd.buildArgs)
+	})
+}
+
+func TestSelectTargetStage(t *testing.T) {
+	var stages []*dockerfile.Stage
+	for _, alias := range []string{"deps", "Builder", ""} {
+		stages = append(stages, &dockerfile.Stage{From: dockerfile.FromDirectiveFixture("", "alpine", alias)})
+	}
+
+	t.Run("found", func(t *testing.T) {
+		require := require.New(t)
+
+		selected, err := selectTargetStage(stages, "deps")
+		require.NoError(err)
+		require.Equal(stages[:1], selected)
+
+		// Aliases are case insensitive.
+		selected, err = selectTargetStage(stages, "builder")
+		require.NoError(err)
+		require.Equal(stages[:2], selected)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := selectTargetStage(stages, "release")
+		require.EqualError(t, err, "target stage release not found in dockerfile")
+	})
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// expandTags resolves the placeholders in --tag and --replica.
+func (cmd *buildCmd) expandTags(contextDir string) error {
+	buildArgs, err := cmd.getBuildArgs()
+	if err != nil {
+		return err
+	}
+	r := &tagResolver{contextDir, buildArgs, time.Now()}
+	if cmd.tag, err = r.expand(cmd.tag); err != nil {
+		return err
+	}
+	for i, replica := range cmd.replicas {
+		if cmd.replicas[i], err = r.expand(replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagResolver resolves the placeholders of templated tags, e.g.
+// "repo:{git_short_sha}-{date}". Git info is read from the build context,
+// and only if a git placeholder is used.
+type tagResolver struct {
+	contextDir string
+	buildArgs  map[string]string
+	now        time.Time
+}
+
+// expand replaces the placeholders in the given tag. Supported placeholders
+// are {git_sha}, {git_short_sha}, {git_branch}, {date} (UTC, formatted as
+// YYYYMMDD), {timestamp} (unix seconds) and {arg:<name>} for build args.
+// Characters of branch names that tags don't allow are replaced with "-".
+func (r *tagResolver) expand(tag string) (string, error) {
+	var result strings.Builder
+	for {
+		start := strings.Index(tag, "{")
+		if start == -1 {
+			result.WriteString(tag)
+			return result.String(), nil
+		}
+		end := strings.Index(tag[start:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated placeholder in tag %s", tag)
+		}
+		value, err := r.resolve(tag[start+1 : start+end])
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(tag[:start])
+		result.WriteString(value)
+		tag = tag[start+end+1:]
+	}
+}
+
+func (r *tagResolver) resolve(placeholder string) (string, error) {
+	switch placeholder {
+	case "git_sha":
+		return r.git("rev-parse", "HEAD")
+	case "git_short_sha":
+		return r.git("rev-parse", "--short", "HEAD")
+	case "git_branch":
+		branch, err := r.git("rev-parse", "--abbrev-ref", "HEAD")
+		return sanitizeTag(branch), err
+	case "date":
+		return r.now.UTC().Format("20060102"), nil
+	case "timestamp":
+		return fmt.Sprintf("%d", r.now.Unix()), nil
+	}
+	if name := strings.TrimPrefix(placeholder, "arg:"); name != placeholder {
+		value, ok := r.buildArgs[name]
+		if !ok {
+			return "", fmt.Errorf("build arg %s of tag placeholder is not set", name)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown tag placeholder {%s}", placeholder)
+}
+
+// sanitizeTag replaces the characters that aren't allowed in tags, i.e.
+// anything but letters, digits, "_", "." and "-", with "-".
+func sanitizeTag(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+			return c
+		}
+		return '-'
+	}, s)
+}
+
+func (r *tagResolver) git(args ...string) (string, error) {
+	return runGit(r.contextDir, args...)
+}
+
+// runGit runs git with the given args in dir, and returns its trimmed output.
+func runGit(dir string, args ...string) (string, error) {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
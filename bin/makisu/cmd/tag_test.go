@@ -0,0 +1,130 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gitRepoFixture returns a git repo with one commit on the given branch.
+func gitRepoFixture(t *testing.T, branch string) (string, func()) {
+	dir, err := ioutil.TempDir("", "makisu-tag-test")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"checkout", "-q", "-b", branch},
+		{"-c", "user.name=test", "-c", "user.email=test@test", "commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestTagResolverExpand(t *testing.T) {
+	// The date is the one of UTC, which is the day after.
+	now := time.Date(2020, 1, 2, 20, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	r := &tagResolver{"", map[string]string{"VERSION": "1.2", "EMPTY": ""}, now}
+
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"repo:latest", "repo:latest"},
+		{"repo:{date}", "repo:20200103"},
+		{"repo:{timestamp}", "repo:1578024000"},
+		{"repo:v{arg:VERSION}-{date}", "repo:v1.2-20200103"},
+		{"repo:x{arg:EMPTY}", "repo:x"},
+		{"registry:5000/{arg:VERSION}:{arg:VERSION}", "registry:5000/1.2:1.2"},
+	}
+	for _, test := range tests {
+		t.Run(test.tag, func(t *testing.T) {
+			require := require.New(t)
+			tag, err := r.expand(test.tag)
+			require.NoError(err)
+			require.Equal(test.expected, tag)
+		})
+	}
+}
+
+func TestTagResolverExpandErrors(t *testing.T) {
+	r := &tagResolver{"", map[string]string{"VERSION": "1.2"}, time.Now()}
+
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"repo:{date", "unterminated placeholder in tag repo:{date"},
+		{"repo:{user}", "unknown tag placeholder {user}"},
+		{"repo:{arg:COMMIT}", "build arg COMMIT of tag placeholder is not set"},
+	}
+	for _, test := range tests {
+		t.Run(test.tag, func(t *testing.T) {
+			require := require.New(t)
+			_, err := r.expand(test.tag)
+			require.EqualError(err, test.expected)
+		})
+	}
+}
+
+func TestTagResolverGit(t *testing.T) {
+	require := require.New(t)
+
+	dir, cleanup := gitRepoFixture(t, "feature/JIRA-12_fix+retry@v2")
+	defer cleanup()
+	sha, err := runGit(dir, "rev-parse", "HEAD")
+	require.NoError(err)
+	shortSHA, err := runGit(dir, "rev-parse", "--short", "HEAD")
+	require.NoError(err)
+
+	r := &tagResolver{dir, nil, time.Now()}
+	tag, err := r.expand("repo:{git_branch}-{git_short_sha}")
+	require.NoError(err)
+	require.Equal("repo:feature-JIRA-12_fix-retry-v2-"+shortSHA, tag)
+
+	tag, err = r.expand("repo:{git_sha}")
+	require.NoError(err)
+	require.Equal("repo:"+sha, tag)
+
+	r = &tagResolver{filepath.Join(dir, "missing"), nil, time.Now()}
+	_, err = r.expand("repo:{git_sha}")
+	require.Error(err)
+}
+
+func TestSanitizeTag(t *testing.T) {
+	tests := []struct {
+		branch   string
+		expected string
+	}{
+		{"master", "master"},
+		{"release-1.2_rc", "release-1.2_rc"},
+		{"feature/foo", "feature-foo"},
+		{"users/me/fix#12", "users-me-fix-12"},
+		{"HEAD", "HEAD"},
+		{"ünicode", "-nicode"},
+	}
+	for _, test := range tests {
+		t.Run(test.branch, func(t *testing.T) {
+			require.Equal(t, test.expected, sanitizeTag(test.branch))
+		})
+	}
+}
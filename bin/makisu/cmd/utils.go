@@ -16,13 +16,21 @@ package cmd
 
 import (
 	ctx "context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/uber/makisu/lib/builder"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
@@ -34,16 +42,61 @@ import (
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/stringset"
+
+	units "github.com/docker/go-units"
 )
 
+// initRegistryConfig loads the registry config of --registry-config, and then
+// the one of the environment, which overrides it.
 func (cmd *buildCmd) initRegistryConfig() error {
-	if cmd.registryConfig == "" {
-		return nil
+	if cmd.registryConfig != "" {
+		cmd.registryConfig = os.ExpandEnv(cmd.registryConfig)
+		if err := registry.UpdateGlobalConfig(cmd.registryConfig); err != nil {
+			return fmt.Errorf("init registry config: %s", err)
+		}
 	}
-	cmd.registryConfig = os.ExpandEnv(cmd.registryConfig)
-	if err := registry.UpdateGlobalConfig(cmd.registryConfig); err != nil {
-		return fmt.Errorf("init registry config: %s", err)
+	if err := registry.UpdateGlobalConfigFromEnv(); err != nil {
+		return fmt.Errorf("init registry config from env: %s", err)
+	}
+	return nil
+}
+
+// expandPathFlags expands the environment variables in the file and directory
+// flags, so that they don't depend on the shell of the caller.
+func (cmd *buildCmd) expandPathFlags() error {
+	flags := []struct {
+		name  string
+		value *string
+	}{
+		{"file", &cmd.dockerfilePath},
+		{"dockerignore", &cmd.dockerignore},
+		{"arg-defaults", &cmd.argDefaults},
+		{"dest", &cmd.destination},
+		{"export-rootfs", &cmd.rootfsFile},
+		{"iidfile", &cmd.iidFile},
+		{"digestfile", &cmd.digestFile},
+		{"digest-map-file", &cmd.digestMapFile},
+		{"oci-digestfile", &cmd.ociDigestFile},
+		{"provenance-file", &cmd.provenanceFile},
+		{"sbom-output", &cmd.sbomOutput},
+		{"storage", &cmd.storageDir},
+		{"tmp-dir", &cmd.tmpDir},
+	}
+	for _, flag := range flags {
+		expanded, err := utils.ExpandEnvStrict(*flag.value)
+		if err != nil {
+			return fmt.Errorf("failed to expand --%s %s: %s", flag.name, *flag.value, err)
+		}
+		*flag.value = expanded
+	}
+	for i, p := range cmd.labelFiles {
+		expanded, err := utils.ExpandEnvStrict(p)
+		if err != nil {
+			return fmt.Errorf("failed to expand --label-file %s: %s", p, err)
+		}
+		cmd.labelFiles[i] = expanded
 	}
 	return nil
 }
@@ -51,39 +104,581 @@ func (cmd *buildCmd) initRegistryConfig() error {
 // Finds a way to get the dockerfile.
 // If the context passed in is not a local path, then it will try to clone the
 // git repo.
-func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, error) {
+func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, dockerfile.Lines, error) {
 	fi, err := os.Lstat(contextDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
+		return nil, nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
 	} else if !fi.Mode().IsDir() {
-		return nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
+		return nil, nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
+	}
+
+	log.Infof("Using build context: %s", contextDir)
+	contents, err := cmd.readDockerfile(contextDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buildArgMap, err := cmd.getBuildArgs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	argDefaultMap, err := cmd.getArgDefaults()
+	if err != nil {
+		return nil, nil, err
+	}
+	globalArgMap, err := parseKeyValues("global-arg", cmd.globalArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	extraEnvMap, err := parseKeyValues("extra-env", cmd.extraEnvs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dockerfile, lines, err := dockerfile.ParseFileWithLines(
+		string(contents), buildArgMap, argDefaultMap, globalArgMap, extraEnvMap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse dockerfile: %s", err)
+	}
+	if cmd.target != "" {
+		if dockerfile, err = selectTargetStage(dockerfile, cmd.target); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dockerfile, lines, nil
+}
+
+// selectTargetStage returns the stages up to the one with the alias target.
+// Stages can only depend on the ones before them, so the later ones are not
+// needed to build it.
+func selectTargetStage(stages []*dockerfile.Stage, target string) ([]*dockerfile.Stage, error) {
+	for i, stage := range stages {
+		if strings.EqualFold(stage.From.Alias, target) {
+			return stages[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("target stage %s not found in dockerfile", target)
+}
+
+// readDockerfile returns the contents of the --file dockerfile. A relative
+// path is relative to the build context, and "-" reads the dockerfile from
+// stdin, the first time only.
+func (cmd *buildCmd) readDockerfile(contextDir string) ([]byte, error) {
+	if cmd.dockerfilePath == "-" {
+		if cmd.stdinDockerfile == nil {
+			contents, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read dockerfile from stdin: %s", err)
+			}
+			cmd.stdinDockerfile = contents
+		}
+		return cmd.stdinDockerfile, nil
 	}
 
 	dockerfilePath := cmd.dockerfilePath
 	if !path.IsAbs(dockerfilePath) {
+		if cmd.noContext {
+			return nil, fmt.Errorf(
+				"no build context given, the dockerfile must be an absolute path or -: %s", dockerfilePath)
+		}
 		dockerfilePath = path.Join(contextDir, dockerfilePath)
 	}
-
-	log.Infof("Using build context: %s", contextDir)
 	contents, err := ioutil.ReadFile(dockerfilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate/find dockerfile in context: %s", err)
 	}
+	return contents, nil
+}
+
+// getDockerignore returns the path of the ignore file of the build context:
+// --dockerignore, else <dockerfile>.dockerignore next to the dockerfile like
+// docker, else .dockerignore at the root of the context. It returns an empty
+// path if none of the defaults exist.
+func (cmd *buildCmd) getDockerignore(contextDir string) (string, error) {
+	if cmd.dockerignore != "" {
+		return cmd.dockerignore, nil
+	}
+	var candidates []string
+	if cmd.dockerfilePath != "-" {
+		dockerfilePath := cmd.dockerfilePath
+		if !path.IsAbs(dockerfilePath) {
+			dockerfilePath = path.Join(contextDir, dockerfilePath)
+		}
+		candidates = append(candidates, dockerfilePath+".dockerignore")
+	}
+	candidates = append(candidates, path.Join(contextDir, ".dockerignore"))
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			log.Infof("Using dockerignore: %s", candidate)
+			return candidate, nil
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to stat dockerignore %s: %s", candidate, err)
+		}
+	}
+	return "", nil
+}
+
+// checkPolicy logs the violations of the --policy rules by the dockerfile, and
+// returns an error listing the ones of rules with the error severity.
+func (cmd *buildCmd) checkPolicy(
+	stages []*dockerfile.Stage, lines dockerfile.Lines, contextDir string) error {
+
+	policy, err := builder.ParsePolicy(cmd.policy)
+	if err != nil {
+		return fmt.Errorf("failed to parse policy: %s", err)
+	}
+	var errs []string
+	for _, violation := range builder.CheckPolicy(stages, lines, contextDir, policy) {
+		if violation.Severity == builder.PolicyError {
+			log.Errorf("%s", violation)
+			errs = append(errs, violation.String())
+		} else {
+			log.Warnf("%s", violation)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("dockerfile violates policy: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
 
+// getBuildArgs parses the --build-arg flags into a map. Like docker, a build
+// arg given without a value takes the one of the environment variable of the
+// same name, and is ignored if it isn't set.
+func (cmd *buildCmd) getBuildArgs() (map[string]string, error) {
 	buildArgMap := make(map[string]string)
 	for _, pair := range cmd.buildArgs {
+		if pair != "" && !strings.Contains(pair, "=") {
+			if val, ok := os.LookupEnv(pair); ok {
+				buildArgMap[pair] = val
+			}
+			continue
+		}
 		parts := strings.Split(pair, "=")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("failed to parse build-arg %s: %s", pair, err)
+			return nil, fmt.Errorf("failed to parse build-arg %s", pair)
 		}
 		buildArgMap[parts[0]] = parts[1]
 	}
+	return buildArgMap, nil
+}
+
+// getArgDefaults reads the map of ARG names to values of --arg-defaults.
+func (cmd *buildCmd) getArgDefaults() (map[string]string, error) {
+	argDefaults := make(map[string]string)
+	if cmd.argDefaults == "" {
+		return argDefaults, nil
+	}
+	data, err := ioutil.ReadFile(cmd.argDefaults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arg defaults: %s", err)
+	}
+	if err := yaml.Unmarshal(data, &argDefaults); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal arg defaults %s: %s", cmd.argDefaults, err)
+	}
+	return argDefaults, nil
+}
+
+// parseKeyValues parses the values of a flag formatted as <key>=<value> into a
+// map. Values may contain '='.
+func parseKeyValues(flag string, pairs []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("failed to parse %s %s", flag, pair)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+// getLayerComments parses the --layer-comment flags into a map of step
+// number to comment.
+func (cmd *buildCmd) getLayerComments() (map[int]string, error) {
+	comments := make(map[int]string)
+	for _, pair := range cmd.layerComments {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("failed to parse layer-comment %s", pair)
+		}
+		step, err := strconv.Atoi(parts[0])
+		if err != nil || step < 1 {
+			return nil, fmt.Errorf("invalid step number in layer-comment %s", pair)
+		}
+		comments[step] = parts[1]
+	}
+	return comments, nil
+}
+
+// getManifestAnnotations parses the --manifest-annotation flags.
+func (cmd *buildCmd) getManifestAnnotations() (map[string]string, error) {
+	annotations := make(map[string]string)
+	for _, pair := range cmd.annotations {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("failed to parse manifest-annotation %s", pair)
+		}
+		annotations[parts[0]] = parts[1]
+	}
+	return annotations, nil
+}
+
+// getKeepHistoryPatterns compiles the --keep-history flags.
+func (cmd *buildCmd) getKeepHistoryPatterns() ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, expr := range cmd.keepHistory {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile keep-history %s: %s", expr, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// getCmdOverride parses --set-cmd, which must be a JSON array of strings.
+func (cmd *buildCmd) getCmdOverride() ([]string, error) {
+	if cmd.setCmd == "" {
+		return nil, nil
+	}
+	var override []string
+	if err := json.Unmarshal([]byte(cmd.setCmd), &override); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON array of strings: %s", cmd.setCmd, err)
+	} else if override == nil {
+		return nil, fmt.Errorf("%s is not a JSON array of strings", cmd.setCmd)
+	}
+	return override, nil
+}
+
+// getMaxSizes returns the sizes in bytes set by --max-image-size and
+// --max-layer-size, or 0 if they are not set.
+func (cmd *buildCmd) getMaxSizes() (maxImageSize, maxLayerSize int64, err error) {
+	if cmd.maxImageSize != "" {
+		if maxImageSize, err = units.RAMInBytes(cmd.maxImageSize); err != nil {
+			return 0, 0, fmt.Errorf("parse max image size: %s", err)
+		}
+	}
+	if cmd.maxLayerSize != "" {
+		if maxLayerSize, err = units.RAMInBytes(cmd.maxLayerSize); err != nil {
+			return 0, 0, fmt.Errorf("parse max layer size: %s", err)
+		}
+	}
+	return maxImageSize, maxLayerSize, nil
+}
 
-	dockerfile, err := dockerfile.ParseFile(string(contents), buildArgMap)
+// getMinFreeDisk returns the size in bytes set by --min-free-disk, or 0 if it
+// is not set.
+func (cmd *buildCmd) getMinFreeDisk() (int64, error) {
+	if cmd.minFreeDisk == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(cmd.minFreeDisk)
+	if err != nil {
+		return 0, fmt.Errorf("parse min free disk: %s", err)
+	}
+	return size, nil
+}
+
+// getDiskQuota returns the size in bytes set by --disk-quota, or 0 if it is
+// not set.
+func (cmd *buildCmd) getDiskQuota() (int64, error) {
+	if cmd.diskQuota == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(cmd.diskQuota)
+	if err != nil {
+		return 0, fmt.Errorf("parse disk quota: %s", err)
+	}
+	return size, nil
+}
+
+// getCacheRepo returns the registry and repository name set by --cache-repo,
+// or nil if it is not set.
+func (cmd *buildCmd) getCacheRepo() (*image.Name, error) {
+	if cmd.cacheRepo == "" {
+		return nil, nil
+	}
+	if strings.Contains(path.Base(cmd.cacheRepo), ":") {
+		return nil, fmt.Errorf("%s must not have a tag", cmd.cacheRepo)
+	}
+	name, err := image.ParseNameForPull(cmd.cacheRepo)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse dockerfile: %s", err)
+		return nil, fmt.Errorf("parse %s: %s", cmd.cacheRepo, err)
+	}
+	return &name, nil
+}
+
+// parseCacheBackend parses a --cache-backend spec into the kind of store and
+// its address, which is empty for the local store.
+func parseCacheBackend(spec string) (kind, addr string, err error) {
+	parts := strings.SplitN(spec, "=", 2)
+	switch {
+	case len(parts) == 1 && parts[0] == "local":
+		return parts[0], "", nil
+	case len(parts) == 2 && (parts[0] == "redis" || parts[0] == "http") && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf(
+		"%s must be one of \"redis=<addr>\", \"http=<addr>\" and \"local\"", spec)
+}
+
+// checkCacheBackends returns an error if a --cache-backend is invalid, or if
+// they are combined with the flags of a single cache store.
+func (cmd *buildCmd) checkCacheBackends() error {
+	if len(cmd.cacheBackends) == 0 {
+		return nil
+	}
+	for _, spec := range cmd.cacheBackends {
+		if _, _, err := parseCacheBackend(spec); err != nil {
+			return err
+		}
+	}
+	if cmd.cacheRepo != "" || cmd.redisCacheAddress != "" || cmd.httpCacheAddress != "" {
+		return fmt.Errorf(
+			"--cache-backend can't be used with --cache-repo, --redis-cache-addr or --http-cache-addr")
+	}
+	return nil
+}
+
+// hasRemoteCacheBackend returns true if a --cache-backend is a server.
+func (cmd *buildCmd) hasRemoteCacheBackend() bool {
+	for _, spec := range cmd.cacheBackends {
+		if kind, _, _ := parseCacheBackend(spec); kind != "local" {
+			return true
+		}
 	}
-	return dockerfile, nil
+	return false
+}
+
+// newCacheBackendsStore returns a store combining the --cache-backend stores.
+// Stores that fail to be initialized are skipped, like a single store that
+// fails to be initialized, and nil is returned if all of them did.
+func (cmd *buildCmd) newCacheBackendsStore(buildContext *context.BuildContext) keyvalue.Store {
+	var stores []keyvalue.NamedStore
+	for _, spec := range cmd.cacheBackends {
+		kind, addr, _ := parseCacheBackend(spec)
+		var store keyvalue.Store
+		var err error
+		switch kind {
+		case "redis":
+			store, err = keyvalue.NewRedisStore(addr, cmd.redisCacheTTL)
+		case "http":
+			store, err = keyvalue.NewHTTPStore(addr, cmd.httpCacheHeaders...)
+		case "local":
+			fullpath := path.Join(buildContext.ImageStore.RootDir, pathutils.CacheKeyValueFileName)
+			store, err = keyvalue.NewFSStore(
+				fullpath, buildContext.ImageStore.SandboxDir, cmd.localCacheTTL)
+		}
+		if err != nil {
+			log.Errorf("Failed to init cache backend %s, skipping it: %s", spec, err)
+			continue
+		}
+		log.Infof("Using cache backend %s for cacheID storage", spec)
+		stores = append(stores, keyvalue.NamedStore{Name: spec, Store: store})
+	}
+	if len(stores) == 0 {
+		return nil
+	}
+	return keyvalue.NewMultiStore(stores...)
+}
+
+// checkFreeDisk returns an error if a disk the build writes to has less free
+// space than --min-free-disk, so that builds fail before filling it up.
+func (cmd *buildCmd) checkFreeDisk() error {
+	minFreeDisk, err := cmd.getMinFreeDisk()
+	if err != nil || minFreeDisk == 0 {
+		return err
+	}
+	dirs := []string{cmd.storageDir, cmd.tmpDir}
+	if cmd.allowModifyFS {
+		dirs = append(dirs, "/")
+	}
+	for _, dir := range dirs {
+		free, err := utils.FreeDiskSpace(dir)
+		if err != nil {
+			return err
+		} else if free < uint64(minFreeDisk) {
+			return fmt.Errorf("%s has %s free, less than the %s required by --min-free-disk",
+				dir, units.BytesSize(float64(free)), units.BytesSize(float64(minFreeDisk)))
+		}
+		log.Infof("%s has %s of free disk space", dir, units.BytesSize(float64(free)))
+	}
+	return nil
+}
+
+// setRegistryPolicy validates the registry patterns of --allow-registry and
+// --deny-registry, and sets them in the options of the registry clients.
+func setRegistryPolicy(opts *registry.Options, allowed, denied []string) error {
+	if err := registry.ValidateRegistryPatterns(allowed); err != nil {
+		return fmt.Errorf("invalid --allow-registry: %s", err)
+	}
+	if err := registry.ValidateRegistryPatterns(denied); err != nil {
+		return fmt.Errorf("invalid --deny-registry: %s", err)
+	}
+	opts.AllowedRegistries = allowed
+	opts.DeniedRegistries = denied
+	return nil
+}
+
+// checkOffline returns an error naming the first flag that needs network
+// access, which --offline forbids.
+func (cmd *buildCmd) checkOffline() error {
+	flags := []struct {
+		name string
+		set  bool
+	}{
+		{"--push", len(cmd.pushRegistries) > 0},
+		{"--replica", len(cmd.replicas) > 0},
+		{"--push-provenance", cmd.pushProvenance},
+		{"--cache-repo", cmd.cacheRepo != ""},
+		{"--cache-from", len(cmd.cacheFrom) > 0},
+		{"--cache-read-through", cmd.cacheReadThrough},
+		{"--redis-cache-addr", cmd.redisCacheAddress != ""},
+		{"--http-cache-addr", cmd.httpCacheAddress != ""},
+		{"--cache-backend", cmd.hasRemoteCacheBackend()},
+		{"--otel-endpoint", cmd.otelEndpoint != ""},
+		{"--vault-addr", cmd.vaultAddr != ""},
+	}
+	for _, flag := range flags {
+		if flag.set {
+			return fmt.Errorf("%s needs network access, which --offline forbids", flag.name)
+		}
+	}
+	for _, secret := range cmd.secrets {
+		if strings.Contains(","+secret, ",source=vault:") {
+			return fmt.Errorf("vault secrets need network access, which --offline forbids")
+		}
+	}
+	return nil
+}
+
+// checkPrivileges returns an error listing the privileges that the build needs
+// but makisu doesn't have, with how to grant them or do without them, so that
+// builds in restricted environments fail before starting instead of with an
+// EPERM in the middle of a step. Privileges that only disable a feature are
+// logged as warnings.
+func (cmd *buildCmd) checkPrivileges() error {
+	var missing []string
+	type writableDir struct {
+		path string
+		hint string
+	}
+	dirs := []writableDir{
+		{cmd.storageDir, "set --storage to a writable dir"},
+		{cmd.tmpDir, "set --tmp-dir to a writable dir"},
+	}
+	if cmd.allowModifyFS {
+		dirs = append(dirs, writableDir{"/", "--modifyfs needs a writable root filesystem"})
+	}
+	for _, dir := range dirs {
+		if err := utils.CheckWritable(dir.path); err != nil {
+			missing = append(missing, fmt.Sprintf("%s; %s", err, dir.hint))
+		}
+	}
+
+	caps, err := utils.EffectiveCapabilities()
+	if err != nil {
+		log.Debugf("Skipping capability checks: %s", err)
+	} else {
+		if cmd.allowModifyFS && !utils.Rootless {
+			for _, required := range []struct {
+				capability utils.Capability
+				reason     string
+			}{
+				{utils.CapChown, "to apply the owners of files"},
+				{utils.CapDacOverride, "to write files owned by other users"},
+				{utils.CapFowner, "to change the mode and mtime of files owned by other users"},
+			} {
+				if !caps.Has(required.capability) {
+					missing = append(missing, fmt.Sprintf(
+						"--modifyfs needs %s %s; add the capability or run with --rootless=true",
+						required.capability, required.reason))
+				}
+			}
+		}
+		if !utils.Rootless && (!caps.Has(utils.CapSetuid) || !caps.Has(utils.CapSetgid)) {
+			log.Warnf("RUN steps after USER fail without %s and %s; add the capabilities or run with --rootless=true to run them as the current user",
+				utils.CapSetuid, utils.CapSetgid)
+		}
+		if cmd.buildOptions.Snapshot.Tar.KeepSpecialFiles && !caps.Has(utils.CapMknod) {
+			log.Warnf("Device nodes can't be created without %s, and are skipped when copied or extracted", utils.CapMknod)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing privileges: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// checkImageSize returns an error listing the largest layers if the
+// compressed size of the image or of one of its layers exceeds the max sizes.
+func (cmd *buildCmd) checkImageSize(manifest *image.DistributionManifest) error {
+	maxImageSize, maxLayerSize, err := cmd.getMaxSizes()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var problems []string
+	for i, layer := range manifest.Layers {
+		total += layer.Size
+		if maxLayerSize > 0 && layer.Size > maxLayerSize {
+			problems = append(problems, fmt.Sprintf("layer %d is %s, over the max layer size of %s",
+				i, units.BytesSize(float64(layer.Size)), units.BytesSize(float64(maxLayerSize))))
+		}
+	}
+	log.Infof("Compressed image size is %s", units.BytesSize(float64(total)))
+	if maxImageSize > 0 && total > maxImageSize {
+		problems = append(problems, fmt.Sprintf("image is %s, over the max image size of %s",
+			units.BytesSize(float64(total)), units.BytesSize(float64(maxImageSize))))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// List the largest layers, which are the most likely culprits.
+	const maxListed = 5
+	indices := make([]int, len(manifest.Layers))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return manifest.Layers[indices[i]].Size > manifest.Layers[indices[j]].Size
+	})
+	if len(indices) > maxListed {
+		indices = indices[:maxListed]
+	}
+	var largest []string
+	for _, i := range indices {
+		layer := manifest.Layers[i]
+		largest = append(largest, fmt.Sprintf("layer %d %s (%s)",
+			i, layer.Digest, units.BytesSize(float64(layer.Size))))
+	}
+	return fmt.Errorf("%s; largest layers: %s",
+		strings.Join(problems, "; "), strings.Join(largest, ", "))
+}
+
+// writeLayerReport prints the layer report of the image to stdout, in the
+// format set by --layer-report. With --quiet, it is printed to stderr, so that
+// stdout only has the result of the build.
+func (cmd *buildCmd) writeLayerReport(
+	buildContext *context.BuildContext, manifest *image.DistributionManifest) error {
+
+	report, err := builder.NewImageReport(buildContext.ImageStore, manifest, cmd.reportFiles)
+	if err != nil {
+		return fmt.Errorf("create report: %s", err)
+	}
+	out := cmd.stdout
+	if cmd.quiet {
+		out = cmd.stderr
+	}
+	if cmd.layerReport == "json" {
+		return report.WriteJSON(out)
+	}
+	return report.WriteText(out)
 }
 
 func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
@@ -108,18 +703,144 @@ func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
 	), nil
 }
 
-// pushImage pushes the specified image to docker registry.
-// Exits with non-0 status code if it encounters an error.
-func pushImage(buildContext *context.BuildContext, imageName image.Name) error {
+// manifestDigests holds the digests of the manifests of the built image, for
+// each format selected by --manifest-format. Unselected formats are empty.
+type manifestDigests struct {
+	docker image.Digest
+	oci    image.Digest
+}
+
+// getManifestDigests computes the digests of the image manifest in the
+// formats selected by --manifest-format, and logs them.
+func (cmd *buildCmd) getManifestDigests(
+	manifest *image.DistributionManifest) (manifestDigests, error) {
+
+	var digests manifestDigests
+	if cmd.manifestFormat != "oci" {
+		digest, err := cmd.buildOptions.Registry.ManifestDigest(manifest)
+		if err != nil {
+			return digests, err
+		}
+		digests.docker = digest
+		log.Infof("Docker manifest digest is %s", digest)
+	}
+	if cmd.manifestFormat != "docker" {
+		oci := cmd.buildOptions.Registry.OCIManifest(manifest)
+		digest, err := cmd.buildOptions.Registry.ManifestDigest(&oci)
+		if err != nil {
+			return digests, err
+		}
+		digests.oci = digest
+		log.Infof("OCI manifest digest is %s", digest)
+	}
+	return digests, nil
+}
+
+// pushImage pushes the specified image to docker registry, in the formats
+// selected by --manifest-format. A tag can only reference one manifest, so with
+// 'both' the OCI manifest is pushed by digest.
+// If --push-digest-only is set, the image is pushed by digest and its tag is
+// left untouched in the registry. If --verify-push is set, the pushed
+// references must resolve to the given manifest digests.
+// It returns the pushed references, as given by pushedName, with the digests
+// of the manifests pushed under them.
+func (cmd *buildCmd) pushImage(
+	buildContext *context.BuildContext, imageName image.Name,
+	digests manifestDigests) (map[string]image.Digest, error) {
+
+	result := make(map[string]image.Digest)
 	registryClient := registry.New(
-		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository())
-	if err := registryClient.Push(imageName.GetTag()); err != nil {
-		return fmt.Errorf("failed to push image: %s", err)
+		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository()).
+		WithOptions(buildContext.Options.Registry)
+	if digests.docker != "" {
+		reference, digest := imageName.GetTag(), digests.docker
+		if cmd.digestOnly {
+			pushed, err := registryClient.PushDigest(imageName.GetTag())
+			if err != nil {
+				return nil, fmt.Errorf("failed to push image: %w", err)
+			}
+			reference, digest = string(pushed), pushed
+		} else if err := registryClient.Push(imageName.GetTag()); err != nil {
+			return nil, fmt.Errorf("failed to push image: %w", err)
+		}
+		if err := cmd.verifyPushed(registryClient, reference, digests.docker); err != nil {
+			return nil, err
+		}
+		cmd.logPushed(imageName, reference)
+		result[pushedName(imageName, reference)] = digest
+	}
+	if digests.oci != "" {
+		byDigest := cmd.digestOnly || digests.docker != ""
+		pushed, err := registryClient.PushOCI(imageName.GetTag(), byDigest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to push OCI image: %w", err)
+		}
+		reference := imageName.GetTag()
+		if byDigest {
+			reference = string(pushed)
+		}
+		if err := cmd.verifyPushed(registryClient, reference, digests.oci); err != nil {
+			return nil, err
+		}
+		cmd.logPushed(imageName, reference)
+		result[pushedName(imageName, reference)] = pushed
+	}
+	return result, nil
+}
+
+// verifyPushed checks the pushed reference if --verify-push is set.
+func (cmd *buildCmd) verifyPushed(
+	registryClient *registry.DockerRegistryClient, reference string, digest image.Digest) error {
+
+	if !cmd.verifyPush {
+		return nil
+	}
+	if err := registryClient.VerifyManifestDigest(reference, digest); err != nil {
+		return fmt.Errorf("failed to verify pushed image: %s", err)
 	}
-	log.Infof("Successfully pushed %s to %s", imageName, imageName.GetRegistry())
 	return nil
 }
 
+// writeDigestMap writes the JSON map of the pushed references to the digest
+// of the manifest pushed under them to <digest-map-file>.
+func (cmd *buildCmd) writeDigestMap(pushed map[string]image.Digest) error {
+	content, err := json.MarshalIndent(pushed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal digest map: %s", err)
+	}
+	if err := ioutil.WriteFile(cmd.digestMapFile, content, 0644); err != nil {
+		return fmt.Errorf("write %s: %s", cmd.digestMapFile, err)
+	}
+	return nil
+}
+
+// pushedName returns the full name an image was pushed under, i.e.
+// "<registry>/<repo>:<tag>" if the reference is its tag, or
+// "<registry>/<repo>@<digest>" if it is a digest.
+func pushedName(imageName image.Name, reference string) string {
+	if reference == imageName.GetTag() {
+		return imageName.String()
+	}
+	return fmt.Sprintf("%s/%s@%s", imageName.GetRegistry(), imageName.GetRepository(), reference)
+}
+
+func (cmd *buildCmd) logPushed(imageName image.Name, reference string) {
+	if reference != imageName.GetTag() {
+		log.Infof("Successfully pushed %s/%s@%s", imageName.GetRegistry(), imageName.GetRepository(), reference)
+	} else {
+		log.Infof("Successfully pushed %s to %s", imageName, imageName.GetRegistry())
+	}
+}
+
+// isTransientError returns true if the build failed because of the registry
+// or the network, rather than the dockerfile, so that it may succeed if run
+// again.
+func isTransientError(err error) bool {
+	return errors.Is(err, registry.ErrNetwork) ||
+		errors.Is(err, registry.ErrRateLimited) ||
+		errors.Is(err, registry.ErrUnavailable)
+}
+
 // loadImage loads the image into the local docker daemon.
 // This is only used for testing purposes.
 func (cmd *buildCmd) loadImage(buildContext *context.BuildContext, imageName image.Name) error {
@@ -152,6 +873,22 @@ func (cmd *buildCmd) saveImage(buildContext *context.BuildContext, imageName ima
 	return nil
 }
 
+// exportRootFS writes the filesystem of the image into <export-rootfs>.
+func (cmd *buildCmd) exportRootFS(
+	buildContext *context.BuildContext, manifest *image.DistributionManifest) error {
+
+	log.Infof("Exporting rootfs at location %s", cmd.rootfsFile)
+	f, err := os.Create(cmd.rootfsFile)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", cmd.rootfsFile, err)
+	}
+	if err := builder.ExportRootFS(buildContext.ImageStore, manifest, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // cleanManifest removes specified image manifest from local filesystem.
 func cleanManifest(buildContext *context.BuildContext, imageName image.Name) error {
 	repo, tag := imageName.GetRepository(), imageName.GetTag()
@@ -164,9 +901,23 @@ func cleanManifest(buildContext *context.BuildContext, imageName image.Name) err
 
 // newCacheManager inits and returns a cache manager object.
 func (cmd *buildCmd) newCacheManager(buildContext *context.BuildContext, imageName image.Name) cache.Manager {
+	opts := cache.Options{PushWorkers: cmd.cachePushWorkers, ReadThrough: cmd.cacheReadThrough}
+	if cacheRepo, _ := cmd.getCacheRepo(); cacheRepo != nil {
+		log.Infof("Using registry repository %s for cache storage", cmd.cacheRepo)
+
+		registryClient := registry.New(
+			buildContext.ImageStore, cacheRepo.GetRegistry(), cacheRepo.GetRepository()).
+			WithOptions(buildContext.Options.Registry)
+		kvStore := cache.NewRegistryStore(buildContext.ImageStore, registryClient)
+		return cache.NewWithLocalStore(
+			buildContext.ImageStore, kvStore, cmd.newCommittedLayersStore(buildContext), registryClient, opts)
+	}
+
 	var kvStore keyvalue.Store
 	var err error
-	if cmd.redisCacheAddress != "" {
+	if len(cmd.cacheBackends) > 0 {
+		kvStore = cmd.newCacheBackendsStore(buildContext)
+	} else if cmd.redisCacheAddress != "" {
 		log.Infof("Using redis at %s for cacheID storage", cmd.redisCacheAddress)
 
 		kvStore, err = keyvalue.NewRedisStore(cmd.redisCacheAddress, cmd.redisCacheTTL)
@@ -201,9 +952,54 @@ func (cmd *buildCmd) newCacheManager(buildContext *context.BuildContext, imageNa
 	} else {
 		registryAddr := cmd.pushRegistries[0]
 		registryClient = registry.New(
-			buildContext.ImageStore, registryAddr, imageName.GetRepository())
+			buildContext.ImageStore, registryAddr, imageName.GetRepository()).
+			WithOptions(buildContext.Options.Registry)
+	}
+	return cache.NewWithLocalStore(
+		buildContext.ImageStore, kvStore, cmd.newCommittedLayersStore(buildContext), registryClient, opts)
+}
+
+// newInlineCacheManager wraps cacheMgr to look up cache IDs in the inline
+// cache of the --cache-from images first. Images that fail to be pulled are
+// skipped, as their cache is only an optimization.
+func (cmd *buildCmd) newInlineCacheManager(
+	buildContext *context.BuildContext, cacheMgr cache.Manager) cache.Manager {
+
+	var sources []*cache.InlineSource
+	for _, from := range cmd.cacheFrom {
+		name, err := image.ParseNameForPull(from)
+		if err != nil {
+			log.Errorf("Failed to parse cache image %s: %s", from, err)
+			continue
+		}
+		registryClient := registry.New(
+			buildContext.ImageStore, name.GetRegistry(), name.GetRepository()).
+			WithOptions(buildContext.Options.Registry)
+		source, err := cache.PullInlineSource(buildContext.ImageStore, registryClient, name.GetTag())
+		if err != nil {
+			log.Errorf("Failed to pull inline cache of %s: %s", from, err)
+			continue
+		}
+		log.Infof("Using %d inline cache entries of %s", len(source.Entries), from)
+		sources = append(sources, source)
+	}
+	return cache.NewInlineCacheManager(cacheMgr, buildContext.ImageStore, sources)
+}
+
+// newCommittedLayersStore returns the local store of the layers committed by
+// builds, which lets builds whose push failed be resumed without executing
+// their steps again. It returns nil if --local-cache-ttl is 0.
+func (cmd *buildCmd) newCommittedLayersStore(buildContext *context.BuildContext) keyvalue.Store {
+	if cmd.localCacheTTL == 0 {
+		return nil
+	}
+	fullpath := path.Join(buildContext.ImageStore.RootDir, pathutils.CommittedLayersFileName)
+	store, err := keyvalue.NewFSStore(fullpath, buildContext.ImageStore.SandboxDir, cmd.localCacheTTL)
+	if err != nil {
+		log.Errorf("Failed to init local committed layers store: %s", err)
+		return nil
 	}
-	return cache.New(buildContext.ImageStore, kvStore, registryClient)
+	return store
 }
 
 func maybeBlacklistVarRun() error {
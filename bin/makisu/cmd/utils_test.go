@@ -0,0 +1,56 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushedName(t *testing.T) {
+	require := require.New(t)
+
+	name := image.MustParseName("registry.dev/team/repo:1.0")
+	require.Equal("registry.dev/team/repo:1.0", pushedName(name, "1.0"))
+	require.Equal("registry.dev/team/repo@sha256:ab12", pushedName(name, "sha256:ab12"))
+}
+
+func TestWriteDigestMap(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "makisu-digest-map")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cmd := &buildCmd{digestMapFile: filepath.Join(dir, "digests.json")}
+	pushed := map[string]image.Digest{
+		"registry-a.dev/repo@sha256:aa": "sha256:aa",
+		"registry-b.dev/repo@sha256:bb": "sha256:bb",
+	}
+	require.NoError(cmd.writeDigestMap(pushed))
+
+	content, err := ioutil.ReadFile(cmd.digestMapFile)
+	require.NoError(err)
+	var parsed map[string]image.Digest
+	require.NoError(json.Unmarshal(content, &parsed))
+	require.Equal(pushed, parsed)
+}
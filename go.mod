@@ -1,6 +1,6 @@
 module github.com/uber/makisu
 
-go 1.12
+go 1.13
 
 require (
 	github.com/AlekSi/gocov-xml v0.0.0-20190121064608-3a14fb1c4737
@@ -14,7 +14,7 @@ require (
 	github.com/docker/engine-api v0.4.0
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-metrics v0.0.0-20181218153428-b84716841b82 // indirect
-	github.com/docker/go-units v0.3.3 // indirect
+	github.com/docker/go-units v0.3.3
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7 // indirect
 	github.com/go-redis/redis v6.14.2+incompatible
 	github.com/golang/mock v1.2.0
@@ -23,7 +23,7 @@ require (
 	github.com/gorilla/mux v1.6.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/juju/ratelimit v1.0.1
-	github.com/klauspost/compress v1.4.1 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/klauspost/cpuid v1.2.0 // indirect
 	github.com/klauspost/pgzip v1.2.1
 	github.com/matm/gocov-html v0.0.0-20160206185555-f6dd0fd0ebc7
@@ -17,6 +17,8 @@ package builder
 import (
 	"archive/tar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -25,6 +27,7 @@ import (
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/progress"
 	"github.com/uber/makisu/lib/tario"
 )
 
@@ -45,6 +48,11 @@ type buildNode struct {
 
 	// digestPair are the layer(s) committed or fetched by this node.
 	digestPairs []*image.DigestPair
+
+	// squashed is true if the node doesn't commit a layer regardless of its
+	// commit annotation, leaving its changes to the next committed layer, to
+	// keep the image under the max layer count.
+	squashed bool
 }
 
 // newBuildNode initializes a buildNode.
@@ -55,6 +63,22 @@ func newBuildNode(ctx *context.BuildContext, step step.BuildStep) *buildNode {
 	}
 }
 
+// HasCommit returns whether the step of the node has a commit annotation and
+// isn't squashed.
+func (n *buildNode) HasCommit() bool {
+	return n.BuildStep.HasCommit() && !n.squashed
+}
+
+// producesLayer returns true if the step of the node changes the file system,
+// so that the commit of this node or a following one generates a layer.
+func (n *buildNode) producesLayer() bool {
+	switch n.BuildStep.(type) {
+	case *step.AddStep, *step.CopyStep, *step.RunStep, *step.CustomStep:
+		return true
+	}
+	return false
+}
+
 // Build applies the image config, builds the step unless it should be skipped or was cached, and
 // generates a resulting config for the next step. Also pushes cache layers if this step commits
 // a layer.
@@ -65,16 +89,26 @@ func (n *buildNode) Build(
 
 	// Always apply config.
 	if err := n.ApplyCtxAndConfig(n.ctx, prevConfig); err != nil {
-		return nil, fmt.Errorf("apply config: %s", err)
+		return nil, fmt.Errorf("apply config: %w", err)
 	}
 
 	cached := n.digestPairs != nil
 	if cached {
 		// The step was cached.
 		// Update MemFS, and only untar layers if modifyFS is strue.
-		for _, pair := range n.digestPairs {
-			if err := n.applyLayer(pair, opts.modifyFS); err != nil {
-				return nil, fmt.Errorf("apply cache: %s", err)
+		for i, pair := range n.digestPairs {
+			diffID, err := n.applyLayer(pair, opts.modifyFS)
+			if err != nil {
+				return nil, fmt.Errorf("apply cache: %w", err)
+			} else if diffID != pair.TarDigest {
+				// The diff ID of the cache entry is wrong, use the one of the
+				// content instead. The pairs can be shared with other stages.
+				log.Warnf("* Cache layer %s has diff ID %s instead of %s, using the former",
+					pair.GzipDescriptor.Digest, diffID, pair.TarDigest)
+				fixed := *pair
+				fixed.TarDigest = diffID
+				n.digestPairs = append([]*image.DigestPair(nil), n.digestPairs...)
+				n.digestPairs[i] = &fixed
 			}
 		}
 	}
@@ -84,26 +118,36 @@ func (n *buildNode) Build(
 	} else if cached {
 		log.Infof("* Skipping execution; cache was applied *")
 	} else if err := n.doExecute(cacheMgr, opts); err != nil {
-		return nil, fmt.Errorf("do execute: %s", err)
+		return nil, fmt.Errorf("do execute: %w", err)
 	} else if !n.HasCommit() && !opts.forceCommit {
 		log.Infof("* Not committing step %s", n.String())
 	} else if err := n.doCommit(cacheMgr, opts); err != nil {
-		return nil, fmt.Errorf("do commit: %s", err)
+		return nil, fmt.Errorf("do commit: %w", err)
 	}
 
 	// Always generate a new config.
 	config, err := n.UpdateCtxAndConfig(n.ctx, prevConfig)
 	if err != nil {
-		return nil, fmt.Errorf("generate config: %s", err)
+		return nil, fmt.Errorf("generate config: %w", err)
 	}
 	return config, nil
 }
 
+// cacheStatus returns how the node is going to be built with the given options.
+func (n *buildNode) cacheStatus(opts *buildNodeOptions) progress.CacheStatus {
+	if opts.skipBuild {
+		return progress.CacheSkipped
+	} else if n.digestPairs != nil {
+		return progress.CacheHit
+	}
+	return progress.CacheMiss
+}
+
 func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) error {
 	var err error
 	n.digestPairs, err = n.Commit(n.ctx)
 	if err != nil {
-		return fmt.Errorf("commit: %s", err)
+		return fmt.Errorf("commit: %w", err)
 	}
 
 	// If the number of digestPairs is greater than 1 then we cannot push
@@ -113,7 +157,7 @@ func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) err
 	}
 
 	if err := n.pushCacheLayer(cacheMgr); err != nil {
-		return fmt.Errorf("push cache: %s", err)
+		return fmt.Errorf("push cache: %w", err)
 	}
 	return nil
 }
@@ -122,29 +166,36 @@ func (n *buildNode) doExecute(cacheMgr cache.Manager, opts *buildNodeOptions) er
 	start := time.Now()
 	err := n.Execute(n.ctx, opts.modifyFS)
 	if err != nil {
-		return fmt.Errorf("execute step: %s", err)
+		return fmt.Errorf("execute step: %w", err)
 	}
 	log.Infof("* Execute %s took %v", n.String(), time.Since(start))
 	return nil
 }
 
-// applyLayer applies the layer to the current memFS.
+// applyLayer applies the layer to the current memFS, and returns the digest of
+// its uncompressed content.
 // If modifyfs is true, writes it to the local file system.
-func (n *buildNode) applyLayer(digestPair *image.DigestPair, modifyfs bool) error {
+func (n *buildNode) applyLayer(digestPair *image.DigestPair, modifyfs bool) (image.Digest, error) {
 	reader, err := n.ctx.ImageStore.Layers.GetStoreFileReader(digestPair.GzipDescriptor.Digest.Hex())
 	if err != nil {
-		return fmt.Errorf("get reader from layer: %s", err)
+		return "", fmt.Errorf("get reader from layer: %w", err)
 	}
-	gzipReader, err := tario.NewGzipReader(reader)
+	gzipReader, err := tario.NewLayerReader(reader)
 	if err != nil {
-		return fmt.Errorf("create gzip reader for layer: %s", err)
+		return "", fmt.Errorf("create layer reader: %w", err)
 	}
 	log.Infof("* Applying cache layer %s (unpack=%v)",
 		digestPair.GzipDescriptor.Digest.Hex(), modifyfs)
-	if err := n.ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyfs); err != nil {
-		return fmt.Errorf("untar reader: %s", err)
+	digester := image.NewDigester()
+	r := io.TeeReader(gzipReader, digester)
+	if err := n.ctx.MemFS.UpdateFromTarReader(tar.NewReader(r), modifyfs); err != nil {
+		return "", fmt.Errorf("untar reader: %w", err)
 	}
-	return nil
+	// The tar reader stops at the end of archive marker, before the padding.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", fmt.Errorf("read layer: %w", err)
+	}
+	return digester.Digest(), nil
 }
 
 // pushCacheLayers pushs cached layers for this node's digest pair(s).
@@ -15,14 +15,24 @@
 package builder
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/concurrency"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/stringset"
 )
 
@@ -31,6 +41,45 @@ type buildPlanOptions struct {
 	allowModifyFS bool
 }
 
+// configOverrides wraps user provided changes to the config of the final
+// image, which don't affect its layers.
+type configOverrides struct {
+	clearEntrypoint bool
+	setCmd          bool
+	cmd             []string
+	labels          map[string]string
+	variant         string
+	osVersion       string
+}
+
+// apply updates the config with the overrides.
+func (o configOverrides) apply(config *image.Config) {
+	if o.variant != "" {
+		config.Variant = o.variant
+	}
+	if o.osVersion != "" {
+		config.OSVersion = o.osVersion
+	}
+	if !o.clearEntrypoint && !o.setCmd && len(o.labels) == 0 {
+		return
+	}
+	if config.Config == nil {
+		config.Config = &image.ContainerConfig{}
+	}
+	if o.clearEntrypoint {
+		config.Config.Entrypoint = nil
+	}
+	if o.setCmd {
+		config.Config.Cmd = o.cmd
+		if len(o.cmd) == 0 {
+			config.Config.Cmd = nil
+		}
+	}
+	if len(o.labels) > 0 {
+		config.Config.Labels = utils.MergeStringMaps(config.Config.Labels, o.labels)
+	}
+}
+
 // BuildPlan describes a list of named buildStages, that can copy files between
 // one another.
 type BuildPlan struct {
@@ -42,6 +91,43 @@ type BuildPlan struct {
 	stages            []*buildStage
 	remoteImageStages map[string]*buildStage
 
+	// history is kept out of opts since it doesn't affect the layers, and
+	// opts is part of the cache ID seed.
+	history *historyOptions
+
+	// maxLayers limits the layer count of the final image if it isn't 0.
+	maxLayers int
+
+	// stageWorkers is the number of stages prepared concurrently.
+	stageWorkers int
+
+	// overrides are applied to the config of the final image once it is
+	// built.
+	overrides configOverrides
+
+	// inlineCache records the cache entries of the final stage in the config
+	// of the final image if true.
+	inlineCache bool
+
+	// preflight validates all the base images before executing any step if
+	// true.
+	preflight bool
+
+	// incrementalFrom is the prior image the final image is rebased onto, if
+	// set.
+	incrementalFrom string
+
+	// layerCompression is the compression the layers of the final image are
+	// converted to, if set.
+	layerCompression LayerCompression
+
+	// postProcessors transform the layers of the final image, in order.
+	postProcessors []namedPostProcessor
+
+	// verifyDiffIDs checks the diff IDs of the final image against its layers
+	// once it is saved if true.
+	verifyDiffIDs bool
+
 	opts *buildPlanOptions
 }
 
@@ -67,7 +153,10 @@ func NewBuildPlan(
 
 	aliases, err := buildAliases(parsedStages)
 	if err != nil {
-		return nil, fmt.Errorf("build alias list: %s", err)
+		return nil, fmt.Errorf("build alias list: %w", err)
+	}
+	if err := resolveCopyFromStages(ctx.Options, parsedStages); err != nil {
+		return nil, fmt.Errorf("resolve copy from stages: %w", err)
 	}
 
 	digestPairs := make(image.DigestPairMap)
@@ -76,7 +165,7 @@ func NewBuildPlan(
 		stage, err := newBuildStage(
 			ctx, parsedStage.From.Alias, parsedStage, digestPairs, plan.opts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert parsed stage: %s", err)
+			return nil, fmt.Errorf("failed to convert parsed stage: %w", err)
 		}
 
 		if len(stage.copyFromDirs) > 0 && !plan.opts.allowModifyFS {
@@ -87,11 +176,241 @@ func NewBuildPlan(
 	}
 
 	if err := plan.handleCopyFromDirs(aliases, digestPairs); err != nil {
-		return nil, fmt.Errorf("handle cross refs: %s", err)
+		return nil, fmt.Errorf("handle cross refs: %w", err)
 	}
 	return plan, nil
 }
 
+// SetHistory sets the author of the final image, and the comments attached to
+// the history entries of the layers committed by the steps of the final stage.
+// Comments are keyed by 1-based step number.
+func (plan *BuildPlan) SetHistory(author string, comments map[int]string) {
+	if plan.history == nil {
+		plan.history = &historyOptions{}
+	}
+	plan.history.author = author
+	plan.history.comments = comments
+}
+
+// SetCreated sets the created time of the config of the final image, and of
+// the history entries of the layers committed by the steps of the final stage.
+func (plan *BuildPlan) SetCreated(created Created) {
+	if plan.history == nil {
+		plan.history = &historyOptions{}
+	}
+	plan.history.created = created
+}
+
+// SetEmptyLayerHistory adds history entries marked as empty layers for the
+// steps of the final stage that don't commit a layer, like docker does for
+// ENV, LABEL and other metadata-only steps.
+func (plan *BuildPlan) SetEmptyLayerHistory(enabled bool) {
+	if plan.history == nil {
+		plan.history = &historyOptions{}
+	}
+	plan.history.emptyLayers = enabled
+}
+
+// SetMaxLayers limits the number of layers of the final image, including the
+// ones of its base image. If the steps of the final stage would commit more
+// layers, the trailing ones are squashed into the last layer. A max of 0 means
+// no limit.
+func (plan *BuildPlan) SetMaxLayers(max int) {
+	plan.maxLayers = max
+}
+
+// SetStageWorkers sets the number of stages whose cache is pulled, and of
+// remote images referenced by COPY --from that are pulled, concurrently before
+// the build. The stages themselves are still built one after another, as the
+// steps of all stages run in the same root filesystem.
+func (plan *BuildPlan) SetStageWorkers(n int) {
+	plan.stageWorkers = n
+}
+
+// SetInlineCache records the cache IDs of the steps of the final stage and the
+// layers they committed in the config of the final image, so that builds
+// reading it with cache.NewInlineCacheManager can reuse its layers.
+func (plan *BuildPlan) SetInlineCache(enabled bool) {
+	plan.inlineCache = enabled
+}
+
+// SetPreflight makes Execute validate the images of all FROM and COPY --from
+// steps before executing any step, so that a missing image, one that can't be
+// pulled with the configured credentials or one for another platform doesn't
+// fail the build after the stages before it were built.
+func (plan *BuildPlan) SetPreflight(enabled bool) {
+	plan.preflight = enabled
+}
+
+// SetLayerCompression makes Execute convert the layers of the final image that
+// have another compression, like the layers of a base image, to the given one.
+func (plan *BuildPlan) SetLayerCompression(compression LayerCompression) {
+	plan.layerCompression = compression
+}
+
+// SetLayerPostProcessors makes Execute pipe the layers of the final image
+// through the post-processors registered under the names, in order. Their
+// digests and the diff IDs of the image are computed from the output.
+func (plan *BuildPlan) SetLayerPostProcessors(names []string) error {
+	processors, err := getLayerPostProcessors(names)
+	if err != nil {
+		return err
+	}
+	plan.postProcessors = processors
+	return nil
+}
+
+// SetVerifyDiffIDs makes Execute fail if the diff IDs of the config of the
+// final image aren't the digests of the uncompressed content of its layers.
+func (plan *BuildPlan) SetVerifyDiffIDs(enabled bool) {
+	plan.verifyDiffIDs = enabled
+}
+
+// SetIncrementalFrom makes Execute produce the final image as the layers of
+// the prior image followed by a single layer of the files that changed since
+// it, instead of the layers of its steps.
+func (plan *BuildPlan) SetIncrementalFrom(prior string) {
+	plan.incrementalFrom = prior
+}
+
+// SetStageResources overrides the resources and isolation of the RUN steps of
+// the stages, keyed by alias or index for stages without alias. Like aliases,
+// the keys are case insensitive. It fails if a key isn't a stage of the plan.
+func (plan *BuildPlan) SetStageResources(resources map[string]*context.StageResources) error {
+	stages := make(map[string]*buildStage, len(plan.stages))
+	aliases := make([]string, 0, len(plan.stages))
+	for _, stage := range plan.stages {
+		stages[stage.alias] = stage
+		aliases = append(aliases, stage.alias)
+	}
+	for name, r := range resources {
+		stage, ok := stages[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown stage %s, stages are: %s", name, strings.Join(aliases, ", "))
+		}
+		stage.ctx.Resources = r
+	}
+	return nil
+}
+
+// ClearEntrypoint removes the entrypoint from the config of the final image.
+func (plan *BuildPlan) ClearEntrypoint() {
+	plan.overrides.clearEntrypoint = true
+}
+
+// SetCmd replaces the cmd in the config of the final image. An empty cmd
+// clears it.
+func (plan *BuildPlan) SetCmd(cmd []string) {
+	plan.overrides.cmd = cmd
+	plan.overrides.setCmd = true
+}
+
+// AddLabels sets labels in the config of the final image, replacing the ones
+// with the same keys set by the dockerfile or inherited from the base image.
+func (plan *BuildPlan) AddLabels(labels map[string]string) {
+	plan.overrides.labels = utils.MergeStringMaps(plan.overrides.labels, labels)
+}
+
+// SetVariant sets the architecture variant, like "v7", in the config of the
+// final image, instead of the one inherited from the base image.
+func (plan *BuildPlan) SetVariant(variant string) {
+	plan.overrides.variant = variant
+}
+
+// SetOSVersion sets the OS version in the config of the final image, instead
+// of the one inherited from the base image.
+func (plan *BuildPlan) SetOSVersion(osVersion string) {
+	plan.overrides.osVersion = osVersion
+}
+
+// StripHistory redacts the commands from the history of the final image,
+// including the entries inherited from the base image. Entries with commands
+// matching any of the keep patterns are left untouched.
+func (plan *BuildPlan) StripHistory(keep []*regexp.Regexp) {
+	if plan.history == nil {
+		plan.history = &historyOptions{}
+	}
+	plan.history.strip = true
+	plan.history.keep = keep
+}
+
+// BaseImage is an image the build depends on, either as the base of a stage or
+// as the source of COPY --from.
+type BaseImage struct {
+	Name   string
+	Digest image.Digest
+}
+
+// BaseImages returns the images the build depends on, with the digests of
+// their manifests, resolved from the registry if they weren't already.
+func (plan *BuildPlan) BaseImages() ([]BaseImage, error) {
+	var images []BaseImage
+	for _, stage := range plan.baseImageStages() {
+		from := stage.nodes[0].BuildStep.(*step.FromStep)
+		digest, err := from.ResolveDigest(stage.ctx)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, BaseImage{from.GetImage(), digest})
+	}
+	return images, nil
+}
+
+// baseImageStages returns the first stage of the plan, in the order of the
+// dockerfile then of the images referenced by COPY --from, for each image the
+// build depends on.
+func (plan *BuildPlan) baseImageStages() []*buildStage {
+	stages := append([]*buildStage{}, plan.stages...)
+	aliases := make([]string, 0, len(plan.remoteImageStages))
+	for alias := range plan.remoteImageStages {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		stages = append(stages, plan.remoteImageStages[alias])
+	}
+
+	var result []*buildStage
+	seen := make(map[string]bool)
+	for _, stage := range stages {
+		from, ok := stage.nodes[0].BuildStep.(*step.FromStep)
+		if !ok || from.IsScratch() || seen[from.GetImage()] {
+			continue
+		}
+		seen[from.GetImage()] = true
+		result = append(result, stage)
+	}
+	return result
+}
+
+// validateBaseImages validates all the images the build depends on, using
+// the stage workers. All the invalid images are reported, not only the first.
+func (plan *BuildPlan) validateBaseImages() error {
+	workers := plan.stageWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	multiError := utils.NewMultiErrors()
+	pool := concurrency.NewWorkerPool(workers)
+	for _, stage := range plan.baseImageStages() {
+		s := stage
+		pool.Do(func() {
+			from := s.nodes[0].BuildStep.(*step.FromStep)
+			if err := from.Validate(s.ctx); err != nil {
+				multiError.Add(err)
+				return
+			}
+			log.Infof("* Validated image %s", from.GetImage())
+		})
+	}
+	pool.Wait()
+	if err := multiError.Collect(); err != nil {
+		return fmt.Errorf("validate base images: %w", err)
+	}
+	return nil
+}
+
 // handleCopyFromDirs goes through all of the stages in the build plan and looks
 // at the `COPY --from` steps to make sure they are valid. If the --from source
 // is another image, we create a new image stage in the build plan.
@@ -112,7 +431,7 @@ func (plan *BuildPlan) handleCopyFromDirs(
 				remoteImageStage, err := newRemoteImageStage(
 					plan.baseCtx, alias, digestPairs, plan.opts)
 				if err != nil {
-					return fmt.Errorf("new image stage: %s", err)
+					return fmt.Errorf("new image stage: %w", err)
 				}
 				plan.remoteImageStages[alias] = remoteImageStage
 				aliases[alias] = true
@@ -126,18 +445,21 @@ func (plan *BuildPlan) handleCopyFromDirs(
 }
 
 // buildAliases mutates the list of stages to assign default aliases.
-// Default aliases will be integers starting from 0.
+// Default aliases will be integers starting from 0. Like Docker, stage names
+// are case insensitive, so the others are lowercased.
 func buildAliases(stages dockerfile.Stages) (map[string]bool, error) {
 	aliases := make(map[string]bool)
 	for i, parsedStage := range stages {
 		// Check for stage alias collision if alias isn't empty.
 		if parsedStage.From.Alias != "" {
-			if _, ok := aliases[parsedStage.From.Alias]; ok {
+			alias := strings.ToLower(parsedStage.From.Alias)
+			if _, ok := aliases[alias]; ok {
 				return nil, fmt.Errorf("duplicate stage alias: %s", parsedStage.From.Alias)
-			} else if _, err := strconv.Atoi(parsedStage.From.Alias); err == nil {
+			} else if _, err := strconv.Atoi(alias); err == nil {
 				// Docker would return `name can't start with a number or contain symbols`
 				return nil, fmt.Errorf("stage alias cannot be a number: %s", parsedStage.From.Alias)
 			}
+			parsedStage.From.Alias = alias
 		} else {
 			parsedStage.From.Alias = strconv.Itoa(i)
 		}
@@ -146,26 +468,147 @@ func buildAliases(stages dockerfile.Stages) (map[string]bool, error) {
 	return aliases, nil
 }
 
+// resolveCopyFromStages mutates the `COPY --from` directives of the stages to
+// reference other stages by their alias. Like Docker, references match stage
+// names case insensitively, or stage indexes, and can only point to earlier
+// stages. References that don't match any stage are named build contexts, or
+// else image names.
+func resolveCopyFromStages(opts *context.BuildOptions, stages dockerfile.Stages) error {
+	for _, parsedStage := range stages {
+		if isBuildContext(opts, parsedStage.From.Alias) {
+			return fmt.Errorf("build context %s has the same name as a stage", parsedStage.From.Alias)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, parsedStage := range stages {
+		for _, directive := range parsedStage.Directives {
+			copyDirective, ok := directive.(*dockerfile.CopyDirective)
+			if !ok || copyDirective.FromStage == "" {
+				continue
+			}
+			ref := copyDirective.FromStage
+			j := stageIndex(stages, ref)
+			if j < 0 {
+				name := strings.ToLower(ref)
+				if _, ok := opts.BuildContextDirs[name]; ok {
+					used[name] = true
+					continue
+				} else if img, ok := opts.BuildContextImages[name]; ok {
+					log.Infof("COPY --from=%s uses build context image %s", ref, img)
+					used[name] = true
+					copyDirective.FromStage = img
+					continue
+				}
+				if _, err := strconv.Atoi(ref); err == nil {
+					return fmt.Errorf("copy from undefined stage %s: index out of range [0, %d)",
+						ref, len(stages))
+				} else if name, err := image.ParseNameForPull(ref); err != nil || !name.IsValid() {
+					return fmt.Errorf("copy from undefined stage %s: not a stage name nor an image name", ref)
+				}
+				log.Infof("COPY --from=%s doesn't match any stage, using it as an image name", ref)
+				continue
+			} else if j >= i {
+				return stageReferenceError(stages, i, j, "COPY "+copyDirective.Args)
+			}
+			copyDirective.FromStage = stages[j].From.Alias
+		}
+	}
+
+	var unused []string
+	for name := range opts.BuildContextDirs {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	for name := range opts.BuildContextImages {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) != 0 {
+		sort.Strings(unused)
+		log.Warnf("Build contexts are not used by any COPY --from: %s", strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// isBuildContext returns true if name is the name of a named build context.
+func isBuildContext(opts *context.BuildOptions, name string) bool {
+	_, isDir := opts.BuildContextDirs[strings.ToLower(name)]
+	_, isImage := opts.BuildContextImages[strings.ToLower(name)]
+	return isDir || isImage
+}
+
+// stageReferenceError returns the error of the directive of stage i, which
+// references stage j, defined at or after it. It lists the stages that can be
+// referenced instead.
+func stageReferenceError(stages dockerfile.Stages, i, j int, directive string) error {
+	referenced := fmt.Sprintf("stage %s (#%d), which is defined after it", stages[j].From.Alias, j)
+	if i == j {
+		referenced = "its own stage"
+	}
+	earlier := []string{}
+	for k := 0; k < i; k++ {
+		earlier = append(earlier, fmt.Sprintf("%s (#%d)", stages[k].From.Alias, k))
+	}
+	valid := "none"
+	if len(earlier) > 0 {
+		valid = strings.Join(earlier, ", ")
+	}
+	return fmt.Errorf("stage %s (#%d): %s references %s; only earlier stages can be referenced: %s",
+		stages[i].From.Alias, i, directive, referenced, valid)
+}
+
+// stageIndex returns the index of the stage referenced by name or index, or -1
+// if no stage matches.
+func stageIndex(stages dockerfile.Stages, ref string) int {
+	if i, err := strconv.Atoi(ref); err == nil {
+		if i < 0 || i >= len(stages) {
+			return -1
+		}
+		return i
+	}
+	for i, parsedStage := range stages {
+		if parsedStage.From.Alias == strings.ToLower(ref) {
+			return i
+		}
+	}
+	return -1
+}
+
 // Execute executes all build stages in order.
 func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
-	// Execute pre-build procedures. Try to pull some reusable layers from the
-	// registry.
-	// TODO: Pull in parallel
-	for _, stage := range plan.stages {
-		stage.pullCacheLayers(plan.cacheMgr)
+	manifest, err := plan.execute()
+	if err != nil {
+		// The entries of the cache layers pushed before the failure are still
+		// stored, so that the next build doesn't execute their steps again.
+		if err := plan.cacheMgr.WaitForPush(); err != nil {
+			log.Errorf("Failed to push cache: %s", err)
+		}
+		return nil, err
 	}
+	return manifest, nil
+}
 
-	for alias, stage := range plan.remoteImageStages {
-		// Building that pseudo stage will unpack the image directly into the
-		// stage's cross stage directory.
-		name, err := image.ParseNameForPull(alias)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse cross stage reference name %s: %s", alias, err)
+func (plan *BuildPlan) execute() (*image.DistributionManifest, error) {
+	if plan.preflight {
+		if err := plan.validateBaseImages(); err != nil {
+			return nil, err
 		}
-		log.Infof("Pulling image %s for cross stage reference", name)
+	}
 
+	// Execute pre-build procedures. Try to pull some reusable layers from the
+	// registry, and extract the files referenced from remote images.
+	unpack, err := plan.prepareStages()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alias := range unpack {
+		stage := plan.remoteImageStages[alias]
 		if err := plan.executeStage(stage, false, true); err != nil {
-			return nil, fmt.Errorf("execute cross referenced stage: %s", err)
+			return nil, fmt.Errorf("execute cross referenced stage: %w", err)
 		}
 	}
 
@@ -176,9 +619,46 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 
 		lastStage := k == len(plan.stages)-1
 		_, copiedFrom := plan.copyFromDirs[currStage.alias]
+		if lastStage {
+			currStage.history = plan.history
+			currStage.maxLayers = plan.maxLayers
+		}
 
 		if err := plan.executeStage(currStage, lastStage, copiedFrom); err != nil {
-			return nil, fmt.Errorf("execute stage: %s", err)
+			return nil, fmt.Errorf("execute stage: %w", err)
+		}
+	}
+
+	plan.overrides.apply(currStage.lastImageConfig)
+
+	// Layers are converted before the inline cache is recorded, so that its
+	// entries reference the layers that are pushed.
+	if len(plan.postProcessors) > 0 {
+		if err := currStage.postProcessLayers(plan.postProcessors); err != nil {
+			return nil, fmt.Errorf("post-process layers: %w", err)
+		}
+	}
+	if plan.layerCompression != "" {
+		if err := currStage.transcodeLayers(plan.layerCompression); err != nil {
+			return nil, fmt.Errorf("transcode layers: %w", err)
+		}
+	}
+
+	// Don't inherit the inline cache of the base image, since its cache IDs
+	// don't describe the layers of this one.
+	currStage.lastImageConfig.InlineCache = nil
+	if plan.inlineCache {
+		currStage.lastImageConfig.InlineCache = currStage.inlineCache()
+	}
+	if plan.incrementalFrom != "" {
+		if err := currStage.rebase(plan.incrementalFrom); err != nil {
+			return nil, fmt.Errorf("rebase onto %s: %w", plan.incrementalFrom, err)
+		}
+		// The layers of the prior image replace the ones of the stage.
+		if plan.layerCompression != "" {
+			if err := currStage.transcodeLayers(plan.layerCompression); err != nil {
+				return nil, fmt.Errorf("transcode layers: %w", err)
+			}
 		}
 	}
 
@@ -191,12 +671,17 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	// Save image manifest.
 	manifest, err := currStage.saveManifest(plan.baseCtx.ImageStore, plan.target)
 	if err != nil {
-		return nil, fmt.Errorf("save image manifest %s: %s", plan.target, err)
+		return nil, fmt.Errorf("save image manifest %s: %w", plan.target, err)
+	}
+	if plan.verifyDiffIDs {
+		if err := verifyDiffIDs(plan.baseCtx.ImageStore, manifest); err != nil {
+			return nil, fmt.Errorf("verify diff IDs of %s: %w", plan.target, err)
+		}
 	}
 	for _, replica := range plan.replicas {
 		_, err := currStage.saveManifest(plan.baseCtx.ImageStore, replica)
 		if err != nil {
-			return nil, fmt.Errorf("save alias manifest %s: %s", replica, err)
+			return nil, fmt.Errorf("save alias manifest %s: %w", replica, err)
 		}
 	}
 
@@ -210,9 +695,82 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	return manifest, nil
 }
 
+// prepareStages pulls the cache layers of the stages and checkpoints the
+// remote images referenced by COPY --from, with up to stageWorkers of them
+// at a time, since neither touches the root filesystem. It returns the aliases
+// of the remote images that have to be unpacked to be checkpointed, which is
+// done sequentially by executing their stage, like other stages.
+// If any of them fails, the ones that haven't started are cancelled.
+func (plan *BuildPlan) prepareStages() ([]string, error) {
+	workers := plan.stageWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	var unpack []string
+	multiError := utils.NewMultiErrors()
+	pool := concurrency.NewWorkerPool(workers)
+	for _, stage := range plan.stages {
+		s := stage
+		pool.Do(func() {
+			s.pullCacheLayers(plan.cacheMgr)
+			log.Infof("* Pulled cache of stage %s", s.String())
+		})
+	}
+
+	aliases := make([]string, 0, len(plan.remoteImageStages))
+	for alias := range plan.remoteImageStages {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		a := alias
+		stage := plan.remoteImageStages[a]
+		pool.Do(func() {
+			// Building that pseudo stage will unpack the image directly into
+			// the stage's cross stage directory.
+			name, err := image.ParseNameForPull(a)
+			if err != nil {
+				multiError.Add(fmt.Errorf("failed to parse cross stage reference name %s: %w", a, err))
+				pool.Stop()
+				return
+			}
+			log.Infof("Pulling image %s for cross stage reference", name)
+
+			// Only extract the referenced files out of the image, unless they
+			// cannot be found without unpacking it.
+			err = stage.checkpointFromImage(plan.copyFromDirs[a])
+			if err == nil {
+				log.Infof("Extracted files of cross stage reference %s", name)
+				return
+			} else if !errors.Is(err, snapshot.ErrPartialCheckpointUnsupported) {
+				multiError.Add(fmt.Errorf("checkpoint cross referenced stage %s: %w", a, err))
+				pool.Stop()
+				return
+			}
+			log.Infof("Unpacking image %s for cross stage reference: %s", name, err)
+			if err := os.RemoveAll(stage.ctx.CopyFromRoot(a)); err != nil {
+				multiError.Add(fmt.Errorf("remove partial checkpoint of %s: %w", a, err))
+				pool.Stop()
+				return
+			}
+			mu.Lock()
+			unpack = append(unpack, a)
+			mu.Unlock()
+		})
+	}
+	pool.Wait()
+	if err := multiError.Collect(); err != nil {
+		return nil, err
+	}
+	sort.Strings(unpack)
+	return unpack, nil
+}
+
 func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom bool) error {
 	if err := stage.build(plan.cacheMgr, lastStage, copiedFrom); err != nil {
-		return fmt.Errorf("build stage %s: %s", stage.alias, err)
+		return fmt.Errorf("build stage %s: %w", stage.alias, err)
 	}
 
 	if !plan.opts.allowModifyFS {
@@ -220,10 +778,10 @@ func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom boo
 	}
 
 	if err := stage.checkpoint(plan.copyFromDirs[stage.alias]); err != nil {
-		return fmt.Errorf("checkpoint stage %s: %s", stage.alias, err)
+		return fmt.Errorf("checkpoint stage %s: %w", stage.alias, err)
 	}
 	if err := stage.cleanup(); err != nil {
-		return fmt.Errorf("cleanup stage %s: %s", stage.alias, err)
+		return fmt.Errorf("cleanup stage %s: %w", stage.alias, err)
 	}
 
 	return nil
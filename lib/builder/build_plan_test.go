@@ -15,15 +15,30 @@
 package builder
 
 import (
+	"archive/tar"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/progress"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/tario"
 
 	"github.com/stretchr/testify/require"
 )
@@ -38,7 +53,7 @@ func TestBuildPlanExecution(t *testing.T) {
 	envImage, err := image.ParseName("scratch")
 	require.NoError(err)
 
-	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
 	directives := []dockerfile.Directive{
@@ -66,6 +81,120 @@ func TestBuildPlanExecution(t *testing.T) {
 	require.Equal(2, len(config.RootFS.DiffIDs))
 }
 
+func TestBuildPlanExecutionMaxLayers(t *testing.T) {
+	testCases := []struct {
+		name        string
+		forceCommit bool
+		maxLayers   int
+		layers      int
+	}{
+		{"explicit under max", false, 3, 3},
+		{"explicit over max", false, 2, 2},
+		{"explicit single layer", false, 1, 1},
+		{"implicit over max", true, 2, 2},
+		{"no max", true, 0, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+				dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+				dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+				dockerfile.EnvDirectiveFixture("TESTENV=test2", map[string]string{"TESTENV": "test2"}),
+				dockerfile.RunCommitDirectiveFixture("ls /", "ls /"),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, tc.forceCommit)
+			require.NoError(err)
+			plan.SetMaxLayers(tc.maxLayers)
+
+			manifest, err := plan.Execute()
+			require.NoError(err)
+			require.Len(manifest.Layers, tc.layers)
+
+			r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+			require.NoError(err)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			var config image.Config
+			require.NoError(json.Unmarshal(b, &config))
+			require.Len(config.History, tc.layers)
+			require.Len(config.RootFS.DiffIDs, tc.layers)
+		})
+	}
+}
+
+func TestBuildPlanBaseImagesScratch(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	stages := []*dockerfile.Stage{{from, nil}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	images, err := plan.BaseImages()
+	require.NoError(err)
+	require.Empty(images)
+}
+
+func TestBuildPlanExecutionReportsProgress(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	var events []progress.Event
+	ctx.Reporter = progress.ReporterFunc(func(e progress.Event) {
+		events = append(events, e)
+	})
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		dockerfile.RunDirectiveFixture("false", "false"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	_, err = plan.Execute()
+	require.Error(err)
+
+	require.Len(events, 6)
+	for i, e := range events {
+		step := i/2 + 1
+		require.Equal(step, e.Step)
+		require.Equal(3, e.Steps)
+		require.Equal(progress.CacheMiss, e.Cache)
+		if i%2 == 0 {
+			require.Equal(progress.StepStarted, e.Type)
+		} else {
+			require.Equal(progress.StepFinished, e.Type)
+			require.Equal(step == 3, e.Err != nil)
+		}
+	}
+	require.True(strings.HasPrefix(events[4].Description, "RUN false"))
+}
+
 func TestBuildPlanContextDirs(t *testing.T) {
 	require := require.New(t)
 
@@ -76,7 +205,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	envImage, err := image.ParseName("scratch")
 	require.NoError(err)
 
-	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	// Valid copies from previous stage.
 	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "stage1")
@@ -133,7 +262,7 @@ func TestBuildPlanBadRun(t *testing.T) {
 	envImage, err := image.ParseName("scratch")
 	require.NoError(err)
 
-	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
 	directives := []dockerfile.Directive{
@@ -159,7 +288,7 @@ func TestDuplicateStageAlias(t *testing.T) {
 	envImage, err := image.ParseName("scratch")
 	require.NoError(err)
 
-	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	// Same image same alias.
 	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias")
@@ -169,6 +298,14 @@ func TestDuplicateStageAlias(t *testing.T) {
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false)
 	require.Error(err)
 
+	// Same alias with different casing.
+	from1 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias")
+	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "Alias")
+	stages = []*dockerfile.Stage{{from1, nil}, {from2, nil}}
+
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false)
+	require.Error(err)
+
 	// Same image different alias.
 	from1 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias1")
 	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
@@ -177,3 +314,725 @@ func TestDuplicateStageAlias(t *testing.T) {
 	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false)
 	require.NoError(err)
 }
+
+func TestBuildPlanSetStageResources(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from1 := dockerfile.FromDirectiveFixture("", "scratch", "Compile")
+	from2 := dockerfile.FromDirectiveFixture("", "scratch", "")
+	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}}
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+
+	compile := &context.StageResources{CPUTime: time.Minute}
+	last := &context.StageResources{Network: context.NetworkNone}
+	require.NoError(plan.SetStageResources(map[string]*context.StageResources{
+		"COMPILE": compile,
+		"1":       last,
+	}))
+	require.Equal(compile, plan.stages[0].ctx.Resources)
+	require.Equal(last, plan.stages[1].ctx.Resources)
+
+	err = plan.SetStageResources(map[string]*context.StageResources{"test": last})
+	require.Error(err)
+	require.Contains(err.Error(), "unknown stage test, stages are: compile, 1")
+}
+
+func TestBuildPlanStageTimeout(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "slow")
+	run := dockerfile.RunDirectiveFixture("sleep 60", "sleep 60")
+	stages := []*dockerfile.Stage{{from, []dockerfile.Directive{run}}}
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	require.NoError(plan.SetStageResources(map[string]*context.StageResources{
+		"slow": {Timeout: 500 * time.Millisecond},
+	}))
+
+	start := time.Now()
+	_, err = plan.Execute()
+	require.Error(err)
+	require.True(errors.Is(err, context.ErrStageTimeout))
+	require.Contains(err.Error(), "stage slow exceeded its timeout of 500ms")
+	require.True(time.Since(start) < 30*time.Second)
+}
+
+func TestBuildPlanCopyFromStageReferences(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(t, err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	tests := []struct {
+		desc     string
+		alias    string
+		ref      string
+		expected string
+		hasError bool
+	}{
+		{"same case", "builder", "builder", "builder", false},
+		{"different case in copy", "builder", "Builder", "builder", false},
+		{"different case in from", "Builder", "builder", "builder", false},
+		{"index of named stage", "Builder", "0", "builder", false},
+		{"index of unnamed stage", "", "0", "0", false},
+		{"out of range index", "builder", "2", "", true},
+		{"negative index", "builder", "-1", "", true},
+		{"index of later stage", "builder", "1", "", true},
+		{"undefined name", "builder", "bad:stage:", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			from1 := dockerfile.FromDirectiveFixture("", envImage.String(), test.alias)
+			from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "")
+			directives2 := []dockerfile.Directive{
+				dockerfile.CopyDirectiveFixture("", "", test.ref, []string{"/hello"}, "/hello"),
+			}
+			stages := []*dockerfile.Stage{{from1, nil}, {from2, directives2}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+			if test.hasError {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Len(plan.copyFromDirs, 1)
+			require.Contains(plan.copyFromDirs, test.expected)
+			require.Empty(plan.remoteImageStages)
+		})
+	}
+}
+
+func TestBuildPlanCopyFromLaterStage(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	tests := []struct {
+		desc     string
+		ref      string
+		expected []string
+	}{
+		{"forward reference", "final", []string{
+			"stage builder (#1): COPY --from=final /hello /hello references stage final (#2), which is defined after it",
+			"only earlier stages can be referenced: base (#0)",
+		}},
+		{"forward reference by index", "2", []string{
+			"COPY --from=2 /hello /hello references stage final (#2)",
+		}},
+		{"self reference", "Builder", []string{
+			"stage builder (#1): COPY --from=Builder /hello /hello references its own stage",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			copyDirective := dockerfile.CopyDirectiveFixture(
+				"--from="+test.ref+" /hello /hello", "", test.ref, []string{"/hello"}, "/hello")
+			stages := []*dockerfile.Stage{
+				{dockerfile.FromDirectiveFixture("", "scratch", "base"), nil},
+				{dockerfile.FromDirectiveFixture("", "scratch", "builder"),
+					[]dockerfile.Directive{copyDirective}},
+				{dockerfile.FromDirectiveFixture("", "scratch", "final"), nil},
+			}
+
+			_, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+			require.Error(err)
+			for _, s := range test.expected {
+				require.Contains(err.Error(), s)
+			}
+		})
+	}
+}
+
+func TestBuildPlanCopyFromDigest(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+	digest := "sha256:e4355b66995c96b4b468159fc5c7e3540fcef961189ca13fee877798649f531a"
+
+	tests := []struct {
+		desc     string
+		ref      string
+		hasError bool
+	}{
+		{"digest", "alpine@" + digest, false},
+		{"tag and digest", "alpine:3.10@" + digest, false},
+		{"invalid digest", "alpine@sha256:1234", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.CopyDirectiveFixture("", "", test.ref, []string{"/etc"}, "/etc"),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+			if test.hasError {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Contains(plan.remoteImageStages, test.ref)
+			require.Contains(plan.copyFromDirs, test.ref)
+		})
+	}
+}
+
+func TestBuildPlanExecutionWithHistory(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	plan.SetHistory("someone", map[int]string{3: "list parent"})
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Equal("someone", config.Author)
+	require.Equal(2, len(config.History))
+	for _, history := range config.History {
+		require.Equal("someone", history.Author)
+	}
+	require.Equal("", config.History[0].Comment)
+	require.Equal("list parent", config.History[1].Comment)
+}
+
+func TestBuildPlanExecutionEmptyLayerHistory(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+		dockerfile.LabelDirectiveFixture("team=infra", map[string]string{"team": "infra"}),
+		dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true)
+	require.NoError(err)
+	plan.SetEmptyLayerHistory(true)
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Len(config.RootFS.DiffIDs, 2)
+	require.Len(config.History, 4)
+	for i, empty := range []bool{false, true, true, false} {
+		require.Equal(empty, config.History[i].EmptyLayer)
+	}
+	require.Contains(config.History[1].CreatedBy, "ENV TESTENV=test")
+	require.Contains(config.History[2].CreatedBy, "LABEL team=infra")
+}
+
+func TestBuildPlanExecutionConfigOverrides(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
+	directives := []dockerfile.Directive{
+		dockerfile.EntrypointDirectiveFixture("[\"/bin/app\"]", []string{"/bin/app"}),
+		dockerfile.CmdDirectiveFixture("[\"serve\"]", []string{"serve"}),
+		dockerfile.LabelDirectiveFixture("team=infra revision=old", map[string]string{
+			"team":     "infra",
+			"revision": "old",
+		}),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	plan.ClearEntrypoint()
+	plan.SetCmd([]string{"sh"})
+	plan.AddLabels(map[string]string{"revision": "abc123", "source": "https://example.com/repo"})
+	plan.SetVariant("v8")
+	plan.SetOSVersion("1.0")
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Nil(config.Config.Entrypoint)
+	require.Equal([]string{"sh"}, config.Config.Cmd)
+	require.Equal(map[string]string{
+		"team":     "infra",
+		"revision": "abc123",
+		"source":   "https://example.com/repo",
+	}, config.Config.Labels)
+	require.Equal("v8", config.Variant)
+	require.Equal("1.0", config.OSVersion)
+}
+
+func TestBuildPlanExecutionInlineCache(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	// NewBuildPlan updates the stages, so each plan gets its own.
+	stages := func() []*dockerfile.Stage {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+			dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+			dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+		}
+		return []*dockerfile.Stage{{From: from, Directives: directives}}
+	}
+
+	readConfig := func(manifest *image.DistributionManifest) image.Config {
+		r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+		require.NoError(err)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		var config image.Config
+		require.NoError(json.Unmarshal(b, &config))
+		return config
+	}
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages(), true, false)
+	require.NoError(err)
+	plan.SetInlineCache(true)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	config := readConfig(manifest)
+	require.Len(config.InlineCache, 2)
+
+	// A build using the image as cache gets the same layers without the
+	// inline cache, which isn't inherited.
+	inline := cache.NewInlineCacheManager(
+		cache.NewNoopCacheManager(), ctx.ImageStore, []*cache.InlineSource{{
+			Entries:        config.InlineCache,
+			RegistryClient: registry.NoopClientFixture(),
+		}})
+	plan, err = NewBuildPlan(
+		ctx, image.NewImageName("", "testrepo", "testtag2"), nil, inline, stages(), true, false)
+	require.NoError(err)
+	plan.stages[0].pullCacheLayers(inline)
+	require.Equal(3, plan.stages[0].latestFetched())
+	cached, err := plan.Execute()
+	require.NoError(err)
+	require.Equal(manifest.Layers, cached.Layers)
+	require.Nil(readConfig(cached).InlineCache)
+}
+
+// barrierCacheFixture blocks cache pulls until want of them are in flight at
+// the same time, or a timeout, and records the most pulls seen in flight.
+type barrierCacheFixture struct {
+	cache.Manager
+
+	want    int
+	mu      sync.Mutex
+	active  int
+	max     int
+	arrived chan struct{}
+}
+
+func (c *barrierCacheFixture) PullCache(cacheID string) (*image.DigestPair, error) {
+	c.mu.Lock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	if c.active == c.want {
+		close(c.arrived)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.arrived:
+	case <-time.After(5 * time.Second):
+	}
+
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	return c.Manager.PullCache(cacheID)
+}
+
+func TestBuildPlanExecutionStageWorkers(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := &barrierCacheFixture{
+		Manager: cache.New(ctx.ImageStore, keyvalue.MemStore{}, registry.NoopClientFixture(), cache.DefaultOptions()),
+		want:    3,
+		arrived: make(chan struct{}),
+	}
+
+	var stages []*dockerfile.Stage
+	for _, alias := range []string{"first", "second", ""} {
+		from := dockerfile.FromDirectiveFixture("", envImage.String(), alias)
+		directives := []dockerfile.Directive{
+			dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		}
+		stages = append(stages, &dockerfile.Stage{From: from, Directives: directives})
+	}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	plan.SetStageWorkers(3)
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 1)
+
+	// The cache of the stages was pulled concurrently.
+	require.Equal(3, cacheMgr.max)
+}
+
+func TestBuildPlanExecutionStripHistory(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from := dockerfile.FromDirectiveFixture("", envImage.String(), "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+		dockerfile.RunCommitDirectiveFixture("ls ..", "ls .."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+	plan.StripHistory([]*regexp.Regexp{regexp.MustCompile(`RUN ls \.\. `)})
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Equal(2, len(config.History))
+	require.Equal(2, len(config.RootFS.DiffIDs))
+	require.Equal("", config.History[0].CreatedBy)
+	require.Contains(config.History[1].CreatedBy, "ls ..")
+}
+
+func TestBuildPlanStageVarsScope(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	envImage, err := image.ParseName("scratch")
+	require.NoError(err)
+
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	from1 := dockerfile.FromDirectiveFixture("", envImage.String(), "stage1")
+	directives1 := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("MAKISU_TEST_SCOPE=1", map[string]string{"MAKISU_TEST_SCOPE": "1"}),
+		dockerfile.RunDirectiveFixture(`test -n "$MAKISU_TEST_SCOPE"`, `test -n "$MAKISU_TEST_SCOPE"`),
+	}
+	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "stage2")
+	directives2 := []dockerfile.Directive{
+		dockerfile.RunDirectiveFixture(`test -z "$MAKISU_TEST_SCOPE"`, `test -z "$MAKISU_TEST_SCOPE"`),
+	}
+	stages := []*dockerfile.Stage{
+		{From: from1, Directives: directives1},
+		{From: from2, Directives: directives2},
+	}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+	require.NoError(err)
+
+	_, err = plan.Execute()
+	require.NoError(err)
+	_, found := os.LookupEnv("MAKISU_TEST_SCOPE")
+	require.False(found)
+}
+
+func TestBuildPlanReadOnlyContext(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("file"), 0644))
+	require.NoError(os.MkdirAll(filepath.Join(ctx.ContextDir, "dir", "sub"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "dir", "sub", "file"), []byte("sub"), 0644))
+	var archive bytes.Buffer
+	w := tar.NewWriter(&archive)
+	require.NoError(w.WriteHeader(&tar.Header{Name: "unpacked", Mode: 0644, Size: 8, Typeflag: tar.TypeReg}))
+	_, err := w.Write([]byte("unpacked"))
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "archive.tar"), archive.Bytes(), 0644))
+
+	// Write permissions are not enforced for root, so the context is also
+	// compared before and after the build.
+	snapshotContext := func() map[string]string {
+		files := make(map[string]string)
+		require.NoError(filepath.Walk(ctx.ContextDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			files[path] = fmt.Sprintf("%v %d %v", fi.Mode(), fi.Size(), fi.ModTime())
+			return nil
+		}))
+		return files
+	}
+	require.NoError(filepath.Walk(ctx.ContextDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, fi.Mode()&^0222)
+	}))
+	defer filepath.Walk(ctx.ContextDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil {
+			os.Chmod(path, fi.Mode()|0200)
+		}
+		return nil
+	})
+	before := snapshotContext()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("file /dst/", "", "", []string{"file"}, "/dst/"),
+		dockerfile.CopyDirectiveFixture("dir /dst/dir/", "", "", []string{"dir"}, "/dst/dir/"),
+		dockerfile.AddDirectiveFixture("archive.tar /dst/archive/", "", []string{"archive.tar"}, "/dst/archive/"),
+		dockerfile.RunDirectiveFixture("ls .", "ls ."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true)
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.NotEmpty(manifest.Layers)
+
+	require.Equal(before, snapshotContext())
+}
+
+func TestBuildPlanExecutionCreated(t *testing.T) {
+	mtime := time.Unix(1500000000, 0).UTC()
+
+	for _, tc := range []struct {
+		name    string
+		created string
+		want    time.Time
+	}{
+		{"epoch", "1600000000", time.Unix(1600000000, 0).UTC()},
+		{"latest-mtime", "latest-mtime", mtime},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+
+			src := filepath.Join(ctx.ContextDir, "file")
+			require.NoError(ioutil.WriteFile(src, []byte("file"), 0644))
+			require.NoError(os.Chtimes(src, mtime, mtime))
+
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			directives := []dockerfile.Directive{
+				dockerfile.CopyDirectiveFixture("file /file", "", "", []string{"file"}, "/file"),
+				dockerfile.LabelDirectiveFixture("team=infra", map[string]string{"team": "infra"}),
+			}
+			stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+			plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+			require.NoError(err)
+			created, err := ParseCreated(tc.created)
+			require.NoError(err)
+			plan.SetCreated(created)
+
+			manifest, err := plan.Execute()
+			require.NoError(err)
+
+			r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+			require.NoError(err)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			var config image.Config
+			require.NoError(json.Unmarshal(b, &config))
+			require.True(tc.want.Equal(config.Created), "created %s", config.Created)
+			require.NotEmpty(config.History)
+			for _, history := range config.History {
+				require.True(tc.want.Equal(history.Created), "history created %s", history.Created)
+			}
+		})
+	}
+}
+
+func TestBuildPlanBuildContexts(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	dataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dataDir, "file"), []byte("data"), 0644))
+	require.NoError(t, step.SetBuildContexts(ctx.Options, []string{
+		"Data=" + dataDir, "base=docker-image://alpine:3.10",
+	}))
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	t.Run("dir", func(t *testing.T) {
+		require := require.New(t)
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("--from=data file /dst/", "", "data", []string{"file"}, "/dst/"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+		require.NoError(err)
+		require.Empty(plan.copyFromDirs)
+		require.Empty(plan.remoteImageStages)
+		manifest, err := plan.Execute()
+		require.NoError(err)
+		require.Len(manifest.Layers, 1)
+
+		r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Layers[0].Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		gr, err := tario.NewGzipReader(r)
+		require.NoError(err)
+		files := make(map[string]string)
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			content, err := ioutil.ReadAll(tr)
+			require.NoError(err)
+			files[hdr.Name] = string(content)
+		}
+		require.Equal("data", files["dst/file"])
+	})
+
+	t.Run("image", func(t *testing.T) {
+		require := require.New(t)
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("--from=base /etc /etc", "", "base", []string{"/etc"}, "/etc"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+		require.NoError(err)
+		require.Contains(plan.remoteImageStages, "alpine:3.10")
+		require.Contains(plan.copyFromDirs, "alpine:3.10")
+	})
+
+	t.Run("same name as stage", func(t *testing.T) {
+		require := require.New(t)
+		from := dockerfile.FromDirectiveFixture("", "scratch", "data")
+		stages := []*dockerfile.Stage{{From: from}}
+
+		_, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false)
+		require.Error(err)
+	})
+}
@@ -18,11 +18,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"time"
 
 	"github.com/uber/makisu/lib/builder/step"
@@ -31,7 +32,9 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/progress"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tracing"
 	"github.com/uber/makisu/lib/utils"
 )
 
@@ -44,6 +47,46 @@ type buildStageOptions struct {
 	requireOnDisk bool
 }
 
+// historyOptions wraps user provided annotations for the history entries of
+// the final image.
+type historyOptions struct {
+	author   string
+	comments map[int]string // Keyed by 1-based step number within the stage.
+
+	// If strip is true, commands are redacted from history entries, except
+	// for the ones matching any of the keep patterns.
+	strip bool
+	keep  []*regexp.Regexp
+
+	// created replaces the build time in the config and in the history
+	// entries that aren't inherited from the base image.
+	created Created
+
+	// If emptyLayers is true, steps that don't commit a layer, like ENV and
+	// LABEL, get history entries marked as empty layers, like in docker.
+	emptyLayers bool
+}
+
+// redact removes the commands and comments of a history entry that isn't
+// allowlisted.
+func (opts *historyOptions) redact(history image.History) image.History {
+	if opts == nil || !opts.strip {
+		return history
+	}
+	for _, pattern := range opts.keep {
+		if pattern.MatchString(history.CreatedBy) {
+			return history
+		}
+	}
+	history.CreatedBy = ""
+	history.Comment = ""
+	return history
+}
+
+// historyAuthor is the author of history entries generated by makisu if none
+// was specified.
+const historyAuthor = "makisu"
+
 // buildStage represents a sequence of steps to build intermediate layers or a final image.
 type buildStage struct {
 	ctx               *context.BuildContext
@@ -53,6 +96,17 @@ type buildStage struct {
 	lastImageConfig   *image.Config
 	sharedDigestPairs image.DigestPairMap
 
+	// history is only set for the stage that produces the final image.
+	history *historyOptions
+
+	// maxLayers limits the layer count of the final image if it isn't 0. It
+	// is only set for the stage that produces it.
+	maxLayers int
+
+	// rebasedLayers replace the layers of the nodes in the manifest of the
+	// stage once it was rebased onto a prior image.
+	rebasedLayers []*image.DigestPair
+
 	opts *buildStageOptions
 }
 
@@ -63,15 +117,17 @@ func newBuildStage(
 
 	// Create a new build context for the stage.
 	ctx, err := context.NewBuildContext(
-		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore)
+		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore, baseCtx.Options)
 	if err != nil {
-		return nil, fmt.Errorf("create stage build context: %s", err)
+		return nil, fmt.Errorf("create stage build context: %w", err)
 	}
+	ctx.Deadline = baseCtx.Deadline
+	ctx.Reporter = baseCtx.Reporter
 
 	// Create steps from parsed stage.
 	steps, err := createDockerfileSteps(ctx, parsedStage, planOpts)
 	if err != nil {
-		return nil, fmt.Errorf("new dockerfile steps: %s", err)
+		return nil, fmt.Errorf("new dockerfile steps: %w", err)
 	}
 
 	return newBuildStageHelper(ctx, alias, steps, digestPairs, planOpts)
@@ -84,15 +140,17 @@ func newRemoteImageStage(
 
 	// Create a new build context for the stage.
 	ctx, err := context.NewBuildContext(
-		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore)
+		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore, baseCtx.Options)
 	if err != nil {
-		return nil, fmt.Errorf("create stage build context: %s", err)
+		return nil, fmt.Errorf("create stage build context: %w", err)
 	}
+	ctx.Deadline = baseCtx.Deadline
+	ctx.Reporter = baseCtx.Reporter
 
 	// Create from step.
 	from, err := step.NewFromStep(alias, alias, alias)
 	if err != nil {
-		return nil, fmt.Errorf("new from step: %s", err)
+		return nil, fmt.Errorf("new from step: %w", err)
 	}
 	steps := []step.BuildStep{from}
 
@@ -154,14 +212,56 @@ func createDockerfileSteps(
 	ctx *context.BuildContext, stage *dockerfile.Stage,
 	planOpts *buildPlanOptions) ([]step.BuildStep, error) {
 
-	checksum := crc32.ChecksumIEEE([]byte(utils.BuildHash + fmt.Sprintf("%v", *planOpts)))
-	seed := fmt.Sprintf("%x", checksum)
+	seedData := utils.BuildHash + fmt.Sprintf("%v", *planOpts) + ctx.Options.CacheHash
+	snapOpts := ctx.Options.Snapshot
+	if snapOpts.OwnerRemap != nil {
+		// Layers with remapped owners can't be shared with other builds.
+		seedData += snapOpts.OwnerRemap.String()
+	}
+	if !snapOpts.SourceDateEpoch.IsZero() {
+		// So do layers with clamped mtimes.
+		seedData += snapOpts.SourceDateEpoch.String()
+	}
+	if snapOpts.Tar.KeepSpecialFiles {
+		// And layers with special files.
+		seedData += "keep-special-files"
+	}
+	if !snapOpts.Tar.SparseFiles {
+		// And layers whose sparse files are written in full.
+		seedData += "no-sparse-files"
+	}
+	if snapOpts.Tar.BlockingFactor != 1 {
+		// And layers padded to larger records.
+		seedData += fmt.Sprintf("tar-blocking-factor=%d", snapOpts.Tar.BlockingFactor)
+	}
+	seed := step.CacheChecksum(ctx.Options.CacheHash, seedData)
+	if ctx.Options.ExplainCache {
+		log.Infof("* Cache seed of stage %s: %s", stage.From.Alias, seed)
+		log.Infof("*   build hash: %q", utils.BuildHash)
+		log.Infof("*   plan options: %q", fmt.Sprintf("%v", *planOpts))
+		log.Infof("*   cache hash: %q", ctx.Options.CacheHash)
+		if snapOpts.OwnerRemap != nil {
+			log.Infof("*   owner remap: %q", snapOpts.OwnerRemap.String())
+		}
+		if !snapOpts.SourceDateEpoch.IsZero() {
+			log.Infof("*   source date epoch: %q", snapOpts.SourceDateEpoch.String())
+		}
+		if snapOpts.Tar.KeepSpecialFiles {
+			log.Infof("*   keep special files: true")
+		}
+		if !snapOpts.Tar.SparseFiles {
+			log.Infof("*   sparse files: false")
+		}
+		if snapOpts.Tar.BlockingFactor != 1 {
+			log.Infof("*   tar blocking factor: %d", snapOpts.Tar.BlockingFactor)
+		}
+	}
 	directives := append([]dockerfile.Directive{stage.From}, stage.Directives...)
 	var steps []step.BuildStep
 	for _, directive := range directives {
 		step, err := step.NewDockerfileStep(ctx, directive, seed)
 		if err != nil {
-			return nil, fmt.Errorf("directive to build step: %s", err)
+			return nil, fmt.Errorf("directive to build step: %w", err)
 		}
 		steps = append(steps, step)
 		seed = step.CacheID()
@@ -171,7 +271,29 @@ func createDockerfileSteps(
 
 // build performs the build for that stage. There are side effects that should
 // be expected on each node within the stage.
-func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom bool) error {
+func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom bool) (err error) {
+	span := tracing.Start(nil, "stage", tracing.KindInternal)
+	span.SetAttribute("makisu.stage", stage.alias)
+	span.SetAttribute("makisu.steps", len(stage.nodes))
+	defer func() { span.End(err) }()
+
+	if r := stage.ctx.Resources; r != nil && r.Timeout > 0 {
+		stage.ctx.StageDeadline = time.Now().Add(r.Timeout)
+		defer func() {
+			stage.ctx.StageDeadline = time.Time{}
+			if errors.Is(err, context.ErrStageTimeout) {
+				err = fmt.Errorf("stage %s exceeded its timeout of %s: %w", stage.alias, r.Timeout, err)
+			}
+		}()
+	}
+
+	// Env vars set for RUN steps are scoped to the stage.
+	defer func() {
+		if err := stage.ctx.RestoreEnv(); err != nil {
+			log.Errorf("Failed to restore env after stage %s: %s", stage.alias, err)
+		}
+	}()
+
 	// Reuse the digestpairs that other stages have populated.
 	for _, node := range stage.nodes {
 		if pairs, ok := stage.sharedDigestPairs[node.CacheID()]; ok {
@@ -180,9 +302,10 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 		}
 	}
 
-	var err error
 	diffIDs := make([]image.Digest, 0)
 	histories := make([]image.History, 0)
+	layers := make([]*image.DigestPair, 0)
+	inherited := 0
 	for i, node := range stage.nodes {
 		// Build current step from the previous image config (possibly cached).
 		modifyFS := stage.opts.requireOnDisk || copiedFrom
@@ -191,7 +314,7 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 		}
 		skipBuild := i < stage.latestFetched() && i > 0
 		lastStep := i == len(stage.nodes)-1
-		forceCommit := i == 0 || (lastStage && lastStep) || stage.opts.forceCommit
+		forceCommit := (i == 0 || (lastStage && lastStep) || stage.opts.forceCommit) && !node.squashed
 
 		nodeOpts := &buildNodeOptions{
 			skipBuild:   skipBuild,
@@ -199,41 +322,205 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 			modifyFS:    modifyFS,
 		}
 
-		log.Infof("* Step %d/%d (%s) : %s", i+1, len(stage.nodes), nodeOpts.String(), node.String())
+		event := progress.Event{
+			Stage:       stage.alias,
+			Step:        i + 1,
+			Steps:       len(stage.nodes),
+			Description: node.String(),
+			Options:     nodeOpts.String(),
+			Cache:       node.cacheStatus(nodeOpts),
+		}
+		if err := stage.ctx.Err(); err != nil {
+			return fmt.Errorf("build node: %w", err)
+		}
+		event.Type = progress.StepStarted
+		progress.Report(stage.ctx.Reporter, event)
+		stage.ctx.Step = fmt.Sprintf("%s %d/%d", stage.alias, i+1, len(stage.nodes))
+		stepSpan := tracing.Start(span, "step", tracing.KindInternal)
+		stepSpan.SetAttribute("makisu.step", event.Description)
+		stepSpan.SetAttribute("makisu.step.index", event.Step)
+		stepSpan.SetAttribute("makisu.cache", string(event.Cache))
+		start := time.Now()
 		stage.lastImageConfig, err = node.Build(cacheMgr, stage.lastImageConfig, nodeOpts)
+		event.Type, event.Duration, event.Err = progress.StepFinished, time.Since(start), err
+		progress.Report(stage.ctx.Reporter, event)
+		stepSpan.SetAttribute("makisu.layers", len(node.digestPairs))
+		stepSpan.SetAttribute("makisu.layers.bytes", layersSize(node.digestPairs))
+		stepSpan.End(err)
 		if err != nil {
-			return fmt.Errorf("build node: %s", err)
+			return fmt.Errorf("build node: %w", err)
 		}
 
 		// Update diff IDs and history information.
-		for _, digestPair := range node.digestPairs {
-			diffIDs = append(diffIDs, digestPair.TarDigest)
-			histories = append(histories, image.History{
-				Created:   time.Now(),
-				CreatedBy: fmt.Sprintf("makisu: %s", node.String()),
-				Author:    "makisu",
-			})
+		// The history of the base image is inherited as is, as long as it
+		// is consistent with the layers pulled for the FROM step.
+		if i == 0 && hasMatchingHistory(stage.lastImageConfig, node.digestPairs) {
+			for _, digestPair := range node.digestPairs {
+				diffIDs = append(diffIDs, digestPair.TarDigest)
+			}
+			for _, history := range stage.lastImageConfig.History {
+				histories = append(histories, stage.history.redact(history))
+			}
+			inherited = len(histories)
+		} else {
+			for _, digestPair := range node.digestPairs {
+				diffIDs = append(diffIDs, digestPair.TarDigest)
+				histories = append(histories, stage.newHistory(i, node))
+			}
+			// Like in docker, steps that didn't commit a layer still get
+			// an entry, which is marked as an empty layer.
+			emptyLayers := stage.history != nil && stage.history.emptyLayers
+			if i > 0 && len(node.digestPairs) == 0 && emptyLayers {
+				history := stage.newHistory(i, node)
+				history.EmptyLayer = true
+				histories = append(histories, history)
+			}
 		}
+		layers = append(layers, node.digestPairs...)
 
 		// Update the shared map of cacheID to digest pair.
 		if len(node.digestPairs) != 0 {
 			stage.sharedDigestPairs[node.CacheID()] = node.digestPairs
 		}
+
+		// The layer count of the base image is only known once it is pulled.
+		if i == 0 && stage.maxLayers > 0 {
+			if err := stage.limitLayers(cacheMgr, lastStage); err != nil {
+				return fmt.Errorf("limit layers: %w", err)
+			}
+		}
 	}
-	stage.lastImageConfig.Created = time.Now()
+	created := time.Now()
+	if stage.history != nil {
+		t, err := stage.history.created.resolve(stage.ctx.ImageStore, layers)
+		if err != nil {
+			return fmt.Errorf("resolve created time: %w", err)
+		} else if !t.IsZero() {
+			created = t
+			for i := inherited; i < len(histories); i++ {
+				histories[i].Created = t
+			}
+		}
+	}
+	stage.lastImageConfig.Created = created
 	stage.lastImageConfig.History = histories
 	stage.lastImageConfig.RootFS.DiffIDs = diffIDs
 	stage.lastImageConfig.ContainerConfiguration = nil
+	if stage.history != nil && stage.history.author != "" {
+		stage.lastImageConfig.Author = stage.history.author
+	}
+	if stage.history != nil && stage.history.strip {
+		stage.lastImageConfig.Container = ""
+		stage.lastImageConfig.Comment = ""
+	}
 	return nil
 }
 
+// layersSize returns the total size of the gzipped layers.
+func layersSize(pairs []*image.DigestPair) int64 {
+	var size int64
+	for _, pair := range pairs {
+		size += pair.GzipDescriptor.Size
+	}
+	return size
+}
+
+// limitLayers squashes the trailing commits of the stage into its last layer
+// if the stage would otherwise generate more than maxLayers layers, including
+// the ones of the base image. It must be called once the FROM step is built.
+// The earlier layers are kept, as they are the most likely to be reused.
+// The cache IDs of the nodes following the first squashed one are updated, as
+// their layers no longer match the ones of a build without the limit, and
+// their cache layers pulled again.
+func (stage *buildStage) limitLayers(cacheMgr cache.Manager, lastStage bool) error {
+	base := len(stage.nodes[0].digestPairs)
+	if base > stage.maxLayers {
+		return fmt.Errorf("base image has %d layers, more than the max of %d",
+			base, stage.maxLayers)
+	}
+
+	// Find the nodes that will commit a layer.
+	var commits []int
+	var dirty bool
+	for i, node := range stage.nodes[1:] {
+		lastStep := i+1 == len(stage.nodes)-1
+		dirty = dirty || node.producesLayer()
+		if dirty && (node.HasCommit() || stage.opts.forceCommit || (lastStage && lastStep)) {
+			commits = append(commits, i+1)
+			dirty = false
+		}
+	}
+	budget := stage.maxLayers - base
+	if len(commits) <= budget {
+		return nil
+	} else if budget == 0 {
+		return fmt.Errorf("base image has %d layers, no layer can be added under the max of %d",
+			base, stage.maxLayers)
+	}
+
+	// All the nodes up to the last commit are squashed, as forced commits of
+	// steps that don't change the file system would otherwise commit the
+	// changes of the squashed steps before them.
+	first, last := commits[budget-1], commits[len(commits)-1]
+	log.Infof("* Squashing %d layers to stay under the max of %d layers",
+		len(commits)-budget, stage.maxLayers)
+	for _, node := range stage.nodes[first:last] {
+		node.squashed = true
+	}
+
+	seed := stage.nodes[first-1].CacheID() + "squashed"
+	for _, node := range stage.nodes[first:] {
+		if err := node.SetCacheID(stage.ctx, seed); err != nil {
+			return fmt.Errorf("set cache id of %s: %w", node, err)
+		}
+		seed = node.CacheID()
+		node.digestPairs = nil
+	}
+	stage.pullCacheLayersFrom(cacheMgr, first)
+	return nil
+}
+
+// newHistory returns the history entry for a layer committed by the i-th node
+// of the stage. User provided comments are kept even if history is stripped.
+func (stage *buildStage) newHistory(i int, node *buildNode) image.History {
+	history := image.History{
+		Created:   time.Now(),
+		CreatedBy: fmt.Sprintf("makisu: %s", node.String()),
+		Author:    historyAuthor,
+	}
+	if stage.history == nil {
+		return history
+	}
+	history = stage.history.redact(history)
+	if stage.history.author != "" {
+		history.Author = stage.history.author
+	}
+	history.Comment = stage.history.comments[i+1]
+	return history
+}
+
+// hasMatchingHistory returns true if the history of the config has exactly one
+// non-empty entry per layer.
+func hasMatchingHistory(config *image.Config, digestPairs []*image.DigestPair) bool {
+	if config == nil || len(config.History) == 0 {
+		return false
+	}
+	var count int
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			count++
+		}
+	}
+	return count == len(digestPairs)
+}
+
 // GetDistributionManifest returns the distribution manifest produced at the end of the stage.
 func (stage *buildStage) GetDistributionManifest(
 	store *storage.ImageStore) (*image.DistributionManifest, error) {
 
 	imageConfigJSON, err := json.Marshal(stage.lastImageConfig)
 	if err != nil {
-		return nil, fmt.Errorf("marshal image config: %s", err)
+		return nil, fmt.Errorf("marshal image config: %w", err)
 	}
 	imageConfigDigester := sha256.New()
 	imageConfigDigester.Write(imageConfigJSON)
@@ -241,17 +528,17 @@ func (stage *buildStage) GetDistributionManifest(
 
 	imageConfigPath := path.Join(stage.ctx.ImageStore.SandboxDir, imageConfigSHA256)
 	if err := ioutil.WriteFile(imageConfigPath, imageConfigJSON, 0755); err != nil {
-		return nil, fmt.Errorf("write image config: %s", err)
+		return nil, fmt.Errorf("write image config: %w", err)
 	}
 	// If this is for a replica, image config might already exists in store.
 	// Ignore
 	err = store.Layers.LinkStoreFileFrom(imageConfigSHA256, imageConfigPath)
 	if err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("commit image config to store: %s", err)
+		return nil, fmt.Errorf("commit image config to store: %w", err)
 	}
 	imageConfigStat, err := store.Layers.GetStoreFileStat(imageConfigSHA256)
 	if err != nil {
-		return nil, fmt.Errorf("get image config file stat: %s", err)
+		return nil, fmt.Errorf("get image config file stat: %w", err)
 	}
 
 	// Save the manifest at the last node to a temp file, then move into store.
@@ -267,10 +554,16 @@ func (stage *buildStage) GetDistributionManifest(
 	}
 
 	descriptors := []image.Descriptor{}
-	for _, node := range stage.nodes {
-		for _, digestPair := range node.digestPairs {
+	if stage.rebasedLayers != nil {
+		for _, digestPair := range stage.rebasedLayers {
 			descriptors = append(descriptors, digestPair.GzipDescriptor)
 		}
+	} else {
+		for _, node := range stage.nodes {
+			for _, digestPair := range node.digestPairs {
+				descriptors = append(descriptors, digestPair.GzipDescriptor)
+			}
+		}
 	}
 
 	distributionManfest.Layers = descriptors
@@ -283,15 +576,15 @@ func (stage *buildStage) saveManifest(
 
 	manifest, err := stage.GetDistributionManifest(store)
 	if err != nil {
-		return nil, fmt.Errorf("get distribution manifest: %s", err)
+		return nil, fmt.Errorf("get distribution manifest: %w", err)
 	}
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
-		return nil, fmt.Errorf("marshal manifest: %s", err)
+		return nil, fmt.Errorf("marshal manifest: %w", err)
 	}
 	manifestFile, err := ioutil.TempFile(stage.ctx.ImageStore.SandboxDir, "")
 	if err != nil {
-		return nil, fmt.Errorf("tmp manifest file: %s", err)
+		return nil, fmt.Errorf("tmp manifest file: %w", err)
 	}
 
 	manifestPath := manifestFile.Name()
@@ -299,13 +592,13 @@ func (stage *buildStage) saveManifest(
 	defer os.Remove(manifestPath)
 
 	if err := ioutil.WriteFile(manifestPath, manifestJSON, 0755); err != nil {
-		return nil, fmt.Errorf("write manifest file: %s", err)
+		return nil, fmt.Errorf("write manifest file: %w", err)
 	}
 
 	if err := store.Manifests.LinkStoreFileFrom(
 		imageName.GetRepository(), imageName.GetTag(), manifestPath); err != nil {
 
-		return nil, fmt.Errorf("commit manifest to store: %s", err)
+		return nil, fmt.Errorf("commit manifest to store: %w", err)
 	}
 	return manifest, nil
 }
@@ -316,9 +609,15 @@ func (stage *buildStage) pullCacheLayers(cacheMgr cache.Manager) {
 	// Skip the first node since it's a FROM step. We do not want to try
 	// to pull from cache because the step itself will pull the right layers when
 	// it gets executed.
-	for _, node := range stage.nodes[1:] {
+	stage.pullCacheLayersFrom(cacheMgr, 1)
+}
+
+// pullCacheLayersFrom pulls reusable layers of the nodes starting at index
+// start, until a node that can be cached fails to pull its layer.
+func (stage *buildStage) pullCacheLayersFrom(cacheMgr cache.Manager, start int) {
+	for _, node := range stage.nodes[start:] {
 		// Stop once the cache chain is broken.
-		if node.HasCommit() || stage.opts.forceCommit {
+		if (node.HasCommit() || stage.opts.forceCommit) && !node.squashed {
 			if !node.pullCacheLayer(cacheMgr) {
 				return
 			}
@@ -326,6 +625,26 @@ func (stage *buildStage) pullCacheLayers(cacheMgr cache.Manager) {
 	}
 }
 
+// inlineCache returns the cache entries of the nodes that pull their layers
+// from cache, for the inline cache of the image built by the stage.
+func (stage *buildStage) inlineCache() map[string]string {
+	entries := make(map[string]string)
+	for _, node := range stage.nodes[1:] {
+		if (node.HasCommit() || stage.opts.forceCommit) && !node.squashed {
+			// Steps with more than one layer aren't cached.
+			if len(node.digestPairs) > 1 {
+				return entries
+			}
+			var pair *image.DigestPair
+			if len(node.digestPairs) != 0 {
+				pair = node.digestPairs[0]
+			}
+			entries[node.CacheID()] = cache.InlineEntry(pair)
+		}
+	}
+	return entries
+}
+
 func (stage *buildStage) latestFetched() int {
 	latest := -1
 	for i, node := range stage.nodes[1:] {
@@ -354,4 +673,15 @@ func (stage *buildStage) checkpoint(copyFromDirs []string) error {
 	return stage.ctx.MemFS.Checkpoint(newRoot, copyFromDirs)
 }
 
+// checkpointFromImage checkpoints the cross stage referenced files and
+// directories of a remote image stage by extracting them out of the image
+// layers, without building the stage.
+func (stage *buildStage) checkpointFromImage(copyFromDirs []string) error {
+	from, ok := stage.nodes[0].BuildStep.(*step.FromStep)
+	if !ok {
+		return fmt.Errorf("first step of stage %s is not FROM", stage.alias)
+	}
+	return from.CheckpointFromLayers(stage.ctx, stage.ctx.CopyFromRoot(stage.alias), copyFromDirs)
+}
+
 func (stage *buildStage) cleanup() error { return stage.ctx.MemFS.Remove() }
@@ -15,6 +15,10 @@
 package builder
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/uber/makisu/lib/cache"
@@ -23,6 +27,7 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/registry/security"
 
 	"github.com/stretchr/testify/require"
 )
@@ -113,6 +118,9 @@ func TestPullCacheLayers(t *testing.T) {
 
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
+
+	// Don't resolve base images from the registry.
+	ctx.Options.CacheBaseDigest = false
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			require := require.New(t)
@@ -127,7 +135,7 @@ func TestPullCacheLayers(t *testing.T) {
 			require.NoError(err)
 
 			kvStore := keyvalue.MemStore{}
-			cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+			cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture(), cache.DefaultOptions())
 
 			for i, node := range stage.nodes {
 				if tc.cacheExistsFlags[i] {
@@ -148,3 +156,124 @@ func TestPullCacheLayers(t *testing.T) {
 		})
 	}
 }
+
+func TestPullCacheLayersBaseImageUpdated(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Fake registry serving the base image manifest, whose digest changes with
+	// its config.
+	var config string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		w.Header().Set("Content-Type", image.MediaTypeManifest)
+		fmt.Fprintf(w, `{"schemaVersion":2,"mediaType":%q,"config":{"digest":%q}}`,
+			image.MediaTypeManifest, config)
+	}))
+	defer server.Close()
+	registryAddr := strings.TrimPrefix(server.URL, "http://")
+	registry.ConfigurationMap[registryAddr] = registry.RepositoryMap{
+		".*": registry.Config{Security: security.Config{PlainHTTP: true}},
+	}
+	defer delete(registry.ConfigurationMap, registryAddr)
+
+	parsedStage := &dockerfile.Stage{
+		From: dockerfile.FromDirectiveFixture("FROM base", registryAddr+"/base:latest", ""),
+		Directives: []dockerfile.Directive{
+			dockerfile.RunCommitDirectiveFixture("ls", "ls"),
+		},
+	}
+	opts := &buildPlanOptions{}
+	kvStore := keyvalue.MemStore{}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture(), cache.DefaultOptions())
+
+	// Cache the layers built on top of the old base image.
+	config = "sha256:" + strings.Repeat("1", 64)
+	stage, err := newBuildStage(ctx, "", parsedStage, image.DigestPairMap{}, opts)
+	require.NoError(err)
+	for _, node := range stage.nodes {
+		require.NoError(cacheMgr.PushCache(node.CacheID(), _testDigestPair))
+	}
+	require.NoError(cacheMgr.WaitForPush())
+
+	// Same base image, same Dockerfile.
+	stage, err = newBuildStage(ctx, "", parsedStage, image.DigestPairMap{}, opts)
+	require.NoError(err)
+	stage.pullCacheLayers(cacheMgr)
+	require.NotNil(stage.nodes[1].digestPairs)
+
+	// The base image got updated, the cache of the RUN step must not be used.
+	config = "sha256:" + strings.Repeat("2", 64)
+	stage, err = newBuildStage(ctx, "", parsedStage, image.DigestPairMap{}, opts)
+	require.NoError(err)
+	stage.pullCacheLayers(cacheMgr)
+	for _, node := range stage.nodes {
+		require.Nil(node.digestPairs)
+	}
+}
+
+func TestLimitLayers(t *testing.T) {
+	testCases := []struct {
+		name      string
+		base      int
+		maxLayers int
+		squashed  []bool
+		err       bool
+	}{
+		{"under max", 1, 4, []bool{false, false, false, false}, false},
+		{"over max", 1, 3, []bool{false, false, true, false}, false},
+		{"all squashed", 1, 2, []bool{false, true, true, false}, false},
+		{"no room for layers", 2, 2, nil, true},
+		{"base over max", 3, 2, nil, true},
+	}
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Don't resolve base images from the registry.
+	ctx.Options.CacheBaseDigest = false
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+
+			parsed := &dockerfile.Stage{
+				From: dockerfile.FromDirectiveFixture("FROM alpine", "alpine", ""),
+				Directives: []dockerfile.Directive{
+					dockerfile.RunCommitDirectiveFixture("ls", "ls"),
+					dockerfile.RunCommitDirectiveFixture("ls", "ls"),
+					dockerfile.RunDirectiveFixture("ls", "ls"),
+				},
+			}
+			opts := &buildPlanOptions{}
+			stage, err := newBuildStage(ctx, "", parsed, image.DigestPairMap{}, opts)
+			require.NoError(err)
+			stage.maxLayers = tc.maxLayers
+			for i := 0; i < tc.base; i++ {
+				stage.nodes[0].digestPairs = append(stage.nodes[0].digestPairs, _testDigestPair)
+			}
+			cacheIDs := []string{}
+			for _, node := range stage.nodes {
+				cacheIDs = append(cacheIDs, node.CacheID())
+			}
+
+			err = stage.limitLayers(cache.NewNoopCacheManager(), true)
+			if tc.err {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			// Cache IDs change from the first squashed node on.
+			changed := false
+			for i, node := range stage.nodes {
+				require.Equal(tc.squashed[i], node.squashed)
+				changed = changed || node.squashed
+				if changed {
+					require.NotEqual(cacheIDs[i], node.CacheID())
+				} else {
+					require.Equal(cacheIDs[i], node.CacheID())
+				}
+			}
+		})
+	}
+}
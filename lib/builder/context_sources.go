@@ -0,0 +1,40 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// ContextSources returns the sources of the ADD and COPY steps of the stages
+// that are copied from the build context, as opposed to other stages, images
+// or named build contexts. A dockerfile without any can be built without
+// build context.
+func ContextSources(stages []*dockerfile.Stage) []string {
+	var srcs []string
+	for _, stage := range stages {
+		for _, directive := range stage.Directives {
+			switch d := directive.(type) {
+			case *dockerfile.CopyDirective:
+				if d.FromStage == "" {
+					srcs = append(srcs, d.Srcs...)
+				}
+			case *dockerfile.AddDirective:
+				srcs = append(srcs, d.Srcs...)
+			}
+		}
+	}
+	return srcs
+}
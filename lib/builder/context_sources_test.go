@@ -0,0 +1,49 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextSources(t *testing.T) {
+	from := dockerfile.FromDirectiveFixture("", "alpine", "")
+	run := dockerfile.RunDirectiveFixture("make", "make")
+	copySrc := dockerfile.CopyDirectiveFixture("src /app/src", "", "", []string{"src"}, "/app/src")
+	copyFrom := dockerfile.CopyDirectiveFixture("--from=0 /bin /bin", "", "0", []string{"/bin"}, "/bin")
+	add := dockerfile.AddDirectiveFixture("a.tar b.tar /", "", []string{"a.tar", "b.tar"}, "/")
+
+	tests := []struct {
+		desc       string
+		directives []dockerfile.Directive
+		expected   []string
+	}{
+		{"run only", []dockerfile.Directive{run}, nil},
+		{"copy from stage", []dockerfile.Directive{copyFrom, run}, nil},
+		{"copy", []dockerfile.Directive{run, copySrc}, []string{"src"}},
+		{"add and copy", []dockerfile.Directive{add, copyFrom, copySrc}, []string{"a.tar", "b.tar", "src"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			stages := []*dockerfile.Stage{{From: from, Directives: test.directives}}
+			require.Equal(test.expected, ContextSources(stages))
+		})
+	}
+}
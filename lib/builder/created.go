@@ -0,0 +1,100 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// Created determines the created time of the final image config and of the
+// history entries makisu adds to it. The zero value keeps the time they were
+// built at.
+type Created struct {
+	time        time.Time
+	latestMTime bool
+}
+
+// ParseCreated parses "now", "latest-mtime", which uses the newest mtime of
+// the files in the layers of the image, or a time in seconds since the unix
+// epoch.
+func ParseCreated(s string) (Created, error) {
+	switch s {
+	case "", "now":
+		return Created{}, nil
+	case "latest-mtime":
+		return Created{latestMTime: true}, nil
+	}
+	t, err := snapshot.ParseSourceDateEpoch(s)
+	if err != nil {
+		return Created{}, fmt.Errorf("invalid created %q, must be now, latest-mtime or a unix time", s)
+	}
+	return Created{time: t}, nil
+}
+
+// resolve returns the created time of an image with the given layers, or the
+// zero time if it should be left as built.
+func (c Created) resolve(store *storage.ImageStore, layers []*image.DigestPair) (time.Time, error) {
+	if !c.latestMTime {
+		return c.time, nil
+	}
+	var latest time.Time
+	for _, layer := range layers {
+		mtime, err := latestLayerMTime(store, layer.GzipDescriptor.Digest)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("get latest mtime of layer %s: %s", layer.GzipDescriptor.Digest, err)
+		}
+		if mtime.After(latest) {
+			latest = mtime
+		}
+	}
+	return latest.UTC(), nil
+}
+
+// latestLayerMTime returns the newest mtime of the entries of a gzipped layer
+// of the store.
+func latestLayerMTime(store *storage.ImageStore, digest image.Digest) (time.Time, error) {
+	reader, err := store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get layer reader: %s", err)
+	}
+	defer reader.Close()
+	gzipReader, err := tario.NewLayerReader(reader)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("create layer reader: %s", err)
+	}
+	defer gzipReader.Close()
+
+	var latest time.Time
+	r := tar.NewReader(gzipReader)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return latest, nil
+		} else if err != nil {
+			return time.Time{}, fmt.Errorf("read tar header: %s", err)
+		}
+		if header.ModTime.After(latest) {
+			latest = header.ModTime
+		}
+	}
+}
@@ -0,0 +1,36 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCreated(t *testing.T) {
+	require := require.New(t)
+
+	created, err := ParseCreated("now")
+	require.NoError(err)
+	require.Equal(Created{}, created)
+
+	created, err = ParseCreated("latest-mtime")
+	require.NoError(err)
+	require.True(created.latestMTime)
+
+	_, err = ParseCreated("yesterday")
+	require.Error(err)
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// verifyDiffIDs checks that the config of the manifest has one diff ID per
+// layer, and that each of them is the digest of the uncompressed content of
+// its layer in the store.
+func verifyDiffIDs(store *storage.ImageStore, manifest *image.DistributionManifest) error {
+	r, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return fmt.Errorf("get image config reader: %w", err)
+	}
+	configJSON, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("read image config: %w", err)
+	}
+	config, err := image.NewImageConfigFromJSON(configJSON)
+	if err != nil {
+		return fmt.Errorf("parse image config: %w", err)
+	}
+
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("config has %d diff IDs for %d layers", len(diffIDs), len(manifest.Layers))
+	}
+	for i, layer := range manifest.Layers {
+		diffID, err := computeDiffID(store, layer.Digest)
+		if err != nil {
+			return fmt.Errorf("compute diff ID of layer %s: %w", layer.Digest, err)
+		} else if diffID != diffIDs[i] {
+			return fmt.Errorf("layer %d (%s) has diff ID %s, but the config has %s",
+				i, layer.Digest, diffID, diffIDs[i])
+		}
+	}
+	log.Infof("* Verified the diff IDs of %d layers", len(diffIDs))
+	return nil
+}
+
+// computeDiffID returns the digest of the uncompressed content of the layer.
+func computeDiffID(store *storage.ImageStore, digest image.Digest) (image.Digest, error) {
+	r, err := store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return "", fmt.Errorf("get layer reader: %w", err)
+	}
+	defer r.Close()
+	tr, err := tario.NewDecompressReader(r)
+	if err != nil {
+		return "", fmt.Errorf("create decompress reader: %w", err)
+	}
+	defer tr.Close()
+	diffID, err := image.NewDigester().FromReader(tr)
+	if err != nil {
+		return "", fmt.Errorf("read layer: %w", err)
+	}
+	return diffID, nil
+}
@@ -0,0 +1,94 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfig writes an image config with the diff IDs to the store, and
+// returns its descriptor.
+func writeConfig(t *testing.T, ctx *context.BuildContext, diffIDs []image.Digest) image.Descriptor {
+	require := require.New(t)
+
+	config := image.NewDefaultImageConfig()
+	config.RootFS = &image.RootFS{Type: "layers", DiffIDs: diffIDs}
+	configJSON, err := json.Marshal(config)
+	require.NoError(err)
+	digest, err := image.NewDigester().FromBytes(configJSON)
+	require.NoError(err)
+	configPath := filepath.Join(ctx.ImageStore.SandboxDir, "config")
+	require.NoError(ioutil.WriteFile(configPath, configJSON, 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), configPath))
+	return image.Descriptor{
+		MediaType: image.MediaTypeConfig,
+		Size:      int64(len(configJSON)),
+		Digest:    digest,
+	}
+}
+
+func TestVerifyDiffIDs(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	pair, _ := writeGzipLayer(t, ctx)
+
+	tests := []struct {
+		desc    string
+		diffIDs []image.Digest
+		err     string
+	}{
+		{"matching", []image.Digest{pair.TarDigest}, ""},
+		{"wrong diff ID", []image.Digest{pair.GzipDescriptor.Digest}, "but the config has"},
+		{"missing diff ID", nil, "config has 0 diff IDs for 1 layers"},
+		{"extra diff ID", []image.Digest{pair.TarDigest, pair.TarDigest}, "config has 2 diff IDs for 1 layers"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			manifest := &image.DistributionManifest{
+				Config: writeConfig(t, ctx, test.diffIDs),
+				Layers: []image.Descriptor{pair.GzipDescriptor},
+			}
+			err := verifyDiffIDs(ctx.ImageStore, manifest)
+			if test.err == "" {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), test.err)
+			}
+		})
+	}
+}
+
+func TestApplyLayerComputesDiffID(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	pair, _ := writeGzipLayer(t, ctx)
+
+	n := newBuildNode(ctx, nil)
+	diffID, err := n.applyLayer(pair, false)
+	require.NoError(err)
+	require.Equal(pair.TarDigest, diffID)
+}
@@ -0,0 +1,107 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// rebase replaces the layers of the stage with the ones of the prior image
+// followed by a single layer of the changes since it. The config of the stage
+// is kept, apart from its layer digests and history, which are the ones of the
+// prior image followed by an entry for the new layer.
+func (stage *buildStage) rebase(prior string) error {
+	// The prior image gets its own context, so that its env doesn't leak into
+	// the stage vars.
+	ctx, err := context.NewBuildContext(
+		stage.ctx.RootDir, stage.ctx.ContextDir, stage.ctx.ImageStore, stage.ctx.Options)
+	if err != nil {
+		return fmt.Errorf("create build context: %w", err)
+	}
+	ctx.Deadline = stage.ctx.Deadline
+	from, err := step.NewFromStep(prior, prior, "")
+	if err != nil {
+		return fmt.Errorf("new from step: %w", err)
+	} else if from.IsScratch() {
+		return fmt.Errorf("cannot build incrementally from scratch")
+	}
+	basePairs, err := from.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("pull prior image: %w", err)
+	}
+	baseConfig, err := from.UpdateCtxAndConfig(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get config of prior image: %w", err)
+	}
+
+	var layers []image.Descriptor
+	for _, node := range stage.nodes {
+		for _, pair := range node.digestPairs {
+			layers = append(layers, pair.GzipDescriptor)
+		}
+	}
+	baseLayers := make([]image.Descriptor, len(basePairs))
+	for i, pair := range basePairs {
+		baseLayers[i] = pair.GzipDescriptor
+	}
+	store := stage.ctx.ImageStore
+	pair, err := step.CommitDiffs(stage.ctx, func(w *tario.Writer) error {
+		return snapshot.DiffLayers(
+			w, storeLayerOpeners(store, baseLayers), storeLayerOpeners(store, layers))
+	})
+	if err != nil {
+		return fmt.Errorf("commit incremental layer: %w", err)
+	}
+	log.Infof("* Committed incremental layer %s (%d bytes) on top of %s",
+		pair.GzipDescriptor.Digest, pair.GzipDescriptor.Size, prior)
+
+	config := stage.lastImageConfig
+	var histories []image.History
+	if hasMatchingHistory(baseConfig, basePairs) {
+		for _, history := range baseConfig.History {
+			histories = append(histories, stage.history.redact(history))
+		}
+	} else {
+		for range basePairs {
+			histories = append(histories, image.History{Created: baseConfig.Created})
+		}
+	}
+	history := image.History{
+		Created:   config.Created,
+		CreatedBy: fmt.Sprintf("makisu: incremental from %s", prior),
+		Author:    historyAuthor,
+	}
+	if stage.history != nil && stage.history.author != "" {
+		history.Author = stage.history.author
+	}
+	config.History = append(histories, history)
+	config.RootFS.DiffIDs = nil
+	for _, p := range append(basePairs, pair) {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, p.TarDigest)
+	}
+	// The inline cache describes the layers of the stage, which the image no
+	// longer has.
+	config.InlineCache = nil
+
+	stage.rebasedLayers = append(basePairs, pair)
+	return nil
+}
@@ -0,0 +1,223 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// LayerCompression is the compression that the layers of the final image are
+// converted to, whatever the compression of the layers of its base image.
+type LayerCompression string
+
+const (
+	// LayerCompressionGzip converts layers to gzipped tars, at the level of
+	// tario.CompressionLevel.
+	LayerCompressionGzip LayerCompression = "gzip"
+	// LayerCompressionNone converts layers to plain tars.
+	LayerCompressionNone LayerCompression = "none"
+	// LayerCompressionZstd converts layers to zstd compressed tars, which only
+	// OCI manifests can reference.
+	LayerCompressionZstd LayerCompression = "zstd"
+)
+
+// ParseLayerCompression parses a layer compression. The empty string means
+// layers are kept as they are.
+func ParseLayerCompression(s string) (LayerCompression, error) {
+	switch c := LayerCompression(s); c {
+	case "", LayerCompressionGzip, LayerCompressionNone, LayerCompressionZstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("invalid layer compression %s: must be 'gzip', 'none' or 'zstd'", s)
+}
+
+// mediaType returns the media type of layers with the compression.
+func (c LayerCompression) mediaType() string {
+	switch c {
+	case LayerCompressionNone:
+		return image.MediaTypeLayerUncompressed
+	case LayerCompressionZstd:
+		return image.MediaTypeOCILayerZstd
+	}
+	return image.MediaTypeLayer
+}
+
+// matches returns true if layers of the media type, either docker or OCI, have
+// the compression.
+func (c LayerCompression) matches(mediaType string) bool {
+	switch c {
+	case LayerCompressionNone:
+		return mediaType == image.MediaTypeLayerUncompressed ||
+			mediaType == image.MediaTypeOCILayerUncompressed
+	case LayerCompressionZstd:
+		return mediaType == image.MediaTypeOCILayerZstd
+	}
+	return mediaType == image.MediaTypeLayer || mediaType == image.MediaTypeOCILayer
+}
+
+// transcodeLayers converts the layers of the image produced by the stage that
+// don't have the compression. The converted layers are saved to the store too,
+// and have the same tar digests, so the diff IDs of the config don't change.
+func (stage *buildStage) transcodeLayers(compression LayerCompression) error {
+	store := stage.ctx.ImageStore
+	tarOpts := stage.ctx.Options.Snapshot.Tar
+	if stage.rebasedLayers != nil {
+		pairs, err := transcodeDigestPairs(store, stage.rebasedLayers, compression, tarOpts)
+		if err != nil {
+			return err
+		}
+		stage.rebasedLayers = pairs
+		return nil
+	}
+	for _, node := range stage.nodes {
+		pairs, err := transcodeDigestPairs(store, node.digestPairs, compression, tarOpts)
+		if err != nil {
+			return err
+		}
+		node.digestPairs = pairs
+	}
+	return nil
+}
+
+// transcodeDigestPairs returns the digest pairs with the layers that don't
+// have the compression replaced by converted ones. The pairs themselves aren't
+// modified, as they can be shared with other stages.
+func transcodeDigestPairs(
+	store *storage.ImageStore, pairs []*image.DigestPair,
+	compression LayerCompression, tarOpts tario.Options) ([]*image.DigestPair, error) {
+
+	var result []*image.DigestPair
+	for i, pair := range pairs {
+		if compression.matches(pair.GzipDescriptor.MediaType) {
+			continue
+		}
+		if result == nil {
+			result = append([]*image.DigestPair(nil), pairs...)
+		}
+		converted, err := transcodeLayer(store, pair, compression, tarOpts)
+		if err != nil {
+			return nil, fmt.Errorf("transcode layer %s: %w", pair.GzipDescriptor.Digest, err)
+		}
+		result[i] = converted
+	}
+	if result == nil {
+		return pairs, nil
+	}
+	return result, nil
+}
+
+// transcodeLayer decompresses the layer and compresses it again with the
+// compression, and returns the digest pair of the converted layer. It fails if
+// the decompressed content doesn't match the tar digest of the pair.
+func transcodeLayer(
+	store *storage.ImageStore, pair *image.DigestPair,
+	compression LayerCompression, tarOpts tario.Options) (*image.DigestPair, error) {
+
+	r, err := store.Layers.GetStoreFileReader(pair.GzipDescriptor.Digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get layer reader: %w", err)
+	}
+	defer r.Close()
+	tr, err := tario.NewDecompressReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("create decompress reader: %w", err)
+	}
+	defer tr.Close()
+
+	converted, err := saveLayer(store, tr, compression, tarOpts)
+	if err != nil {
+		return nil, err
+	}
+	if converted.TarDigest != pair.TarDigest {
+		return nil, fmt.Errorf(
+			"decompressed content has digest %s instead of the diff ID %s",
+			converted.TarDigest, pair.TarDigest)
+	}
+	log.Infof("* Transcoded layer %s (%s, %d bytes) to %s (%s, %d bytes)",
+		pair.GzipDescriptor.Digest, pair.GzipDescriptor.MediaType, pair.GzipDescriptor.Size,
+		converted.GzipDescriptor.Digest, converted.GzipDescriptor.MediaType, converted.GzipDescriptor.Size)
+	return converted, nil
+}
+
+// saveLayer writes the tar read from r to the store as a layer with the
+// compression, and returns its digest pair, computed from the written content.
+// The compression level of tarOpts applies to gzip and zstd.
+func saveLayer(
+	store *storage.ImageStore, r io.Reader,
+	compression LayerCompression, tarOpts tario.Options) (*image.DigestPair, error) {
+
+	f, err := ioutil.TempFile(store.SandboxDir, "layer")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tarDigester := sha256.New()
+	layerDigester := sha256.New()
+	var w io.Writer = io.MultiWriter(f, layerDigester)
+	var cw io.WriteCloser
+	switch compression {
+	case LayerCompressionGzip:
+		if cw, err = tario.NewGzipWriter(w, tarOpts); err != nil {
+			return nil, fmt.Errorf("create gzip writer: %w", err)
+		}
+	case LayerCompressionZstd:
+		if cw, err = tario.NewZstdWriter(w, tarOpts); err != nil {
+			return nil, fmt.Errorf("create zstd writer: %w", err)
+		}
+	}
+	if cw != nil {
+		w = cw
+	}
+	if _, err := io.Copy(io.MultiWriter(w, tarDigester), r); err != nil {
+		return nil, fmt.Errorf("copy layer: %w", err)
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return nil, fmt.Errorf("close %s writer: %w", compression, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("close temp file: %w", err)
+	}
+
+	layerSHA256 := hex.EncodeToString(layerDigester.Sum(nil))
+	if err := store.Layers.LinkStoreFileFrom(layerSHA256, f.Name()); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("commit layer to store: %w", err)
+	}
+	info, err := store.Layers.GetStoreFileStat(layerSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("get layer stat: %w", err)
+	}
+	return &image.DigestPair{
+		TarDigest: image.Digest("sha256:" + hex.EncodeToString(tarDigester.Sum(nil))),
+		GzipDescriptor: image.Descriptor{
+			MediaType: compression.mediaType(),
+			Size:      info.Size(),
+			Digest:    image.Digest("sha256:" + layerSHA256),
+		},
+	}, nil
+}
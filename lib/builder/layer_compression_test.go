@@ -0,0 +1,195 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeGzipLayer writes a gzipped layer with a file to the store, and returns
+// its digest pair and its tar.
+func writeGzipLayer(t *testing.T, ctx *context.BuildContext) (*image.DigestPair, []byte) {
+	require := require.New(t)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	require.NoError(tw.WriteHeader(&tar.Header{
+		Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err := tw.Write([]byte("test"))
+	require.NoError(err)
+	require.NoError(tw.Close())
+	var gzipBuf bytes.Buffer
+	gw, err := tario.NewGzipWriter(&gzipBuf, tario.DefaultOptions())
+	require.NoError(err)
+	_, err = gw.Write(tarBuf.Bytes())
+	require.NoError(err)
+	require.NoError(gw.Close())
+
+	tarDigest, err := image.NewDigester().FromBytes(tarBuf.Bytes())
+	require.NoError(err)
+	gzipDigest, err := image.NewDigester().FromBytes(gzipBuf.Bytes())
+	require.NoError(err)
+	layerPath := filepath.Join(ctx.ImageStore.SandboxDir, "layer")
+	require.NoError(ioutil.WriteFile(layerPath, gzipBuf.Bytes(), 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(gzipDigest.Hex(), layerPath))
+	pair := &image.DigestPair{
+		TarDigest: tarDigest,
+		GzipDescriptor: image.Descriptor{
+			MediaType: image.MediaTypeOCILayer,
+			Size:      int64(gzipBuf.Len()),
+			Digest:    gzipDigest,
+		},
+	}
+	return pair, tarBuf.Bytes()
+}
+
+func TestTranscodeDigestPairs(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	pair, tarBytes := writeGzipLayer(t, ctx)
+	tarDigest := pair.TarDigest
+
+	t.Run("matching layers are kept", func(t *testing.T) {
+		require := require.New(t)
+
+		pairs := []*image.DigestPair{pair}
+		result, err := transcodeDigestPairs(ctx.ImageStore, pairs, LayerCompressionGzip, ctx.Options.Snapshot.Tar)
+		require.NoError(err)
+		require.Equal([]*image.DigestPair{pair}, result)
+	})
+
+	t.Run("gzip to none and back", func(t *testing.T) {
+		require := require.New(t)
+
+		pairs := []*image.DigestPair{pair}
+		result, err := transcodeDigestPairs(ctx.ImageStore, pairs, LayerCompressionNone, ctx.Options.Snapshot.Tar)
+		require.NoError(err)
+		require.Len(result, 1)
+		require.Equal(pair, pairs[0])
+		plain := result[0]
+		require.Equal(tarDigest, plain.TarDigest)
+		require.Equal(image.Descriptor{
+			MediaType: image.MediaTypeLayerUncompressed,
+			Size:      int64(len(tarBytes)),
+			Digest:    tarDigest,
+		}, plain.GzipDescriptor)
+		r, err := ctx.ImageStore.Layers.GetStoreFileReader(tarDigest.Hex())
+		require.NoError(err)
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(err)
+		require.Equal(tarBytes, content)
+
+		result, err = transcodeDigestPairs(ctx.ImageStore, result, LayerCompressionGzip, ctx.Options.Snapshot.Tar)
+		require.NoError(err)
+		require.Equal(tarDigest, result[0].TarDigest)
+		require.Equal(image.MediaTypeLayer, result[0].GzipDescriptor.MediaType)
+		_, err = ctx.ImageStore.Layers.GetStoreFileStat(result[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+	})
+
+	t.Run("gzip to zstd", func(t *testing.T) {
+		require := require.New(t)
+
+		result, err := transcodeDigestPairs(ctx.ImageStore, []*image.DigestPair{pair}, LayerCompressionZstd, ctx.Options.Snapshot.Tar)
+		require.NoError(err)
+		require.Equal(tarDigest, result[0].TarDigest)
+		require.Equal(image.MediaTypeOCILayerZstd, result[0].GzipDescriptor.MediaType)
+		r, err := ctx.ImageStore.Layers.GetStoreFileReader(result[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		zr, err := tario.NewZstdReader(r)
+		require.NoError(err)
+		defer zr.Close()
+		content, err := ioutil.ReadAll(zr)
+		require.NoError(err)
+		require.Equal(tarBytes, content)
+
+		// Zstd layers are kept.
+		kept, err := transcodeDigestPairs(ctx.ImageStore, result, LayerCompressionZstd, ctx.Options.Snapshot.Tar)
+		require.NoError(err)
+		require.Equal(result, kept)
+	})
+
+	t.Run("diff ID mismatch", func(t *testing.T) {
+		require := require.New(t)
+
+		wrong := *pair
+		wrong.TarDigest = pair.GzipDescriptor.Digest
+		_, err := transcodeDigestPairs(ctx.ImageStore, []*image.DigestPair{&wrong}, LayerCompressionNone, ctx.Options.Snapshot.Tar)
+		require.Error(err)
+		require.Contains(err.Error(), "instead of the diff ID")
+	})
+}
+
+func TestParseLayerCompression(t *testing.T) {
+	require := require.New(t)
+
+	for _, s := range []string{"", "gzip", "none", "zstd"} {
+		c, err := ParseLayerCompression(s)
+		require.NoError(err)
+		require.Equal(LayerCompression(s), c)
+	}
+	_, err := ParseLayerCompression("xz")
+	require.Error(err)
+}
+
+func TestSaveLayer(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	_, content := writeGzipLayer(t, ctx)
+	tarDigest, err := image.NewDigester().FromBytes(content)
+	require.NoError(t, err)
+
+	for _, compression := range []LayerCompression{LayerCompressionGzip, LayerCompressionNone, LayerCompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			require := require.New(t)
+
+			pair, err := saveLayer(ctx.ImageStore, bytes.NewReader(content), compression, ctx.Options.Snapshot.Tar)
+			require.NoError(err)
+			require.Equal(tarDigest, pair.TarDigest)
+			require.Equal(compression.mediaType(), pair.GzipDescriptor.MediaType)
+
+			// The layer saved to the store matches its descriptor, and
+			// decompresses to the tar.
+			r, err := ctx.ImageStore.Layers.GetStoreFileReader(pair.GzipDescriptor.Digest.Hex())
+			require.NoError(err)
+			defer r.Close()
+			saved, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(pair.GzipDescriptor.Size, int64(len(saved)))
+			digest, err := image.NewDigester().FromBytes(saved)
+			require.NoError(err)
+			require.Equal(pair.GzipDescriptor.Digest, digest)
+			tr, err := tario.NewDecompressReader(bytes.NewReader(saved))
+			require.NoError(err)
+			defer tr.Close()
+			decompressed, err := ioutil.ReadAll(tr)
+			require.NoError(err)
+			require.Equal(content, decompressed)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+
+	units "github.com/docker/go-units"
+)
+
+// ImageReport describes the sizes and contents of the layers of an image.
+type ImageReport struct {
+	CompressedSize   int64         `json:"compressed_size"`
+	UncompressedSize int64         `json:"uncompressed_size"`
+	Layers           []LayerReport `json:"layers"`
+}
+
+// LayerReport describes the size and content of a single layer.
+type LayerReport struct {
+	Digest           image.Digest `json:"digest"`
+	CompressedSize   int64        `json:"compressed_size"`
+	UncompressedSize int64        `json:"uncompressed_size"`
+	FileCount        int          `json:"file_count"`
+	LargestFiles     []FileReport `json:"largest_files,omitempty"`
+}
+
+// FileReport describes a file in a layer.
+type FileReport struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// NewImageReport reads the layers of the image from the store and reports
+// their sizes and number of files, as well as up to largestFiles of their
+// largest files.
+func NewImageReport(
+	store *storage.ImageStore, manifest *image.DistributionManifest,
+	largestFiles int) (*ImageReport, error) {
+
+	report := &ImageReport{}
+	for _, layer := range manifest.Layers {
+		layerReport, err := newLayerReport(store, layer, largestFiles)
+		if err != nil {
+			return nil, fmt.Errorf("report layer %s: %s", layer.Digest, err)
+		}
+		report.CompressedSize += layerReport.CompressedSize
+		report.UncompressedSize += layerReport.UncompressedSize
+		report.Layers = append(report.Layers, *layerReport)
+	}
+	return report, nil
+}
+
+func newLayerReport(
+	store *storage.ImageStore, layer image.Descriptor,
+	largestFiles int) (*LayerReport, error) {
+
+	reader, err := store.Layers.GetStoreFileReader(layer.Digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get layer reader: %s", err)
+	}
+	defer reader.Close()
+	gzipReader, err := tario.NewLayerReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("create layer reader: %s", err)
+	}
+	defer gzipReader.Close()
+
+	counter := &countingReader{r: gzipReader}
+	tarReader := tar.NewReader(counter)
+	report := &LayerReport{
+		Digest:         layer.Digest,
+		CompressedSize: layer.Size,
+	}
+	var files []FileReport
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read tar header: %s", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		report.FileCount++
+		if largestFiles > 0 && header.Typeflag == tar.TypeReg {
+			files = append(files, FileReport{Path: header.Name, Size: header.Size})
+		}
+	}
+	// Count the padding after the last entry too.
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return nil, fmt.Errorf("read tar: %s", err)
+	}
+	report.UncompressedSize = counter.n
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	if len(files) > largestFiles {
+		files = files[:largestFiles]
+	}
+	report.LargestFiles = files
+	return report, nil
+}
+
+// WriteText writes the report as a human readable table.
+func (r *ImageReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tDIGEST\tCOMPRESSED\tUNCOMPRESSED\tFILES")
+	for i, layer := range r.Layers {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", i, layer.Digest,
+			units.BytesSize(float64(layer.CompressedSize)),
+			units.BytesSize(float64(layer.UncompressedSize)), layer.FileCount)
+		for _, file := range layer.LargestFiles {
+			fmt.Fprintf(tw, "\t  %s\t\t%s\t\n", file.Path, units.BytesSize(float64(file.Size)))
+		}
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%s\t%s\t\n",
+		units.BytesSize(float64(r.CompressedSize)), units.BytesSize(float64(r.UncompressedSize)))
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as JSON.
+func (r *ImageReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
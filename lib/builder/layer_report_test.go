@@ -0,0 +1,84 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageReport(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Write a gzipped layer with a directory and two files to the store.
+	var buf bytes.Buffer
+	gw, err := tario.NewGzipWriter(&buf, tario.DefaultOptions())
+	require.NoError(err)
+	tw := tar.NewWriter(gw)
+	require.NoError(tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for name, content := range map[string]string{"dir/small": "a", "dir/large": "aaaaaaaaaa"} {
+		require.NoError(tw.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(err)
+	}
+	require.NoError(tw.Close())
+	require.NoError(gw.Close())
+
+	digest, err := image.NewDigester().FromBytes(buf.Bytes())
+	require.NoError(err)
+	layerPath := filepath.Join(ctx.ImageStore.SandboxDir, "layer")
+	require.NoError(ioutil.WriteFile(layerPath, buf.Bytes(), 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), layerPath))
+
+	manifest := &image.DistributionManifest{
+		Layers: []image.Descriptor{{Digest: digest, Size: int64(buf.Len())}},
+	}
+	report, err := NewImageReport(ctx.ImageStore, manifest, 1)
+	require.NoError(err)
+	require.Len(report.Layers, 1)
+	layer := report.Layers[0]
+	require.Equal(digest, layer.Digest)
+	require.Equal(int64(buf.Len()), layer.CompressedSize)
+	require.Equal(int64(buf.Len()), report.CompressedSize)
+	require.Equal(2, layer.FileCount)
+	require.Equal([]FileReport{{Path: "dir/large", Size: 10}}, layer.LargestFiles)
+	// Tar streams are made of 512 byte blocks, with 2 blocks at the end.
+	require.Equal(int64(512*7), layer.UncompressedSize)
+
+	var text bytes.Buffer
+	require.NoError(report.WriteText(&text))
+	require.Contains(text.String(), string(digest))
+	require.Contains(text.String(), "dir/large")
+
+	var encoded bytes.Buffer
+	require.NoError(report.WriteJSON(&encoded))
+	var decoded ImageReport
+	require.NoError(json.Unmarshal(encoded.Bytes(), &decoded))
+	require.Equal(*report, decoded)
+}
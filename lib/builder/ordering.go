@@ -0,0 +1,108 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// OrderingHint reports an ADD or COPY step that copies sources likely to
+// change often, e.g. whole directories of the build context, before several
+// RUN steps. Any change to the sources invalidates the cache of all the
+// following steps, so the RUN steps that don't need them, like the ones
+// installing dependencies, are better moved before it.
+type OrderingHint struct {
+	Stage    string   // Alias of the stage, or its index if it has none.
+	Step     int      // 1-based index of the ADD or COPY step within the stage.
+	Srcs     []string // Sources of the step that are likely to change often.
+	RunSteps []int    // 1-based indexes of the RUN steps that follow it.
+}
+
+func (h OrderingHint) String() string {
+	steps := make([]string, len(h.RunSteps))
+	for i, step := range h.RunSteps {
+		steps[i] = fmt.Sprintf("%d", step)
+	}
+	return fmt.Sprintf(
+		"Step %d of stage %s copies %s before RUN steps %s, which are rebuilt "+
+			"whenever a file in it changes. Consider copying only the files they "+
+			"depend on first, and moving this step after them",
+		h.Step, h.Stage, strings.Join(h.Srcs, ", "), strings.Join(steps, ", "))
+}
+
+// CheckStepOrdering returns hints about the steps of the stages whose order
+// makes the build cache inefficient. Sources are considered likely to change
+// often if they are directories of the context dir or patterns; single files,
+// like dependency manifests, are not. As the first RUN step following a copy
+// usually needs the sources, a hint is only returned for copies followed by
+// more than one RUN step.
+func CheckStepOrdering(stages []*dockerfile.Stage, contextDir string) []OrderingHint {
+	var hints []OrderingHint
+	for i, stage := range stages {
+		alias := stage.From.Alias
+		if alias == "" {
+			alias = fmt.Sprintf("%d", i)
+		}
+
+		var stageHints []*OrderingHint
+		for j, directive := range stage.Directives {
+			// The FROM step is step 1.
+			step := j + 2
+			var srcs []string
+			switch d := directive.(type) {
+			case *dockerfile.RunDirective:
+				for _, hint := range stageHints {
+					hint.RunSteps = append(hint.RunSteps, step)
+				}
+			case *dockerfile.CopyDirective:
+				if d.FromStage == "" {
+					srcs = volatileSources(contextDir, d.Srcs)
+				}
+			case *dockerfile.AddDirective:
+				srcs = volatileSources(contextDir, d.Srcs)
+			}
+			if len(srcs) > 0 {
+				stageHints = append(stageHints, &OrderingHint{Stage: alias, Step: step, Srcs: srcs})
+			}
+		}
+		for _, hint := range stageHints {
+			if len(hint.RunSteps) > 1 {
+				hints = append(hints, *hint)
+			}
+		}
+	}
+	return hints
+}
+
+// volatileSources returns the sources that are directories of the context dir
+// or patterns.
+func volatileSources(contextDir string, srcs []string) []string {
+	var volatile []string
+	for _, src := range srcs {
+		if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+			continue
+		} else if strings.ContainsAny(src, "*?[") {
+			volatile = append(volatile, src)
+		} else if fi, err := os.Stat(filepath.Join(contextDir, src)); err == nil && fi.IsDir() {
+			volatile = append(volatile, src)
+		}
+	}
+	return volatile
+}
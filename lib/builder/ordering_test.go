@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStepOrdering(t *testing.T) {
+	require := require.New(t)
+
+	contextDir, err := ioutil.TempDir("", "test-ordering")
+	require.NoError(err)
+	defer os.RemoveAll(contextDir)
+	require.NoError(os.Mkdir(filepath.Join(contextDir, "src"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(contextDir, "package.json"), []byte("{}"), 0644))
+
+	from := dockerfile.FromDirectiveFixture("", "alpine", "")
+	copySrc := dockerfile.CopyDirectiveFixture("src /app/src", "", "", []string{"src"}, "/app/src")
+	copyPackage := dockerfile.CopyDirectiveFixture(
+		"package.json /app/", "", "", []string{"package.json"}, "/app/")
+	copyFrom := dockerfile.CopyDirectiveFixture("--from=0 / /", "", "0", []string{"/"}, "/")
+	copyGlob := dockerfile.CopyDirectiveFixture("*.go /app/", "", "", []string{"*.go"}, "/app/")
+	install := dockerfile.RunDirectiveFixture("npm install", "npm install")
+	build := dockerfile.RunDirectiveFixture("npm build", "npm build")
+
+	tests := []struct {
+		desc       string
+		directives []dockerfile.Directive
+		expected   []OrderingHint
+	}{
+		{
+			"directory before runs",
+			[]dockerfile.Directive{copySrc, install, build},
+			[]OrderingHint{{Stage: "0", Step: 2, Srcs: []string{"src"}, RunSteps: []int{3, 4}}},
+		}, {
+			"pattern before runs",
+			[]dockerfile.Directive{copyGlob, install, build},
+			[]OrderingHint{{Stage: "0", Step: 2, Srcs: []string{"*.go"}, RunSteps: []int{3, 4}}},
+		}, {
+			"directory before single run",
+			[]dockerfile.Directive{install, copySrc, build},
+			nil,
+		}, {
+			"file before runs",
+			[]dockerfile.Directive{copyPackage, install, build},
+			nil,
+		}, {
+			"copy from stage before runs",
+			[]dockerfile.Directive{copyFrom, install, build},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			stages := []*dockerfile.Stage{{From: from, Directives: test.directives}}
+			require.Equal(test.expected, CheckStepOrdering(stages, contextDir))
+		})
+	}
+}
@@ -0,0 +1,246 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// PolicyRule names a built-in check of deprecated or discouraged dockerfile
+// usage.
+type PolicyRule string
+
+const (
+	// PolicyAddLocal reports ADD directives that copy local files which are not
+	// archives, for which COPY should be used instead.
+	PolicyAddLocal PolicyRule = "add-local"
+	// PolicyLatestTag reports base images without a tag, or with the latest
+	// tag, which make builds unreproducible.
+	PolicyLatestTag PolicyRule = "latest-tag"
+	// PolicyMaintainer reports MAINTAINER directives, which are deprecated in
+	// favor of a maintainer LABEL.
+	PolicyMaintainer PolicyRule = "maintainer"
+	// PolicyMissingUser reports final stages that don't switch to a non-root
+	// USER.
+	PolicyMissingUser PolicyRule = "missing-user"
+)
+
+// PolicyRules lists all the built-in rules.
+var PolicyRules = []PolicyRule{PolicyAddLocal, PolicyLatestTag, PolicyMaintainer, PolicyMissingUser}
+
+// PolicySeverity is what happens when a rule is violated.
+type PolicySeverity string
+
+const (
+	// PolicyWarn logs violations of the rule.
+	PolicyWarn PolicySeverity = "warn"
+	// PolicyError fails the build on violations of the rule.
+	PolicyError PolicySeverity = "error"
+)
+
+// Policy maps the enabled rules to their severity. Rules that aren't in it
+// aren't checked.
+type Policy map[PolicyRule]PolicySeverity
+
+// ParsePolicy parses a list of rules of format <rule>[=warn|error], in which
+// <rule> can be "all" to enable every rule. Rules default to warn, and later
+// entries override earlier ones, e.g. "all=error", "missing-user=warn".
+func ParsePolicy(specs []string) (Policy, error) {
+	policy := make(Policy)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		severity := PolicyWarn
+		if len(parts) == 2 {
+			severity = PolicySeverity(parts[1])
+			if severity != PolicyWarn && severity != PolicyError {
+				return nil, fmt.Errorf(
+					"invalid severity %s of policy rule %s, must be warn or error", parts[1], parts[0])
+			}
+		}
+		if parts[0] == "all" {
+			for _, rule := range PolicyRules {
+				policy[rule] = severity
+			}
+			continue
+		}
+		rule := PolicyRule(parts[0])
+		if !isPolicyRule(rule) {
+			return nil, fmt.Errorf("unknown policy rule %s, must be one of %s or all", parts[0], listPolicyRules())
+		}
+		policy[rule] = severity
+	}
+	return policy, nil
+}
+
+func isPolicyRule(rule PolicyRule) bool {
+	for _, r := range PolicyRules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func listPolicyRules() string {
+	rules := make([]string, len(PolicyRules))
+	for i, rule := range PolicyRules {
+		rules[i] = string(rule)
+	}
+	return strings.Join(rules, ", ")
+}
+
+// PolicyViolation reports a directive that violates a rule of the policy.
+type PolicyViolation struct {
+	Rule     PolicyRule
+	Severity PolicySeverity
+	Stage    string // Alias of the stage, or its index if it has none.
+	Line     int    // 1-based line of the directive in the dockerfile.
+	Message  string
+}
+
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("Line %d of stage %s: %s (%s)", v.Line, v.Stage, v.Message, v.Rule)
+}
+
+// CheckPolicy returns the violations of the policy by the stages, sorted by
+// line. The lines are the ones returned by dockerfile.ParseFileWithLines.
+func CheckPolicy(
+	stages []*dockerfile.Stage, lines dockerfile.Lines, contextDir string,
+	policy Policy) []PolicyViolation {
+
+	var violations []PolicyViolation
+	report := func(rule PolicyRule, stage string, directive dockerfile.Directive, msg string) {
+		if severity, ok := policy[rule]; ok {
+			violations = append(violations, PolicyViolation{
+				Rule:     rule,
+				Severity: severity,
+				Stage:    stage,
+				Line:     lines[directive],
+				Message:  msg,
+			})
+		}
+	}
+
+	aliases := make(map[string]bool)
+	for i, stage := range stages {
+		alias := stage.From.Alias
+		if alias == "" {
+			alias = fmt.Sprintf("%d", i)
+		}
+
+		if msg := checkBaseTag(stage.From.Image, aliases); msg != "" {
+			report(PolicyLatestTag, alias, stage.From, msg)
+		}
+		aliases[strings.ToLower(alias)] = true
+
+		for _, directive := range stage.Directives {
+			switch d := directive.(type) {
+			case *dockerfile.AddDirective:
+				if srcs := localNonArchiveSources(contextDir, d.Srcs, d.Unpack); len(srcs) > 0 {
+					report(PolicyAddLocal, alias, d, fmt.Sprintf(
+						"ADD copies local files %s, use COPY instead", strings.Join(srcs, ", ")))
+				}
+			case *dockerfile.MaintainerDirective:
+				report(PolicyMaintainer, alias, d, "MAINTAINER is deprecated, use LABEL maintainer instead")
+			}
+		}
+
+		if i == len(stages)-1 {
+			if msg := checkFinalUser(stages, i); msg != "" {
+				report(PolicyMissingUser, alias, stage.From, msg)
+			}
+		}
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Line < violations[j].Line
+	})
+	return violations
+}
+
+// checkBaseTag returns why the base image of a stage violates the latest-tag
+// rule, or an empty string. Scratch, previous stages and images pinned by
+// digest are fine.
+func checkBaseTag(base string, aliases map[string]bool) string {
+	if strings.EqualFold(base, image.Scratch) || aliases[strings.ToLower(base)] ||
+		strings.Contains(base, "@") {
+		return ""
+	}
+	name, err := image.ParseName(base)
+	if err != nil || name.GetTag() != "latest" {
+		return ""
+	} else if !strings.HasSuffix(base, ":latest") {
+		return fmt.Sprintf("base image %s has no tag, pin it to a version", base)
+	}
+	return fmt.Sprintf("base image %s uses the latest tag, pin it to a version", base)
+}
+
+// localNonArchiveSources returns the sources that are neither URLs nor local
+// archives that ADD unpacks. Sources that can't be read, like patterns, are
+// assumed not to be archives.
+func localNonArchiveSources(contextDir string, srcs []string, unpack bool) []string {
+	var local []string
+	for _, src := range srcs {
+		if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+			continue
+		} else if unpack {
+			if archive, err := tario.IsArchive(filepath.Join(contextDir, src)); err == nil && archive {
+				continue
+			}
+		}
+		local = append(local, src)
+	}
+	return local
+}
+
+// checkFinalUser returns why the stage at index i violates the missing-user
+// rule, or an empty string. The USER of the stages it is built from is
+// inherited, but the one of base images can't be known.
+func checkFinalUser(stages []*dockerfile.Stage, i int) string {
+	var user string
+	for i >= 0 && user == "" {
+		for _, directive := range stages[i].Directives {
+			if d, ok := directive.(*dockerfile.UserDirective); ok {
+				user = d.User
+			}
+		}
+		i = previousStage(stages, i)
+	}
+	name := strings.SplitN(user, ":", 2)[0]
+	if user == "" {
+		return "final stage has no USER, the image runs as root"
+	} else if name == "root" || name == "0" {
+		return fmt.Sprintf("final stage sets USER %s, the image runs as root", user)
+	}
+	return ""
+}
+
+// previousStage returns the index of the stage that the stage at index i is
+// built from, or -1 if it is built from an image.
+func previousStage(stages []*dockerfile.Stage, i int) int {
+	for j := i - 1; j >= 0; j-- {
+		if stages[j].From.Alias != "" && strings.EqualFold(stages[j].From.Alias, stages[i].From.Image) {
+			return j
+		}
+	}
+	return -1
+}
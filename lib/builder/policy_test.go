@@ -0,0 +1,176 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	t.Run("defaults to warn", func(t *testing.T) {
+		require := require.New(t)
+		policy, err := ParsePolicy([]string{"latest-tag", "add-local=error"})
+		require.NoError(err)
+		require.Equal(Policy{PolicyLatestTag: PolicyWarn, PolicyAddLocal: PolicyError}, policy)
+	})
+
+	t.Run("all is overridden by later rules", func(t *testing.T) {
+		require := require.New(t)
+		policy, err := ParsePolicy([]string{"all=error", "missing-user=warn"})
+		require.NoError(err)
+		require.Equal(Policy{
+			PolicyAddLocal:    PolicyError,
+			PolicyLatestTag:   PolicyError,
+			PolicyMaintainer:  PolicyError,
+			PolicyMissingUser: PolicyWarn,
+		}, policy)
+	})
+
+	t.Run("unknown rule", func(t *testing.T) {
+		_, err := ParsePolicy([]string{"no-such-rule"})
+		require.Error(t, err)
+	})
+
+	t.Run("invalid severity", func(t *testing.T) {
+		_, err := ParsePolicy([]string{"latest-tag=fatal"})
+		require.Error(t, err)
+	})
+}
+
+func TestCheckPolicy(t *testing.T) {
+	contextDir, err := ioutil.TempDir("", "test-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(contextDir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextDir, "app.conf"), []byte("conf"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(contextDir, "src"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextDir, "src", "file"), []byte("src"), 0644))
+	var archive bytes.Buffer
+	w := tar.NewWriter(&archive)
+	require.NoError(t, w.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: 3}))
+	_, err = w.Write([]byte("src"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextDir, "src.tar"), archive.Bytes(), 0644))
+
+	all := Policy{
+		PolicyAddLocal:    PolicyError,
+		PolicyLatestTag:   PolicyWarn,
+		PolicyMaintainer:  PolicyWarn,
+		PolicyMissingUser: PolicyWarn,
+	}
+
+	tests := []struct {
+		desc       string
+		dockerfile string
+		expected   []PolicyViolation
+	}{
+		{
+			"clean",
+			`FROM alpine:3.10 AS build
+ADD src.tar /src/
+ADD https://example.com/file /file
+COPY app.conf /etc/
+FROM build
+USER nobody`,
+			nil,
+		}, {
+			"add of local files",
+			`FROM alpine:3.10
+# Comment.
+ADD app.conf \
+  src /app/
+ADD --unpack=false src.tar /src/
+USER nobody`,
+			[]PolicyViolation{{
+				PolicyAddLocal, PolicyError, "0", 3, "ADD copies local files app.conf, src, use COPY instead",
+			}, {
+				PolicyAddLocal, PolicyError, "0", 5, "ADD copies local files src.tar, use COPY instead",
+			}},
+		}, {
+			"latest tags",
+			`FROM alpine AS build
+FROM alpine:latest
+FROM alpine@sha256:e4355b66995c96b4b468159fc5c7e3540fcef961189ca13fee877798649f531a
+FROM build
+FROM scratch
+USER 1000`,
+			[]PolicyViolation{{
+				PolicyLatestTag, PolicyWarn, "build", 1, "base image alpine has no tag, pin it to a version",
+			}, {
+				PolicyLatestTag, PolicyWarn, "1", 2, "base image alpine:latest uses the latest tag, pin it to a version",
+			}},
+		}, {
+			"maintainer",
+			`FROM alpine:3.10
+MAINTAINER Jane Doe <jane@example.com>
+USER nobody`,
+			[]PolicyViolation{{
+				PolicyMaintainer, PolicyWarn, "0", 2, "MAINTAINER is deprecated, use LABEL maintainer instead",
+			}},
+		}, {
+			"missing user",
+			`FROM alpine:3.10 AS build
+USER nobody
+FROM alpine:3.10
+USER app
+USER root:root`,
+			[]PolicyViolation{{
+				PolicyMissingUser, PolicyWarn, "1", 3, "final stage sets USER root:root, the image runs as root",
+			}},
+		}, {
+			"user inherited from previous stage",
+			`FROM alpine:3.10 AS base
+USER nobody
+FROM alpine:3.10 AS other
+FROM base`,
+			nil,
+		}, {
+			"no user",
+			`FROM alpine:3.10 AS base
+FROM base`,
+			[]PolicyViolation{{
+				PolicyMissingUser, PolicyWarn, "1", 2, "final stage has no USER, the image runs as root",
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			stages, lines, err := dockerfile.ParseFileWithLines(test.dockerfile, nil, nil, nil, nil)
+			require.NoError(err)
+			require.Equal(test.expected, CheckPolicy(stages, lines, contextDir, all))
+		})
+	}
+
+	t.Run("disabled rules", func(t *testing.T) {
+		require := require.New(t)
+		stages, lines, err := dockerfile.ParseFileWithLines(
+			"FROM alpine\nADD app.conf /etc/", nil, nil, nil, nil)
+		require.NoError(err)
+		violations := CheckPolicy(stages, lines, contextDir, Policy{PolicyLatestTag: PolicyError})
+		require.Len(violations, 1)
+		require.Equal(PolicyLatestTag, violations[0].Rule)
+		require.Empty(CheckPolicy(stages, lines, contextDir, Policy{}))
+	})
+}
@@ -0,0 +1,232 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// LayerPostProcessor transforms the layers of the final image before they are
+// saved and pushed, e.g. to normalize file ownership.
+type LayerPostProcessor interface {
+	// PostProcess returns the transformed tar stream of the uncompressed
+	// layer read from layer. The returned reader is closed once it was read.
+	PostProcess(layer io.Reader) (io.ReadCloser, error)
+}
+
+// LayerPostProcessorFunc adapts a function to a LayerPostProcessor.
+type LayerPostProcessorFunc func(layer io.Reader) (io.ReadCloser, error)
+
+// PostProcess calls f(layer).
+func (f LayerPostProcessorFunc) PostProcess(layer io.Reader) (io.ReadCloser, error) {
+	return f(layer)
+}
+
+// NormalizeOwnership is the name of the built-in post-processor that makes
+// root the owner of all the files of the layers.
+const NormalizeOwnership = "normalize-ownership"
+
+var (
+	postProcessorsMu sync.RWMutex
+	postProcessors   = map[string]LayerPostProcessor{
+		NormalizeOwnership: LayerPostProcessorFunc(normalizeOwnership),
+	}
+)
+
+// RegisterLayerPostProcessor makes the post-processor available to
+// BuildPlan.SetLayerPostProcessors under the name. It is typically called from
+// an init func of programs embedding makisu.
+func RegisterLayerPostProcessor(name string, p LayerPostProcessor) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	postProcessors[name] = p
+}
+
+// normalizeOwnership rewrites the headers of the layer with uid and gid 0 and
+// without user and group names, leaving the content of the files unchanged.
+func normalizeOwnership(layer io.Reader) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		tr := tar.NewReader(layer)
+		tw := tar.NewWriter(pw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(fmt.Errorf("read header: %s", err))
+				return
+			}
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+			for _, key := range []string{"uid", "gid", "uname", "gname"} {
+				delete(hdr.PAXRecords, key)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(fmt.Errorf("write header: %s", err))
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(fmt.Errorf("copy %s: %s", hdr.Name, err))
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr, nil
+}
+
+// namedPostProcessor is a registered post-processor and its name.
+type namedPostProcessor struct {
+	name string
+	LayerPostProcessor
+}
+
+// getLayerPostProcessors returns the post-processors registered under the
+// names, in order.
+func getLayerPostProcessors(names []string) ([]namedPostProcessor, error) {
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+
+	var result []namedPostProcessor
+	for _, name := range names {
+		p, ok := postProcessors[name]
+		if !ok {
+			registered := make([]string, 0, len(postProcessors))
+			for n := range postProcessors {
+				registered = append(registered, n)
+			}
+			sort.Strings(registered)
+			return nil, fmt.Errorf(
+				"unknown layer post-processor %s, registered ones are: %s",
+				name, strings.Join(registered, ", "))
+		}
+		result = append(result, namedPostProcessor{name, p})
+	}
+	return result, nil
+}
+
+// postProcessLayers replaces the layers of the image produced by the stage
+// with the output of the post-processors, and the diff IDs of its config with
+// the digests of the transformed tars. Layers keep their compression.
+func (stage *buildStage) postProcessLayers(processors []namedPostProcessor) error {
+	store := stage.ctx.ImageStore
+	// The same layer can be used several times, e.g. by the base image and a
+	// cached step, and is only processed once.
+	processed := make(map[image.Digest]*image.DigestPair)
+	diffIDs := make(map[image.Digest]image.Digest)
+	process := func(pairs []*image.DigestPair) ([]*image.DigestPair, error) {
+		// The pairs themselves aren't modified, as they can be shared with
+		// other stages.
+		result := make([]*image.DigestPair, len(pairs))
+		for i, pair := range pairs {
+			p, ok := processed[pair.GzipDescriptor.Digest]
+			if !ok {
+				var err error
+				p, err = postProcessLayer(store, pair, processors, stage.ctx.Options.Snapshot.Tar)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"post-process layer %s: %w", pair.GzipDescriptor.Digest, err)
+				}
+				processed[pair.GzipDescriptor.Digest] = p
+				diffIDs[pair.TarDigest] = p.TarDigest
+			}
+			result[i] = p
+		}
+		return result, nil
+	}
+
+	if stage.rebasedLayers != nil {
+		pairs, err := process(stage.rebasedLayers)
+		if err != nil {
+			return err
+		}
+		stage.rebasedLayers = pairs
+	} else {
+		for _, node := range stage.nodes {
+			pairs, err := process(node.digestPairs)
+			if err != nil {
+				return err
+			}
+			node.digestPairs = pairs
+		}
+	}
+	if stage.lastImageConfig.RootFS == nil {
+		return nil
+	}
+	rootFS := *stage.lastImageConfig.RootFS
+	rootFS.DiffIDs = make([]image.Digest, len(rootFS.DiffIDs))
+	for i, diffID := range stage.lastImageConfig.RootFS.DiffIDs {
+		if d, ok := diffIDs[diffID]; ok {
+			diffID = d
+		}
+		rootFS.DiffIDs[i] = diffID
+	}
+	stage.lastImageConfig.RootFS = &rootFS
+	return nil
+}
+
+// postProcessLayer pipes the uncompressed layer through the post-processors,
+// and returns the digest pair of the resulting layer, which has the
+// compression of the original one.
+func postProcessLayer(
+	store *storage.ImageStore, pair *image.DigestPair,
+	processors []namedPostProcessor, tarOpts tario.Options) (*image.DigestPair, error) {
+
+	r, err := store.Layers.GetStoreFileReader(pair.GzipDescriptor.Digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get layer reader: %w", err)
+	}
+	defer r.Close()
+	tr, err := tario.NewDecompressReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("create decompress reader: %w", err)
+	}
+	defer tr.Close()
+
+	var layer io.Reader = tr
+	for _, p := range processors {
+		out, err := p.PostProcess(layer)
+		if err != nil {
+			return nil, fmt.Errorf("post-process with %s: %w", p.name, err)
+		}
+		defer out.Close()
+		layer = out
+	}
+
+	compression := LayerCompressionGzip
+	for _, c := range []LayerCompression{LayerCompressionNone, LayerCompressionZstd} {
+		if c.matches(pair.GzipDescriptor.MediaType) {
+			compression = c
+		}
+	}
+	result, err := saveLayer(store, layer, compression, tarOpts)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("* Post-processed layer %s (%d bytes) to %s (%d bytes)",
+		pair.GzipDescriptor.Digest, pair.GzipDescriptor.Size,
+		result.GzipDescriptor.Digest, result.GzipDescriptor.Size)
+	return result, nil
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+// upperCasePostProcessor upper-cases the content of the files of layers, and
+// counts the layers it processed.
+type upperCasePostProcessor struct {
+	calls int
+}
+
+func (p *upperCasePostProcessor) PostProcess(layer io.Reader) (io.ReadCloser, error) {
+	p.calls++
+	var buf bytes.Buffer
+	tr := tar.NewReader(layer)
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(bytes.ToUpper(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func TestNormalizeOwnership(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(tw.WriteHeader(&tar.Header{
+		Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000,
+		Uname: "build", Gname: "build"}))
+	require.NoError(tw.WriteHeader(&tar.Header{
+		Name: "etc/conf", Typeflag: tar.TypeReg, Mode: 0600, Size: 4, Uid: 1 << 22, Gid: 5,
+		Format: tar.FormatPAX}))
+	_, err := tw.Write([]byte("conf"))
+	require.NoError(err)
+	require.NoError(tw.Close())
+
+	processors, err := getLayerPostProcessors([]string{NormalizeOwnership})
+	require.NoError(err)
+	out, err := processors[0].PostProcess(&buf)
+	require.NoError(err)
+	defer out.Close()
+	normalized, err := ioutil.ReadAll(out)
+	require.NoError(err)
+
+	tr := tar.NewReader(bytes.NewReader(normalized))
+	for _, name := range []string{"etc/", "etc/conf"} {
+		hdr, err := tr.Next()
+		require.NoError(err)
+		require.Equal(name, hdr.Name)
+		require.Equal(0, hdr.Uid)
+		require.Equal(0, hdr.Gid)
+		require.Empty(hdr.Uname)
+		require.Empty(hdr.Gname)
+	}
+	content, err := ioutil.ReadAll(tr)
+	require.NoError(err)
+	require.Equal("conf", string(content))
+	_, err = tr.Next()
+	require.Equal(io.EOF, err)
+
+	// Normalized layers are left unchanged.
+	out, err = processors[0].PostProcess(bytes.NewReader(normalized))
+	require.NoError(err)
+	defer out.Close()
+	again, err := ioutil.ReadAll(out)
+	require.NoError(err)
+	require.Equal(normalized, again)
+}
+
+func TestPostProcessLayers(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	pair, _ := writeGzipLayer(t, ctx)
+	original := *pair
+
+	p := &upperCasePostProcessor{}
+	RegisterLayerPostProcessor("uppercase", p)
+	processors, err := getLayerPostProcessors([]string{"uppercase"})
+	require.NoError(err)
+
+	// The layer is used by both nodes, and processed once.
+	config := &image.Config{RootFS: &image.RootFS{
+		Type:    "layers",
+		DiffIDs: []image.Digest{pair.TarDigest, pair.TarDigest},
+	}}
+	rootFS := config.RootFS
+	stage := &buildStage{
+		ctx: ctx,
+		nodes: []*buildNode{
+			{digestPairs: []*image.DigestPair{pair}},
+			{digestPairs: []*image.DigestPair{pair}},
+		},
+		lastImageConfig: config,
+	}
+	require.NoError(stage.postProcessLayers(processors))
+	require.Equal(1, p.calls)
+	require.Equal(original, *pair)
+	require.Equal([]image.Digest{pair.TarDigest, pair.TarDigest}, rootFS.DiffIDs)
+
+	processed := stage.nodes[0].digestPairs[0]
+	require.Equal(processed, stage.nodes[1].digestPairs[0])
+	require.NotEqual(pair.GzipDescriptor.Digest, processed.GzipDescriptor.Digest)
+	require.Equal(image.MediaTypeLayer, processed.GzipDescriptor.MediaType)
+	require.Equal(
+		[]image.Digest{processed.TarDigest, processed.TarDigest},
+		stage.lastImageConfig.RootFS.DiffIDs)
+
+	// The digests match the transformed content.
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(processed.GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipDigest, err := image.NewDigester().FromReader(r)
+	require.NoError(err)
+	require.Equal(processed.GzipDescriptor.Digest, gzipDigest)
+
+	r, err = ctx.ImageStore.Layers.GetStoreFileReader(processed.GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gr, err := tario.NewDecompressReader(r)
+	require.NoError(err)
+	defer gr.Close()
+	tarBytes, err := ioutil.ReadAll(gr)
+	require.NoError(err)
+	tarDigest, err := image.NewDigester().FromBytes(tarBytes)
+	require.NoError(err)
+	require.Equal(processed.TarDigest, tarDigest)
+	tr := tar.NewReader(bytes.NewReader(tarBytes))
+	_, err = tr.Next()
+	require.NoError(err)
+	content, err := ioutil.ReadAll(tr)
+	require.NoError(err)
+	require.Equal("TEST", string(content))
+}
+
+func TestGetLayerPostProcessors(t *testing.T) {
+	require := require.New(t)
+
+	RegisterLayerPostProcessor("noop", LayerPostProcessorFunc(
+		func(layer io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(layer), nil }))
+	processors, err := getLayerPostProcessors([]string{"noop", "noop"})
+	require.NoError(err)
+	require.Len(processors, 2)
+	require.Equal("noop", processors[0].name)
+
+	_, err = getLayerPostProcessors([]string{"noop", "missing"})
+	require.Error(err)
+	require.Contains(err.Error(), "unknown layer post-processor missing")
+}
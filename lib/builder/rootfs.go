@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// ExportRootFS writes the filesystem of the image to w as a single
+// uncompressed tar, with the whiteouts of its layers applied, and without its
+// manifest and config.
+func ExportRootFS(
+	store *storage.ImageStore, manifest *image.DistributionManifest, w io.Writer) error {
+
+	return snapshot.FlattenLayers(w, storeLayerOpeners(store, manifest.Layers))
+}
+
+// storeLayerOpeners returns openers of the uncompressed tar streams of the
+// layers, which must be in the store.
+func storeLayerOpeners(
+	store *storage.ImageStore, descriptors []image.Descriptor) []snapshot.LayerOpener {
+
+	layers := make([]snapshot.LayerOpener, len(descriptors))
+	for i, layer := range descriptors {
+		digest := layer.Digest
+		layers[i] = func() (io.ReadCloser, error) {
+			reader, err := store.Layers.GetStoreFileReader(digest.Hex())
+			if err != nil {
+				return nil, fmt.Errorf("get layer reader %s: %s", digest, err)
+			}
+			layerReader, err := tario.NewLayerReader(reader)
+			if err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("create layer reader %s: %s", digest, err)
+			}
+			return layerFile{layerReader, reader}, nil
+		}
+	}
+	return layers
+}
+
+// layerFile closes both the reader of a layer and its file.
+type layerFile struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (f layerFile) Close() error {
+	f.ReadCloser.Close()
+	return f.file.Close()
+}
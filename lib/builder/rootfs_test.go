@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportRootFS(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Writes a layer with the given files to the store, gzipped or not.
+	writeLayer := func(gzipped bool, files map[string]string) image.Descriptor {
+		var buf bytes.Buffer
+		var w io.WriteCloser = nopWriteCloser{&buf}
+		if gzipped {
+			gw, err := tario.NewGzipWriter(&buf, tario.DefaultOptions())
+			require.NoError(err)
+			w = gw
+		}
+		tw := tar.NewWriter(w)
+		for name, content := range files {
+			require.NoError(tw.WriteHeader(&tar.Header{
+				Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+			_, err := tw.Write([]byte(content))
+			require.NoError(err)
+		}
+		require.NoError(tw.Close())
+		require.NoError(w.Close())
+
+		digest, err := image.NewDigester().FromBytes(buf.Bytes())
+		require.NoError(err)
+		layerPath := filepath.Join(ctx.ImageStore.SandboxDir, "layer")
+		require.NoError(ioutil.WriteFile(layerPath, buf.Bytes(), 0644))
+		require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), layerPath))
+		return image.Descriptor{Digest: digest, Size: int64(buf.Len())}
+	}
+
+	manifest := &image.DistributionManifest{
+		Layers: []image.Descriptor{
+			writeLayer(true, map[string]string{"a": "a0", "b": "b0"}),
+			writeLayer(false, map[string]string{"a": "a1", ".wh.b": ""}),
+		},
+	}
+	var out bytes.Buffer
+	require.NoError(ExportRootFS(ctx.ImageStore, manifest, &out))
+
+	files := make(map[string]string)
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(err)
+		files[hdr.Name] = string(content)
+	}
+	require.Equal(map[string]string{"a": "a1"}, files)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
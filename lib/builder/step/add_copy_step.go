@@ -16,8 +16,8 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -25,8 +25,11 @@ import (
 	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/fileio"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 )
 
@@ -51,7 +54,11 @@ import (
 // - COPY dir1  /target/dir1/
 // - COPY dir1  /target/dir1  (same as prev)
 // - COPY dir1, dir2 ...   /tmp/dir1/
-// It also supports a "from" flag to specify a prev stage to copy files from.
+// It also supports a "from" flag to specify a prev stage to copy files from, and
+// a "parents" flag to copy each source under its parent dirs within <dest>, e.g.
+// COPY --parents src/a/b.txt /dst/ writes /dst/src/a/b.txt.
+// ADD also extracts local tar archives, possibly compressed with gzip, bzip2 or
+// xz, into <dest> as a directory, unless the "unpack" flag is false.
 type addCopyStep struct {
 	*baseStep
 
@@ -59,6 +66,12 @@ type addCopyStep struct {
 	fromPaths []string
 	toPath    string
 	chown     string
+	parents   bool
+	unpack    bool
+
+	// contextDir is the dir of the named build context copied from, if any,
+	// which replaces the build context.
+	contextDir string
 }
 
 // newAddCopyStep returns a BuildStep from given arguments.
@@ -78,6 +91,16 @@ func newAddCopyStep(
 	}, nil
 }
 
+// useBuildContextDirs makes the step copy from the named build context its
+// --from refers to, if it is one of dirs, like from the build context instead
+// of from the files of a stage.
+func (s *addCopyStep) useBuildContextDirs(dirs map[string]string) {
+	if contextDir, ok := dirs[strings.ToLower(s.fromStage)]; ok {
+		s.fromStage = ""
+		s.contextDir = contextDir
+	}
+}
+
 // RequireOnDisk returns true if the add/copy has a chown argument, as we need
 // to read the users file to translate user/group name to uid/gid.
 func (s *addCopyStep) RequireOnDisk() bool { return s.chown != "" }
@@ -102,9 +125,10 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 			return fmt.Errorf("read rand: %s", err)
 		}
 		s.cacheID = fmt.Sprintf("%x", b)
+		explainCacheID(ctx, s.directive, s.args, s.cacheID, cacheInput{"random", "copied from stage " + s.fromStage})
 	} else {
 		// Initialize the checksum with the seed, directive and args.
-		checksum := crc32.NewIEEE()
+		checksum := newCacheHash(ctx.Options.CacheHash)
 		_, err := checksum.Write([]byte(seed + string(s.directive) + s.args))
 		if err != nil {
 			return fmt.Errorf("hash copy directive: %s", err)
@@ -112,10 +136,13 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 
 		// If the step args and the contents of sources are identical,
 		// we should be able to use the cache from the previous build.
-		if err := s.updateContextChecksum(ctx, checksum); err != nil {
+		inputs, err := s.updateContextChecksum(ctx, checksum)
+		if err != nil {
 			return fmt.Errorf("hash context sources: %s", err)
 		}
-		s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
+		s.cacheID = cacheIDOf(checksum)
+		explainCacheID(ctx, s.directive, s.args, s.cacheID,
+			append([]cacheInput{{"seed", seed}, {"args", s.args}}, inputs...)...)
 	}
 	return nil
 }
@@ -123,7 +150,10 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 // Execute executes the add/copy step. If modifyFS is true, actually performs the on-disk copy.
 func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err error) {
 	sourceRoot := s.contextRootDir(ctx)
-	sources := s.resolveFromPaths(ctx)
+	sources, missing := s.resolveFromPaths(ctx)
+	for _, source := range missing {
+		log.Warnf("* Skipping missing source %s", source)
+	}
 	relPaths := make([]string, len(sources))
 	for i, source := range sources {
 		relPaths[i], err = pathutils.TrimRoot(source, sourceRoot)
@@ -132,69 +162,259 @@ func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err err
 		}
 	}
 
+	// Like Docker, names are resolved with the users and groups of the image
+	// being built, even when copying from another stage.
+	chown, err := s.resolveChown(ctx)
+	if err != nil {
+		return fmt.Errorf("resolve chown: %s", err)
+	}
+
 	internal := s.fromStage != ""
-	blacklist := append(pathutils.DefaultBlacklist, ctx.ImageStore.RootDir)
-	copyOp, err := snapshot.NewCopyOperation(
-		relPaths, sourceRoot, s.workingDir, s.toPath, s.chown, blacklist, internal)
+	blacklist := append(
+		pathutils.DefaultBlacklist, ctx.ImageStore.RootDir, ctx.ImageStore.SandboxDir)
+
+	// With parents, every source gets its own destination dir.
+	srcsByDst := map[string][]string{s.toPath: relPaths}
+	dsts := []string{s.toPath}
+	if s.parents {
+		srcsByDst = make(map[string][]string)
+		dsts = nil
+		for i, relPath := range relPaths {
+			dst := parentsDestination(s.toPath, sources[i], relPath)
+			if _, ok := srcsByDst[dst]; !ok {
+				dsts = append(dsts, dst)
+			}
+			srcsByDst[dst] = append(srcsByDst[dst], relPath)
+		}
+	}
+
+	// Archives are extracted in the sandbox, and their contents copied from
+	// there instead.
+	var extracted []string
+	if s.unpack && s.fromStage == "" {
+		srcsByDst[s.toPath], extracted, err = s.extractArchives(ctx, sources, relPaths)
+		if err != nil {
+			return fmt.Errorf("extract archives: %s", err)
+		}
+	}
+
+	ignored, err := s.ignoredPaths(ctx, sources)
 	if err != nil {
-		return fmt.Errorf("invalid copy operation: %s", err)
+		return fmt.Errorf("match dockerignore: %s", err)
 	}
 
-	ctx.CopyOps = append(ctx.CopyOps, copyOp)
-	if modifyFS {
-		return copyOp.Execute()
+	var copyOps []*snapshot.CopyOperation
+	for _, dst := range dsts {
+		if len(srcsByDst[dst]) == 0 {
+			continue
+		}
+		copyOp, err := snapshot.NewCopyOperation(
+			srcsByDst[dst], sourceRoot, s.workingDir, dst, chown, blacklist, internal)
+		if err != nil {
+			return fmt.Errorf("invalid copy operation: %s", err)
+		}
+		copyOp.Ignore(ignored)
+		copyOps = append(copyOps, copyOp)
+	}
+	for _, dir := range extracted {
+		copyOp, err := snapshot.NewCopyOperation(
+			[]string{"."}, dir, s.workingDir, s.toPath, chown, blacklist, true)
+		if err != nil {
+			return fmt.Errorf("invalid copy operation: %s", err)
+		}
+		copyOps = append(copyOps, copyOp)
+	}
+
+	for _, copyOp := range copyOps {
+		ctx.CopyOps = append(ctx.CopyOps, copyOp)
+		if modifyFS {
+			if err := copyOp.Execute(ctx.Options.Snapshot); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// resolveChown translates the chown argument to numeric ids, looking names up
+// in the build root.
+func (s *addCopyStep) resolveChown(ctx *context.BuildContext) (string, error) {
+	if s.chown == "" {
+		return "", nil
+	}
+	uid, gid, err := utils.ResolveChownInRoot(s.chown, ctx.RootDir)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+// extractArchives extracts the sources that are tar archives into new dirs in
+// the sandbox. It returns the relative paths of the other sources, and the
+// dirs archives were extracted to.
+func (s *addCopyStep) extractArchives(
+	ctx *context.BuildContext, sources, relPaths []string) ([]string, []string, error) {
+
+	var rest, dirs []string
+	for i, source := range sources {
+		if fi, err := os.Stat(source); err != nil || !fi.Mode().IsRegular() {
+			rest = append(rest, relPaths[i])
+			continue
+		} else if ok, err := tario.IsArchive(source); err != nil {
+			return nil, nil, fmt.Errorf("check archive %s: %s", source, err)
+		} else if !ok {
+			rest = append(rest, relPaths[i])
+			continue
+		}
+
+		dir, err := ioutil.TempDir(ctx.ImageStore.SandboxDir, "add-")
+		if err != nil {
+			return nil, nil, fmt.Errorf("create extraction dir: %s", err)
+		}
+		if err := extractArchive(source, dir, ctx.Options.Snapshot.Tar.SparseFiles); err != nil {
+			return nil, nil, fmt.Errorf("extract %s: %s", relPaths[i], err)
+		}
+		log.Infof("* Extracted archive %s", relPaths[i])
+		dirs = append(dirs, dir)
+	}
+	return rest, dirs, nil
+}
+
+func extractArchive(path, dir string, sparse bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %s", err)
+	}
+	defer f.Close()
+	r, err := tario.NewDecompressReader(f)
+	if err != nil {
+		return fmt.Errorf("decompress: %s", err)
+	}
+	if err := tario.Untar(r, dir, sparse); err != nil {
+		r.Close()
+		return fmt.Errorf("untar: %s", err)
+	}
+	return r.Close()
+}
+
+// parentsDestination returns the destination dir of a source copied with the
+// parents flag. Files are copied into their parent dir while the contents of
+// dirs are copied into the dir itself, both relative to the source root.
+func parentsDestination(toPath, source, relPath string) string {
+	if fi, err := os.Stat(source); err == nil && fi.IsDir() {
+		return filepath.Join(toPath, relPath) + "/"
+	}
+	return filepath.Join(toPath, filepath.Dir(relPath)) + "/"
+}
+
 // Updates the checksum passed in with the data stored in the context on the filesystem.
-func (s *addCopyStep) updateContextChecksum(ctx *context.BuildContext, checksum io.Writer) error {
+func (s *addCopyStep) updateContextChecksum(
+	ctx *context.BuildContext, checksum io.Writer) ([]cacheInput, error) {
+
 	if s.fromStage != "" {
-		return fmt.Errorf("not supported: the copy step has from stage flag")
+		return nil, fmt.Errorf("not supported: the copy step has from stage flag")
 	}
 
-	for _, source := range s.resolveFromPaths(ctx) {
+	// With ExplainCache, the sources are also checksummed one by one, so that
+	// the logs show which of them changed.
+	opts := ctx.Options
+	var inputs []cacheInput
+	sources, _ := s.resolveFromPaths(ctx)
+	ignored, err := s.ignoredPaths(ctx, sources)
+	if err != nil {
+		return nil, fmt.Errorf("match dockerignore: %s", err)
+	}
+	skip := make(map[string]bool, len(ignored))
+	for _, path := range ignored {
+		skip[path] = true
+	}
+	for _, source := range sources {
 		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				return fmt.Errorf("prev error during walk: %s", err)
+			} else if skip[path] && fi.IsDir() {
+				return filepath.SkipDir
+			} else if skip[path] {
+				return nil
+			} else if !opts.ExplainCache {
+				return checksumPathContents(opts.Snapshot.Tar, path, fi, checksum)
+			}
+			pathChecksum := newCacheHash(opts.CacheHash)
+			if err := checksumPathContents(opts.Snapshot.Tar, path, fi, io.MultiWriter(checksum, pathChecksum)); err != nil {
+				return err
 			}
-			return checksumPathContents(path, fi, checksum)
+			inputs = append(inputs, cacheInput{path, cacheIDOf(pathChecksum)})
+			return nil
 		}); err != nil {
-			return fmt.Errorf("walk %s: %s", source, err)
+			return nil, fmt.Errorf("walk %s: %s", source, err)
 		}
 	}
-	return nil
+	return inputs, nil
 }
 
-func (s *addCopyStep) resolveFromPaths(ctx *context.BuildContext) []string {
+// resolveFromPaths expands the globs of the sources. With CopyAllowMissing,
+// the sources of the build context that don't exist are returned separately,
+// relative to its root.
+func (s *addCopyStep) resolveFromPaths(ctx *context.BuildContext) ([]string, []string) {
 	root := s.contextRootDir(ctx)
 	sources := []string{}
-	for _, source := range s.fromPaths {
-		source = filepath.Join(root, source)
+	var missing []string
+	for _, fromPath := range s.fromPaths {
+		source := filepath.Join(root, fromPath)
 		matches, err := filepath.Glob(source)
 		if err != nil || len(matches) == 0 {
+			if s.allowMissing(ctx) && err == nil {
+				if _, err := os.Lstat(source); os.IsNotExist(err) {
+					missing = append(missing, fromPath)
+					continue
+				}
+			}
 			sources = append(sources, source)
 		} else {
 			sources = append(sources, matches...)
 		}
 	}
-	return sources
+	return sources, missing
+}
+
+// ignoredPaths returns the sources and paths under them that aren't copied
+// because of Dockerignore. It only applies to the build context, not to other
+// stages or named build contexts.
+func (s *addCopyStep) ignoredPaths(ctx *context.BuildContext, sources []string) ([]string, error) {
+	if s.fromStage != "" || s.contextDir != "" {
+		return nil, nil
+	}
+	return ignoredPaths(ctx.Options.Dockerignore, ctx.ContextDir, sources)
+}
+
+// allowMissing returns true if missing sources are skipped. Sources copied
+// from stages must exist, as they are checkpointed before the copy.
+func (s *addCopyStep) allowMissing(ctx *context.BuildContext) bool {
+	return ctx.Options.CopyAllowMissing && s.fromStage == ""
 }
 
 func (s *addCopyStep) contextRootDir(ctx *context.BuildContext) string {
 	if s.fromStage != "" {
 		return ctx.CopyFromRoot(s.fromStage)
+	} else if s.contextDir != "" {
+		return s.contextDir
 	}
 	return ctx.ContextDir
 }
 
-func checksumPathContents(path string, fi os.FileInfo, checksum io.Writer) error {
-	// Skip special files.
+func checksumPathContents(
+	tarOpts tario.Options, path string, fi os.FileInfo, checksum io.Writer) error {
+
+	// Skip special files, which are never read. Devices and named pipes kept
+	// in layers are checksummed by their path, mode and device number.
 	if utils.IsSpecialFile(fi) {
 		if fi.IsDir() {
 			return filepath.SkipDir
+		} else if !tarOpts.IsKeptSpecialFile(fi) {
+			return nil
 		}
-		return nil
+		_, err := fmt.Fprintf(checksum, "%s%s%d", path, fi.Mode(), utils.FileInfoStat(fi).Rdev)
+		return err
 	}
 
 	if _, err := checksum.Write([]byte(path)); err != nil {
@@ -216,10 +436,11 @@ func checksumPathContents(path string, fi os.FileInfo, checksum io.Writer) error
 		return err
 	}
 
-	fh, err := os.Open(path)
+	fh, err := fileio.Open(path)
 	if err != nil {
 		return fmt.Errorf("open %s: %s", path, err)
 	}
+	defer fh.Close()
 	if _, err := io.Copy(checksum, fh); err != nil {
 		return fmt.Errorf("read %s: %s", path, err)
 	}
@@ -21,11 +21,16 @@ type AddStep struct {
 	*addCopyStep
 }
 
-// NewAddStep creates a new AddStep
-func NewAddStep(args, chown string, fromPaths []string, toPath string, commit bool) (*AddStep, error) {
+// NewAddStep creates a new AddStep.
+// If unpack is true, local tar archives are extracted into the destination.
+func NewAddStep(
+	args, chown string, fromPaths []string, toPath string, unpack, commit bool,
+) (*AddStep, error) {
+
 	s, err := newAddCopyStep(Add, args, chown, "", fromPaths, toPath, commit)
 	if err != nil {
 		return nil, fmt.Errorf("new add/copy step: %s", err)
 	}
+	s.unpack = unpack
 	return &AddStep{s}, nil
 }
@@ -0,0 +1,156 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestArchive writes a gzipped tar with nested dirs to path.
+func writeTestArchive(t *testing.T, path string) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0750}, ""},
+		{tar.Header{Name: "app/bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755}, "run"},
+		{tar.Header{Name: "app/conf", Typeflag: tar.TypeReg, Mode: 0600}, "conf"},
+	} {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestAddStepExecuteUnpack(t *testing.T) {
+	t.Run("Unpack", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		writeTestArchive(t, filepath.Join(context.ContextDir, "app.tar.gz"))
+		require.NoError(ioutil.WriteFile(
+			filepath.Join(context.ContextDir, "plain.gz"), []byte("plain"), 0644))
+
+		targetDir := filepath.Join(context.RootDir, "target")
+		step, err := NewAddStep(
+			"", "", []string{"app.tar.gz", "plain.gz"}, targetDir+"/", true, false)
+		require.NoError(err)
+		require.NoError(step.Execute(context, true))
+		require.Len(context.CopyOps, 2)
+
+		for p, content := range map[string]string{
+			"app/bin/run.sh": "run",
+			"app/conf":       "conf",
+			"plain.gz":       "plain",
+		} {
+			result, err := ioutil.ReadFile(filepath.Join(targetDir, p))
+			require.NoError(err)
+			require.Equal(content, string(result))
+		}
+		for p, mode := range map[string]os.FileMode{
+			"app":            0750,
+			"app/bin/run.sh": 0755,
+			"app/conf":       0600,
+		} {
+			fi, err := os.Stat(filepath.Join(targetDir, p))
+			require.NoError(err)
+			require.Equal(mode, fi.Mode().Perm())
+		}
+		_, err = os.Stat(filepath.Join(targetDir, "app.tar.gz"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("NoUnpack", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		writeTestArchive(t, filepath.Join(context.ContextDir, "app.tar.gz"))
+
+		targetDir := filepath.Join(context.RootDir, "target")
+		step, err := NewAddStep("", "", []string{"app.tar.gz"}, targetDir+"/", false, false)
+		require.NoError(err)
+		require.NoError(step.Execute(context, true))
+
+		expected, err := ioutil.ReadFile(filepath.Join(context.ContextDir, "app.tar.gz"))
+		require.NoError(err)
+		result, err := ioutil.ReadFile(filepath.Join(targetDir, "app.tar.gz"))
+		require.NoError(err)
+		require.Equal(expected, result)
+	})
+
+	t.Run("CommitWithoutModifyFS", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		writeTestArchive(t, filepath.Join(context.ContextDir, "app.tar.gz"))
+
+		step, err := NewAddStep("", "", []string{"app.tar.gz"}, "/target", true, true)
+		require.NoError(err)
+		require.NoError(step.Execute(context, false))
+		digestPairs, err := step.Commit(context)
+		require.NoError(err)
+		require.Len(digestPairs, 1)
+
+		r, err := context.ImageStore.Layers.GetStoreFileReader(
+			digestPairs[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		gzipReader, err := tario.NewGzipReader(r)
+		require.NoError(err)
+		defer gzipReader.Close()
+		var names []string
+		tr := tar.NewReader(gzipReader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		sort.Strings(names)
+		require.Equal([]string{
+			"target",
+			"target/app/",
+			"target/app/bin/",
+			"target/app/bin/run.sh",
+			"target/app/conf",
+		}, names)
+	})
+}
@@ -16,7 +16,6 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"os"
 	"strconv"
 
@@ -61,8 +60,9 @@ func (s *baseStep) String() string {
 // Special steps like FROM, ADD, COPY have their own implementations.
 func (s *baseStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	commitStr := fmt.Sprintf("%v", s.commit)
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.args + commitStr))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	s.cacheID = CacheChecksum(ctx.Options.CacheHash, seed+string(s.directive)+s.args+commitStr)
+	explainCacheID(ctx, s.directive, s.args, s.cacheID,
+		cacheInput{"seed", seed}, cacheInput{"args", s.args}, cacheInput{"commit", commitStr})
 	return nil
 }
 
@@ -100,7 +100,7 @@ func (s *baseStep) SetEnvFromContext(
 			value = unquoted
 		}
 		value = os.ExpandEnv(value)
-		if err := os.Setenv(key, value); err != nil {
+		if err := ctx.Setenv(key, value); err != nil {
 			return fmt.Errorf("failed to set env %s=%s: %s", key, value, err)
 		}
 	}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// imageContextPrefix marks named build contexts that are images, like in
+// BuildKit.
+const imageContextPrefix = "docker-image://"
+
+// SetBuildContexts parses named contexts formatted as <name>=<dir> or
+// <name>=docker-image://<image> into the BuildContextDirs and
+// BuildContextImages of opts, which COPY --from=<name> can copy from. They are
+// keyed by their lowercased names, as like stage names, they are case
+// insensitive. Directories must exist.
+func SetBuildContexts(opts *context.BuildOptions, contexts []string) error {
+	dirs := make(map[string]string)
+	images := make(map[string]string)
+	for _, c := range contexts {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("failed to parse build context %s, expected <name>=<dir|docker-image://image>", c)
+		}
+		name, src := strings.ToLower(parts[0]), parts[1]
+		if _, ok := dirs[name]; ok {
+			return fmt.Errorf("duplicate build context %s", parts[0])
+		} else if _, ok := images[name]; ok {
+			return fmt.Errorf("duplicate build context %s", parts[0])
+		}
+
+		if strings.HasPrefix(src, imageContextPrefix) {
+			ref := strings.TrimPrefix(src, imageContextPrefix)
+			if parsed, err := image.ParseNameForPull(ref); err != nil || !parsed.IsValid() {
+				return fmt.Errorf("invalid image %s of build context %s", ref, parts[0])
+			}
+			images[name] = ref
+			continue
+		} else if strings.Contains(src, "://") {
+			return fmt.Errorf("unsupported source %s of build context %s", src, parts[0])
+		}
+
+		dir, err := filepath.Abs(src)
+		if err != nil {
+			return fmt.Errorf("resolve dir of build context %s: %s", parts[0], err)
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("dir of build context %s: %s", parts[0], err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("dir of build context %s: %s is not a directory", parts[0], dir)
+		} else if dir == "/" {
+			return fmt.Errorf("dir of build context %s cannot be /", parts[0])
+		}
+		dirs[name] = dir
+	}
+	opts.BuildContextDirs = dirs
+	opts.BuildContextImages = images
+	return nil
+}
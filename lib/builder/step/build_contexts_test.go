@@ -0,0 +1,66 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetBuildContexts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	tests := []struct {
+		desc     string
+		contexts []string
+		dirs     map[string]string
+		images   map[string]string
+		wantErr  bool
+	}{
+		{"dir", []string{"Data=" + tmpDir}, map[string]string{"data": tmpDir}, map[string]string{}, false},
+		{"image", []string{"base=docker-image://alpine:3.10"}, map[string]string{}, map[string]string{"base": "alpine:3.10"}, false},
+		{"missing dir", []string{"data=" + filepath.Join(tmpDir, "missing")}, nil, nil, true},
+		{"file", []string{"data=" + file}, nil, nil, true},
+		{"root", []string{"data=/"}, nil, nil, true},
+		{"invalid image", []string{"base=docker-image://bad:image:"}, nil, nil, true},
+		{"unsupported source", []string{"src=https://github.com/uber/makisu.git"}, nil, nil, true},
+		{"duplicate", []string{"data=" + tmpDir, "DATA=docker-image://alpine"}, nil, nil, true},
+		{"no name", []string{"=" + tmpDir}, nil, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			opts := context.DefaultBuildOptions()
+			err := SetBuildContexts(opts, test.contexts)
+			if test.wantErr {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.dirs, opts.BuildContextDirs)
+			require.Equal(test.images, opts.BuildContextImages)
+		})
+	}
+}
@@ -0,0 +1,225 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// caBundlePaths are the locations of the CA bundles of common distributions,
+// which TLS clients read by default. The first one is created if none of them
+// exist.
+var caBundlePaths = []string{
+	"etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine.
+	"etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL.
+	"etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS.
+	"etc/ssl/ca-bundle.pem",                            // OpenSUSE.
+	"etc/ssl/cert.pem",                                 // Alpine, Arch.
+}
+
+// SetBuildCACerts reads the PEM files at paths into the BuildCACerts of opts.
+// Each file must contain at least one certificate.
+func SetBuildCACerts(opts *context.BuildOptions, paths []string) error {
+	var certs []byte
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read build ca cert: %s", err)
+		}
+		if err := checkPEMCerts(content); err != nil {
+			return fmt.Errorf("invalid build ca cert %s: %s", path, err)
+		}
+		certs = append(certs, bytes.TrimSpace(content)...)
+		certs = append(certs, '\n')
+	}
+	opts.BuildCACerts = certs
+	return nil
+}
+
+// checkPEMCerts returns an error unless content has at least one PEM
+// certificate, and all of them can be parsed.
+func checkPEMCerts(content []byte) error {
+	var found bool
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		} else if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no PEM certificate found")
+	}
+	return nil
+}
+
+// addCACerts appends certs to the CA bundles under rootDir. Bundles that are
+// symlinks are skipped, as they point to one of the others. If there is no
+// bundle, the first of caBundlePaths is created.
+func addCACerts(rootDir string, certs []byte) (restore func() error, err error) {
+	if len(certs) == 0 {
+		return noRestore, nil
+	}
+	var restores []func() error
+	restoreAll := func() error {
+		var errs []string
+		for i := len(restores) - 1; i >= 0; i-- {
+			if err := restores[i](); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) != 0 {
+			return fmt.Errorf("restore ca bundles: %s", strings.Join(errs, "; "))
+		}
+		return nil
+	}
+	for _, p := range caBundlePaths {
+		path := filepath.Join(rootDir, p)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+			continue
+		} else if err != nil {
+			restoreAll()
+			return nil, fmt.Errorf("stat %s: %s", path, err)
+		}
+		r, err := appendToBundle(path, fi, certs)
+		if err != nil {
+			restoreAll()
+			return nil, err
+		}
+		restores = append(restores, r)
+	}
+	if len(restores) != 0 {
+		return restoreAll, nil
+	}
+	return createFile(filepath.Join(rootDir, caBundlePaths[0]), certs, 0644)
+}
+
+// appendToBundle appends certs to the existing bundle at path. The returned
+// function removes them again along with the mtime of the bundle, so that it
+// isn't committed. If the RUN command rewrote the bundle in the meantime, it
+// is left as is.
+func appendToBundle(path string, fi os.FileInfo, certs []byte) (restore func() error, err error) {
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %s", path, err)
+	}
+	added := certs
+	if len(original) != 0 && !bytes.HasSuffix(original, []byte("\n")) {
+		added = append([]byte("\n"), certs...)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %s", path, err)
+	}
+	_, err = f.Write(added)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		ioutil.WriteFile(path, original, fi.Mode())
+		return nil, fmt.Errorf("write %s: %s", path, err)
+	}
+
+	return func() error {
+		current, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read %s: %s", path, err)
+		}
+		i := bytes.Index(current, added)
+		if i < 0 {
+			return nil
+		}
+		restored := append(current[:i:i], current[i+len(added):]...)
+		if err := ioutil.WriteFile(path, restored, fi.Mode()); err != nil {
+			return fmt.Errorf("write %s: %s", path, err)
+		}
+		if bytes.Equal(restored, original) {
+			return os.Chtimes(path, time.Now(), fi.ModTime())
+		}
+		return nil
+	}, nil
+}
+
+// createFile writes content to a new file at path, creating its missing parent
+// directories. The returned function removes the file and those directories,
+// and restores the mtime of the directory they were created in.
+func createFile(path string, content []byte, mode os.FileMode) (restore func() error, err error) {
+	// Find the closest existing ancestor, whose mtime changes.
+	parent := filepath.Dir(path)
+	var created []string
+	for {
+		if _, err := os.Stat(parent); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("stat %s: %s", parent, err)
+		}
+		created = append(created, parent)
+		parent = filepath.Dir(parent)
+	}
+	parentFi, err := os.Stat(parent)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %s", parent, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create dir of %s: %s", path, err)
+	}
+	undo := func() error {
+		// A file the RUN command wrote, e.g. a bundle written by installing
+		// ca-certificates, is kept.
+		current, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read %s: %s", path, err)
+		} else if !bytes.Equal(current, content) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove %s: %s", path, err)
+		}
+		// Directories the RUN command added files to are kept.
+		for _, dir := range created {
+			if err := os.Remove(dir); err != nil {
+				return nil
+			}
+		}
+		return os.Chtimes(parent, time.Now(), parentFi.ModTime())
+	}
+	if err := ioutil.WriteFile(path, content, mode); err != nil {
+		undo()
+		return nil, fmt.Errorf("write %s: %s", path, err)
+	}
+	return undo, nil
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func caCertFixture(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "makisu test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestSetBuildCACerts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	valid := filepath.Join(tmpDir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(valid, caCertFixture(t), 0644))
+	invalid := filepath.Join(tmpDir, "invalid.pem")
+	require.NoError(t, ioutil.WriteFile(invalid, []byte("not a cert"), 0644))
+
+	tests := []struct {
+		desc    string
+		paths   []string
+		wantErr bool
+	}{
+		{"valid", []string{valid, valid}, false},
+		{"no certificate", []string{invalid}, true},
+		{"missing", []string{filepath.Join(tmpDir, "missing.pem")}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			opts := context.DefaultBuildOptions()
+			err := SetBuildCACerts(opts, test.paths)
+			if test.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, checkPEMCerts(opts.BuildCACerts))
+			}
+		})
+	}
+}
+
+func TestAddCACerts(t *testing.T) {
+	certs := caCertFixture(t)
+
+	t.Run("existing", func(t *testing.T) {
+		require := require.New(t)
+		rootDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+
+		path := filepath.Join(rootDir, caBundlePaths[1])
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte("existing"), 0644))
+		mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		require.NoError(os.Chtimes(path, mtime, mtime))
+		// Symlinked bundles point to one of the others.
+		link := filepath.Join(rootDir, caBundlePaths[len(caBundlePaths)-1])
+		require.NoError(os.MkdirAll(filepath.Dir(link), 0755))
+		require.NoError(os.Symlink(path, link))
+
+		restore, err := addCACerts(rootDir, certs)
+		require.NoError(err)
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("existing\n"+string(certs), string(content))
+		_, err = os.Stat(filepath.Join(rootDir, caBundlePaths[0]))
+		require.True(os.IsNotExist(err))
+
+		require.NoError(restore())
+		content, err = ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("existing", string(content))
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.True(fi.ModTime().Equal(mtime))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		require := require.New(t)
+		rootDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+
+		require.NoError(os.Mkdir(filepath.Join(rootDir, "etc"), 0755))
+		mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		require.NoError(os.Chtimes(filepath.Join(rootDir, "etc"), mtime, mtime))
+
+		restore, err := addCACerts(rootDir, certs)
+		require.NoError(err)
+		path := filepath.Join(rootDir, caBundlePaths[0])
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal(certs, content)
+
+		require.NoError(restore())
+		_, err = os.Stat(filepath.Join(rootDir, "etc/ssl"))
+		require.True(os.IsNotExist(err))
+		fi, err := os.Stat(filepath.Join(rootDir, "etc"))
+		require.NoError(err)
+		require.True(fi.ModTime().Equal(mtime))
+	})
+
+	t.Run("rewritten", func(t *testing.T) {
+		require := require.New(t)
+		rootDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+
+		path := filepath.Join(rootDir, caBundlePaths[0])
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte("existing\n"), 0644))
+
+		restore, err := addCACerts(rootDir, certs)
+		require.NoError(err)
+		// Like update-ca-certificates, the command regenerates the bundle.
+		require.NoError(ioutil.WriteFile(path, []byte("regenerated\n"), 0644))
+
+		require.NoError(restore())
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("regenerated\n", string(content))
+	})
+}
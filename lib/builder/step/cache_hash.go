@@ -0,0 +1,71 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// cacheHashes are the supported algorithms of the CacheHash option.
+var cacheHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// cacheIDSize is the number of bytes of the hashes kept in cache IDs, so that
+// the IDs fit in registry tags whatever the algorithm.
+const cacheIDSize = sha256.Size
+
+// SetCacheHash sets the CacheHash of opts after checking that the algorithm
+// is supported.
+func SetCacheHash(opts *context.BuildOptions, algorithm string) error {
+	if _, ok := cacheHashes[algorithm]; !ok {
+		var supported []string
+		for name := range cacheHashes {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("unsupported cache hash %s, expected one of %s",
+			algorithm, strings.Join(supported, ", "))
+	}
+	opts.CacheHash = algorithm
+	return nil
+}
+
+// newCacheHash returns a new hash of the algorithm.
+func newCacheHash(algorithm string) hash.Hash {
+	return cacheHashes[algorithm]()
+}
+
+// cacheIDOf returns the cache ID made of the sum of h.
+func cacheIDOf(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil)[:cacheIDSize])
+}
+
+// CacheChecksum returns the cache ID made of the hash of data with the
+// algorithm.
+func CacheChecksum(algorithm, data string) string {
+	h := newCacheHash(algorithm)
+	h.Write([]byte(data))
+	return cacheIDOf(h)
+}
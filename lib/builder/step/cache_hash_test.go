@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetCacheHash(t *testing.T) {
+	t.Run("supported", func(t *testing.T) {
+		require := require.New(t)
+
+		opts := context.DefaultBuildOptions()
+		require.NoError(SetCacheHash(opts, "sha256"))
+		sha256ID := CacheChecksum(opts.CacheHash, "FROM alpine")
+		require.Len(sha256ID, 64)
+		require.Equal(sha256ID, CacheChecksum(opts.CacheHash, "FROM alpine"))
+
+		require.NoError(SetCacheHash(opts, "sha512"))
+		require.Equal("sha512", opts.CacheHash)
+		sha512ID := CacheChecksum(opts.CacheHash, "FROM alpine")
+		require.Len(sha512ID, 64)
+		require.NotEqual(sha256ID, sha512ID)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		require := require.New(t)
+
+		opts := context.DefaultBuildOptions()
+		err := SetCacheHash(opts, "crc32")
+		require.Error(err)
+		require.Contains(err.Error(), "sha256, sha512")
+		require.Equal("sha256", opts.CacheHash)
+	})
+}
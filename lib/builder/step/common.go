@@ -15,60 +15,174 @@
 package step
 
 import (
-	"archive/tar"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/stream"
 	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils"
 )
 
 // tarAndGzipDiffs tars and gzips files to a temporary location.
-// It returns two digesters and the temporary file name.
-func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) error) (
+// It returns two digesters and the temporary file name. The temporary file is
+// removed if it fails, so that truncated layers never make it to the store.
+func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tario.Writer) error) (
 	gzipDigester hash.Hash, tarDigester hash.Hash, name string, err error) {
 
 	tempGzipTar, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layertar-")
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("temp gzip tar file: %s", err)
+		return nil, nil, "", fmt.Errorf("temp gzip tar file: %s",
+			utils.CheckOutOfDisk(err, ctx.ImageStore.SandboxDir))
 	}
+	defer func() {
+		if err != nil {
+			os.Remove(tempGzipTar.Name())
+		}
+	}()
 	defer tempGzipTar.Close()
 
 	gzipDigester = sha256.New()
 	tarDigester = sha256.New()
 
-	gzipMulti := stream.NewConcurrentMultiWriter(tempGzipTar, gzipDigester)
-	gzipper, err := tario.NewGzipWriter(gzipMulti)
+	gzipMulti := stream.NewConcurrentMultiWriter(fileWriter{tempGzipTar}, gzipDigester)
+	gzipper, err := tario.NewGzipWriter(gzipMulti, ctx.Options.Snapshot.Tar)
 	if err != nil {
 		return nil, nil, "", fmt.Errorf("new gzip writer: %s", err)
 	}
-	defer gzipper.Close()
 
 	multiWriter := stream.NewConcurrentMultiWriter(tarDigester, gzipper)
-	tarWriter := tar.NewWriter(multiWriter)
-	defer tarWriter.Close()
+	tarWriter := tario.NewWriter(multiWriter, ctx.Options.Snapshot.Tar)
 
 	if err := writeDiffs(tarWriter); err != nil {
 		return nil, nil, "", fmt.Errorf("write diffs: %s", err)
 	}
 
+	// Closing flushes the end of the layer, which can fail as well.
+	if err := tarWriter.Close(); err != nil {
+		return nil, nil, "", fmt.Errorf("close tar writer: %s", err)
+	}
+	if err := gzipper.Close(); err != nil {
+		return nil, nil, "", fmt.Errorf("close gzip writer: %s", err)
+	}
+	if err := tempGzipTar.Close(); err != nil {
+		return nil, nil, "", fmt.Errorf("close temp gzip tar file: %s",
+			utils.CheckOutOfDisk(err, tempGzipTar.Name()))
+	}
 	return gzipDigester, tarDigester, tempGzipTar.Name(), nil
 }
 
+// tarDiffsMaybeGzip is like tarAndGzipDiffs, but writes the tar uncompressed
+// first while sampling its entropy, and only gzips it if the entropy is under
+// the IncompressibleEntropy of the build, so that CPU isn't wasted on compressing content
+// that doesn't shrink. It returns whether the layer was gzipped; otherwise both
+// digesters are the tar one.
+func tarDiffsMaybeGzip(ctx *context.BuildContext, writeDiffs func(*tario.Writer) error) (
+	layerDigester hash.Hash, tarDigester hash.Hash, name string, gzipped bool, err error) {
+
+	tempTar, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layertar-")
+	if err != nil {
+		return nil, nil, "", false, fmt.Errorf("temp tar file: %s",
+			utils.CheckOutOfDisk(err, ctx.ImageStore.SandboxDir))
+	}
+	defer func() {
+		if err != nil || gzipped {
+			os.Remove(tempTar.Name())
+		}
+	}()
+	defer tempTar.Close()
+
+	tarDigester = sha256.New()
+	sampler := &tario.EntropySampler{}
+	tarWriter := tario.NewWriter(
+		stream.NewConcurrentMultiWriter(fileWriter{tempTar}, tarDigester, sampler),
+		ctx.Options.Snapshot.Tar)
+
+	if err := writeDiffs(tarWriter); err != nil {
+		return nil, nil, "", false, fmt.Errorf("write diffs: %s", err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, nil, "", false, fmt.Errorf("close tar writer: %s", err)
+	}
+	if err := tempTar.Close(); err != nil {
+		return nil, nil, "", false, fmt.Errorf("close temp tar file: %s",
+			utils.CheckOutOfDisk(err, tempTar.Name()))
+	}
+
+	entropy := sampler.Entropy()
+	if entropy >= ctx.Options.Snapshot.Tar.IncompressibleEntropy {
+		log.Infof("* Storing layer uncompressed, its sampled entropy is %.2f bits per byte", entropy)
+		return tarDigester, tarDigester, tempTar.Name(), false, nil
+	}
+	layerDigester, name, err = gzipFile(ctx, tempTar.Name())
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	return layerDigester, tarDigester, name, true, nil
+}
+
+// gzipFile gzips the file at path to a temporary location, and returns its
+// digester and name. The temporary file is removed if it fails.
+func gzipFile(ctx *context.BuildContext, path string) (hash.Hash, string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("open temp tar file: %s", err)
+	}
+	defer src.Close()
+
+	tempGzipTar, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layertar-")
+	if err != nil {
+		return nil, "", fmt.Errorf("temp gzip tar file: %s",
+			utils.CheckOutOfDisk(err, ctx.ImageStore.SandboxDir))
+	}
+	defer tempGzipTar.Close()
+
+	gzipDigester := sha256.New()
+	gzipper, err := tario.NewGzipWriter(
+		stream.NewConcurrentMultiWriter(fileWriter{tempGzipTar}, gzipDigester),
+		ctx.Options.Snapshot.Tar)
+	if err == nil {
+		_, err = io.Copy(gzipper, src)
+		if closeErr := gzipper.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = utils.CheckOutOfDisk(tempGzipTar.Close(), tempGzipTar.Name())
+	}
+	if err != nil {
+		os.Remove(tempGzipTar.Name())
+		return nil, "", fmt.Errorf("gzip temp tar file: %s", err)
+	}
+	return gzipDigester, tempGzipTar.Name(), nil
+}
+
+// fileWriter reports writes that failed because the disk is full with the
+// path of the file.
+type fileWriter struct {
+	*os.File
+}
+
+func (w fileWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	return n, utils.CheckOutOfDisk(err, w.Name())
+}
+
 // commitLayer commits a layer by either scan or copy operations, depending on the context.
 func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
-	var writeDiffs func(w *tar.Writer) error
+	var writeDiffs func(w *tario.Writer) error
 	if ctx.MustScan {
 		writeDiffs = ctx.MemFS.AddLayerByScan
 	} else if len(ctx.CopyOps) > 0 {
-		writeDiffs = func(w *tar.Writer) error {
+		writeDiffs = func(w *tario.Writer) error {
 			return ctx.MemFS.AddLayerByCopyOps(ctx.CopyOps, w)
 		}
 	} else {
@@ -76,7 +190,29 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 		return nil, nil
 	}
 
-	gzipTarDigester, tarDigester, tempFileName, err := tarAndGzipDiffs(ctx, writeDiffs)
+	digestPair, err := CommitDiffs(ctx, writeDiffs)
+	if err != nil {
+		return nil, err
+	}
+	ctx.MustScan = false
+	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
+	return []*image.DigestPair{digestPair}, nil
+}
+
+// CommitDiffs writes a layer with writeDiffs, gzipped unless its entropy
+// reaches the IncompressibleEntropy of the build, and moves it into the layer store.
+func CommitDiffs(
+	ctx *context.BuildContext, writeDiffs func(*tario.Writer) error) (*image.DigestPair, error) {
+
+	var gzipTarDigester, tarDigester hash.Hash
+	var tempFileName string
+	var err error
+	gzipped := true
+	if ctx.Options.Snapshot.Tar.IncompressibleEntropy == 0 {
+		gzipTarDigester, tarDigester, tempFileName, err = tarAndGzipDiffs(ctx, writeDiffs)
+	} else {
+		gzipTarDigester, tarDigester, tempFileName, gzipped, err = tarDiffsMaybeGzip(ctx, writeDiffs)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate diff layer: %s", err)
 	}
@@ -93,18 +229,18 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 		return nil, fmt.Errorf("get store file stat %s: %s", gzipTarSHA256, err)
 	}
 
+	mediaType := image.MediaTypeLayer
+	if !gzipped {
+		mediaType = image.MediaTypeLayerUncompressed
+	}
 	layerTarDigest := image.Digest("sha256:" + tarSHA256)
 	layerGzipDescriptor := image.Descriptor{
-		MediaType: image.MediaTypeLayer,
+		MediaType: mediaType,
 		Size:      info.Size(),
 		Digest:    image.Digest("sha256:" + gzipTarSHA256),
 	}
-	ctx.MustScan = false
-	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
-	return []*image.DigestPair{
-		{
-			TarDigest:      layerTarDigest,
-			GzipDescriptor: layerGzipDescriptor,
-		},
+	return &image.DigestPair{
+		TarDigest:      layerTarDigest,
+		GzipDescriptor: layerGzipDescriptor,
 	}, nil
 }
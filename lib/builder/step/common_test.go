@@ -16,6 +16,7 @@ package step
 
 import (
 	"archive/tar"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -23,6 +24,7 @@ import (
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/tario"
 
 	"github.com/stretchr/testify/require"
@@ -56,7 +58,7 @@ func TestTarAndGzipDiffsEmpty(t *testing.T) {
 	context, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	_, _, name, err := tarAndGzipDiffs(context, func(*tar.Writer) error { return nil })
+	_, _, name, err := tarAndGzipDiffs(context, func(*tario.Writer) error { return nil })
 	require.NoError(err)
 
 	f, err := os.Open(name)
@@ -102,7 +104,7 @@ func TestCommitDiffs(t *testing.T) {
 		verifyGzippedTar func(io.Reader)
 	}{
 		{
-			NewRunStep("", "touch file1 && touch file2", true),
+			NewRunStep("", "touch file1 && touch file2", nil, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -111,7 +113,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "mkdir dir1 && rm file1", true),
+			NewRunStep("", "mkdir dir1 && rm file1", nil, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -120,7 +122,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "rm -rf dir1", true),
+			NewRunStep("", "rm -rf dir1", nil, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(1, len(files))
@@ -128,7 +130,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "ls ./", true),
+			NewRunStep("", "ls ./", nil, true),
 			func(f io.Reader) {
 				// Verify no files were tarred, since the command doesn't write to or create any files.
 				files := readGzippedTar(t, f)
@@ -150,3 +152,79 @@ func TestCommitDiffs(t *testing.T) {
 		test.verifyGzippedTar(f)
 	}
 }
+
+func TestCommitIncompressibleLayers(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Options.Snapshot.Tar.IncompressibleEntropy = 7.5
+
+	tests := []struct {
+		cmd       string
+		mediaType string
+	}{
+		{"head -c 1048576 /dev/urandom > random", image.MediaTypeLayerUncompressed},
+		{"seq 1 100000 > text", image.MediaTypeLayer},
+	}
+	for _, test := range tests {
+		runStep := NewRunStep("", test.cmd, nil, true)
+		require.NoError(runStep.ApplyCtxAndConfig(ctx, nil))
+		require.NoError(runStep.Execute(ctx, true))
+		digestPairs, err := runStep.Commit(ctx)
+		require.NoError(err)
+		require.Len(digestPairs, 1)
+		pair := digestPairs[0]
+		require.Equal(test.mediaType, pair.GzipDescriptor.MediaType)
+		require.Equal(test.mediaType == image.MediaTypeLayerUncompressed,
+			pair.TarDigest == pair.GzipDescriptor.Digest)
+
+		f, err := ctx.ImageStore.Layers.GetStoreFileReader(pair.GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer f.Close()
+		r, err := tario.NewLayerReader(f)
+		require.NoError(err)
+		digest, err := image.NewDigester().FromReader(r)
+		require.NoError(err)
+		require.Equal(pair.TarDigest, digest)
+	}
+
+	entries, err := ioutil.ReadDir(ctx.ImageStore.SandboxDir)
+	require.NoError(err)
+	for _, entry := range entries {
+		require.False(strings.HasPrefix(entry.Name(), "layertar-"), entry.Name())
+	}
+}
+
+func TestTarAndGzipDiffsFailureRemovesTempFile(t *testing.T) {
+	require := require.New(t)
+
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	_, _, _, err := tarAndGzipDiffs(context, func(*tario.Writer) error {
+		return errors.New("test error")
+	})
+	require.Error(err)
+
+	entries, err := ioutil.ReadDir(context.ImageStore.SandboxDir)
+	require.NoError(err)
+	for _, entry := range entries {
+		require.False(strings.HasPrefix(entry.Name(), "layertar-"), entry.Name())
+	}
+}
+
+func TestFileWriterOutOfDisk(t *testing.T) {
+	require := require.New(t)
+
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("open /dev/full: %s", err)
+	}
+	defer f.Close()
+
+	_, err = fileWriter{f}.Write([]byte("layer"))
+	require.Error(err)
+	require.Contains(err.Error(), "out of disk at /dev/full")
+}
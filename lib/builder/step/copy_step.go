@@ -22,13 +22,16 @@ type CopyStep struct {
 }
 
 // NewCopyStep creates a new CopyStep.
+// If parents is true, the paths of the sources relative to the context are
+// preserved under the destination dir.
 func NewCopyStep(
-	args, chown, fromStage string, fromPaths []string, toPath string, commit bool,
+	args, chown, fromStage string, fromPaths []string, toPath string, parents, commit bool,
 ) (*CopyStep, error) {
 
 	s, err := newAddCopyStep(Copy, args, chown, fromStage, fromPaths, toPath, commit)
 	if err != nil {
 		return nil, fmt.Errorf("new add/copy step: %s", err)
 	}
+	s.parents = parents
 	return &CopyStep{s}, nil
 }
@@ -44,7 +44,7 @@ func abs(path string) string {
 func TestNewCopyStep(t *testing.T) {
 	require := require.New(t)
 
-	_, err := NewCopyStep("", validChown, "", []string{"src", "src"}, "dst", false)
+	_, err := NewCopyStep("", validChown, "", []string{"src", "src"}, "dst", false, false)
 	require.Error(err)
 }
 
@@ -148,6 +148,32 @@ func TestCopyStepSetCacheID(t *testing.T) {
 		require.NotEqual(hash1, step.CacheID())
 	})
 
+	t.Run("ExplainCache", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "a"), []byte("a"), 0644))
+		require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "b"), []byte("b"), 0644))
+
+		step := CopyStepFixture("", "", []string{"a", "b"}, "tmp/", false)
+		require.NoError(step.SetCacheID(context, ""))
+		hash := step.CacheID()
+
+		context.Options.ExplainCache = true
+		require.NoError(step.SetCacheID(context, ""))
+
+		// Explaining doesn't change the cache ID.
+		require.Equal(hash, step.CacheID())
+
+		inputs, err := step.updateContextChecksum(context, ioutil.Discard)
+		require.NoError(err)
+		require.Len(inputs, 2)
+		require.Equal(filepath.Join(context.ContextDir, "a"), inputs[0].name)
+		require.Equal(filepath.Join(context.ContextDir, "b"), inputs[1].name)
+		require.NotEqual(inputs[0].value, inputs[1].value)
+	})
+
 	t.Run("CopyFromStage", func(t *testing.T) {
 		require := require.New(t)
 		context, cleanup := context.BuildContextFixture()
@@ -417,3 +443,212 @@ func TestCopyStepCommitOnNonCriticalPath(t *testing.T) {
 		}
 	})
 }
+
+func TestCopyStepExecuteParents(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(os.MkdirAll(filepath.Join(context.ContextDir, "src/a"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(context.ContextDir, "src/b/c"), 0755))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.ContextDir, "src/a/file1"), []byte("one"), 0644))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.ContextDir, "src/b/file2"), []byte("two"), 0644))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.ContextDir, "src/b/c/file3"), []byte("three"), 0644))
+
+	targetDir := filepath.Join(context.RootDir, "target")
+	step, err := NewCopyStep(
+		"", "", "", []string{"src/*/file*", "src/b/c"}, targetDir+"/", true, false)
+	require.NoError(err)
+	require.NoError(step.Execute(context, true))
+	require.Len(context.CopyOps, 3)
+
+	for p, content := range map[string]string{
+		"src/a/file1":   "one",
+		"src/b/file2":   "two",
+		"src/b/c/file3": "three",
+	} {
+		result, err := ioutil.ReadFile(filepath.Join(targetDir, p))
+		require.NoError(err)
+		require.Equal(content, string(result))
+	}
+}
+
+func TestCopyStepAllowMissing(t *testing.T) {
+	srcs := []string{"present", "missing", "missing*.conf"}
+
+	t.Run("Strict", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		require.NoError(ioutil.WriteFile(
+			filepath.Join(context.ContextDir, "present"), []byte("present"), 0644))
+
+		step, err := NewCopyStep("", "", "", srcs, context.RootDir+"/target/", true, false)
+		require.NoError(err)
+		require.Error(step.SetCacheID(context, ""))
+	})
+
+	t.Run("AllowMissing", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		context.Options.CopyAllowMissing = true
+
+		require.NoError(ioutil.WriteFile(
+			filepath.Join(context.ContextDir, "present"), []byte("present"), 0644))
+
+		targetDir := filepath.Join(context.RootDir, "target")
+		step, err := NewCopyStep("", "", "", srcs, targetDir+"/", true, false)
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		withoutMissing := step.CacheID()
+		require.NoError(step.Execute(context, true))
+
+		result, err := ioutil.ReadFile(filepath.Join(targetDir, "present"))
+		require.NoError(err)
+		require.Equal("present", string(result))
+		_, err = os.Stat(filepath.Join(targetDir, "missing"))
+		require.True(os.IsNotExist(err))
+
+		// Sources that appear later change the cache ID.
+		require.NoError(ioutil.WriteFile(
+			filepath.Join(context.ContextDir, "missing"), []byte("missing"), 0644))
+		require.NoError(step.SetCacheID(context, ""))
+		require.NotEqual(withoutMissing, step.CacheID())
+	})
+
+	t.Run("AllMissing", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		context.Options.CopyAllowMissing = true
+
+		step, err := NewCopyStep("", "", "", []string{"missing"}, context.RootDir+"/target", true, false)
+		require.NoError(err)
+		require.NoError(step.SetCacheID(context, ""))
+		require.NoError(step.Execute(context, true))
+		require.Empty(context.CopyOps)
+	})
+}
+
+func TestCopyStepDockerignore(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	for p, content := range map[string]string{
+		"src/main.go":         "main",
+		"src/debug.log":       "debug",
+		"node_modules/x/x.js": "x",
+		"docs/keep/README.md": "readme",
+		"docs/drop/notes.md":  "notes",
+		".dockerignore":       "src/*.log\nnode_modules\ndocs\n!docs/keep\n",
+	} {
+		require.NoError(os.MkdirAll(filepath.Join(context.ContextDir, filepath.Dir(p)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, p), []byte(content), 0644))
+	}
+	require.NoError(SetDockerignore(context.Options, filepath.Join(context.ContextDir, ".dockerignore")))
+
+	step := CopyStepFixture("", "", []string{"."}, "/target/", true)
+	require.NoError(step.SetCacheID(context, ""))
+	cacheID := step.CacheID()
+
+	// Ignored files aren't part of the cache ID.
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "src/debug.log"), []byte("changed"), 0644))
+	require.NoError(step.SetCacheID(context, ""))
+	require.Equal(cacheID, step.CacheID())
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "src/main.go"), []byte("changed"), 0644))
+	require.NoError(step.SetCacheID(context, ""))
+	require.NotEqual(cacheID, step.CacheID())
+
+	// Nor are they copied to the layer.
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	var names []string
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Typeflag == tar.TypeReg {
+			names = append(names, header.Name)
+		}
+	}
+	require.ElementsMatch([]string{
+		"target/src/main.go",
+		"target/.dockerignore",
+		"target/docs/keep/README.md",
+	}, names)
+}
+
+func TestCopyStepCommitFromStageChownByName(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// The user has different ids in the source stage and the current image.
+	stageDir := context.CopyFromRoot("build")
+	require.NoError(os.MkdirAll(filepath.Join(stageDir, "etc"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(stageDir, "out"), 0755))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(stageDir, "etc/passwd"), []byte("app:x:42:42::/app:/bin/sh\n"), 0644))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(stageDir, "etc/group"), []byte("app:x:42:\n"), 0644))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(stageDir, "out/bin"), []byte("binary"), 0755))
+
+	require.NoError(os.MkdirAll(filepath.Join(context.RootDir, "etc"), 0755))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.RootDir, "etc/passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/sh\napp:x:1234:1234::/app:/bin/sh\n"), 0644))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(context.RootDir, "etc/group"),
+		[]byte("root:x:0:\napp:x:5678:\n"), 0644))
+
+	targetDir := filepath.Join(context.RootDir, "app")
+	step, err := NewCopyStep("", "app:app", "build", []string{"out"}, targetDir+"/", false, true)
+	require.NoError(err)
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	var found bool
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Typeflag == tar.TypeReg {
+			require.Equal(strings.TrimLeft(filepath.Join(targetDir, "bin"), "/"), header.Name)
+			require.Equal(1234, header.Uid)
+			require.Equal(5678, header.Gid)
+			found = true
+		}
+	}
+	require.True(found)
+}
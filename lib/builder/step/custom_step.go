@@ -0,0 +1,108 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+var (
+	customHandlersMu sync.RWMutex
+	customHandlers   = make(map[string]CustomHandler)
+)
+
+// CustomHandler executes a directive registered with RegisterDirective.
+type CustomHandler interface {
+	// CacheKey returns a string identifying the result of the directive, e.g.
+	// the version of the inputs it reads outside of the build context. It is
+	// part of the cache ID of the step, so its cached layer is reused as long
+	// as the key and the previous steps don't change.
+	CacheKey(ctx *context.BuildContext, args string) (string, error)
+
+	// Execute executes the directive. Like for RUN, the changes it makes to
+	// the file system under ctx.RootDir are committed.
+	Execute(ctx *context.BuildContext, args string) error
+}
+
+// RegisterDirective registers the handler of a directive that isn't part of
+// the dockerfile spec, e.g. "VAULT_SECRET", so that dockerfiles can use it. It
+// must be called before dockerfiles are parsed, typically from an init func.
+func RegisterDirective(name string, handler CustomHandler) error {
+	if err := dockerfile.RegisterDirective(name); err != nil {
+		return err
+	}
+	customHandlersMu.Lock()
+	defer customHandlersMu.Unlock()
+	customHandlers[strings.ToUpper(name)] = handler
+	return nil
+}
+
+// CustomStep implements BuildStep and executes a registered directive.
+type CustomStep struct {
+	*baseStep
+
+	handler CustomHandler
+}
+
+// NewCustomStep returns a BuildStep executing the registered directive.
+func NewCustomStep(name, args string, commit bool) (*CustomStep, error) {
+	customHandlersMu.RLock()
+	handler, found := customHandlers[strings.ToUpper(name)]
+	customHandlersMu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("no handler registered for directive %s", name)
+	}
+	return &CustomStep{
+		baseStep: newBaseStep(Directive(strings.ToUpper(name)), args, commit),
+		handler:  handler,
+	}, nil
+}
+
+// RequireOnDisk always returns true, as custom steps may read and change the
+// file system like run steps.
+func (s *CustomStep) RequireOnDisk() bool { return true }
+
+// SetCacheID sets the cache ID of the step, including the cache key returned
+// by the handler.
+func (s *CustomStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	key, err := s.handler.CacheKey(ctx, s.args)
+	if err != nil {
+		return fmt.Errorf("get cache key of %s: %s", s.directive, err)
+	}
+	commitStr := fmt.Sprintf("%v", s.commit)
+	s.cacheID = CacheChecksum(ctx.Options.CacheHash, seed+string(s.directive)+s.args+commitStr+key)
+	explainCacheID(ctx, s.directive, s.args, s.cacheID,
+		cacheInput{"seed", seed}, cacheInput{"args", s.args}, cacheInput{"commit", commitStr},
+		cacheInput{"handler key", key})
+	return nil
+}
+
+// Execute executes the directive with its handler.
+func (s *CustomStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
+	if !modifyFS {
+		return errors.New("attempted to execute custom step without modifying file system")
+	}
+	ctx.MustScan = true
+	if err := s.handler.Execute(ctx, s.args); err != nil {
+		return fmt.Errorf("execute %s: %s", s.directive, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+// customHandlerFixture writes its args to a file named after its key.
+type customHandlerFixture struct {
+	key string
+}
+
+func (h *customHandlerFixture) CacheKey(ctx *context.BuildContext, args string) (string, error) {
+	return h.key, nil
+}
+
+func (h *customHandlerFixture) Execute(ctx *context.BuildContext, args string) error {
+	return ioutil.WriteFile(filepath.Join(ctx.RootDir, h.key), []byte(args), 0644)
+}
+
+func TestCustomStep(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	handler := &customHandlerFixture{"v1"}
+	require.NoError(RegisterDirective("test_custom_step", handler))
+	require.Error(RegisterDirective("env", handler))
+
+	stages, err := dockerfile.ParseFile(
+		"FROM scratch\nTEST_CUSTOM_STEP id=token\n", map[string]string{})
+	require.NoError(err)
+	directive := stages[0].Directives[0]
+
+	step, err := NewDockerfileStep(ctx, directive, "seed")
+	require.NoError(err)
+	custom, ok := step.(*CustomStep)
+	require.True(ok)
+	require.True(custom.RequireOnDisk())
+	v1CacheID := step.CacheID()
+
+	handler.key = "v2"
+	step, err = NewDockerfileStep(ctx, directive, "seed")
+	require.NoError(err)
+	require.NotEqual(v1CacheID, step.CacheID())
+
+	require.Error(step.Execute(ctx, false))
+	require.NoError(step.Execute(ctx, true))
+	require.True(ctx.MustScan)
+	content, err := ioutil.ReadFile(filepath.Join(ctx.RootDir, "v2"))
+	require.NoError(err)
+	require.Equal("id=token", string(content))
+
+	_, err = NewCustomStep("test_unregistered", "", false)
+	require.Error(err)
+}
@@ -0,0 +1,47 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+
+	units "github.com/docker/go-units"
+
+	"github.com/uber/makisu/lib/utils"
+)
+
+// newDiskQuotaCheck returns a function that returns an error once the free
+// space of the filesystem of dir dropped by more than quota bytes since
+// newDiskQuotaCheck was called. Space used by other processes writing to the
+// same filesystem counts against the quota too, since the free space is all
+// that can be measured without walking the filesystem.
+func newDiskQuotaCheck(dir string, quota int64) (func() error, error) {
+	start, err := utils.FreeDiskSpace(dir)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		free, err := utils.FreeDiskSpace(dir)
+		if err != nil {
+			return err
+		}
+		if free < start && start-free > uint64(quota) {
+			return fmt.Errorf(
+				"command used %s of the disk of %s, more than the quota of %s set by --disk-quota",
+				units.BytesSize(float64(start-free)), dir, units.BytesSize(float64(quota)))
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// SetDockerignore reads the Dockerignore of opts from the file at path. An
+// empty path clears it.
+func SetDockerignore(opts *context.BuildOptions, path string) error {
+	if path == "" {
+		opts.Dockerignore = nil
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open dockerignore: %s", err)
+	}
+	defer f.Close()
+	matcher, err := pathutils.ParseIgnoreFile(f)
+	if err != nil {
+		return fmt.Errorf("parse dockerignore %s: %s", path, err)
+	}
+	opts.Dockerignore = matcher
+	return nil
+}
+
+// ignoredPaths returns the paths under the sources that dockerignore matches,
+// relative to root. The contents of ignored dirs aren't listed, unless some
+// patterns are exceptions, in which case only files are.
+func ignoredPaths(
+	dockerignore *pathutils.IgnoreMatcher, root string, sources []string) ([]string, error) {
+
+	if dockerignore == nil {
+		return nil, nil
+	}
+	var ignored []string
+	for _, source := range sources {
+		if _, err := os.Lstat(source); os.IsNotExist(err) {
+			continue
+		}
+		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			} else if !dockerignore.Matches(rel) {
+				return nil
+			} else if !fi.IsDir() {
+				ignored = append(ignored, path)
+			} else if !dockerignore.HasExceptions() {
+				ignored = append(ignored, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("walk %s: %s", source, err)
+		}
+	}
+	return ignored, nil
+}
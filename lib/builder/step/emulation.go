@@ -0,0 +1,176 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// binfmtMiscDir is where the kernel lists the handlers of foreign binaries,
+// which qemu registers to emulate other architectures.
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArchitectures maps the architectures of images to the names of the qemu
+// binfmt_misc handlers emulating them.
+var qemuArchitectures = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+}
+
+// emulator is the interpreter of a binfmt_misc handler registered without the
+// F flag, which the kernel looks up in the filesystem of the executed binary.
+type emulator struct {
+	path    string // Absolute path of the interpreter.
+	content []byte
+}
+
+// emulators are the interpreters loaded by LoadEmulators, keyed by
+// architecture.
+var emulators = make(map[string]emulator)
+
+// LoadEmulators reads the interpreters of the qemu handlers of the platforms
+// that were registered without the F flag, so that they can be added to the
+// filesystem of RUN steps. It must be called before the root filesystem is
+// replaced by the one of the image. Missing handlers and interpreters are
+// reported by CheckEmulation.
+func LoadEmulators(platforms []image.Platform) error {
+	for _, platform := range platforms {
+		handler, err := emulationHandler(platform)
+		if err != nil || handler == "" {
+			continue
+		}
+		entry, err := readBinfmtMisc(handler)
+		if err != nil || entry["enabled"] == "" || strings.Contains(entry["flags:"], "F") {
+			continue
+		}
+		path := entry["interpreter"]
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("read interpreter of binfmt_misc handler %s: %s", handler, err)
+		}
+		log.Infof("Loaded interpreter %s of binfmt_misc handler %s, which is added to the filesystem of RUN steps",
+			path, handler)
+		emulators[platform.Architecture] = emulator{path, content}
+	}
+	return nil
+}
+
+// emulationHandler returns the name of the qemu handler of the platform, or
+// an empty string if the host runs it natively.
+func emulationHandler(platform image.Platform) (string, error) {
+	host := image.DefaultPlatform().Architecture
+	if platform.Architecture == host || (host == "amd64" && platform.Architecture == "386") {
+		return "", nil
+	}
+	qemuArch, ok := qemuArchitectures[platform.Architecture]
+	if !ok {
+		return "", fmt.Errorf("emulation of platform %s is not supported", platform)
+	}
+	return "qemu-" + qemuArch, nil
+}
+
+// CheckEmulation returns an error if RUN steps can't execute the binaries of
+// images of the platform, which requires a qemu binfmt_misc handler for
+// architectures the host can't run natively. The interpreter of handlers
+// registered without the F flag must have been loaded by LoadEmulators, as the
+// root filesystem is replaced by the one of the image during the build.
+func CheckEmulation(platform image.Platform) error {
+	handler, err := emulationHandler(platform)
+	if err != nil || handler == "" {
+		return err
+	}
+	hint := "register qemu handlers on the host, e.g. with " +
+		"docker run --privileged --rm tonistiigi/binfmt --install all"
+
+	if status, err := readBinfmtMisc("status"); err != nil {
+		return fmt.Errorf("RUN steps of platform %s require emulation, but binfmt_misc isn't available: %s, %s",
+			platform, err, hint)
+	} else if status["enabled"] == "" {
+		return fmt.Errorf("RUN steps of platform %s require emulation, but binfmt_misc is disabled", platform)
+	}
+	entry, err := readBinfmtMisc(handler)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("RUN steps of platform %s require emulation, but binfmt_misc handler %s is not registered, %s",
+			platform, handler, hint)
+	} else if err != nil {
+		return fmt.Errorf("read binfmt_misc handler %s: %s", handler, err)
+	} else if entry["enabled"] == "" {
+		return fmt.Errorf("RUN steps of platform %s require emulation, but binfmt_misc handler %s is disabled",
+			platform, handler)
+	} else if strings.Contains(entry["flags:"], "F") {
+		return nil
+	} else if _, ok := emulators[platform.Architecture]; !ok {
+		return fmt.Errorf("RUN steps of platform %s require emulation, but binfmt_misc handler %s was registered "+
+			"without the F flag, and its interpreter %s was not found, %s",
+			platform, handler, entry["interpreter"], hint)
+	}
+	return nil
+}
+
+// addEmulator adds the interpreter loaded for the target platform to the
+// filesystem under rootDir, unless the image already has a file at its path.
+// The returned function removes it again, so that it isn't committed.
+func addEmulator(rootDir string, platform image.Platform) (restore func() error, err error) {
+	emulator, ok := emulators[platform.Architecture]
+	if !ok {
+		return noRestore, nil
+	}
+	path := filepath.Join(rootDir, emulator.path)
+	if _, err := os.Lstat(path); err == nil {
+		return noRestore, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("stat %s: %s", path, err)
+	}
+	return createFile(path, emulator.content, 0755)
+}
+
+// readBinfmtMisc returns the lines of the binfmt_misc file keyed by their
+// first word, e.g. "enabled" or "interpreter", mapped to the rest of the line.
+// Keys without value are mapped to themselves.
+func readBinfmtMisc(name string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(binfmtMiscDir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(parts) == 1 {
+			fields[parts[0]] = parts[0]
+		} else {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	return fields, scanner.Err()
+}
@@ -0,0 +1,173 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckEmulation(t *testing.T) {
+	defer func(dir string) { binfmtMiscDir = dir }(binfmtMiscDir)
+
+	// A platform the host can't run natively.
+	platform := image.Platform{OS: "linux", Architecture: "arm64"}
+	handler := "qemu-aarch64"
+	if runtime.GOARCH == "arm64" {
+		platform.Architecture = "amd64"
+		handler = "qemu-x86_64"
+	}
+
+	setup := func(t *testing.T, status string, entries map[string]string) {
+		dir, err := ioutil.TempDir("", "test-binfmt-misc")
+		require.NoError(t, err)
+		binfmtMiscDir = dir
+		if status != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644))
+		}
+		for name, content := range entries {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+	}
+
+	t.Run("native", func(t *testing.T) {
+		setup(t, "", nil)
+		defer os.RemoveAll(binfmtMiscDir)
+		require.NoError(t, CheckEmulation(image.DefaultPlatform()))
+	})
+
+	t.Run("registered", func(t *testing.T) {
+		setup(t, "enabled\n", map[string]string{
+			handler: "enabled\ninterpreter /usr/bin/" + handler + "\nflags: POCF\noffset 0\n",
+		})
+		defer os.RemoveAll(binfmtMiscDir)
+		require.NoError(t, CheckEmulation(platform))
+	})
+
+	tests := []struct {
+		desc     string
+		status   string
+		entries  map[string]string
+		expected string
+	}{
+		{"binfmt_misc not mounted", "", nil, "binfmt_misc isn't available"},
+		{"binfmt_misc disabled", "disabled\n", nil, "binfmt_misc is disabled"},
+		{"handler missing", "enabled\n", nil, "handler " + handler + " is not registered"},
+		{
+			"handler disabled", "enabled\n",
+			map[string]string{handler: "disabled\ninterpreter /usr/bin/qemu\nflags: F\n"},
+			"handler " + handler + " is disabled",
+		}, {
+			"handler without F flag", "enabled\n",
+			map[string]string{handler: "enabled\ninterpreter /usr/bin/qemu\nflags: \n"},
+			"without the F flag",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			setup(t, test.status, test.entries)
+			defer os.RemoveAll(binfmtMiscDir)
+			err := CheckEmulation(platform)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), test.expected)
+		})
+	}
+
+	t.Run("handler without F flag with loaded interpreter", func(t *testing.T) {
+		require := require.New(t)
+		defer func() { emulators = make(map[string]emulator) }()
+		interpreter, err := ioutil.TempFile("", "test-qemu")
+		require.NoError(err)
+		defer os.Remove(interpreter.Name())
+		interpreter.Close()
+
+		setup(t, "enabled\n", map[string]string{
+			handler: "enabled\ninterpreter " + interpreter.Name() + "\nflags: \n",
+		})
+		defer os.RemoveAll(binfmtMiscDir)
+		require.NoError(LoadEmulators([]image.Platform{image.DefaultPlatform(), platform}))
+		require.Equal(interpreter.Name(), emulators[platform.Architecture].path)
+		require.NoError(CheckEmulation(platform))
+	})
+
+	t.Run("unsupported architecture", func(t *testing.T) {
+		err := CheckEmulation(image.Platform{OS: "linux", Architecture: "vax"})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not supported")
+	})
+}
+
+func TestAddEmulator(t *testing.T) {
+	defer func() { emulators = make(map[string]emulator) }()
+	platform := image.Platform{OS: "linux", Architecture: "arm64"}
+	emulators["arm64"] = emulator{"/usr/bin/qemu-aarch64-static", []byte("qemu")}
+
+	t.Run("added and removed", func(t *testing.T) {
+		require := require.New(t)
+		rootDir, err := ioutil.TempDir("", "test-emulator")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+
+		restore, err := addEmulator(rootDir, platform)
+		require.NoError(err)
+		path := filepath.Join(rootDir, "usr/bin/qemu-aarch64-static")
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.True(fi.Mode()&0111 != 0)
+
+		require.NoError(restore())
+		_, err = os.Stat(filepath.Join(rootDir, "usr"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("existing file is kept", func(t *testing.T) {
+		require := require.New(t)
+		rootDir, err := ioutil.TempDir("", "test-emulator")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+		path := filepath.Join(rootDir, "usr/bin/qemu-aarch64-static")
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte("image qemu"), 0755))
+
+		restore, err := addEmulator(rootDir, platform)
+		require.NoError(err)
+		require.NoError(restore())
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("image qemu", string(content))
+	})
+
+	t.Run("no emulator loaded", func(t *testing.T) {
+		require := require.New(t)
+		platform := image.Platform{OS: "linux", Architecture: "s390x"}
+		rootDir, err := ioutil.TempDir("", "test-emulator")
+		require.NoError(err)
+		defer os.RemoveAll(rootDir)
+
+		restore, err := addEmulator(rootDir, platform)
+		require.NoError(err)
+		require.NoError(restore())
+		entries, err := ioutil.ReadDir(rootDir)
+		require.NoError(err)
+		require.Empty(entries)
+	})
+}
@@ -28,13 +28,17 @@ type EnvStep struct {
 	*baseStep
 
 	envs map[string]string
+	keys []string
 }
 
-// NewEnvStep returns a BuildStep from given arguments.
-func NewEnvStep(args string, envs map[string]string, commit bool) BuildStep {
+// NewEnvStep returns a BuildStep from given arguments. keys are the keys of
+// envs in declaration order, which is the order they are added to the image
+// config in.
+func NewEnvStep(args string, envs map[string]string, keys []string, commit bool) BuildStep {
 	return &EnvStep{
 		baseStep: newBaseStep(Env, args, commit),
 		envs:     envs,
+		keys:     keys,
 	}
 }
 
@@ -58,6 +62,6 @@ func (s *EnvStep) UpdateCtxAndConfig(
 	for k, v := range s.envs {
 		expandedEnvs[k] = os.ExpandEnv(v)
 	}
-	config.Config.Env = utils.MergeEnv(config.Config.Env, expandedEnvs)
+	config.Config.Env = utils.MergeEnvOrdered(config.Config.Env, expandedEnvs, s.keys)
 	return config, nil
 }
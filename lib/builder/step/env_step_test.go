@@ -15,11 +15,13 @@
 package step
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
 
 	"github.com/stretchr/testify/require"
 )
@@ -31,7 +33,7 @@ func TestEnvStepUpdateCtxAndConfig(t *testing.T) {
 	defer cleanup()
 
 	envs := map[string]string{"key": "val", "key2": "val2"}
-	step := NewEnvStep("", envs, false)
+	step := NewEnvStep("", envs, []string{"key", "key2"}, false)
 
 	c := image.NewDefaultImageConfig()
 	result, err := step.UpdateCtxAndConfig(ctx, &c)
@@ -57,8 +59,36 @@ func TestEnvStepNilConfig(t *testing.T) {
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	step := NewEnvStep("", nil, false)
+	step := NewEnvStep("", nil, nil, false)
 
 	_, err := step.UpdateCtxAndConfig(ctx, nil)
 	require.Error(err)
 }
+
+func TestEnvStepDeterministicOrder(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	stages, err := dockerfile.ParseFile("FROM scratch\nENV B=1 A=2 B=3\n", map[string]string{})
+	require.NoError(err)
+
+	var serialized []byte
+	for i := 0; i < 20; i++ {
+		step, err := NewDockerfileStep(ctx, stages[0].Directives[0], "seed")
+		require.NoError(err)
+		c := image.NewDefaultImageConfig()
+		c.Config.Env = []string{"PATH=/bin"}
+		result, err := step.UpdateCtxAndConfig(ctx, &c)
+		require.NoError(err)
+		require.Equal([]string{"PATH=/bin", "B=3", "A=2"}, result.Config.Env)
+
+		b, err := json.Marshal(result)
+		require.NoError(err)
+		if serialized != nil {
+			require.Equal(string(serialized), string(b))
+		}
+		serialized = b
+	}
+}
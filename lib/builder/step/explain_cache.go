@@ -0,0 +1,40 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/log"
+)
+
+// cacheInput is a named input of the cache ID of a step.
+type cacheInput struct {
+	name  string
+	value string
+}
+
+// explainCacheID logs the cache ID of a step and its inputs if the ExplainCache
+// option of the build is set.
+func explainCacheID(
+	ctx *context.BuildContext, directive Directive, args, cacheID string, inputs ...cacheInput) {
+
+	if !ctx.Options.ExplainCache {
+		return
+	}
+	log.Infof("* Cache ID of %s %s: %s", directive, args, cacheID)
+	for _, input := range inputs {
+		log.Infof("*   %s: %q", input.name, input.value)
+	}
+}
@@ -42,7 +42,7 @@ func FromStepFixture(args, image, alias string) *FromStep {
 
 // AddStepFixture returns a AddStep, panicing if it fails, for testing purposes.
 func AddStepFixture(args string, srcs []string, dst string, commit bool) *AddStep {
-	c, err := NewAddStep(args, validChown, srcs, dst, commit)
+	c, err := NewAddStep(args, validChown, srcs, dst, true, commit)
 	if err != nil {
 		panic(err)
 	}
@@ -51,7 +51,7 @@ func AddStepFixture(args string, srcs []string, dst string, commit bool) *AddSte
 
 // AddStepFixtureNoChown returns a AddStep, panicing if it fails, for testing purposes.
 func AddStepFixtureNoChown(args string, srcs []string, dst string, commit bool) *AddStep {
-	c, err := NewAddStep(args, "", srcs, dst, commit)
+	c, err := NewAddStep(args, "", srcs, dst, true, commit)
 	if err != nil {
 		panic(err)
 	}
@@ -60,7 +60,7 @@ func AddStepFixtureNoChown(args string, srcs []string, dst string, commit bool)
 
 // CopyStepFixture returns a CopyStep, panicing if it fails, for testing purposes.
 func CopyStepFixture(args, fromStage string, srcs []string, dst string, commit bool) *CopyStep {
-	c, err := NewCopyStep(args, validChown, fromStage, srcs, dst, commit)
+	c, err := NewCopyStep(args, validChown, fromStage, srcs, dst, false, commit)
 	if err != nil {
 		panic(err)
 	}
@@ -69,7 +69,7 @@ func CopyStepFixture(args, fromStage string, srcs []string, dst string, commit b
 
 // CopyStepFixtureNoChown returns a CopyStep, panicing if it fails, for testing purposes.
 func CopyStepFixtureNoChown(args, fromStage string, srcs []string, dst string, commit bool) *CopyStep {
-	c, err := NewCopyStep(args, "", fromStage, srcs, dst, commit)
+	c, err := NewCopyStep(args, "", fromStage, srcs, dst, false, commit)
 	if err != nil {
 		panic(err)
 	}
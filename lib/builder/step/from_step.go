@@ -18,14 +18,16 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"reflect"
 	"strings"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
@@ -44,6 +46,16 @@ type FromStep struct {
 	image string
 	alias string
 
+	// base is true for the FROM directives of stages, whose images are checked
+	// against TargetPlatform.
+	base bool
+
+	// pulled is the manifest of the base image pulled from the registry, whose
+	// layers may not be pulled yet, and digest is the digest of the content
+	// the registry served for it.
+	pulled *image.DistributionManifest
+	digest image.Digest
+
 	manifest *image.DistributionManifest
 	client   registry.Client
 }
@@ -55,7 +67,13 @@ func NewFromStep(args, imageName, alias string) (*FromStep, error) {
 		if err != nil || !image.IsValid() {
 			return nil, fmt.Errorf("Invalid image name: %s", imageName)
 		}
-		imageName = image.String()
+		rewritten, err := image.Rewrite()
+		if err != nil {
+			return nil, fmt.Errorf("rewrite image name: %w", err)
+		} else if rewritten != image {
+			log.Infof("Rewrote image %s to %s", image, rewritten)
+		}
+		imageName = rewritten.String()
 	}
 	return &FromStep{
 		baseStep: newBaseStep(From, args, false),
@@ -75,13 +93,85 @@ func (s *FromStep) GetAlias() string {
 }
 
 // SetCacheID sets the cacheID of the step using the name of the base image.
-// TODO: Use the sha of that image instead of the image name itself.
+// Unless CacheBaseDigest is false, the digest of the base image manifest is
+// resolved from the registry and included as well, so that an update of the
+// base image invalidates the cache of all the following steps. The target
+// platform is included if it isn't the one of the host, so that the images of
+// the platforms of a multi-platform build don't share cache.
 func (s *FromStep) SetCacheID(ctx *context.BuildContext, seed string) error {
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.image))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	inputs := []cacheInput{{"seed", seed}, {"image", s.image}}
+	seed += string(s.directive) + s.image
+	platform := ctx.Options.TargetPlatform
+	if platform != (image.Platform{}) && platform != image.DefaultPlatform() {
+		seed += platform.String()
+		inputs = append(inputs, cacheInput{"platform", platform.String()})
+	}
+	if ctx.Options.CacheBaseDigest && !isScratch(s.image) {
+		digest, err := s.ResolveDigest(ctx)
+		if err != nil {
+			return err
+		}
+		seed += string(digest)
+		inputs = append(inputs, cacheInput{"base digest", string(digest)})
+	}
+	s.cacheID = CacheChecksum(ctx.Options.CacheHash, seed)
+	explainCacheID(ctx, s.directive, s.args, s.cacheID, inputs...)
 	return nil
 }
 
+// ResolveDigest returns the digest of the base image manifest, or manifest list,
+// pulled from the registry. The manifest is only pulled once, and the image is
+// built from it, so the digest is the one of the image the step uses.
+func (s *FromStep) ResolveDigest(ctx *context.BuildContext) (image.Digest, error) {
+	if _, err := s.pullManifest(ctx); err != nil {
+		return "", err
+	}
+	return s.digest, nil
+}
+
+// pullManifest pulls the manifest of the base image and records its digest,
+// unless it was already pulled.
+func (s *FromStep) pullManifest(ctx *context.BuildContext) (*image.DistributionManifest, error) {
+	if s.digest != "" {
+		return s.pulled, nil
+	}
+	pullImage, err := image.ParseNameForPull(s.image)
+	if err != nil {
+		return nil, fmt.Errorf("parse pull image %s: %w", s.image, err)
+	}
+	s.setRegistryClient(registry.New(ctx.ImageStore, pullImage.GetRegistry(), pullImage.GetRepository()).
+		WithOptions(ctx.Options.Registry))
+	manifest, digest, err := s.client.PullManifestDigest(pullImage.GetTag())
+	if err != nil {
+		return nil, fmt.Errorf("pull manifest of image %s: %w", s.image, err)
+	}
+	log.Infof("* Resolved base image %s to %s", s.image, digest)
+	s.pulled, s.digest = manifest, digest
+	return manifest, nil
+}
+
+// Validate checks that the base image exists, can be pulled with the
+// credentials of its registry, and is for TargetPlatform, by pulling its
+// manifest and config only.
+func (s *FromStep) Validate(ctx *context.BuildContext) error {
+	if isScratch(s.image) {
+		return nil
+	}
+	manifest, err := s.pullManifestAndConfig(ctx)
+	if err != nil {
+		return err
+	}
+	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
+	if err != nil {
+		return fmt.Errorf("get config of image %s: %w", s.image, err)
+	}
+	return s.checkPlatform(ctx.Options, config)
+}
+
+// IsScratch returns true if the step builds from scratch, i.e. has no base
+// image.
+func (s *FromStep) IsScratch() bool { return isScratch(s.image) }
+
 // TODO: Not an ideal way to test. Move to build context.
 func (s *FromStep) setRegistryClient(client registry.Client) {
 	if s.client == nil {
@@ -99,20 +189,20 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	}
 
 	// Otherwise, pull image.
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
-		return fmt.Errorf("get manifest: %s", err)
+		return fmt.Errorf("get manifest: %w", err)
 	}
 
 	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
 	if err != nil {
-		return fmt.Errorf("get config: %s", err)
+		return fmt.Errorf("get config: %w", err)
 	}
 
 	if config.RootFS.DiffIDs == nil || manifest.Layers == nil {
-		return fmt.Errorf("empty layer digests or descriptors: %s", err)
+		return fmt.Errorf("empty layer digests or descriptors: %w", err)
 	} else if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
-		return fmt.Errorf("layer digests and descriptors count doesn't match: %s", err)
+		return fmt.Errorf("layer digests and descriptors count doesn't match: %w", err)
 	}
 
 	// Apply each layer to the memFS.
@@ -120,41 +210,111 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	for _, descriptor := range manifest.Layers {
 		reader, err := ctx.ImageStore.Layers.GetStoreFileReader(descriptor.Digest.Hex())
 		if err != nil {
-			return fmt.Errorf("get reader from layer: %s", err)
+			return fmt.Errorf("get reader from layer: %w", err)
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		gzipReader, err := tario.NewLayerReader(reader)
 		if err != nil {
-			return fmt.Errorf("create gzip reader for layer: %s", err)
+			return fmt.Errorf("create layer reader: %w", err)
 		}
 		log.Infof("* Processing FROM layer %s", descriptor.Digest.Hex())
 		err = ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyFS)
 		if err != nil {
-			return fmt.Errorf("untar reader: %s", err)
+			return fmt.Errorf("untar reader: %w", err)
 		}
 	}
 	return nil
 }
 
+// CheckpointFromLayers extracts the sources out of the layers of the image to
+// newRoot without unpacking the rest of it, as an optimization of Execute
+// followed by a checkpoint of the stage. Layers are pulled lazily, from the
+// topmost one down, so the ones below the layers the sources were found in are
+// not pulled at all.
+func (s *FromStep) CheckpointFromLayers(
+	ctx *context.BuildContext, newRoot string, sources []string) error {
+
+	manifest, err := s.pullManifestAndConfig(ctx)
+	if err != nil {
+		return err
+	}
+	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
+	if err != nil {
+		return fmt.Errorf("get config: %w", err)
+	}
+	if err := s.checkPlatform(ctx.Options, config); err != nil {
+		return err
+	}
+
+	layers := make([]snapshot.LayerOpener, len(manifest.Layers))
+	for i, descriptor := range manifest.Layers {
+		digest := descriptor.Digest
+		layers[i] = func() (io.ReadCloser, error) {
+			if _, err := s.client.PullLayer(digest); err != nil {
+				return nil, fmt.Errorf("pull layer %s: %w", digest, err)
+			}
+			reader, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+			if err != nil {
+				return nil, fmt.Errorf("get reader from layer: %w", err)
+			}
+			gzipReader, err := tario.NewLayerReader(reader)
+			if err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("create layer reader: %w", err)
+			}
+			return layerReader{gzipReader, reader}, nil
+		}
+	}
+	return ctx.MemFS.CheckpointFromLayers(newRoot, sources, layers)
+}
+
+// pullManifestAndConfig pulls the manifest and the config of the image, but
+// none of its layers, unless the whole image was already pulled.
+func (s *FromStep) pullManifestAndConfig(ctx *context.BuildContext) (*image.DistributionManifest, error) {
+	if s.manifest != nil {
+		return s.manifest, nil
+	}
+
+	manifest, err := s.pullManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.client.PullImageConfig(manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("pull config of image %s: %w", s.image, err)
+	}
+	return manifest, nil
+}
+
+// layerReader closes both the gzip reader of a layer and its file.
+type layerReader struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (r layerReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
+
 // Commit generates an image layer.
 func (s *FromStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 	if isScratch(s.image) {
 		return nil, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("get manifest: %s", err)
+		return nil, fmt.Errorf("get manifest: %w", err)
 	}
 
 	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
 	if err != nil {
-		return nil, fmt.Errorf("get config: %s", err)
+		return nil, fmt.Errorf("get config: %w", err)
 	}
 
 	if config.RootFS.DiffIDs == nil || manifest.Layers == nil {
-		return nil, fmt.Errorf("empty layer digests or descriptors: %s", err)
+		return nil, fmt.Errorf("empty layer digests or descriptors: %w", err)
 	} else if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
-		return nil, fmt.Errorf("layer digests and descriptors count doesn't match: %s", err)
+		return nil, fmt.Errorf("layer digests and descriptors count doesn't match: %w", err)
 	}
 
 	digestPairs := make([]*image.DigestPair, len(config.RootFS.DiffIDs))
@@ -175,17 +335,25 @@ func (s *FromStep) UpdateCtxAndConfig(
 
 	if isScratch(s.image) {
 		config := image.NewDefaultImageConfig()
+		if platform := ctx.Options.TargetPlatform; platform != (image.Platform{}) {
+			config.OS = platform.OS
+			config.Architecture = platform.Architecture
+			config.Variant = platform.Variant
+		}
 		return &config, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("get manifest: %s", err)
+		return nil, fmt.Errorf("get manifest: %w", err)
 	}
 
 	config, err := s.getConfig(manifest.Config, ctx.ImageStore)
 	if err != nil {
-		return nil, fmt.Errorf("get config: %s", err)
+		return nil, fmt.Errorf("get config: %w", err)
+	}
+	if err := s.checkPlatform(ctx.Options, config); err != nil {
+		return nil, err
 	}
 
 	// Update in-memory map of merged stage vars from ARG and ENV.
@@ -197,20 +365,45 @@ func (s *FromStep) UpdateCtxAndConfig(
 	return config, nil
 }
 
-func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionManifest, error) {
+// checkPlatform verifies that the image of a FROM directive was built for the
+// TargetPlatform of the build.
+func (s *FromStep) checkPlatform(opts *context.BuildOptions, config *image.Config) error {
+	platform, target := config.Platform(), opts.TargetPlatform
+	if !s.base || target == (image.Platform{}) || target.Matches(platform) {
+		return nil
+	} else if opts.AllowPlatformMismatch {
+		log.Warnf("Image %s is for platform %s, but the build targets %s", s.image, platform, target)
+		return nil
+	}
+	return fmt.Errorf(
+		"image %s is for platform %s, but the build targets %s; "+
+			"use --platform to change the target, or --allow-platform-mismatch to build anyway",
+		s.image, platform, target)
+}
+
+func (s *FromStep) getManifest(ctx *context.BuildContext) (*image.DistributionManifest, error) {
 	if s.manifest != nil {
 		return s.manifest, nil
 	}
 
+	pulled, err := s.pullManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Pull image.
 	pullImage, err := image.ParseNameForPull(s.image)
 	if err != nil {
-		return nil, fmt.Errorf("parse pull image %s: %s", pullImage, err)
+		return nil, fmt.Errorf("parse pull image %s: %w", pullImage, err)
 	}
-	s.setRegistryClient(registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository()))
 	manifest, err := s.client.Pull(pullImage.GetTag())
 	if err != nil {
-		return nil, fmt.Errorf("pull image %s: %s", s.image, err)
+		return nil, fmt.Errorf("pull image %s: %w", s.image, err)
+	}
+	// The tag could have moved to another image since its manifest was pulled,
+	// in which case the image isn't the one of the digest in the cache IDs.
+	if !reflect.DeepEqual(manifest, pulled) {
+		return nil, fmt.Errorf("image %s changed since its manifest %s was pulled", s.image, s.digest)
 	}
 	s.manifest = manifest
 	return manifest, nil
@@ -221,15 +414,15 @@ func (s *FromStep) getConfig(
 
 	r, err := imageStore.Layers.GetStoreFileReader(configDigest.Digest.Hex())
 	if err != nil {
-		return nil, fmt.Errorf("get config file reader %s: %s", configDigest.Digest.Hex(), err)
+		return nil, fmt.Errorf("get config file reader %s: %w", configDigest.Digest.Hex(), err)
 	}
 	configBytes, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("read config file %s: %s", configDigest.Digest.Hex(), err)
+		return nil, fmt.Errorf("read config file %s: %w", configDigest.Digest.Hex(), err)
 	}
 	config := new(image.Config)
 	if err := json.Unmarshal(configBytes, config); err != nil {
-		return nil, fmt.Errorf("unmarshal config file %s: %s", configDigest.Digest.Hex(), err)
+		return nil, fmt.Errorf("unmarshal config file %s: %w", configDigest.Digest.Hex(), err)
 	}
 	return config, nil
 }
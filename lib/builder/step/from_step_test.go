@@ -15,12 +15,18 @@
 package step
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/registry"
 
 	"github.com/stretchr/testify/require"
@@ -40,6 +46,17 @@ func TestNewFromStep(t *testing.T) {
 		_, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "phase1")
 		require.NoError(err)
 	})
+
+	t.Run("Rewritten", func(t *testing.T) {
+		require := require.New(t)
+
+		require.NoError(image.SetRewriteRules([]string{"index.docker.io/(.*)=127.0.0.1:5002/hub/$1"}))
+		defer image.SetRewriteRules(nil)
+
+		step, err := NewFromStep("", "alpine:latest", "")
+		require.NoError(err)
+		require.Equal("127.0.0.1:5002/hub/library/alpine:latest", step.GetImage())
+	})
 }
 
 func TestFromStepSetCacheID(t *testing.T) {
@@ -50,11 +67,13 @@ func TestFromStepSetCacheID(t *testing.T) {
 
 		step1, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "phase1")
 		require.NoError(err)
+		step1.setRegistryClient(registry.NoopClientFixture())
 		err = step1.SetCacheID(context, "")
 		require.NoError(err)
 
 		step2, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "phase1")
 		require.NoError(err)
+		step2.setRegistryClient(registry.NoopClientFixture())
 		err = step2.SetCacheID(context, "")
 		require.NoError(err)
 
@@ -68,11 +87,13 @@ func TestFromStepSetCacheID(t *testing.T) {
 
 		step1, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "phase1")
 		require.NoError(err)
+		step1.setRegistryClient(registry.NoopClientFixture())
 		err = step1.SetCacheID(context, "")
 		require.NoError(err)
 
 		step2, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "phase2")
 		require.NoError(err)
+		step2.setRegistryClient(registry.NoopClientFixture())
 		err = step2.SetCacheID(context, "")
 		require.NoError(err)
 
@@ -86,16 +107,100 @@ func TestFromStepSetCacheID(t *testing.T) {
 
 		step1, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "")
 		require.NoError(err)
+		step1.setRegistryClient(registry.NoopClientFixture())
 		err = step1.SetCacheID(context, "")
 		require.NoError(err)
 
 		step2, err := NewFromStep("", "127.0.0.1:5003/alpine:latest", "")
 		require.NoError(err)
+		step2.setRegistryClient(registry.NoopClientFixture())
+		err = step2.SetCacheID(context, "")
+		require.NoError(err)
+
+		require.NotEqual(step1.CacheID(), step2.CacheID())
+	})
+
+	t.Run("DifferentBaseDigest", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		step1, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "")
+		require.NoError(err)
+		step1.setRegistryClient(digestClientFixture{registry.NoopClientFixture(), "sha256:1"})
+		err = step1.SetCacheID(context, "")
+		require.NoError(err)
+
+		step2, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "")
+		require.NoError(err)
+		step2.setRegistryClient(digestClientFixture{registry.NoopClientFixture(), "sha256:2"})
 		err = step2.SetCacheID(context, "")
 		require.NoError(err)
 
 		require.NotEqual(step1.CacheID(), step2.CacheID())
 	})
+
+	t.Run("DifferentPlatform", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		ids := map[string]bool{}
+		for _, platform := range []image.Platform{
+			{},
+			image.DefaultPlatform(),
+			{OS: "linux", Architecture: "s390x"},
+		} {
+			context.Options.TargetPlatform = platform
+			step, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "")
+			require.NoError(err)
+			step.setRegistryClient(registry.NoopClientFixture())
+			require.NoError(step.SetCacheID(context, ""))
+			ids[step.CacheID()] = true
+		}
+		// The host platform doesn't change the cache ID.
+		require.Len(ids, 2)
+	})
+}
+
+// digestClientFixture serves manifests with the same digest for all tags.
+type digestClientFixture struct {
+	registry.Client
+	digest image.Digest
+}
+
+func (c digestClientFixture) PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	return nil, c.digest, nil
+}
+
+// movedTagClientFixture serves another image for the tag once its manifest
+// was pulled.
+type movedTagClientFixture struct {
+	registry.Client
+}
+
+func (c movedTagClientFixture) PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	return &image.DistributionManifest{Config: image.Descriptor{Digest: "sha256:old"}}, "sha256:1", nil
+}
+
+func (c movedTagClientFixture) Pull(tag string) (*image.DistributionManifest, error) {
+	return &image.DistributionManifest{Config: image.Descriptor{Digest: "sha256:new"}}, nil
+}
+
+func TestFromStepTagMovedAfterCacheID(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step, err := NewFromStep("", "127.0.0.1:5002/alpine:latest", "")
+	require.NoError(err)
+	step.setRegistryClient(movedTagClientFixture{registry.NoopClientFixture()})
+	require.NoError(step.SetCacheID(ctx, ""))
+
+	// The image pulled isn't the one of the digest in the cache ID.
+	err = step.Execute(ctx, false)
+	require.Error(err)
+	require.Contains(err.Error(), "changed since its manifest sha256:1 was pulled")
 }
 
 func TestFromStepScratch(t *testing.T) {
@@ -129,7 +234,7 @@ func TestFromStepRegularFlow(t *testing.T) {
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	p, err := registry.PullClientFixture(ctx, "../../../testdata")
+	p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
 	require.NoError(err)
 
 	step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
@@ -156,3 +261,300 @@ func TestFromStepRegularFlow(t *testing.T) {
 	require.NoError(json.Unmarshal(expectedConfBytes, &expectedConf))
 	require.Equal(expectedConf, *conf)
 }
+
+func TestFromStepResolveDigest(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+	require.NoError(err)
+
+	step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+	require.NoError(err)
+	require.False(step.IsScratch())
+	step.setRegistryClient(p)
+
+	// The digest is the one of the manifest served by the registry.
+	digest, err := step.ResolveDigest(ctx)
+	require.NoError(err)
+	served, err := ioutil.ReadFile("../../../testdata/files/test_distribution_manifest")
+	require.NoError(err)
+	expected, err := image.NewDigester().FromBytes(served)
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	// The digest is only resolved once.
+	step.client = nil
+	step.setRegistryClient(registry.NoopClientFixture())
+	again, err := step.ResolveDigest(ctx)
+	require.NoError(err)
+	require.Equal(digest, again)
+}
+
+func TestFromStepPlatformMismatch(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+	require.NoError(err)
+
+	step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+	require.NoError(err)
+	step.base = true
+	step.setRegistryClient(p)
+	require.NoError(step.Execute(ctx, false))
+
+	ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "amd64"}
+	_, err = step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+
+	ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "arm64"}
+	_, err = step.UpdateCtxAndConfig(ctx, nil)
+	require.Error(err)
+
+	// Images of COPY --from aren't checked.
+	step.base = false
+	_, err = step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	step.base = true
+
+	ctx.Options.AllowPlatformMismatch = true
+	_, err = step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+}
+
+func TestFromStepValidate(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	t.Run("scratch", func(t *testing.T) {
+		require := require.New(t)
+		step, err := NewFromStep("", "scratch", "")
+		require.NoError(err)
+		require.NoError(step.Validate(ctx))
+	})
+
+	t.Run("platform", func(t *testing.T) {
+		require := require.New(t)
+		p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+		require.NoError(err)
+
+		step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+		require.NoError(err)
+		step.base = true
+		step.setRegistryClient(p)
+
+		ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "amd64"}
+		require.NoError(step.Validate(ctx))
+		ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "arm64"}
+		require.Error(step.Validate(ctx))
+	})
+
+	t.Run("copy from", func(t *testing.T) {
+		require := require.New(t)
+		p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+		require.NoError(err)
+
+		step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+		require.NoError(err)
+		step.setRegistryClient(p)
+
+		ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "arm64"}
+		require.NoError(step.Validate(ctx))
+		require.NoError(step.CheckpointFromLayers(ctx, filepath.Join(ctx.RootDir, "copy-from"), nil))
+	})
+}
+
+func TestFromStepScratchPlatform(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step, err := NewFromStep("", "scratch", "")
+	require.NoError(err)
+
+	ctx.Options.TargetPlatform = image.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	config, err := step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Equal(ctx.Options.TargetPlatform, config.Platform())
+}
+
+func TestFromStepCheckpointFromLayers(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+	require.NoError(err)
+
+	step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+	require.NoError(err)
+	step.setRegistryClient(p)
+
+	newRoot := ctx.CopyFromRoot("alpine")
+	require.NoError(step.CheckpointFromLayers(ctx, newRoot, []string{"bin/ls"}))
+
+	// bin/ls is a hard link to bin/[, which is copied as a regular file.
+	fi, err := os.Lstat(filepath.Join(newRoot, "bin/ls"))
+	require.NoError(err)
+	require.True(fi.Mode().IsRegular())
+	require.Equal(int64(1026712), fi.Size())
+	_, err = os.Lstat(filepath.Join(newRoot, "bin/["))
+	require.True(os.IsNotExist(err))
+
+	// Nothing was unpacked to the root.
+	_, err = os.Lstat(filepath.Join(ctx.RootDir, "bin"))
+	require.True(os.IsNotExist(err))
+}
+
+// lazyPullClientFixture serves an image whose blobs are only linked into the
+// store when they are pulled, and records the layers that were pulled.
+type lazyPullClientFixture struct {
+	registry.Client
+
+	ctx      *context.BuildContext
+	manifest *image.DistributionManifest
+	blobs    map[image.Digest]string
+	pulled   []image.Digest
+}
+
+func (c *lazyPullClientFixture) PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	return c.manifest, image.Digest("sha256:lazy"), nil
+}
+
+func (c *lazyPullClientFixture) PullImageConfig(digest image.Digest) (os.FileInfo, error) {
+	return c.pull(digest)
+}
+
+func (c *lazyPullClientFixture) PullLayer(digest image.Digest) (os.FileInfo, error) {
+	c.pulled = append(c.pulled, digest)
+	return c.pull(digest)
+}
+
+func (c *lazyPullClientFixture) pull(digest image.Digest) (os.FileInfo, error) {
+	if _, err := c.ctx.ImageStore.Layers.GetStoreFileStat(digest.Hex()); err != nil {
+		if err := c.ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), c.blobs[digest]); err != nil {
+			return nil, err
+		}
+	}
+	return c.ctx.ImageStore.Layers.GetStoreFileStat(digest.Hex())
+}
+
+// addBlob writes a blob to a temp file, and returns its descriptor.
+func (c *lazyPullClientFixture) addBlob(t *testing.T, b []byte) image.Descriptor {
+	digest, err := image.NewDigester().FromBytes(b)
+	require.NoError(t, err)
+	path := filepath.Join(c.ctx.ImageStore.SandboxDir, digest.Hex())
+	require.NoError(t, ioutil.WriteFile(path, b, 0644))
+	c.blobs[digest] = path
+	return image.Descriptor{Digest: digest, Size: int64(len(b))}
+}
+
+func gzippedLayerFixture(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestFromStepCheckpointFromLayersPullsLazily(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	client := &lazyPullClientFixture{ctx: ctx, blobs: make(map[image.Digest]string)}
+	config, err := json.Marshal(image.NewDefaultImageConfig())
+	require.NoError(err)
+	client.manifest = &image.DistributionManifest{
+		Config: client.addBlob(t, config),
+		Layers: []image.Descriptor{
+			client.addBlob(t, gzippedLayerFixture(t, map[string]string{"big/file": "big"})),
+			client.addBlob(t, gzippedLayerFixture(t, map[string]string{"small/file": "small"})),
+		},
+	}
+
+	step, err := NewFromStep("", "fakeregistry.dev/library/big:latest", "")
+	require.NoError(err)
+	step.setRegistryClient(client)
+
+	newRoot := ctx.CopyFromRoot("big")
+	require.NoError(step.CheckpointFromLayers(ctx, newRoot, []string{"small/file"}))
+
+	b, err := ioutil.ReadFile(filepath.Join(newRoot, "small/file"))
+	require.NoError(err)
+	require.Equal("small", string(b))
+
+	// The bottom layer was never pulled.
+	require.Equal([]image.Digest{client.manifest.Layers[1].Digest}, client.pulled)
+	_, err = ctx.ImageStore.Layers.GetStoreFileStat(client.manifest.Layers[0].Digest.Hex())
+	require.True(os.IsNotExist(err))
+}
+
+func TestFromStepConfigInheritance(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := registry.PullClientFixture(ctx.ImageStore, "../../../testdata")
+	require.NoError(err)
+
+	from, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+	require.NoError(err)
+	from.setRegistryClient(p)
+	require.NoError(from.Execute(ctx, false))
+
+	// Equivalent of:
+	//   FROM alpine
+	//   ENV FOO=bar
+	//   ENV PATH=/opt/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+	//   ENV ALPHA=1
+	//   WORKDIR app
+	//   USER nobody
+	//   LABEL team=build
+	steps := []BuildStep{
+		from,
+		NewEnvStep("", map[string]string{"FOO": "bar"}, []string{"FOO"}, false),
+		NewEnvStep("", map[string]string{
+			"PATH": "/opt/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			[]string{"PATH"}, false),
+		NewEnvStep("", map[string]string{"ALPHA": "1"}, []string{"ALPHA"}, false),
+		NewWorkdirStep("", "app", false),
+		NewUserStep("", "nobody", false),
+		NewLabelStep("", map[string]string{"team": "build"}, false),
+	}
+	var conf *image.Config
+	for _, step := range steps {
+		conf, err = step.UpdateCtxAndConfig(ctx, conf)
+		require.NoError(err)
+	}
+
+	// The golden file is the config generated by docker for the same
+	// Dockerfile, minus the fields that depend on the build host.
+	expectedConfBytes, err := ioutil.ReadFile("../../../testdata/files/test_image_config_golden")
+	require.NoError(err)
+	var expectedConf image.Config
+	require.NoError(json.Unmarshal(expectedConfBytes, &expectedConf))
+
+	conf.Config.Hostname = ""
+	conf.Config.Image = ""
+	conf.Config.WorkingDir, err = pathutils.TrimRoot(conf.Config.WorkingDir, ctx.RootDir)
+	require.NoError(err)
+	require.Equal(*expectedConf.Config, *conf.Config)
+	require.Equal(expectedConf.RootFS, conf.RootFS)
+}
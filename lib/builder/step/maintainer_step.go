@@ -19,9 +19,12 @@ import (
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
 )
 
-// MaintainerStep implements BuildStep and execute MAINTAINER directive
+// MaintainerStep implements BuildStep and execute MAINTAINER directive.
+// MAINTAINER is deprecated, but still sets the author of the image like in
+// docker.
 type MaintainerStep struct {
 	*baseStep
 
@@ -45,6 +48,7 @@ func (s *MaintainerStep) UpdateCtxAndConfig(
 	if err != nil {
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
+	log.Warnf("MAINTAINER is deprecated, use LABEL maintainer instead; setting the author of the image to %s", s.Author)
 	config.Author = s.Author
 	return config, nil
 }
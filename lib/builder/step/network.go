@@ -0,0 +1,143 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// SetExtraHosts parses hosts formatted as <name>:<ip> into the ExtraHosts of
+// opts. Since /etc/hosts is always blacklisted, they never end up in layers.
+func SetExtraHosts(opts *context.BuildOptions, hosts []string) error {
+	lines := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		// Split on the first ':', as IPv6 addresses contain more of them.
+		parts := strings.SplitN(host, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("failed to parse add-host %s", host)
+		}
+		if net.ParseIP(parts[1]) == nil {
+			return fmt.Errorf("invalid ip address in add-host %s", host)
+		}
+		lines = append(lines, parts[1]+"\t"+parts[0])
+	}
+	opts.ExtraHosts = lines
+	return nil
+}
+
+// SetDNS sets the nameservers and search domains of opts, used in
+// /etc/resolv.conf while RUN steps are executed.
+func SetDNS(opts *context.BuildOptions, servers, searches []string) error {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid ip address in dns %s", server)
+		}
+	}
+	for _, search := range searches {
+		if search == "" || strings.ContainsAny(search, " \t") {
+			return fmt.Errorf("invalid dns-search domain %q", search)
+		}
+	}
+	opts.DNSServers = servers
+	opts.DNSSearches = searches
+	return nil
+}
+
+// addHosts appends the lines to the hosts file at path.
+func addHosts(path string, lines []string) (restore func() error, err error) {
+	if len(lines) == 0 {
+		return noRestore, nil
+	}
+	return updateFile(path, func(content string) string {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return content + strings.Join(lines, "\n") + "\n"
+	})
+}
+
+// setResolvConf replaces the nameserver lines of the resolv.conf at path with
+// servers, and its search and domain lines with searches. Other lines, like
+// options, are kept.
+func setResolvConf(path string, servers, searches []string) (restore func() error, err error) {
+	if len(servers) == 0 && len(searches) == 0 {
+		return noRestore, nil
+	}
+	return updateFile(path, func(content string) string {
+		var lines []string
+		for _, line := range strings.Split(content, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				if len(servers) != 0 {
+					continue
+				}
+			case "search", "domain":
+				if len(searches) != 0 {
+					continue
+				}
+			}
+			lines = append(lines, line)
+		}
+		for _, server := range servers {
+			lines = append(lines, "nameserver "+server)
+		}
+		if len(searches) != 0 {
+			lines = append(lines, "search "+strings.Join(searches, " "))
+		}
+		return strings.Join(lines, "\n") + "\n"
+	})
+}
+
+func noRestore() error { return nil }
+
+// updateFile writes update(content) to the file at path, creating it if
+// needed. The returned function restores the file to its previous state. The
+// file is rewritten in place instead of replaced, as it is usually bind
+// mounted into the container.
+func updateFile(path string, update func(content string) string) (restore func() error, err error) {
+	var original []byte
+	mode := os.FileMode(0644)
+	fi, err := os.Stat(path)
+	existed := err == nil
+	if existed {
+		mode = fi.Mode()
+		if original, err = ioutil.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("read %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("stat %s: %s", path, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(update(string(original))), mode); err != nil {
+		return nil, fmt.Errorf("write %s: %s", path, err)
+	}
+
+	return func() error {
+		if !existed {
+			return os.Remove(path)
+		}
+		return ioutil.WriteFile(path, original, mode)
+	}, nil
+}
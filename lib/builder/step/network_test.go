@@ -0,0 +1,148 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetExtraHosts(t *testing.T) {
+	tests := []struct {
+		desc     string
+		hosts    []string
+		expected []string
+		failed   bool
+	}{
+		{"ipv4", []string{"db:10.0.0.1"}, []string{"10.0.0.1\tdb"}, false},
+		{"ipv6", []string{"db:fe80::1"}, []string{"fe80::1\tdb"}, false},
+		{"multiple", []string{"a:1.1.1.1", "b:2.2.2.2"}, []string{"1.1.1.1\ta", "2.2.2.2\tb"}, false},
+		{"missing ip", []string{"db"}, nil, true},
+		{"missing name", []string{":10.0.0.1"}, nil, true},
+		{"invalid ip", []string{"db:10.0.0"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			opts := context.DefaultBuildOptions()
+			err := SetExtraHosts(opts, test.hosts)
+			if test.failed {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, opts.ExtraHosts)
+		})
+	}
+}
+
+func TestAddHosts(t *testing.T) {
+	t.Run("Existing", func(t *testing.T) {
+		require := require.New(t)
+		tmpDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(tmpDir)
+
+		path := filepath.Join(tmpDir, "hosts")
+		require.NoError(ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost"), 0644))
+
+		restore, err := addHosts(path, []string{"10.0.0.1\tdb"})
+		require.NoError(err)
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("127.0.0.1\tlocalhost\n10.0.0.1\tdb\n", string(content))
+
+		require.NoError(restore())
+		content, err = ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("127.0.0.1\tlocalhost", string(content))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		require := require.New(t)
+		tmpDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(tmpDir)
+
+		path := filepath.Join(tmpDir, "hosts")
+		restore, err := addHosts(path, []string{"10.0.0.1\tdb"})
+		require.NoError(err)
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("10.0.0.1\tdb\n", string(content))
+
+		require.NoError(restore())
+		_, err = os.Stat(path)
+		require.True(os.IsNotExist(err))
+	})
+}
+
+func TestSetDNS(t *testing.T) {
+	require := require.New(t)
+
+	opts := context.DefaultBuildOptions()
+	require.NoError(SetDNS(opts, []string{"10.0.0.53", "fe80::53"}, []string{"corp.example.com"}))
+	require.Equal([]string{"10.0.0.53", "fe80::53"}, opts.DNSServers)
+	require.Equal([]string{"corp.example.com"}, opts.DNSSearches)
+
+	require.Error(SetDNS(opts, []string{"dns.example.com"}, nil))
+	require.Error(SetDNS(opts, nil, []string{"a b"}))
+}
+
+func TestSetResolvConf(t *testing.T) {
+	original := "search example.com\nnameserver 8.8.8.8\noptions ndots:0\n"
+	tests := []struct {
+		desc     string
+		servers  []string
+		searches []string
+		expected string
+	}{
+		{"nothing", nil, nil, original},
+		{"servers", []string{"10.0.0.53", "10.0.1.53"}, nil,
+			"search example.com\noptions ndots:0\nnameserver 10.0.0.53\nnameserver 10.0.1.53\n"},
+		{"searches", nil, []string{"a.com", "b.com"},
+			"nameserver 8.8.8.8\noptions ndots:0\nsearch a.com b.com\n"},
+		{"both", []string{"10.0.0.53"}, []string{"a.com"},
+			"options ndots:0\nnameserver 10.0.0.53\nsearch a.com\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			tmpDir, err := ioutil.TempDir("", "")
+			require.NoError(err)
+			defer os.RemoveAll(tmpDir)
+
+			path := filepath.Join(tmpDir, "resolv.conf")
+			require.NoError(ioutil.WriteFile(path, []byte(original), 0644))
+
+			restore, err := setResolvConf(path, test.servers, test.searches)
+			require.NoError(err)
+			content, err := ioutil.ReadFile(path)
+			require.NoError(err)
+			require.Equal(test.expected, string(content))
+
+			require.NoError(restore())
+			content, err = ioutil.ReadFile(path)
+			require.NoError(err)
+			require.Equal(original, string(content))
+		})
+	}
+}
@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// runScriptDir is the directory of the scripts of long RUN commands, relative
+// to the root of the build.
+const runScriptDir = "tmp"
+
+// writeRunScript returns the command to pass to the shell to run cmd. If cmd
+// is longer than threshold, it is written to a script in the build filesystem,
+// and the command sources it. The returned function removes the script, so
+// that it isn't committed.
+func writeRunScript(rootDir, cmd string, threshold int) (string, func() error, error) {
+	if threshold <= 0 || len(cmd) <= threshold {
+		return cmd, noRestore, nil
+	}
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", nil, fmt.Errorf("generate script name: %s", err)
+	}
+	path := filepath.Join(rootDir, runScriptDir, ".makisu-run-"+hex.EncodeToString(suffix[:])+".sh")
+	remove, err := createFile(path, []byte(cmd+"\n"), 0644)
+	if err != nil {
+		return "", nil, fmt.Errorf("create script: %s", err)
+	}
+	log.Infof("* Running command of %d bytes from script %s", len(cmd), path)
+	// Sourcing the script keeps the options of the shell, e.g. "-e".
+	return ". '" + strings.Replace(path, "'", `'\''`, -1) + "'", remove, nil
+}
@@ -15,30 +15,125 @@
 package step
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/shell"
 )
 
+// SetBuildUmask parses an octal umask, e.g. "022", into the BuildUmask of
+// opts. An empty umask makes RUN commands inherit the umask of makisu.
+func SetBuildUmask(opts *context.BuildOptions, umask string) error {
+	if umask == "" {
+		opts.BuildUmask = -1
+		return nil
+	}
+	parsed, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || parsed > 0777 {
+		return fmt.Errorf("invalid umask %s", umask)
+	}
+	opts.BuildUmask = int(parsed)
+	return nil
+}
+
+// defaultRunShell is the shell of RUN commands if RunShell isn't set.
+var defaultRunShell = []string{"sh", "-c"}
+
+// SetRunShell parses the given shell into the RunShell of opts, either a JSON
+// array like `["/bin/bash", "-c"]` or words separated by spaces like
+// "/bin/bash -c". An empty shell restores the default one.
+func SetRunShell(opts *context.BuildOptions, runShell string) error {
+	runShell = strings.TrimSpace(runShell)
+	if runShell == "" {
+		opts.RunShell = nil
+		return nil
+	}
+	var parsed []string
+	if strings.HasPrefix(runShell, "[") {
+		if err := json.Unmarshal([]byte(runShell), &parsed); err != nil {
+			return fmt.Errorf("invalid run shell %s: %s", runShell, err)
+		}
+	} else {
+		parsed = strings.Fields(runShell)
+	}
+	if len(parsed) == 0 {
+		return fmt.Errorf("invalid run shell %s: empty command", runShell)
+	}
+	for _, arg := range parsed {
+		if arg == "" {
+			return fmt.Errorf("invalid run shell %s: empty argument", runShell)
+		}
+	}
+	opts.RunShell = parsed
+	return nil
+}
+
+// runShellCommand returns the command and arguments that run cmd with the
+// shell of RUN commands, or the default one if it is nil.
+func runShellCommand(runShell []string, cmd string) (string, []string) {
+	if runShell == nil {
+		runShell = defaultRunShell
+	}
+	args := append(append([]string{}, runShell[1:]...), cmd)
+	return runShell[0], args
+}
+
+// shellCommand returns the arguments of a CMD or ENTRYPOINT, which are its
+// command in shell form passed to the shell of RUN commands if both are set.
+func shellCommand(runShell []string, args []string, shellCmd string) []string {
+	if runShell == nil || shellCmd == "" {
+		return args
+	}
+	return append(append([]string{}, runShell...), shellCmd)
+}
+
 // RunStep implements BuildStep and execute RUN directive
 type RunStep struct {
 	*baseStep
 
 	cmd string
 
+	// Secrets mounted while the command runs.
+	secrets []dockerfile.SecretMount
+
 	// Used by the user step and the run step to determine which user should run a command (format should be <user>[:<group>] or <UID>[:<GID>], default is "" which is 0:0)
 	user string
 }
 
 // NewRunStep returns a BuildStep from given arguments.
-func NewRunStep(args, cmd string, commit bool) *RunStep {
+func NewRunStep(args, cmd string, secrets []dockerfile.SecretMount, commit bool) *RunStep {
 	return &RunStep{
 		baseStep: newBaseStep(Run, args, commit),
 		cmd:      cmd,
+		secrets:  secrets,
+	}
+}
+
+// SetCacheID sets the cache ID of the step, which also depends on RunShell if
+// it is set, since the same command could have different results in another
+// shell.
+func (s *RunStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	if ctx.Options.RunShell == nil {
+		return s.baseStep.SetCacheID(ctx, seed)
+	}
+	commitStr := fmt.Sprintf("%v", s.commit)
+	runShell, err := json.Marshal(ctx.Options.RunShell)
+	if err != nil {
+		return fmt.Errorf("marshal run shell: %s", err)
 	}
+	s.cacheID = CacheChecksum(ctx.Options.CacheHash, seed+string(s.directive)+s.args+commitStr+string(runShell))
+	explainCacheID(ctx, s.directive, s.args, s.cacheID,
+		cacheInput{"seed", seed}, cacheInput{"args", s.args}, cacheInput{"commit", commitStr},
+		cacheInput{"shell", string(runShell)})
+	return nil
 }
 
 // RequireOnDisk always returns true, as run steps always require the stage's
@@ -62,10 +157,105 @@ func (s *RunStep) ApplyCtxAndConfig(ctx *context.BuildContext, imageConfig *imag
 
 // Execute executes the step.
 // It shells out to run the specified command, which might change local file system.
-func (s *RunStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
+func (s *RunStep) Execute(ctx *context.BuildContext, modifyFS bool) (err error) {
 	if !modifyFS {
 		return errors.New("attempted to execute RUN step without modifying file system")
 	}
 	ctx.MustScan = true
-	return shell.ExecCommand(log.Infof, log.Errorf, s.workingDir, s.user, "sh", "-c", s.cmd)
+	opts := ctx.Options
+	restoreHosts, err := addHosts(filepath.Join(ctx.RootDir, "etc/hosts"), opts.ExtraHosts)
+	if err != nil {
+		return fmt.Errorf("add hosts: %s", err)
+	}
+	defer teardown(opts, &err, "restore /etc/hosts", restoreHosts)
+	restoreResolvConf, err := setResolvConf(
+		filepath.Join(ctx.RootDir, "etc/resolv.conf"), opts.DNSServers, opts.DNSSearches)
+	if err != nil {
+		return fmt.Errorf("set dns: %s", err)
+	}
+	defer teardown(opts, &err, "restore /etc/resolv.conf", restoreResolvConf)
+	restoreCACerts, err := addCACerts(ctx.RootDir, opts.BuildCACerts)
+	if err != nil {
+		return fmt.Errorf("add ca certs: %s", err)
+	}
+	defer teardown(opts, &err, "restore ca bundles", restoreCACerts)
+	removeEmulator, err := addEmulator(ctx.RootDir, opts.TargetPlatform)
+	if err != nil {
+		return fmt.Errorf("add emulator: %s", err)
+	}
+	defer teardown(opts, &err, "remove emulator", removeEmulator)
+
+	unmountSecrets, err := mountSecrets(ctx.RootDir, opts.Secrets, s.secrets)
+	if err != nil {
+		return fmt.Errorf("mount secrets: %s", err)
+	}
+	defer teardown(opts, &err, "remove secrets", unmountSecrets)
+
+	// The command is killed once the build or the stage times out, or when
+	// it exceeds the disk quota.
+	var check func() error
+	if !ctx.Deadline.IsZero() || !ctx.StageDeadline.IsZero() {
+		check = ctx.Err
+	}
+	if opts.DiskQuota > 0 {
+		quotaCheck, err := newDiskQuotaCheck(ctx.RootDir, opts.DiskQuota)
+		if err != nil {
+			return fmt.Errorf("check disk quota: %s", err)
+		}
+		check = func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return quotaCheck()
+		}
+	}
+	execOpts := shell.ExecOptions{Check: check, AssertCleanup: opts.AssertCleanup}
+	if opts.PrefixRunOutput && ctx.Step != "" {
+		execOpts.Prefix = fmt.Sprintf("[%s] ", ctx.Step)
+	}
+	if opts.NoNetwork || (ctx.Resources != nil && ctx.Resources.Network == context.NetworkNone) {
+		execOpts.NoNetwork = true
+	}
+	cmd := ulimitCommand(
+		umaskCommand(opts.BuildUmask, s.cmd), stageUlimits(opts.Ulimits, ctx.Resources))
+	cmd, removeScript, err := writeRunScript(ctx.RootDir, cmd, opts.RunScriptThreshold)
+	if err != nil {
+		return fmt.Errorf("write run script: %s", err)
+	}
+	defer teardown(opts, &err, "remove run script", removeScript)
+	cmdName, cmdArgs := runShellCommand(opts.RunShell, cmd)
+	err = shell.ExecCommandWithOptions(execOpts, log.Infof, log.Errorf, s.workingDir, s.user, cmdName, cmdArgs...)
+	if err != nil && opts.DebugShell && shell.IsTerminal() {
+		// The build fails regardless, so changes made in the shell are never
+		// committed.
+		log.Infof("RUN step failed, starting debug shell. Exit the shell to abort the build")
+		if err := shell.ExecInteractive(s.workingDir, s.user, "sh"); err != nil {
+			log.Errorf("Debug shell exited: %s", err)
+		}
+	}
+	return err
+}
+
+// umaskCommand prefixes the command with the umask builtin of the shell if
+// umask isn't negative, so that files it creates have the same permissions on
+// every host.
+func umaskCommand(umask int, cmd string) string {
+	if umask < 0 {
+		return cmd
+	}
+	return fmt.Sprintf("umask %04o; %s", umask, cmd)
+}
+
+// teardown undoes a change made to the filesystem to execute the command,
+// whether the command failed or not. If that fails, the step fails too if
+// AssertCleanup is set, as the change would leak into the next steps.
+func teardown(opts *context.BuildOptions, err *error, desc string, undo func() error) {
+	undoErr := undo()
+	if undoErr == nil {
+		return
+	} else if opts.AssertCleanup && *err == nil {
+		*err = fmt.Errorf("%s: %s", desc, undoErr)
+		return
+	}
+	log.Errorf("Failed to %s: %s", desc, undoErr)
 }
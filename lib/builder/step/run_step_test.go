@@ -15,9 +15,19 @@
 package step
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/parser/dockerfile"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +37,227 @@ func TestRunStepExecutionFail(t *testing.T) {
 	context, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	step := NewRunStep("", "echo hello", false)
+	step := NewRunStep("", "echo hello", nil, false)
 	err := step.Execute(context, false)
 	require.Error(err)
 }
+
+func TestRunStepAssertCleanup(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(t, os.Setenv("MAKISU_TEST_SECRET", "value"))
+	defer os.Unsetenv("MAKISU_TEST_SECRET")
+	require.NoError(t, SetSecrets(ctx.Options, []string{"id=foo,env=MAKISU_TEST_SECRET"}))
+
+	// The command leaves a file next to the secret, so its directory can't be
+	// removed.
+	mounts := []dockerfile.SecretMount{{ID: "foo", Target: "/run/secrets/foo", Mode: 0400}}
+	cmd := fmt.Sprintf("touch %s", filepath.Join(ctx.RootDir, "run/secrets/leak"))
+
+	t.Run("logged", func(t *testing.T) {
+		require := require.New(t)
+		defer os.RemoveAll(filepath.Join(ctx.RootDir, "run"))
+		require.NoError(NewRunStep("", cmd, mounts, false).Execute(ctx, true))
+		_, err := os.Stat(filepath.Join(ctx.RootDir, "run/secrets/foo"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("asserted", func(t *testing.T) {
+		require := require.New(t)
+		defer os.RemoveAll(filepath.Join(ctx.RootDir, "run"))
+		ctx.Options.AssertCleanup = true
+		require.Error(NewRunStep("", cmd, mounts, false).Execute(ctx, true))
+	})
+}
+
+func TestRunStepBuildUmask(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.Error(SetBuildUmask(ctx.Options, "999"))
+	require.Error(SetBuildUmask(ctx.Options, "1777"))
+	require.NoError(SetBuildUmask(ctx.Options, "077"))
+
+	original := syscall.Umask(022)
+	defer syscall.Umask(original)
+
+	path := filepath.Join(ctx.RootDir, "file")
+	require.NoError(NewRunStep("", "touch "+path, nil, false).Execute(ctx, true))
+	fi, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// The umask of makisu is left as it is.
+	require.Equal(022, syscall.Umask(022))
+}
+
+func TestRunStepUlimits(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	var original syscall.Rlimit
+	require.NoError(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &original))
+	require.NoError(SetUlimits(ctx.Options, []string{fmt.Sprintf("nofile=256:%d", original.Max)}))
+
+	path := filepath.Join(ctx.RootDir, "nofile")
+	require.NoError(NewRunStep("", "ulimit -n > "+path, nil, false).Execute(ctx, true))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal("256\n", string(b))
+
+	// The limits of makisu are left as they are.
+	var restored syscall.Rlimit
+	require.NoError(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &restored))
+	require.Equal(original, restored)
+}
+
+func TestRunStepNoNetwork(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires linux and root")
+	}
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Options.NoNetwork = true
+
+	// Only the loopback interface is left, after the two header lines.
+	path := filepath.Join(ctx.RootDir, "dev")
+	require.NoError(NewRunStep("", "cat /proc/net/dev > "+path, nil, false).Execute(ctx, true))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(lines, 3)
+	require.Contains(lines[2], "lo:")
+}
+
+func TestRunStepDiskQuota(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Options.DiskQuota = 1 << 20
+
+	// The command keeps running after filling the disk, so that it gets
+	// killed by the quota check instead of exiting on its own.
+	big := filepath.Join(ctx.RootDir, "big")
+	cmd := fmt.Sprintf("dd if=/dev/zero of=%s bs=1M count=16 && sync && sleep 60", big)
+	err := NewRunStep("", cmd, nil, false).Execute(ctx, true)
+	require.Error(err)
+	require.Contains(err.Error(), "--disk-quota")
+}
+
+func TestRunStepBuildTimeout(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Deadline = time.Now().Add(500 * time.Millisecond)
+	start := time.Now()
+	err := NewRunStep("", "sleep 60", nil, false).Execute(ctx, true)
+	require.Error(err)
+	require.True(errors.Is(err, context.ErrBuildTimeout))
+	require.True(time.Since(start) < 30*time.Second)
+}
+
+func TestRunStepStageTimeout(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.StageDeadline = time.Now().Add(500 * time.Millisecond)
+	start := time.Now()
+	err := NewRunStep("", "sleep 60", nil, false).Execute(ctx, true)
+	require.Error(err)
+	require.True(errors.Is(err, context.ErrStageTimeout))
+	require.True(time.Since(start) < 30*time.Second)
+}
+
+func TestRunStepRunShell(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		tests := []struct {
+			input    string
+			expected []string
+			valid    bool
+		}{
+			{"", nil, true},
+			{"/usr/bin/env bash -c", []string{"/usr/bin/env", "bash", "-c"}, true},
+			{`["/bin/bash", "-o", "pipefail", "-c"]`, []string{"/bin/bash", "-o", "pipefail", "-c"}, true},
+			{`["/bin/bash", "-c"`, nil, false},
+			{`[]`, nil, false},
+			{`["/bin/bash", ""]`, nil, false},
+			{`[1, 2]`, nil, false},
+		}
+		for _, test := range tests {
+			require := require.New(t)
+			opts := context.DefaultBuildOptions()
+			err := SetRunShell(opts, test.input)
+			if !test.valid {
+				require.Error(err, test.input)
+				continue
+			}
+			require.NoError(err, test.input)
+			require.Equal(test.expected, opts.RunShell)
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		require := require.New(t)
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		require.NoError(SetRunShell(ctx.Options, "/usr/bin/env FOO=bar sh -c"))
+
+		path := filepath.Join(ctx.RootDir, "foo")
+		require.NoError(NewRunStep("", "echo $FOO > "+path, nil, false).Execute(ctx, true))
+		b, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("bar\n", string(b))
+	})
+
+	t.Run("cache id", func(t *testing.T) {
+		require := require.New(t)
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		step := NewRunStep("ls /", "ls /", nil, false)
+		require.NoError(step.SetCacheID(ctx, ""))
+		defaultID := step.CacheID()
+		require.NoError(SetRunShell(ctx.Options, "/bin/bash -c"))
+		require.NoError(step.SetCacheID(ctx, ""))
+		require.NotEqual(defaultID, step.CacheID())
+	})
+}
+
+func TestRunStepLongCommand(t *testing.T) {
+	t.Run("script", func(t *testing.T) {
+		require := require.New(t)
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		// Longer than the 128KiB Linux allows for a single argument.
+		path := filepath.Join(ctx.RootDir, "length")
+		cmd := fmt.Sprintf("x=%s; echo ${#x} > %s", strings.Repeat("a", 200000), path)
+		require.NoError(NewRunStep("", cmd, nil, false).Execute(ctx, true))
+		b, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("200000\n", string(b))
+
+		// The script and its directory are removed.
+		_, err = os.Stat(filepath.Join(ctx.RootDir, runScriptDir))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("exit code", func(t *testing.T) {
+		require := require.New(t)
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		ctx.Options.RunScriptThreshold = 1
+		require.Error(NewRunStep("", "exit 3", nil, false).Execute(ctx, true))
+		require.NoError(NewRunStep("", "true", nil, false).Execute(ctx, true))
+	})
+}
@@ -0,0 +1,143 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/secrets"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// SetSecrets parses secrets formatted as "id=<id>,source=<scheme>:<ref>" into
+// the Secrets of opts.
+func SetSecrets(opts *context.BuildOptions, specs []string) error {
+	parsed := make(map[string]*secrets.Secret)
+	for _, spec := range specs {
+		secret, err := secrets.Parse(spec)
+		if err != nil {
+			return fmt.Errorf("parse secret: %s", err)
+		}
+		parsed[secret.ID] = secret
+	}
+	opts.Secrets = parsed
+	return nil
+}
+
+// mountSecrets writes the given secrets of the mounts to their targets under
+// rootDir. The returned
+// function removes them again, along with the directories created for them,
+// so they are never committed to layers.
+func mountSecrets(
+	rootDir string, given map[string]*secrets.Secret,
+	mounts []dockerfile.SecretMount) (unmount func() error, err error) {
+
+	// Paths to remove, in reverse order of creation.
+	var created []string
+	removeCreated := func() error {
+		var err error
+		for i := len(created) - 1; i >= 0; i-- {
+			if rmErr := os.Remove(created[i]); rmErr != nil && err == nil {
+				err = rmErr
+			}
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if unmountErr := removeCreated(); unmountErr != nil {
+				log.Errorf("Failed to remove secrets: %s", unmountErr)
+			}
+		}
+	}()
+
+	for _, mount := range mounts {
+		secret, ok := given[mount.ID]
+		if !ok {
+			if mount.Required {
+				return nil, fmt.Errorf("required secret %s was not given with --secret", mount.ID)
+			}
+			log.Warnf("Skipping mount of secret %s, which was not given with --secret", mount.ID)
+			continue
+		}
+		target := filepath.Join(rootDir, mount.Target)
+		if _, err := os.Lstat(target); err == nil {
+			return nil, fmt.Errorf("target of secret %s already exists: %s", mount.ID, mount.Target)
+		}
+		dirs, err := mkdirAll(filepath.Dir(target))
+		created = append(created, dirs...)
+		if err != nil {
+			return nil, fmt.Errorf("create directory of secret %s: %s", mount.ID, err)
+		}
+
+		value, err := secret.Value()
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(mount.Mode))
+		if err != nil {
+			return nil, fmt.Errorf("create secret %s: %s", mount.ID, err)
+		}
+		created = append(created, target)
+		_, err = f.Write(value)
+		for i := range value {
+			value[i] = 0
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("write secret %s: %s", mount.ID, err)
+		}
+		// The mode is applied explicitly, as the umask applies to OpenFile.
+		if err := os.Chmod(target, os.FileMode(mount.Mode)); err != nil {
+			return nil, fmt.Errorf("chmod secret %s: %s", mount.ID, err)
+		}
+		if err := utils.Chown(target, mount.UID, mount.GID); err != nil {
+			return nil, fmt.Errorf("chown secret %s: %s", mount.ID, err)
+		}
+	}
+	return removeCreated, nil
+}
+
+// mkdirAll is like os.MkdirAll, but returns the directories it created, from
+// the topmost one down.
+func mkdirAll(dir string) ([]string, error) {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil {
+			return created, err
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStepSecretMounts(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(t, os.Setenv("MAKISU_TEST_SECRET", "value"))
+	defer os.Unsetenv("MAKISU_TEST_SECRET")
+	require.NoError(t, SetSecrets(ctx.Options, []string{"id=foo,env=MAKISU_TEST_SECRET"}))
+
+	outPath := filepath.Join(ctx.RootDir, "out")
+
+	t.Run("mounted", func(t *testing.T) {
+		require := require.New(t)
+		mounts := []dockerfile.SecretMount{
+			{ID: "foo", Target: "/run/secrets/foo", Mode: 0400},
+			{ID: "bar", Target: "/run/secrets/bar", Mode: 0400},
+		}
+		secretPath := filepath.Join(ctx.RootDir, "run/secrets/foo")
+		step := NewRunStep("", fmt.Sprintf("stat -c %%a %s > %s && cat %s >> %s",
+			secretPath, outPath, secretPath, outPath), mounts, false)
+		require.NoError(step.Execute(ctx, true))
+
+		out, err := ioutil.ReadFile(outPath)
+		require.NoError(err)
+		require.Equal("400\nvalue", string(out))
+		_, err = os.Stat(filepath.Join(ctx.RootDir, "run"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("required", func(t *testing.T) {
+		require := require.New(t)
+		mounts := []dockerfile.SecretMount{
+			{ID: "foo", Target: "/run/secrets/foo", Mode: 0400},
+			{ID: "bar", Target: "/run/secrets/bar", Required: true, Mode: 0400},
+		}
+		step := NewRunStep("", "true", mounts, false)
+		require.Error(step.Execute(ctx, true))
+		_, err := os.Stat(filepath.Join(ctx.RootDir, "run"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("existing target", func(t *testing.T) {
+		require := require.New(t)
+		mounts := []dockerfile.SecretMount{{ID: "foo", Target: "/out", Mode: 0400}}
+		step := NewRunStep("", "true", mounts, false)
+		require.Error(step.Execute(ctx, true))
+		out, err := ioutil.ReadFile(outPath)
+		require.NoError(err)
+		require.Equal("400\nvalue", string(out))
+	})
+}
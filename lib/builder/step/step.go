@@ -92,28 +92,38 @@ func NewDockerfileStep(
 	switch t := d.(type) {
 	case *dockerfile.AddDirective:
 		s, _ := d.(*dockerfile.AddDirective)
-		step, err = NewAddStep(s.Args, s.Chown, s.Srcs, s.Dst, s.Commit)
+		step, err = NewAddStep(s.Args, s.Chown, s.Srcs, s.Dst, s.Unpack, s.Commit)
 	case *dockerfile.ArgDirective:
 		s, _ := d.(*dockerfile.ArgDirective)
 		step = NewArgStep(s.Args, s.Name, s.ResolvedVal, s.Commit)
 	case *dockerfile.CmdDirective:
 		s, _ := d.(*dockerfile.CmdDirective)
-		step = NewCmdStep(s.Args, s.Cmd, s.Commit)
+		step = NewCmdStep(s.Args, shellCommand(ctx.Options.RunShell, s.Cmd, s.ShellCmd), s.Commit)
 	case *dockerfile.CopyDirective:
 		s, _ := d.(*dockerfile.CopyDirective)
-		step, err = NewCopyStep(s.Args, s.Chown, s.FromStage, s.Srcs, s.Dst, s.Commit)
+		var copy *CopyStep
+		copy, err = NewCopyStep(
+			s.Args, s.Chown, s.FromStage, s.Srcs, s.Dst, s.Parents, s.Commit)
+		if err == nil {
+			copy.useBuildContextDirs(ctx.Options.BuildContextDirs)
+			step = copy
+		}
 	case *dockerfile.EntrypointDirective:
 		s, _ := d.(*dockerfile.EntrypointDirective)
-		step = NewEntrypointStep(s.Args, s.Entrypoint, s.Commit)
+		step = NewEntrypointStep(s.Args, shellCommand(ctx.Options.RunShell, s.Entrypoint, s.ShellCmd), s.Commit)
 	case *dockerfile.EnvDirective:
 		s, _ := d.(*dockerfile.EnvDirective)
-		step = NewEnvStep(s.Args, s.Envs, s.Commit)
+		step = NewEnvStep(s.Args, s.Envs, s.Keys, s.Commit)
 	case *dockerfile.ExposeDirective:
 		s, _ := d.(*dockerfile.ExposeDirective)
 		step = NewExposeStep(s.Args, s.Ports, s.Commit)
 	case *dockerfile.FromDirective:
 		s, _ := d.(*dockerfile.FromDirective)
-		step, err = NewFromStep(s.Args, s.Image, s.Alias)
+		var from *FromStep
+		if from, err = NewFromStep(s.Args, s.Image, s.Alias); err == nil {
+			from.base = true
+			step = from
+		}
 	case *dockerfile.HealthcheckDirective:
 		s, _ := d.(*dockerfile.HealthcheckDirective)
 		step, err = NewHealthcheckStep(s.Args, s.Interval, s.Timeout, s.StartPeriod, s.Retries, s.Test, s.Commit)
@@ -125,7 +135,7 @@ func NewDockerfileStep(
 		step = NewMaintainerStep(s.Args, s.Author, s.Commit)
 	case *dockerfile.RunDirective:
 		s, _ := d.(*dockerfile.RunDirective)
-		step = NewRunStep(s.Args, s.Cmd, s.Commit)
+		step = NewRunStep(s.Args, s.Cmd, s.Secrets, s.Commit)
 	case *dockerfile.StopsignalDirective:
 		s, _ := d.(*dockerfile.StopsignalDirective)
 		step = NewStopsignalStep(s.Args, s.Signal, s.Commit)
@@ -138,6 +148,9 @@ func NewDockerfileStep(
 	case *dockerfile.WorkdirDirective:
 		s, _ := d.(*dockerfile.WorkdirDirective)
 		step = NewWorkdirStep(s.Args, s.WorkingDir, s.Commit)
+	case *dockerfile.CustomDirective:
+		s, _ := d.(*dockerfile.CustomDirective)
+		step, err = NewCustomStep(s.Name(), s.Args, s.Commit)
 	default:
 		err = fmt.Errorf("unsupported directive type: %#v", t)
 	}
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 
 	"github.com/stretchr/testify/require"
@@ -27,6 +28,9 @@ func TestNewDockerfileStep(t *testing.T) {
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
+	// Don't resolve base images from the registry.
+	ctx.Options.CacheBaseDigest = false
+
 	t.Run("FROM", func(t *testing.T) {
 		require := require.New(t)
 		step := dockerfile.FromDirectiveFixture("", "image", "alias")
@@ -55,6 +59,33 @@ func TestNewDockerfileStep(t *testing.T) {
 		require.NoError(err)
 	})
 
+	t.Run("CMD and ENTRYPOINT with run shell", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(SetRunShell(ctx.Options, "/usr/bin/env bash -c"))
+		defer func() { ctx.Options.RunShell = nil }()
+
+		stages, err := dockerfile.ParseFile(`FROM image
+CMD echo "hello world"
+ENTRYPOINT ["/entrypoint", "arg"]
+`, nil)
+		require.NoError(err)
+		config := image.NewDefaultImageConfig()
+		for i, expected := range [][]string{
+			{"/usr/bin/env", "bash", "-c", `echo "hello world"`},
+			{"/entrypoint", "arg"},
+		} {
+			step, err := NewDockerfileStep(ctx, stages[0].Directives[i], "")
+			require.NoError(err)
+			updated, err := step.UpdateCtxAndConfig(ctx, &config)
+			require.NoError(err)
+			if i == 0 {
+				require.Equal(expected, updated.Config.Cmd)
+			} else {
+				require.Equal(expected, updated.Config.Entrypoint)
+			}
+		}
+	})
+
 	t.Run("LABEL", func(t *testing.T) {
 		require := require.New(t)
 		step := dockerfile.LabelDirectiveFixture("", map[string]string{"key": "val"})
@@ -0,0 +1,157 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// ulimitFlag is the option of the ulimit builtin that sets a resource, and the
+// number of bytes or other units of a docker run --ulimit value per unit of
+// its value. Resources whose option differs between shells have one option per
+// shell, which are tried in order.
+type ulimitFlag struct {
+	options []string
+	unit    uint64
+}
+
+// ulimitFlags maps the names of docker run --ulimit to the options of the
+// ulimit builtin of dash, bash and busybox ash. Core and file sizes are in the
+// 512-byte blocks of POSIX shells.
+var ulimitFlags = map[string]ulimitFlag{
+	"core":       {[]string{"c"}, 512},
+	"cpu":        {[]string{"t"}, 1},
+	"data":       {[]string{"d"}, 1024},
+	"fsize":      {[]string{"f"}, 512},
+	"locks":      {[]string{"x", "w"}, 1},
+	"memlock":    {[]string{"l"}, 1024},
+	"msgqueue":   {[]string{"q"}, 1},
+	"nice":       {[]string{"e"}, 1},
+	"nofile":     {[]string{"n"}, 1},
+	"nproc":      {[]string{"u", "p"}, 1},
+	"rss":        {[]string{"m"}, 1024},
+	"rtprio":     {[]string{"r"}, 1},
+	"rttime":     {[]string{"R"}, 1},
+	"sigpending": {[]string{"i"}, 1},
+	"stack":      {[]string{"s"}, 1024},
+}
+
+// SetUlimits parses limits formatted as <name>=<soft>[:<hard>] into the
+// Ulimits of opts, like docker run --ulimit. The hard limit defaults to the
+// soft one, and "unlimited" or -1 remove a limit.
+func SetUlimits(opts *context.BuildOptions, ulimits []string) error {
+	parsed := make([]context.Ulimit, 0, len(ulimits))
+	for _, ulimit := range ulimits {
+		u, err := parseUlimit(ulimit)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, u)
+	}
+	opts.Ulimits = parsed
+	return nil
+}
+
+func parseUlimit(ulimit string) (context.Ulimit, error) {
+	parts := strings.SplitN(ulimit, "=", 2)
+	if len(parts) != 2 {
+		return context.Ulimit{}, fmt.Errorf("failed to parse ulimit %s", ulimit)
+	}
+	if _, ok := ulimitFlags[parts[0]]; !ok {
+		return context.Ulimit{}, fmt.Errorf("unsupported resource in ulimit %s", ulimit)
+	}
+	values := strings.Split(parts[1], ":")
+	if len(values) > 2 {
+		return context.Ulimit{}, fmt.Errorf("failed to parse ulimit %s", ulimit)
+	}
+	soft, err := parseUlimitValue(values[0])
+	if err != nil {
+		return context.Ulimit{}, fmt.Errorf("invalid soft limit in ulimit %s", ulimit)
+	}
+	hard := soft
+	if len(values) == 2 {
+		if hard, err = parseUlimitValue(values[1]); err != nil {
+			return context.Ulimit{}, fmt.Errorf("invalid hard limit in ulimit %s", ulimit)
+		}
+	}
+	if soft > hard {
+		return context.Ulimit{}, fmt.Errorf("soft limit exceeds hard limit in ulimit %s", ulimit)
+	}
+	return context.Ulimit{Name: parts[0], Soft: soft, Hard: hard}, nil
+}
+
+// stageUlimits returns the ulimits followed by the limit enforcing the CPU time
+// of the resources of a stage, which takes precedence as it is set last.
+func stageUlimits(ulimits []context.Ulimit, resources *context.StageResources) []context.Ulimit {
+	if resources == nil {
+		return ulimits
+	}
+	ulimits = append([]context.Ulimit{}, ulimits...)
+	if resources.CPUTime > 0 {
+		// The limit is in seconds, rounded up so that it is never 0.
+		seconds := uint64((resources.CPUTime + time.Second - 1) / time.Second)
+		ulimits = append(ulimits, context.Ulimit{"cpu", seconds, seconds})
+	}
+	return ulimits
+}
+
+func parseUlimitValue(value string) (uint64, error) {
+	if value == "unlimited" || value == "-1" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// ulimitCommand prefixes the command with the ulimit builtin of the shell for
+// each limit, so that the limits apply to the command and the processes it
+// starts, but not to makisu. The command isn't run if a limit can't be set.
+// Limits are set in order, so later ones for a resource take precedence.
+func ulimitCommand(cmd string, ulimits []context.Ulimit) string {
+	var prefix strings.Builder
+	for _, u := range ulimits {
+		flag := ulimitFlags[u.Name]
+		// Without -H or -S both limits are set at once, which is valid
+		// whatever the current ones are. The soft limit is then lowered.
+		prefix.WriteString(ulimitBuiltin(flag, "", u.Hard))
+		if u.Soft != u.Hard {
+			prefix.WriteString(ulimitBuiltin(flag, "-S ", u.Soft))
+		}
+	}
+	return prefix.String() + cmd
+}
+
+// ulimitBuiltin returns the ulimit builtin setting a limit, trying each option
+// of the resource until one is supported, and exiting otherwise.
+func ulimitBuiltin(flag ulimitFlag, mode string, limit uint64) string {
+	value := "unlimited"
+	if limit != math.MaxUint64 {
+		value = strconv.FormatUint(limit/flag.unit, 10)
+	}
+	var cmds []string
+	for i, option := range flag.options {
+		cmd := fmt.Sprintf("ulimit %s-%s %s", mode, option, value)
+		if i < len(flag.options)-1 {
+			cmd += " 2>/dev/null"
+		}
+		cmds = append(cmds, cmd)
+	}
+	return strings.Join(cmds, " || ") + " || exit; "
+}
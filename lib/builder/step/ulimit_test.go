@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetUlimits(t *testing.T) {
+	tests := []struct {
+		desc     string
+		ulimits  []string
+		expected []context.Ulimit
+		failed   bool
+	}{
+		{"soft and hard", []string{"nofile=1024:4096"}, []context.Ulimit{{"nofile", 1024, 4096}}, false},
+		{"soft only", []string{"nproc=100"}, []context.Ulimit{{"nproc", 100, 100}}, false},
+		{"unlimited", []string{"core=-1:unlimited"}, []context.Ulimit{{"core", math.MaxUint64, math.MaxUint64}}, false},
+		{"multiple", []string{"nofile=1:2", "stack=3:4"}, []context.Ulimit{
+			{"nofile", 1, 2},
+			{"stack", 3, 4},
+		}, false},
+		{"missing value", []string{"nofile"}, nil, true},
+		{"unknown resource", []string{"files=1:2"}, nil, true},
+		{"invalid soft", []string{"nofile=a:2"}, nil, true},
+		{"invalid hard", []string{"nofile=1:b"}, nil, true},
+		{"too many values", []string{"nofile=1:2:3"}, nil, true},
+		{"soft above hard", []string{"nofile=2:1"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			opts := context.DefaultBuildOptions()
+			err := SetUlimits(opts, test.ulimits)
+			if test.failed {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, opts.Ulimits)
+		})
+	}
+}
+
+func TestStageUlimits(t *testing.T) {
+	require := require.New(t)
+	opts := context.DefaultBuildOptions()
+	require.NoError(SetUlimits(opts, []string{"nofile=1024:4096", "cpu=100"}))
+
+	require.Equal(opts.Ulimits, stageUlimits(opts.Ulimits, nil))
+	require.Equal(opts.Ulimits, stageUlimits(opts.Ulimits, &context.StageResources{Network: context.NetworkNone}))
+
+	resources := &context.StageResources{CPUTime: 1500 * time.Millisecond}
+	require.Equal([]context.Ulimit{
+		{"nofile", 1024, 4096},
+		{"cpu", 100, 100},
+		{"cpu", 2, 2},
+	}, stageUlimits(opts.Ulimits, resources))
+
+	// The limits of the build are kept as they are.
+	require.Len(opts.Ulimits, 2)
+}
+
+func TestUlimitCommand(t *testing.T) {
+	tests := []struct {
+		desc     string
+		ulimits  []context.Ulimit
+		expected string
+	}{
+		{"none", nil, "make"},
+		{"soft and hard", []context.Ulimit{{"nofile", 1024, 4096}},
+			"ulimit -n 4096 || exit; ulimit -S -n 1024 || exit; make"},
+		{"same soft and hard", []context.Ulimit{{"cpu", 100, 100}}, "ulimit -t 100 || exit; make"},
+		{"unlimited", []context.Ulimit{{"core", 0, math.MaxUint64}},
+			"ulimit -c unlimited || exit; ulimit -S -c 0 || exit; make"},
+		{"bytes", []context.Ulimit{{"stack", 8 << 20, 8 << 20}, {"fsize", 1 << 20, 1 << 20}},
+			"ulimit -s 8192 || exit; ulimit -f 2048 || exit; make"},
+		{"options of shells", []context.Ulimit{{"nproc", 100, 100}},
+			"ulimit -u 100 2>/dev/null || ulimit -p 100 || exit; make"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, ulimitCommand("make", test.ulimits))
+		})
+	}
+}
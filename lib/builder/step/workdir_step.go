@@ -18,9 +18,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/snapshot"
 )
 
 // WorkdirStep implements BuildStep and execute WORKDIR directive
@@ -48,21 +50,41 @@ func (s *WorkdirStep) UpdateCtxAndConfig(
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
 
-	workdir := os.ExpandEnv(s.workingDir)
-	if filepath.IsAbs(workdir) {
-		config.Config.WorkingDir = ctx.RootDir
-	}
-	config.Config.WorkingDir = filepath.Join(config.Config.WorkingDir, workdir)
+	workdir := resolveWorkdir(ctx.RootDir, config.Config.WorkingDir, os.ExpandEnv(s.workingDir))
+	config.Config.WorkingDir = filepath.Join(ctx.RootDir, workdir)
 
-	// Create this workdir if it does not exist already.
-	if _, err := os.Lstat(config.Config.WorkingDir); err != nil {
+	// Create this workdir if it does not exist already. Like docker, symlinks
+	// are followed within the image, so that a link to a dir isn't replaced by
+	// a dir, and the target of a dangling link is created.
+	resolved, err := snapshot.ResolvePathInRoot(workdir, ctx.RootDir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve working dir %s: %s", workdir, err)
+	}
+	target := filepath.Join(ctx.RootDir, resolved)
+	if _, err := os.Stat(target); err != nil {
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(config.Config.WorkingDir, 0755); err != nil {
-				return nil, fmt.Errorf("mkdir all working dir %s: %s", config.Config.WorkingDir, err)
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, fmt.Errorf("mkdir all working dir %s: %s", target, err)
 			}
 		} else {
-			return nil, fmt.Errorf("lstat working dir %s: %s", config.Config.WorkingDir, err)
+			return nil, fmt.Errorf("stat working dir %s: %s", target, err)
 		}
 	}
 	return config, nil
 }
+
+// resolveWorkdir returns the absolute path in the image of the working dir set
+// by WORKDIR dir, with prev the working dir of the previous step. Like docker,
+// relative paths are resolved against prev, or against / if it is empty.
+func resolveWorkdir(rootDir, prev, dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	// The working dirs set by WORKDIR are under the root dir, but the ones of
+	// base images aren't.
+	root := strings.TrimSuffix(rootDir, "/")
+	if prev == root || strings.HasPrefix(prev, root+"/") {
+		prev = strings.TrimPrefix(prev, root)
+	}
+	return filepath.Join("/", prev, dir)
+}
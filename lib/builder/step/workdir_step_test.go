@@ -15,6 +15,7 @@
 package step
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -39,6 +40,87 @@ func TestWorkdirStepUpdateCtxAndConfig(t *testing.T) {
 	require.Equal(result.Config.WorkingDir, filepath.Join(ctx.RootDir, workdir))
 }
 
+func TestWorkdirStepChainedRelativePaths(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	tests := []struct {
+		desc     string
+		base     string
+		workdirs []string
+		expected string
+	}{
+		{"relative without base", "", []string{"sub"}, "/sub"},
+		{"relative after absolute", "", []string{"/app", "sub"}, "/app/sub"},
+		{"chained relative", "", []string{"/app", "sub", "dir/leaf"}, "/app/sub/dir/leaf"},
+		{"parent", "", []string{"/app/sub", "../other"}, "/app/other"},
+		{"absolute resets", "", []string{"/app", "sub", "/srv"}, "/srv"},
+		{"relative to base image", "/base", []string{"sub"}, "/base/sub"},
+		{"chained relative to base image", "/base", []string{"sub", "leaf"}, "/base/sub/leaf"},
+		{"relative base image", "base", []string{"sub"}, "/base/sub"},
+		{"trailing slash", "", []string{"/app/", "sub/"}, "/app/sub"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			c := image.NewDefaultImageConfig()
+			c.Config.WorkingDir = test.base
+			config := &c
+			for _, workdir := range test.workdirs {
+				var err error
+				config, err = NewWorkdirStep("", workdir, false).UpdateCtxAndConfig(ctx, config)
+				require.NoError(err)
+			}
+			require.Equal(filepath.Join(ctx.RootDir, test.expected), config.Config.WorkingDir)
+		})
+	}
+}
+
+func TestWorkdirStepSymlink(t *testing.T) {
+	t.Run("link to dir", func(t *testing.T) {
+		require := require.New(t)
+
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		require.NoError(os.MkdirAll(filepath.Join(ctx.RootDir, "data/app"), 0755))
+		require.NoError(os.Symlink("/data/app", filepath.Join(ctx.RootDir, "app")))
+
+		c := image.NewDefaultImageConfig()
+		config, err := NewWorkdirStep("", "/app/sub", false).UpdateCtxAndConfig(ctx, &c)
+		require.NoError(err)
+		require.Equal(filepath.Join(ctx.RootDir, "app/sub"), config.Config.WorkingDir)
+
+		fi, err := os.Lstat(filepath.Join(ctx.RootDir, "app"))
+		require.NoError(err)
+		require.True(fi.Mode()&os.ModeSymlink != 0)
+		fi, err = os.Stat(filepath.Join(ctx.RootDir, "data/app/sub"))
+		require.NoError(err)
+		require.True(fi.IsDir())
+	})
+
+	t.Run("dangling link", func(t *testing.T) {
+		require := require.New(t)
+
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		require.NoError(os.Symlink("/data/app", filepath.Join(ctx.RootDir, "app")))
+
+		c := image.NewDefaultImageConfig()
+		_, err := NewWorkdirStep("", "/app", false).UpdateCtxAndConfig(ctx, &c)
+		require.NoError(err)
+
+		fi, err := os.Lstat(filepath.Join(ctx.RootDir, "app"))
+		require.NoError(err)
+		require.True(fi.Mode()&os.ModeSymlink != 0)
+		fi, err = os.Stat(filepath.Join(ctx.RootDir, "data/app"))
+		require.NoError(err)
+		require.True(fi.IsDir())
+	})
+}
+
 func TestWorkdirStepNilConfig(t *testing.T) {
 	require := require.New(t)
 
@@ -26,6 +26,7 @@ import (
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 
 	"github.com/pkg/errors"
@@ -34,6 +35,23 @@ import (
 const _cachePrefix = "makisu_builder_cache_"
 const _cacheEmptyEntry = "MAKISU_CACHE_EMPTY"
 
+// Options are the settings of a cache manager.
+type Options struct {
+	// PushWorkers is the number of cache layers that are pushed concurrently.
+	PushWorkers int
+	// ReadThrough makes the layers committed by earlier builds whose files are
+	// gone from the image store hits if the registry has their blob, in which
+	// case they are pulled instead of being built, and their entries are
+	// stored in the KV store without pushing them again.
+	ReadThrough bool
+}
+
+// DefaultOptions returns the options of cache managers without flags, which
+// push one layer at a time.
+func DefaultOptions() Options {
+	return Options{PushWorkers: 1}
+}
+
 // Manager is the interface through which we interact with the cacheID -> image layer mapping.
 type Manager interface {
 	PullCache(cacheID string) (*image.DigestPair, error)
@@ -68,10 +86,21 @@ type registryCacheManager struct {
 	imageStore     *storage.ImageStore
 	kvStore        keyvalue.Store
 	registryClient registry.Client
+	opts           Options
+
+	// localStore records the layers committed by builds before they are
+	// pushed, so that the following builds can reuse them if the push fails.
+	localStore keyvalue.Store
 
-	sync.Mutex
 	wg         sync.WaitGroup
 	pushErrors utils.MultiErrors
+
+	// pushSlots bounds the number of layers pushed concurrently.
+	pushSlots chan struct{}
+
+	// pending are the entries that haven't been written to the KV store yet.
+	pendingMu sync.Mutex
+	pending   map[string]string
 }
 
 var (
@@ -85,25 +114,49 @@ var (
 // By default the registry field is left blank.
 func New(
 	imageStore *storage.ImageStore, kvStore keyvalue.Store,
-	registryClient registry.Client) Manager {
+	registryClient registry.Client, opts Options) Manager {
 
 	if imageStore == nil || kvStore == nil {
 		log.Infof("No image store or KV store provided, using noop cache manager")
 		return noopCacheManager{}
 	}
+	workers := opts.PushWorkers
+	if workers < 1 {
+		workers = 1
+	}
 	return &registryCacheManager{
 		imageStore:     imageStore,
 		kvStore:        kvStore,
 		registryClient: registryClient,
+		opts:           opts,
+		pushSlots:      make(chan struct{}, workers),
+		pending:        make(map[string]string),
+	}
+}
+
+// NewWithLocalStore is like New, but also records the layers committed by the
+// build in localStore before pushing them, and reuses the layers recorded there
+// whose files are still intact in the image store, so that the steps of a build
+// whose push failed aren't executed again.
+func NewWithLocalStore(
+	imageStore *storage.ImageStore, kvStore, localStore keyvalue.Store,
+	registryClient registry.Client, opts Options) Manager {
+
+	manager := New(imageStore, kvStore, registryClient, opts)
+	if m, ok := manager.(*registryCacheManager); ok {
+		m.localStore = localStore
 	}
+	return manager
 }
 
 // PullCache tries to fetch the layer corresponding to the cache ID.
 // If the layer is not found, it returns ErrorLayerNotFound.
-// This function is blocking
+// This function is blocking, but safe to call concurrently, so that stages
+// pull their cache at the same time.
 func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPair, error) {
-	manager.Lock()
-	defer manager.Unlock()
+	if pair, ok := manager.pullLocalCache(cacheID); ok {
+		return pair, nil
+	}
 
 	var entry string
 	var err error
@@ -123,6 +176,15 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	}
 	log.Infof("Found mapping in cacheID KVStore: %s => %s", cacheID, entry)
 
+	return pullEntry(manager.imageStore, manager.registryClient, entry)
+}
+
+// pullEntry returns the layer of a cache entry, pulling it with registryClient
+// if it isn't in the image store yet. Empty entries return nil.
+func pullEntry(
+	imageStore *storage.ImageStore, registryClient registry.Client,
+	entry string) (*image.DigestPair, error) {
+
 	if entry == _cacheEmptyEntry {
 		return nil, nil
 	}
@@ -133,15 +195,15 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	}
 
 	// Check if layer is already on disk.
-	info, err := manager.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+	info, err := imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
 	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("stat layer %s: %s", entry, err)
 	} else if os.IsNotExist(err) {
-		if manager.registryClient == nil {
+		if registryClient == nil {
 			return nil, fmt.Errorf("registry client not configured to pull cache")
 		}
 		// Pull layer from docker registry.
-		info, err = manager.registryClient.PullLayer(gzipDigest)
+		info, err = registryClient.PullLayer(gzipDigest)
 		if err != nil {
 			return nil, fmt.Errorf("pull layer %s: %s", entry, err)
 		}
@@ -155,15 +217,107 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	return &image.DigestPair{
 		TarDigest: tarDigest,
 		GzipDescriptor: image.Descriptor{
-			MediaType: image.MediaTypeLayer,
+			MediaType: storedLayerMediaType(imageStore, tarDigest, gzipDigest),
 			Size:      size,
 			Digest:    gzipDigest,
 		},
 	}, nil
 }
 
-// PushCache tries to push an image layer asynchronously.
+// pullLocalCache returns the layer corresponding to the cache ID in the local
+// store, and whether it was found. Layers whose file is missing or doesn't
+// match its digest are not returned.
+func (manager *registryCacheManager) pullLocalCache(cacheID string) (*image.DigestPair, bool) {
+	if manager.localStore == nil {
+		return nil, false
+	}
+	entry, err := manager.localStore.Get(_cachePrefix + cacheID)
+	if err != nil {
+		log.Warnf("Failed to query local cache id %s: %s", cacheID, err)
+		return nil, false
+	} else if entry == "" {
+		return nil, false
+	} else if entry == _cacheEmptyEntry {
+		log.Infof("Found mapping in local committed layers: %s => %s", cacheID, entry)
+		return nil, true
+	}
+
+	tarDigest, gzipDigest, err := parseEntry(entry)
+	if err != nil {
+		log.Warnf("Ignoring invalid local cache entry %s: %s", cacheID, err)
+		return nil, false
+	}
+	info, err := manager.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+	if err != nil {
+		log.Infof("Layer %s of local cache id %s is gone: %s", gzipDigest.Hex(), cacheID, err)
+		return manager.pullRegistryLayer(cacheID, entry, gzipDigest)
+	}
+	reader, err := manager.imageStore.Layers.GetStoreFileReader(gzipDigest.Hex())
+	if err != nil {
+		log.Warnf("Failed to open layer %s of local cache id %s: %s", gzipDigest.Hex(), cacheID, err)
+		return nil, false
+	}
+	if ok, err := gzipDigest.Equals(reader); err != nil {
+		log.Warnf("Failed to verify layer %s of local cache id %s: %s", gzipDigest.Hex(), cacheID, err)
+		return nil, false
+	} else if !ok {
+		log.Warnf("Ignoring corrupted layer %s of local cache id %s", gzipDigest.Hex(), cacheID)
+		return nil, false
+	}
+	log.Infof("Found mapping in local committed layers: %s => %s", cacheID, entry)
+
+	return &image.DigestPair{
+		TarDigest: tarDigest,
+		GzipDescriptor: image.Descriptor{
+			MediaType: layerMediaType(tarDigest, gzipDigest),
+			Size:      info.Size(),
+			Digest:    gzipDigest,
+		},
+	}, true
+}
+
+// pullRegistryLayer pulls the layer of a local cache entry whose file is gone
+// if ReadThrough is set and the registry has its blob, and returns whether it
+// was. The entry is then stored with the pushed ones, as its layer doesn't need
+// to be pushed.
+func (manager *registryCacheManager) pullRegistryLayer(
+	cacheID, entry string, gzipDigest image.Digest) (*image.DigestPair, bool) {
+
+	if !manager.opts.ReadThrough || manager.registryClient == nil {
+		return nil, false
+	}
+	exists, err := manager.registryClient.LayerExists(gzipDigest)
+	if err != nil {
+		log.Warnf("Failed to check if registry has layer %s of local cache id %s: %s",
+			gzipDigest.Hex(), cacheID, err)
+		return nil, false
+	} else if !exists {
+		return nil, false
+	}
+	pair, err := pullEntry(manager.imageStore, manager.registryClient, entry)
+	if err != nil {
+		log.Warnf("Failed to pull layer %s of local cache id %s: %s", gzipDigest.Hex(), cacheID, err)
+		return nil, false
+	}
+	log.Infof("Found layer of local cache id in registry: %s => %s", cacheID, entry)
+
+	manager.pendingMu.Lock()
+	defer manager.pendingMu.Unlock()
+	manager.pending[cacheID] = entry
+	return pair, true
+}
+
+// PushCache tries to push an image layer asynchronously, PushWorkers of the
+// options at a time. The layer is recorded in the local store first, if any.
+// Its entry is written to the KV store once it's pushed, along with the entries
+// of the other layers pushed in the meantime.
 func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image.DigestPair) error {
+	if manager.localStore != nil {
+		entry := createEntry(digestPair)
+		if err := manager.localStore.Put(_cachePrefix+cacheID, entry); err != nil {
+			log.Warnf("Failed to record committed layer (%s,%s): %s", cacheID, entry, err)
+		}
+	}
 	if manager.registryClient == nil {
 		manager.pushErrors.Add(fmt.Errorf("registry client not configured to push cache"))
 		return nil
@@ -174,29 +328,29 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 	go func() {
 		defer manager.wg.Done()
 
-		manager.Lock()
-		defer manager.Unlock()
-
 		if digestPair != nil {
-			if err := manager.registryClient.PushLayer(digestPair.GzipDescriptor.Digest); err != nil {
+			manager.pushSlots <- struct{}{}
+			err := manager.registryClient.PushLayer(digestPair.GzipDescriptor.Digest)
+			<-manager.pushSlots
+			if err != nil {
 				manager.pushErrors.Add(fmt.Errorf("push layer %s: %s", digestPair.GzipDescriptor.Digest, err))
 				return
 			}
 		}
 
-		entry := createEntry(digestPair)
-		if err := manager.kvStore.Put(_cachePrefix+cacheID, entry); err != nil {
-			manager.pushErrors.Add(fmt.Errorf("store tag mapping (%s,%s): %s", cacheID, entry, err))
-			return
-		}
-
-		log.Infof("Stored cacheID mapping to KVStore: %s => %s", cacheID, entry)
+		// Only the entries of pushed layers are stored, so that no entry
+		// refers to a missing layer.
+		manager.pendingMu.Lock()
+		manager.pending[cacheID] = createEntry(digestPair)
+		manager.pendingMu.Unlock()
+		manager.storeEntries()
 	}()
 
 	return nil
 }
 
-// WaitForPush blocks until all cache pushes are done or timeout.
+// WaitForPush blocks until all cache pushes are done or timeout, and stores
+// the entries that are still pending.
 func (manager *registryCacheManager) WaitForPush() error {
 	c := make(chan struct{})
 	go func() {
@@ -205,12 +359,38 @@ func (manager *registryCacheManager) WaitForPush() error {
 	}()
 	select {
 	case <-c:
+		manager.storeEntries()
 		return manager.pushErrors.Collect()
 	case <-time.After(time.Minute * 10):
+		manager.storeEntries()
 		return fmt.Errorf("timeout waiting for push")
 	}
 }
 
+// storeEntries writes the pending entries to the KV store in a batch. The
+// entries added while a batch is written are written by the next call.
+func (manager *registryCacheManager) storeEntries() {
+	manager.pendingMu.Lock()
+	pending := manager.pending
+	manager.pending = make(map[string]string)
+	manager.pendingMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	entries := make(map[string]string, len(pending))
+	for cacheID, entry := range pending {
+		entries[_cachePrefix+cacheID] = entry
+	}
+	if err := keyvalue.PutBatch(manager.kvStore, entries); err != nil {
+		manager.pushErrors.Add(fmt.Errorf("store %d tag mappings: %s", len(entries), err))
+		return
+	}
+	for cacheID, entry := range pending {
+		log.Infof("Stored cacheID mapping to KVStore: %s => %s", cacheID, entry)
+	}
+}
+
 func parseEntry(entry string) (image.Digest, image.Digest, error) {
 	if strings.Index(entry, ",") == -1 {
 		return image.NewEmptyDigest(), image.NewEmptyDigest(), errors.Errorf("parse redis entry: %s", entry)
@@ -219,6 +399,36 @@ func parseEntry(entry string) (image.Digest, image.Digest, error) {
 	return image.Digest("sha256:" + split[0]), image.Digest("sha256:" + split[1]), nil
 }
 
+// layerMediaType returns the media type of a cached layer, which was stored
+// uncompressed if its digest is the one of its tar.
+func layerMediaType(tarDigest, layerDigest image.Digest) string {
+	if tarDigest == layerDigest {
+		return image.MediaTypeLayerUncompressed
+	}
+	return image.MediaTypeLayer
+}
+
+// storedLayerMediaType returns the media type of a layer in the store, which
+// can also be zstd compressed if the entry is from the inline cache of an image
+// whose layers were converted to zstd.
+func storedLayerMediaType(
+	imageStore *storage.ImageStore, tarDigest, layerDigest image.Digest) string {
+
+	mediaType := layerMediaType(tarDigest, layerDigest)
+	if mediaType != image.MediaTypeLayer {
+		return mediaType
+	}
+	r, err := imageStore.Layers.GetStoreFileReader(layerDigest.Hex())
+	if err != nil {
+		return mediaType
+	}
+	defer r.Close()
+	if zstd, err := tario.IsZstd(r); err == nil && zstd {
+		return image.MediaTypeOCILayerZstd
+	}
+	return mediaType
+}
+
 func createEntry(pair *image.DigestPair) string {
 	if pair == nil {
 		return _cacheEmptyEntry
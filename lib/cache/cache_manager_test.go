@@ -15,7 +15,13 @@
 package cache_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
@@ -24,6 +30,7 @@ import (
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
 )
 
 func TestNoopCache(t *testing.T) {
@@ -32,7 +39,7 @@ func TestNoopCache(t *testing.T) {
 	ctx, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	_, err := cacheMgr.PullCache("cacheid1")
 	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
@@ -56,7 +63,7 @@ func TestMemStore(t *testing.T) {
 	defer cleanup()
 
 	kvStore := keyvalue.MemStore{}
-	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture(), cache.DefaultOptions())
 
 	_, err := cacheMgr.PullCache("cacheid1")
 	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
@@ -75,3 +82,355 @@ func TestMemStore(t *testing.T) {
 	_, err = cacheMgr.PullCache("cacheid2")
 	require.NoError(err)
 }
+
+type countingClientFixture struct {
+	registry.Client
+	pulls int
+}
+
+func (c *countingClientFixture) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
+	c.pulls++
+	return c.Client.PullLayer(layerDigest)
+}
+
+func TestPullCacheReusesStoredDigests(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Store a layer locally, as a previous build would have.
+	content := []byte("layer content")
+	gzipDigest, err := image.NewDigester().FromBytes(content)
+	require.NoError(err)
+	layerPath := filepath.Join(ctx.ImageStore.SandboxDir, "layer")
+	require.NoError(ioutil.WriteFile(layerPath, content, 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(gzipDigest.Hex(), layerPath))
+
+	client := &countingClientFixture{Client: registry.NoopClientFixture()}
+	cacheMgr := cache.New(ctx.ImageStore, keyvalue.MemStore{}, client, cache.DefaultOptions())
+	pair := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar"),
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}
+	missing := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar2"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:missing")},
+	}
+	require.NoError(cacheMgr.PushCache("cacheid1", pair))
+	require.NoError(cacheMgr.PushCache("cacheid2", missing))
+	require.NoError(cacheMgr.WaitForPush())
+
+	// The stored digests and the size of the local blob are used as is.
+	result, err := cacheMgr.PullCache("cacheid1")
+	require.NoError(err)
+	require.Equal(pair.TarDigest, result.TarDigest)
+	require.Equal(gzipDigest, result.GzipDescriptor.Digest)
+	require.Equal(int64(len(content)), result.GzipDescriptor.Size)
+	require.Equal(0, client.pulls)
+
+	// Layers missing locally are pulled from the registry.
+	result, err = cacheMgr.PullCache("cacheid2")
+	require.NoError(err)
+	require.Equal(missing.TarDigest, result.TarDigest)
+	require.Equal(1, client.pulls)
+}
+
+type failingPushClientFixture struct {
+	registry.Client
+}
+
+func (failingPushClientFixture) PushLayer(layerDigest image.Digest) error {
+	return errors.New("connection reset")
+}
+
+func TestPullCacheResumesFailedPush(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	linkLayer := func(name string, content []byte, digest image.Digest) {
+		layerPath := filepath.Join(ctx.ImageStore.SandboxDir, name)
+		require.NoError(ioutil.WriteFile(layerPath, content, 0644))
+		require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), layerPath))
+	}
+	content := []byte("layer content")
+	gzipDigest, err := image.NewDigester().FromBytes(content)
+	require.NoError(err)
+	linkLayer("layer", content, gzipDigest)
+	// The file of this layer doesn't match its digest.
+	corruptedDigest, err := image.NewDigester().FromBytes([]byte("other content"))
+	require.NoError(err)
+	linkLayer("corrupted", content, corruptedDigest)
+
+	pair := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar"),
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}
+	corrupted := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar2"),
+		GzipDescriptor: image.Descriptor{Digest: corruptedDigest},
+	}
+	localStore := keyvalue.MemStore{}
+	client := failingPushClientFixture{registry.NoopClientFixture()}
+	cacheMgr := cache.NewWithLocalStore(ctx.ImageStore, keyvalue.MemStore{}, localStore, client, cache.DefaultOptions())
+	require.NoError(cacheMgr.PushCache("cacheid1", pair))
+	require.NoError(cacheMgr.PushCache("cacheid2", nil))
+	require.NoError(cacheMgr.PushCache("cacheid3", corrupted))
+	require.Error(cacheMgr.WaitForPush())
+
+	// The next build reuses the layers despite the failed push.
+	cacheMgr = cache.NewWithLocalStore(ctx.ImageStore, keyvalue.MemStore{}, localStore, client, cache.DefaultOptions())
+	result, err := cacheMgr.PullCache("cacheid1")
+	require.NoError(err)
+	require.Equal(pair.TarDigest, result.TarDigest)
+	require.Equal(gzipDigest, result.GzipDescriptor.Digest)
+	require.Equal(int64(len(content)), result.GzipDescriptor.Size)
+
+	result, err = cacheMgr.PullCache("cacheid2")
+	require.NoError(err)
+	require.Nil(result)
+
+	_, err = cacheMgr.PullCache("cacheid3")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+}
+
+// existingLayersClientFixture has the blobs of the given layers, which it
+// writes to the image store when they are pulled.
+type existingLayersClientFixture struct {
+	registry.Client
+	store  *storage.ImageStore
+	layers map[image.Digest][]byte
+	pulls  int
+}
+
+func (c *existingLayersClientFixture) LayerExists(layerDigest image.Digest) (bool, error) {
+	_, ok := c.layers[layerDigest]
+	return ok, nil
+}
+
+func (c *existingLayersClientFixture) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
+	c.pulls++
+	layerPath := filepath.Join(c.store.SandboxDir, "pulled")
+	if err := ioutil.WriteFile(layerPath, c.layers[layerDigest], 0644); err != nil {
+		return nil, err
+	}
+	if err := c.store.Layers.LinkStoreFileFrom(layerDigest.Hex(), layerPath); err != nil {
+		return nil, err
+	}
+	return c.store.Layers.GetStoreFileStat(layerDigest.Hex())
+}
+
+func TestPullCacheReadThrough(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	content := []byte("layer content")
+	published, err := image.NewDigester().FromBytes(content)
+	require.NoError(t, err)
+	unpublished, err := image.NewDigester().FromBytes([]byte("other content"))
+	require.NoError(t, err)
+
+	// An earlier build committed both layers, whose files were removed since.
+	localStore := keyvalue.MemStore{}
+	require.NoError(t, localStore.Put("makisu_builder_cache_cacheid1", published.Hex()+","+published.Hex()))
+	require.NoError(t, localStore.Put("makisu_builder_cache_cacheid2", unpublished.Hex()+","+unpublished.Hex()))
+
+	for _, readThrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("read through %v", readThrough), func(t *testing.T) {
+			require := require.New(t)
+			defer ctx.ImageStore.Layers.DeleteStoreFile(published.Hex())
+
+			kvStore := keyvalue.MemStore{}
+			client := &existingLayersClientFixture{
+				Client: registry.NoopClientFixture(),
+				store:  ctx.ImageStore,
+				layers: map[image.Digest][]byte{published: content},
+			}
+			opts := cache.DefaultOptions()
+			opts.ReadThrough = readThrough
+			cacheMgr := cache.NewWithLocalStore(ctx.ImageStore, kvStore, localStore, client, opts)
+
+			result, err := cacheMgr.PullCache("cacheid1")
+			if !readThrough {
+				require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+				require.Equal(0, client.pulls)
+				return
+			}
+			require.NoError(err)
+			require.Equal(published, result.GzipDescriptor.Digest)
+			require.Equal(int64(len(content)), result.GzipDescriptor.Size)
+			require.Equal(1, client.pulls)
+
+			// Layers the registry doesn't have are still misses.
+			_, err = cacheMgr.PullCache("cacheid2")
+			require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+
+			// The entry of the published layer is stored without pushing it.
+			require.NoError(cacheMgr.WaitForPush())
+			entry, err := kvStore.Get("makisu_builder_cache_cacheid1")
+			require.NoError(err)
+			require.Equal(published.Hex()+","+published.Hex(), entry)
+			entry, err = kvStore.Get("makisu_builder_cache_cacheid2")
+			require.NoError(err)
+			require.Empty(entry)
+		})
+	}
+}
+
+type blockingPushClientFixture struct {
+	registry.Client
+	fail    image.Digest
+	block   image.Digest
+	release chan struct{}
+}
+
+func (c blockingPushClientFixture) PushLayer(layerDigest image.Digest) error {
+	if layerDigest == c.block {
+		<-c.release
+	}
+	if layerDigest == c.fail {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+// batchStoreFixture sends the batches written to it to batches.
+type batchStoreFixture struct {
+	keyvalue.MemStore
+	batches chan map[string]string
+}
+
+func (s *batchStoreFixture) PutBatch(entries map[string]string) error {
+	for k, v := range entries {
+		s.MemStore.Put(k, v)
+	}
+	s.batches <- entries
+	return nil
+}
+
+func TestPushCacheBatchesEntries(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	pushed := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:pushed")},
+	}
+	failed := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar2"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:failed")},
+	}
+	slow := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar3"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:slow")},
+	}
+	kvStore := &batchStoreFixture{
+		MemStore: keyvalue.MemStore{},
+		batches:  make(chan map[string]string, 4),
+	}
+	client := blockingPushClientFixture{
+		Client:  registry.NoopClientFixture(),
+		fail:    failed.GzipDescriptor.Digest,
+		block:   slow.GzipDescriptor.Digest,
+		release: make(chan struct{}),
+	}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, client, cache.Options{PushWorkers: 2})
+	require.NoError(cacheMgr.PushCache("cacheid1", slow))
+	require.NoError(cacheMgr.PushCache("cacheid2", pushed))
+
+	// The entry of a pushed layer is stored without waiting for the others.
+	require.Equal(map[string]string{
+		"makisu_builder_cache_cacheid2": "tar,pushed",
+	}, <-kvStore.batches)
+
+	require.NoError(cacheMgr.PushCache("cacheid3", failed))
+	require.NoError(cacheMgr.PushCache("cacheid4", nil))
+	close(client.release)
+	require.Error(cacheMgr.WaitForPush())
+
+	// The entry of the layer that failed to push isn't stored.
+	close(kvStore.batches)
+	for range kvStore.batches {
+	}
+	require.Len(kvStore.MemStore, 3)
+	_, err := cacheMgr.PullCache("cacheid3")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+	result, err := cacheMgr.PullCache("cacheid4")
+	require.NoError(err)
+	require.Nil(result)
+}
+
+// blockingPullClientFixture blocks layer pulls until want of them are in
+// flight at the same time, or a timeout, and records the most pulls seen in
+// flight.
+type blockingPullClientFixture struct {
+	registry.Client
+
+	want    int
+	mu      sync.Mutex
+	active  int
+	max     int
+	arrived chan struct{}
+}
+
+func (c *blockingPullClientFixture) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
+	c.mu.Lock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	if c.active == c.want {
+		close(c.arrived)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.arrived:
+	case <-time.After(5 * time.Second):
+	}
+
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	return nil, nil
+}
+
+func TestPullCacheConcurrently(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	kvStore := keyvalue.MemStore{}
+	for i := 0; i < 3; i++ {
+		require.NoError(kvStore.Put(fmt.Sprintf("makisu_builder_cache_cacheid%d", i),
+			fmt.Sprintf("tar%d,layer%d", i, i)))
+	}
+	client := &blockingPullClientFixture{
+		Client:  registry.NoopClientFixture(),
+		want:    3,
+		arrived: make(chan struct{}),
+	}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, client, cache.DefaultOptions())
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = cacheMgr.PullCache(fmt.Sprintf("cacheid%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(err)
+	}
+
+	// The layers were pulled from the registry at the same time.
+	require.Equal(3, client.max)
+}
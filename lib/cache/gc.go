@@ -0,0 +1,140 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// GCResult lists what a garbage collection removed, or would remove in a dry
+// run.
+type GCResult struct {
+	// Entries are the cache IDs whose entries expired.
+	Entries []string
+	// Layers are the digest hexes of the local layers that were no longer
+	// referenced.
+	Layers []string
+	// Bytes is the size of the removed layers.
+	Bytes int64
+}
+
+// GC removes the entries of kvStores last updated more than ttl ago, then
+// removes the layers of the image store that are referenced neither by the
+// remaining cache entries nor by the manifests in the store. A zero ttl
+// keeps all entries. If dryRun is true, nothing is removed.
+// It must not run concurrently with builds using the same image store.
+func GC(
+	imageStore *storage.ImageStore, kvStores []keyvalue.Store,
+	ttl time.Duration, dryRun bool) (*GCResult, error) {
+
+	result := &GCResult{}
+	// Stores like MemStore can't be map keys, the expired keys are indexed
+	// like kvStores.
+	listers := make([]keyvalue.Lister, len(kvStores))
+	expired := make([][]string, len(kvStores))
+	expiredIDs := make(map[string]bool)
+	live := make(map[string]bool)
+	for i, kvStore := range kvStores {
+		lister, ok := kvStore.(keyvalue.Lister)
+		if !ok {
+			return nil, fmt.Errorf("cache id store does not support listing entries")
+		}
+		listers[i] = lister
+		entries, err := lister.List(_cachePrefix)
+		if err != nil {
+			return nil, fmt.Errorf("list cache entries: %s", err)
+		}
+
+		for key, entry := range entries {
+			if ttl > 0 && !entry.Updated.IsZero() && time.Since(entry.Updated) > ttl {
+				expired[i] = append(expired[i], key)
+				expiredIDs[key[len(_cachePrefix):]] = true
+				continue
+			}
+			if entry.Value == _cacheEmptyEntry {
+				continue
+			}
+			_, gzipDigest, err := parseEntry(entry.Value)
+			if err != nil {
+				log.Warnf("Ignoring invalid cache entry %s: %s", key, err)
+				continue
+			}
+			live[gzipDigest.Hex()] = true
+		}
+	}
+	for id := range expiredIDs {
+		result.Entries = append(result.Entries, id)
+	}
+	sort.Strings(result.Entries)
+
+	manifests, err := imageStore.Manifests.ReadStoreFiles()
+	if err != nil {
+		return nil, fmt.Errorf("read manifests: %s", err)
+	}
+	for _, content := range manifests {
+		var manifest image.DistributionManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			log.Warnf("Ignoring invalid manifest in store: %s", err)
+			continue
+		}
+		live[manifest.GetConfigDigest().Hex()] = true
+		for _, digest := range manifest.GetLayerDigests() {
+			live[digest.Hex()] = true
+		}
+	}
+
+	layers, err := imageStore.Layers.ListStoreFiles()
+	if err != nil {
+		return nil, fmt.Errorf("list layers: %s", err)
+	}
+	for _, layer := range layers {
+		if live[layer] {
+			continue
+		}
+		info, err := imageStore.Layers.GetStoreFileStat(layer)
+		if err != nil {
+			return nil, fmt.Errorf("stat layer %s: %s", layer, err)
+		}
+		result.Layers = append(result.Layers, layer)
+		result.Bytes += info.Size()
+	}
+	sort.Strings(result.Layers)
+
+	if dryRun {
+		return result, nil
+	}
+	for i, keys := range expired {
+		if len(keys) == 0 {
+			continue
+		}
+		if err := listers[i].Delete(keys...); err != nil {
+			return nil, fmt.Errorf("delete cache entries: %s", err)
+		}
+	}
+	for _, layer := range result.Layers {
+		if err := imageStore.Layers.DeleteStoreFile(layer); err != nil {
+			return nil, fmt.Errorf("delete layer %s: %s", layer, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,153 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils/testutil"
+)
+
+const (
+	liveLayer    = "1111111111111111111111111111111111111111111111111111111111111111"
+	expiredLayer = "2222222222222222222222222222222222222222222222222222222222222222"
+	orphanLayer  = "3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+func gcStoreFixture(t *testing.T) (*storage.ImageStore, keyvalue.Store, func()) {
+	require := require.New(t)
+	imageStore, cleanup := storage.StoreFixtureWithSampleImage()
+
+	for _, layer := range []string{liveLayer, expiredLayer, orphanLayer} {
+		require.NoError(imageStore.Layers.CreateDownloadFile(layer, 4))
+		require.NoError(imageStore.Layers.MoveDownloadFileToStore(layer))
+	}
+
+	now := time.Now()
+	entries := map[string]interface{}{
+		"makisu_builder_cache_live": map[string]interface{}{
+			"LayerSHA": "aaaa," + liveLayer, "Timestamp": now.Unix(),
+		},
+		"makisu_builder_cache_empty": map[string]interface{}{
+			"LayerSHA": "MAKISU_CACHE_EMPTY", "Timestamp": now.Unix(),
+		},
+		"makisu_builder_cache_expired": map[string]interface{}{
+			"LayerSHA": "bbbb," + expiredLayer, "Timestamp": now.Add(-2 * time.Hour).Unix(),
+		},
+	}
+	content, err := json.Marshal(entries)
+	require.NoError(err)
+	fullpath := filepath.Join(imageStore.RootDir, pathutils.CacheKeyValueFileName)
+	require.NoError(ioutil.WriteFile(fullpath, content, 0755))
+
+	kvStore, err := keyvalue.NewFSStore(fullpath, imageStore.SandboxDir, time.Hour)
+	require.NoError(err)
+	return imageStore, kvStore, cleanup
+}
+
+func TestGC(t *testing.T) {
+	t.Run("DryRun", func(t *testing.T) {
+		require := require.New(t)
+		imageStore, kvStore, cleanup := gcStoreFixture(t)
+		defer cleanup()
+
+		result, err := cache.GC(imageStore, []keyvalue.Store{kvStore}, time.Hour, true)
+		require.NoError(err)
+		require.Equal([]string{"expired"}, result.Entries)
+		require.Equal([]string{expiredLayer, orphanLayer}, result.Layers)
+		require.Equal(int64(8), result.Bytes)
+
+		for _, layer := range []string{liveLayer, expiredLayer, orphanLayer} {
+			_, err := imageStore.Layers.GetStoreFileStat(layer)
+			require.NoError(err)
+		}
+		entries, err := kvStore.(keyvalue.Lister).List("")
+		require.NoError(err)
+		require.Len(entries, 3)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		require := require.New(t)
+		imageStore, kvStore, cleanup := gcStoreFixture(t)
+		defer cleanup()
+
+		result, err := cache.GC(imageStore, []keyvalue.Store{kvStore}, time.Hour, false)
+		require.NoError(err)
+		require.Equal([]string{"expired"}, result.Entries)
+		require.Equal([]string{expiredLayer, orphanLayer}, result.Layers)
+
+		// Layers of live entries and of stored images are kept.
+		for _, layer := range []string{
+			liveLayer, testutil.SampleLayerTarDigest, testutil.SampleImageConfigDigest} {
+			_, err := imageStore.Layers.GetStoreFileStat(layer)
+			require.NoError(err)
+		}
+		for _, layer := range []string{expiredLayer, orphanLayer} {
+			_, err := imageStore.Layers.GetStoreFileStat(layer)
+			require.True(os.IsNotExist(err))
+		}
+		entries, err := kvStore.(keyvalue.Lister).List("")
+		require.NoError(err)
+		require.Len(entries, 2)
+		require.Contains(entries, "makisu_builder_cache_live")
+	})
+
+	t.Run("ZeroTTLKeepsEntries", func(t *testing.T) {
+		require := require.New(t)
+		imageStore, kvStore, cleanup := gcStoreFixture(t)
+		defer cleanup()
+
+		result, err := cache.GC(imageStore, []keyvalue.Store{kvStore}, 0, true)
+		require.NoError(err)
+		require.Empty(result.Entries)
+		require.Equal([]string{orphanLayer}, result.Layers)
+	})
+
+	t.Run("MultipleStores", func(t *testing.T) {
+		require := require.New(t)
+		imageStore, kvStore, cleanup := gcStoreFixture(t)
+		defer cleanup()
+
+		// The orphan layer is referenced by the other store.
+		other := keyvalue.MemStore{"makisu_builder_cache_other": "cccc," + orphanLayer}
+		result, err := cache.GC(imageStore, []keyvalue.Store{kvStore, other}, time.Hour, false)
+		require.NoError(err)
+		require.Equal([]string{"expired"}, result.Entries)
+		require.Equal([]string{expiredLayer}, result.Layers)
+		_, err = imageStore.Layers.GetStoreFileStat(orphanLayer)
+		require.NoError(err)
+	})
+
+	t.Run("UnsupportedStore", func(t *testing.T) {
+		require := require.New(t)
+		imageStore, cleanup := storage.StoreFixture()
+		defer cleanup()
+
+		kvStore, err := keyvalue.NewHTTPStore("localhost:0")
+		require.NoError(err)
+		_, err = cache.GC(imageStore, []keyvalue.Store{kvStore}, time.Hour, true)
+		require.Error(err)
+	})
+}
@@ -0,0 +1,111 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// InlineEntry returns the value recorded for the layer of a step in the inline
+// cache of an image config. A nil pair means the step didn't change the
+// filesystem.
+func InlineEntry(pair *image.DigestPair) string {
+	return createEntry(pair)
+}
+
+// InlineSource is the inline cache of an image, along with the client of the
+// repository its layers are pulled from.
+type InlineSource struct {
+	Entries        map[string]string
+	RegistryClient registry.Client
+}
+
+// PullInlineSource pulls the manifest and config of the image with the given
+// tag, and returns its inline cache.
+func PullInlineSource(
+	imageStore *storage.ImageStore, registryClient registry.Client,
+	tag string) (*InlineSource, error) {
+
+	manifest, err := registryClient.PullManifest(tag)
+	if err != nil {
+		return nil, fmt.Errorf("pull manifest: %s", err)
+	}
+	configDigest := manifest.Config.Digest
+	if _, err := registryClient.PullImageConfig(configDigest); err != nil {
+		return nil, fmt.Errorf("pull config: %s", err)
+	}
+	r, err := imageStore.Layers.GetStoreFileReader(configDigest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get config file reader %s: %s", configDigest.Hex(), err)
+	}
+	defer r.Close()
+	configBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read config file %s: %s", configDigest.Hex(), err)
+	}
+	config := new(image.Config)
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		return nil, fmt.Errorf("unmarshal config file %s: %s", configDigest.Hex(), err)
+	}
+	return &InlineSource{config.InlineCache, registryClient}, nil
+}
+
+// inlineCacheManager looks up cache IDs in the inline cache of images before
+// falling back to another Manager, which the cache layers are pushed to.
+type inlineCacheManager struct {
+	Manager
+
+	imageStore *storage.ImageStore
+	sources    []*InlineSource
+}
+
+// NewInlineCacheManager returns a Manager that looks up cache IDs in the
+// inline cache of the sources in order, pulling the layers found from their
+// repositories, and then in manager. Pushes go to manager only.
+func NewInlineCacheManager(
+	manager Manager, imageStore *storage.ImageStore, sources []*InlineSource) Manager {
+
+	return &inlineCacheManager{
+		Manager:    manager,
+		imageStore: imageStore,
+		sources:    sources,
+	}
+}
+
+// PullCache returns the layer of the first source whose inline cache has the
+// cache ID, and falls back to the wrapped manager otherwise.
+func (manager *inlineCacheManager) PullCache(cacheID string) (*image.DigestPair, error) {
+	for _, source := range manager.sources {
+		entry, ok := source.Entries[cacheID]
+		if !ok {
+			continue
+		}
+		pair, err := pullEntry(manager.imageStore, source.RegistryClient, entry)
+		if err != nil {
+			log.Warnf("Failed to pull inline cache entry %s => %s: %s", cacheID, entry, err)
+			continue
+		}
+		log.Infof("Found mapping in inline cache: %s => %s", cacheID, entry)
+		return pair, nil
+	}
+	return manager.Manager.PullCache(cacheID)
+}
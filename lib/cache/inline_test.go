@@ -0,0 +1,131 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/tario"
+)
+
+func TestInlineCacheManager(t *testing.T) {
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	pair := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:tar"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:gzip")},
+	}
+	other := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:othertar"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:othergzip")},
+	}
+
+	kvStore := keyvalue.MemStore{}
+	stored := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture(), cache.DefaultOptions())
+	require.NoError(t, stored.PushCache("stored", other))
+	require.NoError(t, stored.PushCache("both", other))
+	require.NoError(t, stored.WaitForPush())
+
+	cacheMgr := cache.NewInlineCacheManager(stored, ctx.ImageStore, []*cache.InlineSource{
+		{
+			Entries: map[string]string{
+				"inline": cache.InlineEntry(pair),
+				"empty":  cache.InlineEntry(nil),
+				"both":   cache.InlineEntry(pair),
+			},
+			RegistryClient: registry.NoopClientFixture(),
+		},
+		{
+			Entries:        map[string]string{"inline": cache.InlineEntry(other)},
+			RegistryClient: registry.NoopClientFixture(),
+		},
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		require := require.New(t)
+		for _, cacheID := range []string{"inline", "both"} {
+			result, err := cacheMgr.PullCache(cacheID)
+			require.NoError(err)
+			require.Equal(pair.TarDigest, result.TarDigest)
+			require.Equal(pair.GzipDescriptor.Digest, result.GzipDescriptor.Digest)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require := require.New(t)
+		result, err := cacheMgr.PullCache("empty")
+		require.NoError(err)
+		require.Nil(result)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		require := require.New(t)
+		result, err := cacheMgr.PullCache("stored")
+		require.NoError(err)
+		require.Equal(other.GzipDescriptor.Digest, result.GzipDescriptor.Digest)
+
+		_, err = cacheMgr.PullCache("missing")
+		require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		require := require.New(t)
+
+		var buf bytes.Buffer
+		w, err := tario.NewZstdWriter(&buf, tario.DefaultOptions())
+		require.NoError(err)
+		_, err = w.Write([]byte("tar"))
+		require.NoError(err)
+		require.NoError(w.Close())
+		digest, err := image.NewDigester().FromBytes(buf.Bytes())
+		require.NoError(err)
+		layerPath := filepath.Join(ctx.ImageStore.SandboxDir, "zstd")
+		require.NoError(ioutil.WriteFile(layerPath, buf.Bytes(), 0644))
+		require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), layerPath))
+
+		zstdPair := &image.DigestPair{
+			TarDigest:      image.Digest("sha256:zstdtar"),
+			GzipDescriptor: image.Descriptor{Digest: digest},
+		}
+		zstdMgr := cache.NewInlineCacheManager(stored, ctx.ImageStore, []*cache.InlineSource{{
+			Entries:        map[string]string{"zstd": cache.InlineEntry(zstdPair)},
+			RegistryClient: registry.NoopClientFixture(),
+		}})
+		result, err := zstdMgr.PullCache("zstd")
+		require.NoError(err)
+		require.Equal(image.MediaTypeOCILayerZstd, result.GzipDescriptor.MediaType)
+		require.Equal(int64(buf.Len()), result.GzipDescriptor.Size)
+	})
+
+	t.Run("push", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(cacheMgr.PushCache("pushed", pair))
+		require.NoError(cacheMgr.WaitForPush())
+		result, err := stored.PullCache("pushed")
+		require.NoError(err)
+		require.Equal(pair.GzipDescriptor.Digest, result.GzipDescriptor.Digest)
+	})
+}
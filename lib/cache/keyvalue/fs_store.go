@@ -19,10 +19,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/uber/makisu/lib/fileio"
 )
 
+// fsStoreLockTimeout is the maximum time spent waiting for other processes
+// writing to the same cache id file.
+const fsStoreLockTimeout = time.Minute
+
 type cacheEntry struct {
 	LayerSHA  string
 	Timestamp int64
@@ -92,6 +100,15 @@ func (s *fsStore) Put(key, value string) error {
 	s.Lock()
 	defer s.Unlock()
 
+	// Other processes could be sharing the same file, hold the file lock while
+	// merging their entries with ours to avoid losing their updates.
+	lock := fileio.NewFileLock(s.fullpath + ".lock")
+	if err := lock.Lock(fsStoreLockTimeout); err != nil {
+		return fmt.Errorf("lock cache id file: %s", err)
+	}
+	defer lock.Unlock()
+	s.mergeFromFile()
+
 	entry := &cacheEntry{
 		LayerSHA:  value,
 		Timestamp: time.Now().Unix(),
@@ -99,16 +116,23 @@ func (s *fsStore) Put(key, value string) error {
 
 	s.entries[key] = entry
 
+	return s.writeFile()
+}
+
+// writeFile atomically replaces the cache id file with the entries.
+func (s *fsStore) writeFile() error {
 	content, err := json.Marshal(s.entries)
 	if err != nil {
 		return fmt.Errorf("marshal cache id file: %s", err)
 	}
 
-	tempFile, err := ioutil.TempFile(s.sandboxDir, "cache")
+	// Temp file is created next to the cache id file so it can be renamed.
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.fullpath), "cache")
 	if err != nil {
 		return fmt.Errorf("create temp cache id file: %s", err)
 	}
 	defer os.Remove(tempFile.Name())
+	tempFile.Close()
 
 	if err := ioutil.WriteFile(tempFile.Name(), content, 0755); err != nil {
 		return fmt.Errorf("write to temp cache id file: %s", err)
@@ -120,6 +144,27 @@ func (s *fsStore) Put(key, value string) error {
 	return nil
 }
 
+// mergeFromFile adds the entries written to the file by other processes
+// since it was loaded, keeping the most recent entry for each key.
+func (s *fsStore) mergeFromFile() {
+	contents, err := ioutil.ReadFile(s.fullpath)
+	if err != nil {
+		return
+	}
+	entries := make(map[string]*cacheEntry)
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return
+	}
+	for key, entry := range entries {
+		if time.Since(time.Unix(entry.Timestamp, 0)) > s.ttl {
+			continue
+		}
+		if current, ok := s.entries[key]; !ok || current.Timestamp < entry.Timestamp {
+			s.entries[key] = entry
+		}
+	}
+}
+
 func (s *fsStore) Cleanup() error {
 	s.Lock()
 	defer s.Unlock()
@@ -132,3 +177,50 @@ func (s *fsStore) Cleanup() error {
 
 	return nil
 }
+
+// List returns the entries of the cache id file whose key starts with prefix,
+// including the ones that expired.
+func (s *fsStore) List(prefix string) (map[string]Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entries := make(map[string]*cacheEntry)
+	contents, err := ioutil.ReadFile(s.fullpath)
+	if os.IsNotExist(err) {
+		return map[string]Entry{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read cache id file: %s", err)
+	}
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, fmt.Errorf("unmarshal cache id file: %s", err)
+	}
+
+	result := make(map[string]Entry)
+	for key, entry := range entries {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = Entry{
+				Value:   entry.LayerSHA,
+				Updated: time.Unix(entry.Timestamp, 0),
+			}
+		}
+	}
+	return result, nil
+}
+
+// Delete removes keys from the cache id file.
+func (s *fsStore) Delete(keys ...string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	lock := fileio.NewFileLock(s.fullpath + ".lock")
+	if err := lock.Lock(fsStoreLockTimeout); err != nil {
+		return fmt.Errorf("lock cache id file: %s", err)
+	}
+	defer lock.Unlock()
+	s.mergeFromFile()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return s.writeFile()
+}
@@ -65,4 +65,68 @@ func TestFSStore(t *testing.T) {
 		require.NoError(err)
 		require.Equal("b", value)
 	})
+	t.Run("concurrent_stores", func(t *testing.T) {
+		require := require.New(t)
+
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		require.NoError(err)
+		defer os.RemoveAll(tempDir)
+		tempFile, err := ioutil.TempFile(tempDir, "cache")
+		require.NoError(err)
+
+		d, err := time.ParseDuration("10s")
+		require.NoError(err)
+		store1, err := NewFSStore(tempFile.Name(), tempDir, d)
+		require.NoError(err)
+		store2, err := NewFSStore(tempFile.Name(), tempDir, d)
+		require.NoError(err)
+
+		require.NoError(store1.Put("a", "b"))
+		require.NoError(store2.Put("c", "d"))
+
+		store3, err := NewFSStore(tempFile.Name(), tempDir, d)
+		require.NoError(err)
+		defer store3.Cleanup()
+		value, err := store3.Get("a")
+		require.NoError(err)
+		require.Equal("b", value)
+		value, err = store3.Get("c")
+		require.NoError(err)
+		require.Equal("d", value)
+	})
+
+	t.Run("list_then_delete", func(t *testing.T) {
+		require := require.New(t)
+
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		require.NoError(err)
+		defer os.RemoveAll(tempDir)
+		tempFile, err := ioutil.TempFile(tempDir, "cache")
+		require.NoError(err)
+
+		store, err := NewFSStore(tempFile.Name(), tempDir, time.Hour)
+		require.NoError(err)
+		defer store.Cleanup()
+
+		require.NoError(store.Put("prefix_a", "1"))
+		require.NoError(store.Put("prefix_b", "2"))
+		require.NoError(store.Put("other", "3"))
+
+		lister := store.(Lister)
+		entries, err := lister.List("prefix_")
+		require.NoError(err)
+		require.Len(entries, 2)
+		require.Equal("1", entries["prefix_a"].Value)
+		require.WithinDuration(time.Now(), entries["prefix_a"].Updated, time.Minute)
+
+		require.NoError(lister.Delete("prefix_a"))
+		store, err = NewFSStore(tempFile.Name(), tempDir, time.Hour)
+		require.NoError(err)
+		loc, err := store.Get("prefix_a")
+		require.NoError(err)
+		require.Equal("", loc)
+		loc, err = store.Get("prefix_b")
+		require.NoError(err)
+		require.Equal("2", loc)
+	})
 }
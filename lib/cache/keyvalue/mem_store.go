@@ -14,20 +14,57 @@
 
 package keyvalue
 
+import (
+	"strings"
+	"sync"
+)
+
+// memStoreMu guards the maps of all MemStores, which cache managers read and
+// write concurrently.
+var memStoreMu sync.RWMutex
+
 // MemStore implements Client interface. It stores cache key-value mappings
-// in memory.
+// in memory, and is safe for concurrent use.
 type MemStore map[string]string
 
 // Get returns the value of a key previously set in memory.
 func (m MemStore) Get(key string) (string, error) {
+	memStoreMu.RLock()
+	defer memStoreMu.RUnlock()
 	return m[key], nil
 }
 
 // Put stores a key and its value in memory.
 func (m MemStore) Put(key, value string) error {
+	memStoreMu.Lock()
+	defer memStoreMu.Unlock()
 	m[key] = value
 	return nil
 }
 
 // Cleanup does nothing, but is implemented to comply with Client interface.
 func (m MemStore) Cleanup() error { return nil }
+
+// List returns the entries whose key starts with prefix. Their update time is
+// unknown.
+func (m MemStore) List(prefix string) (map[string]Entry, error) {
+	memStoreMu.RLock()
+	defer memStoreMu.RUnlock()
+	entries := make(map[string]Entry)
+	for k, v := range m {
+		if strings.HasPrefix(k, prefix) {
+			entries[k] = Entry{Value: v}
+		}
+	}
+	return entries, nil
+}
+
+// Delete removes keys from memory.
+func (m MemStore) Delete(keys ...string) error {
+	memStoreMu.Lock()
+	defer memStoreMu.Unlock()
+	for _, k := range keys {
+		delete(m, k)
+	}
+	return nil
+}
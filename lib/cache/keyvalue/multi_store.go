@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// multiStore writes entries to all of its stores, and reads them from the
+// first store that has them. Stores that fail are skipped, so that one of
+// them being down doesn't fail the build.
+type multiStore struct {
+	stores []NamedStore
+}
+
+// NamedStore is a store of a multi store, and the name identifying it in logs
+// and errors.
+type NamedStore struct {
+	Name string
+	Store
+}
+
+// NewMultiStore returns a Store combining the stores, e.g. to migrate the
+// cache from one store to another without losing its entries. Reads look up
+// the stores in order.
+func NewMultiStore(stores ...NamedStore) Store {
+	return &multiStore{stores}
+}
+
+// Get returns the value of the first store that has the key, skipping the
+// stores that fail. It only fails if all of them did.
+func (s *multiStore) Get(key string) (string, error) {
+	multiError := utils.NewMultiErrors()
+	failed := 0
+	for _, store := range s.stores {
+		v, err := store.Get(key)
+		if err != nil {
+			log.Warnf("Failed to get %s from cache store %s: %s", key, store.Name, err)
+			multiError.Add(fmt.Errorf("%s: %w", store.Name, err))
+			failed++
+			continue
+		} else if v != "" {
+			return v, nil
+		}
+	}
+	if failed > 0 && failed == len(s.stores) {
+		return "", multiError.Collect()
+	}
+	return "", nil
+}
+
+// Put writes the entry to all of the stores. It only fails if all of them did.
+func (s *multiStore) Put(key, value string) error {
+	return s.each(func(store Store) error { return store.Put(key, value) })
+}
+
+// PutBatch writes the entries to all of the stores, in a single round trip to
+// the ones that support it. It only fails if all of them did.
+func (s *multiStore) PutBatch(entries map[string]string) error {
+	return s.each(func(store Store) error { return PutBatch(store, entries) })
+}
+
+// Cleanup cleans up all of the stores.
+func (s *multiStore) Cleanup() error {
+	multiError := utils.NewMultiErrors()
+	for _, store := range s.stores {
+		if err := store.Cleanup(); err != nil {
+			multiError.Add(fmt.Errorf("%s: %w", store.Name, err))
+		}
+	}
+	return multiError.Collect()
+}
+
+// each calls f with every store, and returns an error if all of them failed.
+func (s *multiStore) each(f func(Store) error) error {
+	multiError := utils.NewMultiErrors()
+	failed := 0
+	for _, store := range s.stores {
+		if err := f(store.Store); err != nil {
+			log.Warnf("Failed to write to cache store %s: %s", store.Name, err)
+			multiError.Add(fmt.Errorf("%s: %w", store.Name, err))
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(s.stores) {
+		return multiError.Collect()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore fails all of its requests.
+type failingStore struct{}
+
+func (failingStore) Get(string) (string, error) { return "", errors.New("down") }
+func (failingStore) Put(string, string) error   { return errors.New("down") }
+func (failingStore) Cleanup() error             { return nil }
+
+func TestMultiStore(t *testing.T) {
+	t.Run("reads in order", func(t *testing.T) {
+		require := require.New(t)
+
+		first := MemStore{"k1": "first"}
+		second := MemStore{"k1": "second", "k2": "second"}
+		store := NewMultiStore(NamedStore{"first", first}, NamedStore{"second", second})
+
+		v, err := store.Get("k1")
+		require.NoError(err)
+		require.Equal("first", v)
+		v, err = store.Get("k2")
+		require.NoError(err)
+		require.Equal("second", v)
+		v, err = store.Get("k3")
+		require.NoError(err)
+		require.Equal("", v)
+	})
+
+	t.Run("writes to all", func(t *testing.T) {
+		require := require.New(t)
+
+		first := MemStore{}
+		second := MemStore{}
+		store := NewMultiStore(NamedStore{"first", first}, NamedStore{"second", second})
+
+		require.NoError(store.Put("k1", "v1"))
+		require.NoError(PutBatch(store, map[string]string{"k2": "v2", "k3": "v3"}))
+		expected := MemStore{"k1": "v1", "k2": "v2", "k3": "v3"}
+		require.Equal(expected, first)
+		require.Equal(expected, second)
+	})
+
+	t.Run("tolerates a failing store", func(t *testing.T) {
+		require := require.New(t)
+
+		mem := MemStore{"k1": "v1"}
+		store := NewMultiStore(NamedStore{"down", failingStore{}}, NamedStore{"mem", mem})
+
+		v, err := store.Get("k1")
+		require.NoError(err)
+		require.Equal("v1", v)
+		v, err = store.Get("k2")
+		require.NoError(err)
+		require.Equal("", v)
+		require.NoError(store.Put("k2", "v2"))
+		require.Equal("v2", mem["k2"])
+	})
+
+	t.Run("fails if all stores fail", func(t *testing.T) {
+		require := require.New(t)
+
+		store := NewMultiStore(NamedStore{"down1", failingStore{}}, NamedStore{"down2", failingStore{}})
+
+		_, err := store.Get("k1")
+		require.Error(err)
+		require.Contains(err.Error(), "down1")
+		require.Contains(err.Error(), "down2")
+		require.Error(store.Put("k1", "v1"))
+	})
+}
@@ -70,4 +70,62 @@ func (store *redisStore) Put(key, value string) error {
 	return nil
 }
 
+// PutBatch sets the keys in a single pipeline.
+func (store *redisStore) PutBatch(entries map[string]string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := store.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for k, v := range entries {
+			pipe.Set(k, v, store.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis set keys: %s", err)
+	}
+	return nil
+}
+
 func (store *redisStore) Cleanup() error { return nil }
+
+// List scans the keys starting with prefix. Since redis only knows the
+// remaining TTL of keys, their update time is inferred from the TTL of the
+// store, and left zero for keys without expiration.
+func (store *redisStore) List(prefix string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	iter := store.cli.Scan(0, prefix+"*", 0).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		v, err := store.cli.Get(key).Result()
+		if err == redis.Nil {
+			// Expired since the scan.
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("redis get key: %s", err)
+		}
+		entry := Entry{Value: v}
+		remaining, err := store.cli.TTL(key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis get ttl: %s", err)
+		}
+		if remaining > 0 && store.ttl > 0 {
+			entry.Updated = time.Now().Add(remaining - store.ttl)
+		}
+		entries[key] = entry
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("redis scan keys: %s", err)
+	}
+	return entries, nil
+}
+
+func (store *redisStore) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, err := store.cli.Del(keys...).Result(); err != nil {
+		return fmt.Errorf("redis delete keys: %s", err)
+	}
+	return nil
+}
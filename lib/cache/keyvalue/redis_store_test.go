@@ -58,4 +58,56 @@ func TestRedisStore(t *testing.T) {
 		require.NoError(err)
 		require.Equal("b", loc)
 	})
+
+	t.Run("put_batch", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+
+		store, err := NewRedisStore(s.Addr(), time.Hour)
+		require.NoError(err)
+
+		require.NoError(PutBatch(store, map[string]string{"a": "1", "b": "2"}))
+		for k, v := range map[string]string{"a": "1", "b": "2"} {
+			loc, err := store.Get(k)
+			require.NoError(err)
+			require.Equal(v, loc)
+		}
+		require.Equal(time.Hour, s.TTL("a"))
+	})
+
+	t.Run("list_then_delete", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+
+		store, err := NewRedisStore(s.Addr(), time.Hour)
+		require.NoError(err)
+
+		require.NoError(store.Put("prefix_a", "1"))
+		require.NoError(store.Put("prefix_b", "2"))
+		require.NoError(store.Put("other", "3"))
+		s.FastForward(10 * time.Minute)
+
+		lister := store.(Lister)
+		entries, err := lister.List("prefix_")
+		require.NoError(err)
+		require.Len(entries, 2)
+		require.Equal("1", entries["prefix_a"].Value)
+		require.InDelta(
+			float64(10*time.Minute), float64(time.Since(entries["prefix_a"].Updated)),
+			float64(time.Minute))
+
+		require.NoError(lister.Delete("prefix_a"))
+		loc, err := store.Get("prefix_a")
+		require.NoError(err)
+		require.Equal("", loc)
+		loc, err = store.Get("other")
+		require.NoError(err)
+		require.Equal("3", loc)
+	})
 }
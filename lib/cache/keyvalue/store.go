@@ -14,6 +14,8 @@
 
 package keyvalue
 
+import "time"
+
 // Store is the interface that the CacheManager relies on to find the mapping
 // between cacheID and layer name.
 // The Get function returns an empty string and no error if the key was not
@@ -24,3 +26,38 @@ type Store interface {
 	Put(string, string) error
 	Cleanup() error
 }
+
+// Batcher is implemented by stores that can write several entries in a
+// single round trip.
+type Batcher interface {
+	PutBatch(entries map[string]string) error
+}
+
+// PutBatch writes the entries to the store, in a single round trip if it is a
+// Batcher, and one at a time otherwise.
+func PutBatch(store Store, entries map[string]string) error {
+	if batcher, ok := store.(Batcher); ok {
+		return batcher.PutBatch(entries)
+	}
+	for k, v := range entries {
+		if err := store.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entry is an entry of a store, as returned by Lister.
+// Updated is the time the entry was last written, or zero if the store does
+// not know it.
+type Entry struct {
+	Value   string
+	Updated time.Time
+}
+
+// Lister is implemented by stores whose entries can be listed and deleted,
+// which is needed to garbage collect them.
+type Lister interface {
+	List(prefix string) (map[string]Entry, error)
+	Delete(keys ...string) error
+}
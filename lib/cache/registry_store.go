@@ -0,0 +1,112 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+)
+
+const (
+	// CacheArtifactType is the artifact type of the manifests that store cache
+	// entries in a registry.
+	CacheArtifactType = "application/vnd.uber.makisu.cache.v1+json"
+
+	// _cacheEntryAnnotation is the manifest annotation holding the entry.
+	_cacheEntryAnnotation = "com.github.uber.makisu.cache.entry"
+)
+
+// artifactClient pushes and pulls OCI artifacts.
+type artifactClient interface {
+	PushArtifact(tag, artifactType string, layers []image.Descriptor,
+		annotations map[string]string) (image.Digest, error)
+	PullArtifact(tag string) (*image.DistributionManifest, error)
+	EmptyDescriptor() (image.Descriptor, error)
+}
+
+// registryStore is a keyvalue.Store that keeps cache entries in a registry
+// repository, as OCI artifacts tagged with their keys. The artifacts reference
+// the layers of their entries, so that the registry does not garbage collect
+// them while the entries exist.
+type registryStore struct {
+	imageStore *storage.ImageStore
+	client     artifactClient
+}
+
+// NewRegistryStore returns a keyvalue.Store that writes entries to the
+// repository of the client. The layers of the entries must be pushed to the
+// same repository before they are written.
+func NewRegistryStore(
+	imageStore *storage.ImageStore, client *registry.DockerRegistryClient) keyvalue.Store {
+
+	return &registryStore{imageStore, client}
+}
+
+// Get returns the entry of the artifact tagged with key, or an empty string if
+// there is none.
+func (s *registryStore) Get(key string) (string, error) {
+	manifest, err := s.client.PullArtifact(key)
+	if errors.Is(err, registry.ErrNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("pull cache artifact %s: %s", key, err)
+	}
+	if manifest.ArtifactType != CacheArtifactType {
+		return "", fmt.Errorf("tag %s is not a cache artifact: artifact type %q",
+			key, manifest.ArtifactType)
+	}
+	return manifest.Annotations[_cacheEntryAnnotation], nil
+}
+
+// Put pushes an artifact holding the entry, tagged with key.
+func (s *registryStore) Put(key, value string) error {
+	var layer image.Descriptor
+	if value == _cacheEmptyEntry {
+		var err error
+		if layer, err = s.client.EmptyDescriptor(); err != nil {
+			return fmt.Errorf("save empty blob: %s", err)
+		}
+	} else {
+		tarDigest, gzipDigest, err := parseEntry(value)
+		if err != nil {
+			return err
+		}
+		info, err := s.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+		if err != nil {
+			return fmt.Errorf("stat layer %s: %s", gzipDigest, err)
+		}
+		layer = image.Descriptor{
+			MediaType: layerMediaType(tarDigest, gzipDigest),
+			Size:      info.Size(),
+			Digest:    gzipDigest,
+		}
+	}
+	annotations := map[string]string{_cacheEntryAnnotation: value}
+	if _, err := s.client.PushArtifact(
+		key, CacheArtifactType, []image.Descriptor{layer}, annotations); err != nil {
+		return fmt.Errorf("push cache artifact %s: %s", key, err)
+	}
+	return nil
+}
+
+// Cleanup does nothing, as there is no connection to close.
+func (s *registryStore) Cleanup() error {
+	return nil
+}
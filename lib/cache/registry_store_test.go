@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// artifactClientFixture keeps pushed artifacts in memory.
+type artifactClientFixture struct {
+	artifacts map[string]*image.DistributionManifest
+}
+
+func (c *artifactClientFixture) PushArtifact(
+	tag, artifactType string, layers []image.Descriptor,
+	annotations map[string]string) (image.Digest, error) {
+
+	c.artifacts[tag] = &image.DistributionManifest{
+		ArtifactType: artifactType,
+		Layers:       layers,
+		Annotations:  annotations,
+	}
+	return image.Digest("sha256:" + tag), nil
+}
+
+func (c *artifactClientFixture) PullArtifact(tag string) (*image.DistributionManifest, error) {
+	manifest, ok := c.artifacts[tag]
+	if !ok {
+		return nil, &registry.Error{Kind: registry.ErrNotFound, Err: registry.ErrNotFound}
+	}
+	return manifest, nil
+}
+
+func (c *artifactClientFixture) EmptyDescriptor() (image.Descriptor, error) {
+	return image.Descriptor{MediaType: image.MediaTypeOCIEmpty, Size: 2}, nil
+}
+
+func TestRegistryStore(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	client := &artifactClientFixture{make(map[string]*image.DistributionManifest)}
+	store := &registryStore{ctx.ImageStore, client}
+
+	value, err := store.Get("key1")
+	require.NoError(err)
+	require.Equal("", value)
+
+	entry := "tar," + testutil.SampleLayerTarDigest
+	require.NoError(store.Put("key1", entry))
+	value, err = store.Get("key1")
+	require.NoError(err)
+	require.Equal(entry, value)
+
+	layers := client.artifacts["key1"].Layers
+	require.Len(layers, 1)
+	require.Equal(image.Digest("sha256:"+testutil.SampleLayerTarDigest), layers[0].Digest)
+	require.NotZero(layers[0].Size)
+
+	require.NoError(store.Put("key2", _cacheEmptyEntry))
+	value, err = store.Get("key2")
+	require.NoError(err)
+	require.Equal(_cacheEmptyEntry, value)
+	require.Equal(image.MediaTypeOCIEmpty, client.artifacts["key2"].Layers[0].MediaType)
+
+	require.Error(store.Put("key3", "tar,missing"))
+
+	client.artifacts["key4"] = &image.DistributionManifest{ArtifactType: "other"}
+	_, err = store.Get("key4")
+	require.Error(err)
+}
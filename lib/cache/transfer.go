@@ -0,0 +1,266 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+const (
+	// _exportEntriesFileName is the first file of cache exports, mapping cache
+	// IDs to entries.
+	_exportEntriesFileName = "entries.json"
+	// _exportLayersDir holds the layers of cache exports, named by the hex of
+	// their gzip digest.
+	_exportLayersDir = "layers"
+)
+
+// TransferResult lists what was exported or imported.
+type TransferResult struct {
+	// Entries are the transferred cache IDs.
+	Entries []string
+	// Layers are the digest hexes of the transferred layers.
+	Layers []string
+	// Bytes is the size of the transferred layers.
+	Bytes int64
+}
+
+// Export writes the entries of kvStore and the layers of the image store they
+// reference to w as a tar, which Import reads. Entries referencing layers that
+// are not in the image store are skipped, as they couldn't be used without
+// access to the registry.
+func Export(
+	imageStore *storage.ImageStore, kvStore keyvalue.Store, w io.Writer) (*TransferResult, error) {
+
+	lister, ok := kvStore.(keyvalue.Lister)
+	if !ok {
+		return nil, fmt.Errorf("cache id store does not support listing entries")
+	}
+	entries, err := lister.List(_cachePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list cache entries: %s", err)
+	}
+
+	result := &TransferResult{}
+	exported := make(map[string]string)
+	layers := make(map[string]bool)
+	for key, entry := range entries {
+		cacheID := strings.TrimPrefix(key, _cachePrefix)
+		if entry.Value != _cacheEmptyEntry {
+			_, gzipDigest, err := parseEntry(entry.Value)
+			if err != nil {
+				log.Warnf("Skipping invalid cache entry %s: %s", cacheID, err)
+				continue
+			}
+			if _, err := imageStore.Layers.GetStoreFileStat(gzipDigest.Hex()); os.IsNotExist(err) {
+				log.Warnf("Skipping cache entry %s, layer %s is not in the storage dir",
+					cacheID, gzipDigest.Hex())
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("stat layer %s: %s", gzipDigest.Hex(), err)
+			}
+			layers[gzipDigest.Hex()] = true
+		}
+		exported[cacheID] = entry.Value
+		result.Entries = append(result.Entries, cacheID)
+	}
+	sort.Strings(result.Entries)
+	for layer := range layers {
+		result.Layers = append(result.Layers, layer)
+	}
+	sort.Strings(result.Layers)
+
+	tw := tar.NewWriter(w)
+	content, err := json.Marshal(exported)
+	if err != nil {
+		return nil, fmt.Errorf("marshal entries: %s", err)
+	}
+	if err := writeExportFile(tw, _exportEntriesFileName, int64(len(content)),
+		bytes.NewReader(content)); err != nil {
+
+		return nil, err
+	}
+	for _, layer := range result.Layers {
+		size, err := exportLayer(imageStore, tw, layer)
+		if err != nil {
+			return nil, fmt.Errorf("export layer %s: %s", layer, err)
+		}
+		result.Bytes += size
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("close tar: %s", err)
+	}
+	return result, nil
+}
+
+func exportLayer(imageStore *storage.ImageStore, tw *tar.Writer, layer string) (int64, error) {
+	info, err := imageStore.Layers.GetStoreFileStat(layer)
+	if err != nil {
+		return 0, fmt.Errorf("stat layer: %s", err)
+	}
+	r, err := imageStore.Layers.GetStoreFileReader(layer)
+	if err != nil {
+		return 0, fmt.Errorf("open layer: %s", err)
+	}
+	defer r.Close()
+	return info.Size(), writeExportFile(tw, path.Join(_exportLayersDir, layer), info.Size(), r)
+}
+
+func writeExportFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("write header of %s: %s", name, err)
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("write %s: %s", name, err)
+	}
+	return nil
+}
+
+// Import reads a tar written by Export, adds its layers to the image store and
+// its entries to kvStore. The gzip and tar digests of each layer are verified
+// against its name and the entries referencing it, and the import fails
+// before any entry is added if one doesn't match, or if an entry references a
+// layer that is neither in the tar nor in the image store.
+func Import(
+	imageStore *storage.ImageStore, kvStore keyvalue.Store, r io.Reader) (*TransferResult, error) {
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read tar: %s", err)
+	} else if header.Name != _exportEntriesFileName {
+		return nil, fmt.Errorf("%s is not the first file of the tar", _exportEntriesFileName)
+	}
+	var entries map[string]string
+	if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decode entries: %s", err)
+	}
+
+	// Tar digests of the layers, as given by the entries referencing them.
+	tarDigests := make(map[string]image.Digest)
+	for cacheID, entry := range entries {
+		if entry == _cacheEmptyEntry {
+			continue
+		}
+		tarDigest, gzipDigest, err := parseEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache entry %s: %s", cacheID, err)
+		} else if prev, ok := tarDigests[gzipDigest.Hex()]; ok && prev != tarDigest {
+			return nil, fmt.Errorf("cache entries of layer %s have different tar digests", gzipDigest.Hex())
+		}
+		tarDigests[gzipDigest.Hex()] = tarDigest
+	}
+
+	result := &TransferResult{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read tar: %s", err)
+		}
+		dir, layer := path.Split(path.Clean(header.Name))
+		if header.Typeflag != tar.TypeReg || path.Clean(dir) != _exportLayersDir {
+			return nil, fmt.Errorf("unexpected file %s in tar", header.Name)
+		}
+		tarDigest, ok := tarDigests[layer]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is not referenced by any entry", layer)
+		}
+		if err := importLayer(imageStore, tr, layer, tarDigest); err != nil {
+			return nil, fmt.Errorf("import layer %s: %s", layer, err)
+		}
+		result.Layers = append(result.Layers, layer)
+		result.Bytes += header.Size
+	}
+
+	for layer := range tarDigests {
+		if _, err := imageStore.Layers.GetStoreFileStat(layer); err != nil {
+			return nil, fmt.Errorf("layer %s not found: %s", layer, err)
+		}
+	}
+	for cacheID, entry := range entries {
+		if err := kvStore.Put(_cachePrefix+cacheID, entry); err != nil {
+			return nil, fmt.Errorf("store cache entry %s: %s", cacheID, err)
+		}
+		result.Entries = append(result.Entries, cacheID)
+	}
+	sort.Strings(result.Entries)
+	return result, nil
+}
+
+// importLayer copies the layer to the image store once its digests are
+// verified.
+func importLayer(
+	imageStore *storage.ImageStore, r io.Reader, layer string, tarDigest image.Digest) error {
+
+	f, err := ioutil.TempFile(imageStore.SandboxDir, "")
+	if err != nil {
+		return fmt.Errorf("create tmp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gzipDigester := image.NewDigester()
+	if _, err := io.Copy(f, io.TeeReader(r, gzipDigester)); err != nil {
+		return fmt.Errorf("write tmp file: %s", err)
+	}
+	if digest := gzipDigester.Digest(); digest.Hex() != layer {
+		return fmt.Errorf("gzip digest is %s", digest)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek tmp file: %s", err)
+	}
+	gr, err := tario.NewLayerReader(f)
+	if err != nil {
+		return fmt.Errorf("create layer reader: %s", err)
+	}
+	defer gr.Close()
+	digest, err := image.NewDigester().FromReader(gr)
+	if err != nil {
+		return fmt.Errorf("decompress: %s", err)
+	} else if digest != tarDigest {
+		return fmt.Errorf("tar digest is %s instead of %s", digest, tarDigest)
+	}
+
+	if err := imageStore.Layers.LinkStoreFileFrom(layer, f.Name()); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("commit layer to store: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// addLayerFixture adds a gzipped layer to the store and returns the entry
+// referencing it.
+func addLayerFixture(t *testing.T, imageStore *storage.ImageStore, content string) (string, string) {
+	require := require.New(t)
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	require.NoError(tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(content))}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(err)
+	require.NoError(tw.Close())
+	tarDigest, err := image.NewDigester().FromBytes(layer.Bytes())
+	require.NoError(err)
+
+	var gzipped bytes.Buffer
+	gw, err := tario.NewGzipWriter(&gzipped, tario.DefaultOptions())
+	require.NoError(err)
+	_, err = gw.Write(layer.Bytes())
+	require.NoError(err)
+	require.NoError(gw.Close())
+	gzipDigest, err := image.NewDigester().FromBytes(gzipped.Bytes())
+	require.NoError(err)
+
+	path := filepath.Join(imageStore.SandboxDir, gzipDigest.Hex())
+	require.NoError(ioutil.WriteFile(path, gzipped.Bytes(), 0644))
+	require.NoError(imageStore.Layers.LinkStoreFileFrom(gzipDigest.Hex(), path))
+	return gzipDigest.Hex(), tarDigest.Hex() + "," + gzipDigest.Hex()
+}
+
+func TestExportImport(t *testing.T) {
+	require := require.New(t)
+
+	src, cleanup := storage.StoreFixture()
+	defer cleanup()
+	layer, entry := addLayerFixture(t, src, "hello")
+	srcKV := keyvalue.MemStore{
+		"makisu_builder_cache_layer":   entry,
+		"makisu_builder_cache_empty":   "MAKISU_CACHE_EMPTY",
+		"makisu_builder_cache_missing": "aaaa,bbbb",
+		"other":                        "value",
+	}
+
+	var exported bytes.Buffer
+	result, err := cache.Export(src, srcKV, &exported)
+	require.NoError(err)
+	require.Equal([]string{"empty", "layer"}, result.Entries)
+	require.Equal([]string{layer}, result.Layers)
+
+	dst, cleanup := storage.StoreFixture()
+	defer cleanup()
+	dstKV := keyvalue.MemStore{}
+	result, err = cache.Import(dst, dstKV, bytes.NewReader(exported.Bytes()))
+	require.NoError(err)
+	require.Equal([]string{"empty", "layer"}, result.Entries)
+	require.Equal([]string{layer}, result.Layers)
+	require.Equal(keyvalue.MemStore{
+		"makisu_builder_cache_layer": entry,
+		"makisu_builder_cache_empty": "MAKISU_CACHE_EMPTY",
+	}, dstKV)
+	_, err = dst.Layers.GetStoreFileStat(layer)
+	require.NoError(err)
+}
+
+func TestImportValidatesDigests(t *testing.T) {
+	src, cleanup := storage.StoreFixture()
+	defer cleanup()
+	layer, entry := addLayerFixture(t, src, "hello")
+	_, otherEntry := addLayerFixture(t, src, "other")
+
+	t.Run("tar digest", func(t *testing.T) {
+		require := require.New(t)
+		// The entry references the layer, but with the tar digest of another.
+		var exported bytes.Buffer
+		kvStore := keyvalue.MemStore{"makisu_builder_cache_layer": otherEntry[:64] + "," + layer}
+		_, err := cache.Export(src, kvStore, &exported)
+		require.NoError(err)
+
+		dst, cleanup := storage.StoreFixture()
+		defer cleanup()
+		dstKV := keyvalue.MemStore{}
+		_, err = cache.Import(dst, dstKV, &exported)
+		require.Error(err)
+		require.Empty(dstKV)
+		_, err = dst.Layers.GetStoreFileStat(layer)
+		require.Error(err)
+	})
+
+	t.Run("gzip digest", func(t *testing.T) {
+		require := require.New(t)
+		var exported bytes.Buffer
+		_, err := cache.Export(src, keyvalue.MemStore{"makisu_builder_cache_layer": entry}, &exported)
+		require.NoError(err)
+
+		// Corrupt the last byte of the layer, which is only followed by the
+		// zero padding of the tar.
+		content := exported.Bytes()
+		i := len(content) - 1
+		for content[i] == 0 {
+			i--
+		}
+		content[i]++
+
+		dst, cleanup := storage.StoreFixture()
+		defer cleanup()
+		dstKV := keyvalue.MemStore{}
+		_, err = cache.Import(dst, dstKV, bytes.NewReader(content))
+		require.Error(err)
+		require.Empty(dstKV)
+	})
+}
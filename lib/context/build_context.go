@@ -16,11 +16,14 @@ package context
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/progress"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 
@@ -31,6 +34,26 @@ const (
 	_stagesDir = "stages"
 )
 
+// ErrBuildTimeout is returned by Err once the deadline of the build passed.
+var ErrBuildTimeout = errors.New("build timed out")
+
+// ErrStageTimeout is returned by Err once the timeout of the stage passed.
+var ErrStageTimeout = errors.New("stage timed out")
+
+// Network modes of the RUN steps of a stage.
+const (
+	NetworkHost = "host"
+	NetworkNone = "none"
+)
+
+// StageResources overrides the resources and isolation of the RUN steps of a
+// stage, on top of the global defaults. Zero fields keep the defaults.
+type StageResources struct {
+	CPUTime time.Duration // Max CPU time of each RUN command.
+	Network string        // NetworkHost, NetworkNone, or empty for the host's.
+	Timeout time.Duration // Max duration of the stage.
+}
+
 // BuildContext stores build state for one build stage.
 type BuildContext struct {
 	RootDir    string // Root of the build file system. Always "/" in production.
@@ -49,23 +72,50 @@ type BuildContext struct {
 
 	CopyOps   []*snapshot.CopyOperation
 	MustScan  bool
+	Step      string // Stage and position of the step being built, e.g. "build 2/5".
 	stagesDir string // Contains dirs with files needed for 'copy --from' operations.
+
+	// Deadline is when the build is cancelled, if it is not zero. Contexts
+	// created for stages get the deadline of the one they are created from.
+	Deadline time.Time
+
+	// Reporter receives the progress events of the steps, which are logged if
+	// it is nil. Contexts created for stages get the reporter of the one they
+	// are created from.
+	Reporter progress.Reporter
+
+	// Options are the settings of the build, shared by the contexts of all
+	// its stages.
+	Options *BuildOptions
+
+	// Resources are the overrides of the stage, nil if it has none.
+	// StageDeadline is set from their timeout when the stage starts.
+	Resources     *StageResources
+	StageDeadline time.Time
+
+	// origEnv contains the values of the process env vars before they were
+	// overwritten by Setenv, nil if they were not set.
+	origEnv map[string]*string
 }
 
-// NewBuildContext inits a new BuildContext object.
+// NewBuildContext inits a new BuildContext object, whose steps are executed
+// with the given options.
 func NewBuildContext(
-	rootDir, contextDir string, imageStore *storage.ImageStore) (*BuildContext, error) {
+	rootDir, contextDir string, imageStore *storage.ImageStore,
+	opts *BuildOptions) (*BuildContext, error) {
 
 	stagesDir := filepath.Join(imageStore.SandboxDir, _stagesDir)
 	if err := os.MkdirAll(stagesDir, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("create stages dir: %s", err)
 	}
 
-	blacklist := append(pathutils.DefaultBlacklist, contextDir, imageStore.RootDir)
-	memFS, err := snapshot.NewMemFS(clock.New(), rootDir, blacklist)
+	blacklist := append(
+		pathutils.DefaultBlacklist, contextDir, imageStore.RootDir, imageStore.SandboxDir)
+	memFS, err := snapshot.NewMemFS(clock.New(), rootDir, blacklist, opts.Snapshot)
 	if err != nil {
 		return nil, fmt.Errorf("init memfs: %s", err)
 	}
+	memFS.SetFileBlobs(imageStore.FileBlobs)
 
 	return &BuildContext{
 		RootDir:    rootDir,
@@ -75,10 +125,57 @@ func NewBuildContext(
 		ImageStore: imageStore,
 		CopyOps:    make([]*snapshot.CopyOperation, 0),
 		MustScan:   false,
+		Options:    opts,
 		stagesDir:  stagesDir,
 	}, nil
 }
 
+// Err returns ErrBuildTimeout if the deadline of the build passed,
+// ErrStageTimeout if the one of the stage passed, and nil otherwise. Steps
+// check it before they are built, and RUN commands while they run.
+func (ctx *BuildContext) Err() error {
+	now := time.Now()
+	if !ctx.Deadline.IsZero() && !now.Before(ctx.Deadline) {
+		return ErrBuildTimeout
+	} else if !ctx.StageDeadline.IsZero() && !now.Before(ctx.StageDeadline) {
+		return ErrStageTimeout
+	}
+	return nil
+}
+
+// Setenv sets an env var of the process, to be used by RUN. The original value
+// is kept so that variables don't leak into other stages.
+func (ctx *BuildContext) Setenv(key, value string) error {
+	if ctx.origEnv == nil {
+		ctx.origEnv = make(map[string]*string)
+	}
+	if _, ok := ctx.origEnv[key]; !ok {
+		if orig, found := os.LookupEnv(key); found {
+			ctx.origEnv[key] = &orig
+		} else {
+			ctx.origEnv[key] = nil
+		}
+	}
+	return os.Setenv(key, value)
+}
+
+// RestoreEnv reverts the env vars of the process set by Setenv.
+func (ctx *BuildContext) RestoreEnv() error {
+	for key, orig := range ctx.origEnv {
+		var err error
+		if orig == nil {
+			err = os.Unsetenv(key)
+		} else {
+			err = os.Setenv(key, *orig)
+		}
+		if err != nil {
+			return fmt.Errorf("restore env %s: %s", key, err)
+		}
+	}
+	ctx.origEnv = nil
+	return nil
+}
+
 // CopyFromRoot returns the directory that context from a stage should be written to and read from.
 func (ctx *BuildContext) CopyFromRoot(alias string) string {
 	// Here we sha the alias to get a string that can be directly appended to the context's
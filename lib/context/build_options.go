@@ -0,0 +1,146 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/secrets"
+	"github.com/uber/makisu/lib/snapshot"
+)
+
+// DefaultRunScriptThreshold is the default of RunScriptThreshold, half of the
+// 128KiB that Linux allows for a single argument of a command.
+const DefaultRunScriptThreshold = 64 * 1024
+
+// Ulimit is a resource limit applied while RUN steps are executed.
+type Ulimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+// BuildOptions are the settings of a build that its steps are executed with.
+// The contexts of the stages of a build share them, and builds with different
+// options can run in the same process.
+type BuildOptions struct {
+	// Snapshot are the options of the layers committed by the build, and of
+	// the tars they are written to.
+	Snapshot snapshot.Options
+	// Registry are the options of the registry clients of the build, which
+	// pull its base images.
+	Registry registry.Options
+
+	// TargetPlatform is the platform of the image being built. FROM images
+	// of other platforms fail the build, unless AllowPlatformMismatch is true.
+	// If it is empty, FROM images are not checked. Images that are only
+	// copied from, with COPY --from, are never checked.
+	TargetPlatform image.Platform
+	// AllowPlatformMismatch only logs a warning for FROM images whose
+	// platform does not match TargetPlatform.
+	AllowPlatformMismatch bool
+
+	// CacheBaseDigest includes the digest of the base image in the cache ID
+	// of FROM steps, and thus of all the steps that follow them.
+	CacheBaseDigest bool
+	// CacheHash is the algorithm of the hashes that the cache IDs of steps
+	// are derived from. It is part of the seed of every stage, so changing it
+	// invalidates all the cache IDs.
+	CacheHash string
+	// ExplainCache logs the inputs of the cache ID of every step when it is
+	// set, so that the logs of two builds can be diffed to find why a step
+	// missed the cache.
+	ExplainCache bool
+
+	// CopyAllowMissing makes COPY and ADD skip the sources of the build
+	// context that don't exist with a warning, instead of failing.
+	CopyAllowMissing bool
+	// Dockerignore matches the paths of the build context that ADD and COPY
+	// don't copy, or is nil if the build has no .dockerignore file.
+	Dockerignore *pathutils.IgnoreMatcher
+	// BuildContextDirs are the absolute paths of the directories of named
+	// contexts. Files are copied from them like from the build context.
+	BuildContextDirs map[string]string
+	// BuildContextImages are the names of the images of named contexts.
+	BuildContextImages map[string]string
+
+	// Secrets are the build secrets given with --secret, by ID, which RUN
+	// steps can mount with --mount=type=secret.
+	Secrets map[string]*secrets.Secret
+	// BuildCACerts are PEM encoded CA certificates added to the CA bundles of
+	// the build filesystem while RUN steps are executed. The bundles are
+	// restored afterwards, so the certificates never end up in layers.
+	BuildCACerts []byte
+	// ExtraHosts are "<ip>\t<name>" lines added to /etc/hosts.
+	ExtraHosts []string
+	// DNSServers replace the nameservers of /etc/resolv.conf.
+	DNSServers []string
+	// DNSSearches replace the search domains of /etc/resolv.conf.
+	DNSSearches []string
+	// NoNetwork makes RUN steps execute their command without network access,
+	// like the ones of stages whose network is none, e.g. for offline builds.
+	NoNetwork bool
+
+	// RunShell is the command that RUN commands are passed to, followed by
+	// the command itself. If set, the CMD and ENTRYPOINT in shell form are
+	// also prefixed with it, instead of being split into arguments.
+	RunShell []string
+	// RunScriptThreshold is the length in bytes above which RUN commands are
+	// written to a script that the shell sources, instead of being passed to
+	// it as an argument, which fails with E2BIG. If 0, commands are always
+	// passed as arguments.
+	RunScriptThreshold int
+	// BuildUmask is the umask RUN commands are executed with, set by the
+	// shell before the command so that the umask of makisu isn't changed
+	// while other stages write files. If negative, they inherit the umask of
+	// makisu.
+	BuildUmask int
+	// Ulimits are the resource limits RUN commands are executed with. They
+	// are set by the ulimit builtin of the shell running the command, and
+	// inherited by the processes it starts, the limits of makisu are left as
+	// they are.
+	Ulimits []Ulimit
+	// DiskQuota is the max number of bytes a RUN command may write to the
+	// filesystem of the build root. RUN commands that exceed it are killed. 0
+	// disables the quota.
+	DiskQuota int64
+	// PrefixRunOutput makes RUN steps stream the output of their command one
+	// line at a time, each preceded by the stage and position of the step, so
+	// that the output of multi-stage builds stays readable.
+	PrefixRunOutput bool
+	// DebugShell makes failed RUN steps start an interactive shell in the
+	// build filesystem before failing the build, if a terminal is attached.
+	DebugShell bool
+	// AssertCleanup makes RUN steps fail if what was set up to execute their
+	// command, like extra hosts and secrets, can't be torn down afterwards, or
+	// if processes left running by the command can't be killed, instead of
+	// only logging it.
+	AssertCleanup bool
+}
+
+// DefaultBuildOptions returns the options of a build without flags.
+func DefaultBuildOptions() *BuildOptions {
+	return &BuildOptions{
+		Snapshot:           snapshot.DefaultOptions(),
+		Registry:           registry.DefaultOptions(),
+		CacheBaseDigest:    true,
+		CacheHash:          "sha256",
+		Secrets:            map[string]*secrets.Secret{},
+		RunScriptThreshold: DefaultRunScriptThreshold,
+		BuildUmask:         -1,
+		PrefixRunOutput:    true,
+	}
+}
@@ -0,0 +1,302 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// ImportImage reads an image from a docker tar, in the format of docker save
+// and of the --dest flag of makisu build, if path is a file, or from an OCI
+// image layout if it is a directory, in which case the first manifest of its
+// index is imported. The config, layers and manifest of the image are saved
+// in the store under imageName, from which they can be pushed to a registry.
+// Uncompressed layers of docker tars are gzipped.
+func ImportImage(
+	store *storage.ImageStore, path string, imageName image.Name) (*image.DistributionManifest, error) {
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest *image.DistributionManifest
+	if fi.IsDir() {
+		manifest, err = importOCILayout(store, path)
+	} else {
+		manifest, err = importDockerTar(store, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := saveImportedManifest(store, imageName, manifest); err != nil {
+		return nil, fmt.Errorf("save manifest: %s", err)
+	}
+	return manifest, nil
+}
+
+// importOCILayout adds the blobs of the first manifest of the index of an OCI
+// image layout to the store, verifying their digests.
+func importOCILayout(store *storage.ImageStore, dir string) (*image.DistributionManifest, error) {
+	blobPath := func(digest image.Digest) string {
+		return filepath.Join(dir, "blobs", digest.Algorithm(), digest.Hex())
+	}
+
+	indexJSON, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read index: %s", err)
+	}
+	var index struct {
+		Manifests []image.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return nil, fmt.Errorf("unmarshal index: %s", err)
+	} else if len(index.Manifests) == 0 {
+		return nil, errors.New("index has no manifest")
+	}
+	descriptor := index.Manifests[0]
+	manifestJSON, err := ioutil.ReadFile(blobPath(descriptor.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %s", err)
+	}
+	manifest, _, err := image.UnmarshalDistributionManifest(descriptor.MediaType, manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %s", err)
+	}
+
+	for _, blob := range append([]image.Descriptor{manifest.Config}, manifest.Layers...) {
+		f, err := os.Open(blobPath(blob.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("open blob: %s", err)
+		}
+		imported, err := importBlob(store, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("import blob %s: %s", blob.Digest, err)
+		} else if imported.Digest != blob.Digest {
+			return nil, fmt.Errorf("blob %s has digest %s", blob.Digest, imported.Digest)
+		}
+	}
+	return &manifest, nil
+}
+
+// importDockerTar adds the config and layers of the first image of a docker
+// tar to the store, and returns a manifest referencing them.
+func importDockerTar(store *storage.ImageStore, path string) (*image.DistributionManifest, error) {
+	dir, err := ioutil.TempDir(store.SandboxDir, "import")
+	if err != nil {
+		return nil, fmt.Errorf("create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := extractRegularFiles(path, dir); err != nil {
+		return nil, fmt.Errorf("extract tar: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, image.ExportManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %s", image.ExportManifestFileName, err)
+	}
+	var exportManifests []image.ExportManifest
+	if err := json.Unmarshal(data, &exportManifests); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %s", image.ExportManifestFileName, err)
+	} else if len(exportManifests) == 0 {
+		return nil, fmt.Errorf("%s has no image", image.ExportManifestFileName)
+	}
+	exportManifest := exportManifests[0]
+
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+	}
+	f, err := os.Open(filepath.Join(dir, exportManifest.Config.String()))
+	if err != nil {
+		return nil, fmt.Errorf("open image config: %s", err)
+	}
+	manifest.Config, err = importBlob(store, f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("import image config: %s", err)
+	}
+	manifest.Config.MediaType = image.MediaTypeConfig
+
+	for _, layer := range exportManifest.Layers {
+		descriptor, err := importLayer(store, filepath.Join(dir, layer.String()))
+		if err != nil {
+			return nil, fmt.Errorf("import layer %s: %s", layer, err)
+		}
+		manifest.Layers = append(manifest.Layers, descriptor)
+	}
+	return manifest, nil
+}
+
+// extractRegularFiles writes the regular files of the tar to dir.
+func extractRegularFiles(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Tars written by makisu build --dest are gzipped.
+	dr, err := tario.NewDecompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	r := tar.NewReader(dr)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid file name %s", header.Name)
+		}
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("write %s: %s", name, err)
+		}
+	}
+}
+
+// importLayer adds the layer to the store, gzipping it first if it isn't
+// already compressed.
+func importLayer(store *storage.ImageStore, path string) (image.Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Descriptor{}, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(2)
+	if err != nil && err != io.EOF {
+		return image.Descriptor{}, fmt.Errorf("read layer: %s", err)
+	}
+	var descriptor image.Descriptor
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		descriptor, err = importBlob(store, r)
+	} else {
+		descriptor, err = importGzippedBlob(store, r)
+	}
+	if err != nil {
+		return image.Descriptor{}, err
+	}
+	descriptor.MediaType = image.MediaTypeLayer
+	return descriptor, nil
+}
+
+// importGzippedBlob compresses the content of r and adds it to the store.
+func importGzippedBlob(store *storage.ImageStore, r io.Reader) (image.Descriptor, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		gw, err := tario.NewGzipWriter(pw, tario.DefaultOptions())
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(gw, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(gw.Close())
+	}()
+	descriptor, err := importBlob(store, pr)
+	pr.CloseWithError(err)
+	return descriptor, err
+}
+
+// importBlob copies the content of r to the layer store, and returns its
+// digest and size.
+func importBlob(store *storage.ImageStore, r io.Reader) (image.Descriptor, error) {
+	f, err := ioutil.TempFile(store.SandboxDir, "")
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("create tmp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	digester := image.NewDigester()
+	size, err := io.Copy(f, io.TeeReader(r, digester))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("write tmp file: %s", err)
+	}
+	digest := digester.Digest()
+	if err := store.Layers.LinkStoreFileFrom(digest.Hex(), f.Name()); err != nil && !os.IsExist(err) {
+		return image.Descriptor{}, fmt.Errorf("commit blob to store: %s", err)
+	}
+	return image.Descriptor{Size: size, Digest: digest}, nil
+}
+
+// saveImportedManifest saves the manifest in the store under imageName,
+// replacing any existing one.
+func saveImportedManifest(
+	store *storage.ImageStore, imageName image.Name, manifest *image.DistributionManifest) error {
+
+	repo, tag := imageName.GetRepository(), imageName.GetTag()
+	if err := store.Manifests.DeleteStoreFile(repo, tag); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete existing manifest: %s", err)
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %s", err)
+	}
+	f, err := ioutil.TempFile(store.SandboxDir, "")
+	if err != nil {
+		return fmt.Errorf("create tmp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(manifestJSON)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write tmp file: %s", err)
+	}
+	if err := store.Manifests.LinkStoreFileFrom(repo, tag, f.Name()); err != nil {
+		return fmt.Errorf("commit manifest to store: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sampleStoreFixture returns a store with the sample image of the testdata dir.
+func sampleStoreFixture(t *testing.T) (*storage.ImageStore, func()) {
+	require := require.New(t)
+
+	store, cleanup := storage.StoreFixture()
+	for _, file := range []string{"test_image_config", "test_layer.tar"} {
+		f, err := os.Open(filepath.Join("../../../testdata/files", file))
+		require.NoError(err)
+		_, err = importBlob(store, f)
+		f.Close()
+		require.NoError(err)
+	}
+	manifestData, err := ioutil.ReadFile("../../../testdata/files/test_distribution_manifest")
+	require.NoError(err)
+	manifest, _, err := image.UnmarshalDistributionManifest(image.MediaTypeManifest, manifestData)
+	require.NoError(err)
+	name := image.NewImageName("", testutil.SampleImageRepoName, testutil.SampleImageTag)
+	require.NoError(saveImportedManifest(store, name, &manifest))
+	return store, cleanup
+}
+
+func TestImportImageDockerTar(t *testing.T) {
+	require := require.New(t)
+
+	src, cleanup := sampleStoreFixture(t)
+	defer cleanup()
+	dst, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	name := image.NewImageName("", testutil.SampleImageRepoName, testutil.SampleImageTag)
+	r, err := NewDefaultImageTarer(src).CreateTarReader(name)
+	require.NoError(err)
+	tarPath := filepath.Join(src.SandboxDir, "image.tar")
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(tarPath, b, 0644))
+
+	target := image.NewImageName("localhost:5055", "imported", "v1")
+	manifest, err := ImportImage(dst, tarPath, target)
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifest, manifest.MediaType)
+	require.Equal(testutil.SampleImageConfigDigest, manifest.Config.Digest.Hex())
+	require.Equal(1, len(manifest.Layers))
+	require.Equal(testutil.SampleLayerTarDigest, manifest.Layers[0].Digest.Hex())
+	require.Equal(image.MediaTypeLayer, manifest.Layers[0].MediaType)
+
+	_, err = dst.Layers.GetStoreFileStat(testutil.SampleLayerTarDigest)
+	require.NoError(err)
+	_, err = dst.Manifests.GetStoreFileStat("imported", "v1")
+	require.NoError(err)
+}
+
+func TestImportImageUncompressedLayer(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	// Layers of docker save are not compressed.
+	layer := filepath.Join(store.SandboxDir, "layer.tar")
+	l, err := os.Create(layer)
+	require.NoError(err)
+	lw := tar.NewWriter(l)
+	require.NoError(lw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5}))
+	_, err = lw.Write([]byte("hello"))
+	require.NoError(err)
+	require.NoError(lw.Close())
+	require.NoError(l.Close())
+
+	exportManifest, err := json.Marshal([]image.ExportManifest{{
+		Config: "config.json",
+		Layers: []image.ExportLayer{"abc/layer.tar"},
+	}})
+	require.NoError(err)
+	tarPath := filepath.Join(store.SandboxDir, "image.tar")
+	f, err := os.Create(tarPath)
+	require.NoError(err)
+	w := tar.NewWriter(f)
+	for name, content := range map[string][]byte{
+		"manifest.json": exportManifest,
+		"config.json":   []byte("{}"),
+	} {
+		require.NoError(w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err = w.Write(content)
+		require.NoError(err)
+	}
+	fi, err := os.Stat(layer)
+	require.NoError(err)
+	require.NoError(w.WriteHeader(&tar.Header{Name: "abc/layer.tar", Mode: 0644, Size: fi.Size()}))
+	content, err := ioutil.ReadFile(layer)
+	require.NoError(err)
+	_, err = w.Write(content)
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(f.Close())
+
+	manifest, err := ImportImage(store, tarPath, image.NewImageName("", "imported", "v1"))
+	require.NoError(err)
+	require.Equal(1, len(manifest.Layers))
+
+	r, err := store.Layers.GetStoreFileReader(manifest.Layers[0].Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gr, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	header, err := tar.NewReader(gr).Next()
+	require.NoError(err)
+	require.Equal("hello", header.Name)
+}
+
+func TestImportImageOCILayout(t *testing.T) {
+	require := require.New(t)
+
+	src, cleanup := sampleStoreFixture(t)
+	defer cleanup()
+	dst, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	manifestData, err := ioutil.ReadFile("../../../testdata/files/test_distribution_manifest")
+	require.NoError(err)
+	sample, _, err := image.UnmarshalDistributionManifest(image.MediaTypeManifest, manifestData)
+	require.NoError(err)
+	oci := sample.OCI()
+	ociJSON, err := json.Marshal(oci)
+	require.NoError(err)
+	ociDigest, err := image.NewDigester().FromBytes(ociJSON)
+	require.NoError(err)
+
+	dir := filepath.Join(src.SandboxDir, "layout")
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	require.NoError(os.MkdirAll(blobs, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(blobs, ociDigest.Hex()), ociJSON, 0644))
+	for _, digest := range []string{testutil.SampleImageConfigDigest, testutil.SampleLayerTarDigest} {
+		require.NoError(src.Layers.LinkStoreFileTo(digest, filepath.Join(blobs, digest)))
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []image.Descriptor{{
+			MediaType: image.MediaTypeOCIManifest,
+			Digest:    ociDigest,
+			Size:      int64(len(ociJSON)),
+		}},
+	})
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+
+	manifest, err := ImportImage(dst, dir, image.NewImageName("", "imported", "v1"))
+	require.NoError(err)
+	require.Equal(oci, *manifest)
+	_, err = dst.Layers.GetStoreFileStat(testutil.SampleLayerTarDigest)
+	require.NoError(err)
+
+	// Blobs that don't match their digest are rejected.
+	require.NoError(os.Remove(filepath.Join(blobs, testutil.SampleLayerTarDigest)))
+	require.NoError(ioutil.WriteFile(filepath.Join(blobs, testutil.SampleLayerTarDigest), []byte("x"), 0644))
+	_, err = ImportImage(dst, dir, image.NewImageName("", "imported", "v1"))
+	require.Error(err)
+}
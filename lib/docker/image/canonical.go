@@ -0,0 +1,46 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MarshalCanonical serializes v to canonical JSON: object keys are sorted at
+// every level and there is no insignificant whitespace, so that equal values
+// always have the same digest. Like encoding/json, characters like '<' are
+// escaped, so that values implementing json.Marshaler with it are serialized
+// the same way when nested in other values.
+func MarshalCanonical(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalize(b)
+}
+
+// canonicalize re-encodes the JSON document b canonically. Decoding it into
+// generic values turns all objects into maps, whose keys encoding/json sorts.
+// Numbers are kept as is.
+func canonicalize(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
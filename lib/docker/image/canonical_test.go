@@ -0,0 +1,75 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalCanonical(t *testing.T) {
+	require := require.New(t)
+
+	v := struct {
+		Z string            `json:"z"`
+		A map[string]string `json:"a"`
+		M struct {
+			Y int     `json:"y"`
+			B float64 `json:"b"`
+		} `json:"m"`
+	}{Z: "<&>", A: map[string]string{"k2": "v", "k1": "v"}}
+	v.M.Y = 1
+	v.M.B = 1.5
+
+	b, err := MarshalCanonical(v)
+	require.NoError(err)
+	require.Equal(`{"a":{"k1":"v","k2":"v"},"m":{"b":1.5,"y":1},"z":"\u003c\u0026\u003e"}`, string(b))
+}
+
+func TestConfigMarshalJSONDeterministic(t *testing.T) {
+	require := require.New(t)
+
+	config := NewDefaultImageConfig()
+	config.Config.Labels = map[string]string{}
+	config.Config.ExposedPorts = map[string]struct{}{}
+	config.Config.Volumes = map[string]struct{}{}
+	for _, k := range []string{"zeta", "alpha", "mu", "beta", "omega", "kappa"} {
+		config.Config.Labels[k] = k
+		config.Config.ExposedPorts[k+"/tcp"] = struct{}{}
+		config.Config.Volumes["/"+k] = struct{}{}
+	}
+	config.Config.Entrypoint = []string{"/bin/sh", "-c", "echo <done> && exit"}
+	config.History = []History{{CreatedBy: "RUN make", Comment: "build"}}
+
+	first, err := json.Marshal(&config)
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		b, err := json.Marshal(&config)
+		require.NoError(err)
+		require.Equal(string(first), string(b))
+	}
+
+	// The output is canonical, and stays the same through a parse cycle.
+	canonical, err := canonicalize(first)
+	require.NoError(err)
+	require.Equal(string(first), string(canonical))
+	parsed, err := NewImageConfigFromJSON(first)
+	require.NoError(err)
+	b, err := json.Marshal(parsed)
+	require.NoError(err)
+	require.Equal(string(first), string(b))
+}
@@ -40,6 +40,13 @@ func (d Digest) Hex() string {
 	return string(d[i+1:])
 }
 
+// Algorithm returns the algorithm part of the digest, e.g. "sha256".
+// This function will panic if the underlying digest doesn't contain ":".
+func (d Digest) Algorithm() string {
+	i := strings.Index(string(d), ":")
+	return string(d[:i])
+}
+
 // Equals compares the digest against the layer contained in the reader passed in as input, and
 // returns true if the two digests are the same.
 func (d Digest) Equals(reader io.ReadCloser) (bool, error) {
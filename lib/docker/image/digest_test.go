@@ -32,6 +32,7 @@ func TestDigestHexParsing(t *testing.T) {
 	hex := Digest(digestStr).Hex()
 	require.NotEqual(NewEmptyDigest(), hex)
 	require.Equal("123abc123", hex)
+	require.Equal("sha256", Digest(digestStr).Algorithm())
 }
 
 func TestEmptyDigest(t *testing.T) {
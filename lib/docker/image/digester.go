@@ -41,6 +41,12 @@ func (d *Digester) Digest() Digest {
 	return Digest(fmt.Sprintf("%s:%x", SHA256, d.hash.Sum(nil)))
 }
 
+// Write adds p to the digested data, so that a Digester can be used as an
+// io.Writer.
+func (d *Digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
 // FromReader returns the digest of data from reader.
 func (d Digester) FromReader(rd io.Reader) (Digest, error) {
 	if _, err := io.Copy(d.hash, rd); err != nil {
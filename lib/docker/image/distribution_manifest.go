@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"mime"
+	"strings"
 )
 
 const (
@@ -29,6 +30,30 @@ const (
 
 	// MediaTypeLayer is the mediaType used for layers referenced by the manifest.
 	MediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeLayerUncompressed is the mediaType used for layers that are
+	// stored as plain tars because their content is incompressible.
+	MediaTypeLayerUncompressed = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeOCIManifest specifies the mediaType for OCI image manifests.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIConfig specifies the mediaType for the image configuration of OCI images.
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCILayer is the mediaType used for layers referenced by OCI manifests.
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// MediaTypeOCILayerUncompressed is the mediaType used for uncompressed
+	// layers referenced by OCI manifests.
+	MediaTypeOCILayerUncompressed = "application/vnd.oci.image.layer.v1.tar"
+
+	// MediaTypeOCILayerZstd is the mediaType used for zstd compressed layers
+	// referenced by OCI manifests. Docker manifests have no equivalent.
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeOCIEmpty is the mediaType of the empty config of OCI artifacts.
+	MediaTypeOCIEmpty = "application/vnd.oci.empty.v1+json"
 )
 
 // DistributionManifest defines a schema2 manifest. It's used for docker pull and docker push.
@@ -44,6 +69,16 @@ type DistributionManifest struct {
 
 	// Layers lists descriptors for all referenced layers, starting from base layer.
 	Layers []Descriptor `json:"layers"`
+
+	// ArtifactType is the type of OCI artifacts, which aren't images.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject references the manifest an OCI artifact is attached to, e.g.
+	// the image an attestation is about.
+	Subject *Descriptor `json:"subject,omitempty"`
+
+	// Annotations are arbitrary metadata of OCI manifests.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // Descriptor describes targeted content.
@@ -60,9 +95,10 @@ type Descriptor struct {
 }
 
 // DigestPair is a pair of uncompressed digest/compressed descriptor of the same layer.
-// All layers in makisu are saved in gzipped format, and that value is used in distribution
+// Layers in makisu are saved in gzipped format, and that value is used in distribution
 // manifest; However the uncompressed digest is needed in image configs, so they are often passed
-// around in pairs.
+// around in pairs. Layers whose content is incompressible may be saved as plain tars, in which
+// case both digests are the same.
 type DigestPair struct {
 	TarDigest      Digest
 	GzipDescriptor Descriptor
@@ -81,10 +117,10 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 		}
 	}
 
-	if mediatype != MediaTypeManifest {
+	if mediatype != MediaTypeManifest && mediatype != MediaTypeOCIManifest {
 		return DistributionManifest{},
 			Descriptor{},
-			fmt.Errorf("unsupported manifest mediatype: %s", mediatype)
+			fmt.Errorf("unsupported manifest mediatype: %s", describeMediaType(mediatype))
 	}
 
 	manifest := DistributionManifest{}
@@ -96,7 +132,44 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 	if err != nil {
 		return DistributionManifest{}, Descriptor{}, err
 	}
-	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: MediaTypeManifest}, nil
+	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: mediatype}, nil
+}
+
+// describeMediaType returns the media type with a hint about why it can't be
+// used as an image manifest.
+func describeMediaType(mediatype string) string {
+	switch {
+	case mediatype == "":
+		return "none (the registry did not send a Content-Type)"
+	case IsManifestList(mediatype):
+		return mediatype + " (manifest lists have to be resolved to the manifest of one platform first)"
+	case strings.HasPrefix(mediatype, "application/vnd.docker.distribution.manifest.v1"):
+		return mediatype + " (docker schema 1 images are not supported, push the image again with a recent docker)"
+	}
+	return mediatype + " (only docker v2 schema 2 and OCI image manifests are supported, the reference may be an OCI artifact instead of an image)"
+}
+
+// OCI returns a copy of the manifest with OCI media types. Both formats share
+// the same config and layer blobs, only the media types differ, so the
+// resulting manifest has a different digest.
+func (manifest DistributionManifest) OCI() DistributionManifest {
+	oci := DistributionManifest{
+		SchemaVersion: manifest.SchemaVersion,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        manifest.Config,
+		Layers:        make([]Descriptor, len(manifest.Layers)),
+	}
+	oci.Config.MediaType = MediaTypeOCIConfig
+	for i, layer := range manifest.Layers {
+		oci.Layers[i] = layer
+		switch layer.MediaType {
+		case MediaTypeLayer:
+			oci.Layers[i].MediaType = MediaTypeOCILayer
+		case MediaTypeLayerUncompressed:
+			oci.Layers[i].MediaType = MediaTypeOCILayerUncompressed
+		}
+	}
+	return oci
 }
 
 // GetLayerDigests returns the list of layer digests of the image.
@@ -108,6 +181,20 @@ func (manifest DistributionManifest) GetLayerDigests() []Digest {
 	return digests
 }
 
+// GetUniqueLayerDigests returns the digests of layers like GetLayerDigests,
+// but lists layers referenced multiple times only once.
+func (manifest DistributionManifest) GetUniqueLayerDigests() []Digest {
+	digests := []Digest{}
+	seen := make(map[Digest]bool)
+	for _, descriptor := range manifest.Layers {
+		if !seen[descriptor.Digest] {
+			seen[descriptor.Digest] = true
+			digests = append(digests, descriptor.Digest)
+		}
+	}
+	return digests
+}
+
 // GetConfigDigest returns digest of the image config
 func (manifest DistributionManifest) GetConfigDigest() Digest {
 	return manifest.Config.Digest
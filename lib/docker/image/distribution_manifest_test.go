@@ -15,6 +15,8 @@
 package image
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -42,3 +44,69 @@ func TestUnmarshalDistributionManifest(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, len(manifest.GetLayerDigests()))
 }
+
+func TestUnmarshalDistributionManifestUnsupported(t *testing.T) {
+	tests := []struct {
+		desc     string
+		ctHeader string
+		expected string
+	}{
+		{"manifest list", MediaTypeManifestList, "manifest lists have to be resolved"},
+		{"schema1", "application/vnd.docker.distribution.manifest.v1+prettyjws", "docker schema 1"},
+		{"artifact", "application/vnd.cncf.helm.config.v1+json", "application/vnd.cncf.helm.config.v1+json"},
+		{"no content type", "", "did not send a Content-Type"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, _, err := UnmarshalDistributionManifest(test.ctHeader, []byte(testManifest))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), test.expected)
+		})
+	}
+}
+
+func TestGetUniqueLayerDigests(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(MediaTypeManifest, []byte(testManifest))
+	require.NoError(err)
+	other := Descriptor{Digest: Digest("sha256:" + strings.Repeat("0", 64))}
+	manifest.Layers = append(manifest.Layers, other, manifest.Layers[0], other)
+
+	require.Len(manifest.GetLayerDigests(), 4)
+	require.Equal(
+		[]Digest{manifest.Layers[0].Digest, other.Digest},
+		manifest.GetUniqueLayerDigests())
+}
+
+func TestDistributionManifestOCI(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(MediaTypeManifest, []byte(testManifest))
+	require.NoError(err)
+
+	oci := manifest.OCI()
+	require.Equal(2, oci.SchemaVersion)
+	require.Equal(MediaTypeOCIManifest, oci.MediaType)
+	require.Equal(MediaTypeOCIConfig, oci.Config.MediaType)
+	require.Equal(manifest.Config.Digest, oci.Config.Digest)
+	require.Equal(manifest.Config.Size, oci.Config.Size)
+	require.Equal(manifest.GetLayerDigests(), oci.GetLayerDigests())
+	require.Equal(MediaTypeOCILayer, oci.Layers[0].MediaType)
+
+	uncompressed := manifest
+	uncompressed.Layers = []Descriptor{{MediaType: MediaTypeLayerUncompressed}}
+	require.Equal(MediaTypeOCILayerUncompressed, uncompressed.OCI().Layers[0].MediaType)
+
+	// The original manifest is left untouched.
+	require.Equal(MediaTypeManifest, manifest.MediaType)
+	require.Equal(MediaTypeLayer, manifest.Layers[0].MediaType)
+
+	// OCI manifests can be unmarshalled too.
+	b, err := json.Marshal(oci)
+	require.NoError(err)
+	unmarshalled, desc, err := UnmarshalDistributionManifest(MediaTypeOCIManifest, b)
+	require.NoError(err)
+	require.Equal(oci, unmarshalled)
+	require.Equal(MediaTypeOCIManifest, desc.MediaType)
+}
@@ -55,6 +55,10 @@ type V1Image struct {
 	Architecture string `json:"architecture,omitempty"`
 	// OS is the operating system used to build and run the image
 	OS string `json:"os,omitempty"`
+	// OSVersion is the version of the operating system, e.g. the Windows build
+	OSVersion string `json:"os.version,omitempty"`
+	// Variant is the variant of the architecture, e.g. v7 for arm
+	Variant string `json:"variant,omitempty"`
 	// Size is the total size of the image including all layers it is composed of
 	Size int64 `json:",omitempty"`
 }
@@ -66,6 +70,11 @@ type Config struct {
 	RootFS  *RootFS   `json:"rootfs,omitempty"`
 	History []History `json:"history,omitempty"`
 
+	// InlineCache maps the cache IDs of the steps that built the image to the
+	// layers they committed, in the format of the cache key-value store, so
+	// that other builds can use the image as cache.
+	InlineCache map[string]string `json:"makisu.cache.v0,omitempty"`
+
 	// rawJSON caches the immutable JSON associated with this image.
 	rawJSON []byte
 
@@ -79,9 +88,10 @@ func (img *Config) ID() ID {
 	return img.computedID
 }
 
-// MarshalJSON serializes the image to JSON.
-// It sorts the top-level keys so that JSON that's been manipulated by a push/pull cycle with a
-// legacy registry won't end up with a different key order.
+// MarshalJSON serializes the image to canonical JSON.
+// It sorts the keys at every level so that JSON that's been manipulated by a push/pull cycle with a
+// legacy registry won't end up with a different key order, and the config digest only depends on
+// its content.
 func (img *Config) MarshalJSON() ([]byte, error) {
 	type MarshalImage Config
 
@@ -89,12 +99,7 @@ func (img *Config) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	var c map[string]*json.RawMessage
-	if err := json.Unmarshal(pass1, &c); err != nil {
-		return nil, err
-	}
-	return json.Marshal(c)
+	return canonicalize(pass1)
 }
 
 // History stores build commands that were used to create an image.
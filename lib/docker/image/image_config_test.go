@@ -42,6 +42,28 @@ func TestMarshalUnmarshalImageConfig(t *testing.T) {
 	require.Error(err)
 }
 
+func TestMarshalUnmarshalImageConfigPlatform(t *testing.T) {
+	require := require.New(t)
+
+	content := []byte(`{"architecture":"arm","os":"windows","os.version":"10.0.17763.1817",` +
+		`"variant":"v7","created":"0001-01-01T00:00:00Z","rootfs":{"type":"layers","diff_ids":[]}}`)
+	config, err := NewImageConfigFromJSON(content)
+	require.NoError(err)
+	require.Equal("10.0.17763.1817", config.OSVersion)
+	require.Equal("v7", config.Variant)
+	require.Equal(Platform{OS: "windows", Architecture: "arm", Variant: "v7"}, config.Platform())
+
+	config.rawJSON = nil
+	content, err = config.MarshalJSON()
+	require.NoError(err)
+	require.Contains(string(content), `"os.version":"10.0.17763.1817"`)
+	require.Contains(string(content), `"variant":"v7"`)
+	newConfig, err := NewImageConfigFromJSON(content)
+	require.NoError(err)
+	newConfig.rawJSON = nil
+	require.Equal(*config, *newConfig)
+}
+
 func TestCopyImageConfig(t *testing.T) {
 	require := require.New(t)
 
@@ -30,7 +30,13 @@ const (
 	Scratch            = "scratch"
 )
 
-// Name is the identifier of an image
+// digestRegexp matches the digests of OCI image references, e.g.
+// sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855.
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+
+// Name is the identifier of an image.
+// The tag of images referenced by digest, like <repo>@sha256:<hex>, is the
+// digest, which the registry API accepts in place of tags.
 type Name struct {
 	registry   string
 	repository string
@@ -39,7 +45,7 @@ type Name struct {
 
 // NewImageName returns a new image name given a registry, repo and tag.
 func NewImageName(registry, repo, tag string) Name {
-	rawName := fmt.Sprintf("%s:%s", repo, tag)
+	rawName := fmt.Sprintf("%s%s%s", repo, referenceSeparator(tag), tag)
 	if registry != "" {
 		rawName = filepath.Join(registry, rawName)
 	}
@@ -66,6 +72,21 @@ func (name Name) GetTag() string {
 	return name.tag
 }
 
+// IsDigest returns whether the image is referenced by digest instead of tag.
+// Tags can't contain ":", unlike digests.
+func (name Name) IsDigest() bool {
+	return strings.Contains(name.tag, ":")
+}
+
+// referenceSeparator returns the separator of the repository and the tag or
+// digest in image names.
+func referenceSeparator(tag string) string {
+	if strings.Contains(tag, ":") {
+		return "@"
+	}
+	return ":"
+}
+
 // GetRegistry returns image repository
 func (name Name) GetRegistry() string {
 	return name.registry
@@ -82,7 +103,7 @@ func (name Name) IsValid() bool {
 
 // ShortName returns the name of the image without the registry information
 func (name Name) ShortName() string {
-	return fmt.Sprintf("%s:%s", name.GetRepository(), name.tag)
+	return fmt.Sprintf("%s%s%s", name.GetRepository(), referenceSeparator(name.tag), name.tag)
 }
 
 // String returns the full name of the image with the registry information if available
@@ -93,8 +114,17 @@ func (name Name) String() string {
 	return filepath.Join(name.registry, name.ShortName())
 }
 
-// ParseName parses image name of format <registry>/<repo>:<tag>
+// ParseName parses image name of format <registry>/<repo>:<tag>, or
+// <registry>/<repo>@<digest>. The tag of names with both is ignored.
 func ParseName(input string) (Name, error) {
+	var digest string
+	if i := strings.Index(input, "@"); i != -1 {
+		input, digest = input[:i], input[i+1:]
+		if !digestRegexp.MatchString(digest) {
+			return Name{}, fmt.Errorf("invalid digest %s of image %s", digest, input)
+		}
+	}
+
 	result := Name{
 		registry:   "",
 		repository: input,
@@ -105,6 +135,7 @@ func ParseName(input string) (Name, error) {
 	sepIndex := strings.LastIndex(input, ":")
 	if sepIndex < slashIndex || sepIndex == -1 {
 		// <ip>:<port>/<repo>
+		// [<ipv6>]:<port>/<repo>
 		// <dns>:<port>/<repo>
 		// <dns>/<repo>
 		// <repo>
@@ -113,6 +144,7 @@ func ParseName(input string) (Name, error) {
 	} else {
 		// if sepIndex >= slashIndex && sepIndex == -1
 		// <ip>:<port>/<repo>:<tag>
+		// [<ipv6>]:<port>/<repo>:<tag>
 		// <dns>:<port>/<repo>:<tag>
 		// <repo>:<tag>
 		result.repository = input[:sepIndex]
@@ -122,12 +154,16 @@ func ParseName(input string) (Name, error) {
 	// Separate hostname from repo.
 	// It ignores the fact that - cannot be the first or last character, or that _ is not valid
 	// character in URL, but those checks would make the regex too complex.
-	hostnameRegexp := regexp.MustCompile(`^([\w\d\.-]+(\.[\w\d\.-]+|:[\d]+))\/`)
+	// IPv6 literals must be bracketed, optionally followed by a port, e.g. [::1]:5000.
+	hostnameRegexp := regexp.MustCompile(`^(\[[\da-fA-F:\.]+\](:[\d]+)?|[\w\d\.-]+(\.[\w\d\.-]+|:[\d]+))\/`)
 	parts := hostnameRegexp.FindStringSubmatch(result.repository)
 	if parts != nil {
 		result.registry = parts[1]
 		result.repository = result.repository[len(parts[1])+1:]
 	}
+	if digest != "" {
+		result.tag = digest
+	}
 
 	return result, nil
 }
@@ -69,4 +69,62 @@ func TestParseImageName(t *testing.T) {
 	require.Equal(name.GetTag(), "latest")
 	require.True(name.IsValid())
 	require.Equal("scratch:latest", name.String())
+
+	for _, test := range []struct {
+		input    string
+		registry string
+		repo     string
+		tag      string
+	}{
+		{"[::1]:5000/uber-usi/dockermover:v1", "[::1]:5000", "uber-usi/dockermover", "v1"},
+		{"[::1]:5000/uber-usi/dockermover", "[::1]:5000", "uber-usi/dockermover", "latest"},
+		{"[fd00:1::2]/dockermover:v1", "[fd00:1::2]", "dockermover", "v1"},
+		{"[fd00:1::2]/dockermover", "[fd00:1::2]", "dockermover", "latest"},
+		{"[::ffff:10.0.0.1]:443/dockermover:v1", "[::ffff:10.0.0.1]:443", "dockermover", "v1"},
+	} {
+		name, err = ParseNameForPull(test.input)
+		require.NoError(err)
+		require.Equal(test.registry, name.GetRegistry())
+		require.Equal(test.repo, name.GetRepository())
+		require.Equal(test.tag, name.GetTag())
+		require.True(name.IsValid())
+		require.Equal(test.registry+"/"+test.repo+":"+test.tag, name.String())
+		require.Equal(name, NewImageName(test.registry, test.repo, test.tag))
+	}
+}
+
+func TestParseImageNameDigest(t *testing.T) {
+	digest := "sha256:e4355b66995c96b4b468159fc5c7e3540fcef961189ca13fee877798649f531a"
+	for _, test := range []struct {
+		input    string
+		registry string
+		repo     string
+	}{
+		{"alpine@" + digest, DockerHubRegistry, "library/alpine"},
+		{"alpine:3.10@" + digest, DockerHubRegistry, "library/alpine"},
+		{"127.0.0.1:5000/uber-usi/dockermover@" + digest, "127.0.0.1:5000", "uber-usi/dockermover"},
+		{"[::1]:5000/dockermover:v1@" + digest, "[::1]:5000", "dockermover"},
+	} {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+			name, err := ParseNameForPull(test.input)
+			require.NoError(err)
+			require.Equal(test.registry, name.GetRegistry())
+			require.Equal(test.repo, name.GetRepository())
+			require.Equal(digest, name.GetTag())
+			require.True(name.IsDigest())
+			require.True(name.IsValid())
+			require.Equal(test.registry+"/"+test.repo+"@"+digest, name.String())
+			require.Equal(name, NewImageName(test.registry, test.repo, digest))
+		})
+	}
+
+	t.Run("invalid digest", func(t *testing.T) {
+		_, err := ParseName("alpine@sha256:1234")
+		require.Error(t, err)
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		require.False(t, MustParseName("alpine:3.10").IsDigest())
+	})
 }
@@ -0,0 +1,125 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MediaTypeManifestList specifies the mediaType for manifest lists, which
+	// reference one image manifest per platform.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeOCIIndex specifies the mediaType for OCI image indexes, the OCI
+	// equivalent of manifest lists.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// ManifestList defines a manifest list or OCI index. Makisu pulls the manifest
+// of one of their platforms, and pushes them for multi-platform builds.
+type ManifestList struct {
+	// SchemaVersion is the image manifest schema that this list uses.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// MediaType is the media type of this schema.
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Manifests lists the referenced manifests.
+	Manifests []ManifestListEntry `json:"manifests"`
+}
+
+// ManifestListEntry is a manifest referenced by a manifest list.
+type ManifestListEntry struct {
+	Descriptor
+
+	// Platform is the platform of the referenced image. It is not set for
+	// entries that aren't images, like attestations.
+	Platform *ManifestListPlatform `json:"platform,omitempty"`
+}
+
+// ManifestListPlatform is the platform of a manifest list entry.
+type ManifestListPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// NewManifestList returns a manifest list of the given media type, either
+// MediaTypeManifestList or MediaTypeOCIIndex, without entries.
+func NewManifestList(mediaType string) *ManifestList {
+	return &ManifestList{SchemaVersion: 2, MediaType: mediaType, Manifests: []ManifestListEntry{}}
+}
+
+// Add appends the image manifest of the platform to the list.
+func (list *ManifestList) Add(manifest Descriptor, platform Platform) {
+	list.Manifests = append(list.Manifests, ManifestListEntry{
+		Descriptor: manifest,
+		Platform: &ManifestListPlatform{
+			Architecture: platform.Architecture,
+			OS:           platform.OS,
+			Variant:      platform.Variant,
+		},
+	})
+}
+
+// IsManifestList returns true if the media type is the one of manifest lists
+// or OCI indexes.
+func IsManifestList(mediatype string) bool {
+	return mediatype == MediaTypeManifestList || mediatype == MediaTypeOCIIndex
+}
+
+// UnmarshalManifestList unmarshals a manifest list or OCI index.
+func UnmarshalManifestList(p []byte) (ManifestList, error) {
+	list := ManifestList{}
+	if err := json.Unmarshal(p, &list); err != nil {
+		return ManifestList{}, err
+	}
+	return list, nil
+}
+
+// Select returns the descriptor of the first image manifest of the list that
+// is for the given platform. If the platform has no variant, entries of any
+// variant are selected.
+func (list ManifestList) Select(platform Platform) (Descriptor, error) {
+	var available []string
+	for _, entry := range list.Manifests {
+		if entry.MediaType != MediaTypeManifest && entry.MediaType != MediaTypeOCIManifest {
+			continue
+		}
+		if entry.Platform == nil {
+			continue
+		}
+		other := Platform{
+			OS:           entry.Platform.OS,
+			Architecture: entry.Platform.Architecture,
+			Variant:      entry.Platform.Variant,
+		}
+		if other.OS == platform.OS && other.Architecture == platform.Architecture &&
+			(platform.Variant == "" || other.Variant == platform.Variant) {
+			return entry.Descriptor, nil
+		}
+		available = append(available, other.String())
+	}
+	if len(available) == 0 {
+		return Descriptor{}, errors.New("manifest list has no image manifests")
+	}
+	return Descriptor{}, fmt.Errorf(
+		"manifest list has no image for platform %s, available: %s",
+		platform, strings.Join(available, ", "))
+}
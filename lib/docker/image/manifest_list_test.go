@@ -0,0 +1,101 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testManifestList = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.oci.image.index.v1+json",
+   "manifests": [
+      {
+         "mediaType": "application/vnd.oci.image.manifest.v1+json",
+         "size": 480,
+         "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000001",
+         "platform": {"architecture": "amd64", "os": "linux"}
+      },
+      {
+         "mediaType": "application/vnd.oci.image.manifest.v1+json",
+         "size": 480,
+         "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000002",
+         "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}
+      },
+      {
+         "mediaType": "application/vnd.oci.image.manifest.v1+json",
+         "size": 566,
+         "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000003",
+         "platform": {"architecture": "unknown", "os": "unknown"},
+         "annotations": {"vnd.docker.reference.type": "attestation-manifest"}
+      }
+   ]
+}`
+
+func TestManifestListSelect(t *testing.T) {
+	list, err := UnmarshalManifestList([]byte(testManifestList))
+	require.NoError(t, err)
+
+	t.Run("match", func(t *testing.T) {
+		require := require.New(t)
+		descriptor, err := list.Select(Platform{OS: "linux", Architecture: "arm64"})
+		require.NoError(err)
+		require.Equal(MediaTypeOCIManifest, descriptor.MediaType)
+		require.Equal(Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002"), descriptor.Digest)
+	})
+
+	t.Run("variant", func(t *testing.T) {
+		require := require.New(t)
+		descriptor, err := list.Select(Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+		require.NoError(err)
+		require.Equal(Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002"), descriptor.Digest)
+
+		_, err = list.Select(Platform{OS: "linux", Architecture: "arm64", Variant: "v9"})
+		require.Error(err)
+		require.Contains(err.Error(), "linux/arm64/v8")
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		require := require.New(t)
+		_, err := list.Select(Platform{OS: "linux", Architecture: "s390x"})
+		require.Error(err)
+		require.Contains(err.Error(), "linux/s390x")
+		require.Contains(err.Error(), "linux/amd64, linux/arm64")
+	})
+
+	t.Run("no images", func(t *testing.T) {
+		require := require.New(t)
+		_, err := ManifestList{}.Select(DefaultPlatform())
+		require.Error(err)
+	})
+}
+
+func TestManifestListAdd(t *testing.T) {
+	require := require.New(t)
+	list := NewManifestList(MediaTypeOCIIndex)
+	amd64 := Descriptor{MediaType: MediaTypeOCIManifest, Size: 480, Digest: "sha256:01"}
+	arm64 := Descriptor{MediaType: MediaTypeOCIManifest, Size: 481, Digest: "sha256:02"}
+	list.Add(amd64, Platform{OS: "linux", Architecture: "amd64"})
+	list.Add(arm64, Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+
+	descriptor, err := list.Select(Platform{OS: "linux", Architecture: "arm64"})
+	require.NoError(err)
+	require.Equal(arm64, descriptor)
+	require.Equal("v8", list.Manifests[1].Platform.Variant)
+	require.Equal(2, list.SchemaVersion)
+	require.Equal(MediaTypeOCIIndex, list.MediaType)
+}
@@ -0,0 +1,73 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform is the operating system and CPU architecture an image runs on. The
+// variant of the architecture, like "v7" for arm, is optional.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// DefaultPlatform returns linux on the architecture makisu runs on. The OS is
+// always linux, since images built on other hosts still run on linux.
+func DefaultPlatform() Platform {
+	return Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// ParsePlatform parses a platform formatted as <os>/<architecture>[/<variant>],
+// like "linux/arm64" or "linux/arm/v7".
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" ||
+		(len(parts) == 3 && parts[2] == "") {
+		return Platform{}, fmt.Errorf("invalid platform %s, expected <os>/<architecture>[/<variant>]", s)
+	}
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// String returns the platform formatted as <os>/<architecture>[/<variant>].
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// Platform returns the platform of the image. Fields missing from the config
+// are left empty.
+func (config *Config) Platform() Platform {
+	return Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+}
+
+// Matches returns true if the image platform other is compatible with p.
+// Empty fields of other, as in configs that don't specify them, match anything.
+// Variants are only compared if both platforms have one.
+func (p Platform) Matches(other Platform) bool {
+	return (other.OS == "" || other.OS == p.OS) &&
+		(other.Architecture == "" || other.Architecture == p.Architecture) &&
+		(other.Variant == "" || p.Variant == "" || other.Variant == p.Variant)
+}
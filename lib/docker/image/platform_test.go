@@ -0,0 +1,66 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Platform
+		failed   bool
+	}{
+		{"linux/amd64", Platform{"linux", "amd64", ""}, false},
+		{"linux/arm64", Platform{"linux", "arm64", ""}, false},
+		{"linux/arm/v7", Platform{"linux", "arm", "v7"}, false},
+		{"linux", Platform{}, true},
+		{"linux/", Platform{}, true},
+		{"linux/arm/", Platform{}, true},
+		{"linux/arm/v7/x", Platform{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+			p, err := ParsePlatform(test.input)
+			if test.failed {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, p)
+			require.Equal(test.input, p.String())
+		})
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	require := require.New(t)
+	target := Platform{"linux", "arm64", ""}
+	require.True(target.Matches(Platform{"linux", "arm64", ""}))
+	require.True(target.Matches(Platform{"linux", "arm64", "v8"}))
+	require.True(target.Matches(Platform{}))
+	require.True(target.Matches(Platform{OS: "linux"}))
+	require.False(target.Matches(Platform{"linux", "amd64", ""}))
+	require.False(target.Matches(Platform{"windows", "arm64", ""}))
+
+	target = Platform{"linux", "arm", "v7"}
+	require.True(target.Matches(Platform{"linux", "arm", "v7"}))
+	require.True(target.Matches(Platform{"linux", "arm", ""}))
+	require.False(target.Matches(Platform{"linux", "arm", "v6"}))
+}
@@ -0,0 +1,72 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule relocates the images pulled for FROM and COPY --from: image
+// references whose <registry>/<repo> fully match the pattern are rewritten to
+// the target, which can refer to capture groups of the pattern, like $1.
+type RewriteRule struct {
+	pattern *regexp.Regexp
+	target  string
+}
+
+// RewriteRules are applied to image references by Rewrite. Only the first
+// matching rule is applied.
+var RewriteRules []RewriteRule
+
+// SetRewriteRules parses rules formatted as <pattern>=<target> and sets global
+// var RewriteRules.
+func SetRewriteRules(rules []string) error {
+	result := make([]RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || i == len(rule)-1 {
+			return fmt.Errorf("invalid rewrite rule %s: must be <pattern>=<target>", rule)
+		}
+		pattern, err := regexp.Compile("^(?:" + rule[:i] + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid rewrite rule pattern %s: %s", rule[:i], err)
+		}
+		result = append(result, RewriteRule{pattern, rule[i+1:]})
+	}
+	RewriteRules = result
+	return nil
+}
+
+// Rewrite applies the first matching rule of RewriteRules to the registry and
+// repository of a name returned by ParseNameForPull.
+func (name Name) Rewrite() (Name, error) {
+	ref := name.registry + "/" + name.repository
+	for _, rule := range RewriteRules {
+		if !rule.pattern.MatchString(ref) {
+			continue
+		}
+		target := rule.pattern.ReplaceAllString(ref, rule.target)
+		rewritten, err := ParseName(target + ":" + name.tag)
+		if err != nil {
+			return name, fmt.Errorf("rewrite %s to %s: %s", ref, target, err)
+		} else if rewritten.registry == "" || rewritten.repository == "" {
+			return name, fmt.Errorf("rewrite %s to %s: target must be <registry>/<repo>", ref, target)
+		}
+		return rewritten, nil
+	}
+	return name, nil
+}
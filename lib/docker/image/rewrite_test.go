@@ -0,0 +1,65 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrite(t *testing.T) {
+	require.NoError(t, SetRewriteRules([]string{
+		`index.docker.io/(.*)=internal.reg/dockerhub/$1`,
+		`gcr.io/([^/]+)/(.*)=internal.reg:5000/gcr-$1/$2`,
+		`gcr.io/.*=internal.reg/never`,
+		`quay.io/bad=bad`,
+	}))
+	defer SetRewriteRules(nil)
+
+	tests := []struct {
+		input    string
+		expected string
+		hasError bool
+	}{
+		{"alpine:3.10", "internal.reg/dockerhub/library/alpine:3.10", false},
+		{"index.docker.io/org/app", "internal.reg/dockerhub/org/app:latest", false},
+		{"gcr.io/project/tools/app:v1", "internal.reg:5000/gcr-project/tools/app:v1", false},
+		{"mygcr.io/project/app:v1", "mygcr.io/project/app:v1", false},
+		{"internal.reg/foo:1", "internal.reg/foo:1", false},
+		{"quay.io/bad:1", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+			name, err := ParseNameForPull(test.input)
+			require.NoError(err)
+			rewritten, err := name.Rewrite()
+			if test.hasError {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, rewritten.String())
+		})
+	}
+}
+
+func TestSetRewriteRulesInvalid(t *testing.T) {
+	defer SetRewriteRules(nil)
+	for _, rule := range []string{"", "noequal", "=target", "pattern=", "(=target"} {
+		require.Error(t, SetRewriteRules([]string{rule}), rule)
+	}
+}
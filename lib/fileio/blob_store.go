@@ -0,0 +1,75 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BlobStore content-addresses the regular files written by a copier, so that
+// files with identical contents are hard links to a single blob instead of
+// distinct copies. Hard links share their mode, owner and mtime, so blobs are
+// keyed by those too.
+// Files linked to a blob must never be written in place, which is why it is
+// only used for files that are read-only copies, like the checkpoints of
+// stages.
+type BlobStore struct {
+	sync.Mutex
+
+	dir        string
+	emptyFiles bool
+}
+
+// NewBlobStore creates a BlobStore that keeps its blobs in dir, which must be
+// on the same filesystem as the files linked to them. Empty files are only
+// linked if emptyFiles is true, as sharing them saves inodes, but no space.
+func NewBlobStore(dir string, emptyFiles bool) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create blob dir %s: %s", dir, err)
+	}
+	return &BlobStore{dir: dir, emptyFiles: emptyFiles}, nil
+}
+
+// accepts returns true if the regular file of the given info should be
+// linked to a blob.
+func (s *BlobStore) accepts(fi os.FileInfo) bool {
+	return fi.Size() > 0 || s.emptyFiles
+}
+
+// blobPath returns the path of the blob with the content of the file at src,
+// and the given mode, owner and mtime.
+func (s *BlobStore) blobPath(
+	src string, mode os.FileMode, uid, gid int, mtime time.Time) (string, error) {
+
+	r, err := Open(src)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %s", src, err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("hash %s: %s", src, err)
+	}
+	name := fmt.Sprintf("%s-%o-%d-%d-%d",
+		hex.EncodeToString(h.Sum(nil)), uint32(mode), uid, gid, mtime.UnixNano())
+	return filepath.Join(s.dir, name), nil
+}
@@ -22,6 +22,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
@@ -38,25 +40,68 @@ type Copier interface {
 }
 
 type copier struct {
-	blacklist []string
+	blacklist     []string
+	maxModTime    time.Time
+	specialFiles  bool
+	sameFileError bool
+	blobs         *BlobStore
+}
+
+// CopierOption configures a Copier.
+type CopierOption func(*copier)
+
+// WithMaxModTime makes the copier clamp mtimes to t. Copied files and dirs
+// keep the mtime of their source if it is earlier, and the dirs created for
+// them get t instead of the current time.
+func WithMaxModTime(t time.Time) CopierOption {
+	return func(c *copier) { c.maxModTime = t }
+}
+
+// WithSpecialFiles makes the copier create device nodes and named pipes at the
+// target like their source, instead of skipping them. Sockets are always
+// skipped.
+func WithSpecialFiles(enabled bool) CopierOption {
+	return func(c *copier) { c.specialFiles = enabled }
+}
+
+// WithSameFileError makes the copier fail to copy a file onto itself, e.g.
+// from a build context under the root to where it is. Otherwise the content of
+// the file is left as is, and only its owner is changed.
+func WithSameFileError(enabled bool) CopierOption {
+	return func(c *copier) { c.sameFileError = enabled }
+}
+
+// WithBlobStore makes the copier link the regular files it copies to the blobs
+// of s with the same content, instead of writing a copy of each of them. A nil
+// store disables it.
+func WithBlobStore(s *BlobStore) CopierOption {
+	return func(c *copier) { c.blobs = s }
 }
 
 // NewCopier initializes a new copier object. Files from provided blacklist will
 // be ignored.
-func NewCopier(blacklist []string) Copier {
-	return &copier{
+func NewCopier(blacklist []string, opts ...CopierOption) Copier {
+	c := &copier{
 		blacklist: append(blacklist),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // NewInternalCopier initializes a new copier object. It is used for copying
 // checkpointed files from sandbox dir, and there is no need to blacklist any
 // path, since they would have been filtered out by checkpoint.
-func NewInternalCopier() Copier {
-	return &copier{}
+func NewInternalCopier(opts ...CopierOption) Copier {
+	c := &copier{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-// CopyFile copies the content and permissions of the file at src to dst.
+// CopyFile copies the content, permissions and mtime of the file at src to dst.
 // If the target file exists, its contents and permissions will be replaced.
 // If the parent directories of dst do not exist, they will be created with
 // the given uid/gid.
@@ -64,7 +109,7 @@ func NewInternalCopier() Copier {
 func (c copier) CopyFile(source, target string, uid, gid int) error {
 	// Make target parent directories (uid and gid will be computed from the sources one).
 	targetDir := filepath.Dir(target)
-	if err := mkdirAll(targetDir, os.ModePerm, uid, gid, false); err != nil {
+	if err := c.mkdirAll(targetDir, os.ModePerm, uid, gid, false); err != nil {
 		return fmt.Errorf("mkdir all %s: %s", targetDir, err)
 	}
 	// Copy file permissions and contents.
@@ -75,7 +120,7 @@ func (c copier) CopyFile(source, target string, uid, gid int) error {
 func (c copier) CopyFilePreserveOwner(source, target string) error {
 	// Make target parent directories with passed uid & gid if they don't exist.
 	targetDir := filepath.Dir(target)
-	if err := mkdirAll(targetDir, os.ModePerm, 0, 0, true); err != nil {
+	if err := c.mkdirAll(targetDir, os.ModePerm, 0, 0, true); err != nil {
 		return fmt.Errorf("mkdir all %s: %s", targetDir, err)
 	}
 	// Copy file permissions and contents.
@@ -86,7 +131,8 @@ func (c copier) CopyFilePreserveOwner(source, target string) error {
 // directory must exist, and the target doesn't need to exist but must be a
 // directory if it does. If the target or any of its ancestors do not exist,
 // they are created with default permissions and owned by the given uid/gid.
-// Permissions and ownership are preserved for directories and files under source.
+// Permissions, ownership and mtimes are preserved for directories and files
+// under source.
 // Symlinks are copied with their original target (not guaranteed to be valid).
 //
 // If src contains dst, this function would break infinite loop silently.
@@ -101,11 +147,7 @@ func (c copier) CopyDir(source, target string, uid, gid int) error {
 		return nil
 	}
 	// Make target parent directories with passed uid & gid if they don't exist.
-	if err := mkdirAll(target, os.ModePerm, uid, gid, false); err != nil {
-		return fmt.Errorf("mkdir all %s: %s", target, err)
-	}
-	// Recursively copy directories and files.
-	return c.copyDirContents(source, target, target, uid, gid, false)
+	return c.copyDirTo(source, target, uid, gid, false)
 }
 
 // CopyDirPreserveOwner follow the behavior of CopyFile but preserve file rights.
@@ -116,11 +158,26 @@ func (c copier) CopyDirPreserveOwner(source, target string) error {
 		return nil
 	}
 	// Make target parent directories (uid and gid will be computed from the sources one).
-	if err := mkdirAll(target, os.ModePerm, 0, 0, true); err != nil {
+	return c.copyDirTo(source, target, 0, 0, true)
+}
+
+// copyDirTo creates target and its parents if they don't exist, and copies the
+// contents of source into it.
+func (c copier) copyDirTo(source, target string, uid, gid int, preserveOwner bool) error {
+	_, err := os.Lstat(target)
+	created := os.IsNotExist(err)
+	if err := c.mkdirAll(target, os.ModePerm, uid, gid, preserveOwner); err != nil {
 		return fmt.Errorf("mkdir all %s: %s", target, err)
 	}
 	// Recursively copy directories and files.
-	return c.copyDirContents(source, target, target, 0, 0, true)
+	if err := c.copyDirContents(source, target, target, uid, gid, preserveOwner); err != nil {
+		return err
+	}
+	if created && !c.maxModTime.IsZero() {
+		// Copying the contents updated the mtime of the created target.
+		return c.chtimes(target, c.maxModTime)
+	}
+	return nil
 }
 
 func (c copier) isBlacklisted(source string) bool {
@@ -136,8 +193,25 @@ func (c copier) copyFile(src, dst string, uid, gid int, preserveOwner bool) erro
 		// Do nothing if this file is blacklisted.
 		log.Infof("* Ignoring copy of file %s because it is blacklisted", src)
 	} else if utils.IsSpecialFile(fi) {
-		// If this is a socket/device/named-pipe, do nothing.
-		return nil
+		// Sockets, devices and named pipes are never read, as reading them
+		// could block forever.
+		if !c.specialFiles || fi.Mode()&os.ModeSocket != 0 {
+			log.Warnf("Skipping copy of special file %s", src)
+			return nil
+		}
+		if preserveOwner {
+			uid, gid = fileOwners(fi)
+		}
+		return c.copySpecialFile(fi, src, dst, uid, gid)
+	}
+
+	// Copying a file onto itself, by path or through a hard link, would
+	// truncate it before reading it.
+	if dstInfo, err := os.Lstat(dst); err == nil && os.SameFile(fi, dstInfo) {
+		if preserveOwner {
+			uid, gid = fileOwners(fi)
+		}
+		return c.copySameFile(fi, src, dst, uid, gid)
 	}
 
 	// Handle symlinks.
@@ -146,9 +220,19 @@ func (c copier) copyFile(src, dst string, uid, gid int, preserveOwner bool) erro
 		return c.copySymlink(src, dst)
 	}
 
-	// If the file already exists, then we will overwrite that file.
-	if _, err := os.Lstat(dst); err != nil && !os.IsNotExist(err) {
+	// If the file already exists, then we will overwrite that file, unless
+	// it is a special file, which opening could block on.
+	if dstInfo, err := os.Lstat(dst); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("lstat %s: %s", dst, err)
+	} else if err == nil && utils.IsSpecialFile(dstInfo) {
+		if err := os.Remove(dst); err != nil {
+			return fmt.Errorf("remove existing special file %s: %s", dst, err)
+		}
+	} else if err == nil && c.blobs != nil {
+		// The existing file may be linked to a blob, which must not change.
+		if err := os.Remove(dst); err != nil {
+			return fmt.Errorf("remove existing file %s: %s", dst, err)
+		}
 	} else if err == nil {
 		if err := os.Chmod(dst, os.ModePerm); err != nil {
 			return fmt.Errorf("chmod %s: %s", dst, err)
@@ -160,12 +244,42 @@ func (c copier) copyFile(src, dst string, uid, gid int, preserveOwner bool) erro
 	}
 
 	// Handle regular files.
+	if c.blobs != nil && c.blobs.accepts(fi) {
+		return c.linkRegularFile(fi, src, dst, uid, gid)
+	}
 	return c.copyRegularFile(fi, src, dst, uid, gid)
 }
 
+// linkRegularFile hard links dst to the blob with the content and metadata of
+// src, which is copied from src first if it doesn't exist yet. It falls back to
+// copying src to dst if the link cannot be created, e.g. because the blob has
+// too many links already.
+func (c copier) linkRegularFile(fi os.FileInfo, src, dst string, uid, gid int) error {
+	blob, err := c.blobs.blobPath(src, fi.Mode(), uid, gid, c.modTime(fi.ModTime()))
+	if err != nil {
+		return fmt.Errorf("get blob of %s: %s", src, err)
+	}
+
+	c.blobs.Lock()
+	defer c.blobs.Unlock()
+	if _, err := os.Lstat(blob); os.IsNotExist(err) {
+		if err := c.copyRegularFile(fi, src, blob, uid, gid); err != nil {
+			os.Remove(blob)
+			return fmt.Errorf("create blob of %s: %s", src, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("lstat %s: %s", blob, err)
+	}
+	if err := os.Link(blob, dst); err != nil {
+		log.Warnf("Failed to link %s to blob, copying it instead: %s", dst, err)
+		return c.copyRegularFile(fi, src, dst, uid, gid)
+	}
+	return nil
+}
+
 // Open both files, creating dst if need be.
 func (c copier) copyRegularFile(fi os.FileInfo, src, dst string, uid, gid int) error {
-	r, err := os.Open(src)
+	r, err := Open(src)
 	if err != nil {
 		return fmt.Errorf("open %s: %s", dst, err)
 	}
@@ -181,21 +295,65 @@ func (c copier) copyRegularFile(fi os.FileInfo, src, dst string, uid, gid int) e
 
 	// Copy contents from src to dst.
 	if _, err := io.Copy(w, r); err != nil {
-		return fmt.Errorf("copy %s to %s: %s", src, dst, err)
+		return fmt.Errorf("copy %s to %s: %s", src, dst, utils.CheckOutOfDisk(err, dst))
 	}
 
 	// Change the owner and mode of dst to that of src.
 	// Note: Chmod needs to be called after chown, otherwise setuid and setgid
 	// bits could be unset.
-	if err := os.Chown(dst, uid, gid); err != nil {
+	if err := utils.Chown(dst, uid, gid); err != nil {
 		return fmt.Errorf("chown %s: %s", dst, err)
 	}
 	if err := os.Chmod(dst, fi.Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %s", dst, err)
 	}
+	return c.chtimes(dst, fi.ModTime())
+}
+
+// copySameFile handles copies of src onto dst when they are the same file. The
+// content, mode and mtime are already those of the source, so only the owner
+// is set, unless the copier fails on such copies.
+func (c copier) copySameFile(fi os.FileInfo, src, dst string, uid, gid int) error {
+	if c.sameFileError {
+		return fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+	log.Infof("* Skipping copy of %s onto itself at %s", src, dst)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := utils.Chown(dst, uid, gid); err != nil {
+		return fmt.Errorf("chown %s: %s", dst, err)
+	}
+	// Chown unsets setuid and setgid bits.
+	if err := os.Chmod(dst, fi.Mode()); err != nil {
+		return fmt.Errorf("chmod %s: %s", dst, err)
+	}
 	return nil
 }
 
+// copySpecialFile creates a device node or named pipe at dst with the mode
+// and device number of the one at src. Devices can only be created by root,
+// so they are skipped with a warning otherwise.
+func (c copier) copySpecialFile(fi os.FileInfo, src, dst string, uid, gid int) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove existing file %s: %s", dst, err)
+	}
+	stat := utils.FileInfoStat(fi)
+	if err := syscall.Mknod(dst, uint32(stat.Mode), int(stat.Rdev)); errors.Is(err, syscall.EPERM) {
+		log.Warnf("Skipping copy of special file %s: %s", src, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("mknod %s: %s", dst, err)
+	}
+	if err := utils.Chown(dst, uid, gid); err != nil {
+		return fmt.Errorf("chown %s: %s", dst, err)
+	}
+	if err := os.Chmod(dst, fi.Mode()); err != nil {
+		return fmt.Errorf("chmod %s: %s", dst, err)
+	}
+	return c.chtimes(dst, fi.ModTime())
+}
+
 func (c copier) copySymlink(src, dst string) error {
 	// Remove existing file if path exists.
 	if _, err := os.Lstat(dst); err == nil {
@@ -231,13 +389,23 @@ func (c copier) copyDirContents(src, dst, origDst string, uid, gid int, preserve
 			continue
 		}
 		currDst := filepath.Join(dst, entry.Name())
-		if entry.IsDir() {
+		if entry.IsDir() && isSymlinkToDir(currDst) {
+			// Like docker, the contents are copied into the target of the
+			// link, which is left as is.
+			if err := c.copyDirContents(currSrc, currDst, origDst, uid, gid, preserveOwner); err != nil {
+				return fmt.Errorf("copy dir contents %s to %s: %s", currSrc, currDst, err)
+			}
+		} else if entry.IsDir() {
 			if err := c.copyDir(currSrc, currDst, uid, gid, preserveOwner); err != nil {
 				return fmt.Errorf("copy dir %s to %s: %s", currSrc, currDst, err)
 			}
 			if err := c.copyDirContents(currSrc, currDst, origDst, uid, gid, preserveOwner); err != nil {
 				return fmt.Errorf("copy dir contents %s to %s: %s", currSrc, currDst, err)
 			}
+			// Copying the contents updated the mtime of the dir.
+			if err := c.chtimes(currDst, entry.ModTime()); err != nil {
+				return err
+			}
 		} else {
 			if err := c.copyFile(currSrc, currDst, uid, gid, preserveOwner); err != nil {
 				return fmt.Errorf("copy file %s to %s: %s", currSrc, currDst, err)
@@ -247,6 +415,15 @@ func (c copier) copyDirContents(src, dst, origDst string, uid, gid int, preserve
 	return nil
 }
 
+// isSymlinkToDir returns true if p is a symlink whose target is a directory.
+func isSymlinkToDir(p string) bool {
+	if fi, err := os.Lstat(p); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
 // copyDir copies the directory at src to dst.
 func (c copier) copyDir(src, dst string, uid, gid int, preserveOwner bool) error {
 	srcInfo, err := os.Lstat(src)
@@ -278,7 +455,7 @@ func (c copier) copyDir(src, dst string, uid, gid int, preserveOwner bool) error
 	if preserveOwner {
 		uid, gid = fileOwners(srcInfo)
 	}
-	if err := os.Chown(dst, uid, gid); err != nil {
+	if err := utils.Chown(dst, uid, gid); err != nil {
 		return fmt.Errorf("chown %s: %s", dst, err)
 	}
 	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
@@ -287,9 +464,28 @@ func (c copier) copyDir(src, dst string, uid, gid int, preserveOwner bool) error
 	return nil
 }
 
+// chtimes sets the mtime of path, clamped to maxModTime if it is set.
+// Symlinks are followed, so they are left as is.
+func (c copier) chtimes(path string, mtime time.Time) error {
+	mtime = c.modTime(mtime)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return fmt.Errorf("chtimes %s: %s", path, err)
+	}
+	return nil
+}
+
+// modTime returns the mtime given to copies of files with the given mtime.
+func (c copier) modTime(mtime time.Time) time.Time {
+	if !c.maxModTime.IsZero() && mtime.After(c.maxModTime) {
+		return c.maxModTime
+	}
+	return mtime
+}
+
 // mkdirAll performs the same operation as os.MkdirAll, but also sets the given
-// permissions & owners on all created directories.
-func mkdirAll(dst string, mode os.FileMode, uid, gid int, preserveOwner bool) error {
+// permissions & owners on all created directories. If maxModTime is set, it is
+// the mtime of the created directories.
+func (c copier) mkdirAll(dst string, mode os.FileMode, uid, gid int, preserveOwner bool) error {
 	if dst == "" {
 		return errors.New("empty target directory")
 	}
@@ -302,6 +498,7 @@ func mkdirAll(dst string, mode os.FileMode, uid, gid int, preserveOwner bool) er
 	split[0] = "/"
 
 	var prevDir string
+	var created []string
 	for _, dir := range split {
 		absDir := filepath.Join(prevDir, dir)
 		if fi, err := os.Lstat(absDir); err != nil {
@@ -313,12 +510,22 @@ func mkdirAll(dst string, mode os.FileMode, uid, gid int, preserveOwner bool) er
 			if preserveOwner {
 				uid, gid = fileOwners(fi)
 			}
-			if err := os.Chown(absDir, uid, gid); err != nil {
+			if err := utils.Chown(absDir, uid, gid); err != nil {
 				return fmt.Errorf("chown %s: %s", absDir, err)
 			}
+			created = append(created, absDir)
 		}
 		prevDir = absDir
 	}
+	if c.maxModTime.IsZero() {
+		return nil
+	}
+	// Children are created after their parent, which updates its mtime.
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := c.chtimes(created[i], c.maxModTime); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -15,11 +15,15 @@
 package fileio
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/utils"
@@ -304,6 +308,37 @@ func TestCopyDirectoryIncludingSymlink(t *testing.T) {
 	require.Equal("Test source file two", string(resultTwo))
 }
 
+func TestCopyDirectoryTargetSymlinkToDir(t *testing.T) {
+	require := require.New(t)
+
+	sourceDir, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(sourceDir)
+	targetDir, err := ioutil.TempDir("/tmp", "testCopyTargetDir")
+	require.NoError(err)
+	defer os.RemoveAll(targetDir)
+
+	require.NoError(os.Mkdir(path.Join(sourceDir, "app"), 0755))
+	require.NoError(ioutil.WriteFile(path.Join(sourceDir, "app", "file"), []byte("Test source file"), 0644))
+
+	// The app dir of the target links to another dir.
+	linkTarget := path.Join(targetDir, "data")
+	require.NoError(os.Mkdir(linkTarget, 0755))
+	require.NoError(os.Symlink(linkTarget, path.Join(targetDir, "app")))
+
+	// Perform copy.
+	c := NewCopier(pathutils.DefaultBlacklist)
+	require.NoError(c.CopyDir(sourceDir, targetDir, currUID, currGID))
+
+	// Verify the link is kept and the file copied to its target.
+	fi, err := os.Lstat(path.Join(targetDir, "app"))
+	require.NoError(err)
+	require.True(fi.Mode()&os.ModeSymlink != 0)
+	result, err := ioutil.ReadFile(path.Join(linkTarget, "file"))
+	require.NoError(err)
+	require.Equal("Test source file", string(result))
+}
+
 func TestCopyDirectoryInfiniteLoop(t *testing.T) {
 	require := require.New(t)
 
@@ -353,3 +388,317 @@ func TestCopyDirectoryInfiniteLoop(t *testing.T) {
 	_, err = os.Stat(path.Join(targetDir, path.Base(targetDir)))
 	require.True(os.IsNotExist(err))
 }
+
+func TestCopyDirPreservesModTime(t *testing.T) {
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	epoch := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc       string
+		opts       []CopierOption
+		newModTime func(now time.Time) time.Time // Expected mtime of new files.
+	}{
+		{"preserve", nil, func(now time.Time) time.Time { return now }},
+		{"clamp", []CopierOption{WithMaxModTime(epoch)}, func(time.Time) time.Time { return epoch }},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			source, err := ioutil.TempDir("/tmp", "testCopy")
+			require.NoError(err)
+			defer os.RemoveAll(source)
+			target, err := ioutil.TempDir("/tmp", "testCopy")
+			require.NoError(err)
+			defer os.RemoveAll(target)
+
+			require.NoError(os.Mkdir(filepath.Join(source, "dir"), 0755))
+			require.NoError(ioutil.WriteFile(filepath.Join(source, "dir/old.txt"), []byte("old"), 0644))
+			require.NoError(os.Chtimes(filepath.Join(source, "dir/old.txt"), old, old))
+			require.NoError(ioutil.WriteFile(filepath.Join(source, "dir/new.txt"), []byte("new"), 0644))
+			require.NoError(os.Chtimes(filepath.Join(source, "dir"), old, old))
+			newFi, err := os.Stat(filepath.Join(source, "dir/new.txt"))
+			require.NoError(err)
+
+			c := NewCopier(nil, test.opts...)
+			require.NoError(c.CopyDir(source, filepath.Join(target, "a/b"), currUID, currGID))
+
+			for p, expected := range map[string]time.Time{
+				"a/b/dir":         old,
+				"a/b/dir/old.txt": old,
+				"a/b/dir/new.txt": test.newModTime(newFi.ModTime()),
+			} {
+				fi, err := os.Stat(filepath.Join(target, p))
+				require.NoError(err)
+				require.True(expected.Equal(fi.ModTime()), "%s: %s", p, fi.ModTime())
+			}
+			if len(test.opts) != 0 {
+				// Created dirs get the max mtime as well.
+				for _, p := range []string{"a", "a/b"} {
+					fi, err := os.Stat(filepath.Join(target, p))
+					require.NoError(err)
+					require.True(epoch.Equal(fi.ModTime()), "%s: %s", p, fi.ModTime())
+				}
+			}
+		})
+	}
+}
+
+func TestCopyFileSpecialFiles(t *testing.T) {
+	t.Run("FifoSkipped", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "fifo")
+		require.NoError(syscall.Mkfifo(source, 0644))
+
+		target := filepath.Join(dir, "target")
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		_, err = os.Lstat(target)
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("FifoKept", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "fifo")
+		require.NoError(syscall.Mkfifo(source, 0640))
+
+		target := filepath.Join(dir, "target")
+		c := NewCopier(pathutils.DefaultBlacklist, WithSpecialFiles(true))
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		fi, err := os.Lstat(target)
+		require.NoError(err)
+		require.Equal(os.ModeNamedPipe|0640, fi.Mode())
+	})
+
+	t.Run("CharDeviceKept", func(t *testing.T) {
+		require := require.New(t)
+		if os.Geteuid() != 0 {
+			t.Skip("creating devices requires root")
+		}
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		source := filepath.Join(dir, "null")
+		require.NoError(syscall.Mknod(source, syscall.S_IFCHR|0666, 1<<8|3))
+
+		target := filepath.Join(dir, "target")
+		c := NewCopier(pathutils.DefaultBlacklist, WithSpecialFiles(true))
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		fi, err := os.Lstat(target)
+		require.NoError(err)
+		sourceInfo, err := os.Lstat(source)
+		require.NoError(err)
+		require.Equal(sourceInfo.Mode(), fi.Mode())
+		require.Equal(utils.FileInfoStat(sourceInfo).Rdev, utils.FileInfoStat(fi).Rdev)
+	})
+
+	t.Run("SocketAlwaysSkipped", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "sock")
+		l, err := net.Listen("unix", source)
+		require.NoError(err)
+		defer l.Close()
+
+		target := filepath.Join(dir, "target")
+		c := NewCopier(pathutils.DefaultBlacklist, WithSpecialFiles(true))
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		_, err = os.Lstat(target)
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("FileOverFifo", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "file")
+		require.NoError(ioutil.WriteFile(source, []byte("content"), 0644))
+
+		// Opening the fifo to write to it would block forever.
+		target := filepath.Join(dir, "fifo")
+		require.NoError(syscall.Mkfifo(target, 0644))
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		result, err := ioutil.ReadFile(target)
+		require.NoError(err)
+		require.Equal("content", string(result))
+	})
+}
+
+func TestCopyOntoItself(t *testing.T) {
+	t.Run("File", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "file")
+		require.NoError(ioutil.WriteFile(source, []byte("content"), 0750))
+
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyFile(source, source, currUID, currGID))
+		content, err := ioutil.ReadFile(source)
+		require.NoError(err)
+		require.Equal("content", string(content))
+		fi, err := os.Lstat(source)
+		require.NoError(err)
+		require.Equal(os.FileMode(0750), fi.Mode())
+	})
+
+	t.Run("HardLink", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "file")
+		require.NoError(ioutil.WriteFile(source, []byte("content"), 0644))
+		target := filepath.Join(dir, "link")
+		require.NoError(os.Link(source, target))
+
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyFile(source, target, currUID, currGID))
+		content, err := ioutil.ReadFile(source)
+		require.NoError(err)
+		require.Equal("content", string(content))
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "link")
+		require.NoError(os.Symlink("target", source))
+
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyFile(source, source, currUID, currGID))
+		linkTarget, err := os.Readlink(source)
+		require.NoError(err)
+		require.Equal("target", linkTarget)
+	})
+
+	t.Run("Dir", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		require.NoError(os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("content"), 0644))
+
+		c := NewCopier(pathutils.DefaultBlacklist)
+		require.NoError(c.CopyDir(dir, dir, currUID, currGID))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "sub/file"))
+		require.NoError(err)
+		require.Equal("content", string(content))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("/tmp", "testCopy")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		source := filepath.Join(dir, "file")
+		require.NoError(ioutil.WriteFile(source, []byte("content"), 0644))
+
+		c := NewCopier(pathutils.DefaultBlacklist, WithSameFileError(true))
+		err = c.CopyFile(source, source, currUID, currGID)
+		require.Error(err)
+		require.Contains(err.Error(), "same file")
+		content, err := ioutil.ReadFile(source)
+		require.NoError(err)
+		require.Equal("content", string(content))
+	})
+}
+
+func TestCopyDirBlobStore(t *testing.T) {
+	mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, emptyFiles := range []bool{false, true} {
+		t.Run(fmt.Sprintf("empty files %v", emptyFiles), func(t *testing.T) {
+			require := require.New(t)
+
+			source, err := ioutil.TempDir("/tmp", "testCopy")
+			require.NoError(err)
+			defer os.RemoveAll(source)
+			target, err := ioutil.TempDir("/tmp", "testCopy")
+			require.NoError(err)
+			defer os.RemoveAll(target)
+
+			for name, mode := range map[string]os.FileMode{
+				"a.txt": 0644, "dir/b.txt": 0644, "c.txt": 0600, "d.txt": 0644,
+				"e1": 0644, "dir/e2": 0644,
+			} {
+				content := "same"
+				if name == "d.txt" {
+					content = "other"
+				} else if name == "e1" || name == "dir/e2" {
+					content = ""
+				}
+				p := filepath.Join(source, name)
+				require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+				require.NoError(ioutil.WriteFile(p, []byte(content), mode))
+				require.NoError(os.Chmod(p, mode))
+				require.NoError(os.Chtimes(p, mtime, mtime))
+			}
+
+			blobs, err := NewBlobStore(filepath.Join(target, "blobs"), emptyFiles)
+			require.NoError(err)
+			dst := filepath.Join(target, "dst")
+			c := NewCopier(nil, WithBlobStore(blobs))
+			require.NoError(c.CopyDir(source, dst, currUID, currGID))
+
+			sameFile := func(a, b string) bool {
+				fa, err := os.Stat(filepath.Join(dst, a))
+				require.NoError(err)
+				fb, err := os.Stat(filepath.Join(dst, b))
+				require.NoError(err)
+				return os.SameFile(fa, fb)
+			}
+			require.True(sameFile("a.txt", "dir/b.txt"))
+			require.False(sameFile("a.txt", "c.txt"))
+			require.False(sameFile("a.txt", "d.txt"))
+			require.Equal(emptyFiles, sameFile("e1", "dir/e2"))
+			for name, expected := range map[string]string{
+				"a.txt": "same", "dir/b.txt": "same", "c.txt": "same", "d.txt": "other",
+			} {
+				content, err := ioutil.ReadFile(filepath.Join(dst, name))
+				require.NoError(err)
+				require.Equal(expected, string(content))
+			}
+			fi, err := os.Stat(filepath.Join(dst, "c.txt"))
+			require.NoError(err)
+			require.Equal(os.FileMode(0600), fi.Mode())
+			require.True(mtime.Equal(fi.ModTime()))
+
+			// Copying a changed file again doesn't change the files that
+			// shared its blob.
+			require.NoError(ioutil.WriteFile(filepath.Join(source, "a.txt"), []byte("changed"), 0644))
+			require.NoError(c.CopyFile(filepath.Join(source, "a.txt"), filepath.Join(dst, "a.txt"), currUID, currGID))
+			content, err := ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+			require.NoError(err)
+			require.Equal("changed", string(content))
+			content, err = ioutil.ReadFile(filepath.Join(dst, "dir/b.txt"))
+			require.NoError(err)
+			require.Equal("same", string(content))
+		})
+	}
+}
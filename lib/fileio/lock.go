@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockRetryInterval is the interval between two attempts to acquire a lock.
+const lockRetryInterval = 20 * time.Millisecond
+
+// FileLock is an exclusive advisory lock backed by flock(2). It can be used to
+// synchronize multiple processes sharing the same directory.
+type FileLock struct {
+	path string
+	f    *os.File
+}
+
+// NewFileLock returns a new FileLock backed by the file at path. The file and
+// its parent directories are created when the lock is acquired.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Lock acquires the lock, waiting up to timeout for other holders to release
+// it. A timeout of 0 means waiting forever.
+func (l *FileLock) Lock(timeout time.Duration) error {
+	if l.f != nil {
+		return fmt.Errorf("lock %s already acquired", l.path)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("create lock dir: %s", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open lock file: %s", err)
+	}
+
+	start := time.Now()
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			l.f = f
+			return nil
+		} else if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return fmt.Errorf("flock %s: %s", l.path, err)
+		} else if timeout > 0 && time.Since(start) > timeout {
+			f.Close()
+			return fmt.Errorf("timed out after %v waiting for lock %s", timeout, l.path)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	if l.f == nil {
+		return fmt.Errorf("lock %s not acquired", l.path)
+	}
+	defer func() { l.f = nil }()
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return fmt.Errorf("unlock %s: %s", l.path, err)
+	}
+	return l.f.Close()
+}
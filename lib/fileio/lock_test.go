@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locks", "test.lock")
+
+	t.Run("lock and unlock", func(t *testing.T) {
+		require := require.New(t)
+		l := NewFileLock(path)
+		require.NoError(l.Lock(time.Second))
+		require.Error(l.Lock(time.Second))
+		require.NoError(l.Unlock())
+		require.Error(l.Unlock())
+		require.NoError(l.Lock(time.Second))
+		require.NoError(l.Unlock())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		require := require.New(t)
+		l1 := NewFileLock(path)
+		l2 := NewFileLock(path)
+		require.NoError(l1.Lock(time.Second))
+		require.Error(l2.Lock(100 * time.Millisecond))
+
+		done := make(chan error)
+		go func() { done <- l2.Lock(5 * time.Second) }()
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(l1.Unlock())
+		require.NoError(<-done)
+		require.NoError(l2.Unlock())
+	})
+}
@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultMaxOpenFiles is the default number of files opened with Open that
+// can be open at the same time.
+const DefaultMaxOpenFiles = 256
+
+var openFiles = make(chan struct{}, DefaultMaxOpenFiles)
+
+// SetMaxOpenFiles limits the number of files opened with Open that can be open
+// at the same time across the whole build, including the files hashed for the
+// cache IDs of COPY and ADD steps and the files written to layers. It must be
+// called before any file is opened.
+func SetMaxOpenFiles(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid max open files %d, must be at least 1", n)
+	}
+	openFiles = make(chan struct{}, n)
+	return nil
+}
+
+// File is a file opened with Open. Closing it lets another file be opened.
+type File struct {
+	*os.File
+
+	slots chan struct{}
+	once  sync.Once
+}
+
+// Open opens the file at path for reading like os.Open, but waits while the
+// max number of files opened with it are open. The returned file must be
+// closed, and must be closed before opening another file with Open in the
+// same goroutine.
+func Open(path string) (*File, error) {
+	slots := openFiles
+	slots <- struct{}{}
+	f, err := os.Open(path)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	return &File{File: f, slots: slots}, nil
+}
+
+// Close closes the file, and releases its slot.
+func (f *File) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() { <-f.slots })
+	return err
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(path, []byte("content"), 0644))
+
+	defer SetMaxOpenFiles(DefaultMaxOpenFiles)
+	require.Error(SetMaxOpenFiles(0))
+	require.NoError(SetMaxOpenFiles(1))
+
+	f, err := Open(path)
+	require.NoError(err)
+
+	// The second open waits for the first file to be closed.
+	opened := make(chan *File)
+	go func() {
+		f, err := Open(path)
+		if err != nil {
+			opened <- nil
+			return
+		}
+		opened <- f
+	}()
+	select {
+	case <-opened:
+		require.FailNow("file opened while the max number of files was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(f.Close())
+	// Closing again doesn't release another slot.
+	require.Error(f.Close())
+	select {
+	case f := <-opened:
+		require.NotNil(f)
+		b, err := ioutil.ReadAll(f)
+		require.NoError(err)
+		require.Equal("content", string(b))
+		require.NoError(f.Close())
+	case <-time.After(5 * time.Second):
+		require.FailNow("file not opened after the first one was closed")
+	}
+
+	// Failed opens don't hold their slot.
+	_, err = Open(filepath.Join(dir, "missing"))
+	require.True(os.IsNotExist(err))
+	f, err = Open(path)
+	require.NoError(err)
+	require.NoError(f.Close())
+}
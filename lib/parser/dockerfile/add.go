@@ -15,23 +15,52 @@
 package dockerfile
 
 import (
+	"strconv"
 	"strings"
 )
 
 // AddDirective represents the "ADD" dockerfile command.
 type AddDirective struct {
 	*addCopyDirective
+	Unpack bool
 }
 
+// Variables:
+//   Replaced from ARGs and ENVs from within our stage.
+// Formats:
+//   ADD [--chown=<user>:<group>] [--unpack=<bool>] ["<src>",... "<dest>"]
+//   ADD [--chown=<user>:<group>] [--unpack=<bool>] <src>... <dest>
 func newAddDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	d, err := newAddCopyDirective(base, strings.Fields(base.Args))
+	args := strings.Fields(base.Args)
+
+	// Flags can be specified in any order, the ones shared with COPY are
+	// passed through.
+	unpack := true
+	var rest []string
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if val, ok, err := parseFlag(arg, "unpack"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			if unpack, err = strconv.ParseBool(val); err != nil {
+				return nil, base.err(errMalformedUnpack)
+			}
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+
+	d, err := newAddCopyDirective(base, rest)
 	if err != nil {
 		return nil, err
 	}
-	return &AddDirective{d}, nil
+	return &AddDirective{d, unpack}, nil
 }
 
 // Add this command to the build stage.
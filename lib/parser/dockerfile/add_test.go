@@ -31,20 +31,26 @@ func TestNewAddDirective(t *testing.T) {
 		srcs    []string
 		dst     string
 		chown   string
+		unpack  bool
 	}{
-		{"shell single source", true, `add src dst`, []string{"src"}, "dst", ""},
-		{"shell multi source", true, `add src1 src2 dst`, []string{"src1", "src2"}, "dst", ""},
-		{"shell substitution", true, `add src1 ${prefix}src2 dst$suffix`, []string{"src1", "test_src2"}, "dst_test", ""},
-		{"shell substitution bad", false, "add src1 ${prefix", nil, "", ""},
-		{"shell chown", true, `add --chown=user:group src dst`, []string{"src"}, "dst", "user:group"},
-		{"shell chown bad", false, `add --chown= src dst`, nil, "", ""},
-		{"shell chown substitution", true, `add --chown=${prefix}user:group src1 ${prefix}src2 dst$suffix`, []string{"src1", "test_src2"}, "dst_test", "test_user:group"},
-		{"json bad", false, `add ["src"]`, nil, "", ""},
-		{"json single source", true, `add ["src", "dst"]`, []string{"src"}, "dst", ""},
-		{"json multi source", true, `add ["src1", "src2", "dst"]`, []string{"src1", "src2"}, "dst", ""},
-		{"json substitution", true, `add ["src1"$comma "src2${suffix}", "${prefix}dst"]`, []string{"src1", "src2_test"}, "test_dst", ""},
-		{"json chown", true, `add --chown=user:group ["src", "dst"]`, []string{"src"}, "dst", "user:group"},
-		{"json chown substitution", true, `add --chown=${prefix}user:group ["src1"$comma "src2${suffix}", "${prefix}dst"]`, []string{"src1", "src2_test"}, "test_dst", "test_user:group"},
+		{"shell single source", true, `add src dst`, []string{"src"}, "dst", "", true},
+		{"shell multi source", true, `add src1 src2 dst`, []string{"src1", "src2"}, "dst", "", true},
+		{"shell substitution", true, `add src1 ${prefix}src2 dst$suffix`, []string{"src1", "test_src2"}, "dst_test", "", true},
+		{"shell substitution bad", false, "add src1 ${prefix", nil, "", "", true},
+		{"shell chown", true, `add --chown=user:group src dst`, []string{"src"}, "dst", "user:group", true},
+		{"shell chown bad", false, `add --chown= src dst`, nil, "", "", true},
+		{"shell chown substitution", true, `add --chown=${prefix}user:group src1 ${prefix}src2 dst$suffix`, []string{"src1", "test_src2"}, "dst_test", "test_user:group", true},
+		{"json bad", false, `add ["src"]`, nil, "", "", true},
+		{"json single source", true, `add ["src", "dst"]`, []string{"src"}, "dst", "", true},
+		{"json multi source", true, `add ["src1", "src2", "dst"]`, []string{"src1", "src2"}, "dst", "", true},
+		{"json substitution", true, `add ["src1"$comma "src2${suffix}", "${prefix}dst"]`, []string{"src1", "src2_test"}, "test_dst", "", true},
+		{"json chown", true, `add --chown=user:group ["src", "dst"]`, []string{"src"}, "dst", "user:group", true},
+		{"shell unpack false", true, `add --unpack=false src dst`, []string{"src"}, "dst", "", false},
+		{"shell unpack true", true, `add --unpack=true src dst`, []string{"src"}, "dst", "", true},
+		{"shell unpack and chown", true, `add --unpack=false --chown=user:group src dst`, []string{"src"}, "dst", "user:group", false},
+		{"shell unpack bad", false, `add --unpack=maybe src dst`, nil, "", "", false},
+		{"json unpack false", true, `add --unpack=false ["src", "dst"]`, []string{"src"}, "dst", "", false},
+		{"json chown substitution", true, `add --chown=${prefix}user:group ["src1"$comma "src2${suffix}", "${prefix}dst"]`, []string{"src1", "src2_test"}, "test_dst", "test_user:group", true},
 	}
 
 	for _, test := range tests {
@@ -58,6 +64,7 @@ func TestNewAddDirective(t *testing.T) {
 				require.Equal(test.srcs, cast.Srcs)
 				require.Equal(test.dst, cast.Dst)
 				require.Equal(test.chown, cast.Chown)
+				require.Equal(test.unpack, cast.Unpack)
 			} else {
 				require.Error(err)
 			}
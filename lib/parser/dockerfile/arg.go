@@ -60,7 +60,8 @@ func newArgDirective(base *baseDirective, state *parsingState) (Directive, error
 // If we have not yet entered the first stage (encountered a FROM directive), we update
 // the global args map.
 // Else, we update the current stage variables.
-// In either case, we only update the variable if it has a default value or a value is passed.
+// In either case, we only update the variable if it has a default value or a value is passed,
+// if it re-declares a global ARG within a stage, or if an arg default is given.
 func (d *ArgDirective) update(state *parsingState) error {
 	var global bool
 	vars := state.stageVars
@@ -74,6 +75,14 @@ func (d *ArgDirective) update(state *parsingState) error {
 	} else if d.DefaultVal != "" {
 		vars[d.Name] = d.DefaultVal
 		d.ResolvedVal = &d.DefaultVal
+	} else if val, ok := state.globalArgs[d.Name]; ok && !global {
+		// Like docker, a global ARG re-declared without a value in a stage
+		// inherits the global value.
+		vars[d.Name] = val
+		d.ResolvedVal = &val
+	} else if val, ok := state.argDefaults[d.Name]; ok {
+		vars[d.Name] = val
+		d.ResolvedVal = &val
 	}
 	if !global {
 		return state.addToCurrStage(d)
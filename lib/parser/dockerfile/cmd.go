@@ -14,10 +14,16 @@
 
 package dockerfile
 
+import "strings"
+
 // CmdDirective represents the "CMD" dockerfile command.
 type CmdDirective struct {
 	*baseDirective
 	Cmd []string
+
+	// ShellCmd is the command as written if it is in shell form, and empty
+	// if it is a JSON array.
+	ShellCmd string
 }
 
 // Variables:
@@ -31,14 +37,14 @@ func newCmdDirective(base *baseDirective, state *parsingState) (Directive, error
 		return nil, err
 	}
 	if cmd, ok := parseJSONArray(base.Args); ok {
-		return &CmdDirective{base, cmd}, nil
+		return &CmdDirective{base, cmd, ""}, nil
 	}
 
 	args, err := splitArgs(base.Args)
 	if err != nil {
 		return nil, base.err(err)
 	}
-	return &CmdDirective{base, args}, nil
+	return &CmdDirective{base, args, strings.TrimSpace(base.Args)}, nil
 }
 
 // Add this command to the build stage.
@@ -23,11 +23,14 @@ import (
 )
 
 var (
+	errAmbiguousEnv         = errors.New("Ambiguous ENV, quote the value or use <key>=<value> for every variable")
 	errBeforeFirstFrom      = errors.New("Invalid directive before first build stage (FROM)")
 	errMalformedChown       = errors.New("Malformed chown argument")
 	errMalformedKeyVal      = errors.New("Malformed key/value pairs")
+	errMalformedMount       = errors.New("Malformed mount argument")
+	errMalformedParents     = errors.New("Malformed parents argument")
+	errMalformedUnpack      = errors.New("Malformed unpack argument")
 	errMissingArgs          = errors.New("Missing arguments")
-	errMissingSpace         = errors.New("Missing space in single variable ENV")
 	errNotExactlyOneArg     = errors.New("Expected exactly one argument")
 	errUnsupportedDirective = errors.New("Unsupported directive type")
 )
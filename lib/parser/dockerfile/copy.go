@@ -15,6 +15,7 @@
 package dockerfile
 
 import (
+	"strconv"
 	"strings"
 )
 
@@ -22,39 +23,52 @@ import (
 type CopyDirective struct {
 	*addCopyDirective
 	FromStage string
+	Parents   bool
 }
 
 // Variables:
 //   Replaced from ARGs and ENVs from within our stage.
 // Formats:
-//   COPY [--from=<name|index>] [--chown=<user>:<group>] ["<src>",... "<dest>"]
-//   COPY [--from=<name|index>] [--chown=<user>:<group>] <src>... <dest>
+//   COPY [--from=<name|index>] [--chown=<user>:<group>] [--parents] ["<src>",... "<dest>"]
+//   COPY [--from=<name|index>] [--chown=<user>:<group>] [--parents] <src>... <dest>
 func newCopyDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
 	args := strings.Fields(base.Args)
 
+	// Flags can be specified in any order, the ones shared with ADD are passed
+	// through.
 	var fromStage string
-	if val, ok, err := parseFlag(args[0], "from"); err != nil {
-		return nil, base.err(err)
-	} else if ok {
-		fromStage = val
-		args = args[1:]
-	} else if len(args) >= 3 {
-		if val, ok, err := parseFlag(args[1], "from"); err != nil {
+	var parents bool
+	var rest []string
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if val, ok, err := parseFlag(arg, "from"); err != nil {
 			return nil, base.err(err)
 		} else if ok {
 			fromStage = val
-			args = append([]string{args[0]}, args[2:]...)
+		} else if arg == "--parents" {
+			parents = true
+		} else if val, ok, err := parseFlag(arg, "parents"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			if parents, err = strconv.ParseBool(val); err != nil {
+				return nil, base.err(errMalformedParents)
+			}
+		} else {
+			rest = append(rest, arg)
 		}
 	}
 
-	d, err := newAddCopyDirective(base, args)
+	d, err := newAddCopyDirective(base, rest)
 	if err != nil {
 		return nil, err
 	}
-	return &CopyDirective{d, fromStage}, nil
+	return &CopyDirective{d, fromStage, parents}, nil
 }
 
 // Add this command to the build stage.
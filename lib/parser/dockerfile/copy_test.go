@@ -73,3 +73,45 @@ func TestNewCopyDirective(t *testing.T) {
 		})
 	}
 }
+
+func TestNewCopyDirectiveParents(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{}
+
+	tests := []struct {
+		desc      string
+		succeed   bool
+		input     string
+		srcs      []string
+		fromStage string
+		chown     string
+		parents   bool
+	}{
+		{"no parents", true, `copy src dst/`, []string{"src"}, "", "", false},
+		{"parents", true, `copy --parents src/a/b.txt dst/`, []string{"src/a/b.txt"}, "", "", true},
+		{"parents value", true, `copy --parents=true src dst/`, []string{"src"}, "", "", true},
+		{"parents false", true, `copy --parents=false src dst/`, []string{"src"}, "", "", false},
+		{"parents bad value", false, `copy --parents=maybe src dst/`, nil, "", "", false},
+		{"parents from chown", true, `copy --parents --chown=user:group --from=stage src dst/`, []string{"src"}, "stage", "user:group", true},
+		{"from parents chown", true, `copy --from=stage --chown=user:group --parents src dst/`, []string{"src"}, "stage", "user:group", true},
+		{"parents json", true, `copy --parents ["src1", "src2", "dst/"]`, []string{"src1", "src2"}, "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				cast, ok := directive.(*CopyDirective)
+				require.True(ok)
+				require.Equal(test.srcs, cast.Srcs)
+				require.Equal(test.fromStage, cast.FromStage)
+				require.Equal(test.chown, cast.Chown)
+				require.Equal(test.parents, cast.Parents)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	customDirectivesMu sync.RWMutex
+	customDirectives   = make(map[string]bool)
+)
+
+// CustomDirective represents a directive that isn't part of the dockerfile
+// spec, which was registered with RegisterDirective.
+type CustomDirective struct {
+	*baseDirective
+}
+
+// RegisterDirective makes the parser accept the directive of the given name,
+// case insensitive, as a CustomDirective. Builtin directives cannot be
+// overridden.
+func RegisterDirective(name string) error {
+	name = strings.ToLower(name)
+	if _, found := directiveConstructors[name]; found {
+		return fmt.Errorf("directive %s is builtin", name)
+	} else if name == "" || strings.ContainsAny(name, " \t\n#") {
+		return fmt.Errorf("invalid directive name: %q", name)
+	}
+	customDirectivesMu.Lock()
+	defer customDirectivesMu.Unlock()
+	customDirectives[name] = true
+	return nil
+}
+
+// isCustomDirective returns true if the directive was registered.
+func isCustomDirective(name string) bool {
+	customDirectivesMu.RLock()
+	defer customDirectivesMu.RUnlock()
+	return customDirectives[name]
+}
+
+// Name returns the name of the directive, in upper case.
+func (d *CustomDirective) Name() string {
+	return strings.ToUpper(d.t)
+}
+
+// Variables:
+//   Replaced from ARGs and ENVs from within our stage.
+// Formats:
+//   <NAME> <args>
+func newCustomDirective(base *baseDirective, state *parsingState) (Directive, error) {
+	if err := base.replaceVarsCurrStage(state); err != nil {
+		return nil, err
+	}
+	return &CustomDirective{base}, nil
+}
+
+// Add this command to the build stage.
+func (d *CustomDirective) update(state *parsingState) error {
+	return state.addToCurrStage(d)
+}
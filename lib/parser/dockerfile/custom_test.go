@@ -0,0 +1,50 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDirective(t *testing.T) {
+	require := require.New(t)
+
+	require.Error(RegisterDirective("run"))
+	require.Error(RegisterDirective("COPY"))
+	require.Error(RegisterDirective(""))
+	require.Error(RegisterDirective("two words"))
+	require.NoError(RegisterDirective("TEST_CUSTOM"))
+}
+
+func TestNewCustomDirective(t *testing.T) {
+	require := require.New(t)
+	require.NoError(RegisterDirective("test_custom"))
+
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{"ID": "token"}
+
+	directive, err := newDirective("TEST_CUSTOM id=${ID} #!COMMIT", buildState)
+	require.NoError(err)
+	casted, ok := directive.(*CustomDirective)
+	require.True(ok)
+	require.Equal("TEST_CUSTOM", casted.Name())
+	require.Equal("id=token", casted.Args)
+	require.True(casted.Commit)
+
+	_, err = newDirective("TEST_UNREGISTERED id=token", buildState)
+	require.Error(err)
+}
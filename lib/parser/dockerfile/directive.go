@@ -53,7 +53,9 @@ func newDirective(line string, state *parsingState) (Directive, error) {
 	}
 
 	cons, found := directiveConstructors[base.t]
-	if !found {
+	if !found && isCustomDirective(base.t) {
+		cons = newCustomDirective
+	} else if !found {
 		return nil, base.err(errUnsupportedDirective)
 	}
 	return cons(base, state)
@@ -14,10 +14,16 @@
 
 package dockerfile
 
+import "strings"
+
 // EntrypointDirective represents the "ENTRYPOINT" dockerfile command.
 type EntrypointDirective struct {
 	*baseDirective
 	Entrypoint []string
+
+	// ShellCmd is the command as written if it is in shell form, and empty
+	// if it is a JSON array.
+	ShellCmd string
 }
 
 // Variables:
@@ -31,14 +37,14 @@ func newEntrypointDirective(base *baseDirective, state *parsingState) (Directive
 	}
 
 	if entrypoint, ok := parseJSONArray(base.Args); ok {
-		return &EntrypointDirective{base, entrypoint}, nil
+		return &EntrypointDirective{base, entrypoint, ""}, nil
 	}
 
 	args, err := splitArgs(base.Args)
 	if err != nil {
 		return nil, base.err(err)
 	}
-	return &EntrypointDirective{base, args}, nil
+	return &EntrypointDirective{base, args, strings.TrimSpace(base.Args)}, nil
 }
 
 // Add this command to the build stage.
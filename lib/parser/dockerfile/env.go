@@ -16,12 +16,15 @@ package dockerfile
 
 import (
 	"strings"
+	"unicode"
 )
 
 // EnvDirective represents the "ENV" dockerfile command.
 type EnvDirective struct {
 	*baseDirective
 	Envs map[string]string
+	// Keys are the keys of Envs in the order they were declared.
+	Keys []string
 }
 
 // Variables:
@@ -29,31 +32,74 @@ type EnvDirective struct {
 // Formats:
 //   ENV <key> <value>
 //   ENV <key>=<value> ...
+//   ENV <key>
 func newEnvDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	if vars, err := parseKeyVals(base.Args); err == nil {
-		return &EnvDirective{base, vars}, nil
+	if vars, keys, err := parseOrderedKeyVals(base.Args); err == nil {
+		return &EnvDirective{base, vars, keys}, nil
 	}
 
 	// Formatted as <key> <value>. Find index of space.
 	idx := strings.Index(base.Args, " ")
 	if idx == -1 || idx == len(base.Args)-1 {
-		return nil, base.err(errMissingSpace)
+		// Formatted as <key>, which takes the value of the ARG or ENV of the
+		// stage, or else of the build arg, of the same name.
+		key := strings.TrimSuffix(base.Args, " ")
+		for _, r := range key {
+			if err := validKeyRune(r); err != nil {
+				return nil, base.err(err)
+			}
+		}
+		return &EnvDirective{base, map[string]string{key: state.lookupVar(key)}, []string{key}}, nil
 	}
 
 	// Split on the 1st space (including whitespace characters).
 	key := base.Args[:idx]
 	val := base.Args[idx+1:]
 
-	return &EnvDirective{base, map[string]string{key: val}}, nil
+	// A value made of <key>=<value> pairs could be meant as variables too,
+	// e.g. "ENV A B=c" as A with no value and B, and isn't guessed. Values
+	// like "-Dfile.encoding=UTF-8" are only ever options.
+	if isKeyValsOnly(val) {
+		return nil, base.err(errAmbiguousEnv)
+	}
+
+	return &EnvDirective{base, map[string]string{key: val}, []string{key}}, nil
+}
+
+// isKeyValsOnly returns true if every whitespace separated token of s is a
+// <key>=<value> pair whose key is an identifier, like a shell variable name.
+func isKeyValsOnly(s string) bool {
+	tokens := strings.Fields(s)
+	if len(tokens) == 0 {
+		return false
+	}
+	for _, token := range tokens {
+		idx := strings.Index(token, "=")
+		if idx <= 0 || !isIdentifier(token[:idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentifier returns true if s is made of letters, digits and underscores,
+// and doesn't start with a digit.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return s != ""
 }
 
 // Add this command to the build stage and update stage variables.
 func (d *EnvDirective) update(state *parsingState) error {
-	for k, v := range d.Envs {
-		state.stageVars[k] = v
+	for _, k := range d.Keys {
+		state.stageVars[k] = d.Envs[k]
 	}
 	return state.addToCurrStage(d)
 }
@@ -21,7 +21,7 @@ import (
 )
 
 func TestNewEnvDirective(t *testing.T) {
-	buildState := newParsingState(make(map[string]string))
+	buildState := newParsingState(map[string]string{"passed": "build_arg", "prefix": "passed_"})
 	buildState.stageVars = map[string]string{"prefix": "test_", "suffix": "_test", "space": " "}
 
 	tests := []struct {
@@ -39,6 +39,19 @@ func TestNewEnvDirective(t *testing.T) {
 		{"substitution", true, "env k1=${prefix}v1 k2=v2$suffix", map[string]string{"k1": "test_v1", "k2": "v2_test"}},
 		{"bad substitution", false, "env k1=${prefixv1 k2=v2$suffix", nil},
 		{"quotes_substitution", true, `env k1="v1a${space}v1b"`, map[string]string{"k1": "v1a v1b"}},
+		{"no value from stage", true, "env prefix", map[string]string{"prefix": "test_"}},
+		{"no value from build arg", true, "env passed", map[string]string{"passed": "build_arg"}},
+		{"no value unset", true, "env k1", map[string]string{"k1": ""}},
+		{"no value invalid key", false, "env k1/v1", nil},
+		{"ambiguous", false, "env k1 k2=v2", nil},
+		{"ambiguous multiple", false, "env k1 k2=v2 k3=v3", nil},
+		{"single with separator", true, "env k1 -Dk2=v2 -Xmx1g", map[string]string{"k1": "-Dk2=v2 -Xmx1g"}},
+		{"single with option", true, "env JAVA_OPTS -Dfile.encoding=UTF-8", map[string]string{"JAVA_OPTS": "-Dfile.encoding=UTF-8"}},
+		{"single with dotted option", true, "env MAVEN_OPTS -Dmaven.repo.local=/root/.m2", map[string]string{"MAVEN_OPTS": "-Dmaven.repo.local=/root/.m2"}},
+		{"single with flag", true, "env GOFLAGS -mod=vendor", map[string]string{"GOFLAGS": "-mod=vendor"}},
+		{"single with dotted key", true, "env k1 a.b=c", map[string]string{"k1": "a.b=c"}},
+		{"single with pair and word", true, "env k1 k2=v2 word", map[string]string{"k1": "k2=v2 word"}},
+		{"single with leading digit", true, "env k1 2k=v", map[string]string{"k1": "2k=v"}},
 	}
 
 	for _, test := range tests {
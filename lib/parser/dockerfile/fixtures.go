@@ -21,18 +21,18 @@ func FromDirectiveFixture(args, image, alias string) *FromDirective {
 
 // RunDirectiveFixture returns a RunDirective for testing purposes.
 func RunDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, false}, cmd}
+	return &RunDirective{&baseDirective{"run", args, false}, cmd, nil}
 }
 
 // RunCommitDirectiveFixture returns a RunDirective with a commit annotation
 // for testing purposes.
 func RunCommitDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, true}, cmd}
+	return &RunDirective{&baseDirective{"run", args, true}, cmd, nil}
 }
 
 // CmdDirectiveFixture returns a CmdDirective for testing purposes.
 func CmdDirectiveFixture(args string, cmd []string) *CmdDirective {
-	return &CmdDirective{&baseDirective{"cmd", args, false}, cmd}
+	return &CmdDirective{&baseDirective{"cmd", args, false}, cmd, ""}
 }
 
 // LabelDirectiveFixture returns a LabelDirective for testing purposes.
@@ -55,17 +55,18 @@ func CopyDirectiveFixture(args, chown, fromStage string, srcs []string, dst stri
 			dst,
 		},
 		fromStage,
+		false,
 	}
 }
 
 // EntrypointDirectiveFixture returns a EntrypointDirective for testing purposes.
 func EntrypointDirectiveFixture(args string, entrypoint []string) *EntrypointDirective {
-	return &EntrypointDirective{&baseDirective{"entrypoint", args, false}, entrypoint}
+	return &EntrypointDirective{&baseDirective{"entrypoint", args, false}, entrypoint, ""}
 }
 
 // EnvDirectiveFixture returns a EnvDirective for testing purposes.
 func EnvDirectiveFixture(args string, envs map[string]string) *EnvDirective {
-	return &EnvDirective{&baseDirective{"env", args, false}, envs}
+	return &EnvDirective{&baseDirective{"env", args, false}, envs, sortedKeys(envs)}
 }
 
 // UserDirectiveFixture returns a UserDirective for testing purposes.
@@ -92,5 +93,6 @@ func AddDirectiveFixture(args, chown string, srcs []string, dst string) *AddDire
 			srcs,
 			dst,
 		},
+		true,
 	}
 }
@@ -52,8 +52,9 @@ func newFromDirective(base *baseDirective, state *parsingState) (Directive, erro
 // update:
 //   1) Adds a new stage to the parsing state containing the from directive.
 //   2) Resets the stage variables.
+//   3) Adds the default args and envs to the stage.
 func (d *FromDirective) update(state *parsingState) error {
 	state.addStage(newStage(d))
 	state.stageVars = make(map[string]string)
-	return nil
+	return state.addDefaults()
 }
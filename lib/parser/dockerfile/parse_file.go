@@ -15,53 +15,101 @@
 package dockerfile
 
 import (
-	"bufio"
 	"fmt"
 	"strings"
 )
 
 // ParseFile parses dockerfile from given reader, returns a ParsedFile object.
 func ParseFile(filecontents string, args map[string]string) ([]*Stage, error) {
-	filecontents = removeCommentLines(filecontents)
-	filecontents = strings.Replace(filecontents, "\\\n", "", -1)
-	reader := strings.NewReader(filecontents)
-	scanner := bufio.NewScanner(reader)
+	return ParseFileWithDefaults(filecontents, args, nil, nil)
+}
+
+// ParseFileWithDefaults is like ParseFile, but also declares the default args
+// before the first stage and at the beginning of every stage, and sets the
+// default envs at the beginning of every stage, after the args.
+// Args passed in take precedence over default args, and both can be
+// overridden by the ARG and ENV directives of the dockerfile.
+func ParseFileWithDefaults(
+	filecontents string, args, defaultArgs, defaultEnvs map[string]string) ([]*Stage, error) {
+
+	return ParseFileWithArgDefaults(filecontents, args, nil, defaultArgs, defaultEnvs)
+}
+
+// ParseFileWithArgDefaults is like ParseFileWithDefaults, but also resolves
+// the ARG directives that are neither passed in args nor given a default value
+// by the dockerfile to their value in argDefaults. Unlike default args, arg
+// defaults don't declare any ARG.
+func ParseFileWithArgDefaults(
+	filecontents string, args, argDefaults, defaultArgs, defaultEnvs map[string]string) ([]*Stage, error) {
+
+	stages, _, err := ParseFileWithLines(filecontents, args, argDefaults, defaultArgs, defaultEnvs)
+	return stages, err
+}
+
+// Lines maps the directives of a parsed dockerfile to the 1-based number of the
+// line they start at. Directives declared from default args and envs are not
+// in the dockerfile, and have no line.
+type Lines map[Directive]int
+
+// ParseFileWithLines is like ParseFileWithArgDefaults, but also returns the
+// lines of the directives.
+func ParseFileWithLines(
+	filecontents string, args, argDefaults, defaultArgs, defaultEnvs map[string]string) ([]*Stage, Lines, error) {
 
 	if args == nil {
 		args = make(map[string]string)
 	}
 
 	state := newParsingState(args)
-	var count int
-	for scanner.Scan() {
-		count++
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("file scanning failed (line %d): %s", count, err)
-		}
-		text := scanner.Text()
-		if directive, err := newDirective(text, state); err != nil {
-			return nil, fmt.Errorf("failed to create new directive (line %d): %s", count, err)
+	state.argDefaults = argDefaults
+	state.setDefaults(defaultArgs, defaultEnvs)
+	lines := make(Lines)
+	for _, line := range logicalLines(filecontents) {
+		if directive, err := newDirective(line.text, state); err != nil {
+			return nil, nil, fmt.Errorf("failed to create new directive (line %d): %s", line.number, err)
 		} else if directive == nil {
 			continue
 		} else if err := directive.update(state); err != nil {
-			return nil, fmt.Errorf("failed to update parser state (line %d): %s", count, err)
+			return nil, nil, fmt.Errorf("failed to update parser state (line %d): %s", line.number, err)
+		} else {
+			lines[directive] = line.number
 		}
 	}
 
-	return state.stages, nil
+	return state.stages, lines, nil
+}
+
+// sourceLine is a directive line of a dockerfile, with its continuations
+// joined, and the number of the line it starts at.
+type sourceLine struct {
+	text   string
+	number int
 }
 
-func removeCommentLines(filecontents string) string {
-	lines := strings.Split(filecontents, "\n")
-	var output string
-	for _, line := range lines {
+// logicalLines removes the comment and empty lines of the dockerfile, and joins
+// lines ending with a backslash with the next ones. Comment lines within
+// continued lines are removed too.
+func logicalLines(filecontents string) []sourceLine {
+	var lines []sourceLine
+	var current *sourceLine
+	for i, line := range strings.Split(filecontents, "\n") {
 		trimmed := strings.Trim(line, " \t")
-		if len(trimmed) != 0 && trimmed[0] == '#' {
+		if len(trimmed) == 0 || trimmed[0] == '#' {
 			continue
-		} else if len(trimmed) == 0 {
+		}
+		if current == nil {
+			current = &sourceLine{number: i + 1}
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.text += strings.TrimSuffix(line, "\\")
 			continue
 		}
-		output += line + "\n"
+		current.text += line
+		lines = append(lines, *current)
+		current = nil
+	}
+	if current != nil {
+		lines = append(lines, *current)
 	}
-	return output
+	return lines
 }
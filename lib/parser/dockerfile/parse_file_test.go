@@ -89,7 +89,69 @@ func TestParseSucceeds(t *testing.T) {
 	}
 }
 
-func TestRemoveComments(t *testing.T) {
+func TestParseFileWithDefaults(t *testing.T) {
+	require := require.New(t)
+
+	dockerfile := `
+	FROM alpine:${tag} AS build
+	ENV proxy=overridden
+	CMD ${proxy} ${mirror}
+	FROM alpine:latest
+	ARG mirror=dockerfile
+	CMD ${proxy} ${mirror} ${tag}
+	`
+	stages, err := ParseFileWithDefaults(
+		dockerfile,
+		map[string]string{"tag": "3.9"},
+		map[string]string{"mirror": "global", "tag": "latest"},
+		map[string]string{"proxy": "extra"})
+	require.NoError(err)
+	require.Len(stages, 2)
+
+	require.Equal("alpine:3.9", stages[0].From.Image)
+	for _, stage := range stages {
+		mirror := stage.Directives[0].(*ArgDirective)
+		require.Equal("mirror", mirror.Name)
+		require.Equal("global", *mirror.ResolvedVal)
+		tag := stage.Directives[1].(*ArgDirective)
+		require.Equal("tag", tag.Name)
+		require.Equal("3.9", *tag.ResolvedVal)
+		env := stage.Directives[2].(*EnvDirective)
+		require.Equal(map[string]string{"proxy": "extra"}, env.Envs)
+	}
+	require.Equal([]string{"overridden", "global"}, stages[0].Directives[4].(*CmdDirective).Cmd)
+	require.Equal([]string{"extra", "dockerfile", "3.9"}, stages[1].Directives[4].(*CmdDirective).Cmd)
+}
+
+func TestParseFileWithArgDefaults(t *testing.T) {
+	require := require.New(t)
+
+	dockerfile := `
+	ARG tag
+	FROM alpine:${tag}
+	ARG tag
+	ARG mirror=dockerfile
+	ARG proxy
+	ARG version
+	ARG unset
+	CMD ${tag} ${mirror} ${proxy} ${version} ${unset}
+	`
+	stages, err := ParseFileWithArgDefaults(
+		dockerfile,
+		map[string]string{"version": "passed"},
+		map[string]string{"tag": "3.9", "mirror": "config", "proxy": "config", "version": "config"},
+		nil, nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+
+	require.Equal("alpine:3.9", stages[0].From.Image)
+	require.Equal(
+		[]string{"3.9", "dockerfile", "config", "passed", "${unset}"},
+		stages[0].Directives[5].(*CmdDirective).Cmd)
+	require.Nil(stages[0].Directives[4].(*ArgDirective).ResolvedVal)
+}
+
+func TestLogicalLines(t *testing.T) {
 	t.Run("simple", func(t *testing.T) {
 		contents := `RUN echo asd #!COMMIT
 	RUN apt-get install -y qwasd \
@@ -97,15 +159,38 @@ func TestRemoveComments(t *testing.T) {
 		# asdwqe
 		zxczxd #!COMMIT
 `
-		cleaned := `RUN echo asd #!COMMIT
-	RUN apt-get install -y qwasd \
-		zxczxd #!COMMIT
-`
-		output := removeCommentLines(contents)
-		require.Equal(t, output, cleaned)
+		expected := []sourceLine{
+			{"RUN echo asd #!COMMIT", 1},
+			{"\tRUN apt-get install -y qwasd \t\tzxczxd #!COMMIT", 2},
+		}
+		require.Equal(t, expected, logicalLines(contents))
 	})
 }
 
+func TestParseFileWithLines(t *testing.T) {
+	require := require.New(t)
+	contents := `# comment
+FROM alpine:3.9
+
+RUN apk add \
+    curl
+USER nobody
+`
+	stages, lines, err := ParseFileWithLines(contents, nil, nil, nil, map[string]string{"key": "value"})
+	require.NoError(err)
+	require.Len(stages, 1)
+	require.Equal(2, lines[stages[0].From])
+	require.Len(stages[0].Directives, 3)
+	// The ENV of the default envs is not in the dockerfile.
+	require.Equal(0, lines[stages[0].Directives[0]])
+	require.Equal(4, lines[stages[0].Directives[1]])
+	require.Equal(6, lines[stages[0].Directives[2]])
+
+	_, _, err = ParseFileWithLines("FROM alpine\n\nBAD directive\n", nil, nil, nil, nil)
+	require.Error(err)
+	require.Contains(err.Error(), "line 3")
+}
+
 func invalidDirective() []*test {
 	return []*test{{
 		desc:       "invalid directive",
@@ -295,6 +380,7 @@ func stageArgs() []*test {
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
 		[]string{"${cmd}"},
+		"${cmd}",
 	})
 
 	tests = append(tests, &test{
@@ -324,6 +410,7 @@ func stageArgs() []*test {
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
 		[]string{"${cmd}"},
+		"${cmd}",
 	})
 
 	tests = append(tests, &test{
@@ -356,6 +443,7 @@ func stageArgs() []*test {
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "ls", false},
 		[]string{"ls"},
+		"ls",
 	})
 	stage2 := newStage(&FromDirective{
 		&baseDirective{"from", "alpine:latest AS alias2", false},
@@ -365,6 +453,7 @@ func stageArgs() []*test {
 	stage2.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
 		[]string{"${cmd}"},
+		"${cmd}",
 	})
 
 	tests = append(tests, &test{
@@ -395,6 +484,7 @@ func stageArgs() []*test {
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "ls", false},
 		[]string{"ls"},
+		"ls",
 	})
 
 	tests = append(tests, &test{
@@ -405,6 +495,100 @@ func stageArgs() []*test {
 		stages:     []*Stage{stage},
 	})
 
+	dockerfile = `
+	ARG cmd=ls
+	FROM alpine:latest AS alias1
+	ARG cmd
+	CMD ${cmd}
+	FROM alpine:latest AS alias2
+	CMD ${cmd}
+	`
+	stage1 = newStage(&FromDirective{
+		&baseDirective{"from", "alpine:latest AS alias1", false},
+		"alpine:latest",
+		"alias1",
+	})
+	paramVal = "ls"
+	stage1.addDirective(&ArgDirective{
+		&baseDirective{"arg", "cmd", false},
+		"cmd",
+		"",
+		&paramVal,
+	})
+	stage1.addDirective(&CmdDirective{
+		&baseDirective{"cmd", "ls", false},
+		[]string{"ls"},
+		"ls",
+	})
+	stage2 = newStage(&FromDirective{
+		&baseDirective{"from", "alpine:latest AS alias2", false},
+		"alpine:latest",
+		"alias2",
+	})
+	stage2.addDirective(&CmdDirective{
+		&baseDirective{"cmd", "${cmd}", false},
+		[]string{"${cmd}"},
+		"${cmd}",
+	})
+
+	tests = append(tests, &test{
+		desc:       "global arg re-declared in stage",
+		dockerfile: dockerfile,
+		args:       nil,
+		succeed:    true,
+		stages:     []*Stage{stage1, stage2},
+	})
+
+	dockerfile = `
+	FROM alpine:latest AS alias1
+	ARG cmd=ls
+	CMD ${cmd}
+	FROM alpine:latest AS alias2
+	ARG cmd
+	CMD ${cmd}
+	`
+	stage1 = newStage(&FromDirective{
+		&baseDirective{"from", "alpine:latest AS alias1", false},
+		"alpine:latest",
+		"alias1",
+	})
+	paramVal = "ls"
+	stage1.addDirective(&ArgDirective{
+		&baseDirective{"arg", "cmd=ls", false},
+		"cmd",
+		"ls",
+		&paramVal,
+	})
+	stage1.addDirective(&CmdDirective{
+		&baseDirective{"cmd", "ls", false},
+		[]string{"ls"},
+		"ls",
+	})
+	stage2 = newStage(&FromDirective{
+		&baseDirective{"from", "alpine:latest AS alias2", false},
+		"alpine:latest",
+		"alias2",
+	})
+	stage2.addDirective(&ArgDirective{
+		&baseDirective{"arg", "cmd", false},
+		"cmd",
+		"",
+		nil,
+	})
+	stage2.addDirective(&CmdDirective{
+		&baseDirective{"cmd", "${cmd}", false},
+		[]string{"${cmd}"},
+		"${cmd}",
+	})
+
+	tests = append(tests, &test{
+		desc:       "stage arg re-declared in later stage",
+		dockerfile: dockerfile,
+		args:       nil,
+		succeed:    true,
+		stages:     []*Stage{stage1, stage2},
+	})
+
 	dockerfile = `
 	ARG cmd
 	CMD ${cmd}
@@ -440,10 +624,12 @@ func envs() []*test {
 	stage1.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd ls", false},
 		map[string]string{"cmd": "ls"},
+		[]string{"cmd"},
 	})
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "ls", false},
 		[]string{"ls"},
+		"ls",
 	})
 	stage2 := newStage(&FromDirective{
 		&baseDirective{"from", "alpine:latest AS alias2", false},
@@ -453,6 +639,7 @@ func envs() []*test {
 	stage2.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "${cmd}", false},
 		[]string{"${cmd}"},
+		"${cmd}",
 	})
 
 	tests = append(tests, &test{
@@ -480,26 +667,32 @@ func envs() []*test {
 	stage.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd ls", false},
 		map[string]string{"cmd": "ls"},
+		[]string{"cmd"},
 	})
 	stage.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd ls -la", false},
 		map[string]string{"cmd": "ls -la"},
+		[]string{"cmd"},
 	})
 	stage.addDirective(&EnvDirective{
 		&baseDirective{"env", "cmd=\"ls -la\" cmd2=echo", false},
 		map[string]string{"cmd": "ls -la", "cmd2": "echo"},
+		[]string{"cmd", "cmd2"},
 	})
 	stage.addDirective(&EnvDirective{
 		&baseDirective{"env", "empty=\"\" nonEmpty=\"true\"", false},
 		map[string]string{"empty": "", "nonEmpty": "true"},
+		[]string{"empty", "nonEmpty"},
 	})
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "ls -la", false},
 		[]string{"ls", "-la"},
+		"ls -la",
 	})
 	stage.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "echo", false},
 		[]string{"echo"},
+		"echo",
 	})
 
 	tests = append(tests, &test{
@@ -565,18 +758,22 @@ func integration() []*test {
 	stage1.addDirective(&EnvDirective{
 		&baseDirective{"env", "image=ubuntu cmd=\"echo echo\"", false},
 		map[string]string{"image": "ubuntu", "cmd": "echo echo"},
+		[]string{"image", "cmd"},
 	})
 	stage1.addDirective(&RunDirective{
 		&baseDirective{"run", "echo echo ubuntu", false},
 		"echo echo ubuntu",
+		nil,
 	})
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "echo echo ubuntu", false},
 		[]string{"echo", "echo", "ubuntu"},
+		"echo echo ubuntu",
 	})
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", `["echo echo", "ubuntu"]`, false},
 		[]string{"echo echo", "ubuntu"},
+		"",
 	})
 
 	stage2 := newStage(&FromDirective{
@@ -594,6 +791,7 @@ func integration() []*test {
 	stage2.addDirective(&EnvDirective{
 		&baseDirective{"env", "dir1 home", false},
 		map[string]string{"dir1": "home"},
+		[]string{"dir1"},
 	})
 	defaultVal1 := "dir"
 	stage2.addDirective(&ArgDirective{
@@ -614,6 +812,7 @@ func integration() []*test {
 			"dst/",
 		},
 		"digest",
+		false,
 	})
 	stage2.addDirective(&WorkdirDirective{
 		&baseDirective{"workdir", "/path/to/home/dir", false},
@@ -636,6 +835,7 @@ func integration() []*test {
 			[]string{"src1", "src2", "src3"},
 			"dst/",
 		},
+		true,
 	})
 	stage3.addDirective(&ArgDirective{
 		&baseDirective{"arg", "cmd", false},
@@ -646,6 +846,7 @@ func integration() []*test {
 	stage3.addDirective(&EntrypointDirective{
 		&baseDirective{"entrypoint", `["bash", "echo"]`, false},
 		[]string{"bash", "echo"},
+		"",
 	})
 	stage3.addDirective(&VolumeDirective{
 		&baseDirective{"volume", "v1 v2", false},
@@ -658,10 +859,12 @@ func integration() []*test {
 	stage3.addDirective(&EnvDirective{
 		&baseDirective{"env", "PATH=/tmp:$PATH", false},
 		map[string]string{"PATH": "/tmp:$PATH"},
+		[]string{"PATH"},
 	})
 	stage3.addDirective(&EnvDirective{
 		&baseDirective{"env", "PATH=/tmp2:/tmp:$PATH", false},
 		map[string]string{"PATH": "/tmp2:/tmp:$PATH"},
+		[]string{"PATH"},
 	})
 	stage3.addDirective(&UserDirective{
 		&baseDirective{"user", "udocker", false},
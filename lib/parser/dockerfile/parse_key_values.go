@@ -29,17 +29,28 @@ var (
 // pairs into a map. Both keys and values may optionally contain whitespace by
 // escaping them using '\' or using double quotes.
 func parseKeyVals(input string) (map[string]string, error) {
+	vars, _, err := parseOrderedKeyVals(input)
+	return vars, err
+}
+
+// parseOrderedKeyVals is like parseKeyVals, but also returns the keys in the
+// order they first appear in the input. A key that appears more than once
+// keeps its first position and its last value.
+func parseOrderedKeyVals(input string) (map[string]string, []string, error) {
 	var err error
-	var state parseKVsState = &parseKVsStateSpace{
-		&parseKVsBase{vars: make(map[string]string)},
-	}
+	base := &parseKVsBase{vars: make(map[string]string)}
+	var state parseKVsState = &parseKVsStateSpace{base}
 	for i := 0; i < len(input); i++ {
 		state, err = state.nextRune(rune(input[i]))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	return state.endOfInput()
+	vars, err := state.endOfInput()
+	if err != nil {
+		return nil, nil, err
+	}
+	return vars, base.keys, nil
 }
 
 // parseKVsState defines an interface that a state in the
@@ -52,6 +63,7 @@ type parseKVsState interface {
 // parseKVsBase defines pieces of data that are used & managed by each state.
 type parseKVsBase struct {
 	vars    map[string]string
+	keys    []string // Keys of vars in insertion order.
 	currKey string
 	currVal string
 	escaped bool
@@ -62,12 +74,21 @@ func (s *parseKVsBase) consumeCurrKV() error {
 	if s.currVal == "" {
 		return errMissingValue
 	}
-	s.vars[s.currKey] = s.currVal
+	s.setCurrKV()
 	s.currKey = ""
 	s.currVal = ""
 	return nil
 }
 
+// setCurrKV sets currKey=currVal in the vars map, recording the key if it is
+// new.
+func (s *parseKVsBase) setCurrKV() {
+	if _, ok := s.vars[s.currKey]; !ok {
+		s.keys = append(s.keys, s.currKey)
+	}
+	s.vars[s.currKey] = s.currVal
+}
+
 // parseKVsStateSpace is the starting state for the state machine. It should be entered
 // any time a key-value pair has finished being processed.
 type parseKVsStateSpace struct{ *parseKVsBase }
@@ -168,7 +189,7 @@ type parseKVsStateValQuote struct{ *parseKVsBase }
 // consumeCurrKV sets currKey="currVal" in the vars map and resets them.
 // It allows current value to be empty.
 func (s *parseKVsStateValQuote) consumeCurrKV() error {
-	s.vars[s.currKey] = s.currVal
+	s.setCurrKV()
 	s.currKey = ""
 	s.currVal = ""
 	return nil
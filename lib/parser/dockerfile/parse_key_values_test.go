@@ -61,3 +61,25 @@ func TestParseKeyVals(t *testing.T) {
 		})
 	}
 }
+
+func TestParseOrderedKeyVals(t *testing.T) {
+	tests := []struct {
+		desc   string
+		input  string
+		keys   []string
+		output map[string]string
+	}{
+		{"insertion order", `b=1 a=2 c=3`, []string{"b", "a", "c"}, map[string]string{"a": "2", "b": "1", "c": "3"}},
+		{"duplicate last wins", `b=1 a=2 b=3`, []string{"b", "a"}, map[string]string{"a": "2", "b": "3"}},
+		{"quoted duplicate", `b="" a=2 b="x y"`, []string{"b", "a"}, map[string]string{"a": "2", "b": "x y"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			result, keys, err := parseOrderedKeyVals(test.input)
+			require.NoError(err)
+			require.Equal(test.output, result)
+			require.Equal(test.keys, keys)
+		})
+	}
+}
@@ -15,30 +15,124 @@
 package dockerfile
 
 import (
+	"fmt"
+	"path"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
 // RunDirective represents the "RUN" dockerfile command.
 type RunDirective struct {
 	*baseDirective
-	Cmd string
+	Cmd     string
+	Secrets []SecretMount
+}
+
+// SecretMount is a secret mounted as a file while a RUN directive executes.
+type SecretMount struct {
+	ID       string
+	Target   string
+	Required bool
+	Mode     uint32
+	UID      int
+	GID      int
 }
 
 // Variables:
 //   Replaced from ARGs and ENVs from within our stage.
 // Formats:
-//   RUN ["<executable>", "<param>"...]
-//   RUN ["<param>"...]
-//   RUN <command>
+//   RUN [--mount=type=secret,id=<id>[,target=<path>][,required][,mode=<mode>][,uid=<uid>][,gid=<gid>]] ["<executable>", "<param>"...]
+//   RUN [--mount=...] ["<param>"...]
+//   RUN [--mount=...] <command>
 func newRunDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	if cmd, ok := parseJSONArray(base.Args); ok {
-		return &RunDirective{base, strings.Join(cmd, " ")}, nil
+
+	var secrets []SecretMount
+	args := strings.TrimLeftFunc(base.Args, unicode.IsSpace)
+	for strings.HasPrefix(args, "--") {
+		end := strings.IndexFunc(args, unicode.IsSpace)
+		if end == -1 {
+			end = len(args)
+		}
+		val, ok, err := parseFlag(args[:end], "mount")
+		if err != nil {
+			return nil, base.err(err)
+		} else if !ok {
+			return nil, base.err(fmt.Errorf("Unsupported flag: %s", args[:end]))
+		}
+		secret, err := parseSecretMount(val)
+		if err != nil {
+			return nil, base.err(err)
+		}
+		secrets = append(secrets, secret)
+		args = strings.TrimLeftFunc(args[end:], unicode.IsSpace)
+	}
+	if args == "" {
+		return nil, base.err(errMissingArgs)
 	}
 
-	return &RunDirective{base, base.Args}, nil
+	if cmd, ok := parseJSONArray(args); ok {
+		return &RunDirective{base, strings.Join(cmd, " "), secrets}, nil
+	}
+
+	return &RunDirective{base, args, secrets}, nil
+}
+
+// parseSecretMount parses the value of a --mount flag. Only secret mounts are
+// supported.
+func parseSecretMount(val string) (SecretMount, error) {
+	secret := SecretMount{Mode: 0400}
+	var mountType string
+	for _, field := range strings.Split(val, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		key, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		var err error
+		switch key {
+		case "type":
+			mountType = value
+		case "id":
+			secret.ID = value
+		case "target", "dst", "destination":
+			secret.Target = value
+		case "required":
+			secret.Required = true
+			if len(parts) == 2 {
+				secret.Required, err = strconv.ParseBool(value)
+			}
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			secret.Mode = uint32(mode)
+		case "uid":
+			secret.UID, err = strconv.Atoi(value)
+		case "gid":
+			secret.GID, err = strconv.Atoi(value)
+		default:
+			return SecretMount{}, fmt.Errorf("Unsupported mount option: %s", key)
+		}
+		if err != nil {
+			return SecretMount{}, errMalformedMount
+		}
+	}
+	if mountType != "secret" {
+		return SecretMount{}, fmt.Errorf("Unsupported mount type: %s", mountType)
+	}
+	if secret.ID == "" && secret.Target == "" {
+		return SecretMount{}, errMalformedMount
+	}
+	if secret.ID == "" {
+		secret.ID = path.Base(secret.Target)
+	}
+	if secret.Target == "" {
+		secret.Target = path.Join("/run/secrets", secret.ID)
+	}
+	return secret, nil
 }
 
 // Add this command to the build stage.
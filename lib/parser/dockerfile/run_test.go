@@ -34,6 +34,11 @@ func TestNewRunDirective(t *testing.T) {
 		{"substitution", true, `run ["${prefix}this", "cmd${suffix}"]`, "test_this cmd_test"},
 		{"substitution2", true, `run ["this"$comma "cmd"]`, "this cmd"},
 		{"bad substitution", false, `run ["${prefixthis", "cmd${suffix}"]`, ""},
+		{"secret mount", true, `run --mount=type=secret,id=foo cat /run/secrets/foo`, "cat /run/secrets/foo"},
+		{"secret mount json", true, `run --mount=type=secret,id=foo ["cat", "/run/secrets/foo"]`, "cat /run/secrets/foo"},
+		{"unsupported mount type", false, `run --mount=type=cache,target=/root/.cache make`, ""},
+		{"unsupported flag", false, `run --network=none make`, ""},
+		{"only mount", false, `run --mount=type=secret,id=foo`, ""},
 	}
 
 	for _, test := range tests {
@@ -51,3 +56,46 @@ func TestNewRunDirective(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRunDirectiveSecretMounts(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = map[string]string{}
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		input   string
+		secrets []SecretMount
+	}{
+		{"default target", true, `run --mount=type=secret,id=foo cmd`,
+			[]SecretMount{{ID: "foo", Target: "/run/secrets/foo", Mode: 0400}}},
+		{"id from target", true, `run --mount=type=secret,target=/root/.netrc cmd`,
+			[]SecretMount{{ID: ".netrc", Target: "/root/.netrc", Mode: 0400}}},
+		{"options", true, `run --mount=type=secret,id=foo,dst=/foo,required,mode=0440,uid=1,gid=2 cmd`,
+			[]SecretMount{{ID: "foo", Target: "/foo", Required: true, Mode: 0440, UID: 1, GID: 2}}},
+		{"multiple", true, `run --mount=type=secret,id=a --mount=type=secret,id=b,required=false cmd`,
+			[]SecretMount{
+				{ID: "a", Target: "/run/secrets/a", Mode: 0400},
+				{ID: "b", Target: "/run/secrets/b", Mode: 0400},
+			}},
+		{"no id nor target", false, `run --mount=type=secret cmd`, nil},
+		{"bad mode", false, `run --mount=type=secret,id=foo,mode=rw cmd`, nil},
+		{"unknown option", false, `run --mount=type=secret,id=foo,readonly cmd`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			if test.succeed {
+				require.NoError(err)
+				run, ok := directive.(*RunDirective)
+				require.True(ok)
+				require.Equal("cmd", run.Cmd)
+				require.Equal(test.secrets, run.Secrets)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
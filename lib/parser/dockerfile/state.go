@@ -14,6 +14,12 @@
 
 package dockerfile
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 // Stage represents a parsed dockerfile stage.
 type Stage struct {
 	From       *FromDirective
@@ -40,6 +46,11 @@ type parsingState struct {
 	// not be modified by any directive.
 	passedArgs map[string]string
 
+	// argDefaults contains the values of ARG directives that are neither
+	// passed in nor given a default value by the dockerfile. The map should
+	// not be modified by any directive.
+	argDefaults map[string]string
+
 	// globalArgs contains the resolved values corresponding to ARG
 	// directives that occur before the first stage (FROM directive),
 	// used for variable replacement in FROM directives.
@@ -49,13 +60,78 @@ type parsingState struct {
 	// ENV directives that occurred during the current stage, used in
 	// variable replacements in other directives in the stage.
 	stageVars map[string]string
+
+	// defaultArgs and defaultEnvs are declared at the beginning of every
+	// stage, before the directives of the dockerfile.
+	defaultArgs map[string]string
+	defaultEnvs map[string]string
 }
 
 // newParsingState initializes a blank slate parsingState to begin parsing a dockerfile.
 func newParsingState(vars map[string]string) *parsingState {
 	return &parsingState{
-		make([]*Stage, 0), vars, make(map[string]string), nil,
+		stages:     make([]*Stage, 0),
+		passedArgs: vars,
+		globalArgs: make(map[string]string),
+	}
+}
+
+// setDefaults sets the default args and envs of every stage. Default args are
+// also declared as global args.
+func (s *parsingState) setDefaults(args, envs map[string]string) {
+	s.defaultArgs = make(map[string]string)
+	for k, v := range args {
+		if passed, ok := s.passedArgs[k]; ok {
+			v = passed
+		}
+		s.defaultArgs[k] = v
+		s.globalArgs[k] = v
+	}
+	s.defaultEnvs = envs
+}
+
+// addDefaults adds an ARG directive for each default arg, and an ENV directive
+// with all of the default envs to the current stage.
+func (s *parsingState) addDefaults() error {
+	for _, k := range sortedKeys(s.defaultArgs) {
+		v := s.defaultArgs[k]
+		base := &baseDirective{"arg", fmt.Sprintf("%s=%s", k, v), false}
+		s.stageVars[k] = v
+		if err := s.addToCurrStage(&ArgDirective{base, k, v, &v}); err != nil {
+			return err
+		}
+	}
+	if len(s.defaultEnvs) == 0 {
+		return nil
+	}
+	var pairs []string
+	envs := make(map[string]string)
+	keys := sortedKeys(s.defaultEnvs)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, s.defaultEnvs[k]))
+		envs[k] = s.defaultEnvs[k]
+		s.stageVars[k] = s.defaultEnvs[k]
+	}
+	base := &baseDirective{"env", strings.Join(pairs, " "), false}
+	return s.addToCurrStage(&EnvDirective{base, envs, keys})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lookupVar returns the value of the ARG or ENV of the current stage with the
+// name, or else of the passed argument, or else the empty string.
+func (s *parsingState) lookupVar(name string) string {
+	if val, ok := s.stageVars[name]; ok {
+		return val
 	}
+	return s.passedArgs[name]
 }
 
 func (s *parsingState) currStage() (*Stage, error) {
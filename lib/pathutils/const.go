@@ -59,3 +59,7 @@ const DefaultCACertsPath = "/makisu-internal/certs/cacerts.pem"
 
 // CacheKeyValueFileName is the name of local cache key value file.
 const CacheKeyValueFileName = "cache_key_value.json"
+
+// CommittedLayersFileName is the name of the local file that maps the cache IDs
+// of the steps committed by builds to their layers, even if pushing them failed.
+const CommittedLayersFileName = "committed_layers.json"
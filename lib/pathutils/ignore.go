@@ -0,0 +1,145 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pathutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreMatcher matches paths against the patterns of a .dockerignore file.
+// Like docker, "*" and "?" don't match "/", "**" matches any number of dirs,
+// patterns starting with "!" are exceptions, and the last pattern matching a
+// path or one of its parent dirs wins.
+type IgnoreMatcher struct {
+	patterns   []ignorePattern
+	exceptions bool
+}
+
+type ignorePattern struct {
+	re        *regexp.Regexp
+	exception bool
+}
+
+// ParseIgnoreFile parses the patterns of a .dockerignore file. Empty lines and
+// lines starting with "#" are skipped.
+func ParseIgnoreFile(r io.Reader) (*IgnoreMatcher, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read ignore file: %s", err)
+	}
+	return NewIgnoreMatcher(patterns)
+}
+
+// NewIgnoreMatcher compiles the patterns, which are relative to the root of
+// the build context.
+func NewIgnoreMatcher(patterns []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	for _, pattern := range patterns {
+		exception := strings.HasPrefix(pattern, "!")
+		if exception {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		pattern = strings.TrimPrefix(filepath.Clean("/"+pattern), "/")
+		re, err := compileIgnorePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+		m.patterns = append(m.patterns, ignorePattern{re, exception})
+		m.exceptions = m.exceptions || exception
+	}
+	return m, nil
+}
+
+// Matches returns true if the path relative to the root of the build context
+// is ignored.
+func (m *IgnoreMatcher) Matches(relPath string) bool {
+	relPath = strings.TrimPrefix(filepath.Clean("/"+relPath), "/")
+	var matched bool
+	for _, pattern := range m.patterns {
+		// Only patterns that would change the result need to be checked.
+		if pattern.exception != matched {
+			continue
+		}
+		for p := relPath; p != "." && p != ""; p = filepath.Dir(p) {
+			if pattern.re.MatchString(p) {
+				matched = !pattern.exception
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// HasExceptions returns true if some patterns are exceptions, in which case
+// the contents of ignored dirs may not all be ignored.
+func (m *IgnoreMatcher) HasExceptions() bool { return m.exceptions }
+
+// compileIgnorePattern converts a pattern to an anchored regexp.
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" also matches no dir at all.
+					i++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
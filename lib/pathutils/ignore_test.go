@@ -0,0 +1,84 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pathutils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	m, err := ParseIgnoreFile(strings.NewReader(`
+# build outputs
+/bin
+*.log
+**/node_modules
+docs/**/*.md
+!docs/README.md
+tmp?
+[ab].txt
+`))
+	require.NoError(t, err)
+	require.True(t, m.HasExceptions())
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"bin", true},
+		{"bin/makisu", true},
+		{"cmd/bin", false},
+		{"app.log", true},
+		{"logs/app.log", false},
+		{"node_modules/x/index.js", true},
+		{"web/node_modules", true},
+		{"docs/guide.md", true},
+		{"docs/a/b/guide.md", true},
+		{"docs/README.md", false},
+		{"docs/guide.txt", false},
+		{"tmp1", true},
+		{"tmp12", false},
+		{"a.txt", true},
+		{"c.txt", false},
+		{"./bin/", true},
+		{"main.go", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			require := require.New(t)
+			require.Equal(test.expected, m.Matches(test.path))
+		})
+	}
+}
+
+func TestIgnoreMatcherExceptionOrder(t *testing.T) {
+	require := require.New(t)
+
+	m, err := NewIgnoreMatcher([]string{"*.md", "!README.md", "README*"})
+	require.NoError(err)
+	require.True(m.Matches("README.md"))
+	require.True(m.Matches("CHANGELOG.md"))
+
+	m, err = NewIgnoreMatcher([]string{"vendor", "!vendor/keep"})
+	require.NoError(err)
+	require.True(m.Matches("vendor/drop"))
+	require.False(m.Matches("vendor/keep"))
+	require.False(m.Matches("vendor/keep/file"))
+
+	_, err = NewIgnoreMatcher([]string{"[a"})
+	require.Error(err)
+}
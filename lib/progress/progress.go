@@ -0,0 +1,119 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// StepStarted is reported before a build step is executed.
+	StepStarted EventType = "step_started"
+	// StepFinished is reported after a build step was executed.
+	StepFinished EventType = "step_finished"
+	// UploadStarted is reported before a blob is pushed to a registry.
+	UploadStarted EventType = "upload_started"
+	// UploadProgress is reported after each chunk of a blob is pushed.
+	UploadProgress EventType = "upload_progress"
+	// UploadFinished is reported once a blob push was committed.
+	UploadFinished EventType = "upload_finished"
+)
+
+// CacheStatus describes how a build step was obtained.
+type CacheStatus string
+
+const (
+	// CacheMiss means the step is executed.
+	CacheMiss CacheStatus = "miss"
+	// CacheHit means the layers of the step were pulled from cache.
+	CacheHit CacheStatus = "hit"
+	// CacheSkipped means the step is skipped because a later step was cached.
+	CacheSkipped CacheStatus = "skipped"
+)
+
+// Event is a structured progress event. Only the fields relevant to its Type
+// are set.
+type Event struct {
+	Type EventType
+
+	// Step events.
+	Stage       string // Alias of the stage.
+	Step        int    // 1-based index of the step within the stage.
+	Steps       int    // Number of steps in the stage.
+	Description string // The directive of the step, e.g. "RUN make".
+	Options     string // Build options of the step, e.g. "modifyfs".
+	Cache       CacheStatus
+	Duration    time.Duration // Only set for StepFinished.
+	Err         error         // Only set for StepFinished, if the step failed.
+
+	// Upload events.
+	Registry   string
+	Repository string
+	Digest     string
+	Config     bool  // True if the blob is an image config instead of a layer.
+	Bytes      int64 // Bytes pushed so far.
+	Total      int64 // Size of the blob.
+}
+
+// Reporter receives progress events from the builder and registry clients.
+// Report may be called concurrently, as layers are pushed in parallel.
+// Builds report to the Reporter of their BuildContext, and registry clients to
+// the one set by WithReporter.
+type Reporter interface {
+	Report(Event)
+}
+
+// ReporterFunc adapts a function to a Reporter.
+type ReporterFunc func(Event)
+
+// Report calls f(e).
+func (f ReporterFunc) Report(e Event) { f(e) }
+
+// LogReporter is the default Reporter, which logs events like makisu always
+// has.
+type LogReporter struct{}
+
+// Report logs the event.
+func (LogReporter) Report(e Event) {
+	switch e.Type {
+	case StepStarted:
+		log.Infof("* Step %d/%d (%s) : %s", e.Step, e.Steps, e.Options, e.Description)
+	case UploadStarted:
+		if e.Config {
+			log.Infof("* Started pushing image config %s", e.Digest)
+		} else {
+			log.Infof("* Started pushing layer %s", e.Digest)
+		}
+	case UploadFinished:
+		if e.Config {
+			log.Infof("* Finished pushing image config %s", e.Digest)
+		} else {
+			log.Infof("* Finished pushing layer %s", e.Digest)
+		}
+	}
+}
+
+// Report sends the event to r, or to LogReporter if r is nil.
+func Report(r Reporter, e Event) {
+	if r == nil {
+		r = LogReporter{}
+	}
+	r.Report(e)
+}
@@ -0,0 +1,37 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	require := require.New(t)
+
+	var events []Event
+	r := ReporterFunc(func(e Event) { events = append(events, e) })
+	Report(r, Event{Type: StepStarted, Step: 1, Steps: 2})
+	Report(r, Event{Type: UploadProgress, Bytes: 10, Total: 20})
+	require.Equal([]Event{
+		{Type: StepStarted, Step: 1, Steps: 2},
+		{Type: UploadProgress, Bytes: 10, Total: 20},
+	}, events)
+
+	// Events are logged without a reporter.
+	Report(nil, Event{Type: StepStarted, Step: 1, Steps: 2})
+}
@@ -0,0 +1,226 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+const (
+	// StatementType is the type of in-toto statements.
+	StatementType = "https://in-toto.io/Statement/v0.1"
+
+	// PredicateType is the type of SLSA provenance predicates.
+	PredicateType = "https://slsa.dev/provenance/v0.2"
+
+	// BuildType identifies makisu builds, which defines the format of the
+	// invocation parameters.
+	BuildType = "https://github.com/uber/makisu/build@v1"
+
+	// MediaType is the media type of in-toto statements, used as the artifact
+	// type of provenance pushed to registries.
+	MediaType = "application/vnd.in-toto+json"
+)
+
+// Statement is an in-toto statement, whose predicate is the SLSA provenance of
+// its subjects.
+type Statement struct {
+	Type          string    `json:"_type"`
+	PredicateType string    `json:"predicateType"`
+	Subject       []Subject `json:"subject"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Subject is an artifact the provenance is about.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Predicate is a SLSA provenance predicate.
+type Predicate struct {
+	Builder    Builder    `json:"builder"`
+	BuildType  string     `json:"buildType"`
+	Invocation Invocation `json:"invocation"`
+	Metadata   Metadata   `json:"metadata"`
+	Materials  []Material `json:"materials"`
+}
+
+// Builder identifies what ran the build.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// Invocation describes how the build was started.
+type Invocation struct {
+	Parameters Parameters `json:"parameters"`
+}
+
+// Parameters are the options of the build that affect its result.
+type Parameters struct {
+	Dockerfile  string            `json:"dockerfile"`
+	BuildArgs   map[string]string `json:"buildArgs,omitempty"`
+	ArgDefaults map[string]string `json:"argDefaults,omitempty"`
+	GlobalArgs  map[string]string `json:"globalArgs,omitempty"`
+	ExtraEnvs   map[string]string `json:"extraEnvs,omitempty"`
+	Platform    string            `json:"platform,omitempty"`
+	Commit      string            `json:"commit,omitempty"`
+}
+
+// Metadata holds information about the build that isn't part of its inputs.
+type Metadata struct {
+	BuildStartedOn  time.Time    `json:"buildStartedOn"`
+	BuildFinishedOn time.Time    `json:"buildFinishedOn"`
+	Completeness    Completeness `json:"completeness"`
+	Reproducible    bool         `json:"reproducible"`
+}
+
+// Completeness tells which parts of the provenance are known to be complete.
+type Completeness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+// Material is an input of the build, like a base image or the build context.
+type Material struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// New returns the provenance of a build. Subjects are added once the digests
+// of the image manifests are known.
+func New(
+	builderID string, params Parameters, materials []Material,
+	started, finished time.Time) *Statement {
+
+	return &Statement{
+		Type:          StatementType,
+		PredicateType: PredicateType,
+		Subject:       []Subject{},
+		Predicate: Predicate{
+			Builder:    Builder{ID: builderID},
+			BuildType:  BuildType,
+			Invocation: Invocation{Parameters: params},
+			Metadata: Metadata{
+				BuildStartedOn:  started.UTC(),
+				BuildFinishedOn: finished.UTC(),
+				Completeness: Completeness{
+					Parameters: true,
+					// RUN steps can fetch anything from the network.
+					Materials: false,
+				},
+			},
+			Materials: materials,
+		},
+	}
+}
+
+// AddSubject adds an image, referenced by the digest of its manifest.
+func (s *Statement) AddSubject(name image.Name, digest image.Digest) {
+	s.Subject = append(s.Subject, Subject{
+		Name:   fmt.Sprintf("%s/%s", name.GetRegistry(), name.GetRepository()),
+		Digest: digestMap(digest),
+	})
+}
+
+// BaseImageMaterial returns the material of a base image, referenced by the
+// digest of its manifest.
+func BaseImageMaterial(name string, digest image.Digest) Material {
+	return Material{URI: name, Digest: digestMap(digest)}
+}
+
+// ContextMaterial returns the material of the build context, with a digest of
+// the paths, modes, link targets and contents of the files in it.
+func ContextMaterial(contextDir string) (Material, error) {
+	digest, err := hashDir(contextDir)
+	if err != nil {
+		return Material{}, fmt.Errorf("hash context: %s", err)
+	}
+	return Material{
+		URI:    "file://" + contextDir,
+		Digest: map[string]string{"sha256": digest},
+	}, nil
+}
+
+func digestMap(digest image.Digest) map[string]string {
+	return map[string]string{digest.Algorithm(): digest.Hex()}
+}
+
+// hashDir returns the hex sha256 of the content of the directory, which doesn't
+// depend on the order files are listed in nor on their timestamps.
+func hashDir(root string) (string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, fi.Mode())
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case fi.Mode().IsRegular():
+			if err := hashFile(h, path); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, f); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%x\x00", fileHash.Sum(nil))
+	return err
+}
@@ -0,0 +1,99 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provenance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatement(t *testing.T) {
+	require := require.New(t)
+
+	digest := image.Digest("sha256:" + "ab12")
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := New(
+		"https://example.com/builder",
+		Parameters{Dockerfile: "Dockerfile", BuildArgs: map[string]string{"VERSION": "1"}},
+		[]Material{BaseImageMaterial("index.docker.io/library/alpine:latest", digest)},
+		started, started.Add(time.Minute))
+	s.AddSubject(image.MustParseName("registry.dev/repo:tag"), digest)
+
+	payload, err := json.Marshal(s)
+	require.NoError(err)
+	var parsed map[string]interface{}
+	require.NoError(json.Unmarshal(payload, &parsed))
+	require.Equal(StatementType, parsed["_type"])
+	require.Equal(PredicateType, parsed["predicateType"])
+	require.Equal([]interface{}{map[string]interface{}{
+		"name":   "registry.dev/repo",
+		"digest": map[string]interface{}{"sha256": "ab12"},
+	}}, parsed["subject"])
+
+	predicate := parsed["predicate"].(map[string]interface{})
+	require.Equal(map[string]interface{}{"id": "https://example.com/builder"}, predicate["builder"])
+	require.Equal([]interface{}{map[string]interface{}{
+		"uri":    "index.docker.io/library/alpine:latest",
+		"digest": map[string]interface{}{"sha256": "ab12"},
+	}}, predicate["materials"])
+	require.Equal(map[string]interface{}{
+		"dockerfile": "Dockerfile",
+		"buildArgs":  map[string]interface{}{"VERSION": "1"},
+	}, predicate["invocation"].(map[string]interface{})["parameters"])
+	require.Equal("2020-01-02T03:05:05Z",
+		predicate["metadata"].(map[string]interface{})["buildFinishedOn"])
+}
+
+func TestContextMaterial(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "provenance")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("content"), 0644))
+	require.NoError(os.Symlink("sub/file", filepath.Join(dir, "link")))
+
+	material, err := ContextMaterial(dir)
+	require.NoError(err)
+	require.Equal("file://"+dir, material.URI)
+	require.Len(material.Digest["sha256"], 64)
+
+	// Timestamps don't matter.
+	old := time.Now().Add(-time.Hour)
+	require.NoError(os.Chtimes(filepath.Join(dir, "sub/file"), old, old))
+	same, err := ContextMaterial(dir)
+	require.NoError(err)
+	require.Equal(material, same)
+
+	// Contents and modes do.
+	require.NoError(os.Chmod(filepath.Join(dir, "sub/file"), 0755))
+	chmodded, err := ContextMaterial(dir)
+	require.NoError(err)
+	require.NotEqual(material, chmodded)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("changed"), 0755))
+	changed, err := ContextMaterial(dir)
+	require.NoError(err)
+	require.NotEqual(chmodded, changed)
+}
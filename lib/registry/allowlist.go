@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// CheckRegistryAllowed returns an error matching ErrNotAllowed if requests to
+// the registry are forbidden by AllowedRegistries and DeniedRegistries.
+func (o Options) CheckRegistryAllowed(registry string) error {
+	if pattern, ok := matchRegistry(o.DeniedRegistries, registry); ok {
+		return &Error{ErrNotAllowed, fmt.Errorf(
+			"registry %s is denied by policy (matches %s)", registry, pattern)}
+	}
+	if len(o.AllowedRegistries) == 0 {
+		return nil
+	}
+	if _, ok := matchRegistry(o.AllowedRegistries, registry); !ok {
+		return &Error{ErrNotAllowed, fmt.Errorf(
+			"registry %s is not allowed by policy (allowed: %s)",
+			registry, strings.Join(o.AllowedRegistries, ", "))}
+	}
+	return nil
+}
+
+// ValidateRegistryPatterns returns an error if one of the patterns is invalid.
+func ValidateRegistryPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("empty registry pattern")
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid registry pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchRegistry returns the first of the patterns that matches the registry.
+// "docker.io" is treated as Docker Hub, the registry of images without one.
+func matchRegistry(patterns []string, registry string) (string, bool) {
+	host := registry
+	if i := strings.LastIndex(registry, ":"); i != -1 {
+		host = registry[:i]
+	}
+	for _, pattern := range patterns {
+		p := pattern
+		if p == "docker.io" {
+			p = image.DockerHubRegistry
+		}
+		target := registry
+		if !strings.Contains(p, ":") {
+			target = host
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
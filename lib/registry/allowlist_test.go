@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRegistryAllowed(t *testing.T) {
+	tests := []struct {
+		desc     string
+		allowed  []string
+		denied   []string
+		registry string
+		ok       bool
+	}{
+		{"no policy", nil, nil, "registry.example.com", true},
+		{"allowed", []string{"registry.example.com"}, nil, "registry.example.com", true},
+		{"not allowed", []string{"registry.example.com"}, nil, "other.example.com", false},
+		{"wildcard", []string{"*.example.com"}, nil, "mirror.example.com", true},
+		{"wildcard doesn't match domain", []string{"*.example.com"}, nil, "example.com", false},
+		{"any port", []string{"localhost"}, nil, "localhost:5055", true},
+		{"port", []string{"localhost:5055"}, nil, "localhost:5055", true},
+		{"other port", []string{"localhost:5055"}, nil, "localhost:5000", false},
+		{"docker hub", []string{"docker.io"}, nil, "index.docker.io", true},
+		{"denied", nil, []string{"*.example.com"}, "mirror.example.com", false},
+		{"denied over allowed", []string{"*"}, []string{"evil.example.com"}, "evil.example.com", false},
+		{"not denied", []string{"*"}, []string{"evil.example.com"}, "good.example.com", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			opts := DefaultOptions()
+			opts.AllowedRegistries, opts.DeniedRegistries = test.allowed, test.denied
+
+			err := opts.CheckRegistryAllowed(test.registry)
+			if test.ok {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.True(errors.Is(err, ErrNotAllowed))
+				require.Contains(err.Error(), test.registry)
+			}
+		})
+	}
+}
+
+func TestValidateRegistryPatterns(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(ValidateRegistryPatterns([]string{"*.example.com", "localhost:5055"}))
+	require.Error(ValidateRegistryPatterns([]string{""}))
+	require.Error(ValidateRegistryPatterns([]string{"[example.com"}))
+}
+
+func TestClientRegistryNotAllowed(t *testing.T) {
+	require := require.New(t)
+
+	opts := DefaultOptions()
+	opts.AllowedRegistries = []string{"registry.example.com"}
+
+	c := New(nil, "localhost:5055", "repo").WithOptions(opts)
+	_, err := c.PullManifest("latest")
+	require.Error(err)
+	require.True(errors.Is(err, ErrNotAllowed))
+	err = c.PushLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.True(errors.Is(err, ErrNotAllowed))
+}
@@ -15,15 +15,22 @@
 package registry
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/ratelimit"
@@ -31,7 +38,9 @@ import (
 	"github.com/uber/makisu/lib/concurrency"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/progress"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tracing"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
 )
@@ -48,9 +57,11 @@ type Client interface {
 	Pull(tag string) (*image.DistributionManifest, error)
 	Push(tag string) error
 	PullManifest(tag string) (*image.DistributionManifest, error)
+	PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error)
 	PushManifest(tag string, manifest *image.DistributionManifest) error
 	PullLayer(layerDigest image.Digest) (os.FileInfo, error)
 	PushLayer(layerDigest image.Digest) error
+	LayerExists(layerDigest image.Digest) (bool, error)
 	PullImageConfig(layerDigest image.Digest) (os.FileInfo, error)
 	PushImageConfig(layerDigest image.Digest) error
 }
@@ -65,6 +76,8 @@ type DockerRegistryClient struct {
 	store      *storage.ImageStore
 	registry   string
 	repository string
+	reporter   progress.Reporter
+	opts       Options
 
 	// TODO: there must be a better way to test this.
 	client *http.Client
@@ -100,78 +113,207 @@ func newClient(store *storage.ImageStore, registry, repository string, client *h
 		registry:   registry,
 		repository: repository,
 		store:      store,
+		opts:       DefaultOptions(),
 		client:     client,
 	}
 }
 
+// WithReporter returns a copy of the client that sends the progress events of
+// its uploads to r instead of logging them.
+func (c DockerRegistryClient) WithReporter(r progress.Reporter) *DockerRegistryClient {
+	c.reporter = r
+	return &c
+}
+
+// WithOptions returns a copy of the client that sends its requests and pushes
+// its manifests with opts instead of the default options.
+func (c DockerRegistryClient) WithOptions(opts Options) *DockerRegistryClient {
+	c.opts = opts
+	return &c
+}
+
 // Pull tries to pull an image from its docker registry.
 // If the pull succeeded, it would store the image in the ImageStore of the client, and returns the
 // distribution manifest.
-func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, error) {
+func (c DockerRegistryClient) Pull(tag string) (_ *image.DistributionManifest, err error) {
 	name := image.NewImageName(c.registry, c.repository, tag)
 	log.Infof("* Started pulling image %s", name)
 	starttime := time.Now()
+	span := c.startSpan("pull", name.String())
+	defer func() { span.End(err) }()
 
 	manifest, err := c.PullManifest(tag)
 	if err != nil {
-		return nil, fmt.Errorf("pull manifest: %s", err)
+		return nil, fmt.Errorf("pull manifest: %w", err)
+	}
+	setManifestAttributes(span, manifest)
+
+	if err := c.pullLayers(manifest); err != nil {
+		return nil, err
 	}
+	if err := c.saveManifest(tag, manifest); err != nil {
+		return nil, fmt.Errorf("save manifest: %w", err)
+	}
+	log.Infof("* Finished pulling image %s in %s", name, time.Since(starttime))
+	return manifest, nil
+}
+
+// pullLayers pulls the layers and the config of the manifest to the store, with
+// up to pull_concurrency of them at a time. Each blob is verified against its
+// digest once it is downloaded. The first failure cancels the other pulls.
+func (c DockerRegistryClient) pullLayers(manifest *image.DistributionManifest) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	multiError := utils.NewMultiErrors()
-	workers := concurrency.NewWorkerPool(c.config.Concurrency)
-	for _, layer := range manifest.GetLayerDigests() {
-		l := layer
+	workers := concurrency.NewWorkerPool(c.config.PullConcurrency)
+	pull := func(l image.Digest, isConfig bool, what string) {
 		workers.Do(func() {
-			if _, err := c.PullLayer(l); err != nil {
-				multiError.Add(fmt.Errorf("pull layer %s: %s", l, err))
+			if _, err := c.pullLayerHelper(ctx, l, isConfig); err != nil {
+				// Pulls canceled by the first failure fail too.
+				if ctx.Err() == nil {
+					multiError.Add(fmt.Errorf("pull %s %s: %w", what, l, err))
+				}
+				cancel()
 				workers.Stop()
-				return
 			}
 		})
 	}
-	l := manifest.GetConfigDigest()
-	workers.Do(func() {
-		if _, err := c.PullLayer(l); err != nil {
-			multiError.Add(fmt.Errorf("pull image config %s: %s", l, err))
-			workers.Stop()
-			return
-		}
-	})
-	workers.Wait()
-	if err := multiError.Collect(); err != nil {
-		return nil, err
-	}
-
-	if err := c.saveManifest(tag, manifest); err != nil {
-		return nil, fmt.Errorf("save manifest: %s", err)
+	for _, layer := range manifest.GetUniqueLayerDigests() {
+		pull(layer, false, "layer")
 	}
-	log.Infof("* Finished pulling image %s in %s", name, time.Since(starttime))
-	return manifest, nil
+	pull(manifest.GetConfigDigest(), true, "image config")
+	workers.Wait()
+	return multiError.Collect()
 }
 
 // Push tries to push an image to docker registry, using the ImageStore of the client.
-func (c DockerRegistryClient) Push(tag string) error {
+func (c DockerRegistryClient) Push(tag string) (err error) {
 	name := image.NewImageName(c.registry, c.repository, tag)
 	log.Infof("* Started pushing image %s", name)
 	starttime := time.Now()
+	span := c.startSpan("push", name.String())
+	defer func() { span.End(err) }()
 
 	if found, err := c.manifestExists(tag); err != nil {
-		return fmt.Errorf("check manifest exists for image %s: %s", name, err)
+		return fmt.Errorf("check manifest exists for image %s: %w", name, err)
 	} else if found {
 		log.Infof("* Image %s already exists, overwriting", name)
 	}
 	manifest, err := c.loadManifest(tag)
 	if err != nil {
-		return fmt.Errorf("load manifest: %s", err)
+		return fmt.Errorf("load manifest: %w", err)
 	}
+	setManifestAttributes(span, manifest)
+	if err := c.pushLayers(manifest); err != nil {
+		return err
+	}
+
+	if err := c.PushManifest(tag, manifest); err != nil {
+		return fmt.Errorf("push manifest: %w", err)
+	}
+	log.Infof("* Finished pushing image %s in %s", name, time.Since(starttime))
+	return nil
+}
 
+// PushDigest pushes an image to docker registry like Push, but references its
+// manifest by digest instead of tag, so no tag gets created or updated in the
+// registry. It returns the digest of the pushed manifest.
+func (c DockerRegistryClient) PushDigest(tag string) (_ image.Digest, err error) {
+	manifest, err := c.loadManifest(tag)
+	if err != nil {
+		return "", fmt.Errorf("load manifest: %w", err)
+	}
+	digest, err := c.opts.ManifestDigest(manifest)
+	if err != nil {
+		return "", fmt.Errorf("compute manifest digest: %w", err)
+	}
+	ref := fmt.Sprintf("%s/%s@%s", c.registry, c.repository, digest)
+	log.Infof("* Started pushing image %s", ref)
+	starttime := time.Now()
+	span := c.startSpan("push", ref)
+	setManifestAttributes(span, manifest)
+	defer func() { span.End(err) }()
+
+	if err := c.pushLayers(manifest); err != nil {
+		return "", err
+	}
+	if err := c.PushManifest(string(digest), manifest); err != nil {
+		return "", fmt.Errorf("push manifest: %w", err)
+	}
+	log.Infof("* Finished pushing image %s in %s", ref, time.Since(starttime))
+	return digest, nil
+}
+
+// PushOCI pushes an image to docker registry like Push, but with the media
+// types of its manifest converted to OCI. The config and layer blobs are shared
+// with the Docker format, so they only get uploaded once when both formats are
+// pushed. If byDigest is true, the manifest is referenced by digest and no tag
+// gets created or updated. It returns the digest of the OCI manifest.
+func (c DockerRegistryClient) PushOCI(tag string, byDigest bool) (_ image.Digest, err error) {
+	manifest, err := c.loadManifest(tag)
+	if err != nil {
+		return "", fmt.Errorf("load manifest: %w", err)
+	}
+	oci := c.opts.OCIManifest(manifest)
+	digest, err := c.opts.ManifestDigest(&oci)
+	if err != nil {
+		return "", fmt.Errorf("compute manifest digest: %w", err)
+	}
+	reference := tag
+	ref := image.NewImageName(c.registry, c.repository, tag).String()
+	if byDigest {
+		reference = string(digest)
+		ref = fmt.Sprintf("%s/%s@%s", c.registry, c.repository, digest)
+	}
+	log.Infof("* Started pushing OCI image %s", ref)
+	starttime := time.Now()
+	span := c.startSpan("push", ref)
+	span.SetAttribute("makisu.oci", true)
+	setManifestAttributes(span, &oci)
+	defer func() { span.End(err) }()
+
+	if err := c.pushLayers(&oci); err != nil {
+		return "", err
+	}
+	if err := c.PushManifest(reference, &oci); err != nil {
+		return "", fmt.Errorf("push manifest: %w", err)
+	}
+	log.Infof("* Finished pushing OCI image %s in %s", ref, time.Since(starttime))
+	return digest, nil
+}
+
+// startSpan starts a client span for a pull or a push of the image ref.
+func (c DockerRegistryClient) startSpan(name, ref string) *tracing.Span {
+	span := tracing.Start(nil, name, tracing.KindClient)
+	span.SetAttribute("makisu.registry", c.registry)
+	span.SetAttribute("makisu.repository", c.repository)
+	span.SetAttribute("makisu.image", ref)
+	return span
+}
+
+// setManifestAttributes sets the layer count and the size of the blobs of the
+// manifest on the span.
+func setManifestAttributes(span *tracing.Span, manifest *image.DistributionManifest) {
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	span.SetAttribute("makisu.layers", len(manifest.Layers))
+	span.SetAttribute("makisu.layers.bytes", size)
+}
+
+// pushLayers pushes the layers and the image config referenced by the manifest,
+// and checks that they are readable from the registry if VerifyPushedBlobs is set.
+func (c DockerRegistryClient) pushLayers(manifest *image.DistributionManifest) error {
+	// Layers referenced multiple times are only pushed once.
 	multiError := utils.NewMultiErrors()
-	workers := concurrency.NewWorkerPool(c.config.Concurrency)
-	for _, layer := range manifest.GetLayerDigests() {
+	workers := concurrency.NewWorkerPool(c.config.PushConcurrency)
+	for _, layer := range manifest.GetUniqueLayerDigests() {
 		l := layer
 		workers.Do(func() {
 			if err := c.PushLayer(l); err != nil {
-				multiError.Add(fmt.Errorf("push layer %s: %s", l, err))
+				multiError.Add(fmt.Errorf("push layer %s: %w", l, err))
 				workers.Stop()
 				return
 			}
@@ -180,7 +322,7 @@ func (c DockerRegistryClient) Push(tag string) error {
 	l := manifest.GetConfigDigest()
 	workers.Do(func() {
 		if err := c.PushImageConfig(l); err != nil {
-			multiError.Add(fmt.Errorf("push image config %s: %s", l, err))
+			multiError.Add(fmt.Errorf("push image config %s: %w", l, err))
 			workers.Stop()
 			return
 		}
@@ -189,115 +331,322 @@ func (c DockerRegistryClient) Push(tag string) error {
 	if err := multiError.Collect(); err != nil {
 		return err
 	}
-
-	if err := c.PushManifest(tag, manifest); err != nil {
-		return fmt.Errorf("push manifest: %s", err)
+	if c.opts.VerifyPushedBlobs {
+		return c.verifyBlobs(manifest)
 	}
-	log.Infof("* Finished pushing image %s in %s", name, time.Since(starttime))
 	return nil
 }
 
 // PullManifest pulls docker image manifest from the docker registry.
-// It does not save the manifest to the store.
+// If the tag references a manifest list or an OCI index, the manifest of the
+// ManifestListPlatform of the options of the client is pulled instead.
+// It does not save the manifest to the store. In offline mode, the manifest
+// saved by a previous pull is returned instead.
 func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManifest, error) {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	manifest, _, err := c.PullManifestDigest(tag)
+	return manifest, err
+}
+
+// PullManifestDigest is like PullManifest, and also returns the digest of the
+// content the registry served for the tag, which is the one of the manifest
+// list if the tag references one. In offline mode, it is the digest of the
+// manifest saved by a previous pull.
+func (c DockerRegistryClient) PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	manifest, digest, _, err := c.pullManifestContent(tag)
+	return manifest, digest, err
+}
+
+// PullRawManifest is like PullManifest, and also returns the manifest as the
+// registry served it. In offline mode, it is the manifest saved by a previous
+// pull, as makisu serialized it.
+func (c DockerRegistryClient) PullRawManifest(tag string) (*image.DistributionManifest, []byte, error) {
+	manifest, _, raw, err := c.pullManifestContent(tag)
+	return manifest, raw, err
+}
+
+// pullManifestContent pulls the manifest of the tag, and returns it with the
+// digest of the content served for the tag and the body of the manifest.
+func (c DockerRegistryClient) pullManifestContent(
+	tag string) (*image.DistributionManifest, image.Digest, []byte, error) {
+
+	if c.opts.Offline {
+		manifest, err := c.loadLocalManifest(tag)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		raw, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("marshal manifest: %w", err)
+		}
+		digest, err := c.opts.ManifestDigest(manifest)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return manifest, digest, raw, nil
+	}
+	accept := strings.Join([]string{
+		image.MediaTypeManifest, image.MediaTypeOCIManifest,
+		image.MediaTypeManifestList, image.MediaTypeOCIIndex,
+	}, ", ")
+	ctHeader, body, err := c.getManifest(tag, accept)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	digest, err := image.NewDigester().FromBytes(body)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("compute manifest digest: %w", err)
+	}
+	if mediatype, _, err := mime.ParseMediaType(ctHeader); err == nil && image.IsManifestList(mediatype) {
+		list, err := image.UnmarshalManifestList(body)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("unmarshal manifest list: %w", err)
+		}
+		descriptor, err := list.Select(c.opts.ManifestListPlatform)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("select manifest of %s: %w", tag, err)
+		}
+		log.Infof("* Selected manifest %s for platform %s from %s",
+			descriptor.Digest, c.opts.ManifestListPlatform, mediatype)
+		manifest, body, err := c.pullManifest(string(descriptor.Digest), descriptor.MediaType)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return manifest, digest, body, nil
+	}
+	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unmarshal distribution manifest: %w", err)
+	}
+	return &manifest, digest, body, nil
+}
+
+// pullManifest pulls the manifest of the tag, accepting the given media types,
+// and returns it with its body.
+func (c DockerRegistryClient) pullManifest(tag, accept string) (*image.DistributionManifest, []byte, error) {
+	ctHeader, body, err := c.getManifest(tag, accept)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Parse the manifest according to the content type.
+	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal distribution manifest: %w", err)
+	}
+	return &manifest, body, nil
+}
+
+// getManifest returns the content type and the body of the manifest of the
+// tag, accepting the given media types.
+func (c DockerRegistryClient) getManifest(tag, accept string) (string, []byte, error) {
+	opt, err := c.httpOption()
 	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
+		return "", nil, err
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.apiBase(), c.repository, tag)
 	resp, err := httputil.Send(
 		"GET",
 		URL,
 		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pullRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest),
-		httputil.SendHeaders(map[string]string{"Accept": image.MediaTypeManifest}))
+		httputil.SendHeaders(map[string]string{"Accept": accept}))
 	if err != nil {
-		return nil, fmt.Errorf("http send error: %s", err)
+		return "", nil, fmt.Errorf("http send error: %w", classifyError(err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
-		return nil, fmt.Errorf("manifest not found")
+		return "", nil, &Error{Kind: ErrNotFound, Err: errors.New("manifest not found")}
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
+		return "", nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
+	}
+	r := newSizeLimitReader(resp.Body, "manifest "+tag, c.config.MaxManifestSize)
+	if err := r.checkContentLength(resp); err != nil {
+		return "", nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("read resp body: %s", err)
+		return "", nil, fmt.Errorf("read resp body: %w", err)
 	}
-	// Parse the manifest according to the content type.
-	ctHeader := resp.Header.Get("Content-Type")
-	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	// Manifests referenced by digest are verified, so that a registry or a
+	// proxy can't swap pinned images.
+	if strings.Contains(tag, ":") {
+		if err := verifyDigest(image.Digest(tag), body); err != nil {
+			return "", nil, fmt.Errorf("verify manifest: %w", err)
+		}
+	}
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+// verifyDigest checks that the digest of the blob is the expected one.
+func verifyDigest(expected image.Digest, blob []byte) error {
+	if expected.Algorithm() != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s of %s", expected.Algorithm(), expected)
+	}
+	actual, err := image.NewDigester().FromBytes(blob)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
+		return fmt.Errorf("compute digest: %w", err)
+	} else if actual != expected {
+		return fmt.Errorf("registry returned manifest with digest %s, expected %s", actual, expected)
 	}
-	return &manifest, nil
+	return nil
 }
 
 // PushManifest pushes the manifest to the registry.
 func (c DockerRegistryClient) PushManifest(tag string, manifest *image.DistributionManifest) error {
-	payload, err := json.MarshalIndent(manifest, "", "   ")
+	payload, err := c.opts.marshalManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	return c.putManifest(tag, manifest.MediaType, payload)
+}
+
+// PushManifestList pushes the manifest list or OCI index under the tag or
+// digest reference, and returns its digest. The manifests it references must
+// have been pushed to the repository first.
+func (c DockerRegistryClient) PushManifestList(tag string, list *image.ManifestList) (image.Digest, error) {
+	payload, err := c.opts.marshalManifestList(list)
 	if err != nil {
-		return fmt.Errorf("marshal manifest: %s", err)
+		return "", fmt.Errorf("marshal manifest list: %w", err)
 	}
+	digest, err := image.NewDigester().FromBytes(payload)
+	if err != nil {
+		return "", fmt.Errorf("compute manifest list digest: %w", err)
+	}
+	if err := c.putManifest(tag, list.MediaType, payload); err != nil {
+		return "", fmt.Errorf("push manifest list: %w", err)
+	}
+	return digest, nil
+}
+
+// putManifest uploads the serialized manifest of the given media type.
+func (c DockerRegistryClient) putManifest(tag, mediaType string, payload []byte) error {
 	headers := map[string]string{
-		"Content-Type": manifest.MediaType,
+		"Content-Type": mediaType,
 		"Host":         c.registry,
 	}
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	opt, err := c.httpOption()
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return err
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.apiBase(), c.repository, tag)
 	resp, err := httputil.Send(
 		"PUT",
 		URL,
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pushRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusCreated),
 		httputil.SendHeaders(headers),
 		httputil.SendBody(bytes.NewReader(payload)))
 	if err != nil {
-		return err
+		return classifyError(err)
 	}
 	defer resp.Body.Close()
 	return nil
 }
 
+// ManifestDigest returns the digest of the manifest as pushed by the
+// client, which is what the registry resolves its references to.
+func (o Options) ManifestDigest(manifest *image.DistributionManifest) (image.Digest, error) {
+	payload, err := o.marshalManifest(manifest)
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest: %w", err)
+	}
+	return image.NewDigester().FromBytes(payload)
+}
+
+func (o Options) marshalManifest(manifest *image.DistributionManifest) ([]byte, error) {
+	if o.CanonicalManifests {
+		return image.MarshalCanonical(manifest)
+	}
+	return json.MarshalIndent(manifest, "", "   ")
+}
+
+// OCIManifest returns the OCI version of the manifest as pushed by the client,
+// with OCIAnnotations.
+func (o Options) OCIManifest(manifest *image.DistributionManifest) image.DistributionManifest {
+	oci := manifest.OCI()
+	if len(o.OCIAnnotations) > 0 {
+		oci.Annotations = make(map[string]string)
+		for k, v := range o.OCIAnnotations {
+			oci.Annotations[k] = v
+		}
+	}
+	return oci
+}
+
+// ManifestListDigest returns the digest of the manifest list as pushed by the
+// client.
+func (o Options) ManifestListDigest(list *image.ManifestList) (image.Digest, error) {
+	payload, err := o.marshalManifestList(list)
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest list: %w", err)
+	}
+	return image.NewDigester().FromBytes(payload)
+}
+
+func (o Options) marshalManifestList(list *image.ManifestList) ([]byte, error) {
+	if o.CanonicalManifests {
+		return image.MarshalCanonical(list)
+	}
+	return json.MarshalIndent(list, "", "   ")
+}
+
 // PullLayer pulls image layer from the registry, and verifies that the contents
 // of that layer match the digest of the manifest.
 // If the layer already exists in the imagestore, the download is skipped.
 func (c DockerRegistryClient) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
-	return c.pullLayerHelper(layerDigest, false)
+	return c.pullLayerHelper(context.Background(), layerDigest, false)
 }
 
 // PullImageConfig pulls image config blob from the registry.
 // Same as PullLayer, with slightly different log message.
 func (c DockerRegistryClient) PullImageConfig(layerDigest image.Digest) (os.FileInfo, error) {
-	return c.pullLayerHelper(layerDigest, true)
+	return c.pullLayerHelper(context.Background(), layerDigest, true)
 }
 
+// pullLayerHelper pulls the blob, aborting the download if ctx is done.
 func (c DockerRegistryClient) pullLayerHelper(
-	layerDigest image.Digest, isConfig bool) (os.FileInfo, error) {
+	ctx context.Context, layerDigest image.Digest, isConfig bool) (os.FileInfo, error) {
 
-	if info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex()); err == nil {
-		if isConfig {
-			log.Infof("* Skipped pulling existing image config %s:%s", c.repository, layerDigest)
-		} else {
-			log.Infof("* Skipped pulling existing layer %s:%s", c.repository, layerDigest)
-		}
+	if info, err := c.store.Layers.GetStoreFileStat(layerDigest.Hex()); err == nil {
+		c.logSkippedLayer(layerDigest, isConfig)
 		return info, nil
 	}
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+
+	// The same layer could be pulled concurrently by other builds sharing the
+	// store, wait for them to finish and check the store again.
+	lock := c.store.NewFileLock("layer-" + layerDigest.Hex())
+	if err := lock.Lock(storage.DefaultLockTimeout); err != nil {
+		return nil, fmt.Errorf("lock layer: %w", err)
+	}
+	defer lock.Unlock()
+	if info, err := c.store.Layers.GetStoreFileStat(layerDigest.Hex()); err == nil {
+		c.logSkippedLayer(layerDigest, isConfig)
+		return info, nil
+	}
+	// Remove partial download left by a previous build, if any.
+	if err := c.store.Layers.DeleteDownloadFile(layerDigest.Hex()); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("delete partial layer file: %w", err)
+	}
+
+	limits := c.limits()
+	release, err := acquire(ctx, limits.pullSlots)
 	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
+		return nil, fmt.Errorf("wait for registry pull limit: %w", err)
+	}
+	defer release()
+
+	opt, err := c.httpOption()
+	if err != nil {
+		return nil, err
 	}
 
 	if isConfig {
@@ -306,39 +655,51 @@ func (c DockerRegistryClient) pullLayerHelper(
 		log.Infof("* Started pulling layer %s/%s:%s", c.registry, c.repository, layerDigest)
 	}
 
-	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, string(layerDigest))
+	URL := fmt.Sprintf(baseLayerQuery, c.apiBase(), c.repository, string(layerDigest))
 	resp, err := httputil.Send(
 		"GET",
 		URL,
 		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry())
+		httputil.SendContext(ctx),
+		c.config.pullRetry())
 	if err != nil {
-		return nil, fmt.Errorf("send pull layer request %s: %s", URL, err)
+		return nil, fmt.Errorf("send pull layer request %s: %w", URL, classifyError(err))
 	}
 	defer resp.Body.Close()
 
-	// TODO: handle concurrent download of the same file.
+	var body io.Reader = limitRate(resp.Body, limits.pullBucket)
+	if isConfig {
+		r := newSizeLimitReader(body, "image config "+string(layerDigest), c.config.MaxConfigSize)
+		if err := r.checkContentLength(resp); err != nil {
+			return nil, err
+		}
+		body = r
+	}
+
 	if err := c.store.Layers.CreateDownloadFile(layerDigest.Hex(), 0); err != nil {
-		return nil, fmt.Errorf("create layer file: %s", err)
+		return nil, fmt.Errorf("create layer file: %w", err)
 	}
 	w, err := c.store.Layers.GetDownloadFileReadWriter(layerDigest.Hex())
 	if err != nil {
-		return nil, fmt.Errorf("get layer file readwriter: %s", err)
+		return nil, fmt.Errorf("get layer file readwriter: %w", err)
 	}
 	defer w.Close()
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		return nil, fmt.Errorf("copy layer file: %s", err)
+	if _, err := io.Copy(w, body); err != nil {
+		// Partial downloads are never moved to the store.
+		c.store.Layers.DeleteDownloadFile(layerDigest.Hex())
+		return nil, fmt.Errorf("copy layer file: %w", utils.CheckOutOfDisk(err, c.store.RootDir))
 	}
 	if err := c.saveLayer(layerDigest); err != nil {
-		return nil, fmt.Errorf("save layer file: %s", err)
+		return nil, fmt.Errorf("save layer file: %w", err)
 	}
 
-	info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex())
+	info, err := c.store.Layers.GetStoreFileStat(layerDigest.Hex())
 	if err != nil {
-		return nil, fmt.Errorf("get layer stat: %s", err)
+		return nil, fmt.Errorf("get layer stat: %w", err)
 	}
 	if isConfig {
 		log.Infof("* Finished pulling image config %s:%s", c.repository, layerDigest.Hex())
@@ -348,6 +709,14 @@ func (c DockerRegistryClient) pullLayerHelper(
 	return info, nil
 }
 
+func (c DockerRegistryClient) logSkippedLayer(layerDigest image.Digest, isConfig bool) {
+	if isConfig {
+		log.Infof("* Skipped pulling existing image config %s:%s", c.repository, layerDigest)
+	} else {
+		log.Infof("* Skipped pulling existing layer %s:%s", c.repository, layerDigest)
+	}
+}
+
 // PushLayer pushes the image layer to the registry.
 func (c DockerRegistryClient) PushLayer(layerDigest image.Digest) error {
 	return c.pushLayerHelper(layerDigest, false)
@@ -361,7 +730,7 @@ func (c DockerRegistryClient) PushImageConfig(layerDigest image.Digest) error {
 
 func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig bool) error {
 	if found, err := c.layerExists(layerDigest); err != nil {
-		return fmt.Errorf("check layer exists: %s/%s (%s): %s", c.registry, c.repository, layerDigest, err)
+		return fmt.Errorf("check layer exists: %s/%s (%s): %w", c.registry, c.repository, layerDigest, err)
 	} else if found {
 		if isConfig {
 			log.Infof("* Skipped pushing existing image config %s:%s", c.repository, layerDigest)
@@ -370,76 +739,207 @@ func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig
 		}
 		return nil
 	}
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	release, err := acquire(context.Background(), c.limits().pushSlots)
+	if err != nil {
+		return fmt.Errorf("wait for registry push limit: %w", err)
+	}
+	defer release()
+
+	mode := c.pushMode()
+	if mode != PushModeAuto && mode != PushModeChunked && mode != PushModeMonolithic {
+		return fmt.Errorf("invalid push mode: %s", mode)
+	}
+
+	URL, minChunk, err := c.startLayerUpload()
+	if err != nil {
+		return err
+	}
+
+	event := c.uploadEvent(layerDigest, isConfig)
+	event.Type = progress.UploadStarted
+	progress.Report(c.reporter, event)
+	if mode == PushModeMonolithic {
+		err = c.pushLayerMonolithic(layerDigest, URL, isConfig)
+	} else {
+		err = c.pushLayerChunked(layerDigest, URL, minChunk, isConfig)
+		if err != nil && mode == PushModeAuto && isChunkedUploadRejected(err) {
+			log.Warnf("Registry %s rejected chunked upload of %s, uploading blobs in a single request from now on: %s",
+				c.registry, layerDigest, err)
+			monolithicRegistries.Store(c.registry, true)
+			// The rejected upload can't be resumed, so start another one.
+			if URL, _, err = c.startLayerUpload(); err != nil {
+				return err
+			}
+			err = c.pushLayerMonolithic(layerDigest, URL, isConfig)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return err
+	}
+	event.Type, event.Bytes = progress.UploadFinished, event.Total
+	progress.Report(c.reporter, event)
+	return nil
+}
+
+// monolithicRegistries are the registries that rejected a chunked upload in
+// auto push mode, to which the following blobs are uploaded in one request.
+var monolithicRegistries sync.Map
+
+// pushMode returns the push mode of the client, with auto resolved to
+// monolithic if the registry rejected a chunked upload before.
+func (c DockerRegistryClient) pushMode() string {
+	if c.config.PushMode == PushModeAuto {
+		if _, rejected := monolithicRegistries.Load(c.registry); rejected {
+			return PushModeMonolithic
+		}
+	}
+	return c.config.PushMode
+}
+
+// isChunkedUploadRejected returns true if err is a response of the registry
+// to a PATCH request showing that it doesn't support chunked uploads, or
+// rejected the range of a chunk.
+func isChunkedUploadRejected(err error) bool {
+	var statusErr httputil.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Method != "PATCH" {
+		return false
+	}
+	switch statusErr.Status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed,
+		http.StatusUnsupportedMediaType, http.StatusRequestedRangeNotSatisfiable:
+		return true
+	}
+	return false
+}
+
+// startLayerUpload starts a blob upload, and returns its location and the
+// minimum chunk size that the registry accepts, if it sets one.
+func (c DockerRegistryClient) startLayerUpload() (string, int64, error) {
+	opt, err := c.httpOption()
+	if err != nil {
+		return "", 0, err
 	}
 
-	URL := fmt.Sprintf(baseStartQuery, c.registry, c.repository)
+	URL := fmt.Sprintf(baseStartQuery, c.apiBase(), c.repository)
 	resp, err := httputil.Send(
 		"POST",
 		URL,
 		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pushRetry(),
 		httputil.SendAcceptedCodes(http.StatusAccepted),
 		httputil.SendHeaders(map[string]string{"Host": c.registry}))
 	if err != nil {
-		return fmt.Errorf("send start push layer request %s: %s", URL, err)
+		return "", 0, fmt.Errorf("send start push layer request %s: %w", URL, classifyError(err))
 	}
 	defer resp.Body.Close()
-	URL = resp.Header.Get("Location")
-	if URL == "" {
-		return fmt.Errorf("empty layer upload URL")
+	location, err := c.resolveLocation(resp.Header.Get("Location"))
+	if err != nil {
+		return "", 0, fmt.Errorf("layer upload URL: %w", err)
+	}
+	var minChunk int64
+	if v := resp.Header.Get("OCI-Chunk-Min-Length"); v != "" {
+		if minChunk, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, fmt.Errorf("parse minimum chunk length %q: %w", v, err)
+		}
 	}
+	return location, minChunk, nil
+}
 
-	if isConfig {
-		log.Infof("* Started pushing image config %s", layerDigest)
-	} else {
-		log.Infof("* Started pushing layer %s", layerDigest)
+// pushLayerChunked uploads the blob with a PATCH request per chunk, and
+// completes the upload with a PUT without body.
+func (c DockerRegistryClient) pushLayerChunked(
+	digest image.Digest, location string, minChunk int64, isConfig bool) error {
+
+	location, err := c.pushLayerContent(digest, location, minChunk, isConfig)
+	if err != nil {
+		return fmt.Errorf("push layer content %s: %w", digest, err)
 	}
-	URL, err = c.pushLayerContent(layerDigest, URL)
+	location, err = locationWithDigest(location, digest)
 	if err != nil {
-		return fmt.Errorf("push layer content %s: %s", layerDigest, err)
+		return err
+	}
+	if err := c.commitLayer(digest, location, 0, nil); err != nil {
+		return fmt.Errorf("commit layer push %s: %w", digest, err)
 	}
+	return nil
+}
 
-	parsed, err := url.Parse(URL)
+// pushLayerMonolithic uploads the whole blob in the body of the PUT that
+// completes the upload.
+func (c DockerRegistryClient) pushLayerMonolithic(digest image.Digest, location string, isConfig bool) error {
+	info, err := c.store.Layers.GetStoreFileStat(digest.Hex())
 	if err != nil {
-		return fmt.Errorf("failed to parse location: %s", err)
+		return fmt.Errorf("get layer file stat: %w", err)
 	}
-	q := parsed.Query()
-	q.Add("digest", string(layerDigest))
-	parsed.RawQuery = q.Encode()
-	if err := c.commitLayer(parsed.String()); err != nil {
-		return fmt.Errorf("commit layer push %s: %s", layerDigest, err)
+	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return fmt.Errorf("get layer file reader: %w", err)
 	}
-	if isConfig {
-		log.Infof("* Finished pushing image config %s", layerDigest)
-	} else {
-		log.Infof("* Finished pushing layer %s", layerDigest)
+	defer r.Close()
+
+	location, err = locationWithDigest(location, digest)
+	if err != nil {
+		return err
+	}
+	if err := c.commitLayer(digest, location, info.Size(), c.pushBody(r)); err != nil {
+		return fmt.Errorf("push layer %s: %w", digest, err)
 	}
+	event := c.uploadEvent(digest, isConfig)
+	event.Type, event.Bytes = progress.UploadProgress, info.Size()
+	progress.Report(c.reporter, event)
 	return nil
 }
 
+// locationWithDigest adds the digest query parameter that completes an upload
+// to its location.
+func locationWithDigest(location string, digest image.Digest) (string, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse location: %w", err)
+	}
+	q := parsed.Query()
+	q.Add("digest", string(digest))
+	parsed.RawQuery = q.Encode()
+	return parsed.String(), nil
+}
+
+// uploadEvent returns a progress event for pushing the given blob, with its
+// size filled in if it is found in the store.
+func (c DockerRegistryClient) uploadEvent(digest image.Digest, isConfig bool) progress.Event {
+	event := progress.Event{
+		Registry:   c.registry,
+		Repository: c.repository,
+		Digest:     string(digest),
+		Config:     isConfig,
+	}
+	if info, err := c.store.Layers.GetStoreFileStat(digest.Hex()); err == nil {
+		event.Total = info.Size()
+	}
+	return event
+}
+
 // manifestExists checks with the registry to see if an image is present and available for download.
 func (c DockerRegistryClient) manifestExists(tag string) (bool, error) {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	opt, err := c.httpOption()
 	if err != nil {
-		return false, fmt.Errorf("get security opt: %s", err)
+		return false, err
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.apiBase(), c.repository, tag)
 	resp, err := httputil.Send(
 		"HEAD",
 		URL,
 		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pullRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest))
 	if err != nil {
-		return false, fmt.Errorf("check manifest exists: %s", err)
+		return false, fmt.Errorf("check manifest exists: %w", classifyError(err))
 	}
 	defer resp.Body.Close()
 
@@ -449,24 +949,105 @@ func (c DockerRegistryClient) manifestExists(tag string) (bool, error) {
 	return true, nil
 }
 
+// VerifyManifestDigest checks that the registry resolves the tag or digest
+// reference to a manifest, or manifest list, with the expected digest.
+// Registries or proxies that rewrite manifests would otherwise silently break
+// digest pinning.
+func (c DockerRegistryClient) VerifyManifestDigest(reference string, expected image.Digest) error {
+	actual, err := c.resolveDigest(reference, strings.Join([]string{
+		image.MediaTypeManifest, image.MediaTypeOCIManifest,
+		image.MediaTypeManifestList, image.MediaTypeOCIIndex,
+	}, ", "))
+	if err != nil {
+		return err
+	} else if actual != expected {
+		return fmt.Errorf("registry resolved %s to digest %s, expected %s", reference, actual, expected)
+	}
+	return nil
+}
+
+// resolveDigest returns the digest of the manifest that the registry resolves
+// the tag or digest reference to, accepting the given media types, without
+// pulling the image. If the registry doesn't return the digest in the response
+// headers, the manifest is fetched and hashed instead.
+func (c DockerRegistryClient) resolveDigest(reference, accept string) (image.Digest, error) {
+	opt, err := c.httpOption()
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{"Accept": accept}
+	URL := fmt.Sprintf(baseManifestQuery, c.apiBase(), c.repository, reference)
+	resp, err := httputil.Send(
+		"HEAD",
+		URL,
+		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.pullRetry(),
+		httputil.SendAcceptedCodes(http.StatusOK),
+		httputil.SendHeaders(headers))
+	if err != nil {
+		return "", fmt.Errorf("get manifest digest: %w", classifyError(err))
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return image.Digest(digest), nil
+	}
+
+	resp, err = httputil.Send(
+		"GET",
+		URL,
+		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.pullRetry(),
+		httputil.SendAcceptedCodes(http.StatusOK),
+		httputil.SendHeaders(headers))
+	if err != nil {
+		return "", fmt.Errorf("get manifest: %w", classifyError(err))
+	}
+	defer resp.Body.Close()
+	r := newSizeLimitReader(resp.Body, "manifest "+reference, c.config.MaxManifestSize)
+	if err := r.checkContentLength(resp); err != nil {
+		return "", err
+	}
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("read manifest: %w", err)
+	} else if len(payload) == 0 {
+		return "", fmt.Errorf("registry did not return a manifest digest for %s", reference)
+	}
+	return image.NewDigester().FromBytes(payload)
+}
+
+// LayerExists checks with the registry whether the blob of the layer exists,
+// without pulling it.
+func (c DockerRegistryClient) LayerExists(layerDigest image.Digest) (bool, error) {
+	return c.layerExists(layerDigest)
+}
+
 // layerExists checks with the registry to see if a layer exists and is downloadable.
 func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	opt, err := c.httpOption()
 	if err != nil {
-		return false, fmt.Errorf("get security opt: %s", err)
+		return false, err
 	}
 
-	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, digest)
+	URL := fmt.Sprintf(baseLayerQuery, c.apiBase(), c.repository, digest)
 	resp, err := httputil.Send(
 		"HEAD",
 		URL,
 		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pullRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound))
 	if err != nil {
-		return false, fmt.Errorf("check manifest exists: %s", err)
+		return false, fmt.Errorf("check manifest exists: %w", classifyError(err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
@@ -475,42 +1056,58 @@ func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
 	return true, nil
 }
 
-func (c DockerRegistryClient) pushLayerContent(digest image.Digest, location string) (string, error) {
+// pushLayerContent uploads the blob in chunks of the configured size, or of
+// minChunk if it is larger, and returns the location to complete the upload.
+func (c DockerRegistryClient) pushLayerContent(
+	digest image.Digest, location string, minChunk int64, isConfig bool) (string, error) {
+
 	info, err := c.store.Layers.GetStoreFileStat(digest.Hex())
 	if err != nil {
-		return "", fmt.Errorf("get layer file stat: %s", err)
+		return "", fmt.Errorf("get layer file stat: %w", err)
 	}
 	size := info.Size()
 	pushChunk := c.config.PushChunk
-	if pushChunk == -1 {
+	if pushChunk == -1 || size == 0 {
 		pushChunk = size
+	} else if pushChunk < minChunk {
+		pushChunk = minChunk
 	}
 	start, endInclusive := int64(0), utils.Min(pushChunk-1, size-1)
 
 	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
 	if err != nil {
-		return "", fmt.Errorf("get layer file reader: %s", err)
+		return "", fmt.Errorf("get layer file reader: %w", err)
 	}
 	defer r.Close()
 
+	event := progress.Event{
+		Type:       progress.UploadProgress,
+		Registry:   c.registry,
+		Repository: c.repository,
+		Digest:     string(digest),
+		Config:     isConfig,
+		Total:      size,
+	}
 	for start < size {
 		location, err = c.pushOneLayerChunk(location, start, endInclusive, r)
 		if err != nil {
-			return location, fmt.Errorf("push layer chunk: %s", err)
+			return location, fmt.Errorf("push layer chunk: %w", err)
 		}
-		start, endInclusive = endInclusive+1, utils.Min(start+pushChunk-1, size-1)
+		event.Bytes = endInclusive + 1
+		progress.Report(c.reporter, event)
+		start = endInclusive + 1
+		endInclusive = utils.Min(start+pushChunk-1, size-1)
 	}
 	return location, nil
 }
 
 func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endIncluded int64, r io.Reader) (string, error) {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	opt, err := c.httpOption()
 	if err != nil {
-		return "", fmt.Errorf("get security opt: %s", err)
+		return "", err
 	}
 	chunckSize := endIncluded + 1 - start
-	r = io.LimitReader(r, chunckSize)
-	readerOptions := ratelimit.NewBucketWithRate(c.config.PushRate, 1)
+	body := c.pushBody(io.LimitReader(r, chunckSize))
 	headers := map[string]string{
 		"Host":           c.registry,
 		"Content-Type":   "application/octet-stream",
@@ -523,50 +1120,176 @@ func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endInclu
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pushRetry(),
 		// Docker registry returns 202
 		// GCR returns 204 on success
 		// AWS ECR returns 201 on success
 		httputil.SendAcceptedCodes(http.StatusAccepted, http.StatusNoContent, http.StatusCreated),
 		httputil.SendHeaders(headers),
-		httputil.SendBody(ratelimit.Reader(r, readerOptions)))
+		httputil.SendBody(body))
 	if err != nil {
-		return "", fmt.Errorf("send push chunk request: %s", err)
+		return "", fmt.Errorf("send push chunk request: %w", classifyError(err))
 	}
 	defer resp.Body.Close()
 
-	newLocation := resp.Header.Get("Location")
-	if newLocation == "" {
-		return "", fmt.Errorf("empty layer upload URL")
+	// Registries report the range they received so far. Strict ones reject
+	// chunks that don't start right after it, so fail early if it isn't what
+	// was sent.
+	if err := c.checkReceivedRange(resp.Header.Get("Range"), start, endIncluded); err != nil {
+		return "", err
+	}
+
+	newLocation, err := c.resolveLocation(resp.Header.Get("Location"))
+	if err != nil {
+		return "", fmt.Errorf("layer upload URL: %w", err)
 	}
 	return newLocation, nil
 }
 
-func (c DockerRegistryClient) commitLayer(location string) error {
-	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+// pushBody returns the body of a push request reading from r, limited to the
+// configured push rate, and to the rate shared by the clients of the registry.
+func (c DockerRegistryClient) pushBody(r io.Reader) io.Reader {
+	readerOptions := ratelimit.NewBucketWithRate(c.config.PushRate, 1)
+	r = limitRate(ratelimit.Reader(r, readerOptions), c.limits().pushBucket)
+	// The transport copies bodies to the connection through a small buffer,
+	// unless they implement io.WriterTo like bufio.Reader, which writes its
+	// whole buffer at once.
+	return bufio.NewReaderSize(r, c.config.PushBufferSize)
+}
+
+// httpOption returns the security option of requests to the registry, or an
+// error if the registry isn't allowed or makisu is offline.
+func (c DockerRegistryClient) httpOption() (httputil.SendOption, error) {
+	if err := c.opts.checkOnline(c.registry); err != nil {
+		return nil, err
+	}
+	if err := c.opts.CheckRegistryAllowed(c.registry); err != nil {
+		return nil, err
+	}
+	opt, err := c.config.Security.GetHTTPOption(c.apiBase(), c.repository)
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return nil, fmt.Errorf("get security opt: %w", err)
+	}
+	return opt, nil
+}
+
+// apiBase returns the address under which the registry API is served,
+// including the path prefix if configured.
+func (c DockerRegistryClient) apiBase() string {
+	if prefix := c.config.pathPrefix(); prefix != "" {
+		return c.registry + "/" + prefix
+	}
+	return c.registry
+}
+
+// resolveLocation resolves an upload location returned by the registry, which
+// may be relative to the registry host. Locations that point to the API root
+// without the path prefix are moved under the prefix.
+func (c DockerRegistryClient) resolveLocation(location string) (string, error) {
+	if location == "" {
+		return "", errors.New("empty location")
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("parse location: %w", err)
+	}
+	if u.IsAbs() {
+		return location, nil
+	}
+	c.addPathPrefix(u)
+	base := &url.URL{Scheme: "http", Host: c.registry, Path: "/"}
+	return base.ResolveReference(u).String(), nil
+}
+
+// checkRedirect follows redirects, e.g. of blob downloads to a storage
+// backend. Like the Docker client, it does not send the registry
+// Authorization header to other hosts, and it keeps the path prefix in
+// redirects to the registry API root.
+func (c DockerRegistryClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host == c.registry {
+		c.addPathPrefix(req.URL)
+	} else {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+func (c DockerRegistryClient) addPathPrefix(u *url.URL) {
+	prefix := c.config.pathPrefix()
+	if prefix != "" && strings.HasPrefix(u.Path, "/v2/") {
+		u.Path = "/" + prefix + u.Path
+	}
+}
+
+// checkReceivedRange checks that the range the registry reports after the
+// chunk start-endIncluded covers the blob up to the end of the chunk, without
+// gaps or extra bytes. A missing range is only an error with VerifyChunks.
+func (c DockerRegistryClient) checkReceivedRange(received string, start, endIncluded int64) error {
+	if received == "" {
+		if c.config.VerifyChunks {
+			return fmt.Errorf("registry did not report the range it received after chunk %d-%d", start, endIncluded)
+		}
+		return nil
+	}
+	var first, last int64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(received, "bytes="), "%d-%d", &first, &last); err != nil {
+		return fmt.Errorf("parse range %q received after chunk %d-%d: %s", received, start, endIncluded, err)
+	} else if first != 0 {
+		return fmt.Errorf("registry received range %s after chunk %d-%d, which doesn't start at 0",
+			received, start, endIncluded)
+	} else if last < endIncluded {
+		return fmt.Errorf("registry received range %s after chunk %d-%d, missing bytes %d-%d",
+			received, start, endIncluded, last+1, endIncluded)
+	} else if last > endIncluded {
+		return fmt.Errorf("registry received range %s after chunk %d-%d, %d bytes more than were sent",
+			received, start, endIncluded, last-endIncluded)
+	}
+	return nil
+}
+
+// commitLayer completes the upload of the blob with the given digest at
+// location, sending body as its last content. It fails if the registry returns
+// another digest, or none with VerifyChunks.
+func (c DockerRegistryClient) commitLayer(
+	digest image.Digest, location string, size int64, body io.Reader) error {
+
+	opt, err := c.httpOption()
+	if err != nil {
+		return err
 	}
 
 	headers := map[string]string{
 		"Host":           c.registry,
 		"Content-Type":   "application/octet-stream",
-		"Content-Length": fmt.Sprintf("%d", 0),
+		"Content-Length": fmt.Sprintf("%d", size),
 	}
-	resp, err := httputil.Send(
-		"PUT",
-		location,
+	options := []httputil.SendOption{
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry(),
+		c.config.pushRetry(),
 		// Docker registry returns 201 but gcr returns 204 on success.
 		httputil.SendAcceptedCodes(http.StatusCreated, http.StatusNoContent),
-		httputil.SendHeaders(headers))
+		httputil.SendHeaders(headers),
+	}
+	if body != nil {
+		options = append(options, httputil.SendBody(body))
+	}
+	resp, err := httputil.Send("PUT", location, options...)
 	if err != nil {
-		return fmt.Errorf("commit: %s", err)
+		return fmt.Errorf("commit: %w", classifyError(err))
 	}
 	defer resp.Body.Close()
+	if committed := resp.Header.Get("Docker-Content-Digest"); committed == "" {
+		if c.config.VerifyChunks {
+			return fmt.Errorf("registry did not return the digest of committed blob %s", digest)
+		}
+	} else if image.Digest(committed) != digest {
+		return fmt.Errorf("registry committed blob with digest %s, expected %s", committed, digest)
+	}
 	return nil
 }
 
@@ -575,43 +1298,58 @@ func (c DockerRegistryClient) saveLayer(layerDigest image.Digest) error {
 	// Verify that the layers downloaded were correct.
 	r, err := c.store.Layers.GetDownloadFileReader(layerDigest.Hex())
 	if err != nil {
-		return fmt.Errorf("get layer file reader: %s", err)
+		return fmt.Errorf("get layer file reader: %w", err)
 	}
 	defer r.Close()
 	if verified, err := layerDigest.Equals(r); err != nil {
-		return fmt.Errorf("verify layer: %s", err)
+		return fmt.Errorf("verify layer: %w", err)
 	} else if !verified {
 		return fmt.Errorf("layer digest did not match")
 	}
 
 	if err := c.store.Layers.MoveDownloadFileToStore(layerDigest.Hex()); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("commit layer to store: %s", err)
+		return fmt.Errorf("commit layer to store: %w", err)
 	}
 	return nil
 }
 
 // saveManifest saves given distribution manifest into local store.
 func (c DockerRegistryClient) saveManifest(tag string, manifest *image.DistributionManifest) error {
-	if _, err := c.store.Manifests.GetDownloadOrCacheFileStat(c.repository, tag); err == nil {
+	if _, err := c.store.Manifests.GetStoreFileStat(c.repository, tag); err == nil {
 		return nil
 	}
+
+	// Other builds sharing the store could be saving the same manifest.
+	lock := c.store.NewFileLock("manifest-" + url.PathEscape(c.repository+":"+tag))
+	if err := lock.Lock(storage.DefaultLockTimeout); err != nil {
+		return fmt.Errorf("lock manifest: %w", err)
+	}
+	defer lock.Unlock()
+	if _, err := c.store.Manifests.GetStoreFileStat(c.repository, tag); err == nil {
+		return nil
+	}
+	err := c.store.Manifests.DeleteDownloadFile(c.repository, tag)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete partial manifest file: %w", err)
+	}
+
 	if err := c.store.Manifests.CreateDownloadFile(c.repository, tag, 0); err != nil {
-		return fmt.Errorf("create manifest file: %s", err)
+		return fmt.Errorf("create manifest file: %w", err)
 	}
 	w, err := c.store.Manifests.GetDownloadFileReadWriter(c.repository, tag)
 	if err != nil {
-		return fmt.Errorf("create manifest file readwriter: %s", err)
+		return fmt.Errorf("create manifest file readwriter: %w", err)
 	}
 	defer w.Close()
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
-		return fmt.Errorf("marshal manifest: %s", err)
+		return fmt.Errorf("marshal manifest: %w", err)
 	}
 	if _, err := w.Write(manifestJSON); err != nil {
-		return fmt.Errorf("write manifest json: %s", err)
+		return fmt.Errorf("write manifest json: %w", err)
 	}
 	if err := c.store.Manifests.MoveDownloadFileToStore(c.repository, tag); err != nil {
-		return fmt.Errorf("commit manifest to store: %s", err)
+		return fmt.Errorf("commit manifest to store: %w", err)
 	}
 	return nil
 }
@@ -620,16 +1358,16 @@ func (c DockerRegistryClient) saveManifest(tag string, manifest *image.Distribut
 func (c DockerRegistryClient) loadManifest(tag string) (*image.DistributionManifest, error) {
 	r, err := c.store.Manifests.GetStoreFileReader(c.repository, tag)
 	if err != nil {
-		return nil, fmt.Errorf("get manifest file reader: %s", err)
+		return nil, fmt.Errorf("get manifest file reader: %w", err)
 	}
 	manifestBytes, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("read manifest: %s", err)
+		return nil, fmt.Errorf("read manifest: %w", err)
 	}
 
 	manifest := new(image.DistributionManifest)
 	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
-		return nil, fmt.Errorf("unmarshal manifest: %s", err)
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
 	}
 	return manifest, nil
 }
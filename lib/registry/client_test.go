@@ -15,11 +15,24 @@
 package registry
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/progress"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -29,23 +42,38 @@ var _testdata = "../../testdata"
 
 func TestPullManifest(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixture(ctx, _testdata)
+	p, err := PullClientFixture(store, _testdata)
 	require.NoError(err)
 
 	// Pull manifest.
 	_, err = p.PullManifest(testutil.SampleImageTag)
 	require.NoError(err)
+
+	// The digest is the one of the manifest served.
+	manifest, digest, err := p.PullManifestDigest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.NotEmpty(manifest.Layers)
+	served, err := ioutil.ReadFile(filepath.Join(_testdata, "files/test_distribution_manifest"))
+	require.NoError(err)
+	expected, err := image.NewDigester().FromBytes(served)
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	// The raw manifest is the one served.
+	_, raw, err := p.PullRawManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(served, raw)
 }
 
 func TestPullImage(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixture(ctx, _testdata)
+	p, err := PullClientFixture(store, _testdata)
 	require.NoError(err)
 
 	// Pull image.
@@ -61,22 +89,22 @@ func TestPullImage(t *testing.T) {
 
 func TestPullWithExistingLayer(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixture(ctx, _testdata)
+	p, err := PullClientFixture(store, _testdata)
 	require.NoError(err)
 
 	// Put layer in store first.
 	layerTarData, err := ioutil.ReadFile("../../testdata/files/test_layer.tar")
 	require.NoError(err)
-	err = ctx.ImageStore.Layers.CreateDownloadFile("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b", 0)
+	err = store.Layers.CreateDownloadFile("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b", 0)
 	require.NoError(err)
-	w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
+	w, err := store.Layers.GetDownloadFileReadWriter("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
 	require.NoError(err)
 	_, err = w.Write(layerTarData)
 	require.NoError(err)
-	require.NoError(ctx.ImageStore.Layers.MoveDownloadFileToStore("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b"))
+	require.NoError(store.Layers.MoveDownloadFileToStore("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b"))
 
 	// Pull image.
 	_, err = p.Pull(testutil.SampleImageTag)
@@ -90,10 +118,10 @@ func TestPullWithExistingLayer(t *testing.T) {
 
 func TestManifestExists(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixture(ctx, _testdata)
+	p, err := PullClientFixture(store, _testdata)
 	require.NoError(err)
 
 	exists, err := p.manifestExists(testutil.SampleImageTag)
@@ -103,10 +131,10 @@ func TestManifestExists(t *testing.T) {
 
 func TestLayerExists(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixture(ctx, _testdata)
+	p, err := PullClientFixture(store, _testdata)
 	require.NoError(err)
 
 	exists, err := p.layerExists("sha256:" + testutil.SampleLayerTarDigest)
@@ -116,21 +144,981 @@ func TestLayerExists(t *testing.T) {
 
 func TestPushManifest(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PushClientFixture(ctx)
+	p, err := PushClientFixture(store)
 	require.NoError(err)
 
 	require.NoError(p.PushManifest(testutil.SampleImageTag, &image.DistributionManifest{}))
 }
 
+// manifestPutTransportFixture records the manifests pushed to it.
+type manifestPutTransportFixture struct {
+	puts map[string]*http.Request
+	body map[string][]byte
+}
+
+func (t manifestPutTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.puts[r.URL.Path] = r
+	t.body[r.URL.Path] = b
+	return &http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func TestPushManifestList(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	transport := manifestPutTransportFixture{map[string]*http.Request{}, map[string][]byte{}}
+	c := NewWithClient(store, "localhost:5055", testutil.SampleImageRepoName, &http.Client{Transport: transport})
+	c.config.Security.TLS.Client.Disabled = true
+
+	list := image.NewManifestList(image.MediaTypeOCIIndex)
+	list.Add(image.Descriptor{MediaType: image.MediaTypeOCIManifest, Size: 10, Digest: "sha256:01"},
+		image.Platform{OS: "linux", Architecture: "arm64"})
+	digest, err := c.PushManifestList(testutil.SampleImageTag, list)
+	require.NoError(err)
+	expected, err := c.opts.ManifestListDigest(list)
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	path := "/v2/" + testutil.SampleImageRepoName + "/manifests/" + testutil.SampleImageTag
+	require.Contains(transport.puts, path)
+	require.Equal(image.MediaTypeOCIIndex, transport.puts[path].Header.Get("Content-Type"))
+	pushed, err := image.NewDigester().FromBytes(transport.body[path])
+	require.NoError(err)
+	require.Equal(digest, pushed)
+	parsed, err := image.UnmarshalManifestList(transport.body[path])
+	require.NoError(err)
+	require.Equal(*list, parsed)
+}
+
 func TestPushImage(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	require.NoError(p.Push(testutil.SampleImageTag))
+}
+
+func TestPushImageByDigest(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	digest, err := p.PushDigest(testutil.SampleImageTag)
+	require.NoError(err)
+
+	manifest, err := p.loadManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	payload, err := json.MarshalIndent(manifest, "", "   ")
+	require.NoError(err)
+	expected, err := image.NewDigester().FromBytes(payload)
+	require.NoError(err)
+	require.Equal(expected, digest)
+}
+
+func TestPushOCIImage(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	dockerDigest, err := p.PushDigest(testutil.SampleImageTag)
+	require.NoError(err)
+
+	for _, byDigest := range []bool{false, true} {
+		digest, err := p.PushOCI(testutil.SampleImageTag, byDigest)
+		require.NoError(err)
+
+		manifest, err := p.loadManifest(testutil.SampleImageTag)
+		require.NoError(err)
+		oci := manifest.OCI()
+		expected, err := p.opts.ManifestDigest(&oci)
+		require.NoError(err)
+		require.Equal(expected, digest)
+		require.NotEqual(dockerDigest, digest)
+	}
+}
+
+func TestPushOCIImageAnnotations(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	plain, err := p.PushOCI(testutil.SampleImageTag, true)
+	require.NoError(err)
+
+	opts := DefaultOptions()
+	opts.OCIAnnotations = map[string]string{"org.example.team": "infra"}
+	p = p.WithOptions(opts)
+
+	manifest, err := p.loadManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	oci := opts.OCIManifest(manifest)
+	require.Equal(opts.OCIAnnotations, oci.Annotations)
+	require.Nil(manifest.Annotations)
+
+	// The manifest doesn't share the map of the options.
+	oci.Annotations["other"] = "value"
+	require.Len(opts.OCIAnnotations, 1)
+
+	digest, err := p.PushOCI(testutil.SampleImageTag, true)
+	require.NoError(err)
+	annotated := opts.OCIManifest(manifest)
+	expected, err := opts.ManifestDigest(&annotated)
+	require.NoError(err)
+	require.Equal(expected, digest)
+	require.NotEqual(plain, digest)
+}
+
+func TestPushImageReportsProgress(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
 	defer cleanup()
 
-	p, err := PushClientFixture(ctx)
+	var mu sync.Mutex
+	events := make(map[string][]progress.Event)
+	reporter := progress.ReporterFunc(func(e progress.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[e.Digest] = append(events[e.Digest], e)
+	})
+
+	p, err := PushClientFixture(store)
 	require.NoError(err)
+	p = p.WithReporter(reporter)
+	p.client.Transport = missingBlobsTransportFixture{p.client.Transport}
 	require.NoError(p.Push(testutil.SampleImageTag))
+
+	manifest, err := p.loadManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	digests := append(manifest.GetLayerDigests(), manifest.GetConfigDigest())
+	require.Len(events, len(digests))
+	for _, digest := range digests {
+		blobEvents := events[string(digest)]
+		require.True(len(blobEvents) >= 3)
+		first, last := blobEvents[0], blobEvents[len(blobEvents)-1]
+		require.Equal(progress.UploadStarted, first.Type)
+		require.Equal(progress.UploadFinished, last.Type)
+		require.Equal(digest == manifest.GetConfigDigest(), last.Config)
+		require.True(last.Total > 0)
+		require.Equal(last.Total, last.Bytes)
+		for _, e := range blobEvents[1 : len(blobEvents)-1] {
+			require.Equal(progress.UploadProgress, e.Type)
+			require.True(e.Bytes <= e.Total)
+		}
+	}
+}
+
+func TestPushImageWithDuplicateLayers(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	var mu sync.Mutex
+	uploads := make(map[string]int)
+	reporter := progress.ReporterFunc(func(e progress.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Type == progress.UploadStarted {
+			uploads[e.Digest]++
+		}
+	})
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	p = p.WithReporter(reporter)
+	p.client.Transport = missingBlobsTransportFixture{p.client.Transport}
+
+	manifest, err := p.loadManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	manifest.Layers = append(manifest.Layers, manifest.Layers...)
+	require.NoError(p.saveManifest(testutil.SampleImageTag, manifest))
+	require.NoError(p.Push(testutil.SampleImageTag))
+
+	digests := manifest.GetUniqueLayerDigests()
+	require.True(len(digests) < len(manifest.Layers))
+	require.Len(uploads, len(digests)+1)
+	for _, digest := range append(digests, manifest.GetConfigDigest()) {
+		require.Equal(1, uploads[string(digest)])
+	}
+}
+
+// missingBlobsTransportFixture makes the registry look like it has no blobs,
+// so that they all get pushed.
+type missingBlobsTransportFixture struct {
+	http.RoundTripper
+}
+
+func (t missingBlobsTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "HEAD" && strings.Contains(r.URL.Path, "/blobs/") {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+		}, nil
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+type digestTransportFixture struct {
+	digest image.Digest
+}
+
+func (t digestTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Docker-Content-Digest", string(t.digest))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+		Header:     header,
+	}, nil
+}
+
+func TestVerifyManifestDigest(t *testing.T) {
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	digest := image.Digest("sha256:" + testutil.SampleImageConfigDigest)
+	other := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	tests := []struct {
+		desc     string
+		returned image.Digest
+		hasError bool
+	}{
+		{"match", digest, false},
+		{"mismatch", other, true},
+		{"missing", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			cli := &http.Client{Transport: digestTransportFixture{test.returned}}
+			c := NewWithClient(store, "localhost:5055", testutil.SampleImageRepoName, cli)
+			c.config.Security.TLS.Client.Disabled = true
+
+			err := c.VerifyManifestDigest(testutil.SampleImageTag, digest)
+			if test.hasError {
+				require.Error(err)
+			} else {
+				require.NoError(err)
+			}
+		})
+	}
+}
+
+// manifestListTransportFixture serves a manifest list for the sample tag, and
+// the sample manifest for its entries.
+type manifestListTransportFixture struct {
+	pullTransportFixture
+	list  image.ManifestList
+	pulls *[]string
+}
+
+func (t manifestListTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.Contains(r.URL.Path, "/manifests/") {
+		return t.pullTransportFixture.RoundTrip(r)
+	}
+	*t.pulls = append(*t.pulls, r.URL.Path)
+	if !strings.Contains(r.URL.Path, "/manifests/sha256:") {
+		b, err := json.Marshal(t.list)
+		if err != nil {
+			return nil, err
+		}
+		header := make(http.Header)
+		header.Set("Content-Type", t.list.MediaType)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(b)),
+			Header:     header,
+		}, nil
+	}
+	return t.manifestResponse()
+}
+
+func TestPullManifestFromManifestList(t *testing.T) {
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	img := image.MustParseName(testutil.SampleImageRepoName + ":" + testutil.SampleImageTag)
+	entry := func(digest, arch string) image.ManifestListEntry {
+		return image.ManifestListEntry{
+			Descriptor: image.Descriptor{MediaType: image.MediaTypeManifest, Digest: image.Digest(digest)},
+			Platform:   &image.ManifestListPlatform{OS: "linux", Architecture: arch},
+		}
+	}
+	list := image.ManifestList{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifestList,
+		Manifests: []image.ManifestListEntry{
+			entry("sha256:"+testutil.SampleLayerTarDigest, "amd64"),
+			entry("sha256:"+testutil.SampleImageManifestDigest, "arm64"),
+		},
+	}
+	newClient := func(pulls *[]string, platform image.Platform) *DockerRegistryClient {
+		cli := &http.Client{Transport: manifestListTransportFixture{
+			pullTransportFixture{img, _testdata}, list, pulls,
+		}}
+		opts := DefaultOptions()
+		opts.ManifestListPlatform = platform
+		c := NewWithClient(store, img.GetRegistry(), img.GetRepository(), cli).WithOptions(opts)
+		c.config.Security.TLS.Client.Disabled = true
+		return c
+	}
+
+	t.Run("select platform", func(t *testing.T) {
+		require := require.New(t)
+		var pulls []string
+		arm64 := image.Platform{OS: "linux", Architecture: "arm64"}
+		manifest, digest, err := newClient(&pulls, arm64).PullManifestDigest(testutil.SampleImageTag)
+		require.NoError(err)
+		require.NotEmpty(manifest.Layers)
+		require.Len(pulls, 2)
+		require.True(strings.HasSuffix(pulls[1], "/manifests/sha256:"+testutil.SampleImageManifestDigest))
+
+		// The digest is the one of the manifest list the tag references.
+		b, err := json.Marshal(list)
+		require.NoError(err)
+		expected, err := image.NewDigester().FromBytes(b)
+		require.NoError(err)
+		require.Equal(expected, digest)
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		require := require.New(t)
+		var pulls []string
+		amd64 := image.Platform{OS: "linux", Architecture: "amd64"}
+		_, err := newClient(&pulls, amd64).PullManifest(testutil.SampleImageTag)
+		require.Error(err)
+		require.Contains(err.Error(), "expected sha256:"+testutil.SampleLayerTarDigest)
+	})
+
+	t.Run("missing platform", func(t *testing.T) {
+		require := require.New(t)
+		var pulls []string
+		s390x := image.Platform{OS: "linux", Architecture: "s390x"}
+		_, err := newClient(&pulls, s390x).PullManifest(testutil.SampleImageTag)
+		require.Error(err)
+		require.Contains(err.Error(), "linux/s390x")
+		require.Len(pulls, 1)
+	})
+}
+
+func TestPullManifestNotFound(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	_, err = p.PullManifest("missing")
+	require.True(errors.Is(err, ErrNotFound))
+}
+
+func TestPullSizeLimits(t *testing.T) {
+	t.Run("manifest", func(t *testing.T) {
+		require := require.New(t)
+		store, cleanup := storage.StoreFixture()
+		defer cleanup()
+
+		p, err := PullClientFixture(store, _testdata)
+		require.NoError(err)
+		p.config.MaxManifestSize = 16
+		_, err = p.PullManifest(testutil.SampleImageTag)
+		require.True(errors.Is(err, ErrTooLarge))
+		require.Contains(err.Error(), "16 bytes")
+	})
+
+	t.Run("image config", func(t *testing.T) {
+		require := require.New(t)
+		store, cleanup := storage.StoreFixture()
+		defer cleanup()
+
+		p, err := PullClientFixture(store, _testdata)
+		require.NoError(err)
+		p.config.MaxConfigSize = 16
+		_, err = p.PullImageConfig("sha256:" + testutil.SampleImageConfigDigest)
+		require.True(errors.Is(err, ErrTooLarge))
+		_, err = p.store.Layers.GetStoreFileStat(testutil.SampleImageConfigDigest)
+		require.Error(err)
+
+		// Layers aren't limited.
+		_, err = p.PullLayer("sha256:" + testutil.SampleLayerTarDigest)
+		require.NoError(err)
+	})
+
+	t.Run("image config of pulled image", func(t *testing.T) {
+		require := require.New(t)
+		store, cleanup := storage.StoreFixture()
+		defer cleanup()
+
+		p, err := PullClientFixture(store, _testdata)
+		require.NoError(err)
+		p.config.MaxConfigSize = 16
+		_, err = p.Pull(testutil.SampleImageTag)
+		require.True(errors.Is(err, ErrTooLarge))
+		require.Contains(err.Error(), "pull image config")
+	})
+
+	t.Run("image config rate", func(t *testing.T) {
+		require := require.New(t)
+		store, cleanup := storage.StoreFixture()
+		defer cleanup()
+
+		p, err := PullClientFixture(store, _testdata)
+		require.NoError(err)
+		// The config is larger than the burst of a second allowed by the rate,
+		// whose bucket is empty once it was pulled.
+		p.config.RegistryPullRate = 1001
+		_, err = p.PullImageConfig("sha256:" + testutil.SampleImageConfigDigest)
+		require.NoError(err)
+		require.True(p.limits().pullBucket.TakeAvailable(1001) < 500)
+	})
+}
+
+type recordingTransportFixture struct {
+	digestTransportFixture
+	paths *[]string
+}
+
+func (t recordingTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	*t.paths = append(*t.paths, r.URL.Path)
+	return t.digestTransportFixture.RoundTrip(r)
+}
+
+func TestPathPrefix(t *testing.T) {
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	t.Run("api base", func(t *testing.T) {
+		require := require.New(t)
+		digest := image.Digest("sha256:" + testutil.SampleImageConfigDigest)
+		var paths []string
+		cli := &http.Client{Transport: recordingTransportFixture{digestTransportFixture{digest}, &paths}}
+		c := NewWithClient(store, "localhost:5055", testutil.SampleImageRepoName, cli)
+		c.config.Security.TLS.Client.Disabled = true
+		c.config.PathPrefix = "/docker/"
+
+		require.NoError(c.VerifyManifestDigest(testutil.SampleImageTag, digest))
+		require.Equal([]string{
+			"/docker/v2/" + testutil.SampleImageRepoName + "/manifests/" + testutil.SampleImageTag,
+		}, paths)
+	})
+
+	t.Run("resolve location", func(t *testing.T) {
+		c := New(store, "localhost:5055", testutil.SampleImageRepoName)
+		c.config.PathPrefix = "docker"
+		tests := []struct {
+			location string
+			expected string
+		}{
+			{"https://other/upload/1", "https://other/upload/1"},
+			{"/v2/repo/blobs/uploads/1", "http://localhost:5055/docker/v2/repo/blobs/uploads/1"},
+			{"/docker/v2/repo/blobs/uploads/1", "http://localhost:5055/docker/v2/repo/blobs/uploads/1"},
+		}
+		for _, test := range tests {
+			location, err := c.resolveLocation(test.location)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, location)
+		}
+		_, err := c.resolveLocation("")
+		require.Error(t, err)
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		require := require.New(t)
+		c := New(store, "localhost:5055", testutil.SampleImageRepoName)
+		c.config.PathPrefix = "docker"
+		req, err := http.NewRequest("GET", "https://localhost:5055/v2/repo/blobs/sha256:abc", nil)
+		require.NoError(err)
+		require.NoError(c.checkRedirect(req, []*http.Request{req}))
+		require.Equal("/docker/v2/repo/blobs/sha256:abc", req.URL.Path)
+
+		req, err = http.NewRequest("GET", "https://storage/v2/blob", nil)
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer abc")
+		require.NoError(c.checkRedirect(req, []*http.Request{req}))
+		require.Equal("/v2/blob", req.URL.Path)
+		require.Empty(req.Header.Get("Authorization"))
+	})
+}
+
+func TestMarshalManifestCanonical(t *testing.T) {
+	require := require.New(t)
+
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config: image.Descriptor{
+			MediaType: image.MediaTypeConfig,
+			Size:      10,
+			Digest:    image.Digest("sha256:" + strings.Repeat("a", 64)),
+		},
+		Annotations: map[string]string{"z": "1", "a": "2"},
+	}
+
+	opts := DefaultOptions()
+	indented, err := opts.marshalManifest(manifest)
+	require.NoError(err)
+	require.Contains(string(indented), "\n   \"mediaType\"")
+
+	opts.CanonicalManifests = true
+	canonical, err := opts.marshalManifest(manifest)
+	require.NoError(err)
+	again, err := opts.marshalManifest(manifest)
+	require.NoError(err)
+	require.Equal(string(canonical), string(again))
+	require.NotContains(string(canonical), "\n")
+	require.Regexp(`^\{"annotations":\{"a":"2","z":"1"\},"config":\{"digest":.*\},"layers":.*,"mediaType":.*,"schemaVersion":2\}$`, string(canonical))
+
+	digest, err := opts.ManifestDigest(manifest)
+	require.NoError(err)
+	expected, err := image.NewDigester().FromBytes(canonical)
+	require.NoError(err)
+	require.Equal(expected, digest)
+}
+
+// strictRegistryFixture is a registry that only accepts chunks whose
+// Content-Range starts right after the content it received and matches the
+// size of the chunk, and checks the digest of completed uploads. If
+// misbehavior is set, it acknowledges ranges or digests that don't match what
+// it received.
+type strictRegistryFixture struct {
+	sync.Mutex
+	rejectPatch bool
+	misbehavior string
+	uploads     int
+	content     map[string][]byte
+	ranges      []string
+	blobs       map[string][]byte
+}
+
+func newStrictRegistryFixture(rejectPatch bool) *strictRegistryFixture {
+	return &strictRegistryFixture{
+		rejectPatch: rejectPatch,
+		content:     make(map[string][]byte),
+		blobs:       make(map[string][]byte),
+	}
+}
+
+func (f *strictRegistryFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	const uploadsPath = "/v2/repo/blobs/uploads/"
+	id := strings.TrimPrefix(r.URL.Path, uploadsPath)
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/":
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "HEAD":
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "POST" && r.URL.Path == uploadsPath:
+		f.uploads++
+		id = fmt.Sprintf("upload%d", f.uploads)
+		f.content[id] = []byte{}
+		w.Header().Set("Location", uploadsPath+id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PATCH" && f.content[id] != nil:
+		if f.rejectPatch {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil ||
+			start != len(f.content[id]) || end-start+1 != len(body) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		f.ranges = append(f.ranges, r.Header.Get("Content-Range"))
+		f.content[id] = append(f.content[id], body...)
+		w.Header().Set("Location", uploadsPath+id)
+		last := len(f.content[id]) - 1
+		switch f.misbehavior {
+		case "gap":
+			last--
+		case "overlap":
+			last++
+		}
+		if f.misbehavior != "no range" {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", last))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && f.content[id] != nil:
+		content := append(f.content[id], body...)
+		digest, err := image.NewDigester().FromBytes(content)
+		if err != nil || string(digest) != r.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(f.content, id)
+		f.blobs[string(digest)] = content
+		switch f.misbehavior {
+		case "wrong digest":
+			w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("0", 64))
+		case "no digest":
+		default:
+			w.Header().Set("Docker-Content-Digest", string(digest))
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushLayerModes(t *testing.T) {
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	r, err := store.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(t, err)
+	expected, err := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc        string
+		mode        string
+		rejectPatch bool
+		uploads     int
+		chunked     bool
+	}{
+		{"chunked", PushModeChunked, false, 1, true},
+		{"monolithic", PushModeMonolithic, false, 1, false},
+		{"auto", PushModeAuto, false, 1, true},
+		{"auto falls back", PushModeAuto, true, 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			registry := newStrictRegistryFixture(test.rejectPatch)
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+			defer monolithicRegistries.Delete(c.registry)
+			c.config.Security.TLS.Client.Disabled = true
+			c.config.PushMode = test.mode
+			c.config.PushChunk = 1000
+			require.NoError(c.PushLayer(digest))
+			require.Equal(expected, registry.blobs[string(digest)])
+			require.Equal(test.uploads, registry.uploads)
+
+			if !test.chunked {
+				require.Empty(registry.ranges)
+				return
+			}
+			// The sample layer is uploaded in full chunks of 1000 bytes and
+			// a last one with the rest.
+			require.Len(registry.ranges, (len(expected)+999)/1000)
+			require.Equal("0-999", registry.ranges[0])
+			require.Equal(fmt.Sprintf("1000-%d", utils.Min(1999, int64(len(expected)-1))), registry.ranges[1])
+		})
+	}
+
+	t.Run("chunked rejected", func(t *testing.T) {
+		require := require.New(t)
+
+		registry := newStrictRegistryFixture(true)
+		server := httptest.NewServer(registry)
+		defer server.Close()
+
+		c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+		c.config.Security.TLS.Client.Disabled = true
+		c.config.PushMode = PushModeChunked
+		require.Error(c.PushLayer(digest))
+		require.Empty(registry.blobs)
+	})
+
+	t.Run("auto remembers registry", func(t *testing.T) {
+		require := require.New(t)
+
+		registry := newStrictRegistryFixture(true)
+		server := httptest.NewServer(registry)
+		defer server.Close()
+
+		c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+		c.config.Security.TLS.Client.Disabled = true
+		require.Equal(PushModeAuto, c.config.PushMode)
+		require.NoError(c.PushLayer(digest))
+		defer monolithicRegistries.Delete(c.registry)
+		require.Equal(PushModeMonolithic, c.pushMode())
+
+		delete(registry.blobs, string(digest))
+		require.NoError(c.PushImageConfig(digest))
+		require.Equal(3, registry.uploads)
+	})
+}
+
+func TestPushLayerVerifyChunks(t *testing.T) {
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+
+	tests := []struct {
+		misbehavior string
+		verify      bool
+		mode        string
+		err         string
+		aborted     bool // If true, the upload fails after the first chunk.
+	}{
+		{"", true, PushModeChunked, "", false},
+		{"", true, PushModeMonolithic, "", false},
+		{"gap", false, PushModeChunked, "missing bytes 999-999", true},
+		{"overlap", false, PushModeChunked, "1 bytes more than were sent", true},
+		{"no range", false, PushModeChunked, "", false},
+		{"no range", true, PushModeChunked, "did not report the range", true},
+		{"wrong digest", false, PushModeChunked, "registry committed blob with digest sha256:000", false},
+		{"wrong digest", false, PushModeMonolithic, "registry committed blob with digest sha256:000", false},
+		{"no digest", false, PushModeChunked, "", false},
+		{"no digest", true, PushModeChunked, "did not return the digest", false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %s verify=%v", test.misbehavior, test.mode, test.verify), func(t *testing.T) {
+			require := require.New(t)
+
+			registry := newStrictRegistryFixture(false)
+			registry.misbehavior = test.misbehavior
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+			c.config.Security.TLS.Client.Disabled = true
+			c.config.PushMode = test.mode
+			c.config.PushChunk = 1000
+			c.config.VerifyChunks = test.verify
+			err := c.PushLayer(digest)
+			if test.err == "" {
+				require.NoError(err)
+				return
+			}
+			require.Error(err)
+			require.Contains(err.Error(), test.err)
+			if test.aborted {
+				require.Len(registry.ranges, 1)
+				require.Empty(registry.blobs)
+			}
+		})
+	}
+}
+
+func BenchmarkPushOneLayerChunk(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Location", "/v2/repo/blobs/uploads/upload123")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	const size = 64 * 1024 * 1024
+	content := make([]byte, size)
+	location := server.URL + "/v2/repo/blobs/uploads/upload123"
+	for _, bufferSize := range []int{4 * 1024, 32 * 1024, 256 * 1024, 1024 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize/1024), func(b *testing.B) {
+			c := New(nil, strings.TrimPrefix(server.URL, "http://"), "repo")
+			c.config.Security.TLS.Client.Disabled = true
+			c.config.PushRate = 100 * 1024 * 1024 * 1024
+			c.config.PushBufferSize = bufferSize
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.pushOneLayerChunk(location, 0, size-1, bytes.NewReader(content)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// pullServerFixture serves the blobs of its map, and records the largest
+// number of blob requests it served at once. Requests of the missing blob fail
+// once the others were received, and the others are then held until they are
+// canceled.
+type pullServerFixture struct {
+	sync.Mutex
+	blobs       map[string][]byte
+	missing     string
+	inFlight    int
+	maxInFlight int
+	requests    int
+}
+
+func (f *pullServerFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	digest := r.URL.Path[strings.LastIndex(r.URL.Path, "/blobs/")+len("/blobs/"):]
+
+	f.Lock()
+	f.requests++
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		f.inFlight--
+		f.Unlock()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if f.missing != "" {
+		if digest == f.missing {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			<-r.Context().Done()
+		}
+		return
+	}
+	w.Write(f.blobs[digest])
+}
+
+func TestPullLayersConcurrency(t *testing.T) {
+	blobs := make(map[string][]byte)
+	manifest := &image.DistributionManifest{}
+	for i := 0; i < 7; i++ {
+		content := []byte(fmt.Sprintf("blob %d", i))
+		digest, err := image.NewDigester().FromBytes(content)
+		require.NoError(t, err)
+		blobs[string(digest)] = content
+		if i == 0 {
+			manifest.Config = image.Descriptor{Digest: digest}
+		} else {
+			manifest.Layers = append(manifest.Layers, image.Descriptor{Digest: digest})
+		}
+	}
+
+	tests := []struct {
+		desc        string
+		concurrency int
+		missing     bool
+	}{
+		{"one at a time", 1, false},
+		{"up to the concurrency", 3, false},
+		{"more workers than blobs", 10, false},
+		{"failure cancels the other pulls", 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			store, cleanup := storage.StoreFixture()
+			defer cleanup()
+
+			fixture := &pullServerFixture{blobs: blobs}
+			missing := manifest.Layers[1].Digest
+			if test.missing {
+				fixture.missing = string(missing)
+			}
+			server := httptest.NewServer(fixture)
+			defer server.Close()
+
+			c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+			c.config.Security.PlainHTTP = true
+			c.config.PullConcurrency = test.concurrency
+
+			start := time.Now()
+			err := c.pullLayers(manifest)
+
+			fixture.Lock()
+			defer fixture.Unlock()
+			expected := test.concurrency
+			if expected > len(blobs) {
+				expected = len(blobs)
+			}
+			require.Equal(expected, fixture.maxInFlight)
+
+			if test.missing {
+				require.Error(err)
+				require.True(errors.Is(err, ErrNotFound))
+				require.Contains(err.Error(), missing.Hex())
+				require.NotContains(err.Error(), "context canceled")
+				require.True(time.Since(start) < 5*time.Second)
+				// The pulls that weren't started were skipped.
+				require.True(fixture.requests < len(blobs))
+				return
+			}
+			require.NoError(err)
+			require.Equal(len(blobs), fixture.requests)
+			for digest := range blobs {
+				_, err := store.Layers.GetStoreFileStat(image.Digest(digest).Hex())
+				require.NoError(err)
+			}
+		})
+	}
+}
+
+func TestRegistryPullConcurrency(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	// Two images of different repositories of the same registry.
+	blobs := make(map[string][]byte)
+	var manifests []*image.DistributionManifest
+	for _, repo := range []string{"repo", "other"} {
+		manifest := &image.DistributionManifest{}
+		for i := 0; i < 4; i++ {
+			content := []byte(fmt.Sprintf("%s blob %d", repo, i))
+			digest, err := image.NewDigester().FromBytes(content)
+			require.NoError(err)
+			blobs[string(digest)] = content
+			if i == 0 {
+				manifest.Config = image.Descriptor{Digest: digest}
+			} else {
+				manifest.Layers = append(manifest.Layers, image.Descriptor{Digest: digest})
+			}
+		}
+		manifests = append(manifests, manifest)
+	}
+	fixture := &pullServerFixture{blobs: blobs}
+	server := httptest.NewServer(fixture)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(manifests))
+	for i, repo := range []string{"repo", "other"} {
+		c := New(store, strings.TrimPrefix(server.URL, "http://"), repo)
+		c.config.Security.PlainHTTP = true
+		c.config.PullConcurrency = 3
+		c.config.RegistryPullConcurrency = 2
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.pullLayers(manifests[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(err)
+	}
+
+	fixture.Lock()
+	defer fixture.Unlock()
+	require.Equal(len(blobs), fixture.requests)
+	require.Equal(2, fixture.maxInFlight)
 }
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -38,6 +39,46 @@ var DefaultDockerHubConfiguration = Config{
 		BasicAuth: &security.BasicAuthConfig{}, // DockerHub requires empty username and password for public repositories.
 	}}
 
+// Default retry settings per operation type, used when the registry config
+// doesn't specify them. Pulls are idempotent and can be retried aggressively,
+// pushes are retried more conservatively.
+var (
+	DefaultPullRetries      = 6
+	DefaultPullRetryBackoff = 2.0
+	DefaultPushRetries      = 2
+	DefaultPushRetryBackoff = 3.0
+)
+
+// DefaultPullConcurrency is the number of blobs of an image pulled in
+// parallel, used when the registry config specifies neither pull_concurrency
+// nor concurrency.
+var DefaultPullConcurrency = 3
+
+// DefaultPushBufferSize is the size of the buffer of push request bodies, used
+// when the registry config doesn't specify it.
+var DefaultPushBufferSize = 256 * 1024 // 256 KB
+
+// Modes of blob uploads.
+const (
+	// PushModeAuto uploads blobs in chunks, and in a single request to
+	// registries that rejected a chunked upload.
+	PushModeAuto = "auto"
+	// PushModeChunked uploads blobs with a PATCH request per chunk, followed
+	// by a PUT without body that completes the upload.
+	PushModeChunked = "chunked"
+	// PushModeMonolithic uploads blobs in the body of the PUT that completes
+	// the upload.
+	PushModeMonolithic = "monolithic"
+)
+
+// Default limits of the size of pulled manifests and image configs, used when
+// the registry config doesn't specify them. They are far larger than those of
+// real images, and only guard against registries returning huge bodies.
+var (
+	DefaultMaxManifestSize int64 = 4 * 1024 * 1024  // 4 MB
+	DefaultMaxConfigSize   int64 = 64 * 1024 * 1024 // 64 MB
+)
+
 // Map contains a map of registry config.
 type Map map[string]RepositoryMap
 
@@ -46,51 +87,141 @@ type RepositoryMap map[string]Config
 
 // Config contains docker registry client configuration.
 type Config struct {
-	Concurrency   int           `yaml:"concurrency" json:"concurrency"`
-	Timeout       time.Duration `yaml:"timeout" json:"timeout"`
-	Retries       int           `yaml:"retries" json:"retries"`
-	RetryInterval time.Duration `yaml:"retry_interval" json:"retry_interval"`
-	RetryBackoff  float64       `yaml:"retry_backoff" json:"retry_backoff"`
-	PushRate      float64       `yaml:"push_rate" json:"push_rate"`
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+	// Number of blobs pulled in parallel. If not specified, concurrency is
+	// used if set, and the default otherwise.
+	PullConcurrency int `yaml:"pull_concurrency" json:"pull_concurrency"`
+	// Number of blobs of an image pushed in parallel. If not specified,
+	// concurrency is used.
+	PushConcurrency int `yaml:"push_concurrency" json:"push_concurrency"`
+	// Limits of the blob transfers of all the clients of the registry host
+	// with the same limits, across images and repositories, e.g. when pushing
+	// to several repositories of it at once. Rates are in bytes per second.
+	// 0 means no limit.
+	RegistryPushConcurrency int           `yaml:"registry_push_concurrency" json:"registry_push_concurrency"`
+	RegistryPullConcurrency int           `yaml:"registry_pull_concurrency" json:"registry_pull_concurrency"`
+	RegistryPushRate        float64       `yaml:"registry_push_rate" json:"registry_push_rate"`
+	RegistryPullRate        float64       `yaml:"registry_pull_rate" json:"registry_pull_rate"`
+	Timeout                 time.Duration `yaml:"timeout" json:"timeout"`
+	Retries                 int           `yaml:"retries" json:"retries"`
+	RetryInterval           time.Duration `yaml:"retry_interval" json:"retry_interval"`
+	RetryBackoff            float64       `yaml:"retry_backoff" json:"retry_backoff"`
+	// Per operation retry settings. If not specified, retries and
+	// retry_backoff are used if set, and the defaults otherwise.
+	PullRetries      int     `yaml:"pull_retries" json:"pull_retries"`
+	PullRetryBackoff float64 `yaml:"pull_retry_backoff" json:"pull_retry_backoff"`
+	PushRetries      int     `yaml:"push_retries" json:"push_retries"`
+	PushRetryBackoff float64 `yaml:"push_retry_backoff" json:"push_retry_backoff"`
+	PushRate         float64 `yaml:"push_rate" json:"push_rate"`
+	// Size of the buffer between layer files and the body of push requests,
+	// in bytes. Larger buffers mean fewer, larger writes to the connection.
+	PushBufferSize int `yaml:"push_buffer_size" json:"push_buffer_size"`
 	// If not specify, a default chunk size will be used.
 	// Set it to -1 to turn off chunk upload.
 	// NOTE: gcr and ecr do not support chunked upload.
-	PushChunk int64           `yaml:"push_chunk" json:"push_chunk"`
-	Security  security.Config `yaml:"security" json:"security"`
+	PushChunk int64 `yaml:"push_chunk" json:"push_chunk"`
+	// How blobs are uploaded: "chunked", "monolithic" or "auto", the default,
+	// which falls back to monolithic uploads if the registry rejects chunks.
+	PushMode string `yaml:"push_mode" json:"push_mode"`
+	// If true, chunked uploads fail unless the registry reports the range it
+	// received after each chunk, and completed uploads unless it returns the
+	// digest of the blob.
+	VerifyChunks bool `yaml:"verify_chunks" json:"verify_chunks"`
+	// Maximum size of pulled manifests and image configs, in bytes. Pulls of
+	// larger ones fail.
+	MaxManifestSize int64 `yaml:"max_manifest_size" json:"max_manifest_size"`
+	MaxConfigSize   int64 `yaml:"max_config_size" json:"max_config_size"`
+	// Path under which the registry API is served, for registries behind a
+	// path based reverse proxy. For example, set it to "docker" if the API is
+	// at https://host/docker/v2/.
+	PathPrefix string          `yaml:"path_prefix" json:"path_prefix"`
+	Security   security.Config `yaml:"security" json:"security"`
 }
 
 func (c Config) applyDefaults() Config {
+	if c.PullConcurrency == 0 {
+		c.PullConcurrency = defaultInt(c.Concurrency, DefaultPullConcurrency)
+	}
 	if c.Concurrency == 0 {
 		c.Concurrency = 3
 	}
+	if c.PushConcurrency == 0 {
+		c.PushConcurrency = c.Concurrency
+	}
 	// TODO: Decrease the timeout. 10 mins is too long.
 	if c.Timeout == 0 {
 		c.Timeout = 600 * time.Second
 	}
-	if c.Retries == 0 {
-		c.Retries = 4
+	if c.PullRetries == 0 {
+		c.PullRetries = defaultInt(c.Retries, DefaultPullRetries)
+	}
+	if c.PullRetryBackoff == 0 {
+		c.PullRetryBackoff = defaultFloat(c.RetryBackoff, DefaultPullRetryBackoff)
+	}
+	if c.PushRetries == 0 {
+		c.PushRetries = defaultInt(c.Retries, DefaultPushRetries)
+	}
+	if c.PushRetryBackoff == 0 {
+		c.PushRetryBackoff = defaultFloat(c.RetryBackoff, DefaultPushRetryBackoff)
 	}
 	if c.RetryInterval == 0 {
 		c.RetryInterval = 500 * time.Millisecond
 	}
-	if c.RetryBackoff == 0 {
-		c.RetryBackoff = 2
-	}
 	if c.PushRate == 0 {
 		c.PushRate = 100 * 1024 * 1024 // 100 MB/s
 	}
+	if c.PushBufferSize == 0 {
+		c.PushBufferSize = DefaultPushBufferSize
+	}
 	if c.PushChunk == 0 {
 		c.PushChunk = 50 * 1024 * 1024 // 50 MB
 	}
+	if c.PushMode == "" {
+		c.PushMode = PushModeAuto
+	}
+	if c.MaxManifestSize == 0 {
+		c.MaxManifestSize = DefaultMaxManifestSize
+	}
+	if c.MaxConfigSize == 0 {
+		c.MaxConfigSize = DefaultMaxConfigSize
+	}
 	c.Security = c.Security.ApplyDefaults()
 	return c
 }
 
-func (c *Config) sendRetry() httputil.SendOption {
+// pathPrefix returns the path prefix without leading and trailing slashes.
+func (c Config) pathPrefix() string {
+	return strings.Trim(c.PathPrefix, "/")
+}
+
+func defaultInt(v, d int) int {
+	if v == 0 {
+		return d
+	}
+	return v
+}
+
+func defaultFloat(v, d float64) float64 {
+	if v == 0 {
+		return d
+	}
+	return v
+}
+
+// pullRetry returns the retry option for idempotent requests.
+func (c *Config) pullRetry() httputil.SendOption {
+	return httputil.SendRetry(
+		httputil.RetryMax(c.PullRetries),
+		httputil.RetryInterval(c.RetryInterval),
+		httputil.RetryBackoff(c.PullRetryBackoff))
+}
+
+// pushRetry returns the retry option for requests that upload content.
+func (c *Config) pushRetry() httputil.SendOption {
 	return httputil.SendRetry(
-		httputil.RetryMax(c.Retries),
+		httputil.RetryMax(c.PushRetries),
 		httputil.RetryInterval(c.RetryInterval),
-		httputil.RetryBackoff(c.RetryBackoff))
+		httputil.RetryBackoff(c.PushRetryBackoff))
 }
 
 // UpdateGlobalConfig updates the global registry config given either:
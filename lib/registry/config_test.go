@@ -0,0 +1,55 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigApplyDefaultRetries(t *testing.T) {
+	tests := []struct {
+		desc             string
+		config           Config
+		pullRetries      int
+		pullRetryBackoff float64
+		pushRetries      int
+		pushRetryBackoff float64
+	}{
+		{"defaults", Config{}, DefaultPullRetries, DefaultPullRetryBackoff,
+			DefaultPushRetries, DefaultPushRetryBackoff},
+		{"generic", Config{Retries: 1, RetryBackoff: 1.5}, 1, 1.5, 1, 1.5},
+		{"per operation", Config{Retries: 1, PullRetries: 8, PushRetryBackoff: 4}, 8,
+			DefaultPullRetryBackoff, 1, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			config := test.config.applyDefaults()
+			require.Equal(test.pullRetries, config.PullRetries)
+			require.Equal(test.pullRetryBackoff, config.PullRetryBackoff)
+			require.Equal(test.pushRetries, config.PushRetries)
+			require.Equal(test.pushRetryBackoff, config.PushRetryBackoff)
+		})
+	}
+}
+
+func TestConfigApplyDefaultPushBufferSize(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(DefaultPushBufferSize, Config{}.applyDefaults().PushBufferSize)
+	require.Equal(4096, Config{PushBufferSize: 4096}.applyDefaults().PushBufferSize)
+}
@@ -0,0 +1,221 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uber/makisu/lib/registry/security"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// EnvConfigPrefix is the prefix of the environment variables that configure
+// registries, formatted as MAKISU_REGISTRY_<ID>_<SETTING>. Variables with the
+// same <ID> configure the same registry and repos.
+const EnvConfigPrefix = "MAKISU_REGISTRY_"
+
+// envSettings are the settings that can be set through environment variables,
+// and how they are applied to the config.
+var envSettings = map[string]func(c *Config, value string) error{
+	"USERNAME": func(c *Config, v string) error {
+		c.Security.BasicAuth = basicAuth(c)
+		c.Security.BasicAuth.Username = v
+		return nil
+	},
+	"PASSWORD": func(c *Config, v string) error {
+		c.Security.BasicAuth = basicAuth(c)
+		c.Security.BasicAuth.Password = v
+		return nil
+	},
+	"PASSWORD_FILE": func(c *Config, v string) error {
+		c.Security.BasicAuth = basicAuth(c)
+		c.Security.BasicAuth.PasswordFile = v
+		return nil
+	},
+	"CREDS_STORE": func(c *Config, v string) error {
+		c.Security.RemoteCredentialsStore = v
+		return nil
+	},
+	"TLS_CA": func(c *Config, v string) error {
+		c.Security.TLS = tlsConfig(c)
+		c.Security.TLS.CA.Cert.Path = v
+		return nil
+	},
+	"TLS_CERT": func(c *Config, v string) error {
+		c.Security.TLS = tlsConfig(c)
+		c.Security.TLS.Client.Cert.Path = v
+		return nil
+	},
+	"TLS_KEY": func(c *Config, v string) error {
+		c.Security.TLS = tlsConfig(c)
+		c.Security.TLS.Client.Key.Path = v
+		return nil
+	},
+	"TLS_DISABLED": func(c *Config, v string) error {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		c.Security.TLS = tlsConfig(c)
+		c.Security.TLS.Client.Disabled = disabled
+		return nil
+	},
+	"PUSH_MODE": func(c *Config, v string) error {
+		c.PushMode = v
+		return nil
+	},
+	"PLAIN_HTTP": func(c *Config, v string) (err error) {
+		c.Security.PlainHTTP, err = strconv.ParseBool(v)
+		return err
+	},
+	"PUSH_CONCURRENCY": func(c *Config, v string) (err error) {
+		c.PushConcurrency, err = strconv.Atoi(v)
+		return err
+	},
+	"PULL_CONCURRENCY": func(c *Config, v string) (err error) {
+		c.PullConcurrency, err = strconv.Atoi(v)
+		return err
+	},
+	"REGISTRY_PUSH_CONCURRENCY": func(c *Config, v string) (err error) {
+		c.RegistryPushConcurrency, err = strconv.Atoi(v)
+		return err
+	},
+	"REGISTRY_PULL_CONCURRENCY": func(c *Config, v string) (err error) {
+		c.RegistryPullConcurrency, err = strconv.Atoi(v)
+		return err
+	},
+	"REGISTRY_PUSH_RATE": func(c *Config, v string) (err error) {
+		c.RegistryPushRate, err = strconv.ParseFloat(v, 64)
+		return err
+	},
+	"REGISTRY_PULL_RATE": func(c *Config, v string) (err error) {
+		c.RegistryPullRate, err = strconv.ParseFloat(v, 64)
+		return err
+	},
+}
+
+// basicAuth returns a copy of the basic auth config of c, so that configs
+// sharing it with others aren't modified.
+func basicAuth(c *Config) *security.BasicAuthConfig {
+	if c.Security.BasicAuth == nil {
+		return &security.BasicAuthConfig{}
+	}
+	auth := *c.Security.BasicAuth
+	return &auth
+}
+
+// tlsConfig returns a copy of the TLS config of c, so that configs sharing it
+// with others aren't modified.
+func tlsConfig(c *Config) *httputil.TLSConfig {
+	if c.Security.TLS == nil {
+		return &httputil.TLSConfig{}
+	}
+	tls := *c.Security.TLS
+	return &tls
+}
+
+// UpdateGlobalConfigFromEnv updates the global registry config with the
+// environment variables starting with EnvConfigPrefix. MAKISU_REGISTRY_<ID>_HOST
+// is the registry, and the optional MAKISU_REGISTRY_<ID>_REPO the repo
+// pattern, ".*" by default. The other settings of the same <ID> override the
+// ones of the config of that registry and repo, if there is one already.
+func UpdateGlobalConfigFromEnv() error {
+	return updateConfigFromEnv(os.Environ())
+}
+
+func updateConfigFromEnv(environ []string) error {
+	// Settings keyed by ID, then by setting name.
+	groups := make(map[string]map[string]string)
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvConfigPrefix) {
+			continue
+		}
+		id, setting, err := splitEnvSetting(strings.TrimPrefix(parts[0], EnvConfigPrefix))
+		if err != nil {
+			return fmt.Errorf("%s: %s", parts[0], err)
+		}
+		if _, ok := groups[id]; !ok {
+			groups[id] = make(map[string]string)
+		}
+		groups[id][setting] = parts[1]
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		settings := groups[id]
+		reg := settings["HOST"]
+		if reg == "" {
+			return fmt.Errorf("%s%s_HOST is not set", EnvConfigPrefix, id)
+		}
+		repo := settings["REPO"]
+		if repo == "" {
+			repo = ".*"
+		}
+		if _, ok := ConfigurationMap[reg]; !ok {
+			ConfigurationMap[reg] = make(RepositoryMap)
+		}
+		config := ConfigurationMap[reg][repo]
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if apply, ok := envSettings[name]; ok {
+				if err := apply(&config, settings[name]); err != nil {
+					return fmt.Errorf("%s%s_%s: %s", EnvConfigPrefix, id, name, err)
+				}
+			}
+		}
+		ConfigurationMap[reg][repo] = config
+	}
+	return nil
+}
+
+// splitEnvSetting splits <ID>_<SETTING> into its ID and setting. Settings
+// contain underscores too, so the longest setting that matches is used.
+func splitEnvSetting(s string) (string, string, error) {
+	var match string
+	for _, name := range append([]string{"HOST", "REPO"}, envSettingNames()...) {
+		if strings.HasSuffix(s, "_"+name) && len(name) > len(match) {
+			match = name
+		}
+	}
+	if match == "" {
+		return "", "", fmt.Errorf("unknown registry setting")
+	}
+	id := strings.TrimSuffix(s, "_"+match)
+	if id == "" {
+		return "", "", fmt.Errorf("missing registry id")
+	}
+	return id, match, nil
+}
+
+func envSettingNames() []string {
+	names := make([]string, 0, len(envSettings))
+	for name := range envSettings {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/registry/security"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateConfigFromEnv(t *testing.T) {
+	defer func(m Map) { ConfigurationMap = m }(ConfigurationMap)
+
+	t.Run("new config", func(t *testing.T) {
+		require := require.New(t)
+		ConfigurationMap = Map{}
+		require.NoError(updateConfigFromEnv([]string{
+			"MAKISU_REGISTRY_INTERNAL_HOST=registry.internal:5000",
+			"MAKISU_REGISTRY_INTERNAL_USERNAME=builder",
+			"MAKISU_REGISTRY_INTERNAL_PASSWORD_FILE=/run/secrets/password",
+			"MAKISU_REGISTRY_INTERNAL_TLS_CA=/etc/certs/ca.pem",
+			"MAKISU_REGISTRY_GCR_HOST=gcr.io",
+			"MAKISU_REGISTRY_GCR_REPO=my-project/.*",
+			"MAKISU_REGISTRY_GCR_CREDS_STORE=gcr",
+			"PATH=/bin",
+		}))
+
+		config := ConfigurationMap["registry.internal:5000"][".*"]
+		require.Equal("builder", config.Security.BasicAuth.Username)
+		require.Equal("/run/secrets/password", config.Security.BasicAuth.PasswordFile)
+		require.Equal("/etc/certs/ca.pem", config.Security.TLS.CA.Cert.Path)
+		require.Equal("gcr", ConfigurationMap["gcr.io"]["my-project/.*"].Security.RemoteCredentialsStore)
+	})
+
+	t.Run("overrides file", func(t *testing.T) {
+		require := require.New(t)
+		fileAuth := &security.BasicAuthConfig{PasswordFile: "/file/password"}
+		fileAuth.Username = "file"
+		ConfigurationMap = Map{"gcr.io": RepositoryMap{".*": Config{
+			PushChunk: -1,
+			Security:  security.Config{BasicAuth: fileAuth},
+		}}}
+		require.NoError(updateConfigFromEnv([]string{
+			"MAKISU_REGISTRY_GCR_HOST=gcr.io",
+			"MAKISU_REGISTRY_GCR_USERNAME=env",
+			"MAKISU_REGISTRY_GCR_PLAIN_HTTP=true",
+		}))
+
+		config := ConfigurationMap["gcr.io"][".*"]
+		require.Equal(int64(-1), config.PushChunk)
+		require.Equal("env", config.Security.BasicAuth.Username)
+		require.Equal("/file/password", config.Security.BasicAuth.PasswordFile)
+		require.True(config.Security.PlainHTTP)
+		// The config of the file is copied, not modified.
+		require.Equal("file", fileAuth.Username)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		require := require.New(t)
+		ConfigurationMap = Map{}
+		require.NoError(updateConfigFromEnv([]string{
+			"MAKISU_REGISTRY_SHARED_HOST=registry.shared",
+			"MAKISU_REGISTRY_SHARED_PUSH_CONCURRENCY=2",
+			"MAKISU_REGISTRY_SHARED_REGISTRY_PUSH_CONCURRENCY=4",
+			"MAKISU_REGISTRY_SHARED_REGISTRY_PUSH_RATE=1048576",
+			"MAKISU_REGISTRY_MIRROR_HOST=mirror.internal",
+			"MAKISU_REGISTRY_MIRROR_PULL_CONCURRENCY=16",
+			"MAKISU_REGISTRY_MIRROR_REGISTRY_PULL_CONCURRENCY=32",
+			"MAKISU_REGISTRY_MIRROR_REGISTRY_PULL_RATE=0",
+		}))
+
+		shared := ConfigurationMap["registry.shared"][".*"]
+		require.Equal(2, shared.PushConcurrency)
+		require.Equal(4, shared.RegistryPushConcurrency)
+		require.Equal(1048576.0, shared.RegistryPushRate)
+		mirror := ConfigurationMap["mirror.internal"][".*"]
+		require.Equal(16, mirror.PullConcurrency)
+		require.Equal(32, mirror.RegistryPullConcurrency)
+		require.Equal(0.0, mirror.RegistryPullRate)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			desc    string
+			environ []string
+		}{
+			{"missing host", []string{"MAKISU_REGISTRY_GCR_USERNAME=env"}},
+			{"unknown setting", []string{"MAKISU_REGISTRY_GCR_HOST=gcr.io", "MAKISU_REGISTRY_GCR_TOKEN=x"}},
+			{"missing id", []string{"MAKISU_REGISTRY_HOST=gcr.io"}},
+			{"invalid bool", []string{"MAKISU_REGISTRY_GCR_HOST=gcr.io", "MAKISU_REGISTRY_GCR_TLS_DISABLED=maybe"}},
+			{"invalid int", []string{"MAKISU_REGISTRY_GCR_HOST=gcr.io", "MAKISU_REGISTRY_GCR_PUSH_CONCURRENCY=many"}},
+		}
+		for _, test := range tests {
+			t.Run(test.desc, func(t *testing.T) {
+				ConfigurationMap = Map{}
+				require.Error(t, updateConfigFromEnv(test.environ))
+			})
+		}
+	})
+}
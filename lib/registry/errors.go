@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// Kinds of registry failures. Errors returned by the registry client match them
+// with errors.Is, and can be converted to *Error with errors.As.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrNetwork      = errors.New("network error")
+	ErrTooLarge     = errors.New("too large")
+	ErrUnavailable  = errors.New("unavailable")
+	ErrNotAllowed   = errors.New("not allowed")
+	ErrOffline      = errors.New("offline")
+)
+
+// Error is a registry failure of a known kind. It keeps the message of the
+// underlying error.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// classifyError converts errors returned by httputil.Send to *Error if their
+// kind is known, and returns them unchanged otherwise.
+func classifyError(err error) error {
+	var kind error
+	switch {
+	case httputil.IsNetworkError(err):
+		kind = ErrNetwork
+	case httputil.IsStatus(err, http.StatusUnauthorized), httputil.IsForbidden(err):
+		kind = ErrUnauthorized
+	case httputil.IsNotFound(err):
+		kind = ErrNotFound
+	case httputil.IsStatus(err, http.StatusTooManyRequests):
+		kind = ErrRateLimited
+	case httputil.IsServerError(err):
+		kind = ErrUnavailable
+	default:
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
@@ -0,0 +1,64 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		kind error
+	}{
+		{"unauthorized", httputil.StatusError{Status: http.StatusUnauthorized}, ErrUnauthorized},
+		{"forbidden", httputil.StatusError{Status: http.StatusForbidden}, ErrUnauthorized},
+		{"not found", httputil.StatusError{Status: http.StatusNotFound}, ErrNotFound},
+		{"rate limited", httputil.StatusError{Status: http.StatusTooManyRequests}, ErrRateLimited},
+		{"network", httputil.NetworkError{}, ErrNetwork},
+		{"internal server error", httputil.StatusError{Status: http.StatusInternalServerError}, ErrUnavailable},
+		{"service unavailable", httputil.StatusError{Status: http.StatusServiceUnavailable}, ErrUnavailable},
+		{"unknown", httputil.StatusError{Status: http.StatusBadRequest}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			err := fmt.Errorf("wrapped: %w", classifyError(test.err))
+			require.Equal("wrapped: "+test.err.Error(), err.Error())
+
+			var regErr *Error
+			if test.kind == nil {
+				require.False(errors.As(err, &regErr))
+				return
+			}
+			require.True(errors.Is(err, test.kind))
+			require.True(errors.As(err, &regErr))
+			require.Equal(test.kind, regErr.Kind)
+
+			var statusErr httputil.StatusError
+			if errors.As(test.err, &statusErr) {
+				require.True(errors.As(err, &statusErr))
+			}
+		})
+	}
+}
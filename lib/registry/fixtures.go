@@ -44,6 +44,11 @@ func (noopClientFixture) PullManifest(tag string) (*image.DistributionManifest,
 	return nil, nil
 }
 
+// PullManifestDigest implements registry.Client.PullManifestDigest.
+func (noopClientFixture) PullManifestDigest(tag string) (*image.DistributionManifest, image.Digest, error) {
+	return nil, "", nil
+}
+
 // PushManifest pushes the manifest to the registry.
 func (noopClientFixture) PushManifest(tag string, manifest *image.DistributionManifest) error {
 	return nil
@@ -59,6 +64,11 @@ func (noopClientFixture) PushLayer(layerDigest image.Digest) error {
 	return nil
 }
 
+// LayerExists implements registry.Client.LayerExists.
+func (noopClientFixture) LayerExists(layerDigest image.Digest) (bool, error) {
+	return false, nil
+}
+
 // PullImageConfig implements registry.Client.PullImageConfig.
 func (noopClientFixture) PullImageConfig(layerDigest image.Digest) (os.FileInfo, error) {
 	return nil, nil
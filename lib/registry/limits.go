@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+// registryLimitsKey identifies the limits shared by clients, which are those
+// of the same registry host with the same registry_* settings.
+type registryLimitsKey struct {
+	registry        string
+	pushConcurrency int
+	pullConcurrency int
+	pushRate        float64
+	pullRate        float64
+}
+
+// registryLimits limit the blob transfers of all the clients of a registry,
+// whatever the image and repository they push or pull. Nil slots and buckets
+// mean no limit.
+type registryLimits struct {
+	pushSlots  chan struct{}
+	pullSlots  chan struct{}
+	pushBucket *ratelimit.Bucket
+	pullBucket *ratelimit.Bucket
+}
+
+// sharedRegistryLimits are the limits of the registries used by the build,
+// by key.
+var sharedRegistryLimits sync.Map
+
+// limits returns the limits the client shares with the other clients of its
+// registry.
+func (c DockerRegistryClient) limits() *registryLimits {
+	key := registryLimitsKey{
+		registry:        c.registry,
+		pushConcurrency: c.config.RegistryPushConcurrency,
+		pullConcurrency: c.config.RegistryPullConcurrency,
+		pushRate:        c.config.RegistryPushRate,
+		pullRate:        c.config.RegistryPullRate,
+	}
+	if l, ok := sharedRegistryLimits.Load(key); ok {
+		return l.(*registryLimits)
+	}
+	l := &registryLimits{}
+	if key.pushConcurrency > 0 {
+		l.pushSlots = make(chan struct{}, key.pushConcurrency)
+	}
+	if key.pullConcurrency > 0 {
+		l.pullSlots = make(chan struct{}, key.pullConcurrency)
+	}
+	if key.pushRate > 0 {
+		l.pushBucket = newRateBucket(key.pushRate)
+	}
+	if key.pullRate > 0 {
+		l.pullBucket = newRateBucket(key.pullRate)
+	}
+	actual, _ := sharedRegistryLimits.LoadOrStore(key, l)
+	return actual.(*registryLimits)
+}
+
+// newRateBucket returns a bucket of rate bytes per second, which allows bursts
+// of up to a second of transfer.
+func newRateBucket(rate float64) *ratelimit.Bucket {
+	capacity := int64(rate)
+	if capacity < 1 {
+		capacity = 1
+	}
+	return ratelimit.NewBucketWithRate(rate, capacity)
+}
+
+// acquire waits for a free slot, unless ctx is done first. The returned
+// function frees the slot.
+func acquire(ctx context.Context, slots chan struct{}) (release func(), err error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitRate returns a reader of r limited to the rate of bucket.
+func limitRate(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
+	if bucket == nil {
+		return r
+	}
+	return ratelimit.Reader(r, bucket)
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// checkOnline returns an error matching ErrOffline if requests to the registry
+// are forbidden by Offline.
+func (o Options) checkOnline(registry string) error {
+	if !o.Offline {
+		return nil
+	}
+	return &Error{ErrOffline, fmt.Errorf(
+		"registry %s can't be reached in offline mode", registry)}
+}
+
+// loadLocalManifest returns the manifest of the tag saved in the local store
+// by a previous pull, or an error matching ErrOffline if there is none.
+func (c DockerRegistryClient) loadLocalManifest(tag string) (*image.DistributionManifest, error) {
+	if _, err := c.store.Manifests.GetStoreFileStat(c.repository, tag); os.IsNotExist(err) {
+		name := image.NewImageName(c.registry, c.repository, tag)
+		return nil, &Error{ErrOffline, fmt.Errorf(
+			"image %s isn't available locally and can't be pulled in offline mode", name)}
+	} else if err != nil {
+		return nil, fmt.Errorf("stat local manifest: %w", err)
+	}
+	return c.loadManifest(tag)
+}
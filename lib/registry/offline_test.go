@@ -0,0 +1,55 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientOffline(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	opts := DefaultOptions()
+	opts.Offline = true
+
+	c := New(store, "localhost:5055", testutil.SampleImageRepoName).WithOptions(opts)
+	manifest, err := c.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+	pulled, digest, err := c.PullManifestDigest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(manifest, pulled)
+	expected, err := opts.ManifestDigest(manifest)
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	_, err = c.PullManifest("missing")
+	require.Error(err)
+	require.True(errors.Is(err, ErrOffline))
+	require.Contains(err.Error(), "isn't available locally")
+
+	_, err = c.PullLayer(image.Digest("sha256:" + testutil.SampleImageManifestDigest))
+	require.True(errors.Is(err, ErrOffline))
+	err = c.PushLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.True(errors.Is(err, ErrOffline))
+}
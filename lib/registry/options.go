@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// Options are the settings of the requests and manifests of the clients of a
+// build, on top of the Config of each registry, so that builds with different
+// settings can use registries in the same process.
+type Options struct {
+	// Offline forbids clients from sending requests to registries. Manifests
+	// and blobs are only read from the local store, which images must have
+	// been pulled to beforehand.
+	Offline bool
+	// AllowedRegistries and DeniedRegistries are the registry hosts that
+	// clients may send requests to. Patterns can contain shell wildcards like
+	// "*.corp", and match hosts with any port unless they have one. Hosts
+	// matching a denied pattern are never allowed; if there are allowed
+	// patterns, hosts must match one of them.
+	AllowedRegistries []string
+	DeniedRegistries  []string
+	// ManifestListPlatform is the platform whose manifest is pulled when a
+	// tag references a manifest list or an OCI index.
+	ManifestListPlatform image.Platform
+	// VerifyPushedBlobs makes pushes check that the registry serves back every
+	// blob of the image once they are all pushed, before pushing the manifest,
+	// to catch registries that accept blobs they fail to store.
+	VerifyPushedBlobs bool
+	// CanonicalManifests makes the client push manifests serialized as
+	// canonical JSON, instead of indented with their fields in declaration
+	// order. Both are deterministic, but canonical JSON is what some digest
+	// pinning tools expect. Changing it changes the digests of the pushed
+	// manifests.
+	CanonicalManifests bool
+	// OCIAnnotations are set in the annotations of the OCI manifests pushed
+	// by the client. Docker manifests have no annotations.
+	OCIAnnotations map[string]string
+}
+
+// DefaultOptions returns the options of clients without flags, which pull the
+// manifests of the default platform from any registry.
+func DefaultOptions() Options {
+	return Options{
+		ManifestListPlatform: image.DefaultPlatform(),
+	}
+}
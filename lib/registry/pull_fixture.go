@@ -8,14 +8,14 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 )
 
 // PullClientFixture returns a new registry client fixture that can handle
 // image pull requests.
-func PullClientFixture(ctx *context.BuildContext, testdataDir string) (*DockerRegistryClient, error) {
+func PullClientFixture(store *storage.ImageStore, testdataDir string) (*DockerRegistryClient, error) {
 	image := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
 	cli := &http.Client{
 		Transport: pullTransportFixture{
@@ -23,7 +23,7 @@ func PullClientFixture(ctx *context.BuildContext, testdataDir string) (*DockerRe
 			testdataDir: testdataDir,
 		},
 	}
-	c := NewWithClient(ctx.ImageStore, image.GetRegistry(), image.GetRepository(), cli)
+	c := NewWithClient(store, image.GetRegistry(), image.GetRepository(), cli)
 	c.config.Security.TLS.Client.Disabled = true
 	return c, nil
 }
@@ -5,20 +5,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 )
 
 // PushClientFixture returns a new registry client fixture that can handle
 // image push requests.
-func PushClientFixture(ctx *context.BuildContext) (*DockerRegistryClient, error) {
+func PushClientFixture(store *storage.ImageStore) (*DockerRegistryClient, error) {
 	image := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
 	cli := &http.Client{
 		Transport: pushTransportFixture{image},
 	}
-	c := NewWithClient(ctx.ImageStore, image.GetRegistry(), image.GetRepository(), cli)
+	c := NewWithClient(store, image.GetRegistry(), image.GetRepository(), cli)
 	c.config.Security.TLS.Client.Disabled = true
 	return c, nil
 }
@@ -88,6 +89,15 @@ func (t pushTransportFixture) RoundTrip(r *http.Request) (*http.Response, error)
 		"PATCH" + chunkUploadURL: commitUploadURL,
 	}
 
+	// Manifests pushed by digest.
+	if r.Method == "PUT" && strings.HasPrefix(url, repoURL+"/manifests/sha256:") {
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     make(http.Header),
+		}, nil
+	}
+
 	resp, found := resps[r.Method+url]
 	if !found {
 		return &http.Response{
@@ -0,0 +1,154 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// emptyConfig is the content of the config of OCI artifacts.
+var emptyConfig = []byte("{}")
+
+// ManifestDescriptor returns the descriptor of the manifest as pushed by the
+// client, which artifacts attached to it reference as their subject.
+func (o Options) ManifestDescriptor(manifest *image.DistributionManifest) (image.Descriptor, error) {
+	payload, err := o.marshalManifest(manifest)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("marshal manifest: %w", err)
+	}
+	digest, err := image.NewDigester().FromBytes(payload)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("compute manifest digest: %w", err)
+	}
+	return image.Descriptor{
+		MediaType: manifest.MediaType,
+		Size:      int64(len(payload)),
+		Digest:    digest,
+	}, nil
+}
+
+// PushReferrer pushes the content as an OCI artifact attached to the subject
+// manifest, which registries list as one of its referrers. The artifact
+// manifest is pushed by digest, which is returned.
+func (c DockerRegistryClient) PushReferrer(
+	subject image.Descriptor, artifactType string, content []byte) (image.Digest, error) {
+
+	config, err := c.saveBlob(image.MediaTypeOCIEmpty, emptyConfig)
+	if err != nil {
+		return "", fmt.Errorf("save artifact config: %w", err)
+	}
+	layer, err := c.saveBlob(artifactType, content)
+	if err != nil {
+		return "", fmt.Errorf("save artifact: %w", err)
+	}
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        config,
+		Layers:        []image.Descriptor{layer},
+		Subject:       &subject,
+	}
+	digest, err := c.opts.ManifestDigest(manifest)
+	if err != nil {
+		return "", fmt.Errorf("compute artifact manifest digest: %w", err)
+	}
+
+	if err := c.pushLayers(manifest); err != nil {
+		return "", err
+	}
+	if err := c.PushManifest(string(digest), manifest); err != nil {
+		return "", fmt.Errorf("push artifact manifest: %w", err)
+	}
+	log.Infof("* Pushed %s %s/%s@%s for %s", artifactType, c.registry, c.repository, digest, subject.Digest)
+	return digest, nil
+}
+
+// PushArtifact pushes an OCI artifact made of the given blobs, which must be
+// in the layer store, under the tag. The artifact manifest digest is returned.
+func (c DockerRegistryClient) PushArtifact(
+	tag, artifactType string, layers []image.Descriptor,
+	annotations map[string]string) (image.Digest, error) {
+
+	config, err := c.saveBlob(image.MediaTypeOCIEmpty, emptyConfig)
+	if err != nil {
+		return "", fmt.Errorf("save artifact config: %w", err)
+	}
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        config,
+		Layers:        layers,
+		Annotations:   annotations,
+	}
+	digest, err := c.opts.ManifestDigest(manifest)
+	if err != nil {
+		return "", fmt.Errorf("compute artifact manifest digest: %w", err)
+	}
+	if err := c.pushLayers(manifest); err != nil {
+		return "", err
+	}
+	if err := c.PushManifest(tag, manifest); err != nil {
+		return "", fmt.Errorf("push artifact manifest: %w", err)
+	}
+	return digest, nil
+}
+
+// PullArtifact pulls the manifest of the OCI artifact under the tag. Its blobs
+// are not pulled.
+func (c DockerRegistryClient) PullArtifact(tag string) (*image.DistributionManifest, error) {
+	manifest, _, err := c.pullManifest(tag, image.MediaTypeOCIManifest)
+	return manifest, err
+}
+
+// EmptyDescriptor returns the descriptor of the empty blob that OCI artifacts
+// without content reference as their layer, after adding it to the layer store.
+func (c DockerRegistryClient) EmptyDescriptor() (image.Descriptor, error) {
+	return c.saveBlob(image.MediaTypeOCIEmpty, emptyConfig)
+}
+
+// saveBlob adds the content to the layer store, from which it can be pushed.
+func (c DockerRegistryClient) saveBlob(mediaType string, content []byte) (image.Descriptor, error) {
+	digest, err := image.NewDigester().FromBytes(content)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("compute digest: %w", err)
+	}
+	f, err := ioutil.TempFile(c.store.SandboxDir, "")
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("create tmp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("write tmp file: %w", err)
+	}
+	if err := c.store.Layers.LinkStoreFileFrom(digest.Hex(), f.Name()); err != nil && !os.IsExist(err) {
+		return image.Descriptor{}, fmt.Errorf("commit blob to store: %w", err)
+	}
+	return image.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    digest,
+	}, nil
+}
@@ -0,0 +1,171 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blobStoreTransportFixture accepts all pushes, and records the pushed blobs
+// and manifests by digest.
+type blobStoreTransportFixture struct {
+	sync.Mutex
+
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   map[string][]byte
+	started   int
+}
+
+func newBlobStoreTransportFixture() *blobStoreTransportFixture {
+	return &blobStoreTransportFixture{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+	}
+}
+
+func (t *blobStoreTransportFixture) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+		Header:     make(http.Header),
+		Request:    r,
+	}
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	path := r.URL.Path
+	switch {
+	case r.Method == "HEAD" && strings.Contains(path, "/blobs/"):
+		resp.StatusCode = http.StatusNotFound
+	case r.Method == "POST" && strings.HasSuffix(path, "/blobs/uploads/"):
+		resp.StatusCode = http.StatusAccepted
+		t.started++
+		resp.Header.Set("Location", fmt.Sprintf("%supload%d", path, t.started))
+	case r.Method == "PATCH":
+		t.uploads[path] = append(t.uploads[path], body...)
+		resp.StatusCode = http.StatusAccepted
+		resp.Header.Set("Location", path)
+	case r.Method == "PUT" && strings.Contains(path, "/blobs/uploads/"):
+		t.blobs[r.URL.Query().Get("digest")] = t.uploads[path]
+		delete(t.uploads, path)
+		resp.StatusCode = http.StatusCreated
+	case r.Method == "PUT" && strings.Contains(path, "/manifests/"):
+		t.manifests[path[strings.LastIndex(path, "/")+1:]] = body
+		resp.StatusCode = http.StatusCreated
+	case r.Method == "GET" && strings.Contains(path, "/manifests/"):
+		payload, ok := t.manifests[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			resp.StatusCode = http.StatusNotFound
+			break
+		}
+		resp.Header.Set("Content-Type", r.Header.Get("Accept"))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	default:
+		resp.StatusCode = http.StatusNotFound
+	}
+	return resp, nil
+}
+
+func TestPushReferrer(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	transport := newBlobStoreTransportFixture()
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	p.client.Transport = transport
+
+	manifest, err := p.loadManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	subject, err := p.opts.ManifestDescriptor(manifest)
+	require.NoError(err)
+	digest, err := p.opts.ManifestDigest(manifest)
+	require.NoError(err)
+	require.Equal(digest, subject.Digest)
+	require.Equal(image.MediaTypeManifest, subject.MediaType)
+
+	content := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	pushed, err := p.PushReferrer(subject, "application/vnd.in-toto+json", content)
+	require.NoError(err)
+
+	payload, ok := transport.manifests[string(pushed)]
+	require.True(ok)
+	pushedDigest, err := image.NewDigester().FromBytes(payload)
+	require.NoError(err)
+	require.Equal(pushed, pushedDigest)
+
+	var artifact image.DistributionManifest
+	require.NoError(json.Unmarshal(payload, &artifact))
+	require.Equal(image.MediaTypeOCIManifest, artifact.MediaType)
+	require.Equal("application/vnd.in-toto+json", artifact.ArtifactType)
+	require.Equal(&subject, artifact.Subject)
+	require.Equal(image.MediaTypeOCIEmpty, artifact.Config.MediaType)
+	require.Equal([]byte("{}"), transport.blobs[string(artifact.Config.Digest)])
+	require.Len(artifact.Layers, 1)
+	require.Equal(content, transport.blobs[string(artifact.Layers[0].Digest)])
+}
+
+func TestPushPullArtifact(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	transport := newBlobStoreTransportFixture()
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+	p.client.Transport = transport
+
+	_, err = p.PullArtifact("artifact")
+	require.True(errors.Is(err, ErrNotFound))
+
+	layer, err := p.EmptyDescriptor()
+	require.NoError(err)
+	annotations := map[string]string{"key": "value"}
+	digest, err := p.PushArtifact(
+		"artifact", "application/vnd.test", []image.Descriptor{layer}, annotations)
+	require.NoError(err)
+	require.Contains(transport.manifests, "artifact")
+
+	artifact, err := p.PullArtifact("artifact")
+	require.NoError(err)
+	pulledDigest, err := p.opts.ManifestDigest(artifact)
+	require.NoError(err)
+	require.Equal(digest, pulledDigest)
+	require.Equal("application/vnd.test", artifact.ArtifactType)
+	require.Equal(annotations, artifact.Annotations)
+	require.Equal([]image.Descriptor{layer}, artifact.Layers)
+	require.Equal([]byte("{}"), transport.blobs[string(layer.Digest)])
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	// Username ACR accepts along with a refresh token.
+	azureTokenUsername = "00000000-0000-0000-0000-000000000000"
+	azureResource      = "https://management.azure.com/"
+	azureTimeout       = 10 * time.Second
+)
+
+// Endpoints used to get ACR tokens.
+var (
+	azureIMDSURL     = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureLoginURL    = "https://login.microsoftonline.com/%s/oauth2/token"
+	azureExchangeURL = "https://%s/oauth2/exchange"
+)
+
+// azureTokens caches ACR refresh tokens by registry. Failures are cached too,
+// to not wait on an unreachable identity endpoint every request.
+var azureTokens = struct {
+	sync.Mutex
+	m map[string]*azureToken
+}{m: make(map[string]*azureToken)}
+
+type azureToken struct {
+	token    string
+	expiry   time.Time
+	err      error
+	failedAt time.Time
+}
+
+// isAzureRegistry returns true for ACR hosts.
+func isAzureRegistry(addr string) bool {
+	return strings.HasSuffix(registryHostname(addr), ".azurecr.io")
+}
+
+// getAzureCredentials returns credentials for ACR, exchanging an AAD access
+// token for an ACR refresh token. The token handler of the registry transport
+// then uses it to get access tokens scoped to the repository.
+// The AAD token is obtained with the service principal in $AZURE_TENANT_ID,
+// $AZURE_CLIENT_ID and $AZURE_CLIENT_SECRET if set, and from the managed
+// identity of the host otherwise.
+func getAzureCredentials(addr string) (types.AuthConfig, error) {
+	azureTokens.Lock()
+	defer azureTokens.Unlock()
+	t, ok := azureTokens.m[addr]
+	if !ok {
+		t = &azureToken{}
+		azureTokens.m[addr] = t
+	}
+	// Refresh the token a minute before it expires.
+	if t.token == "" || !time.Now().Add(time.Minute).Before(t.expiry) {
+		if t.err != nil && time.Since(t.failedAt) < 5*time.Minute {
+			return types.AuthConfig{}, t.err
+		}
+		token, expiry, err := fetchAzureRefreshToken(addr)
+		if err != nil {
+			t.err, t.failedAt = err, time.Now()
+			return types.AuthConfig{}, err
+		}
+		t.token, t.expiry, t.err = token, expiry, nil
+	}
+	return types.AuthConfig{Username: azureTokenUsername, IdentityToken: t.token}, nil
+}
+
+// fetchAzureRefreshToken returns an ACR refresh token, which lives at least as
+// long as the AAD token it was exchanged for.
+func fetchAzureRefreshToken(addr string) (string, time.Time, error) {
+	aadToken, expiry, err := fetchAADToken()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("get aad token: %s", err)
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {addr},
+		"access_token": {aadToken},
+	}
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := postAzureForm(fmt.Sprintf(azureExchangeURL, addr), form, &exchange); err != nil {
+		return "", time.Time{}, fmt.Errorf("exchange aad token: %s", err)
+	} else if exchange.RefreshToken == "" {
+		return "", time.Time{}, fmt.Errorf("exchange aad token: empty refresh token")
+	}
+	return exchange.RefreshToken, expiry, nil
+}
+
+func fetchAADToken() (string, time.Time, error) {
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"resource":      {azureResource},
+		}
+		loginURL := fmt.Sprintf(azureLoginURL, os.Getenv("AZURE_TENANT_ID"))
+		if err := postAzureForm(loginURL, form, &token); err != nil {
+			return "", time.Time{}, fmt.Errorf("client credentials: %s", err)
+		}
+	} else {
+		query := url.Values{
+			"api-version": {"2018-02-01"},
+			"resource":    {azureResource},
+		}
+		// Picks a user-assigned identity.
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		resp, err := httputil.Send(
+			"GET",
+			azureIMDSURL+"?"+query.Encode(),
+			httputil.SendTimeout(azureTimeout),
+			httputil.SendHeaders(map[string]string{"Metadata": "true"}),
+			httputil.SendAcceptedCodes(http.StatusOK))
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("managed identity: %s", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", time.Time{}, fmt.Errorf("decode managed identity token: %s", err)
+		}
+	}
+
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("empty access token")
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parse token expiry: %s", err)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
+
+func postAzureForm(URL string, form url.Values, result interface{}) error {
+	resp, err := httputil.Send(
+		"POST",
+		URL,
+		httputil.SendTimeout(azureTimeout),
+		httputil.SendHeaders(map[string]string{"Content-Type": "application/x-www-form-urlencoded"}),
+		httputil.SendBody(strings.NewReader(form.Encode())),
+		httputil.SendAcceptedCodes(http.StatusOK))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode response: %s", err)
+	}
+	return nil
+}
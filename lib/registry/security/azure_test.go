@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsAzureRegistry(t *testing.T) {
+	require := require.New(t)
+	require.True(isAzureRegistry("myregistry.azurecr.io"))
+	require.True(isAzureRegistry("myregistry.azurecr.io:443"))
+	require.False(isAzureRegistry("azurecr.io.example.com"))
+	require.False(isAzureRegistry("gcr.io"))
+}
+
+func TestGetAzureCredentials(t *testing.T) {
+	require := require.New(t)
+
+	var exchanges int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// Managed identity returns expires_in as a string.
+			w.Write([]byte(`{"access_token": "aad", "expires_in": "3599"}`))
+		case "/oauth2/exchange":
+			atomic.AddInt32(&exchanges, 1)
+			r.ParseForm()
+			if r.PostForm.Get("grant_type") != "access_token" || r.PostForm.Get("access_token") != "aad" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"refresh_token": "refresh"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	defer func(imds, exchange string) {
+		azureIMDSURL, azureExchangeURL = imds, exchange
+	}(azureIMDSURL, azureExchangeURL)
+	azureIMDSURL = server.URL + "/metadata/identity/oauth2/token"
+	azureExchangeURL = "http://%s/oauth2/exchange"
+
+	for i := 0; i < 2; i++ {
+		authConfig, err := getAzureCredentials(u.Host)
+		require.NoError(err)
+		require.Equal(azureTokenUsername, authConfig.Username)
+		require.Equal("refresh", authConfig.IdentityToken)
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&exchanges))
+}
@@ -15,15 +15,19 @@
 package security
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/distribution/registry/client/auth/challenge"
 	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/engine-api/types"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/utils/httputil"
 )
 
@@ -37,9 +41,175 @@ var v2Version = auth.APIVersion{
 	Version: "2.0",
 }
 
+// ErrNotV2Registry is returned when a registry doesn't serve /v2/, or its
+// Docker-Distribution-Api-Version header names another API version.
+var ErrNotV2Registry = errors.New("registry does not support the v2 API")
+
+// pingKey identifies registry hosts in the ping cache.
+type pingKey struct {
+	addr      string
+	plainHTTP bool
+}
+
+// pingResult is the outcome of the /v2/ handshake with a registry host.
+type pingResult struct {
+	cm  challenge.Manager
+	err error
+}
+
+// pingEntry holds the handshake of a registry host. Its mutex is held while the
+// host is pinged, so that the requests to the host wait for a single ping
+// without blocking the pings of other hosts.
+type pingEntry struct {
+	sync.Mutex
+	result *pingResult
+}
+
+// pings caches the handshake of every registry host, so that it is done once
+// for all its repositories. Only successes and ErrNotV2Registry are cached,
+// other errors are retried by the next request.
+var pings = struct {
+	sync.Mutex
+	m map[pingKey]*pingEntry
+}{m: make(map[pingKey]*pingEntry)}
+
+// transportKey identifies authenticated transports in the cache.
+type transportKey struct {
+	addr       string
+	repo       string
+	authConfig types.AuthConfig
+	anonymous  bool
+	plainHTTP  bool
+
+	// newConnections is true for the transports of Config.NewConnections,
+	// whose base transport doesn't reuse connections.
+	newConnections bool
+
+	// base is the transport the requests are sent with, which has the TLS
+	// config of the registry, so that registries with the same credentials
+	// but different TLS configs don't share a transport.
+	base http.RoundTripper
+}
+
+// scope returns the key without its credentials, which identifies the
+// transports that the ones of refreshed credentials supersede.
+func (k transportKey) scope() transportKey {
+	k.authConfig = types.AuthConfig{}
+	return k
+}
+
+// transportEntry holds a cached transport. Its mutex is held while the
+// transport is created, so that the requests of a scope wait for a single
+// transport without blocking the creation of the transports of other scopes.
+type transportEntry struct {
+	sync.Mutex
+	rt http.RoundTripper
+}
+
+// transports caches authenticated transports by registry and repository scope.
+// Their token handler reuses bearer tokens until they expire, so caching them
+// saves the ping and token requests of every registry call. Only the transport
+// of the latest credentials of a scope is kept, e.g. once a short-lived Google
+// or Azure token was refreshed.
+var transports = struct {
+	sync.Mutex
+	m map[transportKey]*transportEntry
+}{m: make(map[transportKey]*transportEntry)}
+
 // BasicAuthTransport creates a transport that does basic authentication.
-func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig types.AuthConfig) (http.RoundTripper, error) {
-	cm, err := ping(addr, tr)
+// Transports are cached, and evicted once the registry rejects their token.
+// If plainHTTP is true, the registry is pinged over http instead of https.
+func BasicAuthTransport(addr, repo string, plainHTTP bool, tr http.RoundTripper, authConfig types.AuthConfig) (http.RoundTripper, error) {
+	key := transportKey{addr: addr, repo: repo, authConfig: authConfig, plainHTTP: plainHTTP}
+	return basicAuthTransport(key, tr)
+}
+
+func basicAuthTransport(key transportKey, tr http.RoundTripper) (http.RoundTripper, error) {
+	return cachedTransport(key, tr, func() (http.RoundTripper, error) {
+		return newBasicAuthTransport(key.addr, key.repo, key.plainHTTP, tr, key.authConfig)
+	})
+}
+
+// AnonymousTransport creates a transport that fetches pull tokens without
+// credentials, for registries that require tokens even for public
+// repositories. It is cached like basic auth transports.
+func AnonymousTransport(addr, repo string, plainHTTP bool, tr http.RoundTripper) (http.RoundTripper, error) {
+	key := transportKey{addr: addr, repo: repo, anonymous: true, plainHTTP: plainHTTP}
+	return anonymousTransport(key, tr)
+}
+
+func anonymousTransport(key transportKey, tr http.RoundTripper) (http.RoundTripper, error) {
+	return cachedTransport(key, tr, func() (http.RoundTripper, error) {
+		return newAnonymousTransport(key.addr, key.repo, key.plainHTTP, tr)
+	})
+}
+
+func cachedTransport(
+	key transportKey, base http.RoundTripper,
+	create func() (http.RoundTripper, error)) (http.RoundTripper, error) {
+
+	if !reflect.TypeOf(base).Comparable() {
+		// Such transports can't be told apart, so they aren't cached.
+		return create()
+	}
+	key.base = base
+	transports.Lock()
+	entry, ok := transports.m[key]
+	if !ok {
+		for k := range transports.m {
+			if k.scope() == key.scope() {
+				delete(transports.m, k)
+			}
+		}
+		entry = &transportEntry{}
+		transports.m[key] = entry
+	}
+	transports.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.rt != nil {
+		return entry.rt, nil
+	}
+	rt, err := create()
+	if err != nil {
+		// The next request creates the transport again.
+		return nil, err
+	}
+	entry.rt = evictingTransport{key, rt, base}
+	return entry.rt, nil
+}
+
+// evictingTransport removes its transport from the cache on 401 responses,
+// so that the next request authenticates again.
+// Requests to other hosts, e.g. blob downloads redirected to a storage
+// backend, are sent with the base transport so they don't get the registry
+// credentials.
+type evictingTransport struct {
+	key  transportKey
+	rt   http.RoundTripper
+	base http.RoundTripper
+}
+
+func (t evictingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != strings.SplitN(t.key.addr, "/", 2)[0] {
+		return t.base.RoundTrip(r)
+	}
+	resp, err := t.rt.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		transports.Lock()
+		delete(transports.m, t.key)
+		transports.Unlock()
+		// The auth challenge may have changed as well.
+		pings.Lock()
+		delete(pings.m, pingKey{t.key.addr, t.key.plainHTTP})
+		pings.Unlock()
+	}
+	return resp, err
+}
+
+func newBasicAuthTransport(addr, repo string, plainHTTP bool, tr http.RoundTripper, authConfig types.AuthConfig) (http.RoundTripper, error) {
+	cm, err := ping(addr, plainHTTP, tr)
 	if err != nil {
 		return nil, fmt.Errorf("ping v2 registry: %s", err)
 	}
@@ -64,18 +234,75 @@ func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig type
 	}
 }
 
-func ping(addr string, tr http.RoundTripper) (challenge.Manager, error) {
+func newAnonymousTransport(addr, repo string, plainHTTP bool, tr http.RoundTripper) (http.RoundTripper, error) {
+	cm, err := ping(addr, plainHTTP, tr)
+	if err != nil {
+		return nil, fmt.Errorf("ping v2 registry: %w", err)
+	}
+	// Without credentials, the token handler requests tokens anonymously.
+	return transport.NewTransport(tr, auth.NewAuthorizer(cm, auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+		Transport: tr,
+		Scopes: []auth.Scope{
+			auth.RepositoryScope{
+				Repository: repo,
+				Actions:    []string{"pull"},
+			},
+		},
+		ClientID: "docker",
+	}))), nil
+}
+
+// ping performs the /v2/ version check handshake with the registry, and
+// returns the auth challenges of its response. Results are cached per host.
+func ping(addr string, plainHTTP bool, tr http.RoundTripper) (challenge.Manager, error) {
+	key := pingKey{addr, plainHTTP}
+	pings.Lock()
+	entry, ok := pings.m[key]
+	if !ok {
+		entry = &pingEntry{}
+		pings.m[key] = entry
+	}
+	pings.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.result != nil {
+		return entry.result.cm, entry.result.err
+	}
+	cm, err := doPing(addr, plainHTTP, tr)
+	if err == nil || errors.Is(err, ErrNotV2Registry) {
+		entry.result = &pingResult{cm, err}
+	}
+	return cm, err
+}
+
+func doPing(addr string, plainHTTP bool, tr http.RoundTripper) (challenge.Manager, error) {
+	transportOpt := httputil.SendTLSTransport(tr)
+	if plainHTTP {
+		transportOpt = httputil.SendTransport(tr)
+	}
 	resp, err := httputil.Send(
 		"GET",
 		fmt.Sprintf(basePingQuery, addr),
-		httputil.SendTLSTransport(tr),
+		transportOpt,
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusUnauthorized),
 	)
-	if err != nil {
+	if httputil.IsNotFound(err) {
+		// v1 registries don't serve /v2/ at all.
+		return nil, fmt.Errorf("%s: %w", addr, ErrNotV2Registry)
+	} else if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	versions := auth.APIVersions(resp, registryVersionHeader)
+	if len(versions) == 0 {
+		// Some registries and proxies in front of them don't send the header,
+		// the requests to the v2 API fail later if they don't serve it.
+		log.Warnf("The /v2/ response of registry %s has no %s header, assuming it serves the v2 API",
+			addr, registryVersionHeader)
+		versions = []auth.APIVersion{v2Version}
+	}
 	for _, version := range versions {
 		if version == v2Version {
 			cm := challenge.NewSimpleManager()
@@ -85,7 +312,8 @@ func ping(addr string, tr http.RoundTripper) (challenge.Manager, error) {
 			return cm, nil
 		}
 	}
-	return nil, fmt.Errorf("registry is not v2")
+	return nil, fmt.Errorf("%s: %w, %s header of /v2/ is %q",
+		addr, ErrNotV2Registry, registryVersionHeader, resp.Header.Get(registryVersionHeader))
 }
 
 type defaultCredStore struct {
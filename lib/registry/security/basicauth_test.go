@@ -0,0 +1,338 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicAuthTransportCache(t *testing.T) {
+	require := require.New(t)
+
+	var pings, tokens int32
+	unauthorized := false
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			atomic.AddInt32(&pings, 1)
+			w.Header().Set(registryVersionHeader, "registry/2.0")
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			atomic.AddInt32(&tokens, 1)
+			w.Write([]byte(`{"token": "abc", "expires_in": 3600}`))
+		default:
+			if unauthorized {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	addr := u.Host
+	authConfig := types.AuthConfig{Username: "user", Password: "password"}
+
+	// Token is fetched once and reused by the cached transport.
+	for i := 0; i < 3; i++ {
+		rt, err := BasicAuthTransport(addr, "repo", false, http.DefaultTransport, authConfig)
+		require.NoError(err)
+		resp, err := (&http.Client{Transport: rt}).Get(server.URL + "/v2/repo/manifests/latest")
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&pings))
+	require.Equal(int32(1), atomic.LoadInt32(&tokens))
+
+	// A 401 evicts the transport.
+	unauthorized = true
+	rt, err := BasicAuthTransport(addr, "repo", false, http.DefaultTransport, authConfig)
+	require.NoError(err)
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL + "/v2/repo/manifests/latest")
+	require.NoError(err)
+	resp.Body.Close()
+	_, err = BasicAuthTransport(addr, "repo", false, http.DefaultTransport, authConfig)
+	require.NoError(err)
+	require.Equal(int32(2), atomic.LoadInt32(&pings))
+
+	// Transports with another base transport, e.g. with another TLS config,
+	// aren't shared.
+	unauthorized = false
+	rt1, err := BasicAuthTransport(addr, "repo", false, http.DefaultTransport, authConfig)
+	require.NoError(err)
+	other := http.DefaultTransport.(*http.Transport).Clone()
+	rt2, err := BasicAuthTransport(addr, "repo", false, other, authConfig)
+	require.NoError(err)
+	require.True(rt1 != rt2)
+	rt3, err := BasicAuthTransport(addr, "repo", false, other, authConfig)
+	require.NoError(err)
+	require.True(rt2 == rt3)
+
+	// Refreshed credentials supersede the transports of the old ones.
+	refreshed := types.AuthConfig{Username: "user", Password: "refreshed"}
+	_, err = BasicAuthTransport(addr, "repo", false, other, refreshed)
+	require.NoError(err)
+	transports.Lock()
+	for k := range transports.m {
+		if k.addr == addr && k.base == other {
+			require.Equal(refreshed, k.authConfig)
+		}
+	}
+	transports.Unlock()
+}
+
+func TestBasicAuthTransportDoesNotBlockOtherScopes(t *testing.T) {
+	require := require.New(t)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer fast.Close()
+	slowURL, err := url.Parse(slow.URL)
+	require.NoError(err)
+	fastURL, err := url.Parse(fast.URL)
+	require.NoError(err)
+
+	go AnonymousTransport(slowURL.Host, "repo", true, http.DefaultTransport)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := AnonymousTransport(fastURL.Host, "repo", true, http.DefaultTransport)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		require.FailNow("transport of another registry blocked by the slow one")
+	}
+}
+
+func TestAnonymousTransport(t *testing.T) {
+	require := require.New(t)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set(registryVersionHeader, "registry/2.0")
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			if r.Header.Get("Authorization") != "" ||
+				r.URL.Query().Get("scope") != "repository:library/alpine:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"token": "anonymous", "expires_in": 3600}`))
+		default:
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	rt, err := AnonymousTransport(u.Host, "library/alpine", false, http.DefaultTransport)
+	require.NoError(err)
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL + "/v2/library/alpine/manifests/latest")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestBasicAuthTransportCrossHostRedirect(t *testing.T) {
+	require := require.New(t)
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("blob"))
+	}))
+	defer storage.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set(registryVersionHeader, "registry/2.0")
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			w.Write([]byte(`{"token": "abc", "expires_in": 3600}`))
+		default:
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, storage.URL+"/docker/registry/v2/blobs/sha256/ab/abc/data",
+				http.StatusTemporaryRedirect)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	authConfig := types.AuthConfig{Username: "user", Password: "redirect"}
+	rt, err := BasicAuthTransport(u.Host, "repo", false, http.DefaultTransport, authConfig)
+	require.NoError(err)
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL + "/v2/repo/blobs/sha256:abc")
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Equal("blob", string(body))
+}
+
+func TestPingCachedPerHost(t *testing.T) {
+	require := require.New(t)
+
+	var pings int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			atomic.AddInt32(&pings, 1)
+		}
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	for _, repo := range []string{"repo1", "repo2", "repo3"} {
+		_, err := AnonymousTransport(u.Host, repo, true, http.DefaultTransport)
+		require.NoError(err)
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&pings))
+}
+
+func TestPingDoesNotBlockOtherHosts(t *testing.T) {
+	require := require.New(t)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer fast.Close()
+	slowURL, err := url.Parse(slow.URL)
+	require.NoError(err)
+	fastURL, err := url.Parse(fast.URL)
+	require.NoError(err)
+
+	go ping(slowURL.Host, true, http.DefaultTransport)
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := ping(fastURL.Host, true, http.DefaultTransport)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		require.FailNow("ping of another host blocked by the slow one")
+	}
+}
+
+func TestPingWithoutVersionHeader(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			require := require.New(t)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			require.NoError(err)
+
+			_, err = ping(u.Host, true, http.DefaultTransport)
+			require.NoError(err)
+		})
+	}
+}
+
+func TestPingNotV2Registry(t *testing.T) {
+	tests := []struct {
+		desc    string
+		handler http.HandlerFunc
+	}{
+		{"other version", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(registryVersionHeader, "registry/1.0")
+		}},
+		{"not found", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			var pings int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&pings, 1)
+				test.handler(w, r)
+			}))
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			require.NoError(err)
+
+			// The failed handshake is cached as well.
+			for i := 0; i < 2; i++ {
+				_, err = ping(u.Host, true, http.DefaultTransport)
+				require.True(errors.Is(err, ErrNotV2Registry), "%v", err)
+			}
+			require.Equal(int32(1), atomic.LoadInt32(&pings))
+		})
+	}
+}
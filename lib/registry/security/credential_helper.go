@@ -0,0 +1,132 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/pathutils"
+
+	"github.com/docker/docker-credential-helpers/client"
+)
+
+const credentialHelperPrefix = "docker-credential-"
+
+// CredentialHelperTimeout is the maximum time a credential helper is allowed
+// to run before it is killed.
+var CredentialHelperTimeout = time.Minute
+
+// CredentialHelperRetries is the number of times a failed credential helper
+// call is retried. Helpers that have no credentials for a registry are not
+// retried.
+var CredentialHelperRetries = 0
+
+// CredentialHelperBackoff is the wait before the first retry of a credential
+// helper call, doubled after each retry.
+var CredentialHelperBackoff = time.Second
+
+// CredentialHelperDirs are the dirs searched, in order, for the
+// docker-credential-<helper> binaries of credential helpers.
+// Default is the internal dir of makisu.
+var CredentialHelperDirs = []string{pathutils.DefaultInternalDir}
+
+// SetCredentialHelperDirs sets global var CredentialHelperDirs. The dirs must
+// be absolute, so that helpers don't depend on the working dir. An empty list
+// keeps the default.
+func SetCredentialHelperDirs(dirs []string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("credential helper dir %s is not absolute", dir)
+		}
+	}
+	CredentialHelperDirs = dirs
+	return nil
+}
+
+// resolveCredentialHelper returns the path of the binary of the given
+// credential helper in CredentialHelperDirs. Helper names can't contain path
+// separators, so that configs can't run binaries outside of these dirs.
+func resolveCredentialHelper(helper string) (string, error) {
+	if helper == "" || helper == "." || helper == ".." || strings.ContainsAny(helper, `/\`) {
+		return "", fmt.Errorf("invalid credential helper name %q", helper)
+	}
+	name := credentialHelperPrefix + helper
+	for _, dir := range CredentialHelperDirs {
+		p := filepath.Join(dir, name)
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("stat %s: %s", p, err)
+		} else if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			return "", fmt.Errorf("credential helper %s is not an executable file", p)
+		}
+		return p, nil
+	}
+	return "", fmt.Errorf("%s not found in %s", name, strings.Join(CredentialHelperDirs, ", "))
+}
+
+// helperProgram implements client.Program. It runs credential helpers with a
+// context, and captures their stderr so it can be surfaced in errors.
+type helperProgram struct {
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// newHelperProgramFunc returns a client.ProgramFunc that runs the credential
+// helper with the given name, killing it when ctx is done. The stderr output
+// of the helper is written to the stderr buffer.
+func newHelperProgramFunc(
+	ctx context.Context, name string, stderr *bytes.Buffer) client.ProgramFunc {
+
+	return func(args ...string) client.Program {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = os.Environ()
+		cmd.Stderr = stderr
+		return &helperProgram{cmd: cmd, stderr: stderr}
+	}
+}
+
+// Output runs the helper and returns its stdout.
+func (p *helperProgram) Output() ([]byte, error) {
+	return p.cmd.Output()
+}
+
+// Input sets the stdin of the helper.
+func (p *helperProgram) Input(in io.Reader) {
+	p.cmd.Stdin = in
+}
+
+// helperStderr returns the trimmed stderr output of a helper, limited to a
+// reasonable length for error messages.
+func helperStderr(stderr *bytes.Buffer) string {
+	const maxLen = 1024
+	s := strings.TrimSpace(stderr.String())
+	if len(s) > maxLen {
+		s = s[len(s)-maxLen:]
+	}
+	return s
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCredentialFromHelper(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-credential-helper-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dirs := CredentialHelperDirs
+	CredentialHelperDirs = []string{tmpDir}
+	defer func() { CredentialHelperDirs = dirs }()
+
+	writeHelper := func(name, script string) {
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(tmpDir, credentialHelperPrefix+name), []byte("#!/bin/sh\n"+script), 0755))
+	}
+	writeHelper("ok", `echo '{"ServerURL": "myregistry", "Username": "user", "Secret": "pass"}'`)
+	writeHelper("fail", "echo 'token service unavailable' >&2\nexit 1")
+	writeHelper("hang", "exec sleep 10")
+	// flaky fails on its first call and succeeds afterwards.
+	counter := filepath.Join(tmpDir, "flaky-calls")
+	writeHelper("flaky", `if [ ! -f `+counter+` ]; then touch `+counter+`; echo 'try again' >&2; exit 1; fi
+echo '{"ServerURL": "myregistry", "Username": "user", "Secret": "pass"}'`)
+
+	t.Run("success", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := Config{}.getCredentialFromHelper("ok", "myregistry")
+		require.NoError(err)
+		require.Equal("user", authConfig.Username)
+		require.Equal("pass", authConfig.Password)
+	})
+
+	t.Run("stderr", func(t *testing.T) {
+		require := require.New(t)
+		_, err := Config{}.getCredentialFromHelper("fail", "myregistry")
+		require.Error(err)
+		require.Contains(err.Error(), "token service unavailable")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		require := require.New(t)
+		timeout := CredentialHelperTimeout
+		CredentialHelperTimeout = 100 * time.Millisecond
+		defer func() { CredentialHelperTimeout = timeout }()
+
+		start := time.Now()
+		_, err := Config{}.getCredentialFromHelper("hang", "myregistry")
+		require.Error(err)
+		require.Contains(err.Error(), "timed out")
+		require.Contains(err.Error(), "docker-credential-hang")
+		require.True(time.Since(start) < 5*time.Second)
+	})
+
+	setRetries := func(retries int) func() {
+		oldRetries, oldBackoff := CredentialHelperRetries, CredentialHelperBackoff
+		CredentialHelperRetries, CredentialHelperBackoff = retries, time.Millisecond
+		return func() {
+			CredentialHelperRetries, CredentialHelperBackoff = oldRetries, oldBackoff
+		}
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		require := require.New(t)
+		defer setRetries(2)()
+		defer os.Remove(counter)
+
+		authConfig, err := Config{}.getCredentialFromHelper("flaky", "myregistry")
+		require.NoError(err)
+		require.Equal("user", authConfig.Username)
+	})
+
+	t.Run("no retry", func(t *testing.T) {
+		require := require.New(t)
+		defer os.Remove(counter)
+
+		_, err := Config{}.getCredentialFromHelper("flaky", "myregistry")
+		require.Error(err)
+		require.Contains(err.Error(), "try again")
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		require := require.New(t)
+		defer setRetries(2)()
+
+		_, err := Config{}.getCredentialFromHelper("fail", "myregistry")
+		require.Error(err)
+		require.Contains(err.Error(), "failed after 3 attempts")
+		require.Contains(err.Error(), "token service unavailable")
+	})
+
+	t.Run("fallback to basic auth", func(t *testing.T) {
+		require := require.New(t)
+		basic := &BasicAuthConfig{}
+		basic.Username = "inline"
+		basic.Password = "secret"
+
+		config := Config{BasicAuth: basic, CredsStoreFallback: true}
+		authConfig, err := config.getCredentials("fail", "myregistry")
+		require.NoError(err)
+		require.Equal("inline", authConfig.Username)
+		require.Equal("secret", authConfig.Password)
+
+		config.CredsStoreFallback = false
+		_, err = config.getCredentials("fail", "myregistry")
+		require.Error(err)
+		require.Contains(err.Error(), "token service unavailable")
+	})
+}
+
+func TestResolveCredentialHelper(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-credential-helper-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	first := filepath.Join(tmpDir, "first")
+	second := filepath.Join(tmpDir, "second")
+	require.NoError(t, os.MkdirAll(first, 0755))
+	require.NoError(t, os.MkdirAll(second, 0755))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(first, "docker-credential-noexec"), []byte("#!/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(second, "docker-credential-ecr-login"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(second, "docker-credential-dir"), 0755))
+
+	dirs := CredentialHelperDirs
+	defer func() { CredentialHelperDirs = dirs }()
+	require.NoError(t, SetCredentialHelperDirs([]string{first, second}))
+
+	tests := []struct {
+		helper   string
+		expected string
+		err      string
+	}{
+		{"ecr-login", filepath.Join(second, "docker-credential-ecr-login"), ""},
+		{"noexec", "", "not an executable file"},
+		{"dir", "", "not an executable file"},
+		{"missing", "", "docker-credential-missing not found"},
+		{"../../bin/sh", "", "invalid credential helper name"},
+		{"sub/helper", "", "invalid credential helper name"},
+		{"..", "", "invalid credential helper name"},
+		{"", "", "invalid credential helper name"},
+	}
+	for _, test := range tests {
+		t.Run(test.helper, func(t *testing.T) {
+			require := require.New(t)
+			p, err := resolveCredentialHelper(test.helper)
+			if test.err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), test.err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, p)
+		})
+	}
+}
+
+func TestSetCredentialHelperDirs(t *testing.T) {
+	require := require.New(t)
+
+	dirs := CredentialHelperDirs
+	defer func() { CredentialHelperDirs = dirs }()
+
+	require.Error(SetCredentialHelperDirs([]string{"/usr/bin", "helpers"}))
+	require.Equal(dirs, CredentialHelperDirs)
+	require.NoError(SetCredentialHelperDirs(nil))
+	require.Equal(dirs, CredentialHelperDirs)
+	require.NoError(SetCredentialHelperDirs([]string{"/usr/local/bin"}))
+	require.Equal([]string{"/usr/local/bin"}, CredentialHelperDirs)
+}
@@ -0,0 +1,160 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/docker/engine-api/types"
+)
+
+// DockerConfigFile is the path of a Docker config.json to read credentials
+// from, for registries without security config. Not used if empty.
+var DockerConfigFile string
+
+// dockerHubAddress is the address Docker uses for Docker Hub credentials.
+const dockerHubAddress = "https://index.docker.io/v1/"
+
+// dockerConfig contains the credential settings of a Docker config.json.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// getDockerConfigCredentials returns the credentials for addr in the Docker
+// config file, or nil if it has none. Like Docker, the credHelpers entry of the
+// registry takes precedence over the global credsStore, which takes precedence
+// over auths entries. A credHelpers entry that has no credentials for the
+// registry means none, while the credsStore falls back to auths entries.
+func getDockerConfigCredentials(path, addr string) (*types.AuthConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read docker config: %s", err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal docker config: %s", err)
+	}
+
+	serverAddr := addr
+	if normalizeDockerAddress(addr) == "index.docker.io" {
+		serverAddr = dockerHubAddress
+	}
+
+	helperKeys := make([]string, 0, len(config.CredHelpers))
+	for key := range config.CredHelpers {
+		helperKeys = append(helperKeys, key)
+	}
+	if key, ok := matchDockerConfigKey(helperKeys, addr); ok {
+		helper := config.CredHelpers[key]
+		authConfig, err := Config{}.getCredentialFromHelper(helper, serverAddr)
+		if credentials.IsErrCredentialsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("get credentials from helper %s: %s", helper, err)
+		}
+		return &authConfig, nil
+	}
+
+	if config.CredsStore != "" {
+		// The store might not have credentials for every registry, in which
+		// case auths entries are still looked up.
+		authConfig, err := Config{}.getCredentialFromHelper(config.CredsStore, serverAddr)
+		if err == nil {
+			return &authConfig, nil
+		} else if !credentials.IsErrCredentialsNotFound(err) {
+			log.Warnf("Failed to get credentials for %s from credsStore %s, falling back to auths: %s",
+				addr, config.CredsStore, err)
+		}
+	}
+
+	authKeys := make([]string, 0, len(config.Auths))
+	for key := range config.Auths {
+		authKeys = append(authKeys, key)
+	}
+	if key, ok := matchDockerConfigKey(authKeys, addr); ok {
+		return config.Auths[key].toAuthConfig(serverAddr)
+	}
+	return nil, nil
+}
+
+// matchDockerConfigKey returns the key of a Docker config map that applies to
+// addr. A key equal to addr wins over keys that only match once normalized,
+// of which the first in lexical order is picked.
+func matchDockerConfigKey(keys []string, addr string) (string, bool) {
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == addr {
+			return key, true
+		}
+	}
+	for _, key := range keys {
+		if normalizeDockerAddress(key) == normalizeDockerAddress(addr) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (a dockerAuth) toAuthConfig(serverAddr string) (*types.AuthConfig, error) {
+	authConfig := &types.AuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+		ServerAddress: serverAddr,
+	}
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("decode auth: %s", err)
+		}
+		split := strings.SplitN(string(decoded), ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("auth is not in user:password format")
+		}
+		authConfig.Username, authConfig.Password = split[0], split[1]
+	}
+	if authConfig.Username == "" && authConfig.IdentityToken == "" {
+		return nil, nil
+	}
+	return authConfig, nil
+}
+
+// normalizeDockerAddress strips the scheme and path of registry addresses
+// used as keys in Docker config files, e.g. "https://index.docker.io/v1/".
+func normalizeDockerAddress(addr string) string {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://")
+	addr = strings.Split(addr, "/")[0]
+	if addr == "docker.io" || addr == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+	return addr
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDockerAddress(t *testing.T) {
+	require := require.New(t)
+	require.Equal("index.docker.io", normalizeDockerAddress("https://index.docker.io/v1/"))
+	require.Equal("index.docker.io", normalizeDockerAddress("docker.io"))
+	require.Equal("index.docker.io", normalizeDockerAddress("registry-1.docker.io"))
+	require.Equal("myregistry:5000", normalizeDockerAddress("http://myregistry:5000"))
+	require.Equal("gcr.io", normalizeDockerAddress("gcr.io"))
+}
+
+func TestGetDockerConfigCredentials(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-docker-config-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	configPath := filepath.Join(tmpDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+			"myregistry:5000": {"username": "user2", "password": "pass2"},
+			"tokenregistry": {"identitytoken": "token"},
+			"badregistry": {"auth": "not base64"},
+			"[fd00::1]:5000": {"username": "ipv6user", "password": "pass"},
+			"https://[fd00::2]/v1/": {"username": "ipv6user2", "password": "pass"}
+		}
+	}`), 0644))
+
+	t.Run("docker hub", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := getDockerConfigCredentials(configPath, "index.docker.io")
+		require.NoError(err)
+		require.NotNil(authConfig)
+		require.Equal("user", authConfig.Username)
+		require.Equal("pass", authConfig.Password)
+		require.Equal(dockerHubAddress, authConfig.ServerAddress)
+	})
+
+	t.Run("username and password", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := getDockerConfigCredentials(configPath, "myregistry:5000")
+		require.NoError(err)
+		require.NotNil(authConfig)
+		require.Equal("user2", authConfig.Username)
+		require.Equal("pass2", authConfig.Password)
+	})
+
+	t.Run("identity token", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := getDockerConfigCredentials(configPath, "tokenregistry")
+		require.NoError(err)
+		require.NotNil(authConfig)
+		require.Equal("token", authConfig.IdentityToken)
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := getDockerConfigCredentials(configPath, "[fd00::1]:5000")
+		require.NoError(err)
+		require.NotNil(authConfig)
+		require.Equal("ipv6user", authConfig.Username)
+		require.Equal("[fd00::1]:5000", authConfig.ServerAddress)
+
+		authConfig, err = getDockerConfigCredentials(configPath, "[fd00::2]")
+		require.NoError(err)
+		require.NotNil(authConfig)
+		require.Equal("ipv6user2", authConfig.Username)
+
+		authConfig, err = getDockerConfigCredentials(configPath, "[fd00::1]:5001")
+		require.NoError(err)
+		require.Nil(authConfig)
+	})
+
+	t.Run("invalid auth", func(t *testing.T) {
+		_, err := getDockerConfigCredentials(configPath, "badregistry")
+		require.Error(t, err)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		require := require.New(t)
+		authConfig, err := getDockerConfigCredentials(configPath, "otherregistry")
+		require.NoError(err)
+		require.Nil(authConfig)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := getDockerConfigCredentials(filepath.Join(tmpDir, "missing.json"), "index.docker.io")
+		require.Error(t, err)
+	})
+}
+
+func TestGetDockerConfigCredentialsPrecedence(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-docker-config-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dirs := CredentialHelperDirs
+	CredentialHelperDirs = []string{tmpDir}
+	defer func() { CredentialHelperDirs = dirs }()
+
+	writeHelper := func(name, registry, username string) {
+		script := fmt.Sprintf(`#!/bin/sh
+read url
+if [ "$url" = "%s" ]; then
+	echo '{"ServerURL": "%s", "Username": "%s", "Secret": "secret"}'
+else
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+`, registry, registry, username)
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(tmpDir, credentialHelperPrefix+name), []byte(script), 0755))
+	}
+	writeHelper("priv", "helperregistry", "helperuser")
+	writeHelper("empty", "none", "")
+	writeHelper("store", "storeregistry", "storeuser")
+
+	writeConfig := func(name, credsStore string) string {
+		p := filepath.Join(tmpDir, name)
+		require.NoError(t, ioutil.WriteFile(p, []byte(`{
+			"credsStore": "`+credsStore+`",
+			"credHelpers": {"helperregistry": "priv", "emptyregistry": "empty"},
+			"auths": {
+				"helperregistry": {"username": "authuser", "password": "pass"},
+				"emptyregistry": {"username": "authuser", "password": "pass"},
+				"storeregistry": {"username": "authuser", "password": "pass"},
+				"authregistry": {"username": "authuser", "password": "pass"},
+				"https://mirror/v1/": {"username": "normalizeduser", "password": "pass"},
+				"mirror": {"username": "exactuser", "password": "pass"}
+			}
+		}`), 0644))
+		return p
+	}
+	config := writeConfig("config.json", "store")
+	brokenStoreConfig := writeConfig("broken.json", "missing")
+
+	tests := []struct {
+		desc     string
+		config   string
+		addr     string
+		expected string
+	}{
+		{"cred helper over store and auths", config, "helperregistry", "helperuser"},
+		{"cred helper without credentials", config, "emptyregistry", ""},
+		{"store over auths", config, "storeregistry", "storeuser"},
+		{"auths if store has no credentials", config, "authregistry", "authuser"},
+		{"auths if store fails", brokenStoreConfig, "storeregistry", "authuser"},
+		{"exact auths key over normalized", config, "mirror", "exactuser"},
+		{"no credentials", config, "otherregistry", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			authConfig, err := getDockerConfigCredentials(test.config, test.addr)
+			require.NoError(err)
+			if test.expected == "" {
+				require.Nil(authConfig)
+				return
+			}
+			require.NotNil(authConfig)
+			require.Equal(test.expected, authConfig.Username)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	// Usernames that Google registries accept along with an OAuth access token
+	// or the JSON key of a service account.
+	googleTokenUsername = "oauth2accesstoken"
+	googleKeyUsername   = "_json_key"
+
+	googleTokenPath = "/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// googleToken caches the access token of the GCE metadata server. Failures
+// are cached too, to not wait on an unreachable metadata server every request.
+var googleToken = struct {
+	sync.Mutex
+	token    string
+	expiry   time.Time
+	err      error
+	failedAt time.Time
+}{}
+
+// isGoogleRegistry returns true for GCR and Artifact Registry hosts.
+func isGoogleRegistry(addr string) bool {
+	host := registryHostname(addr)
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") ||
+		strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// getGoogleCredentials returns credentials for Google registries, using the
+// service account key in $GOOGLE_APPLICATION_CREDENTIALS if set, and an access
+// token from the GCE metadata server otherwise.
+func getGoogleCredentials() (types.AuthConfig, error) {
+	if keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return types.AuthConfig{}, fmt.Errorf("read service account key: %s", err)
+		}
+		return types.AuthConfig{Username: googleKeyUsername, Password: string(key)}, nil
+	}
+	token, err := getGoogleMetadataToken()
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("get metadata server token: %s", err)
+	}
+	return types.AuthConfig{Username: googleTokenUsername, Password: token}, nil
+}
+
+func getGoogleMetadataToken() (string, error) {
+	googleToken.Lock()
+	defer googleToken.Unlock()
+	// Refresh the token a minute before it expires.
+	if googleToken.token != "" && time.Now().Add(time.Minute).Before(googleToken.expiry) {
+		return googleToken.token, nil
+	} else if googleToken.err != nil && time.Since(googleToken.failedAt) < 5*time.Minute {
+		return "", googleToken.err
+	}
+
+	token, expiry, err := fetchGoogleMetadataToken()
+	if err != nil {
+		googleToken.err, googleToken.failedAt = err, time.Now()
+		return "", err
+	}
+	googleToken.token, googleToken.expiry, googleToken.err = token, expiry, nil
+	return token, nil
+}
+
+func fetchGoogleMetadataToken() (string, time.Time, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	resp, err := httputil.Send(
+		"GET",
+		"http://"+host+googleTokenPath,
+		httputil.SendTimeout(2*time.Second),
+		httputil.SendHeaders(map[string]string{"Metadata-Flavor": "Google"}),
+		httputil.SendAcceptedCodes(http.StatusOK))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", time.Time{}, fmt.Errorf("decode token: %s", err)
+	} else if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("empty access token")
+	}
+	expiry := time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return token.AccessToken, expiry, nil
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGoogleRegistry(t *testing.T) {
+	require := require.New(t)
+	require.True(isGoogleRegistry("gcr.io"))
+	require.True(isGoogleRegistry("us.gcr.io"))
+	require.True(isGoogleRegistry("europe-west1-docker.pkg.dev"))
+	require.True(isGoogleRegistry("gcr.io:443"))
+	require.False(isGoogleRegistry("index.docker.io"))
+	require.False(isGoogleRegistry("notgcr.io"))
+}
+
+func TestGetGoogleCredentials(t *testing.T) {
+	t.Run("metadata", func(t *testing.T) {
+		require := require.New(t)
+
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if r.URL.Path != googleTokenPath || r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"access_token": "token1", "expires_in": 3600, "token_type": "Bearer"}`))
+		}))
+		defer server.Close()
+		u, err := url.Parse(server.URL)
+		require.NoError(err)
+		os.Setenv("GCE_METADATA_HOST", u.Host)
+		defer os.Unsetenv("GCE_METADATA_HOST")
+
+		for i := 0; i < 2; i++ {
+			authConfig, err := getGoogleCredentials()
+			require.NoError(err)
+			require.Equal(googleTokenUsername, authConfig.Username)
+			require.Equal("token1", authConfig.Password)
+		}
+		require.Equal(int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("service_account_key", func(t *testing.T) {
+		require := require.New(t)
+
+		keyFile, err := ioutil.TempFile("", "makisu-test")
+		require.NoError(err)
+		defer os.Remove(keyFile.Name())
+		_, err = keyFile.Write([]byte(`{"type": "service_account"}`))
+		require.NoError(err)
+		keyFile.Close()
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile.Name())
+		defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+		authConfig, err := getGoogleCredentials()
+		require.NoError(err)
+		require.Equal(googleKeyUsername, authConfig.Username)
+		require.Equal(`{"type": "service_account"}`, authConfig.Password)
+	})
+}
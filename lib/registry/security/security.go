@@ -15,24 +15,30 @@
 package security
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"path"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
 
 	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
 	"github.com/docker/engine-api/types"
 )
 
 const tokenUsername = "<token>"
 
-var credentialHelperPrefix = path.Join(pathutils.DefaultInternalDir, "docker-credential-")
-
 // BasicAuthConfig is a simple wrapper of Docker's types.AuthConfig with addtional support
 // for a password file.
 type BasicAuthConfig struct {
@@ -57,6 +63,107 @@ type Config struct {
 	TLS                    *httputil.TLSConfig `yaml:"tls" json:"tls"`
 	BasicAuth              *BasicAuthConfig    `yaml:"basic" json:"basic"`
 	RemoteCredentialsStore string              `yaml:"credsStore" json:"credsStore"`
+	// PlainHTTP makes the registry API calls use http instead of https.
+	// Only meant for registries on trusted networks without TLS.
+	PlainHTTP bool `yaml:"plainHTTP" json:"plainHTTP"`
+	// DisableHTTP2 makes the registry API calls use HTTP/1.1 even if the
+	// registry supports HTTP/2, for proxies with broken HTTP/2 support.
+	DisableHTTP2 bool `yaml:"disableHTTP2" json:"disableHTTP2"`
+	// CredsStoreFallback makes the registry use the basic auth credentials if
+	// the credsStore helper fails, instead of failing the build.
+	CredsStoreFallback bool `yaml:"credsStoreFallback" json:"credsStoreFallback"`
+	// NewConnections makes every registry API call open a new connection
+	// instead of reusing the ones of earlier calls, for checks that must not
+	// depend on them. It isn't read from registry configs.
+	NewConnections bool `yaml:"-" json:"-"`
+}
+
+// UserAgent is the User-Agent header of the requests sent to registries,
+// including the ones fetching auth tokens.
+var UserAgent = "makisu/" + utils.BuildHash
+
+// userAgentTransport sets UserAgent on requests that don't have a User-Agent.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" || UserAgent == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent)
+	return t.base.RoundTrip(req)
+}
+
+// plainHTTPWarned records the registries that plain http was already warned
+// about, to only warn once per registry.
+var plainHTTPWarned sync.Map
+
+// baseTransportKey identifies base transports in the cache, by the TLS config
+// they are built from and how they use connections.
+type baseTransportKey struct {
+	tlsName        string
+	tlsCA          httputil.X509Pair
+	tlsClient      httputil.X509Pair
+	tlsConfig      *tls.Config // Only set if the TLS config isn't built from Config.TLS.
+	noTLS          bool
+	disableHTTP2   bool
+	newConnections bool
+}
+
+// baseTransports caches the transports that registry requests are sent with,
+// so that the registries with the same config share connections, while the
+// ones with different TLS configs never share a transport.
+var baseTransports = struct {
+	sync.Mutex
+	m map[baseTransportKey]*http.Transport
+}{m: make(map[baseTransportKey]*http.Transport)}
+
+// baseTransport returns the transport that registry requests are sent with,
+// a copy of the default transport with the given TLS config.
+func (c Config) baseTransport(tlsClientConfig *tls.Config) *http.Transport {
+	key := baseTransportKey{disableHTTP2: c.DisableHTTP2, newConnections: c.NewConnections}
+	if tlsClientConfig == nil {
+		key.noTLS = true
+	} else if c.TLS != nil {
+		key.tlsName, key.tlsCA, key.tlsClient = c.TLS.Name, c.TLS.CA, c.TLS.Client
+	} else {
+		key.tlsConfig = tlsClientConfig
+	}
+
+	baseTransports.Lock()
+	defer baseTransports.Unlock()
+	if tr, ok := baseTransports.m[key]; ok {
+		return tr
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if c.DisableHTTP2 {
+		tr.ForceAttemptHTTP2 = false
+		// A non-nil empty map is the documented way to disable HTTP/2.
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if tlsClientConfig != nil {
+			// Registries must not be offered HTTP/2 in the TLS handshake.
+			tlsClientConfig = tlsClientConfig.Clone()
+			var protos []string
+			for _, proto := range tlsClientConfig.NextProtos {
+				if proto != "h2" {
+					protos = append(protos, proto)
+				}
+			}
+			tlsClientConfig.NextProtos = protos
+		}
+	}
+	if tlsClientConfig != nil {
+		// The transport adds its protocols to the config, which is shared by
+		// the transports built from it.
+		tr.TLSClientConfig = tlsClientConfig.Clone()
+	}
+	if c.NewConnections {
+		tr.DisableKeepAlives = true
+	}
+	baseTransports.m[key] = tr
+	return tr
 }
 
 // ApplyDefaults applies default configuration.
@@ -71,35 +178,125 @@ func (c Config) ApplyDefaults() Config {
 }
 
 // GetHTTPOption returns httputil.Option based on the security configuration.
+// addr may include the path prefix under which the registry API is served;
+// credentials are looked up for the host only.
 func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
+	host := strings.SplitN(addr, "/", 2)[0]
 	shouldUseBasicAuth := (c.BasicAuth != nil || c.RemoteCredentialsStore != "")
 
+	// Without security config, credentials are taken from the docker config
+	// file or from the environment of cloud providers if available, and the
+	// registry is accessed anonymously otherwise.
+	var detectedAuth *types.AuthConfig
+	if !shouldUseBasicAuth {
+		detectedAuth = detectCredentials(host)
+		shouldUseBasicAuth = detectedAuth != nil
+	}
+
 	var tlsClientConfig *tls.Config
 	var err error
-	if c.TLS != nil {
+	if c.PlainHTTP {
+		if _, warned := plainHTTPWarned.LoadOrStore(addr, true); !warned {
+			log.Warnf("Using plain http for registry %s, traffic is not encrypted", addr)
+		}
+	} else if c.TLS != nil {
 		tlsClientConfig, err = c.TLS.BuildClient()
 		if err != nil {
 			return nil, fmt.Errorf("build tls config: %s", err)
 		}
-		if !shouldUseBasicAuth {
-			return httputil.SendTLS(tlsClientConfig), nil
-		}
+	}
+	tr := userAgentTransport{c.baseTransport(tlsClientConfig)}
+	transportOpt := httputil.SendTLSTransport
+	if c.PlainHTTP {
+		transportOpt = httputil.SendTransport
 	}
 
 	if shouldUseBasicAuth {
-		authConfig, err := c.getCredentials(c.RemoteCredentialsStore, addr)
+		authConfig, err := c.getCredentials(c.RemoteCredentialsStore, host)
 		if err != nil {
 			return nil, fmt.Errorf("get credentials: %s", err)
 		}
-		tr := http.DefaultTransport.(*http.Transport)
-		tr.TLSClientConfig = tlsClientConfig // If tlsClientConfig is nil, default is used.
-		rt, err := BasicAuthTransport(addr, repo, tr, authConfig)
+		if detectedAuth != nil {
+			authConfig = *detectedAuth
+		}
+		rt, err := basicAuthTransport(transportKey{
+			addr:           addr,
+			repo:           repo,
+			authConfig:     authConfig,
+			plainHTTP:      c.PlainHTTP,
+			newConnections: c.NewConnections,
+		}, tr)
 		if err != nil {
 			return nil, fmt.Errorf("basic auth: %s", err)
 		}
-		return httputil.SendTLSTransport(rt), nil
+		return transportOpt(rt), nil
 	}
-	return httputil.SendNoop(), nil
+
+	// Registries like Docker Hub require a token even for public pulls, which
+	// is fetched anonymously if there are no credentials.
+	// Registries that fail the v2 handshake are rejected rather than sent
+	// requests they can't serve.
+	rt, err := anonymousTransport(transportKey{
+		addr:           addr,
+		repo:           repo,
+		anonymous:      true,
+		plainHTTP:      c.PlainHTTP,
+		newConnections: c.NewConnections,
+	}, tr)
+	if err == nil {
+		return transportOpt(rt), nil
+	} else if errors.Is(err, ErrNotV2Registry) {
+		return nil, err
+	}
+	log.Debugf("Failed to set up anonymous token auth for %s: %s", addr, err)
+	// Requests are sent without auth, with the transport of the config.
+	if tlsClientConfig != nil {
+		return httputil.SendTLSTransport(tr), nil
+	}
+	return httputil.SendTransport(tr), nil
+}
+
+// detectCredentials returns credentials for registries without security
+// config, or nil if there are none.
+func detectCredentials(addr string) *types.AuthConfig {
+	if DockerConfigFile != "" {
+		authConfig, err := getDockerConfigCredentials(DockerConfigFile, addr)
+		if err != nil {
+			log.Warnf("Failed to get credentials for %s from %s: %s", addr, DockerConfigFile, err)
+		} else if authConfig != nil {
+			return authConfig
+		}
+	}
+	return getCloudCredentials(addr)
+}
+
+// registryHostname strips the port of a registry address, and the brackets
+// of IPv6 literals, e.g. "[::1]:5000" becomes "::1".
+func registryHostname(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// getCloudCredentials returns credentials for GCR, Artifact Registry and ACR
+// hosts, or nil if there are none.
+func getCloudCredentials(addr string) *types.AuthConfig {
+	var authConfig types.AuthConfig
+	var err error
+	switch {
+	case isGoogleRegistry(addr):
+		authConfig, err = getGoogleCredentials()
+	case isAzureRegistry(addr):
+		authConfig, err = getAzureCredentials(addr)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Debugf("No credentials found for %s: %s", addr, err)
+		return nil
+	}
+	return &authConfig
 }
 
 func (c Config) getCredentials(helper, addr string) (types.AuthConfig, error) {
@@ -112,20 +309,65 @@ func (c Config) getCredentials(helper, addr string) (types.AuthConfig, error) {
 		}
 	}
 	if helper != "" {
-		authConfig, err = c.getCredentialFromHelper(helper, addr)
-		if err != nil {
+		helperAuthConfig, err := c.getCredentialFromHelper(helper, addr)
+		if err != nil && c.BasicAuth != nil && c.CredsStoreFallback {
+			log.Warnf("Failed to get credentials for %s from helper %s, "+
+				"falling back to basic auth: %s", addr, helper, err)
+			return authConfig, nil
+		} else if err != nil {
 			return types.AuthConfig{}, fmt.Errorf("get credentials from helper %s: %s", helper, err)
 		}
+		authConfig = helperAuthConfig
 	}
 	return authConfig, nil
 }
 
+// getCredentialFromHelper runs the credential helper to get the credentials of
+// addr, retrying failed calls up to CredentialHelperRetries times with
+// exponential backoff.
 func (c Config) getCredentialFromHelper(helper, addr string) (types.AuthConfig, error) {
-	helperFullName := credentialHelperPrefix + helper
-	creds, err := client.Get(client.NewShellProgramFunc(helperFullName), addr)
+	helperFullName, err := resolveCredentialHelper(helper)
 	if err != nil {
 		return types.AuthConfig{}, err
 	}
+	backoff := CredentialHelperBackoff
+	for attempt := 0; ; attempt++ {
+		authConfig, err := c.runCredentialHelper(helperFullName, addr)
+		if err == nil || credentials.IsErrCredentialsNotFound(err) {
+			return authConfig, err
+		} else if attempt >= CredentialHelperRetries {
+			if attempt > 0 {
+				return types.AuthConfig{}, fmt.Errorf("failed after %d attempts: %s", attempt+1, err)
+			}
+			return types.AuthConfig{}, err
+		}
+		log.Warnf("Credential helper %s failed for %s, retrying in %s: %s",
+			helperFullName, addr, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// runCredentialHelper runs the credential helper binary at helperFullName
+// once to get the credentials of addr.
+func (c Config) runCredentialHelper(helperFullName, addr string) (types.AuthConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CredentialHelperTimeout)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	creds, err := client.Get(newHelperProgramFunc(ctx, helperFullName, stderr), addr)
+	if ctx.Err() == context.DeadlineExceeded {
+		return types.AuthConfig{}, fmt.Errorf(
+			"credential helper %s timed out after %s, check that it can reach its "+
+				"credential source or increase --credential-helper-timeout",
+			helperFullName, CredentialHelperTimeout)
+	} else if credentials.IsErrCredentialsNotFound(err) {
+		return types.AuthConfig{}, err
+	} else if err != nil {
+		if msg := helperStderr(stderr); msg != "" {
+			return types.AuthConfig{}, fmt.Errorf("%s, stderr: %s", err, msg)
+		}
+		return types.AuthConfig{}, err
+	}
 
 	var ret types.AuthConfig
 	if c.BasicAuth != nil {
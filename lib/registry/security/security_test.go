@@ -0,0 +1,195 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetHTTPOptionPlainHTTP(t *testing.T) {
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	config := Config{PlainHTTP: true}.ApplyDefaults()
+	opt, err := config.GetHTTPOption(u.Host, "repo")
+	require.NoError(err)
+
+	// Without fallback, an https request to the server would fail.
+	resp, err := httputil.Get(
+		"http://"+u.Host+"/v2/repo/manifests/latest", opt, httputil.DisableHTTPFallback())
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestGetHTTPOptionUserAgent(t *testing.T) {
+	require := require.New(t)
+
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	defaultUserAgent := UserAgent
+	require.Regexp("^makisu/.+", defaultUserAgent)
+	defer func() { UserAgent = defaultUserAgent }()
+
+	config := Config{PlainHTTP: true}.ApplyDefaults()
+	for _, userAgent := range []string{defaultUserAgent, "custom/1.0"} {
+		UserAgent = userAgent
+		userAgents = nil
+		opt, err := config.GetHTTPOption(u.Host, "repo-"+userAgent)
+		require.NoError(err)
+
+		resp, err := httputil.Get(
+			"http://"+u.Host+"/v2/repo/manifests/latest", opt, httputil.DisableHTTPFallback())
+		require.NoError(err)
+		resp.Body.Close()
+		require.NotEmpty(userAgents)
+		for _, ua := range userAgents {
+			require.Equal(userAgent, ua)
+		}
+	}
+}
+
+func TestGetHTTPOptionNotV2Registry(t *testing.T) {
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	config := Config{PlainHTTP: true}.ApplyDefaults()
+	_, err = config.GetHTTPOption(u.Host, "repo")
+	require.Error(err)
+	require.Contains(err.Error(), ErrNotV2Registry.Error())
+}
+
+func TestGetHTTPOptionIPv6(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 loopback unavailable: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, "registry/2.0")
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	require.Regexp(`^\[::1\]:\d+$`, u.Host)
+
+	config := Config{PlainHTTP: true}.ApplyDefaults()
+	opt, err := config.GetHTTPOption(u.Host, "repo")
+	require.NoError(err)
+
+	resp, err := httputil.Get(
+		"http://"+u.Host+"/v2/repo/manifests/latest", opt, httputil.DisableHTTPFallback())
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestBaseTransportPerTLSConfig(t *testing.T) {
+	require := require.New(t)
+
+	ca1 := &httputil.TLSConfig{CA: httputil.X509Pair{Cert: httputil.Secret{Path: "/ca1"}}}
+	ca2 := &httputil.TLSConfig{CA: httputil.X509Pair{Cert: httputil.Secret{Path: "/ca2"}}}
+	tls1 := &tls.Config{ServerName: "registry1"}
+	tls2 := &tls.Config{ServerName: "registry2"}
+
+	tr1 := Config{TLS: ca1}.baseTransport(tls1)
+	tr2 := Config{TLS: ca2}.baseTransport(tls2)
+	require.NotEqual(tr1, tr2)
+	require.Equal("registry1", tr1.TLSClientConfig.ServerName)
+	require.Equal("registry2", tr2.TLSClientConfig.ServerName)
+
+	// The transports of the same config are shared, and the default transport
+	// is left as it is.
+	require.True(tr1 == Config{TLS: ca1}.baseTransport(&tls.Config{ServerName: "registry1"}))
+	require.True(tr1 != http.DefaultTransport)
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil {
+		require.Empty(c.ServerName)
+	}
+}
+
+func TestBaseTransportDisableHTTP2(t *testing.T) {
+	require := require.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// The client of the server negotiates HTTP/2.
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(2, resp.ProtoMajor)
+
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tr := Config{DisableHTTP2: true}.baseTransport(tlsConfig)
+	require.NotEqual(http.DefaultTransport, tr)
+	resp, err = (&http.Client{Transport: tr}).Get(server.URL)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(1, resp.ProtoMajor)
+
+	// Registries with other TLS configs get their own transport.
+	other := Config{DisableHTTP2: true}.baseTransport(&tls.Config{ServerName: "other"})
+	require.True(tr != other)
+	require.Equal("other", other.TLSClientConfig.ServerName)
+	require.NotEqual("other", tr.TLSClientConfig.ServerName)
+	require.False(other.ForceAttemptHTTP2)
+}
+
+func TestRegistryHostname(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"gcr.io":        "gcr.io",
+		"gcr.io:443":    "gcr.io",
+		"[::1]:5000":    "::1",
+		"[fd00::1]":     "fd00::1",
+		"10.0.0.1:5000": "10.0.0.1",
+	} {
+		require.Equal(t, expected, registryHostname(addr))
+	}
+	require.False(t, isGoogleRegistry("[::1]:5000"))
+	require.False(t, isAzureRegistry("[::1]:5000"))
+}
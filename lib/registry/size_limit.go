@@ -0,0 +1,65 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// sizeLimitReader reads from r until more than limit bytes were read, and then
+// returns an error of kind ErrTooLarge.
+type sizeLimitReader struct {
+	r     io.Reader
+	what  string
+	limit int64
+	read  int64
+}
+
+func newSizeLimitReader(r io.Reader, what string, limit int64) *sizeLimitReader {
+	return &sizeLimitReader{r: r, what: what, limit: limit}
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit to tell bodies of exactly limit bytes from
+	// larger ones.
+	if max := l.limit - l.read + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, l.tooLarge()
+	}
+	return n, err
+}
+
+func (l *sizeLimitReader) tooLarge() error {
+	return &Error{
+		Kind: ErrTooLarge,
+		Err:  fmt.Errorf("%s exceeds the maximum size of %d bytes", l.what, l.limit),
+	}
+}
+
+// checkContentLength returns an error of kind ErrTooLarge if the response
+// announces a body larger than the limit of the reader, so that it is not
+// downloaded at all.
+func (l *sizeLimitReader) checkContentLength(resp *http.Response) error {
+	if resp.ContentLength > l.limit {
+		return l.tooLarge()
+	}
+	return nil
+}
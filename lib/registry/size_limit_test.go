@@ -0,0 +1,49 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeLimitReader(t *testing.T) {
+	t.Run("within limit", func(t *testing.T) {
+		require := require.New(t)
+		b, err := ioutil.ReadAll(newSizeLimitReader(strings.NewReader("12345"), "blob", 5))
+		require.NoError(err)
+		require.Equal("12345", string(b))
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		require := require.New(t)
+		_, err := ioutil.ReadAll(newSizeLimitReader(strings.NewReader("123456"), "blob", 5))
+		require.True(errors.Is(err, ErrTooLarge))
+		require.Equal("blob exceeds the maximum size of 5 bytes", err.Error())
+	})
+
+	t.Run("content length", func(t *testing.T) {
+		require := require.New(t)
+		r := newSizeLimitReader(strings.NewReader(""), "blob", 5)
+		require.NoError(r.checkContentLength(&http.Response{ContentLength: -1}))
+		require.NoError(r.checkContentLength(&http.Response{ContentLength: 5}))
+		require.True(errors.Is(r.checkContentLength(&http.Response{ContentLength: 6}), ErrTooLarge))
+	})
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/uber/makisu/lib/concurrency"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// verifyReadSize is the number of bytes of each blob read back by VerifyPushedBlobs.
+const verifyReadSize = 1024
+
+// verifyBlobs checks that the layers and the config of the manifest are
+// readable from the registry, over new connections so that none of them is
+// served from the state of the connections that pushed them.
+func (c DockerRegistryClient) verifyBlobs(manifest *image.DistributionManifest) error {
+	c.config.Security.NewConnections = true
+	digests := append(manifest.GetUniqueLayerDigests(), manifest.GetConfigDigest())
+	multiError := utils.NewMultiErrors()
+	workers := concurrency.NewWorkerPool(c.config.Concurrency)
+	for _, digest := range digests {
+		d := digest
+		workers.Do(func() {
+			if err := c.verifyBlob(d); err != nil {
+				multiError.Add(fmt.Errorf("blob %s is not readable from the registry: %w", d, err))
+			}
+		})
+	}
+	workers.Wait()
+	if err := multiError.Collect(); err != nil {
+		return err
+	}
+	log.Infof("* Verified that the %d blobs of the image are readable from %s/%s",
+		len(digests), c.registry, c.repository)
+	return nil
+}
+
+// verifyBlob checks that the registry reports the size of the local blob, and
+// serves its first bytes.
+func (c DockerRegistryClient) verifyBlob(digest image.Digest) error {
+	info, err := c.store.Layers.GetStoreFileStat(digest.Hex())
+	if err != nil {
+		return fmt.Errorf("stat local blob: %s", err)
+	}
+	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return fmt.Errorf("open local blob: %s", err)
+	}
+	expected, err := ioutil.ReadAll(io.LimitReader(r, verifyReadSize))
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("read local blob: %s", err)
+	}
+
+	opt, err := c.httpOption()
+	if err != nil {
+		return err
+	}
+	URL := fmt.Sprintf(baseLayerQuery, c.apiBase(), c.repository, digest)
+	resp, err := httputil.Send(
+		"HEAD",
+		URL,
+		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.pullRetry())
+	if err != nil {
+		return fmt.Errorf("head blob: %w", classifyError(err))
+	}
+	resp.Body.Close()
+	if resp.ContentLength >= 0 && resp.ContentLength != info.Size() {
+		return fmt.Errorf("registry reports %d bytes instead of %d", resp.ContentLength, info.Size())
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	resp, err = httputil.Send(
+		"GET",
+		URL,
+		httputil.SendClient(c.client),
+		httputil.SendRedirect(c.checkRedirect),
+		opt,
+		httputil.SendHeaders(map[string]string{
+			"Range": fmt.Sprintf("bytes=0-%d", len(expected)-1),
+		}),
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.pullRetry(),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusPartialContent))
+	if err != nil {
+		return fmt.Errorf("get blob: %w", classifyError(err))
+	}
+	defer resp.Body.Close()
+	// Registries that ignore the range send the whole blob, so only its first
+	// bytes are read.
+	received, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(expected))))
+	if err != nil {
+		return fmt.Errorf("read blob: %s", err)
+	} else if !bytes.Equal(received, expected) {
+		return fmt.Errorf("registry served %d bytes that don't match the first %d bytes of the blob",
+			len(received), len(expected))
+	}
+	return nil
+}
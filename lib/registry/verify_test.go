@@ -0,0 +1,144 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blobServerFixture serves the blobs of its map, and counts the requests and
+// the connections they were sent on. If misbehavior is set, it fails to serve
+// back the layer of the sample image.
+type blobServerFixture struct {
+	sync.Mutex
+	blobs       map[string][]byte
+	misbehavior string
+	requests    int
+	conns       int
+}
+
+func (f *blobServerFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests++
+	const blobsPath = "/v2/repo/blobs/"
+	digest := strings.TrimPrefix(r.URL.Path, blobsPath)
+	content, ok := f.blobs[digest]
+	if r.URL.Path == "/v2/" {
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	layer := digest == "sha256:"+testutil.SampleLayerTarDigest
+	switch {
+	case layer && f.misbehavior == "wrong size":
+		content = content[:len(content)-1]
+	case layer && f.misbehavior == "corrupted":
+		content = append([]byte{content[0] + 1}, content[1:]...)
+	case layer && f.misbehavior == "unreadable" && r.Method == "GET":
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		w.Write(content)
+	}
+}
+
+func (f *blobServerFixture) connState(conn net.Conn, state http.ConnState) {
+	f.Lock()
+	defer f.Unlock()
+	if state == http.StateNew {
+		f.conns++
+	}
+}
+
+func TestVerifyBlobs(t *testing.T) {
+	store, cleanup := storage.StoreFixtureWithSampleImage()
+	defer cleanup()
+
+	blobs := make(map[string][]byte)
+	manifest := &image.DistributionManifest{
+		Config: image.Descriptor{Digest: image.Digest("sha256:" + testutil.SampleImageConfigDigest)},
+		Layers: []image.Descriptor{
+			{Digest: image.Digest("sha256:" + testutil.SampleLayerTarDigest)},
+			{Digest: image.Digest("sha256:" + testutil.SampleLayerTarDigest)},
+		},
+	}
+	for _, hex := range []string{testutil.SampleImageConfigDigest, testutil.SampleLayerTarDigest} {
+		r, err := store.Layers.GetStoreFileReader(hex)
+		require.NoError(t, err)
+		blobs["sha256:"+hex], err = ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		misbehavior string
+		err         string
+	}{
+		{"none", ""},
+		{"wrong size", "registry reports"},
+		{"corrupted", "don't match the first 1024 bytes"},
+		{"unreadable", "get blob"},
+	}
+	for _, test := range tests {
+		t.Run(test.misbehavior, func(t *testing.T) {
+			require := require.New(t)
+
+			fixture := &blobServerFixture{blobs: blobs, misbehavior: test.misbehavior}
+			server := httptest.NewUnstartedServer(fixture)
+			server.Config.ConnState = fixture.connState
+			server.Start()
+			defer server.Close()
+
+			c := New(store, strings.TrimPrefix(server.URL, "http://"), "repo")
+			c.config.Security.PlainHTTP = true
+			err := c.verifyBlobs(manifest)
+			if test.err == "" {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+				require.Contains(err.Error(), testutil.SampleLayerTarDigest)
+				require.Contains(err.Error(), test.err)
+				require.NotContains(err.Error(), testutil.SampleImageConfigDigest)
+			}
+
+			// Every request was sent on a new connection.
+			fixture.Lock()
+			defer fixture.Unlock()
+			require.True(fixture.requests > 0)
+			require.Equal(fixture.requests, fixture.conns)
+		})
+	}
+}
@@ -0,0 +1,360 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Tags and types of rpm header entries.
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagArch    = 1022
+
+	rpmTypeInt32  = 4
+	rpmTypeString = 6
+)
+
+// sqliteMagic starts every sqlite database file.
+const sqliteMagic = "SQLite format 3\x00"
+
+// parseRPMSqlite parses the sqlite database of rpm 4.16 and later, whose
+// Packages table has the header of a package in each row.
+// The gpg-pubkey entries of imported signing keys aren't packages, and are
+// skipped.
+func parseRPMSqlite(content []byte) ([]Package, error) {
+	db, err := newSqliteFile(content)
+	if err != nil {
+		return nil, err
+	}
+	var root uint32
+	err = db.walkTable(1, func(record [][]byte) error {
+		// Columns of sqlite_master are type, name, tbl_name, rootpage and sql.
+		if len(record) < 4 || string(record[0]) != "table" || string(record[1]) != "Packages" {
+			return nil
+		}
+		root = uint32(decodeSqliteInt(record[3]))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read schema: %s", err)
+	} else if root == 0 {
+		return nil, errors.New("no Packages table")
+	}
+
+	var packages []Package
+	err = db.walkTable(root, func(record [][]byte) error {
+		// Columns of Packages are hnum, which is the row ID, and blob.
+		if len(record) < 2 {
+			return errors.New("Packages row without blob")
+		}
+		p, err := parseRPMHeader(record[1])
+		if err != nil {
+			return fmt.Errorf("parse header: %s", err)
+		}
+		if p.Name != "" && p.Name != "gpg-pubkey" {
+			packages = append(packages, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read Packages: %s", err)
+	}
+	return packages, nil
+}
+
+// parseRPMHeader returns the package described by an rpm header blob, which is
+// made of the number of index entries and the size of the data, an index entry
+// per tag, and the data the entries point to.
+func parseRPMHeader(blob []byte) (Package, error) {
+	if len(blob) < 8 {
+		return Package{}, errors.New("truncated header")
+	}
+	il := binary.BigEndian.Uint32(blob[0:4])
+	dl := binary.BigEndian.Uint32(blob[4:8])
+	if uint64(il)*16+uint64(dl)+8 > uint64(len(blob)) {
+		return Package{}, fmt.Errorf("header of %d entries and %d bytes of data is truncated", il, dl)
+	}
+	data := blob[8+il*16 : 8+il*16+dl]
+
+	p := Package{Type: "rpm"}
+	var release string
+	for i := uint32(0); i < il; i++ {
+		entry := blob[8+i*16 : 8+(i+1)*16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		typ := binary.BigEndian.Uint32(entry[4:8])
+		offset := binary.BigEndian.Uint32(entry[8:12])
+		if offset >= dl {
+			continue
+		}
+		value := data[offset:]
+		var s string
+		switch typ {
+		case rpmTypeString:
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				s = string(value[:end])
+			}
+		case rpmTypeInt32:
+			if len(value) >= 4 {
+				s = strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+			}
+		}
+		switch tag {
+		case rpmTagName:
+			p.Name = s
+		case rpmTagVersion:
+			p.Version = s
+		case rpmTagRelease:
+			release = s
+		case rpmTagEpoch:
+			p.Epoch = s
+		case rpmTagArch:
+			p.Arch = s
+		}
+	}
+	if release != "" {
+		p.Version += "-" + release
+	}
+	return p, nil
+}
+
+// sqliteFile reads the table b-trees of a sqlite database file.
+type sqliteFile struct {
+	content    []byte
+	pageSize   int
+	usableSize int
+}
+
+func newSqliteFile(content []byte) (*sqliteFile, error) {
+	if len(content) < 100 || string(content[:len(sqliteMagic)]) != sqliteMagic {
+		return nil, errors.New("not a sqlite database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(content[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size %d", pageSize)
+	}
+	return &sqliteFile{
+		content:    content,
+		pageSize:   pageSize,
+		usableSize: pageSize - int(content[20]),
+	}, nil
+}
+
+// page returns the content of a page, numbered from 1.
+func (db *sqliteFile) page(n uint32) ([]byte, error) {
+	start := (int64(n) - 1) * int64(db.pageSize)
+	if n == 0 || start+int64(db.pageSize) > int64(len(db.content)) {
+		return nil, fmt.Errorf("page %d out of range", n)
+	}
+	return db.content[start : start+int64(db.pageSize)], nil
+}
+
+// walkTable calls f with the columns of each row of the table b-tree rooted at
+// page root, in row ID order.
+func (db *sqliteFile) walkTable(root uint32, f func([][]byte) error) error {
+	return db.walkPage(root, make(map[uint32]bool), f)
+}
+
+func (db *sqliteFile) walkPage(n uint32, visited map[uint32]bool, f func([][]byte) error) error {
+	if visited[n] {
+		return fmt.Errorf("page %d is referenced twice", n)
+	}
+	visited[n] = true
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	// The first page starts with the 100 bytes of the database header.
+	hdr := 0
+	if n == 1 {
+		hdr = 100
+	}
+	kind := page[hdr]
+	cells := int(binary.BigEndian.Uint16(page[hdr+3 : hdr+5]))
+	var pointers int
+	switch kind {
+	case 0x05: // Interior table page.
+		pointers = hdr + 12
+	case 0x0d: // Leaf table page.
+		pointers = hdr + 8
+	default:
+		return fmt.Errorf("page %d is not a table page", n)
+	}
+	if pointers+2*cells > len(page) {
+		return fmt.Errorf("page %d has too many cells", n)
+	}
+
+	for i := 0; i < cells; i++ {
+		offset := int(binary.BigEndian.Uint16(page[pointers+2*i:]))
+		if offset >= db.usableSize {
+			return fmt.Errorf("cell %d of page %d out of range", i, n)
+		}
+		cell := page[offset:db.usableSize]
+		if kind == 0x05 {
+			if len(cell) < 4 {
+				return fmt.Errorf("truncated cell %d of page %d", i, n)
+			}
+			if err := db.walkPage(binary.BigEndian.Uint32(cell), visited, f); err != nil {
+				return err
+			}
+			continue
+		}
+		payload, err := db.leafPayload(cell)
+		if err != nil {
+			return fmt.Errorf("cell %d of page %d: %s", i, n, err)
+		}
+		record, err := decodeSqliteRecord(payload)
+		if err != nil {
+			return fmt.Errorf("cell %d of page %d: %s", i, n, err)
+		}
+		if err := f(record); err != nil {
+			return err
+		}
+	}
+	if kind == 0x05 {
+		return db.walkPage(binary.BigEndian.Uint32(page[hdr+8:hdr+12]), visited, f)
+	}
+	return nil
+}
+
+// leafPayload returns the payload of a cell of a leaf table page, made of the
+// part stored in the cell and of the overflow pages it links to.
+func (db *sqliteFile) leafPayload(cell []byte) ([]byte, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 {
+		return nil, errors.New("invalid payload size")
+	}
+	cell = cell[n:]
+	if _, n = sqliteVarint(cell); n == 0 {
+		return nil, errors.New("invalid row ID")
+	}
+	cell = cell[n:]
+	if size > uint64(len(db.content)) {
+		return nil, fmt.Errorf("payload of %d bytes out of range", size)
+	}
+
+	maxLocal := uint64(db.usableSize - 35)
+	if size <= maxLocal {
+		if size > uint64(len(cell)) {
+			return nil, errors.New("truncated payload")
+		}
+		return cell[:size], nil
+	}
+	minLocal := uint64((db.usableSize-12)*32/255 - 23)
+	local := minLocal + (size-minLocal)%uint64(db.usableSize-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	if local+4 > uint64(len(cell)) {
+		return nil, errors.New("truncated payload")
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+	next := binary.BigEndian.Uint32(cell[local:])
+	for uint64(len(payload)) < size {
+		page, err := db.page(next)
+		if err != nil {
+			return nil, fmt.Errorf("overflow: %s", err)
+		}
+		chunk := page[4:db.usableSize]
+		if remaining := size - uint64(len(payload)); uint64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	return payload, nil
+}
+
+// decodeSqliteRecord returns the columns of a record, as big-endian integers,
+// text or blobs. Null columns, and floats which rpm doesn't use, are raw bytes
+// or empty.
+func decodeSqliteRecord(payload []byte) ([][]byte, error) {
+	headerSize, n := sqliteVarint(payload)
+	if n == 0 || headerSize < uint64(n) || headerSize > uint64(len(payload)) {
+		return nil, errors.New("invalid record header")
+	}
+	header := payload[n:headerSize]
+	body := payload[headerSize:]
+	var columns [][]byte
+	for len(header) > 0 {
+		serial, n := sqliteVarint(header)
+		if n == 0 {
+			return nil, errors.New("invalid column type")
+		}
+		header = header[n:]
+		var size uint64
+		switch {
+		case serial <= 4:
+			size = serial
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		case serial >= 12:
+			size = (serial - 12) / 2
+		}
+		if size > uint64(len(body)) {
+			return nil, errors.New("truncated record")
+		} else if serial == 9 {
+			// The integer 1 is stored in the header only.
+			columns = append(columns, []byte{1})
+			continue
+		}
+		columns = append(columns, body[:size])
+		body = body[size:]
+	}
+	return columns, nil
+}
+
+// decodeSqliteInt decodes an integer column of a record.
+func decodeSqliteInt(column []byte) int64 {
+	var v int64
+	for i, b := range column {
+		if i == 0 {
+			v = int64(int8(b))
+		} else {
+			v = v<<8 | int64(b)
+		}
+	}
+	return v
+}
+
+// sqliteVarint decodes a sqlite varint, which has 7 bits per byte, most
+// significant first, except for the 9th byte which has 8. It returns the
+// number of bytes read, or 0 if b is truncated.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
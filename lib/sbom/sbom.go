@@ -0,0 +1,406 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+const (
+	// BOMFormat is the format of CycloneDX documents.
+	BOMFormat = "CycloneDX"
+
+	// SpecVersion is the version of the CycloneDX specification the documents
+	// follow.
+	SpecVersion = "1.4"
+
+	// MediaType is the media type of CycloneDX JSON documents.
+	MediaType = "application/vnd.cyclonedx+json"
+)
+
+// Package databases, relative to the root of the image.
+const (
+	apkInstalled  = "lib/apk/db/installed"
+	dpkgStatus    = "var/lib/dpkg/status"
+	dpkgStatusDir = "var/lib/dpkg/status.d"
+)
+
+// rpmSqliteDatabases are the sqlite databases of rpm 4.16 and later.
+var rpmSqliteDatabases = map[string]bool{
+	"var/lib/rpm/rpmdb.sqlite":          true,
+	"usr/lib/sysimage/rpm/rpmdb.sqlite": true,
+}
+
+// rpmLegacyDatabases are the Berkeley DB and ndb databases of rpm, which can't
+// be read without the rpm libraries.
+var rpmLegacyDatabases = map[string]bool{
+	"var/lib/rpm/Packages":             true,
+	"var/lib/rpm/Packages.db":          true,
+	"usr/lib/sysimage/rpm/Packages":    true,
+	"usr/lib/sysimage/rpm/Packages.db": true,
+}
+
+// UnreadDatabaseProperty is the name of the metadata property that records a
+// package database whose packages aren't listed.
+const UnreadDatabaseProperty = "makisu:sbom:unread_package_database"
+
+// BOM is a CycloneDX document.
+type BOM struct {
+	BOMFormat    string        `json:"bomFormat"`
+	SpecVersion  string        `json:"specVersion"`
+	SerialNumber string        `json:"serialNumber"`
+	Version      int           `json:"version"`
+	Metadata     Metadata      `json:"metadata"`
+	Components   []Component   `json:"components"`
+	Compositions []Composition `json:"compositions,omitempty"`
+}
+
+// Metadata describes the subject of the document and how it was generated.
+type Metadata struct {
+	Timestamp  time.Time  `json:"timestamp"`
+	Tools      []Tool     `json:"tools"`
+	Component  Component  `json:"component"`
+	Properties []Property `json:"properties,omitempty"`
+}
+
+// Property is a name-value pair of metadata.
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Composition states whether the components of the assemblies it refers to
+// are all listed.
+type Composition struct {
+	Aggregate  string   `json:"aggregate"`
+	Assemblies []string `json:"assemblies"`
+}
+
+// Tool identifies what generated the document.
+type Tool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Component is the image, or a package installed in it.
+type Component struct {
+	BOMRef  string `json:"bom-ref,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+	Hashes  []Hash `json:"hashes,omitempty"`
+}
+
+// Hash is a digest of a component.
+type Hash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// Package is an OS package installed in an image.
+type Package struct {
+	Type      string // Package URL type: "apk", "deb" or "rpm".
+	Namespace string // Distribution of the package, e.g. "alpine" or "debian".
+	Distro    string // Distribution and its version, e.g. "debian-11", if known.
+	Name      string
+	Version   string
+	Epoch     string // Epoch of rpm packages, which is part of Version for deb.
+	Arch      string
+}
+
+// PURL returns the package URL of the package.
+func (p Package) PURL() string {
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s",
+		p.Type, p.Namespace, purlEscape(p.Name), purlEscape(p.Version))
+	var qualifiers []string
+	if p.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(p.Arch))
+	}
+	if p.Epoch != "" {
+		qualifiers = append(qualifiers, "epoch="+url.QueryEscape(p.Epoch))
+	}
+	if p.Distro != "" {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(p.Distro))
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// New returns the SBOM of an image, referenced by the digest of its manifest,
+// with the packages installed in it. If some package databases of the image
+// were not read, the document records them and states that its components are
+// incomplete.
+func New(
+	name image.Name, digest image.Digest, packages []Package, unread []string,
+	timestamp time.Time, toolVersion string) (*BOM, error) {
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %s", err)
+	}
+	repo := fmt.Sprintf("%s/%s", name.GetRegistry(), name.GetRepository())
+	purl := fmt.Sprintf("pkg:oci/%s@%s?repository_url=%s",
+		path.Base(name.GetRepository()), purlEscape(string(digest)), url.QueryEscape(repo))
+	var tag string
+	if !name.IsDigest() {
+		tag = name.GetTag()
+		purl += "&tag=" + url.QueryEscape(tag)
+	}
+
+	components := []Component{}
+	for _, p := range packages {
+		purl := p.PURL()
+		version := p.Version
+		if p.Epoch != "" {
+			version = p.Epoch + ":" + version
+		}
+		components = append(components, Component{
+			BOMRef:  purl,
+			Type:    "library",
+			Name:    p.Name,
+			Version: version,
+			PURL:    purl,
+		})
+	}
+	var properties []Property
+	var compositions []Composition
+	for _, db := range unread {
+		properties = append(properties, Property{Name: UnreadDatabaseProperty, Value: db})
+	}
+	if len(unread) > 0 {
+		compositions = []Composition{{Aggregate: "incomplete", Assemblies: []string{purl}}}
+	}
+	return &BOM{
+		BOMFormat:    BOMFormat,
+		SpecVersion:  SpecVersion,
+		SerialNumber: serial,
+		Version:      1,
+		Metadata: Metadata{
+			Timestamp: timestamp.UTC(),
+			Tools:     []Tool{{Vendor: "Uber", Name: "makisu", Version: toolVersion}},
+			Component: Component{
+				BOMRef:  purl,
+				Type:    "container",
+				Name:    repo,
+				Version: tag,
+				PURL:    purl,
+				Hashes:  []Hash{{Alg: "SHA-256", Content: digest.Hex()}},
+			},
+			Properties: properties,
+		},
+		Components:   components,
+		Compositions: compositions,
+	}, nil
+}
+
+// ReadPackages returns the packages listed in the apk, dpkg and sqlite rpm
+// databases of a filesystem, read from rootfs as a flattened tar, sorted by
+// name. It also returns the absolute paths of the Berkeley DB and ndb rpm
+// databases, whose packages aren't listed.
+func ReadPackages(rootfs io.Reader) ([]Package, []string, error) {
+	var packages []Package
+	var unread []string
+	var etcOSRelease, usrOSRelease []byte
+	tr := tar.NewReader(rootfs)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("read header: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		p := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		var parse func([]byte) ([]Package, error)
+		switch {
+		case p == "etc/os-release":
+			if etcOSRelease, err = ioutil.ReadAll(tr); err != nil {
+				return nil, nil, fmt.Errorf("read %s: %s", p, err)
+			}
+		case p == "usr/lib/os-release":
+			if usrOSRelease, err = ioutil.ReadAll(tr); err != nil {
+				return nil, nil, fmt.Errorf("read %s: %s", p, err)
+			}
+		case p == apkInstalled:
+			parse = parseAPKInstalled
+		case p == dpkgStatus || path.Dir(p) == dpkgStatusDir:
+			parse = parseDpkgStatus
+		case rpmSqliteDatabases[p]:
+			parse = parseRPMSqlite
+		case rpmLegacyDatabases[p]:
+			unread = append(unread, "/"+p)
+		}
+		if parse == nil {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %s", p, err)
+		}
+		found, err := parse(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %s", p, err)
+		}
+		packages = append(packages, found...)
+	}
+
+	// /etc/os-release is usually a link to /usr/lib/os-release.
+	osRelease := etcOSRelease
+	if osRelease == nil {
+		osRelease = usrOSRelease
+	}
+	id, versionID := parseOSRelease(osRelease)
+	for i := range packages {
+		if id != "" {
+			packages[i].Namespace = id
+			if versionID != "" {
+				packages[i].Distro = id + "-" + versionID
+			}
+			continue
+		}
+		switch packages[i].Type {
+		case "apk":
+			packages[i].Namespace = "alpine"
+		case "rpm":
+			packages[i].Namespace = "redhat"
+		default:
+			packages[i].Namespace = "debian"
+		}
+	}
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Type < packages[j].Type
+	})
+	sort.Strings(unread)
+	return packages, unread, nil
+}
+
+// parseAPKInstalled parses the installed database of apk, which has a
+// paragraph of single letter fields per package.
+func parseAPKInstalled(content []byte) ([]Package, error) {
+	var packages []Package
+	err := readParagraphs(content, func(fields map[string]string) {
+		if fields["P"] != "" {
+			packages = append(packages, Package{
+				Type: "apk", Name: fields["P"], Version: fields["V"], Arch: fields["A"]})
+		}
+	})
+	return packages, err
+}
+
+// parseDpkgStatus parses the status database of dpkg, or a file of the
+// status.d directory of distroless images, which have a paragraph per package.
+// Packages that were removed but whose config files remain are skipped.
+func parseDpkgStatus(content []byte) ([]Package, error) {
+	var packages []Package
+	err := readParagraphs(content, func(fields map[string]string) {
+		status, hasStatus := fields["Status"]
+		if fields["Package"] == "" || (hasStatus && !strings.HasSuffix(status, " installed")) {
+			return
+		}
+		packages = append(packages, Package{
+			Type: "deb", Name: fields["Package"], Version: fields["Version"],
+			Arch: fields["Architecture"]})
+	})
+	return packages, err
+}
+
+// readParagraphs calls f with the fields of each paragraph of content, which
+// are separated by blank lines and are "name:value" lines. Continuation lines, which start with a space,
+// are ignored.
+func readParagraphs(content []byte, f func(map[string]string)) error {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(fields) > 0 {
+				f(fields)
+			}
+			fields = make(map[string]string)
+			continue
+		} else if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		f(fields)
+	}
+	return nil
+}
+
+// parseOSRelease returns the ID and VERSION_ID of an os-release file.
+func parseOSRelease(content []byte) (id, versionID string) {
+	for _, line := range strings.Split(string(content), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			versionID = value
+		}
+	}
+	return id, versionID
+}
+
+// purlEscape percent-encodes a segment of a package URL, in which ":" is
+// reserved, unlike in URL paths.
+func purlEscape(s string) string {
+	return strings.Replace(url.PathEscape(s), ":", "%3A", -1)
+}
+
+// newSerialNumber returns a random version 4 UUID URN.
+func newSerialNumber() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,199 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeRootFS returns a flattened tar with the given files.
+func writeRootFS(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func TestReadPackages(t *testing.T) {
+	t.Run("apk", func(t *testing.T) {
+		require := require.New(t)
+
+		rootfs := writeRootFS(t, map[string]string{
+			"etc/os-release": "NAME=\"Alpine Linux\"\nID=alpine\nVERSION_ID=3.12.0\n",
+			"lib/apk/db/installed": "C:Q1abc=\nP:musl\nV:1.1.24-r9\nA:x86_64\n\n" +
+				"C:Q1def=\nP:busybox\nV:1.31.1-r19\nA:x86_64\nF:bin\nR:busybox\n",
+		})
+		packages, unread, err := ReadPackages(rootfs)
+		require.NoError(err)
+		require.Empty(unread)
+		require.Equal([]Package{
+			{Type: "apk", Namespace: "alpine", Distro: "alpine-3.12.0",
+				Name: "busybox", Version: "1.31.1-r19", Arch: "x86_64"},
+			{Type: "apk", Namespace: "alpine", Distro: "alpine-3.12.0",
+				Name: "musl", Version: "1.1.24-r9", Arch: "x86_64"},
+		}, packages)
+		require.Equal("pkg:apk/alpine/musl@1.1.24-r9?arch=x86_64&distro=alpine-3.12.0", packages[1].PURL())
+	})
+
+	t.Run("dpkg", func(t *testing.T) {
+		require := require.New(t)
+
+		rootfs := writeRootFS(t, map[string]string{
+			"usr/lib/os-release": "ID=debian\nVERSION_ID=\"10\"\n",
+			"var/lib/dpkg/status": "Package: libc6\nStatus: install ok installed\n" +
+				"Architecture: amd64\nVersion: 2.28-10\nDescription: GNU C Library\n continued: line\n\n" +
+				"Package: vim\nStatus: deinstall ok config-files\nArchitecture: amd64\nVersion: 2:8.1\n",
+			"var/lib/dpkg/status.d/tzdata": "Package: tzdata\nVersion: 2020a-0+deb10u1\nArchitecture: all\n",
+		})
+		packages, unread, err := ReadPackages(rootfs)
+		require.NoError(err)
+		require.Empty(unread)
+		require.Equal([]Package{
+			{Type: "deb", Namespace: "debian", Distro: "debian-10",
+				Name: "libc6", Version: "2.28-10", Arch: "amd64"},
+			{Type: "deb", Namespace: "debian", Distro: "debian-10",
+				Name: "tzdata", Version: "2020a-0+deb10u1", Arch: "all"},
+		}, packages)
+	})
+
+	t.Run("no os-release", func(t *testing.T) {
+		require := require.New(t)
+
+		rootfs := writeRootFS(t, map[string]string{
+			"var/lib/dpkg/status":  "Package: epoch\nVersion: 1:2.0\n",
+			"var/lib/rpm/Packages": "not parsed",
+		})
+		packages, unread, err := ReadPackages(rootfs)
+		require.NoError(err)
+		require.Equal([]Package{
+			{Type: "deb", Namespace: "debian", Name: "epoch", Version: "1:2.0"},
+		}, packages)
+		require.Equal("pkg:deb/debian/epoch@1%3A2.0", packages[0].PURL())
+		require.Equal([]string{"/var/lib/rpm/Packages"}, unread)
+	})
+
+	t.Run("rpm sqlite", func(t *testing.T) {
+		require := require.New(t)
+
+		// The Packages table of the database has headers that overflow its 512
+		// bytes pages, under an interior page, and a gpg-pubkey entry.
+		rpmdb, err := ioutil.ReadFile("../../testdata/files/rpmdb.sqlite")
+		require.NoError(err)
+		rootfs := writeRootFS(t, map[string]string{
+			"etc/os-release":           "ID=\"rhel\"\nVERSION_ID=\"9.2\"\n",
+			"var/lib/rpm/rpmdb.sqlite": string(rpmdb),
+		})
+		packages, unread, err := ReadPackages(rootfs)
+		require.NoError(err)
+		require.Empty(unread)
+		var names []string
+		for _, p := range packages {
+			names = append(names, p.Name)
+		}
+		require.Equal([]string{
+			"bash", "coreutils-single", "curl-minimal", "filesystem", "glibc", "libcurl-minimal",
+			"openssl-libs", "setup", "tzdata", "xz-libs", "zlib",
+		}, names)
+		require.Equal(Package{Type: "rpm", Namespace: "rhel", Distro: "rhel-9.2",
+			Name: "openssl-libs", Version: "3.0.7-6.el9", Epoch: "1", Arch: "x86_64"}, packages[6])
+		require.Equal("pkg:rpm/rhel/openssl-libs@3.0.7-6.el9?arch=x86_64&epoch=1&distro=rhel-9.2",
+			packages[6].PURL())
+	})
+
+	t.Run("invalid rpm sqlite", func(t *testing.T) {
+		require := require.New(t)
+
+		rootfs := writeRootFS(t, map[string]string{
+			"usr/lib/sysimage/rpm/rpmdb.sqlite": "SQLite format 3\x00" + string(make([]byte, 84)),
+		})
+		_, _, err := ReadPackages(rootfs)
+		require.Error(err)
+		require.Contains(err.Error(), "usr/lib/sysimage/rpm/rpmdb.sqlite")
+	})
+}
+
+func TestNew(t *testing.T) {
+	require := require.New(t)
+
+	digest := image.Digest("sha256:" + "ab12")
+	bom, err := New(
+		image.MustParseName("registry.dev/team/repo:tag"), digest,
+		[]Package{{Type: "apk", Namespace: "alpine", Name: "musl", Version: "1.1.24-r9"}}, nil,
+		time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "v1")
+	require.NoError(err)
+	require.Regexp("^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$",
+		bom.SerialNumber)
+
+	payload, err := json.Marshal(bom)
+	require.NoError(err)
+	var parsed map[string]interface{}
+	require.NoError(json.Unmarshal(payload, &parsed))
+	require.Equal("CycloneDX", parsed["bomFormat"])
+	require.Equal("1.4", parsed["specVersion"])
+
+	metadata := parsed["metadata"].(map[string]interface{})
+	require.Equal("2020-01-02T03:04:05Z", metadata["timestamp"])
+	purl := "pkg:oci/repo@sha256%3Aab12?repository_url=registry.dev%2Fteam%2Frepo&tag=tag"
+	require.Equal(map[string]interface{}{
+		"bom-ref": purl,
+		"type":    "container",
+		"name":    "registry.dev/team/repo",
+		"version": "tag",
+		"purl":    purl,
+		"hashes":  []interface{}{map[string]interface{}{"alg": "SHA-256", "content": "ab12"}},
+	}, metadata["component"])
+	require.Equal([]interface{}{map[string]interface{}{
+		"bom-ref": "pkg:apk/alpine/musl@1.1.24-r9",
+		"type":    "library",
+		"name":    "musl",
+		"version": "1.1.24-r9",
+		"purl":    "pkg:apk/alpine/musl@1.1.24-r9",
+	}}, parsed["components"])
+	require.NotContains(metadata, "properties")
+	require.NotContains(parsed, "compositions")
+}
+
+func TestNewUnreadDatabases(t *testing.T) {
+	require := require.New(t)
+
+	bom, err := New(
+		image.MustParseName("registry.dev/team/repo:tag"), image.Digest("sha256:ab12"),
+		[]Package{{Type: "rpm", Namespace: "centos", Name: "bash", Version: "4.2.46-34.el7", Epoch: "2"}},
+		[]string{"/var/lib/rpm/Packages"}, time.Now(), "v1")
+	require.NoError(err)
+	require.Equal("2:4.2.46-34.el7", bom.Components[0].Version)
+	require.Equal("pkg:rpm/centos/bash@4.2.46-34.el7?epoch=2", bom.Components[0].PURL)
+	require.Equal([]Property{
+		{Name: UnreadDatabaseProperty, Value: "/var/lib/rpm/Packages"},
+	}, bom.Metadata.Properties)
+	require.Equal([]Composition{
+		{Aggregate: "incomplete", Assemblies: []string{bom.Metadata.Component.BOMRef}},
+	}, bom.Compositions)
+}
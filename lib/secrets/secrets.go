@@ -0,0 +1,136 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Source fetches the values of secrets. The format of references depends on
+// the source. Implementations must not log values, nor include them in errors.
+type Source interface {
+	Fetch(ref string) ([]byte, error)
+}
+
+// FileSource reads secrets from files. References are paths.
+type FileSource struct{}
+
+// Fetch returns the content of the file.
+func (FileSource) Fetch(ref string) ([]byte, error) {
+	value, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return nil, fmt.Errorf("read secret file: %s", err)
+	}
+	return value, nil
+}
+
+// EnvSource reads secrets from environment variables. References are names.
+type EnvSource struct{}
+
+// Fetch returns the value of the environment variable.
+func (EnvSource) Fetch(ref string) ([]byte, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return []byte(value), nil
+}
+
+var (
+	mu      sync.RWMutex
+	sources = map[string]Source{
+		"file": FileSource{},
+		"env":  EnvSource{},
+	}
+)
+
+// RegisterSource makes the source available to secrets given as
+// source=<scheme>:<ref>.
+func RegisterSource(scheme string, source Source) {
+	mu.Lock()
+	defer mu.Unlock()
+	sources[scheme] = source
+}
+
+func getSource(scheme string) (Source, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	source, ok := sources[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret source %s", scheme)
+	}
+	return source, nil
+}
+
+// Secret is a build secret, which RUN steps can mount. Its value is only
+// fetched when it is mounted.
+type Secret struct {
+	ID string
+
+	source Source
+	ref    string
+}
+
+// Parse parses a secret given as "id=<id>,source=<scheme>:<ref>". Like
+// Docker, "id=<id>,src=<path>" and "id=<id>,env=<name>" are accepted as
+// shorthands for the file and env sources.
+func Parse(spec string) (*Secret, error) {
+	var id, scheme, ref string
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed secret %s", spec)
+		}
+		switch parts[0] {
+		case "id":
+			id = parts[1]
+		case "source":
+			sourceParts := strings.SplitN(parts[1], ":", 2)
+			if len(sourceParts) != 2 {
+				return nil, fmt.Errorf("secret source must be formatted as <scheme>:<ref>: %s", parts[1])
+			}
+			scheme, ref = sourceParts[0], sourceParts[1]
+		case "src":
+			scheme, ref = "file", parts[1]
+		case "env":
+			scheme, ref = "env", parts[1]
+		default:
+			return nil, fmt.Errorf("unknown secret option %s", parts[0])
+		}
+	}
+	if id == "" {
+		return nil, fmt.Errorf("missing id of secret %s", spec)
+	} else if scheme == "" {
+		return nil, fmt.Errorf("missing source of secret %s", id)
+	}
+	source, err := getSource(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &Secret{ID: id, source: source, ref: ref}, nil
+}
+
+// Value fetches the value of the secret.
+func (s *Secret) Value() ([]byte, error) {
+	value, err := s.source.Fetch(s.ref)
+	if err != nil {
+		return nil, fmt.Errorf("fetch secret %s: %s", s.ID, err)
+	}
+	return value, nil
+}
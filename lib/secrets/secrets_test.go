@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource map[string]string
+
+func (s fakeSource) Fetch(ref string) ([]byte, error) {
+	return []byte(s[ref]), nil
+}
+
+func TestParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo")
+	require.NoError(t, ioutil.WriteFile(path, []byte("file value"), 0600))
+
+	require.NoError(t, os.Setenv("MAKISU_TEST_SECRET", "env value"))
+	defer os.Unsetenv("MAKISU_TEST_SECRET")
+
+	RegisterSource("fake", fakeSource{"a#b": "fake value"})
+	defer func() {
+		mu.Lock()
+		delete(sources, "fake")
+		mu.Unlock()
+	}()
+
+	tests := []struct {
+		desc  string
+		spec  string
+		value string
+	}{
+		{"file", "id=foo,source=file:" + path, "file value"},
+		{"src", "id=foo,src=" + path, "file value"},
+		{"env", "id=foo,source=env:MAKISU_TEST_SECRET", "env value"},
+		{"env shorthand", "env=MAKISU_TEST_SECRET,id=foo", "env value"},
+		{"registered", "id=foo,source=fake:a#b", "fake value"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			secret, err := Parse(test.spec)
+			require.NoError(err)
+			require.Equal("foo", secret.ID)
+			value, err := secret.Value()
+			require.NoError(err)
+			require.Equal(test.value, string(value))
+		})
+	}
+
+	for _, spec := range []string{
+		"source=env:FOO",
+		"id=foo",
+		"id=foo,source=env",
+		"id=foo,source=unknown:bar",
+		"id=foo,required",
+		"id=foo,type=file",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := Parse(spec)
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("missing value", func(t *testing.T) {
+		require := require.New(t)
+		secret, err := Parse("id=foo,env=MAKISU_TEST_UNSET_SECRET")
+		require.NoError(err)
+		_, err = secret.Value()
+		require.Error(err)
+	})
+}
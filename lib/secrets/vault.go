@@ -0,0 +1,162 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// VaultSource reads secrets from HashiCorp Vault. References are formatted as
+// <path>[#<field>], e.g. "secret/data/foo#password"; the field can be omitted
+// if the secret has a single one. Both KV version 1 and 2 are supported.
+type VaultSource struct {
+	// Address of the Vault server, e.g. "https://vault.example.com:8200".
+	Address string
+	// Token used to read secrets. If empty, a token is obtained by logging in
+	// with RoleID and SecretID.
+	Token string
+	// RoleID and SecretID are the credentials of the AppRole auth method.
+	RoleID   string
+	SecretID string
+	// AppRolePath is the mount path of the AppRole auth method, "approle" by
+	// default.
+	AppRolePath string
+
+	mu sync.Mutex
+}
+
+// NewVaultSourceFromEnv returns a VaultSource configured by the VAULT_ADDR,
+// VAULT_TOKEN, VAULT_ROLE_ID, VAULT_SECRET_ID and VAULT_APPROLE_PATH
+// environment variables.
+func NewVaultSourceFromEnv() *VaultSource {
+	return &VaultSource{
+		Address:     os.Getenv("VAULT_ADDR"),
+		Token:       os.Getenv("VAULT_TOKEN"),
+		RoleID:      os.Getenv("VAULT_ROLE_ID"),
+		SecretID:    os.Getenv("VAULT_SECRET_ID"),
+		AppRolePath: os.Getenv("VAULT_APPROLE_PATH"),
+	}
+}
+
+// Fetch reads the field of the secret at the given path.
+func (s *VaultSource) Fetch(ref string) ([]byte, error) {
+	if s.Address == "" {
+		return nil, fmt.Errorf("vault address is not set")
+	}
+	path, field := ref, ""
+	if i := strings.LastIndex(ref, "#"); i != -1 {
+		path, field = ref[:i], ref[i+1:]
+	}
+
+	token, err := s.getToken()
+	if err != nil {
+		return nil, fmt.Errorf("login to vault: %s", err)
+	}
+	resp, err := httputil.Get(
+		s.url(path),
+		httputil.SendHeaders(map[string]string{"X-Vault-Token": token}),
+		httputil.DisableHTTPFallback())
+	if err != nil {
+		return nil, fmt.Errorf("read %s from vault: %s", path, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode vault response of %s: %s", path, err)
+	}
+	data := body.Data
+	// KV version 2 nests the fields of the secret next to its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	if field == "" {
+		if len(data) != 1 {
+			return nil, fmt.Errorf("secret %s has %d fields, select one with %s#<field>", path, len(data), path)
+		}
+		for f := range data {
+			field = f
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no field %s", path, field)
+	}
+	if str, ok := value.(string); ok {
+		return []byte(str), nil
+	}
+	return json.Marshal(value)
+}
+
+// getToken returns the configured token, or logs in with AppRole to get one.
+func (s *VaultSource) getToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Token != "" {
+		return s.Token, nil
+	} else if s.RoleID == "" || s.SecretID == "" {
+		return "", fmt.Errorf("neither a token nor approle credentials are set")
+	}
+
+	appRolePath := s.AppRolePath
+	if appRolePath == "" {
+		appRolePath = "approle"
+	}
+	login, err := json.Marshal(map[string]string{
+		"role_id":   s.RoleID,
+		"secret_id": s.SecretID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal login: %s", err)
+	}
+	resp, err := httputil.Post(
+		s.url("auth/"+appRolePath+"/login"),
+		httputil.SendBody(bytes.NewReader(login)),
+		httputil.DisableHTTPFallback())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode login response: %s", err)
+	} else if body.Auth.ClientToken == "" {
+		return "", fmt.Errorf("login response has no token")
+	}
+	s.Token = body.Auth.ClientToken
+	return s.Token, nil
+}
+
+func (s *VaultSource) url(path string) string {
+	return strings.TrimSuffix(s.Address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func vaultServerFixture(t *testing.T) *httptest.Server {
+	secrets := map[string]interface{}{
+		// KV version 1.
+		"/v1/kv/foo": map[string]interface{}{
+			"password": "kv1 value",
+		},
+		// KV version 2.
+		"/v1/secret/data/foo": map[string]interface{}{
+			"data": map[string]interface{}{
+				"password": "kv2 value",
+				"user":     "makisu",
+			},
+			"metadata": map[string]interface{}{"version": 1},
+		},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var login map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&login))
+			if login["role_id"] != "role" || login["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"auth": map[string]string{"client_token": "approle-token"},
+			})
+			return
+		}
+		token := r.Header.Get("X-Vault-Token")
+		if token != "token" && token != "approle-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestVaultSource(t *testing.T) {
+	server := vaultServerFixture(t)
+	defer server.Close()
+
+	tests := []struct {
+		desc  string
+		ref   string
+		value string
+	}{
+		{"kv1 with field", "kv/foo#password", "kv1 value"},
+		{"kv1 single field", "kv/foo", "kv1 value"},
+		{"kv2 with field", "secret/data/foo#user", "makisu"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			source := &VaultSource{Address: server.URL, Token: "token"}
+			value, err := source.Fetch(test.ref)
+			require.NoError(err)
+			require.Equal(test.value, string(value))
+		})
+	}
+
+	t.Run("approle", func(t *testing.T) {
+		require := require.New(t)
+		source := &VaultSource{Address: server.URL, RoleID: "role", SecretID: "secret"}
+		value, err := source.Fetch("secret/data/foo#password")
+		require.NoError(err)
+		require.Equal("kv2 value", string(value))
+		require.Equal("approle-token", source.Token)
+	})
+
+	for _, test := range []struct {
+		desc   string
+		source *VaultSource
+		ref    string
+	}{
+		{"no address", &VaultSource{Token: "token"}, "kv/foo"},
+		{"no credentials", &VaultSource{Address: server.URL}, "kv/foo"},
+		{"bad approle", &VaultSource{Address: server.URL, RoleID: "role", SecretID: "bad"}, "kv/foo"},
+		{"bad token", &VaultSource{Address: server.URL, Token: "bad"}, "kv/foo"},
+		{"not found", &VaultSource{Address: server.URL, Token: "token"}, "kv/bar"},
+		{"missing field", &VaultSource{Address: server.URL, Token: "token"}, "kv/foo#user"},
+		{"ambiguous field", &VaultSource{Address: server.URL, Token: "token"}, "secret/data/foo"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := test.source.Fetch(test.ref)
+			require.Error(t, err)
+		})
+	}
+}
@@ -15,30 +15,119 @@
 package shell
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/utils"
 )
 
 // ShellStreamBufferSize is the size of the output buffers when streaming command stdout and stderr
 const ShellStreamBufferSize = 1 << 20
 
+// PlainOutput makes command output streamed one line at a time, with control
+// sequences removed and lines rewritten with carriage returns reduced to their
+// final content, so it stays readable in non-TTY logs.
+var PlainOutput = false
+
+// processGroupKillTimeout is how long processes left by a command may take to
+// exit after being killed.
+const processGroupKillTimeout = 5 * time.Second
+
+// controlSequence matches ANSI escape sequences and other control characters,
+// except for tabs.
+var controlSequence = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[@-_]|[\x00-\x08\x0b-\x1f\x7f]`)
+
 type formatStream func(string, ...interface{})
 
+// checkInterval is how often the Check of ExecOptions is called.
+var checkInterval = time.Second
+
+// ExecOptions are the options of ExecCommandWithOptions.
+type ExecOptions struct {
+	// Prefix, if not empty, makes the output of the command streamed one line
+	// at a time, each preceded by it, so that the output of several commands
+	// can be told apart.
+	Prefix string
+	// Check, if set, is called periodically while the command runs. If it
+	// returns an error, the command and the processes it started are killed,
+	// and that error is returned.
+	Check func() error
+	// NoNetwork runs the command in a new network namespace, so that it can't
+	// reach the network. Creating the namespace requires CAP_SYS_ADMIN, and is
+	// only supported on linux.
+	NoNetwork bool
+	// AssertCleanup makes the command fail if processes that it left running
+	// can't be killed once it exits, instead of only logging it.
+	AssertCleanup bool
+}
+
 // ExecCommand exec a cmd and args inside workingDir as user, returns error if cmd fails
 func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName string, cmdArgs ...string) error {
+	return ExecCommandWithOptions(ExecOptions{}, outStream, errStream, workingDir, user, cmdName, cmdArgs...)
+}
+
+// ExecCommandWithOptions is like ExecCommand, with the given options.
+func ExecCommandWithOptions(
+	opts ExecOptions, outStream, errStream formatStream,
+	workingDir, user, cmdName string, cmdArgs ...string) error {
+
+	cmd, err := newCommand(workingDir, user, cmdName, cmdArgs...)
+	if err != nil {
+		return err
+	}
+	if opts.NoNetwork {
+		if err := isolateNetwork(cmd); err != nil {
+			return err
+		}
+	}
+	return streamCmd(opts, outStream, errStream, cmd)
+}
+
+// ExecInteractive exec a cmd and args inside workingDir as user, attached to
+// the stdin, stdout and stderr of the current process.
+func ExecInteractive(workingDir, user, cmdName string, cmdArgs ...string) error {
+	cmd, err := newCommand(workingDir, user, cmdName, cmdArgs...)
+	if err != nil {
+		return err
+	}
+	// The command needs to stay in the foreground process group to read
+	// from the terminal.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// IsTerminal returns true if stdin is attached to a terminal.
+func IsTerminal() bool { return isTerminal(os.Stdin) }
+
+// IsOutputTerminal returns true if stdout is attached to a terminal.
+func IsOutputTerminal() bool { return isTerminal(os.Stdout) }
+
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		f.Fd(), ioctlReadTermios, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+func newCommand(workingDir, user, cmdName string, cmdArgs ...string) (*exec.Cmd, error) {
 	cmd := exec.Command(cmdName, cmdArgs...)
 	if workingDir != "" {
 		cmd.Dir = workingDir
 	}
 
 	if err := setProcAttributes(cmd, user); err != nil {
-		return fmt.Errorf("set command creds: %v", err)
+		return nil, fmt.Errorf("set command creds: %v", err)
 	}
 
 	cmd.Env = os.Environ()
@@ -49,35 +138,133 @@ func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName st
 		// Append it so it has a priority on any other env var from before (and will override previous HOME definition)
 		cmd.Env = append(cmd.Env, home)
 	}
-	return streamCmd(outStream, errStream, cmd)
+	return cmd, nil
 }
 
-func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
-	outReader, outWriter := io.Pipe()
-	errReader, errWriter := io.Pipe()
+func streamCmd(opts ExecOptions, outStream, errStream formatStream, cmd *exec.Cmd) error {
+	prefix, check := opts.Prefix, opts.Check
+	// The command writes to pipes directly, so that processes it leaves
+	// running in the background can't keep Wait from returning.
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create stdout pipe: %s", err)
+	}
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		outReader.Close()
+		outWriter.Close()
+		return fmt.Errorf("create stderr pipe: %s", err)
+	}
 	cmd.Stdout, cmd.Stderr = outWriter, errWriter
 
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		if err := readerToStream(outReader, outStream); err != nil {
+		defer wg.Done()
+		defer outReader.Close()
+		if err := readerToStream(outReader, outStream, prefix); err != nil {
 			outStream("Failed to stream stdout from command: %s\n", err)
 		}
 	}()
 
 	go func() {
-		if err := readerToStream(errReader, errStream); err != nil {
+		defer wg.Done()
+		defer errReader.Close()
+		if err := readerToStream(errReader, errStream, prefix); err != nil {
 			errStream("Failed to stream stderr from command: %s\n", err)
 		}
 	}()
 
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	// The command has its own copies of the write ends, the streams end once
+	// it and its children exit.
+	outWriter.Close()
+	errWriter.Close()
+	if err != nil {
+		wg.Wait()
 		return fmt.Errorf("cmd start: %s", err)
-	} else if err := cmd.Wait(); err != nil {
+	}
+
+	checkErr := make(chan error, 1)
+	stopCheck := make(chan struct{})
+	if check != nil {
+		go runCheck(check, cmd.Process.Pid, stopCheck, checkErr)
+	}
+	err = cmd.Wait()
+	close(stopCheck)
+	// Like the container of a docker RUN step, nothing started by the command
+	// outlives it.
+	killErr := killProcessGroup(cmd.Process.Pid)
+	wg.Wait()
+	select {
+	case err := <-checkErr:
+		errStream("Command was killed: %s\n", err)
+		return err
+	default:
+	}
+	if err != nil {
 		errStream("Command exited with %d\n", cmd.ProcessState.ExitCode())
 		return fmt.Errorf("cmd wait: %s", err)
+	} else if killErr != nil {
+		if opts.AssertCleanup {
+			return killErr
+		}
+		log.Warnf("%s", killErr)
 	}
 	return nil
 }
 
+// runCheck calls check every checkInterval until stop is closed. On the first
+// error, it kills the process group of the command and sends the error to
+// errc.
+func runCheck(check func() error, pgid int, stop <-chan struct{}, errc chan<- error) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := check(); err != nil {
+				errc <- err
+				syscall.Kill(-pgid, syscall.SIGKILL)
+				return
+			}
+		}
+	}
+}
+
+// killProcessGroup kills the processes left in the process group of a
+// command that exited, and waits for them to be gone.
+func killProcessGroup(pgid int) error {
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err == syscall.ESRCH {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("kill processes left by command: %s", err)
+	}
+	log.Infof("Killed processes left running by command")
+
+	deadline := time.Now().Add(processGroupKillTimeout)
+	for {
+		// Processes left by the command are reparented to init, which is
+		// makisu itself if it runs as pid 1 of a container, so reap them if
+		// they are children of this process.
+		for {
+			pid, err := syscall.Wait4(-pgid, nil, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+		}
+		if err := syscall.Kill(-pgid, 0); err == syscall.ESRCH {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("processes left by command still exist %s after being killed", processGroupKillTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func setProcAttributes(cmd *exec.Cmd, user string) error {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	if user == "" {
@@ -89,11 +276,19 @@ func setProcAttributes(cmd *exec.Cmd, user string) error {
 		return fmt.Errorf("cmd user resolve: %s", err)
 	}
 
+	if utils.Rootless && uid != os.Geteuid() {
+		// Switching users requires CAP_SETUID and CAP_SETGID.
+		log.Warnf("Running as current user instead of %s in rootless mode", user)
+		return nil
+	}
 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 	return nil
 }
 
-func readerToStream(reader io.Reader, stream func(string, ...interface{})) error {
+func readerToStream(reader io.Reader, stream func(string, ...interface{}), prefix string) error {
+	if PlainOutput || prefix != "" {
+		return readerToLineStream(reader, stream, prefix)
+	}
 	buffer := make([]byte, ShellStreamBufferSize)
 	for {
 		n, err := reader.Read(buffer)
@@ -108,3 +303,38 @@ func readerToStream(reader io.Reader, stream func(string, ...interface{})) error
 		}
 	}
 }
+
+// readerToLineStream streams each line of the reader separately, preceded by
+// prefix. With PlainOutput, lines are in the form they would end up displayed
+// in on a terminal. Lines longer than ShellStreamBufferSize are streamed in
+// chunks of that size, so that the reader is always drained and the command
+// never blocks on a full pipe.
+func readerToLineStream(reader io.Reader, stream func(string, ...interface{}), prefix string) error {
+	r := bufio.NewReaderSize(reader, ShellStreamBufferSize)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) > 0 {
+			line := string(chunk)
+			if strings.HasSuffix(line, "\n") {
+				line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			}
+			if PlainOutput {
+				line = plainLine(line)
+			}
+			stream("%s%s", prefix, line)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// plainLine keeps the final segment of a line rewritten with carriage
+// returns, and strips control sequences from it.
+func plainLine(line string) string {
+	segments := strings.Split(strings.TrimRight(line, "\r"), "\r")
+	line = segments[len(segments)-1]
+	return controlSequence.ReplaceAllString(line, "")
+}
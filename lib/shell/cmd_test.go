@@ -16,9 +16,14 @@ package shell
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -66,3 +71,155 @@ func TestExecCommandError(t *testing.T) {
 	require.Error(err)
 	require.NotEmpty(stderr.String())
 }
+
+func TestExecCommandKillsBackgroundProcesses(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	start := time.Now()
+	err := ExecCommandWithOptions(ExecOptions{AssertCleanup: true},
+		stdout.Write, stderr.Write, ".", "", "sh", "-c", "sleep 60 & echo $!")
+	require.NoError(err)
+	require.True(time.Since(start) < 30*time.Second)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	require.NoError(err)
+	require.Equal(syscall.ESRCH, syscall.Kill(pid, 0))
+}
+
+func TestExecCommandWithOptionsCheck(t *testing.T) {
+	defer func(interval time.Duration) { checkInterval = interval }(checkInterval)
+	checkInterval = 10 * time.Millisecond
+
+	t.Run("check fails", func(t *testing.T) {
+		require := require.New(t)
+		var calls int
+		check := func() error {
+			calls++
+			if calls > 2 {
+				return errors.New("over quota")
+			}
+			return nil
+		}
+		stdout, stderr := syncWriterFixture(), syncWriterFixture()
+		start := time.Now()
+		err := ExecCommandWithOptions(ExecOptions{Check: check},
+			stdout.Write, stderr.Write, ".", "", "sh", "-c", "sleep 60")
+		require.EqualError(err, "over quota")
+		require.True(time.Since(start) < 30*time.Second)
+		require.Contains(stderr.String(), "over quota")
+	})
+
+	t.Run("check passes", func(t *testing.T) {
+		require := require.New(t)
+		check := func() error { return nil }
+		stdout, stderr := syncWriterFixture(), syncWriterFixture()
+		err := ExecCommandWithOptions(ExecOptions{Check: check},
+			stdout.Write, stderr.Write, ".", "", "sh", "-c", "sleep 0.1; echo done")
+		require.NoError(err)
+		require.Equal("done\n", stdout.String())
+	})
+}
+
+func TestExecInteractive(t *testing.T) {
+	require := require.New(t)
+	require.NoError(ExecInteractive(".", "", "sh", "-c", "exit 0"))
+	require.Error(ExecInteractive(".", "", "sh", "-c", "exit 1"))
+}
+
+func TestExecCommandPlainOutput(t *testing.T) {
+	PlainOutput = true
+	defer func() { PlainOutput = false }()
+
+	require := require.New(t)
+	var lines []string
+	var mu sync.Mutex
+	stream := func(template string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(template, args...))
+	}
+	err := ExecCommand(stream, stream, ".", "", "printf",
+		`10%%\r50%%\r100%%\ndone\r\n\033[1;32mok\033[0m\tgreen\033[K\n`)
+	require.NoError(err)
+	require.Equal([]string{"100%", "done", "ok\tgreen"}, lines)
+}
+
+func TestExecCommandPlainOutputLongLines(t *testing.T) {
+	PlainOutput = true
+	defer func() { PlainOutput = false }()
+
+	require := require.New(t)
+	var lines []string
+	var mu sync.Mutex
+	stream := func(template string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(template, args...))
+	}
+	// Lines longer than the buffer are streamed in chunks instead of making
+	// the command fail on a full pipe.
+	size := 3*ShellStreamBufferSize + 10
+	err := ExecCommand(stream, stream, ".", "", "sh", "-c",
+		fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo; echo end", size))
+	require.NoError(err)
+	require.Len(lines, 5)
+	for _, line := range lines[:3] {
+		require.Len(line, ShellStreamBufferSize)
+	}
+	require.Equal(strings.Repeat("a", size), strings.Join(lines[:4], ""))
+	require.Equal("end", lines[4])
+}
+
+func TestExecCommandWithOptionsPrefix(t *testing.T) {
+	require := require.New(t)
+	var lines []string
+	var mu sync.Mutex
+	stream := func(template string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(template, args...))
+	}
+	err := ExecCommandWithOptions(ExecOptions{Prefix: "[build 2/3] "}, stream, stream, ".", "", "sh", "-c",
+		`printf 'partial'; sleep 0.1; printf ' line\nlast'`)
+	require.NoError(err)
+	require.Equal([]string{"[build 2/3] partial line", "[build 2/3] last"}, lines)
+}
+
+func TestExecCommandWithOptionsPrefixLongLines(t *testing.T) {
+	require := require.New(t)
+	var lines []string
+	var mu sync.Mutex
+	stream := func(template string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(template, args...))
+	}
+	size := ShellStreamBufferSize + 10
+	err := ExecCommandWithOptions(ExecOptions{Prefix: "[build 1/1] "}, stream, stream, ".", "", "sh", "-c",
+		fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo; echo end", size))
+	require.NoError(err)
+	require.Equal([]string{
+		"[build 1/1] " + strings.Repeat("a", ShellStreamBufferSize),
+		"[build 1/1] " + strings.Repeat("a", 10),
+		"[build 1/1] end",
+	}, lines)
+}
+
+func TestPlainLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"crlf\r", "crlf"},
+		{"1/3\r2/3\r3/3", "3/3"},
+		{"\x1b[31mred\x1b[0m", "red"},
+		{"bell\a", "bell"},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			require.Equal(t, test.expected, plainLine(test.line))
+		})
+	}
+}
@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecCommandWithOptionsNoNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	err := ExecCommandWithOptions(ExecOptions{NoNetwork: true},
+		stdout.Write, stderr.Write, ".", "", "cat", "/proc/net/dev")
+	require.NoError(err)
+
+	// Only the loopback interface is left, after the two header lines.
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(lines, 3)
+	require.Contains(lines[2], "lo:")
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CaseSensitivity is how names of files that only differ by case are treated
+// when the filesystem is diffed.
+type CaseSensitivity string
+
+const (
+	// CaseAuto probes the filesystem of the root dir.
+	CaseAuto CaseSensitivity = "auto"
+	// CaseSensitive treats names that only differ by case as different files,
+	// like Linux filesystems do.
+	CaseSensitive CaseSensitivity = "sensitive"
+	// CaseInsensitive treats names that only differ by case as the same file,
+	// like the default filesystems of macOS and Windows do.
+	CaseInsensitive CaseSensitivity = "insensitive"
+)
+
+// ParseCaseSensitivity parses auto, sensitive or insensitive.
+func ParseCaseSensitivity(s string) (CaseSensitivity, error) {
+	switch c := CaseSensitivity(s); c {
+	case CaseAuto, CaseSensitive, CaseInsensitive:
+		return c, nil
+	}
+	return "", fmt.Errorf("invalid case sensitivity %s, must be auto, sensitive or insensitive", s)
+}
+
+// isCaseInsensitive returns whether names of files in dir that only differ by
+// case refer to the same file, according to sensitivity. With CaseAuto, it
+// creates a file in dir, and checks whether its upper case name resolves to the
+// same inode.
+func isCaseInsensitive(dir string, sensitivity CaseSensitivity) (bool, error) {
+	switch sensitivity {
+	case CaseSensitive:
+		return false, nil
+	case CaseInsensitive:
+		return true, nil
+	}
+
+	f, err := ioutil.TempFile(dir, ".makisu-case-probe-")
+	if err != nil {
+		return false, fmt.Errorf("create probe file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat probe file: %s", err)
+	}
+	upper := filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name())))
+	upperFi, err := os.Lstat(upper)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("stat %s: %s", upper, err)
+	}
+	return os.SameFile(fi, upperFi), nil
+}
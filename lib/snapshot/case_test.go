@@ -0,0 +1,136 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCaseInsensitive(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpRoot)
+
+	t.Run("overrides", func(t *testing.T) {
+		require := require.New(t)
+		insensitive, err := isCaseInsensitive(tmpRoot, CaseSensitive)
+		require.NoError(err)
+		require.False(insensitive)
+
+		insensitive, err = isCaseInsensitive(tmpRoot, CaseInsensitive)
+		require.NoError(err)
+		require.True(insensitive)
+	})
+
+	t.Run("auto", func(t *testing.T) {
+		require := require.New(t)
+		_, err := isCaseInsensitive(tmpRoot, CaseAuto)
+		require.NoError(err)
+
+		// The probe file is removed.
+		files, err := ioutil.ReadDir(tmpRoot)
+		require.NoError(err)
+		require.Empty(files)
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		require := require.New(t)
+		c, err := ParseCaseSensitivity("insensitive")
+		require.NoError(err)
+		require.Equal(CaseInsensitive, c)
+		_, err = ParseCaseSensitivity("ignore")
+		require.Error(err)
+	})
+}
+
+func TestCreateLayerByScanCaseCollision(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+	uid, gid := os.Getuid(), os.Getgid()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/Foo", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "etc/foo", Typeflag: tar.TypeReg, Mode: 0644, Size: 2},
+	} {
+		hdr.ModTime, hdr.Uid, hdr.Gid = modTime, uid, gid
+		require.NoError(t, w.WriteHeader(hdr))
+		_, err := w.Write(bytes.Repeat([]byte("a"), int(hdr.Size)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// newRoot mimics the result of extracting the tar on a case-insensitive
+	// filesystem: etc/foo was written to etc/Foo, which keeps its name.
+	newRoot := func(t *testing.T) string {
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(t, err)
+		etc := filepath.Join(tmpRoot, "etc")
+		require.NoError(t, os.Mkdir(etc, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(etc, "Foo"), []byte("aa"), 0644))
+		require.NoError(t, os.Chmod(etc, 0755))
+		require.NoError(t, os.Chtimes(filepath.Join(etc, "Foo"), modTime, modTime))
+		require.NoError(t, os.Chtimes(etc, modTime, modTime))
+		return tmpRoot
+	}
+
+	t.Run("insensitive", func(t *testing.T) {
+		require := require.New(t)
+		tmpRoot := newRoot(t)
+		defer os.RemoveAll(tmpRoot)
+
+		opts := DefaultOptions()
+		opts.FilesystemCase = CaseInsensitive
+		fs, err := NewMemFS(clock.New(), tmpRoot, nil, opts)
+		require.NoError(err)
+		require.NoError(fs.UpdateFromTarReader(tar.NewReader(bytes.NewReader(buf.Bytes())), false))
+
+		// The second name replaced the first one, like on disk, so the
+		// scan doesn't find any difference.
+		l, err := fs.createLayerByScan()
+		require.NoError(err)
+		require.Equal(0, l.count())
+		n, err := findNode(fs, "/etc/FOO", false, 0)
+		require.NoError(err)
+		require.Equal("/etc/foo", n.dst)
+	})
+
+	t.Run("sensitive", func(t *testing.T) {
+		require := require.New(t)
+		tmpRoot := newRoot(t)
+		defer os.RemoveAll(tmpRoot)
+
+		opts := DefaultOptions()
+		opts.FilesystemCase = CaseSensitive
+		fs, err := NewMemFS(clock.New(), tmpRoot, nil, opts)
+		require.NoError(err)
+		require.NoError(fs.UpdateFromTarReader(tar.NewReader(bytes.NewReader(buf.Bytes())), false))
+
+		// Both names are kept, so etc/Foo looks modified, and gets the
+		// content of etc/foo in the layer.
+		l, err := fs.createLayerByScan()
+		require.NoError(err)
+		require.Contains(l.files, "/etc/Foo")
+	})
+}
@@ -36,6 +36,9 @@ type CopyOperation struct {
 	blacklist []string
 	// Indicates if the copy op is used for copying from previous stages.
 	internal bool
+
+	// ignored are absolute paths of the sources that aren't copied.
+	ignored []string
 }
 
 // NewCopyOperation initializes and validates a CopyOperation. Use "internal" to
@@ -71,8 +74,15 @@ func NewCopyOperation(
 	}, nil
 }
 
-// Execute performs the actual copying of files specified by the CopyOperation.
-func (c *CopyOperation) Execute() error {
+// Ignore excludes absolute paths under the sources, and their contents, from
+// the copy, like the paths of the build context matched by .dockerignore.
+func (c *CopyOperation) Ignore(paths []string) {
+	c.ignored = paths
+}
+
+// Execute performs the actual copying of files specified by the CopyOperation,
+// with the mtimes, special files and same file checks of opts.
+func (c *CopyOperation) Execute(opts Options) error {
 	var err error
 	for _, src := range c.srcs {
 		src, err = evalSymlinks(src, c.srcRoot)
@@ -85,18 +95,24 @@ func (c *CopyOperation) Execute() error {
 			return fmt.Errorf("lstat %s: %s", src, err)
 		}
 		var copier fileio.Copier
+		copierOpts := []fileio.CopierOption{
+			fileio.WithMaxModTime(opts.SourceDateEpoch),
+			fileio.WithSpecialFiles(opts.Tar.KeepSpecialFiles),
+			fileio.WithSameFileError(opts.FailCopyOntoItself),
+		}
 		if c.internal {
-			copier = fileio.NewInternalCopier()
+			copier = fileio.NewInternalCopier(copierOpts...)
 		} else {
-			copier = fileio.NewCopier(c.blacklist)
+			blacklist := append(append([]string{}, c.blacklist...), c.ignored...)
+			copier = fileio.NewCopier(blacklist, copierOpts...)
 		}
 		if fi.IsDir() {
 			// Dir to dir
 			if err := copier.CopyDir(src, c.dst, c.uid, c.gid); err != nil {
 				return fmt.Errorf("copy dir %s to dir %s: %s", src, c.dst, err)
 			}
-		} else if isDirFormat(c.dst) {
-			// File to dir
+		} else if isDirFormat(c.dst) || isDir(c.dst) {
+			// File to dir, which may be a symlink to a dir.
 			targetFilePath := filepath.Join(c.dst, filepath.Base(src))
 			if err := copier.CopyFile(src, targetFilePath, c.uid, c.gid); err != nil {
 				return fmt.Errorf("copy file %s to dir %s: %s", src, targetFilePath, err)
@@ -134,6 +150,12 @@ func checkCopyParams(srcs []string, workDir, dst string) error {
 	return nil
 }
 
+// isDir returns true if p is a directory, or a symlink to one.
+func isDir(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
 func isDirFormat(dst string) bool {
 	return strings.HasSuffix(dst, "/") || dst == "." || dst == ".."
 }
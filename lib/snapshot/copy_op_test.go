@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -89,13 +90,13 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, "", dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(dst)
 		require.NoError(err)
 		require.Equal(_hello, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 
 	t.Run("absolute file to relative file", func(t *testing.T) {
 		require := require.New(t)
@@ -109,13 +110,13 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, dst))
 		require.NoError(err)
 		require.Equal(_hello, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 
 	t.Run("absolute files to absolute dir", func(t *testing.T) {
 		require := require.New(t)
@@ -131,7 +132,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, dst, "test.txt"))
 		require.NoError(err)
 		require.Equal(_hello, b)
@@ -139,8 +140,8 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 
 	t.Run("absolute files to relative dir", func(t *testing.T) {
 		require := require.New(t)
@@ -156,7 +157,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, "test2", "test.txt"))
 		require.NoError(err)
 		require.Equal(_hello, b)
@@ -164,8 +165,8 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 
 	t.Run("absolute dirs to relative dir", func(t *testing.T) {
 		require := require.New(t)
@@ -183,7 +184,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, dst, "test.txt"))
 		require.NoError(err)
 		require.Equal(_hello, b)
@@ -191,8 +192,8 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 
 	t.Run("absolute dir and file to relative dir", func(t *testing.T) {
 		require := require.New(t)
@@ -209,7 +210,7 @@ func TestExecuteCopyOperation(t *testing.T) {
 		c, err := NewCopyOperation(
 			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
 		require.NoError(err)
-		require.NoError(c.Execute())
+		require.NoError(c.Execute(DefaultOptions()))
 		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, dst, "test.txt"))
 		require.NoError(err)
 		require.Equal(_hello, b)
@@ -217,6 +218,76 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
-	removeAllChildren(tmpRoot1, nil)
-	removeAllChildren(tmpRoot2, nil)
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
+
+	t.Run("symlink to dir", func(t *testing.T) {
+		require := require.New(t)
+
+		srcs := []string{"/link/"}
+		require.NoError(os.MkdirAll(filepath.Join(tmpRoot1, "test"), os.ModePerm))
+		require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot1, "test", "test.txt"), _hello, os.ModePerm))
+		require.NoError(os.Chown(filepath.Join(tmpRoot1, "test", "test.txt"), testutil.CurrUID(), testutil.CurrGID()))
+		require.NoError(os.Symlink("test.txt", filepath.Join(tmpRoot1, "test", "inner")))
+		require.NoError(os.Symlink("test", filepath.Join(tmpRoot1, "link")))
+		srcRoot := tmpRoot1
+		workDir := tmpRoot2
+		dst := "test2/"
+		c, err := NewCopyOperation(
+			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
+		require.NoError(err)
+		require.NoError(c.Execute(DefaultOptions()))
+		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, dst, "test.txt"))
+		require.NoError(err)
+		require.Equal(_hello, b)
+		target, err := os.Readlink(filepath.Join(tmpRoot2, dst, "inner"))
+		require.NoError(err)
+		require.Equal("test.txt", target)
+	})
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
+
+	t.Run("dangling symlink", func(t *testing.T) {
+		require := require.New(t)
+
+		srcs := []string{"/link"}
+		require.NoError(os.Symlink("nonexistent", filepath.Join(tmpRoot1, "link")))
+		srcRoot := tmpRoot1
+		workDir := tmpRoot2
+		dst := "test2/"
+		c, err := NewCopyOperation(
+			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
+		require.NoError(err)
+		require.NoError(c.Execute(DefaultOptions()))
+		target, err := os.Readlink(filepath.Join(tmpRoot2, dst, "link"))
+		require.NoError(err)
+		require.Equal("nonexistent", target)
+	})
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
+
+	t.Run("file to symlink to dir", func(t *testing.T) {
+		require := require.New(t)
+
+		srcs := []string{"/test.txt"}
+		require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot1, "test.txt"), _hello, os.ModePerm))
+		require.NoError(os.Chown(filepath.Join(tmpRoot1, "test.txt"), testutil.CurrUID(), testutil.CurrGID()))
+		require.NoError(os.Mkdir(filepath.Join(tmpRoot2, "data"), 0755))
+		require.NoError(os.Symlink("data", filepath.Join(tmpRoot2, "app")))
+		srcRoot := tmpRoot1
+		workDir := tmpRoot2
+		dst := "app"
+		c, err := NewCopyOperation(
+			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
+		require.NoError(err)
+		require.NoError(c.Execute(DefaultOptions()))
+		b, err := ioutil.ReadFile(filepath.Join(tmpRoot2, "data", "test.txt"))
+		require.NoError(err)
+		require.Equal(_hello, b)
+		target, err := os.Readlink(filepath.Join(tmpRoot2, "app"))
+		require.NoError(err)
+		require.Equal("data", target)
+	})
+	removeAllChildren(tmpRoot1, nil, tario.DefaultOptions())
+	removeAllChildren(tmpRoot2, nil, tario.DefaultOptions())
 }
@@ -0,0 +1,66 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetLayerExcludes validates the patterns and sets the LayerExcludes of opts.
+func SetLayerExcludes(opts *Options, patterns []string) error {
+	excludes := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			pattern = filepath.Join("/", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+		excludes = append(excludes, pattern)
+	}
+	opts.LayerExcludes = excludes
+	return nil
+}
+
+// isExcluded returns true if the absolute path in the image, or any of its
+// parent directories, matches one of the LayerExcludes patterns.
+func (o Options) isExcluded(dst string) bool {
+	if len(o.LayerExcludes) == 0 {
+		return false
+	}
+	for p := filepath.Join("/", dst); p != "/"; p = filepath.Dir(p) {
+		for _, pattern := range o.LayerExcludes {
+			name := p
+			if !strings.HasPrefix(pattern, "/") {
+				name = filepath.Base(p)
+			}
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipExcluded returns the error that makes a walk skip the excluded path.
+func skipExcluded(fi os.FileInfo) error {
+	if fi.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
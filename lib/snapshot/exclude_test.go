@@ -0,0 +1,52 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsExcluded(t *testing.T) {
+	opts := DefaultOptions()
+	require.NoError(t, SetLayerExcludes(&opts, []string{".git", "*.pyc", "root/.cache", "/tmp/build-*"}))
+
+	tests := []struct {
+		path     string
+		excluded bool
+	}{
+		{"/app/.git", true},
+		{"/app/.git/objects/ab", true},
+		{"/app/main.pyc", true},
+		{"/root/.cache/pip", true},
+		{"/tmp/build-123/out", true},
+		{"/app/git", false},
+		{"/home/root/.cache", false},
+		{"/tmp/build", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			require.Equal(t, test.excluded, opts.isExcluded(test.path))
+		})
+	}
+}
+
+func TestSetLayerExcludesInvalid(t *testing.T) {
+	opts := DefaultOptions()
+	require.Error(t, SetLayerExcludes(&opts, []string{"[a-"}))
+	require.Empty(t, opts.LayerExcludes)
+}
@@ -0,0 +1,207 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/tario"
+)
+
+// flattener merges the layers of an image into a single tar. The layers are
+// first read from the topmost one down to find the entries that are not
+// shadowed by upper layers, and then written from the bottom one up, so that
+// parent directories and the targets of hard links precede their entries.
+type flattener struct {
+	// states of the paths resolved by the layers processed so far.
+	states map[string]extractState
+	// cleared are the directories recreated by upper layers over a whiteout,
+	// whose contents in lower layers are deleted.
+	cleared map[string]bool
+	// owners are the indexes of the layers whose entry of a path is kept.
+	owners map[string]int
+	// links are the names of the kept hard links of each layer, by the path
+	// of their target.
+	links []map[string][]string
+}
+
+// FlattenLayers writes the filesystem that results from applying the layers
+// of an image in order to w, as a single tar. Entries that are replaced or
+// deleted by upper layers, as well as whiteouts, are left out.
+func FlattenLayers(w io.Writer, layers []LayerOpener) error {
+	f := &flattener{
+		states:  make(map[string]extractState),
+		cleared: make(map[string]bool),
+		owners:  make(map[string]int),
+		links:   make([]map[string][]string, len(layers)),
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := f.resolveLayer(i, layers[i]); err != nil {
+			return fmt.Errorf("resolve layer %d: %s", i, err)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for i := range layers {
+		if err := f.writeLayer(tw, i, layers[i]); err != nil {
+			return fmt.Errorf("write layer %d: %s", i, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar writer: %s", err)
+	}
+	return nil
+}
+
+// resolveLayer records the entries of a layer that are not shadowed by upper
+// layers.
+func (f *flattener) resolveLayer(i int, open LayerOpener) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open layer: %s", err)
+	}
+	defer r.Close()
+
+	// States set by this layer only apply to lower layers.
+	pending := make(map[string]extractState)
+	cleared := make(map[string]bool)
+	f.links[i] = make(map[string][]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+
+		p := filepath.Join("/", hdr.Name)
+		base := filepath.Base(p)
+		if strings.HasPrefix(base, _whiteoutMetaPrefix) {
+			continue
+		} else if strings.HasPrefix(base, _whiteoutPrefix) {
+			deleted := filepath.Join(filepath.Dir(p), strings.TrimPrefix(base, _whiteoutPrefix))
+			if f.hidden(deleted) || f.cleared[deleted] {
+				continue
+			} else if s := f.states[deleted]; s == stateUnknown {
+				pending[deleted] = stateDeleted
+			} else if s == stateDir || s == stateImplicitDir {
+				cleared[deleted] = true
+			}
+			continue
+		} else if f.hidden(p) || f.cleared[p] {
+			continue
+		}
+
+		isDir := hdr.Typeflag == tar.TypeDir
+		if s := f.states[p]; s == stateDir || s == stateFile || s == stateDeleted ||
+			(s == stateImplicitDir && !isDir) {
+			continue
+		}
+
+		f.owners[p] = i
+		if isDir {
+			pending[p] = stateDir
+		} else {
+			pending[p] = stateFile
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target := filepath.Join("/", hdr.Linkname)
+			f.links[i][target] = append(f.links[i][target], hdr.Name)
+		}
+		for dir := filepath.Dir(p); dir != "/"; dir = filepath.Dir(dir) {
+			if f.states[dir] == stateUnknown && pending[dir] == stateUnknown {
+				pending[dir] = stateImplicitDir
+			}
+		}
+	}
+
+	for p, s := range pending {
+		if current := f.states[p]; current == stateUnknown || current == stateImplicitDir {
+			f.states[p] = s
+		}
+	}
+	for p := range cleared {
+		f.cleared[p] = true
+	}
+	return nil
+}
+
+// writeLayer writes the kept entries of a layer to tw. If the target of a
+// kept hard link is shadowed, its content is written as the first link
+// instead, which the other links then point to.
+func (f *flattener) writeLayer(tw *tar.Writer, i int, open LayerOpener) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open layer: %s", err)
+	}
+	defer r.Close()
+
+	// Names that the shadowed targets of hard links were written as.
+	renamed := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+
+		p := filepath.Join("/", hdr.Name)
+		if owner, ok := f.owners[p]; !ok || owner != i {
+			links := f.links[i][p]
+			if len(links) == 0 || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+				continue
+			}
+			renamed[p] = links[0]
+			hdr.Name = links[0]
+		} else if hdr.Typeflag == tar.TypeLink {
+			if name, ok := renamed[filepath.Join("/", hdr.Linkname)]; ok {
+				if name == hdr.Name {
+					continue
+				}
+				hdr.Linkname = name
+			}
+		}
+
+		if err := tario.WriteHeader(tw, hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("copy %s: %s", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// hidden returns true if an ancestor of p was replaced by a file, deleted or
+// cleared in an upper layer.
+func (f *flattener) hidden(p string) bool {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if s := f.states[dir]; s == stateFile || s == stateDeleted || f.cleared[dir] {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
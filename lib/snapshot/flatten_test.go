@@ -0,0 +1,135 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readTar returns the names of the entries of a tar in order, and a
+// description of each of them.
+func readTar(require *require.Assertions, b []byte) ([]string, map[string]string) {
+	var names []string
+	entries := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entries[hdr.Name] = "dir"
+		case tar.TypeSymlink:
+			entries[hdr.Name] = "symlink " + hdr.Linkname
+		case tar.TypeLink:
+			entries[hdr.Name] = "link " + hdr.Linkname
+		default:
+			content, err := ioutil.ReadAll(tr)
+			require.NoError(err)
+			entries[hdr.Name] = "file " + string(content)
+		}
+	}
+	return names, entries
+}
+
+func TestFlattenLayers(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]byte{
+		tarLayer(require, 1,
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config0"),
+			fileEntry("etc/removed", "removed0"),
+			dirEntry("opt/"),
+			fileEntry("opt/bin", "bin0"),
+			linkEntry(tar.TypeLink, "opt/link", "opt/bin"),
+			dirEntry("replaced/"),
+			fileEntry("replaced/file", "replaced0"),
+			dirEntry("deleted/"),
+			fileEntry("deleted/file", "deleted0"),
+			linkEntry(tar.TypeSymlink, "sym", "etc/config"),
+		),
+		tarLayer(require, 2,
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config1"),
+			fileEntry("etc/.wh.removed", ""),
+			dirEntry("opt/"),
+			fileEntry("opt/.wh.bin", ""),
+			fileEntry("replaced", "replaced1"),
+			fileEntry(".wh.deleted", ""),
+			fileEntry(".wh..wh..opq", ""),
+		),
+		tarLayer(require, 3,
+			dirEntry("deleted/"),
+			fileEntry("deleted/new", "new2"),
+		),
+	}
+
+	var b bytes.Buffer
+	require.NoError(FlattenLayers(&b, openers(layers, make([]int, len(layers)))))
+
+	names, entries := readTar(require, b.Bytes())
+	require.Equal(map[string]string{
+		"etc/":        "dir",
+		"etc/config":  "file config1",
+		"opt/":        "dir",
+		"opt/link":    "file bin0",
+		"sym":         "symlink etc/config",
+		"replaced":    "file replaced1",
+		"deleted/":    "dir",
+		"deleted/new": "file new2",
+	}, entries)
+	require.Equal([]string{
+		"opt/link", "sym", "etc/", "etc/config", "opt/", "replaced", "deleted/", "deleted/new",
+	}, names)
+}
+
+func TestFlattenLayersHardlinks(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]byte{
+		tarLayer(require, 1,
+			fileEntry("a", "a0"),
+			linkEntry(tar.TypeLink, "b", "a"),
+			linkEntry(tar.TypeLink, "c", "a"),
+			fileEntry("d", "d0"),
+			linkEntry(tar.TypeLink, "e", "d"),
+		),
+		tarLayer(require, 2,
+			fileEntry("a", "a1"),
+		),
+	}
+
+	var b bytes.Buffer
+	require.NoError(FlattenLayers(&b, openers(layers, make([]int, len(layers)))))
+
+	_, entries := readTar(require, b.Bytes())
+	require.Equal(map[string]string{
+		"a": "file a1",
+		"b": "file a0",
+		"c": "link b",
+		"d": "file d0",
+		"e": "link d",
+	}, entries)
+}
@@ -0,0 +1,154 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/uber/makisu/lib/tario"
+)
+
+// diffEntry is an entry of a flattened filesystem, with the digest of its
+// content.
+type diffEntry struct {
+	hdr    *tar.Header
+	digest string
+}
+
+// changed returns true if the entry doesn't describe the same file as the one
+// of the base filesystem.
+func (e *diffEntry) changed(base *diffEntry) bool {
+	similar, err := tario.IsSimilarHeader(base.hdr, e.hdr)
+	return err != nil || !similar || base.digest != e.digest
+}
+
+// DiffLayers writes the changes between the filesystem resulting from the base
+// layers and the one resulting from layers to w, as a single layer to apply on
+// top of the base ones: whiteouts for the paths that were deleted, followed by
+// the entries that were added or changed along with their parent directories.
+func DiffLayers(w *tario.Writer, base, layers []LayerOpener) error {
+	baseEntries, err := flattenedEntries(base)
+	if err != nil {
+		return fmt.Errorf("read base layers: %s", err)
+	}
+	entries, err := flattenedEntries(layers)
+	if err != nil {
+		return fmt.Errorf("read layers: %s", err)
+	}
+
+	changed := make(map[string]bool)
+	for p, e := range entries {
+		if b, ok := baseEntries[p]; !ok || e.changed(b) {
+			changed[p] = true
+		}
+	}
+	// Hard links to changed files are written again, since replacing their
+	// target in the new layer breaks the link.
+	for p, e := range entries {
+		if e.hdr.Typeflag == tar.TypeLink && changed[filepath.Join("/", e.hdr.Linkname)] {
+			changed[p] = true
+		}
+	}
+	included := make(map[string]bool)
+	for p := range changed {
+		for ; p != "/" && !included[p]; p = filepath.Dir(p) {
+			included[p] = true
+		}
+	}
+
+	// Only the topmost of the deleted paths need a whiteout, as the ones under
+	// a directory that was deleted or replaced by a file go along with it.
+	var deleted []string
+	for p := range baseEntries {
+		if _, ok := entries[p]; ok {
+			continue
+		}
+		if _, ok := baseEntries[filepath.Dir(p)]; ok {
+			if e, ok := entries[filepath.Dir(p)]; !ok || e.hdr.Typeflag != tar.TypeDir {
+				continue
+			}
+		}
+		deleted = append(deleted, p)
+	}
+	sort.Strings(deleted)
+	for _, p := range deleted {
+		whiteout := path.Join(filepath.Dir(p), _whiteoutPrefix+filepath.Base(p))
+		if err := tario.WriteHeader(w.Writer, &tar.Header{Name: whiteout}); err != nil {
+			return fmt.Errorf("write whiteout of %s: %s", p, err)
+		}
+	}
+
+	return readFlattened(layers, func(p string, hdr *tar.Header, r io.Reader) error {
+		if !included[p] {
+			return nil
+		}
+		if err := tario.WriteHeader(w.Writer, hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("copy %s: %s", hdr.Name, err)
+		}
+		return nil
+	})
+}
+
+// flattenedEntries returns the entries of the filesystem resulting from the
+// layers, by path.
+func flattenedEntries(layers []LayerOpener) (map[string]*diffEntry, error) {
+	entries := make(map[string]*diffEntry)
+	err := readFlattened(layers, func(p string, hdr *tar.Header, r io.Reader) error {
+		digester := sha256.New()
+		if _, err := io.Copy(digester, r); err != nil {
+			return fmt.Errorf("read %s: %s", hdr.Name, err)
+		}
+		entries[p] = &diffEntry{hdr, hex.EncodeToString(digester.Sum(nil))}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readFlattened calls f with the absolute path, header and content of each
+// entry of the flattened layers, in the order written by FlattenLayers.
+func readFlattened(layers []LayerOpener, f func(string, *tar.Header, io.Reader) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(FlattenLayers(pw, layers))
+	}()
+	// Closing the reader stops the flattening if f failed.
+	defer pr.Close()
+
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+		if err := f(filepath.Join("/", hdr.Name), hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffLayers(t *testing.T) {
+	require := require.New(t)
+
+	base := [][]byte{
+		tarLayer(require, 1,
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config0"),
+			fileEntry("etc/same", "same0"),
+			dirEntry("opt/"),
+			fileEntry("opt/bin", "bin0"),
+			linkEntry(tar.TypeLink, "opt/link", "etc/config"),
+			dirEntry("deleted/"),
+			fileEntry("deleted/file", "deleted0"),
+			fileEntry("removed", "removed0"),
+			linkEntry(tar.TypeSymlink, "sym", "etc/config"),
+		),
+	}
+	layers := [][]byte{
+		base[0],
+		tarLayer(require, 2,
+			fileEntry("etc/config", "config1"),
+			fileEntry(".wh.deleted", ""),
+			fileEntry(".wh.removed", ""),
+		),
+		tarLayer(require, 1,
+			fileEntry("opt/new", "new1"),
+		),
+	}
+
+	var b bytes.Buffer
+	w := tario.NewWriter(&b, tario.DefaultOptions())
+	require.NoError(DiffLayers(
+		w, openers(base, make([]int, len(base))), openers(layers, make([]int, len(layers)))))
+	require.NoError(w.Close())
+
+	names, entries := readTar(require, b.Bytes())
+	require.Equal(map[string]string{
+		".wh.deleted": "file ",
+		".wh.removed": "file ",
+		"etc/":        "dir",
+		"etc/config":  "file config1",
+		"opt/":        "dir",
+		"opt/link":    "file config0",
+		"opt/new":     "file new1",
+	}, entries)
+	require.Equal([]string{".wh.deleted", ".wh.removed"}, names[:2])
+}
+
+func TestDiffLayersUnchanged(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]byte{
+		tarLayer(require, 1,
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config0"),
+		),
+		tarLayer(require, 1,
+			fileEntry("etc/config", "config0"),
+		),
+	}
+
+	var b bytes.Buffer
+	w := tario.NewWriter(&b, tario.DefaultOptions())
+	require.NoError(DiffLayers(
+		w, openers(layers[:1], make([]int, 1)), openers(layers, make([]int, len(layers)))))
+	require.NoError(w.Close())
+
+	names, _ := readTar(require, b.Bytes())
+	require.Empty(names)
+}
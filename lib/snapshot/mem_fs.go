@@ -16,6 +16,7 @@ package snapshot
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -29,6 +30,7 @@ import (
 	"github.com/uber/makisu/lib/mountutils"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils"
 
 	"github.com/andres-erbsen/clock"
 )
@@ -36,12 +38,33 @@ import (
 // memFSNode represents one node of the directory tree in the merged fs view.
 type memFSNode struct {
 	*contentMemFile                       // No whiteouts
-	children        map[string]*memFSNode // Child nodes of the directory, indexed by base name
+	children        map[string]*memFSNode // Child nodes of the directory, indexed by key of base name
+
+	// foldCase is true if the tree is on a case-insensitive filesystem, on
+	// which names that only differ by case are the same file.
+	foldCase bool
 }
 
 // newMemFSNode inits a new memFSNode instance.
 func newMemFSNode(mf *contentMemFile) *memFSNode {
-	return &memFSNode{mf, make(map[string]*memFSNode)}
+	return &memFSNode{contentMemFile: mf, children: make(map[string]*memFSNode)}
+}
+
+// newChild inits a new memFSNode instance in the same tree as n.
+func (n *memFSNode) newChild(mf *contentMemFile) *memFSNode {
+	child := newMemFSNode(mf)
+	child.foldCase = n.foldCase
+	return child
+}
+
+// key returns the key of the child with the given base name. Names that only
+// differ by case share a key if the tree folds case, since the filesystem
+// stores them as a single file, whichever name was created first.
+func (n *memFSNode) key(name string) string {
+	if n.foldCase {
+		return strings.ToLower(name)
+	}
+	return name
 }
 
 // isOnDisk returns true if the path exists on disk.
@@ -62,10 +85,15 @@ type MemFS struct {
 
 	blacklist []string
 	layers    []*memLayer
+	opts      Options
+
+	// blobs, if set, is shared by the files copied by Checkpoint.
+	blobs *fileio.BlobStore
 }
 
-// NewMemFS inits a new MemFS instance.
-func NewMemFS(clk clock.Clock, root string, blacklist []string) (*MemFS, error) {
+// NewMemFS inits a new MemFS instance, which commits layers and extracts files
+// with the given options.
+func NewMemFS(clk clock.Clock, root string, blacklist []string, opts Options) (*MemFS, error) {
 	fi, err := os.Lstat(root)
 	if err != nil {
 		return nil, fmt.Errorf("unable to stat root dir: %s", root)
@@ -74,13 +102,26 @@ func NewMemFS(clk clock.Clock, root string, blacklist []string) (*MemFS, error)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create root header")
 	}
+	tree := newMemFSNode(newContentMemFile(root, "/", hdr))
+	if tree.foldCase, err = isCaseInsensitive(root, opts.FilesystemCase); err != nil {
+		log.Warnf("Failed to check case sensitivity of %s, assuming it is case sensitive: %s", root, err)
+	} else if tree.foldCase {
+		log.Infof("* Filesystem of %s is case insensitive, names that only differ by case are the same file", root)
+	}
 	return &MemFS{
 		clk:       clk,
-		tree:      newMemFSNode(newContentMemFile(root, "/", hdr)),
+		tree:      tree,
 		blacklist: blacklist,
+		opts:      opts,
 	}, nil
 }
 
+// SetFileBlobs makes Checkpoint link the files it copies to the blobs of the
+// given store. A nil store disables it.
+func (fs *MemFS) SetFileBlobs(blobs *fileio.BlobStore) {
+	fs.blobs = blobs
+}
+
 // Reset resets the in-memory file system view of the memFS.
 func (fs *MemFS) Reset() {
 	fs.tree.children = make(map[string]*memFSNode)
@@ -98,7 +139,7 @@ func (fs *MemFS) Checkpoint(newRoot string, sources []string) error {
 	}
 
 	log.Infof("* Moving directories %v to %s", sources, newRoot)
-	copier := fileio.NewCopier(fs.blacklist)
+	copier := fileio.NewCopier(fs.blacklist, fileio.WithBlobStore(fs.blobs))
 	for _, src := range resolvedSources {
 		if !filepath.IsAbs(src) {
 			src = filepath.Join(fs.tree.src, src)
@@ -128,7 +169,7 @@ func (fs *MemFS) Checkpoint(newRoot string, sources []string) error {
 
 // Remove removes everything under the root of the memFS.
 func (fs *MemFS) Remove() error {
-	return removeAllChildren(fs.tree.src, fs.blacklist)
+	return removeAllChildren(fs.tree.src, fs.blacklist, fs.opts.Tar)
 }
 
 // UpdateFromTarPath updates MemFS with the contents of the tarball at the given
@@ -140,19 +181,27 @@ func (fs *MemFS) UpdateFromTarPath(source string, untar bool) error {
 		return fmt.Errorf("open tar file: %s", err)
 	}
 	defer reader.Close()
-	gzipReader, err := tario.NewGzipReader(reader)
+	gzipReader, err := tario.NewLayerReader(reader)
 	if err != nil {
-		return fmt.Errorf("new gzip reader: %s", err)
+		return fmt.Errorf("new layer reader: %s", err)
 	}
 	return fs.UpdateFromTarReader(tar.NewReader(gzipReader), untar)
 }
 
 // UpdateFromTarReader updates MemFS with the contents of the tarball from the
 // gvien reader, and optionally untars the tarball onto the root of MemFS.
+// Like in Docker, if the tarball has several entries with the same path, the
+// last one wins.
 func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 	start := time.Now()
-	// Keep a list of all hard links that we will create in a second pass.
+	// Keep a list of all hard links that we will create in a second pass, in
+	// the order they appear in.
 	hardlinks := make(map[string]*tar.Header)
+	var hardlinkPaths []string
+
+	// Paths of the entries seen so far, to detect duplicates.
+	seen := make(map[string]bool)
+	var duplicates int
 
 	// Also keep a list of the mod times of the parent directories. We will use this to
 	// reset them.
@@ -173,7 +222,7 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		}
 
 		path := filepath.Join(fs.tree.src, hdr.Name)
-		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist); err != nil {
+		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist, fs.opts.Tar); err != nil {
 			return fmt.Errorf("check if should skip %s: %s", path, err)
 		} else if skip {
 			continue
@@ -199,12 +248,27 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 
 		hdr.Name = pathutils.RelPath(hdr.Name)
 
+		// A duplicate entry replaces the previous one, even if their headers
+		// are similar, so it must not be skipped as already on disk.
+		duplicate := seen[path]
+		if duplicate {
+			duplicates++
+			delete(hardlinks, path)
+			if untar && hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeLink {
+				if err := os.RemoveAll(path); err != nil {
+					return fmt.Errorf("remove duplicate %s: %s", path, err)
+				}
+			}
+		}
+		seen[path] = true
+
 		// If the new file is a hard link, then append it to the list
 		// that will be created later.
 		if hdr.Typeflag == tar.TypeLink {
 			// Docker hard link names are all absolute, but don't have a leading slash.
 			hdr.Linkname = pathutils.AbsPath(hdr.Linkname)
 			hardlinks[path] = hdr
+			hardlinkPaths = append(hardlinkPaths, path)
 		} else {
 			if untar {
 				if err := fs.untarOneItem(path, hdr, r); err != nil {
@@ -218,8 +282,14 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		count++
 	}
 
-	// Run through all the hard links and create them.
-	for path, hdr := range hardlinks {
+	// Run through all the hard links and create them. Paths of duplicate hard
+	// links are only created once, with the last header.
+	for _, path := range hardlinkPaths {
+		hdr, ok := hardlinks[path]
+		if !ok {
+			continue
+		}
+		delete(hardlinks, path)
 		if untar {
 			if err := fs.untarOneItem(path, hdr, nil); err != nil {
 				return fmt.Errorf("untar one item %s: %s", path, err)
@@ -237,6 +307,9 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		}
 	}
 	fs.layers = append(fs.layers, l)
+	if duplicates > 0 {
+		log.Warnf("* Replaced %d duplicate entries of tar with the last one of each path", duplicates)
+	}
 	log.Infof("* Merged %d headers from tar to memfs", l.count())
 	return nil
 }
@@ -244,7 +317,7 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 // AddLayerByScan creates an in-memory layer by scanning the differences
 // between the file system and existing in-memory merged layers. The
 // resulting layer is merged in memory and written to the tar writer.
-func (fs *MemFS) AddLayerByScan(w *tar.Writer) error {
+func (fs *MemFS) AddLayerByScan(w *tario.Writer) error {
 	fs.sync()
 	if l, err := fs.createLayerByScan(); err != nil {
 		return fmt.Errorf("create layer by scan: %s", err)
@@ -260,7 +333,7 @@ func (fs *MemFS) AddLayerByScan(w *tar.Writer) error {
 // on the given src-dst pairs. The file system is not modified during this
 // operation. The resulting layer is merged in memory and written to the
 // tar writer.
-func (fs *MemFS) AddLayerByCopyOps(cs []*CopyOperation, w *tar.Writer) error {
+func (fs *MemFS) AddLayerByCopyOps(cs []*CopyOperation, w *tario.Writer) error {
 	fs.sync()
 	l := newMemLayer()
 	for _, c := range cs {
@@ -301,11 +374,14 @@ func (fs *MemFS) createLayerByScan() (*memLayer, error) {
 	l := newMemLayer()
 	root := fs.tree.src
 	if err := walk(
-		root, fs.blacklist, func(src string, fi os.FileInfo) error {
+		root, fs.blacklist, fs.opts.Tar, func(src string, fi os.FileInfo) error {
 			dst, err := pathutils.TrimRoot(src, root)
 			if err != nil {
 				return err
 			}
+			if fs.opts.isExcluded(dst) {
+				return skipExcluded(fi)
+			}
 			hdr, err := l.createHeader(fs.tree.src, src, dst, fi)
 			if err != nil {
 				return fmt.Errorf("create header %s: %s", dst, err)
@@ -334,13 +410,20 @@ func (fs *MemFS) createLayerByScan() (*memLayer, error) {
 //   - files copied to dir2
 //   - contents of dirs copied to dir2
 func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
-	var err error
+	srcs := make([]string, len(c.srcs))
+	for i, src := range c.srcs {
+		resolved, err := evalSymlinks(src, c.srcRoot)
+		if err != nil {
+			return fmt.Errorf("eval symlinks for %s: %s", src, err)
+		}
+		srcs[i] = filepath.Join(c.srcRoot, resolved)
+	}
 	createDst := true
 
-	if len(c.srcs) == 1 {
-		src := filepath.Join(c.srcRoot, c.srcs[0])
-		if fi, err := os.Stat(src); err != nil {
-			return fmt.Errorf("stat src %s: %s", src, err)
+	if len(srcs) == 1 {
+		src := srcs[0]
+		if fi, err := os.Lstat(src); err != nil {
+			return fmt.Errorf("lstat src %s: %s", src, err)
 		} else if !fi.IsDir() {
 			// Case 1, no need to ensure dst exists explicitly.
 			createDst = false
@@ -359,16 +442,13 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 		c.dst = resolved
 	}
 
-	for _, src := range c.srcs {
-		src, err = evalSymlinks(src, c.srcRoot)
-		if err != nil {
-			return fmt.Errorf("eval symlinks for %s: %s", src, err)
-		}
-		src = filepath.Join(c.srcRoot, src)
-		if err := walk(src, nil, func(currSrc string, fi os.FileInfo) error {
+	for _, src := range srcs {
+		if err := walk(src, c.ignored, fs.opts.Tar, func(currSrc string, fi os.FileInfo) error {
 			var currDst string
 			if currSrc == src {
-				if fi.IsDir() {
+				if fi.IsDir() && fs.opts.isExcluded(c.dst) {
+					return filepath.SkipDir
+				} else if fi.IsDir() {
 					// If src is a directory, recursively copy its contents to
 					// dst (but not the directory itself since dst directory
 					// either already exists or was created at the beginning
@@ -376,8 +456,16 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 					return nil
 
 				} else if !strings.HasSuffix(c.dst, "/") {
-					// If src & dst are files, just copy src to dst (case 1).
+					// If src & dst are files, just copy src to dst (case 1),
+					// unless dst is a directory or links to one, into which
+					// src is copied like docker does.
 					currDst = c.dst
+					target, n, err := fs.resolvePath(c.dst)
+					if err != nil {
+						return fmt.Errorf("resolve %s: %s", c.dst, err)
+					} else if n != nil && n.hdr.Typeflag == tar.TypeDir {
+						currDst = filepath.Join(target, filepath.Base(src))
+					}
 
 				} else {
 					// If src is a file & dst is a dir, copy src to dst/<file>.
@@ -388,12 +476,21 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 				// destination in dst (strip src prefix & append to dst).
 				currDst = filepath.Join(c.dst, currSrc[len(src):])
 			}
+			resolved, err := fs.resolveCopyDestination(currDst, fi.IsDir())
+			if err != nil {
+				return fmt.Errorf("resolve %s: %s", currDst, err)
+			}
+			currDst = resolved
+			if fs.opts.isExcluded(currDst) {
+				return skipExcluded(fi)
+			}
 			hdr, err := l.createHeader(fs.tree.src, currSrc, currDst, fi)
 			if err != nil {
 				return fmt.Errorf("create header %s: %s", currDst, err)
 			}
 			hdr.Uid = c.uid
 			hdr.Gid = c.gid
+			hdr.ModTime = fs.opts.clampModTime(hdr.ModTime)
 			return fs.maybeAddToLayer(l, currSrc, currDst, hdr, false)
 		}); err != nil {
 			return fmt.Errorf("copy src %s to dst %s: %s", src, c.dst, err)
@@ -404,10 +501,10 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 
 // commitLayer writes the layer content into the given tar writer.
 // It ensures all paths are alphabetically sorted.
-func (fs *MemFS) commitLayer(l *memLayer, w *tar.Writer) error {
+func (fs *MemFS) commitLayer(l *memLayer, w *tario.Writer) error {
 	// Write to tar header in alphabetical order.
 	if err := l.rangeFiles(func(f memFile) error {
-		return f.commit(w)
+		return f.commit(w, fs.opts.OwnerRemap)
 	}); err != nil {
 		return fmt.Errorf("commit layer: %s", err)
 	}
@@ -471,7 +568,7 @@ func (fs *MemFS) isUpdated(p string, hdr *tar.Header) (bool, *memFSNode, error)
 	curr := fs.tree
 	parts := pathutils.SplitPath(p)
 	for _, part := range parts {
-		if n, ok := curr.children[part]; ok {
+		if n, ok := curr.children[curr.key(part)]; ok {
 			curr = n
 		} else {
 			return true, nil, nil
@@ -485,13 +582,94 @@ func (fs *MemFS) isUpdated(p string, hdr *tar.Header) (bool, *memFSNode, error)
 	return !similar, curr, nil
 }
 
+// resolveCopyDestination returns where a file copied to dst ends up once the
+// symlinks of the image are followed, like docker does: the parents of dst are
+// resolved, and so is dst itself if both it and the copied file are
+// directories, so that symlinks to directories are kept instead of being
+// replaced with directories.
+func (fs *MemFS) resolveCopyDestination(dst string, isDir bool) (string, error) {
+	dir, _, err := fs.resolvePath(filepath.Dir(dst))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, filepath.Base(dst))
+	if !isDir {
+		return resolved, nil
+	}
+	target, n, err := fs.resolvePath(resolved)
+	if err != nil {
+		return "", err
+	} else if n != nil && n.hdr.Typeflag == tar.TypeDir {
+		return target, nil
+	}
+	return resolved, nil
+}
+
+// resolvePath returns the path that p resolves to in memory, along with its
+// node, following the symlinks of all its elements. Like on disk with
+// walkLinks, ".." never goes above the root and absolute link targets are
+// resolved against it. Once an element doesn't exist, the remaining elements
+// are appended as is, and the returned node is nil.
+func (fs *MemFS) resolvePath(p string) (string, *memFSNode, error) {
+	resolved := "/"
+	unresolved := pathutils.SplitPath(p)
+	var linksWalked int
+	for len(unresolved) > 0 {
+		elem := unresolved[0]
+		unresolved = unresolved[1:]
+		if elem == "" || elem == "." {
+			continue
+		} else if elem == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		n := fs.lookup(next)
+		if n == nil {
+			return filepath.Join(append([]string{next}, unresolved...)...), nil, nil
+		} else if n.hdr.Typeflag != tar.TypeSymlink {
+			resolved = next
+			continue
+		}
+
+		linksWalked++
+		if linksWalked > 255 {
+			return "", nil, fmt.Errorf("%w at %s", errSymlinkLoop, p)
+		}
+		if filepath.IsAbs(n.hdr.Linkname) {
+			resolved = "/"
+		}
+		unresolved = append(strings.Split(n.hdr.Linkname, "/"), unresolved...)
+	}
+	return resolved, fs.lookup(resolved), nil
+}
+
+// lookup returns the node of the path in memory without following symlinks,
+// or nil if there is none.
+func (fs *MemFS) lookup(p string) *memFSNode {
+	curr := fs.tree
+	for _, part := range pathutils.SplitPath(p) {
+		n, ok := curr.children[curr.key(part)]
+		if !ok {
+			return nil
+		}
+		curr = n
+	}
+	return curr
+}
+
+// errSymlinkLoop is returned by addAncestors when resolving a path follows too
+// many symlinks.
+var errSymlinkLoop = errors.New("symlink loop")
+
 // addAncestors adds a memFile to the layer for each ancestor of the given path.
 // Set inclusive to true to include the dst path itself as a directory.
 // It follows symlinks, and returns the resolved dst path to the best of its
 // knowledge.
 func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, uid, gid int) (string, error) {
 	if depth >= 1024 {
-		return "", fmt.Errorf("symlink loop at %s", dst)
+		return "", fmt.Errorf("%w at %s", errSymlinkLoop, dst)
 	}
 
 	lastAncestor := fs.tree
@@ -506,7 +684,7 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 	}
 	for ; i < end; i++ {
 		part = parts[i]
-		if n, ok := curr.children[part]; ok {
+		if n, ok := curr.children[curr.key(part)]; ok {
 			if err := l.addHeader(n.src, n.dst, n.hdr).updateMemFS(fs.tree); err != nil {
 				return "", fmt.Errorf("update memfs with ancestor %s: %s", n.dst, err)
 			}
@@ -516,11 +694,18 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 				lastAncestor = n
 				curr = n
 			case tar.TypeSymlink:
-				// Add ancestors of symlink target too.
+				// Add ancestors of symlink target too. Relative targets are
+				// relative to the directory of the symlink.
 				remaining := filepath.Join(parts[i+1:]...)
 				target := filepath.Join(n.hdr.Linkname, remaining)
+				if !filepath.IsAbs(n.hdr.Linkname) {
+					target = filepath.Join("/", filepath.Join(parts[:i]...), target)
+				}
 				resolved, err := fs.addAncestors(l, target, inclusive, depth+1, uid, gid)
-				if err != nil {
+				if errors.Is(err, errSymlinkLoop) {
+					// Not wrapped at every level, as the loop is the cause.
+					return "", err
+				} else if err != nil {
 					return "", fmt.Errorf(
 						"get symlink target ancestors %s: %s", target, err)
 				}
@@ -540,7 +725,7 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 		if err != nil {
 			return "", fmt.Errorf("create header %s: %s", curr, err)
 		}
-		hdr.ModTime = fs.clk.Now()
+		hdr.ModTime = fs.opts.clampModTime(fs.clk.Now())
 		hdr.Uid = uid
 		hdr.Gid = gid
 		if err := l.addHeader("", curr, hdr).updateMemFS(fs.tree); err != nil {
@@ -624,6 +809,10 @@ func (fs *MemFS) untarOneItem(path string, header *tar.Header, r *tar.Reader) er
 		if err := fs.untarHardlink(path, header); err != nil {
 			return fmt.Errorf("untar hard link: %s", err)
 		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := fs.untarSpecialFile(path, header); err != nil {
+			return fmt.Errorf("untar special file: %s", err)
+		}
 	default:
 		if err := fs.untarFile(path, header, r); err != nil {
 			return fmt.Errorf("untar file: %s", err)
@@ -663,7 +852,7 @@ func (fs *MemFS) untarSymlink(path string, header *tar.Header) error {
 		return fmt.Errorf("create symlink %s => %s: %s", path, target, err)
 	}
 
-	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+	if err := utils.Lchown(path, header.Uid, header.Gid); err != nil {
 		return fmt.Errorf("lchown symlink: %s", path)
 	}
 	return nil
@@ -682,6 +871,18 @@ func (fs *MemFS) untarHardlink(path string, header *tar.Header) error {
 	return nil
 }
 
+// untarSpecialFile creates the device node or named pipe specified by header
+// at path. Devices can only be created by root, so they are skipped with a
+// warning otherwise.
+func (fs *MemFS) untarSpecialFile(path string, header *tar.Header) error {
+	if err := tario.MakeSpecialFile(path, header); errors.Is(err, syscall.EPERM) {
+		log.Warnf("Skipping special file %s: %s", path, err)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
 // untarFile creates the file specified by header at path, copies its content from
 // the tar reader, and applies the metadata.
 func (fs *MemFS) untarFile(path string, header *tar.Header, r *tar.Reader) error {
@@ -691,8 +892,8 @@ func (fs *MemFS) untarFile(path string, header *tar.Header, r *tar.Reader) error
 		return fmt.Errorf("open file %s: %s", path, err)
 	}
 	defer file.Close()
-	if _, err := io.Copy(file, r); err != nil {
-		return fmt.Errorf("read from file %s: %s", path, err)
+	if _, err := tario.CopyFileContent(file, r, fs.opts.Tar.SparseFiles); err != nil {
+		return fmt.Errorf("read from file %s: %s", path, utils.CheckOutOfDisk(err, path))
 	}
 	if err := tario.ApplyHeader(path, header); err != nil {
 		return fmt.Errorf("update fi %s: %s", path, err)
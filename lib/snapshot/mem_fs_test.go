@@ -16,13 +16,18 @@ package snapshot
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/tario"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
@@ -70,7 +75,7 @@ func TestUntarFromPath(t *testing.T) {
 	require.NoError(err)
 
 	clk := clock.NewMock()
-	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 	require.NoError(err)
 	fs.blacklist = nil
 
@@ -116,6 +121,73 @@ func TestUntarFromPath(t *testing.T) {
 	require.Equal(2, fs.layers[len(fs.layers)-1].count())
 }
 
+func TestUntarDuplicateEntries(t *testing.T) {
+	require := require.New(t)
+
+	modTime := time.Unix(1500000000, 0)
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	writeEntry := func(hdr *tar.Header, content string) {
+		hdr.Mode = 0644
+		hdr.ModTime = modTime
+		hdr.Size = int64(len(content))
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		require.NoError(w.WriteHeader(hdr))
+		_, err := w.Write([]byte(content))
+		require.NoError(err)
+	}
+	// Duplicates with similar headers but different contents.
+	writeEntry(&tar.Header{Name: "file", Typeflag: tar.TypeReg}, "one!")
+	writeEntry(&tar.Header{Name: "file", Typeflag: tar.TypeReg}, "two!")
+	// A directory replaced by a file.
+	writeEntry(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir}, "")
+	writeEntry(&tar.Header{Name: "dir/child", Typeflag: tar.TypeReg}, "child")
+	writeEntry(&tar.Header{Name: "dir", Typeflag: tar.TypeReg}, "not a dir")
+	// A hard link replaced by a file, and a file replaced by a hard link.
+	writeEntry(&tar.Header{Name: "target", Typeflag: tar.TypeReg}, "target")
+	writeEntry(&tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "target"}, "")
+	writeEntry(&tar.Header{Name: "link", Typeflag: tar.TypeReg}, "regular")
+	writeEntry(&tar.Header{Name: "regular", Typeflag: tar.TypeReg}, "regular")
+	writeEntry(&tar.Header{Name: "regular", Typeflag: tar.TypeLink, Linkname: "target"}, "")
+	require.NoError(w.Close())
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	fs, err := NewMemFS(clock.NewMock(), root, nil, DefaultOptions())
+	require.NoError(err)
+	require.NoError(fs.UpdateFromTarReader(tar.NewReader(bytes.NewReader(b.Bytes())), true))
+
+	for name, expected := range map[string]string{
+		"file":    "two!",
+		"dir":     "not a dir",
+		"link":    "regular",
+		"regular": "target",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(root, name))
+		require.NoError(err)
+		require.Equal(expected, string(content), name)
+	}
+	fi, err := os.Lstat(filepath.Join(root, "link"))
+	require.NoError(err)
+	require.Equal(uint64(1), uint64(fi.Sys().(*syscall.Stat_t).Nlink))
+	fi, err = os.Lstat(filepath.Join(root, "regular"))
+	require.NoError(err)
+	require.Equal(uint64(2), uint64(fi.Sys().(*syscall.Stat_t).Nlink))
+
+	// The memfs has the last entries too.
+	updated, _, err := fs.isUpdated("/dir", &tar.Header{
+		Name: "dir", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime, Size: 9})
+	require.NoError(err)
+	require.False(updated)
+	updated, _, err = fs.isUpdated("/dir/child", &tar.Header{
+		Name: "dir/child", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime, Size: 5})
+	require.NoError(err)
+	require.True(updated)
+}
+
 func TestMemNodeIsOnDisk(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		require := require.New(t)
@@ -170,7 +242,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -197,7 +269,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -224,7 +296,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -251,7 +323,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -270,7 +342,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -311,7 +383,7 @@ func TestUpdateMemFS(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -346,7 +418,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -377,7 +449,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -410,7 +482,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -442,7 +514,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -492,7 +564,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -547,7 +619,7 @@ func TestGetAncestors(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 
 		l1 := newMemLayer()
@@ -578,7 +650,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -610,7 +682,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -647,7 +719,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -683,6 +755,34 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(err)
 		requireEqualLayers(require, l2, l)
 	})
+
+	t.Run("Excludes", func(t *testing.T) {
+		require := require.New(t)
+
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		opts := DefaultOptions()
+		require.NoError(SetLayerExcludes(&opts, []string{".git", "/root/.cache"}))
+
+		clk := clock.NewMock()
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, opts)
+		require.NoError(err)
+		fs.blacklist = nil
+
+		l1 := newMemLayer()
+		require.NoError(addDirectoryToLayer(l1, tmpRoot, "/app", 0755))
+		require.NoError(addRegularFileToLayer(l1, tmpRoot, "/app/main.go", "hello", 0644))
+		require.NoError(addDirectoryToLayer(l1, tmpRoot, "/root", 0755))
+		for _, p := range []string{"/app/.git/HEAD", "/root/.cache/pip/file"} {
+			require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(tmpRoot, p)), 0755))
+			require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, p), []byte("excluded"), 0644))
+		}
+		l, err := fs.createLayerByScan()
+		require.NoError(err)
+		requireEqualLayers(require, l1, l)
+	})
 }
 
 func TestCreateLayerByCopy(t *testing.T) {
@@ -694,7 +794,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -734,7 +834,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -774,7 +874,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -821,7 +921,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -863,7 +963,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -921,7 +1021,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -979,7 +1079,7 @@ func TestCreateLayerByCopy(t *testing.T) {
 		defer os.RemoveAll(tmpRoot)
 
 		clk := clock.NewMock()
-		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 		require.NoError(err)
 		fs.blacklist = nil
 
@@ -1033,6 +1133,58 @@ func TestCreateLayerByCopy(t *testing.T) {
 		require.NotNil(n)
 		require.Equal(tmpRoot+"/test1/test4/test5/test6.txt", n.src)
 	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		require := require.New(t)
+
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		clk := clock.NewMock()
+		fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
+		require.NoError(err)
+		fs.blacklist = nil
+
+		l1 := newMemLayer()
+		dst11 := "/test1"
+		require.NoError(addDirectoryToLayer(l1, tmpRoot, dst11, 0755))
+		dst12 := "/test1/test2"
+		require.NoError(addDirectoryToLayer(l1, tmpRoot, dst12, 0755))
+		dst13 := "/test1/test2/test.txt"
+		require.NoError(addRegularFileToLayer(l1, tmpRoot, dst13, "hello", 0755))
+		require.NoError(fs.merge(l1))
+		require.NoError(os.Symlink("test2", filepath.Join(tmpRoot, "test1", "link")))
+		require.NoError(os.Symlink("nonexistent", filepath.Join(tmpRoot, "test1", "dangling")))
+		require.NoError(os.Symlink("test1", filepath.Join(tmpRoot, "link")))
+
+		srcs := []string{"/link", "/test1/dangling"}
+		srcRoot := tmpRoot
+		workDir := ""
+		dst := "/dst/"
+		c, err := NewCopyOperation(
+			srcs, srcRoot, workDir, dst, validChown, pathutils.DefaultBlacklist, false)
+		require.NoError(err)
+		err = fs.addToLayer(newMemLayer(), c)
+		require.NoError(err)
+
+		n, err := findNode(fs, "/dst/test2/test.txt", false, 0)
+		require.NoError(err)
+		require.NotNil(n)
+		require.Equal(tmpRoot+"/test1/test2/test.txt", n.src)
+
+		n, err = findNode(fs, "/dst/link", false, 0)
+		require.NoError(err)
+		require.NotNil(n)
+		require.Equal(byte(tar.TypeSymlink), n.hdr.Typeflag)
+		require.Equal("test2", n.hdr.Linkname)
+
+		n, err = findNode(fs, "/dst/dangling", false, 0)
+		require.NoError(err)
+		require.NotNil(n)
+		require.Equal(byte(tar.TypeSymlink), n.hdr.Typeflag)
+		require.Equal("nonexistent", n.hdr.Linkname)
+	})
 }
 
 func TestAddLayerByScanWhiteout(t *testing.T) {
@@ -1043,7 +1195,7 @@ func TestAddLayerByScanWhiteout(t *testing.T) {
 	defer os.RemoveAll(tmpRoot)
 
 	clk := clock.NewMock()
-	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 	require.NoError(err)
 	fs.blacklist = nil
 
@@ -1065,7 +1217,7 @@ func TestAddLayerByScanWhiteout(t *testing.T) {
 	tarFile1, err := ioutil.TempFile("/tmp", "makisu-test-1.tar")
 	defer os.Remove(tarFile1.Name())
 	require.NoError(err)
-	w1 := tar.NewWriter(tarFile1)
+	w1 := tario.NewWriter(tarFile1, tario.DefaultOptions())
 	err = fs.AddLayerByScan(w1)
 	require.NoError(err)
 	require.Equal(6, fs.layers[len(fs.layers)-1].count())
@@ -1092,7 +1244,7 @@ func TestAddLayerByScanWhiteout(t *testing.T) {
 	tarFile2, err := ioutil.TempFile("/tmp", "makisu-test-2.tar")
 	defer os.Remove(tarFile2.Name())
 	require.NoError(err)
-	w2 := tar.NewWriter(tarFile2)
+	w2 := tario.NewWriter(tarFile2, tario.DefaultOptions())
 	err = fs.AddLayerByScan(w2)
 	require.NoError(err)
 	require.Equal(1, fs.layers[len(fs.layers)-1].count())
@@ -1123,15 +1275,15 @@ func TestAddLayersEqual(t *testing.T) {
 	defer os.RemoveAll(tmpRoot)
 
 	clk := clock.NewMock()
-	fs1, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	fs1, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 	require.NoError(err)
 	fs1.blacklist = nil
 
-	fs2, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	fs2, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 	require.NoError(err)
 	fs2.blacklist = nil
 
-	fs3, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	fs3, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
 	require.NoError(err)
 	fs3.blacklist = nil
 
@@ -1153,7 +1305,7 @@ func TestAddLayersEqual(t *testing.T) {
 	tarFile1, err := ioutil.TempFile("/tmp", "makisu-test-1.tar")
 	defer os.Remove(tarFile1.Name())
 	require.NoError(err)
-	w1 := tar.NewWriter(tarFile1)
+	w1 := tario.NewWriter(tarFile1, tario.DefaultOptions())
 	srcs := []string{"/test1/test2/test3.txt", "/test1/test4"}
 	srcRoot := tmpRoot
 	workDir := "/wrk"
@@ -1169,7 +1321,7 @@ func TestAddLayersEqual(t *testing.T) {
 	tarFile2, err := ioutil.TempFile("/tmp", "makisu-test-2.tar")
 	defer os.Remove(tarFile2.Name())
 	require.NoError(err)
-	w2 := tar.NewWriter(tarFile2)
+	w2 := tario.NewWriter(tarFile2, tario.DefaultOptions())
 	err = fs2.AddLayerByScan(w2)
 	require.NoError(err)
 	w2.Close()
@@ -1178,7 +1330,7 @@ func TestAddLayersEqual(t *testing.T) {
 	tarFile3, err := ioutil.TempFile("/tmp", "makisu-test-3.tar")
 	defer os.Remove(tarFile3.Name())
 	require.NoError(err)
-	w3 := tar.NewWriter(tarFile3)
+	w3 := tario.NewWriter(tarFile3, tario.DefaultOptions())
 	err = fs3.commitLayer(l, w3)
 	require.NoError(err)
 	w3.Close()
@@ -1194,3 +1346,273 @@ func TestAddLayersEqual(t *testing.T) {
 	require.Equal(b3, b1)
 	require.Equal(b2, b1)
 }
+
+func TestAddLayerByCopyOpsSourceDateEpoch(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+	srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(srcRoot)
+
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "old.txt"), []byte("old"), 0644))
+	require.NoError(os.Chtimes(filepath.Join(srcRoot, "old.txt"), old, old))
+	require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "new.txt"), []byte("new"), 0644))
+
+	epoch := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := DefaultOptions()
+	opts.SourceDateEpoch = epoch
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, opts)
+	require.NoError(err)
+	c, err := NewCopyOperation(
+		[]string{"old.txt", "new.txt"}, srcRoot, "/", "/dst/sub/", "", nil, false)
+	require.NoError(err)
+
+	var b bytes.Buffer
+	w := tario.NewWriter(&b, tario.DefaultOptions())
+	require.NoError(fs.AddLayerByCopyOps([]*CopyOperation{c}, w))
+	require.NoError(w.Close())
+
+	mtimes := make(map[string]time.Time)
+	r := tar.NewReader(&b)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		mtimes[hdr.Name] = hdr.ModTime.UTC()
+	}
+	require.Equal(map[string]time.Time{
+		"dst":             epoch,
+		"dst/sub":         epoch,
+		"dst/sub/old.txt": old,
+		"dst/sub/new.txt": epoch,
+	}, mtimes)
+}
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	require := require.New(t)
+
+	epoch, err := ParseSourceDateEpoch("1262304000")
+	require.NoError(err)
+	require.Equal(time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC), epoch)
+
+	for _, s := range []string{"", "-1", "2010-01-01", "1.5"} {
+		_, err := ParseSourceDateEpoch(s)
+		require.Error(err, s)
+	}
+}
+
+func TestSymlinkLoops(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+	srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(srcRoot)
+	require.NoError(os.Mkdir(filepath.Join(srcRoot, "data"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "data/file"), []byte("file"), 0644))
+
+	clk := clock.NewMock()
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
+	require.NoError(err)
+	fs.blacklist = nil
+
+	// Symlinks created by a step, that loop through each other, themselves or
+	// a parent directory.
+	links := map[string]string{
+		"/loop1":       "loop2",
+		"/loop2":       "loop1",
+		"/self":        "self",
+		"/dir/sub/up":  "..",
+		"/dir/sub/top": "/dir",
+	}
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "dir/sub"), 0755))
+	for p, target := range links {
+		if filepath.IsAbs(target) {
+			target = filepath.Join(tmpRoot, target)
+		}
+		require.NoError(os.Symlink(target, filepath.Join(tmpRoot, p)))
+	}
+
+	l, err := fs.createLayerByScan()
+	require.NoError(err)
+	for p, target := range links {
+		f, ok := l.files[p].(*contentMemFile)
+		require.True(ok, p)
+		require.Equal(byte(tar.TypeSymlink), f.hdr.Typeflag, p)
+		require.Equal(target, f.hdr.Linkname, p)
+	}
+	l, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Equal(0, l.count())
+
+	// Copying through a symlink loop fails without following it forever.
+	c, err := NewCopyOperation([]string{"data"}, srcRoot, "/", "/self/", "", nil, false)
+	require.NoError(err)
+	err = fs.addToLayer(newMemLayer(), c)
+	require.Error(err)
+	require.Contains(err.Error(), errSymlinkLoop.Error())
+	require.True(len(err.Error()) < 512, err.Error())
+
+	// Relative symlinks are resolved from their directory.
+	c, err = NewCopyOperation([]string{"data"}, srcRoot, "/", "/dir/sub/up/sub/top/sub/up/", "", nil, false)
+	require.NoError(err)
+	l = newMemLayer()
+	require.NoError(fs.addToLayer(l, c))
+	require.Contains(l.files, "/dir/file")
+}
+
+func TestAddLayerByCopySymlinkedDestination(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpRoot)
+	srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcRoot)
+	require.NoError(t, os.Mkdir(filepath.Join(srcRoot, "src"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "src/file"), []byte("file"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "single"), []byte("single"), 0644))
+
+	// /app and /rel are links to /data/app, /dangling doesn't have a target
+	// and is replaced like any file.
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpRoot, "data/app"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(tmpRoot, "data/app"), filepath.Join(tmpRoot, "app")))
+	require.NoError(t, os.Symlink("data/app", filepath.Join(tmpRoot, "rel")))
+	require.NoError(t, os.Symlink(filepath.Join(tmpRoot, "missing"), filepath.Join(tmpRoot, "dangling")))
+
+	tests := []struct {
+		desc     string
+		srcs     []string
+		dst      string
+		expected string
+	}{
+		{"dir into link", []string{"src"}, "/app/", "/data/app/file"},
+		{"dir into link without slash", []string{"src"}, "/app", "/data/app/file"},
+		{"dir into relative link", []string{"src"}, "/rel", "/data/app/file"},
+		{"dir into subdir of link", []string{"src"}, "/app/sub/", "/data/app/sub/file"},
+		{"file into link", []string{"single"}, "/app/", "/data/app/single"},
+		{"file into link without slash", []string{"single"}, "/app", "/data/app/single"},
+		{"file onto dangling link", []string{"single"}, "/dangling", "/dangling"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist, DefaultOptions())
+			require.NoError(err)
+			fs.blacklist = nil
+			_, err = fs.createLayerByScan()
+			require.NoError(err)
+
+			c, err := NewCopyOperation(test.srcs, srcRoot, "/", test.dst, "", nil, false)
+			require.NoError(err)
+			l := newMemLayer()
+			require.NoError(fs.addToLayer(l, c))
+			require.Contains(l.files, test.expected)
+			// The links are kept as is.
+			for _, link := range []string{"/app", "/rel"} {
+				if f, ok := l.files[link]; ok {
+					require.Equal(byte(tar.TypeSymlink), f.(*contentMemFile).hdr.Typeflag, link)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateLayerByScanSpecialFiles(t *testing.T) {
+	// createRoot creates a root with a regular file, a fifo, a socket and, if
+	// running as root, a char device.
+	createRoot := func(require *require.Assertions) (string, func()) {
+		root, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		require.NoError(ioutil.WriteFile(filepath.Join(root, "file"), []byte("file"), 0644))
+		require.NoError(syscall.Mkfifo(filepath.Join(root, "fifo"), 0644))
+		l, err := net.Listen("unix", filepath.Join(root, "sock"))
+		require.NoError(err)
+		if os.Geteuid() == 0 {
+			require.NoError(syscall.Mknod(filepath.Join(root, "null"), syscall.S_IFCHR|0666, 1<<8|3))
+		}
+		return root, func() {
+			l.Close()
+			os.RemoveAll(root)
+		}
+	}
+
+	t.Run("Skipped", func(t *testing.T) {
+		require := require.New(t)
+
+		root, cleanup := createRoot(require)
+		defer cleanup()
+
+		fs, err := NewMemFS(clock.NewMock(), root, nil, DefaultOptions())
+		require.NoError(err)
+		l, err := fs.createLayerByScan()
+		require.NoError(err)
+		require.Contains(l.files, "/file")
+		require.NotContains(l.files, "/fifo")
+		require.NotContains(l.files, "/sock")
+		require.NotContains(l.files, "/null")
+	})
+
+	t.Run("Kept", func(t *testing.T) {
+		require := require.New(t)
+
+		opts := DefaultOptions()
+		opts.Tar.KeepSpecialFiles = true
+
+		root, cleanup := createRoot(require)
+		defer cleanup()
+
+		fs, err := NewMemFS(clock.NewMock(), root, nil, opts)
+		require.NoError(err)
+		var b bytes.Buffer
+		w := tario.NewWriter(&b, opts.Tar)
+		require.NoError(fs.AddLayerByScan(w))
+		require.NoError(w.Close())
+
+		headers := make(map[string]*tar.Header)
+		r := tar.NewReader(bytes.NewReader(b.Bytes()))
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			headers[hdr.Name] = hdr
+		}
+		require.Contains(headers, "file")
+		require.Equal(byte(tar.TypeFifo), headers["fifo"].Typeflag)
+		require.NotContains(headers, "sock")
+		if os.Geteuid() == 0 {
+			require.Equal(byte(tar.TypeChar), headers["null"].Typeflag)
+			require.Equal(int64(1), headers["null"].Devmajor)
+			require.Equal(int64(3), headers["null"].Devminor)
+		}
+
+		// The special files are created again when the layer is extracted.
+		target, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(target)
+		targetFS, err := NewMemFS(clock.NewMock(), target, nil, opts)
+		require.NoError(err)
+		require.NoError(targetFS.UpdateFromTarReader(tar.NewReader(bytes.NewReader(b.Bytes())), true))
+		fi, err := os.Lstat(filepath.Join(target, "fifo"))
+		require.NoError(err)
+		require.Equal(os.ModeNamedPipe, fi.Mode()&os.ModeType)
+		if os.Geteuid() == 0 {
+			fi, err := os.Lstat(filepath.Join(target, "null"))
+			require.NoError(err)
+			require.Equal(os.ModeDevice|os.ModeCharDevice, fi.Mode()&os.ModeType)
+		}
+	})
+}
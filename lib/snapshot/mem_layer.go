@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/tario"
 )
@@ -30,7 +31,7 @@ import (
 // memFile represents one file in an in-memory layer.
 type memFile interface {
 	updateMemFS(tree *memFSNode) error
-	commit(w *tar.Writer) error
+	commit(w *tario.Writer, remap *OwnerMapping) error
 }
 
 // contentMemFile represents a MemFile implementation that references on-disk contents.
@@ -54,14 +55,19 @@ func newContentMemFile(src, dst string, hdr *tar.Header) *contentMemFile {
 func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 	parts := pathutils.SplitPath(f.dst)
 	for i, part := range parts {
-		if n, ok := node.children[part]; ok {
+		key := node.key(part)
+		if n, ok := node.children[key]; ok {
 			if i == len(parts)-1 {
-				node.children[part] = newMemFSNode(f)
+				if name := filepath.Base(n.dst); name != part {
+					log.Warnf("%s and %s only differ by case, and are the same file on this filesystem",
+						n.dst, f.dst)
+				}
+				node.children[key] = node.newChild(f)
 
 				if f.hdr.Typeflag == tar.TypeDir {
 					// Copy the children of existing node.
 					for k, child := range n.children {
-						node.children[part].children[k] = child
+						node.children[key].children[k] = child
 					}
 				}
 			} else {
@@ -69,7 +75,7 @@ func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 			}
 		} else {
 			if i == len(parts)-1 {
-				node.children[part] = newMemFSNode(f)
+				node.children[key] = node.newChild(f)
 			} else {
 				return fmt.Errorf("missing intermediate directory %s in %s", part, f.dst)
 			}
@@ -79,8 +85,14 @@ func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 }
 
 // commit writes the contentMemFile's contents to the tar writer.
-func (f *contentMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteEntry(w, f.src, f.hdr); err != nil {
+// The owner is remapped if remap isn't nil. The header in memory keeps the
+// owner on disk, so that later scans don't detect changes.
+func (f *contentMemFile) commit(w *tario.Writer, remap *OwnerMapping) error {
+	hdr := f.hdr
+	if remap != nil {
+		hdr = remap.apply(hdr)
+	}
+	if err := w.WriteEntry(f.src, hdr); err != nil {
 		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
@@ -104,9 +116,9 @@ func newWhiteoutMemFile(deletedPath, whiteoutPath string) *whiteoutMemFile {
 func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
 	parts := pathutils.SplitPath(f.del)
 	for i, part := range parts {
-		if n, ok := node.children[part]; ok {
+		if n, ok := node.children[node.key(part)]; ok {
 			if i == len(parts)-1 {
-				delete(node.children, part)
+				delete(node.children, node.key(part))
 			} else {
 				node = n
 			}
@@ -121,8 +133,8 @@ func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
 }
 
 // commit writes an empty whiteout file to the tar writer.
-func (f *whiteoutMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteHeader(w, f.hdr); err != nil {
+func (f *whiteoutMemFile) commit(w *tario.Writer, remap *OwnerMapping) error {
+	if err := tario.WriteHeader(w.Writer, f.hdr); err != nil {
 		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
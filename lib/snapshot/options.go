@@ -0,0 +1,61 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"time"
+
+	"github.com/uber/makisu/lib/tario"
+)
+
+// Options are the settings of the layers committed by MemFS and of the files
+// written by copy operations, so that builds with different settings can run
+// in the same process.
+type Options struct {
+	// Tar are the options of the tars that layers are written to and
+	// extracted from.
+	Tar tario.Options
+	// OwnerRemap remaps the owners of files in the layers committed by the
+	// build, if it is not nil. Layers of base images are not modified.
+	OwnerRemap *OwnerMapping
+	// SourceDateEpoch clamps the mtimes of the files added to layers by COPY
+	// and ADD, and of the directories created for them, if it is not zero.
+	// Mtimes after it are set to it, like tools honoring $SOURCE_DATE_EPOCH
+	// do. Otherwise copied files keep the mtimes of their sources.
+	SourceDateEpoch time.Time
+	// FailCopyOntoItself makes copy operations fail if a source is the same
+	// file as its destination, which happens with --modifyfs when the build
+	// context is under the root. Otherwise the file is left as is.
+	FailCopyOntoItself bool
+	// FilesystemCase is the case sensitivity of the filesystem that MemFS is
+	// created on.
+	FilesystemCase CaseSensitivity
+	// LayerExcludes are glob patterns of paths that are never added to layers
+	// created by scanning the file system or by copying files, no matter the
+	// Dockerfile. Patterns containing a "/" are matched against absolute
+	// paths in the image, other patterns against base names. Contents of
+	// matching directories are excluded too.
+	LayerExcludes []string
+}
+
+// DefaultOptions returns the options of layers without flags, which keep the
+// owners and mtimes of files, and probe the case sensitivity of the
+// filesystem.
+func DefaultOptions() Options {
+	return Options{
+		Tar:            tario.DefaultOptions(),
+		FilesystemCase: CaseAuto,
+	}
+}
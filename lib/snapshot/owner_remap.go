@@ -0,0 +1,91 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OwnerMapping maps the uids and gids of files written to layers.
+type OwnerMapping struct {
+	// If Size is 0, all files are owned by UID and GID.
+	UID int
+	GID int
+
+	// If Size is not 0, ids in [From, From+Size) are shifted to
+	// [To, To+Size), like user namespace id maps, so that relative
+	// differences between ids are preserved. Other ids are left unchanged.
+	From int
+	To   int
+	Size int
+}
+
+// ParseOwnerMapping parses "<uid>:<gid>" to map all files to the same owner,
+// or "<from>:<to>:<size>" to shift ids in a range.
+func ParseOwnerMapping(s string) (*OwnerMapping, error) {
+	parts := strings.Split(s, ":")
+	ids := make([]int, len(parts))
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid id %q in %s", part, s)
+		}
+		ids[i] = id
+	}
+	switch len(ids) {
+	case 2:
+		return &OwnerMapping{UID: ids[0], GID: ids[1]}, nil
+	case 3:
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid id map %s: size must not be 0", s)
+		}
+		return &OwnerMapping{From: ids[0], To: ids[1], Size: ids[2]}, nil
+	default:
+		return nil, fmt.Errorf("invalid owner mapping %s, expected <uid>:<gid> or <from>:<to>:<size>", s)
+	}
+}
+
+// String returns the mapping in the format parsed by ParseOwnerMapping.
+func (m *OwnerMapping) String() string {
+	if m.Size == 0 {
+		return fmt.Sprintf("%d:%d", m.UID, m.GID)
+	}
+	return fmt.Sprintf("%d:%d:%d", m.From, m.To, m.Size)
+}
+
+// apply returns a copy of the header with its owner remapped.
+func (m *OwnerMapping) apply(hdr *tar.Header) *tar.Header {
+	remapped := *hdr
+	if m.Size == 0 {
+		remapped.Uid, remapped.Gid = m.UID, m.GID
+	} else {
+		remapped.Uid, remapped.Gid = m.mapID(hdr.Uid), m.mapID(hdr.Gid)
+	}
+	if remapped.Uid != hdr.Uid || remapped.Gid != hdr.Gid {
+		// Names of the original owners would not match the new ids.
+		remapped.Uname, remapped.Gname = "", ""
+	}
+	return &remapped
+}
+
+func (m *OwnerMapping) mapID(id int) int {
+	if id >= m.From && id < m.From+m.Size {
+		return id - m.From + m.To
+	}
+	return id
+}
@@ -0,0 +1,90 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/uber/makisu/lib/tario"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOwnerMapping(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected *OwnerMapping
+	}{
+		{"1000:1000", &OwnerMapping{UID: 1000, GID: 1000}},
+		{"0:100000:65536", &OwnerMapping{From: 0, To: 100000, Size: 65536}},
+		{"1000", nil},
+		{"a:b", nil},
+		{"-1:0", nil},
+		{"0:1000:0", nil},
+		{"1:2:3:4", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+			m, err := ParseOwnerMapping(test.input)
+			if test.expected == nil {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.expected, m)
+			require.Equal(test.input, m.String())
+		})
+	}
+}
+
+func TestOwnerMappingApply(t *testing.T) {
+	require := require.New(t)
+
+	hdr := &tar.Header{Name: "file", Uid: 0, Gid: 10, Uname: "root", Gname: "wheel"}
+	flat := &OwnerMapping{UID: 1000, GID: 1001}
+	remapped := flat.apply(hdr)
+	require.Equal(1000, remapped.Uid)
+	require.Equal(1001, remapped.Gid)
+	require.Empty(remapped.Uname)
+	require.Equal(0, hdr.Uid)
+
+	idmap := &OwnerMapping{From: 0, To: 100000, Size: 65536}
+	remapped = idmap.apply(hdr)
+	require.Equal(100000, remapped.Uid)
+	require.Equal(100010, remapped.Gid)
+	remapped = idmap.apply(&tar.Header{Uid: 70000, Gid: 70000})
+	require.Equal(70000, remapped.Uid)
+	require.Equal(70000, remapped.Gid)
+}
+
+func TestCommitWithOwnerRemap(t *testing.T) {
+	require := require.New(t)
+
+	hdr := &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}
+	f := newContentMemFile("", "/dir", hdr)
+	var buf bytes.Buffer
+	w := tario.NewWriter(&buf, tario.DefaultOptions())
+	require.NoError(f.commit(w, &OwnerMapping{UID: 1000, GID: 1000}))
+	require.NoError(w.Close())
+	require.Equal(0, f.hdr.Uid)
+
+	written, err := tar.NewReader(&buf).Next()
+	require.NoError(err)
+	require.Equal(1000, written.Uid)
+	require.Equal(1000, written.Gid)
+}
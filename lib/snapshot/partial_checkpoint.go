@@ -0,0 +1,365 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// ErrPartialCheckpointUnsupported is returned by CheckpointFromLayers when the
+// sources cannot be extracted without unpacking the whole image, e.g. because
+// they contain globs or go through symlinks.
+var ErrPartialCheckpointUnsupported = errors.New("partial checkpoint unsupported")
+
+// LayerOpener opens the uncompressed tar stream of a layer.
+type LayerOpener func() (io.ReadCloser, error)
+
+// extractState is the state of a path of the image, as set by the topmost
+// layer containing it.
+type extractState int
+
+const (
+	stateUnknown extractState = iota
+	// stateImplicitDir is a directory that has entries in upper layers, but
+	// whose own header was not found yet.
+	stateImplicitDir
+	stateDir
+	// stateFile is any entry that is not a directory.
+	stateFile
+	stateDeleted
+)
+
+// partialExtractor extracts sources out of the layers of an image, from the
+// topmost layer down, skipping the entries shadowed by upper layers.
+type partialExtractor struct {
+	fs      *MemFS
+	newRoot string
+	sources []string
+
+	// states of the paths resolved by the layers processed so far.
+	states map[string]extractState
+}
+
+// CheckpointFromLayers has the same result as untarring the layers of an
+// image and calling Checkpoint with newRoot and sources, but only extracts
+// the sources out of the layers. Layers are read lazily from the topmost one
+// down, and reading stops as soon as all the sources that are not directories
+// were found.
+// It returns ErrPartialCheckpointUnsupported if the sources cannot be
+// extracted that way, in which case the caller should fall back to untarring
+// the whole image.
+func (fs *MemFS) CheckpointFromLayers(newRoot string, sources []string, layers []LayerOpener) error {
+	e := &partialExtractor{
+		fs:      fs,
+		newRoot: newRoot,
+		states:  make(map[string]extractState),
+	}
+	for _, src := range sources {
+		if strings.ContainsAny(src, `*?[\`) {
+			return fmt.Errorf("%w: glob in %s", ErrPartialCheckpointUnsupported, src)
+		}
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(fs.tree.src, src)
+		}
+		trimmedSrc, err := pathutils.TrimRoot(src, fs.tree.src)
+		if err != nil {
+			return fmt.Errorf("trim src %s: %s", src, err)
+		}
+		e.sources = append(e.sources, filepath.Join("/", trimmedSrc))
+	}
+
+	log.Infof("* Extracting %v from %d layers to %s", sources, len(layers), newRoot)
+	for i := len(layers) - 1; i >= 0 && !e.done(nil); i-- {
+		if err := e.extractLayer(layers[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, src := range e.sources {
+		if s := e.states[src]; s == stateUnknown || s == stateDeleted || e.hidden(src) {
+			return fmt.Errorf("stat %s: %w", src, os.ErrNotExist)
+		}
+	}
+	return nil
+}
+
+// extractLayer extracts the entries of one layer that are under the sources
+// and not shadowed by upper layers.
+func (e *partialExtractor) extractLayer(open LayerOpener) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open layer: %s", err)
+	}
+	defer r.Close()
+
+	// States set by this layer only apply to lower layers.
+	pending := make(map[string]extractState)
+	written := make(map[string]bool)
+	hardlinks := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for !e.done(pending) {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+
+		p := filepath.Join("/", hdr.Name)
+		base := filepath.Base(p)
+		if strings.HasPrefix(base, _whiteoutMetaPrefix) ||
+			pathutils.IsDescendantOfAny(filepath.Join(e.fs.tree.src, p), e.fs.blacklist) {
+			continue
+		} else if strings.HasPrefix(base, _whiteoutPrefix) {
+			deleted := filepath.Join(filepath.Dir(p), strings.TrimPrefix(base, _whiteoutPrefix))
+			if e.relevant(deleted) && !e.hidden(deleted) && e.states[deleted] == stateUnknown {
+				pending[deleted] = stateDeleted
+			}
+			continue
+		} else if !e.relevant(p) || e.hidden(p) {
+			continue
+		}
+
+		isDir := hdr.Typeflag == tar.TypeDir
+		if s := e.states[p]; s == stateDir || s == stateFile || s == stateDeleted ||
+			(s == stateImplicitDir && !isDir) {
+			continue
+		}
+
+		src := e.sourceOf(p)
+		if src == "" {
+			// Ancestor of a source, which is not extracted itself.
+			if hdr.Typeflag == tar.TypeSymlink {
+				return fmt.Errorf("%w: symlink at %s", ErrPartialCheckpointUnsupported, p)
+			} else if isDir {
+				pending[p] = stateDir
+			} else {
+				pending[p] = stateFile
+			}
+			continue
+		} else if p == src && hdr.Typeflag == tar.TypeSymlink {
+			return fmt.Errorf("%w: symlink at %s", ErrPartialCheckpointUnsupported, p)
+		}
+
+		dst := filepath.Join(e.newRoot, p)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+				return fmt.Errorf("mkdir %s: %s", dst, err)
+			}
+			// Like Checkpoint, only the directories under the sources get
+			// their original modes.
+			if p != src {
+				if err := os.Chmod(dst, hdr.FileInfo().Mode()); err != nil {
+					return fmt.Errorf("chmod %s: %s", dst, err)
+				}
+			}
+			pending[p] = stateDir
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(dst, hdr.FileInfo().Mode(), tr); err != nil {
+				return err
+			}
+			written[p] = true
+			pending[p] = stateFile
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+				return fmt.Errorf("mkdir %s: %s", filepath.Dir(dst), err)
+			}
+			if err := os.Symlink(hdr.Linkname, dst); err != nil {
+				return fmt.Errorf("create symlink %s: %s", dst, err)
+			}
+			pending[p] = stateFile
+		case tar.TypeLink:
+			// Like Checkpoint, hard links are copied as regular files, once
+			// their target was found in the same layer.
+			hardlinks[p] = filepath.Join("/", hdr.Linkname)
+			pending[p] = stateFile
+		default:
+			// Special files are skipped by Checkpoint, but still shadow the
+			// lower layers.
+			pending[p] = stateFile
+		}
+		for dir := filepath.Dir(p); dir != "/"; dir = filepath.Dir(dir) {
+			if e.states[dir] == stateUnknown && pending[dir] == stateUnknown {
+				pending[dir] = stateImplicitDir
+			}
+		}
+	}
+
+	if err := e.copyHardlinks(open, hardlinks, written); err != nil {
+		return err
+	}
+	for p, s := range pending {
+		if current := e.states[p]; current == stateUnknown || current == stateImplicitDir {
+			e.states[p] = s
+		}
+	}
+	return nil
+}
+
+// copyHardlinks writes the content of the targets of hard links found in a
+// layer. Targets that were not extracted are read from the layer again.
+func (e *partialExtractor) copyHardlinks(
+	open LayerOpener, hardlinks map[string]string, written map[string]bool) error {
+
+	missing := make(map[string][]string)
+	for p, target := range hardlinks {
+		if !written[target] {
+			missing[target] = append(missing[target], p)
+			continue
+		}
+		src := filepath.Join(e.newRoot, target)
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("stat %s: %s", src, err)
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("open %s: %s", src, err)
+		}
+		err = writeFile(filepath.Join(e.newRoot, p), fi.Mode(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open layer: %s", err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for len(missing) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+		target := filepath.Join("/", hdr.Name)
+		links, ok := missing[target]
+		if !ok || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+			continue
+		}
+		first := filepath.Join(e.newRoot, links[0])
+		if err := writeFile(first, hdr.FileInfo().Mode(), tr); err != nil {
+			return err
+		}
+		for _, p := range links[1:] {
+			f, err := os.Open(first)
+			if err != nil {
+				return fmt.Errorf("open %s: %s", first, err)
+			}
+			err = writeFile(filepath.Join(e.newRoot, p), hdr.FileInfo().Mode(), f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		delete(missing, target)
+	}
+	for target := range missing {
+		return fmt.Errorf("%w: hard link target %s not found in layer",
+			ErrPartialCheckpointUnsupported, target)
+	}
+	return nil
+}
+
+// done returns true once all sources were found to be files or deleted, in
+// which case lower layers cannot change them anymore.
+func (e *partialExtractor) done(pending map[string]extractState) bool {
+	for _, src := range e.sources {
+		s := e.states[src]
+		if s == stateUnknown || s == stateImplicitDir {
+			s = pending[src]
+		}
+		if s != stateFile && s != stateDeleted {
+			return false
+		}
+	}
+	return true
+}
+
+// relevant returns true if p is a source, under a source, or an ancestor of
+// one.
+func (e *partialExtractor) relevant(p string) bool {
+	for _, src := range e.sources {
+		if pathutils.IsDescendantOfAny(p, []string{src}) || pathutils.IsDescendantOfAny(src, []string{p}) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceOf returns the outermost source that p is or is under, or "" if there
+// is none.
+func (e *partialExtractor) sourceOf(p string) string {
+	var result string
+	for _, src := range e.sources {
+		if pathutils.IsDescendantOfAny(p, []string{src}) && (result == "" || len(src) < len(result)) {
+			result = src
+		}
+	}
+	return result
+}
+
+// hidden returns true if an ancestor of p was replaced by a file or deleted in
+// an upper layer.
+func (e *partialExtractor) hidden(p string) bool {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if s := e.states[dir]; s == stateFile || s == stateDeleted {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// writeFile writes the content of r to the file at path with the given mode,
+// creating its parent directories.
+func writeFile(path string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("mkdir %s: %s", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("open file %s: %s", path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("write file %s: %s", path, utils.CheckOutOfDisk(err, path))
+	}
+	// Set the mode again, as it was masked by umask on creation.
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("chmod %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func dirEntry(name string) testEntry { return testEntry{name: name, typeflag: tar.TypeDir} }
+
+func fileEntry(name, content string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeReg, content: content}
+}
+
+func linkEntry(typeflag byte, name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: typeflag, linkname: linkname}
+}
+
+// tarLayer returns a tar of the entries, which are all modified at mtime.
+func tarLayer(require *require.Assertions, mtime int64, entries ...testEntry) []byte {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			ModTime:  time.Unix(mtime, 0),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0750
+		} else if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		require.NoError(w.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := w.Write([]byte(e.content))
+			require.NoError(err)
+		}
+	}
+	require.NoError(w.Close())
+	return b.Bytes()
+}
+
+// openers returns layer openers for the tars, counting how many times each
+// layer was opened.
+func openers(layers [][]byte, opened []int) []LayerOpener {
+	var result []LayerOpener
+	for i := range layers {
+		i := i
+		result = append(result, func() (io.ReadCloser, error) {
+			opened[i]++
+			return ioutil.NopCloser(bytes.NewReader(layers[i])), nil
+		})
+	}
+	return result
+}
+
+// readTree returns a description of every file under root.
+func readTree(require *require.Assertions, root string) map[string]string {
+	tree := make(map[string]string)
+	require.NoError(filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		require.NoError(err)
+		rel, err := filepath.Rel(root, p)
+		require.NoError(err)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			require.NoError(err)
+			tree[rel] = "symlink " + target
+		case fi.IsDir():
+			tree[rel] = "dir " + fi.Mode().String()
+		default:
+			content, err := ioutil.ReadFile(p)
+			require.NoError(err)
+			tree[rel] = fi.Mode().String() + " " + string(content)
+		}
+		return nil
+	}))
+	return tree
+}
+
+func TestCheckpointFromLayers(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]byte{
+		tarLayer(require, 1,
+			dirEntry("usr/"),
+			dirEntry("usr/lib/"),
+			fileEntry("usr/lib/a.so", "a0"),
+			fileEntry("usr/lib/b.so", "b0"),
+			dirEntry("usr/lib/sub/"),
+			fileEntry("usr/lib/sub/c.so", "c0"),
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config0"),
+			dirEntry("opt/"),
+			dirEntry("opt/app/"),
+			fileEntry("opt/app/bin", "bin0"),
+			linkEntry(tar.TypeLink, "opt/app/link", "opt/app/bin"),
+			linkEntry(tar.TypeSymlink, "opt/app/sym", "bin"),
+			dirEntry("data/"),
+			linkEntry(tar.TypeLink, "data/hl", "etc/config"),
+			dirEntry("other/"),
+			fileEntry("other/file", "other0"),
+		),
+		tarLayer(require, 2,
+			dirEntry("usr/"),
+			dirEntry("usr/lib/"),
+			fileEntry("usr/lib/a.so", "a1"),
+			fileEntry("usr/lib/.wh.b.so", ""),
+			fileEntry("usr/lib/.wh.sub", ""),
+			dirEntry("opt/"),
+			dirEntry("opt/app/"),
+			fileEntry("opt/app/new", "new1"),
+			dirEntry("etc/"),
+			fileEntry("etc/config", "config1"),
+		),
+	}
+	// Sources are relative to the root of the MemFS, which is not / in tests.
+	sources := []string{"usr/lib", "opt/app", "etc/config", "data/hl"}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "root")
+	unpacked := filepath.Join(tmpDir, "unpacked")
+	extracted := filepath.Join(tmpDir, "extracted")
+	require.NoError(os.Mkdir(root, 0755))
+
+	fs, err := NewMemFS(clock.New(), root, nil, DefaultOptions())
+	require.NoError(err)
+
+	// Unpack the image and checkpoint it, as for stages that are built.
+	for _, layer := range layers {
+		require.NoError(fs.UpdateFromTarReader(tar.NewReader(bytes.NewReader(layer)), true))
+	}
+	require.NoError(fs.Checkpoint(unpacked, sources))
+
+	opened := make([]int, len(layers))
+	require.NoError(fs.CheckpointFromLayers(extracted, sources, openers(layers, opened)))
+
+	expected := readTree(require, unpacked)
+	require.Equal(expected, readTree(require, extracted))
+	require.Equal("-rw-r--r-- a1", expected["usr/lib/a.so"])
+	require.NotContains(expected, "usr/lib/b.so")
+	require.NotContains(expected, "usr/lib/sub")
+	require.Equal("-rw-r--r-- bin0", expected["opt/app/link"])
+	require.Equal("-rw-r--r-- config0", expected["data/hl"])
+	require.NotContains(expected, "other")
+	// The hard link to a file outside of the sources needs a second read of
+	// the bottom layer.
+	require.Equal([]int{2, 1}, opened)
+}
+
+func TestCheckpointFromLayersStopsEarly(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]byte{
+		tarLayer(require, 1, dirEntry("bin/"), fileEntry("bin/tool", "old")),
+		tarLayer(require, 2, dirEntry("bin/"), fileEntry("bin/tool", "new"), fileEntry("bin/other", "x")),
+	}
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fs, err := NewMemFS(clock.New(), tmpDir, nil, DefaultOptions())
+	require.NoError(err)
+
+	newRoot := filepath.Join(tmpDir, "new")
+	opened := make([]int, len(layers))
+	require.NoError(fs.CheckpointFromLayers(newRoot, []string{"bin/tool"}, openers(layers, opened)))
+	require.Equal([]int{0, 1}, opened)
+	tree := readTree(require, newRoot)
+	require.Equal("-rw-r--r-- new", tree["bin/tool"])
+	require.NotContains(tree, "bin/other")
+}
+
+func TestCheckpointFromLayersErrors(t *testing.T) {
+	tests := []struct {
+		desc        string
+		layer       []testEntry
+		source      string
+		unsupported bool
+	}{
+		{"glob", []testEntry{fileEntry("a.so", "")}, "*.so", true},
+		{"symlinked parent", []testEntry{
+			linkEntry(tar.TypeSymlink, "lib", "usr/lib"),
+			dirEntry("usr/"),
+			dirEntry("usr/lib/"),
+			fileEntry("usr/lib/a.so", ""),
+		}, "lib/a.so", true},
+		{"symlink source", []testEntry{
+			dirEntry("usr/"),
+			linkEntry(tar.TypeSymlink, "usr/lib", "lib64"),
+		}, "usr/lib", true},
+		{"missing", []testEntry{fileEntry("a.so", "")}, "b.so", false},
+		{"deleted", []testEntry{fileEntry(".wh.a.so", "")}, "a.so", false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			tmpDir, err := ioutil.TempDir("", "")
+			require.NoError(err)
+			defer os.RemoveAll(tmpDir)
+
+			fs, err := NewMemFS(clock.New(), tmpDir, nil, DefaultOptions())
+			require.NoError(err)
+
+			layers := [][]byte{tarLayer(require, 1, test.layer...)}
+			err = fs.CheckpointFromLayers(
+				filepath.Join(tmpDir, "new"), []string{test.source}, openers(layers, []int{0}))
+			require.Error(err)
+			require.Equal(test.unsupported, errors.Is(err, ErrPartialCheckpointUnsupported))
+		})
+	}
+}
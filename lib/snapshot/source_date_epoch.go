@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ParseSourceDateEpoch parses a SOURCE_DATE_EPOCH value, in seconds since the
+// unix epoch.
+func ParseSourceDateEpoch(s string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid source date epoch %q", s)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// clampModTime returns t, or SourceDateEpoch if it is set and earlier.
+func (o Options) clampModTime(t time.Time) time.Time {
+	if !o.SourceDateEpoch.IsZero() && t.After(o.SourceDateEpoch) {
+		return o.SourceDateEpoch
+	}
+	return t
+}
@@ -220,7 +220,7 @@ func findNode(fs *MemFS, p string, followSymlink bool, depth int) (*memFSNode, e
 	curr := fs.tree
 	parts := strings.Split(strings.Trim(p, "/"), "/")
 	for i, part := range parts {
-		if n, ok := curr.children[part]; ok {
+		if n, ok := curr.children[curr.key(part)]; ok {
 			if followSymlink && n.hdr.Typeflag == tar.TypeSymlink {
 				unresolved := filepath.Join(parts[i+1:]...)
 				return findNode(fs, filepath.Join(n.hdr.Linkname, unresolved), true, depth+1)
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/mountutils"
 	"github.com/uber/makisu/lib/pathutils"
@@ -32,15 +33,15 @@ import (
 )
 
 // shouldSkip returns true if the path is a descendent of any path in the blacklist,
-// a special file, or a mount point.
-func shouldSkip(path string, fi os.FileInfo, blacklist []string) (bool, error) {
+// a special file that isn't kept by opts, or a mount point.
+func shouldSkip(path string, fi os.FileInfo, blacklist []string, opts tario.Options) (bool, error) {
 	if strings.HasPrefix(filepath.Base(path), _whiteoutMetaPrefix) {
 		// If it's a AUFS metadata file or dir, simply ignore.
 		// TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
 		// Taking the simplest solution for now, but this is preventing us from
 		// deduping hardlinks.
 		return true, nil
-	} else if pathutils.IsDescendantOfAny(path, blacklist) || (fi != nil && utils.IsSpecialFile(fi)) {
+	} else if pathutils.IsDescendantOfAny(path, blacklist) || isSkippedSpecialFile(fi, opts) {
 		return true, nil
 	} else if isMountpoint, err := mountutils.IsMountpoint(path); err != nil {
 		return false, fmt.Errorf("check mount point: %s", err)
@@ -50,20 +51,51 @@ func shouldSkip(path string, fi os.FileInfo, blacklist []string) (bool, error) {
 	return false, nil
 }
 
-func walk(srcRoot string, blacklist []string, f func(string, os.FileInfo) error) error {
+// isSkippedSpecialFile returns true for sockets, and for device nodes and
+// named pipes unless the KeepSpecialFiles of opts is true. They are never read.
+func isSkippedSpecialFile(fi os.FileInfo, opts tario.Options) bool {
+	return fi != nil && utils.IsSpecialFile(fi) && !opts.IsKeptSpecialFile(fi)
+}
+
+// dirID identifies a directory by device and inode.
+type dirID struct {
+	dev uint64
+	ino uint64
+}
+
+// walk calls f for srcRoot and all the files under it that shouldn't be
+// skipped. Symlinks are not followed. Directories that were already visited,
+// e.g. through a bind mount that isn't detected as a mount point, are skipped
+// so that cycles don't make the walk loop forever.
+func walk(srcRoot string, blacklist []string, opts tario.Options, f func(string, os.FileInfo) error) error {
+	visited := make(map[dirID]bool)
 	if err := filepath.Walk(srcRoot, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("starting walk %s: %s", p, err)
-		} else if skip, err := shouldSkip(p, fi, blacklist); err != nil {
+		} else if skip, err := shouldSkip(p, fi, blacklist, opts); err != nil {
 			return fmt.Errorf("check should skip: %s", err)
 		} else if skip {
 			if fi.IsDir() {
 				return filepath.SkipDir
+			} else if isSkippedSpecialFile(fi, opts) {
+				log.Warnf("Skipping special file %s", p)
 			}
 			return nil
 		}
 
-		if err := f(p, fi); err != nil {
+		if fi.IsDir() {
+			stat := utils.FileInfoStat(fi)
+			id := dirID{uint64(stat.Dev), uint64(stat.Ino)}
+			if visited[id] {
+				log.Warnf("Skipping directory %s, which was already visited", p)
+				return filepath.SkipDir
+			}
+			visited[id] = true
+		}
+
+		if err := f(p, fi); err == filepath.SkipDir {
+			return err
+		} else if err != nil {
 			return fmt.Errorf("applying f to %s: %s", p, err)
 		}
 		return nil
@@ -76,8 +108,8 @@ func walk(srcRoot string, blacklist []string, f func(string, os.FileInfo) error)
 // removePathRecursive attempts to recursively remove everything under the given path,
 // excluding paths specified by the blacklist. Returns true if it succeeds in removing
 // everything under the path.
-func removePathRecursive(p string, fi os.FileInfo, blacklist []string) bool {
-	if skip, err := shouldSkip(p, fi, blacklist); err != nil {
+func removePathRecursive(p string, fi os.FileInfo, blacklist []string, opts tario.Options) bool {
+	if skip, err := shouldSkip(p, fi, blacklist, opts); err != nil {
 		log.Errorf("failed to check if should skip %s: %s", p, err)
 		return false
 	} else if skip {
@@ -102,7 +134,7 @@ func removePathRecursive(p string, fi os.FileInfo, blacklist []string) bool {
 		return false
 	}
 	for _, fi := range children {
-		if !removePathRecursive(filepath.Join(p, fi.Name()), fi, blacklist) {
+		if !removePathRecursive(filepath.Join(p, fi.Name()), fi, blacklist, opts) {
 			anyFailed = true
 		}
 	}
@@ -118,13 +150,13 @@ func removePathRecursive(p string, fi os.FileInfo, blacklist []string) bool {
 
 // removeAllChildren recursively removes all of the files that it can under the given root.
 // It skips paths in the given blacklist and continues when it fails to remove a file.
-func removeAllChildren(srcRoot string, blacklist []string) error {
+func removeAllChildren(srcRoot string, blacklist []string, opts tario.Options) error {
 	children, err := ioutil.ReadDir(srcRoot)
 	if err != nil {
 		return fmt.Errorf("failed to get children of %s: %s", srcRoot, err)
 	}
 	for _, child := range children {
-		removePathRecursive(filepath.Join(srcRoot, child.Name()), child, blacklist)
+		removePathRecursive(filepath.Join(srcRoot, child.Name()), child, blacklist, opts)
 	}
 	return nil
 }
@@ -149,7 +181,7 @@ func resolveSymlink(p string, fi os.FileInfo) (bool, string, error) {
 }
 
 // CreateTarFromDirectory creates a tar archive containing the contents of the given
-// directory. It also compresses the contents with given compression level.
+// directory. It also compresses the contents with the default compression level.
 func CreateTarFromDirectory(target, dir string) error {
 	file, err := os.Create(target)
 	if err != nil {
@@ -158,7 +190,7 @@ func CreateTarFromDirectory(target, dir string) error {
 	defer file.Close()
 
 	var tw *tar.Writer
-	gw, err := tario.NewGzipWriter(file)
+	gw, err := tario.NewGzipWriter(file, tario.DefaultOptions())
 	if err != nil {
 		return fmt.Errorf("new gzip writer: %s", err)
 	}
@@ -224,7 +256,7 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 
 	// Copy file content for regular files only.
 	if fi.Mode().IsRegular() {
-		f, err := os.Open(p)
+		f, err := fileio.Open(p)
 		if err != nil {
 			return fmt.Errorf("open f: %s", err)
 		}
@@ -236,86 +268,97 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 	return nil
 }
 
-// evalSymlinks returns the path name after the evaluation of any symbolic links.
-// When actually operating on files, joins their absolute paths to srcRoot. This
-// function assumes that the path passed corresponds to a file that exists and that
-// is a symlink.
-//
-// This function and the below helpers are minimally modified from the
-// filepath.EvalSymlinks source at: https://golang.org/src/path/filepath/symlink.go
+// evalSymlinks returns the path name, relative to srcRoot, after the evaluation
+// of any symbolic links. Evaluation is scoped to srcRoot, similar to Docker's
+// FollowSymlinkInScope: ".." never goes above srcRoot and absolute link targets
+// are resolved against srcRoot, so the result never points outside of it.
+// If the last element of the path is a dangling symlink, the path of the link
+// itself is returned, so that the link gets copied as is.
 func evalSymlinks(p, srcRoot string) (string, error) {
 	if p == "" {
 		return p, nil
 	}
-	var linksWalked int // to protect against cycles
-	for {
-		i := linksWalked
-		newpath, err := walkLinks(p, srcRoot, &linksWalked)
-		if err != nil {
-			return "", err
-		}
-		if i == linksWalked {
-			return pathutils.AbsPath(newpath), nil
-		}
-		p = newpath
+	p = pathutils.AbsPath(filepath.Clean(p))
+	if p == "/" {
+		return p, nil
 	}
-}
 
-func walkLink(path, root string, linksWalked *int) (newpath string, islink bool, err error) {
-	if *linksWalked > 255 {
-		return "", false, errors.New("eval symlinks: too many links")
+	var linksWalked int // to protect against cycles
+	dir, err := walkLinks(filepath.Dir(p), srcRoot, &linksWalked)
+	if err != nil {
+		return "", fmt.Errorf("walk links: %s", err)
 	}
-	fi, err := os.Lstat(filepath.Join(root, path))
+	last := filepath.Join(dir, filepath.Base(p))
+	resolved, err := walkLinks(last, srcRoot, &linksWalked)
 	if err != nil {
-		return "", false, fmt.Errorf("lstat: %s", err)
+		return "", fmt.Errorf("walk links: %s", err)
 	}
-	if fi.Mode()&os.ModeSymlink == 0 {
-		return path, false, nil
+	if _, err := os.Lstat(filepath.Join(srcRoot, resolved)); os.IsNotExist(err) {
+		return last, nil
 	}
-	newpath, err = os.Readlink(filepath.Join(root, path))
+	return resolved, nil
+}
+
+// ResolvePathInRoot returns the absolute path p, relative to root, after the
+// evaluation of the symbolic links of all of its elements, scoped to root like
+// evalSymlinks. Elements that don't exist, including the targets of dangling
+// links, are kept as is.
+func ResolvePathInRoot(p, root string) (string, error) {
+	var linksWalked int
+	resolved, err := walkLinks(pathutils.AbsPath(filepath.Clean(p)), root, &linksWalked)
 	if err != nil {
-		return "", false, err
-	} else if !filepath.HasPrefix(newpath, root) && filepath.IsAbs(newpath) {
-		return "", false, fmt.Errorf("link points outside of root: %s -> %s", filepath.Join(root, path), newpath)
+		return "", fmt.Errorf("walk links: %s", err)
 	}
-	*linksWalked++
-	newpath = strings.TrimPrefix(newpath, root)
-	return newpath, true, nil
+	return resolved, nil
 }
 
-func walkLinks(path, root string, linksWalked *int) (string, error) {
-	switch dir, file := filepath.Split(path); {
-	case dir == "":
-		newpath, _, err := walkLink(file, root, linksWalked)
-		if err != nil {
-			return newpath, fmt.Errorf("walk link: %s", err)
+// walkLinks resolves every element of the absolute path p within root.
+// Once an element does not exist, the remaining elements are appended as is.
+func walkLinks(p, root string, linksWalked *int) (string, error) {
+	resolved := "/"
+	unresolved := p
+	for unresolved != "" {
+		var elem string
+		if i := strings.IndexByte(unresolved, '/'); i >= 0 {
+			elem, unresolved = unresolved[:i], unresolved[i+1:]
+		} else {
+			elem, unresolved = unresolved, ""
 		}
-		return newpath, nil
-	case file == "":
-		if os.IsPathSeparator(dir[len(dir)-1]) {
-			if strings.TrimRight(dir, "/") == strings.TrimRight(root, "/") {
-				return dir, nil
-			}
-			return walkLinks(dir[:len(dir)-1], root, linksWalked)
+		if elem == "" || elem == "." {
+			continue
+		} else if elem == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
 		}
-		// TODO(pourchet): confirm unreachable code?
-		newpath, _, err := walkLink(dir, root, linksWalked)
-		return newpath, err
-	default:
-		newdir, err := walkLinks(dir, root, linksWalked)
-		if err != nil {
-			return "", err
+
+		next := filepath.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			return filepath.Join(next, unresolved), nil
+		} else if err != nil {
+			return "", fmt.Errorf("lstat: %s", err)
+		} else if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
 		}
-		newpath, islink, err := walkLink(filepath.Join(newdir, file), root, linksWalked)
-		if err != nil {
-			return "", fmt.Errorf("walk link: %s", err)
+
+		*linksWalked++
+		if *linksWalked > 255 {
+			return "", errors.New("too many links")
 		}
-		if !islink {
-			return newpath, nil
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("readlink: %s", err)
 		}
-		if filepath.IsAbs(newpath) || os.IsPathSeparator(newpath[0]) {
-			return newpath, nil
+		if filepath.IsAbs(target) {
+			// Links might have been created with the absolute path of root.
+			if rel, err := filepath.Rel(root, target); err == nil && root != "/" &&
+				rel != ".." && !strings.HasPrefix(rel, "../") {
+				target = rel
+			}
+			resolved = "/"
 		}
-		return filepath.Join(newdir, newpath), nil
+		unresolved = target + "/" + unresolved
 	}
+	return resolved, nil
 }
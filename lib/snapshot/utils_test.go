@@ -20,6 +20,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/uber/makisu/lib/tario"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -144,6 +146,65 @@ func TestEvalSymlink(t *testing.T) {
 		require.NoError(err)
 		require.Equal("/dir1/tmp1", path)
 	})
+
+	t.Run("symlink_to_dir", func(t *testing.T) {
+		require := require.New(t)
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "dir1", "dir2"), os.ModePerm))
+		require.NoError(os.Symlink("dir1/dir2", filepath.Join(tmpRoot, "link1")))
+		require.NoError(os.Symlink("../link1", filepath.Join(tmpRoot, "dir1", "link2")))
+
+		path, err := evalSymlinks("link1/", tmpRoot)
+		require.NoError(err)
+		require.Equal("/dir1/dir2", path)
+		path, err = evalSymlinks(filepath.Join("dir1", "link2"), tmpRoot)
+		require.NoError(err)
+		require.Equal("/dir1/dir2", path)
+	})
+
+	t.Run("dangling", func(t *testing.T) {
+		require := require.New(t)
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		require.NoError(os.Mkdir(filepath.Join(tmpRoot, "dir1"), os.ModePerm))
+		require.NoError(os.Symlink("nonexistent", filepath.Join(tmpRoot, "dir1", "link1")))
+		require.NoError(os.Symlink("dir1/link1", filepath.Join(tmpRoot, "link2")))
+
+		path, err := evalSymlinks(filepath.Join("dir1", "link1"), tmpRoot)
+		require.NoError(err)
+		require.Equal("/dir1/link1", path)
+		path, err = evalSymlinks("link2", tmpRoot)
+		require.NoError(err)
+		require.Equal("/link2", path)
+	})
+
+	t.Run("scoped_to_root", func(t *testing.T) {
+		require := require.New(t)
+		tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(tmpRoot)
+
+		require.NoError(os.Mkdir(filepath.Join(tmpRoot, "etc"), os.ModePerm))
+		_, err = os.Create(filepath.Join(tmpRoot, "etc", "passwd"))
+		require.NoError(err)
+		require.NoError(os.Symlink("../../../etc", filepath.Join(tmpRoot, "link1")))
+		require.NoError(os.Symlink("/etc", filepath.Join(tmpRoot, "link2")))
+
+		path, err := evalSymlinks(filepath.Join("link1", "passwd"), tmpRoot)
+		require.NoError(err)
+		require.Equal("/etc/passwd", path)
+		path, err = evalSymlinks(filepath.Join("link2", "passwd"), tmpRoot)
+		require.NoError(err)
+		require.Equal("/etc/passwd", path)
+		path, err = evalSymlinks(filepath.Join("..", "..", "etc", "passwd"), tmpRoot)
+		require.NoError(err)
+		require.Equal("/etc/passwd", path)
+	})
 }
 
 func TestRemoveAll(t *testing.T) {
@@ -172,7 +233,7 @@ func TestRemoveAll(t *testing.T) {
 	tmp4, err := ioutil.TempFile(dir2, "test4")
 	require.NoError(err)
 
-	require.NoError(removeAllChildren(tmpRoot, []string{dir2}))
+	require.NoError(removeAllChildren(tmpRoot, []string{dir2}, tario.DefaultOptions()))
 
 	_, err = os.Lstat(tmp1.Name())
 	require.True(os.IsNotExist(err))
@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 
 	"github.com/uber/makisu/lib/storage/metadata"
 	"github.com/uber/makisu/lib/utils/stringset"
@@ -281,7 +283,7 @@ func (entry *localFileEntry) MoveFrom(targetState FileState, sourcePath string)
 	}
 
 	// Move data.
-	return os.Rename(sourcePath, targetPath)
+	return rename(sourcePath, targetPath)
 }
 
 // Move moves file to target dir under the same name, moves all metadata that's `movable`, and
@@ -320,7 +322,7 @@ func (entry *localFileEntry) Move(targetState FileState) error {
 	}
 
 	// Move data. This could be a slow operation if source and target are not on the same FS.
-	if err := os.Rename(sourcePath, targetPath); err != nil {
+	if err := rename(sourcePath, targetPath); err != nil {
 		return err
 	}
 
@@ -535,3 +537,42 @@ func compareAndWriteFile(filePath string, b []byte) (bool, error) {
 	}
 	return true, nil
 }
+
+// rename renames sourcePath to targetPath. If they are not on the same FS, it
+// falls back to copying the data into a temp file next to targetPath, which
+// is then renamed.
+func rename(sourcePath, targetPath string) error {
+	err := os.Rename(sourcePath, targetPath)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(targetPath), filepath.Base(targetPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, source); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), targetPath); err != nil {
+		return err
+	}
+	return os.Remove(sourcePath)
+}
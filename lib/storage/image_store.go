@@ -19,19 +19,57 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/uber/makisu/lib/fileio"
+)
+
+// DefaultLockTimeout is the maximum time spent waiting for a lock on the
+// store held by another process.
+var DefaultLockTimeout = 10 * time.Minute
+
+// DedupMode configures which of the files copied to the sandbox dir, like the
+// checkpoints of stages, share a single copy per content.
+type DedupMode string
+
+const (
+	// DedupNone copies every file.
+	DedupNone DedupMode = "none"
+	// DedupContent shares the copies of files with identical non-empty
+	// contents.
+	DedupContent DedupMode = "content"
+	// DedupAll also shares the copies of empty files.
+	DedupAll DedupMode = "all"
 )
 
+// FileDedup is the dedup mode of the files of new image stores.
+var FileDedup = DedupNone
+
+const fileBlobsDir = "file_blobs"
+
 // ImageStore contains a manifeststore, a layertarstore, and a sandbox dir.
 type ImageStore struct {
 	RootDir    string
 	SandboxDir string
 	Manifests  *ManifestStore
 	Layers     *LayerTarStore
+
+	// FileBlobs content-addresses the files copied to the sandbox dir. It is
+	// nil if FileDedup is DedupNone.
+	FileBlobs *fileio.BlobStore
 }
 
 // NewImageStore creates a new ImageStore.
 func NewImageStore(rootDir string) (*ImageStore, error) {
-	sandboxParent := filepath.Join(rootDir, "sandbox")
+	return NewImageStoreWithTmpDir(rootDir, rootDir)
+}
+
+// NewImageStoreWithTmpDir creates a new ImageStore, which uses tmpDir instead
+// of rootDir for the sandbox dir.
+// tmpDir can be on a different filesystem, at the cost of copying files
+// committed to the store instead of renaming them.
+func NewImageStoreWithTmpDir(rootDir, tmpDir string) (*ImageStore, error) {
+	sandboxParent := filepath.Join(tmpDir, "sandbox")
 	if err := os.MkdirAll(sandboxParent, 0755); err != nil {
 		return nil, fmt.Errorf("init sandbox parent dir: %s", err)
 	}
@@ -49,15 +87,42 @@ func NewImageStore(rootDir string) (*ImageStore, error) {
 		return nil, fmt.Errorf("init layer store: %s", err)
 	}
 
+	var blobs *fileio.BlobStore
+	if FileDedup != DedupNone {
+		blobs, err = fileio.NewBlobStore(
+			filepath.Join(sandboxDir, fileBlobsDir), FileDedup == DedupAll)
+		if err != nil {
+			return nil, fmt.Errorf("init file blob store: %s", err)
+		}
+	}
+
 	return &ImageStore{
 		RootDir:    rootDir,
 		SandboxDir: sandboxDir,
 		Manifests:  m,
 		Layers:     l,
+		FileBlobs:  blobs,
 	}, nil
 }
 
+// NewFileLock returns a lock with the given name, shared by all the processes
+// using the same store root dir. It should be held while writing to the store
+// files that could be written concurrently by other builds.
+func (s *ImageStore) NewFileLock(name string) *fileio.FileLock {
+	return fileio.NewFileLock(filepath.Join(s.RootDir, "locks", name+".lock"))
+}
+
+// CleanupSandbox removes the sandbox dir of this store only, leaving alone the
+// ones of other builds sharing the same storage dir.
+func (s *ImageStore) CleanupSandbox() error {
+	if err := os.RemoveAll(s.SandboxDir); err != nil {
+		return fmt.Errorf("remove sandbox %s: %s", s.SandboxDir, err)
+	}
+	return nil
+}
+
 // CleanupSandbox removes sandbox dir. This should be done after every build.
+// rootDir is the tmpDir if the store was created with NewImageStoreWithTmpDir.
 func CleanupSandbox(rootDir string) error {
 	sandboxParent := filepath.Join(rootDir, "sandbox")
 	if err := os.RemoveAll(sandboxParent); err != nil {
@@ -65,3 +130,16 @@ func CleanupSandbox(rootDir string) error {
 	}
 	return nil
 }
+
+// listFiles returns the names of the entries of a store directory.
+func listFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir %s: %s", dir, err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
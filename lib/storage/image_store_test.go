@@ -0,0 +1,53 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewImageStoreWithTmpDir(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	tmpDir, err := ioutil.TempDir("/tmp", "makisu-test-tmp")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewImageStoreWithTmpDir(root, tmpDir)
+	require.NoError(err)
+	require.Equal(root, store.RootDir)
+	require.Equal(filepath.Join(tmpDir, "sandbox"), filepath.Dir(store.SandboxDir))
+
+	tmpFile := filepath.Join(store.SandboxDir, "layer")
+	require.NoError(ioutil.WriteFile(tmpFile, []byte("content"), 0644))
+	require.NoError(store.Layers.LinkStoreFileFrom("layer", tmpFile))
+	r, err := store.Layers.GetStoreFileReader("layer")
+	require.NoError(err)
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal("content", string(content))
+
+	require.NoError(CleanupSandbox(tmpDir))
+	_, err = os.Stat(store.SandboxDir)
+	require.True(os.IsNotExist(err))
+}
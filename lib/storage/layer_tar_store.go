@@ -100,6 +100,11 @@ func (s *LayerTarStore) GetDownloadFileReadWriter(fileName string) (base.FileRea
 	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileReadWriter(fileName)
 }
 
+// DeleteDownloadFile deletes a file from download directory.
+func (s *LayerTarStore) DeleteDownloadFile(fileName string) error {
+	return s.backend.NewFileOp().AcceptState(s.downloadState).DeleteFile(fileName)
+}
+
 // MoveDownloadFileToStore moves a file from store directory to cache directory.
 func (s *LayerTarStore) MoveDownloadFileToStore(fileName string) error {
 	return s.backend.NewFileOp().AcceptState(s.downloadState).MoveFile(fileName, s.cacheState)
@@ -135,3 +140,8 @@ func (s *LayerTarStore) DeleteStoreFile(fileName string) error {
 func (s *LayerTarStore) LinkStoreFileTo(fileName, target string) error {
 	return s.backend.NewFileOp().AcceptState(s.cacheState).LinkFileTo(fileName, target)
 }
+
+// ListStoreFiles returns the names of the files in store directory.
+func (s *LayerTarStore) ListStoreFiles() ([]string, error) {
+	return listFiles(s.cacheState.GetDirectory())
+}
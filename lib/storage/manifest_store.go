@@ -121,6 +121,12 @@ func (s *ManifestStore) GetDownloadFileReadWriter(repo, tag string) (base.FileRe
 	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileReadWriter(fileName)
 }
 
+// DeleteDownloadFile deletes a file from download directory.
+func (s *ManifestStore) DeleteDownloadFile(repo, tag string) error {
+	fileName := encodeRepoTag(repo, tag)
+	return s.backend.NewFileOp().AcceptState(s.downloadState).DeleteFile(fileName)
+}
+
 // MoveDownloadFileToStore moves a file from store directory to cache directory.
 func (s *ManifestStore) MoveDownloadFileToStore(repo, tag string) error {
 	fileName := encodeRepoTag(repo, tag)
@@ -164,3 +170,25 @@ func (s *ManifestStore) LinkStoreFileTo(repo, tag, target string) error {
 	fileName := encodeRepoTag(repo, tag)
 	return s.backend.NewFileOp().AcceptState(s.cacheState).LinkFileTo(fileName, target)
 }
+
+// ReadStoreFiles returns the contents of all the files in store directory.
+func (s *ManifestStore) ReadStoreFiles() ([][]byte, error) {
+	names, err := listFiles(s.cacheState.GetDirectory())
+	if err != nil {
+		return nil, err
+	}
+	var contents [][]byte
+	for _, name := range names {
+		reader, err := s.backend.NewFileOp().AcceptState(s.cacheState).GetFileReader(name)
+		if err != nil {
+			return nil, fmt.Errorf("get reader of %s: %s", name, err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %s", name, err)
+		}
+		contents = append(contents, content)
+	}
+	return contents, nil
+}
@@ -18,6 +18,8 @@ import (
 	"archive/tar"
 	"fmt"
 	"os"
+
+	"github.com/uber/makisu/lib/utils"
 )
 
 // ApplyHeader updates file owner, mtime, and permission bits according to
@@ -35,7 +37,7 @@ func ApplyHeader(path string, header *tar.Header) error {
 	// Change the owner, mode and mtime of path.
 	// Note: Chmod needs to be called after chown, otherwise setuid and setgid
 	// bits could be unset.
-	if err := os.Chown(path, header.Uid, header.Gid); err != nil {
+	if err := utils.Chown(path, header.Uid, header.Gid); err != nil {
 		return fmt.Errorf("chown %s: %s", path, err)
 	}
 	if err := os.Chmod(path, header.FileInfo().Mode()); err != nil {
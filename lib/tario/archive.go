@@ -0,0 +1,228 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/utils"
+)
+
+var (
+	_gzipMagic  = []byte{0x1f, 0x8b, 0x08}
+	_bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	_xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// NewDecompressReader returns a reader of the decompressed content of r.
+// Gzip, bzip2, xz and zstd are detected by their magic bytes, other content is
+// read as is. Xz relies on the xz binary, like docker does.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(_xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read magic bytes: %s", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, _gzipMagic):
+		return NewGzipReader(br)
+	case bytes.HasPrefix(magic, _bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, _xzMagic):
+		return newXZReader(br)
+	case bytes.HasPrefix(magic, _zstdMagic):
+		return NewZstdReader(br)
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// xzReader reads the output of an xz process decompressing its input.
+type xzReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func newXZReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "-d", "-c", "-q")
+	cmd.Stdin = r
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("pipe xz output: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start xz: %s", err)
+	}
+	return &xzReader{stdout, cmd, stderr}, nil
+}
+
+// Close waits for the xz process to exit. The output is drained first, so xz
+// isn't left blocked writing to the pipe.
+func (r *xzReader) Close() error {
+	io.Copy(ioutil.Discard, r.ReadCloser)
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("xz: %s: %s", err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
+
+// IsArchive returns true if the file at path is a tar archive, possibly
+// compressed with gzip, bzip2 or xz.
+func IsArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	r, err := NewDecompressReader(f)
+	if err != nil {
+		return false, nil
+	}
+	defer r.Close()
+	_, err = tar.NewReader(r).Next()
+	return err == nil, nil
+}
+
+// Untar extracts the tar archive read from r into dir, which must exist.
+// Permissions and mtimes are preserved, while files are owned by the current
+// user. Entries can't be written outside of dir, including through symlinks.
+// Special files, like devices, are skipped. Holes of sparse files are kept if
+// sparse is true.
+func Untar(r io.Reader, dir string, sparse bool) error {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("eval symlinks %s: %s", dir, err)
+	}
+
+	// Mtimes of dirs are set at the end, since adding entries updates them.
+	var dirs []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read tar header: %s", err)
+		}
+		path := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if path == dir {
+			continue
+		}
+		if err := checkUntarParent(dir, path); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+				os.Remove(path)
+			}
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return fmt.Errorf("mkdir %s: %s", path, err)
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := untarFile(tr, path, hdr, sparse); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return fmt.Errorf("symlink %s: %s", path, err)
+			}
+			continue
+		case tar.TypeLink:
+			target := filepath.Join(dir, filepath.Clean("/"+hdr.Linkname))
+			if err := checkUntarParent(dir, target); err != nil {
+				return err
+			}
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				return fmt.Errorf("link %s: %s", path, err)
+			}
+			continue
+		default:
+			continue
+		}
+		if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("chmod %s: %s", path, err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, filepath.Clean("/"+dirs[i].Name))
+		if err := os.Chtimes(path, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return fmt.Errorf("chtimes %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// checkUntarParent returns an error if the parent dir of path resolves outside
+// of dir, and creates it otherwise. Only the existing part of the parent dir is
+// resolved, since the missing part can't contain symlinks.
+func checkUntarParent(dir, path string) error {
+	parent := filepath.Dir(path)
+	existing := parent
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("lstat %s: %s", existing, err)
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("eval symlinks %s: %s", existing, err)
+	}
+	if resolved != dir && !strings.HasPrefix(resolved, dir+"/") {
+		return fmt.Errorf("tar entry %s is outside of %s", path, dir)
+	}
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return fmt.Errorf("mkdir %s: %s", parent, err)
+	}
+	return nil
+}
+
+func untarFile(r io.Reader, path string, hdr *tar.Header, sparse bool) error {
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", path, err)
+	}
+	defer f.Close()
+	if _, err := CopyFileContent(f, r, sparse); err != nil {
+		return fmt.Errorf("write %s: %s", path, utils.CheckOutOfDisk(err, path))
+	}
+	if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+		return fmt.Errorf("chtimes %s: %s", path, err)
+	}
+	return nil
+}
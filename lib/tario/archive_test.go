@@ -0,0 +1,179 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func writeTestTar(t *testing.T, entries []testTarEntry) []byte {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, w.WriteHeader(&hdr))
+		_, err := w.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressWith(t *testing.T, name string, data []byte) []byte {
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not found", name)
+	}
+	cmd := exec.Command(name, "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return out
+}
+
+func TestIsArchive(t *testing.T) {
+	tarData := writeTestTar(t, []testTarEntry{
+		{tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}, "hello"},
+	})
+	gzipped := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipped)
+	_, err := gw.Write(tarData)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	gzippedText := new(bytes.Buffer)
+	gw = gzip.NewWriter(gzippedText)
+	_, err = gw.Write([]byte("not a tar"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	tests := []struct {
+		desc     string
+		data     func(t *testing.T) []byte
+		expected bool
+	}{
+		{"tar", func(t *testing.T) []byte { return tarData }, true},
+		{"gzip", func(t *testing.T) []byte { return gzipped.Bytes() }, true},
+		{"bzip2", func(t *testing.T) []byte { return compressWith(t, "bzip2", tarData) }, true},
+		{"xz", func(t *testing.T) []byte { return compressWith(t, "xz", tarData) }, true},
+		{"text", func(t *testing.T) []byte { return []byte("not a tar") }, false},
+		{"empty", func(t *testing.T) []byte { return nil }, false},
+		{"gzipped text", func(t *testing.T) []byte { return gzippedText.Bytes() }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "archive")
+			require.NoError(ioutil.WriteFile(path, test.data(t), 0644))
+			ok, err := IsArchive(path)
+			require.NoError(err)
+			require.Equal(test.expected, ok)
+		})
+	}
+}
+
+func TestUntar(t *testing.T) {
+	t.Run("Entries", func(t *testing.T) {
+		require := require.New(t)
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		mtime := time.Unix(1500000000, 0)
+		data := writeTestTar(t, []testTarEntry{
+			{tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime}, ""},
+			{tar.Header{Name: "a/b/c.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime}, "echo"},
+			{tar.Header{Name: "./d", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, "d"},
+			{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "a/b/c.sh"}, ""},
+			{tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "d"}, ""},
+		})
+		r, err := NewDecompressReader(bytes.NewReader(data))
+		require.NoError(err)
+		require.NoError(Untar(r, dir, true))
+
+		fi, err := os.Stat(filepath.Join(dir, "a"))
+		require.NoError(err)
+		require.True(fi.IsDir())
+		require.Equal(os.FileMode(0700), fi.Mode().Perm())
+		require.True(mtime.Equal(fi.ModTime()))
+
+		fi, err = os.Stat(filepath.Join(dir, "a/b/c.sh"))
+		require.NoError(err)
+		require.Equal(os.FileMode(0755), fi.Mode().Perm())
+		require.True(mtime.Equal(fi.ModTime()))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "a/b/c.sh"))
+		require.NoError(err)
+		require.Equal("echo", string(content))
+
+		target, err := os.Readlink(filepath.Join(dir, "link"))
+		require.NoError(err)
+		require.Equal("a/b/c.sh", target)
+
+		content, err = ioutil.ReadFile(filepath.Join(dir, "hard"))
+		require.NoError(err)
+		require.Equal("d", string(content))
+	})
+
+	t.Run("PathTraversal", func(t *testing.T) {
+		require := require.New(t)
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		require.NoError(os.Mkdir(filepath.Join(dir, "root"), 0755))
+		data := writeTestTar(t, []testTarEntry{
+			{tar.Header{Name: "../../escaped", Typeflag: tar.TypeReg, Mode: 0644}, "x"},
+		})
+		require.NoError(Untar(bytes.NewReader(data), filepath.Join(dir, "root"), true))
+		_, err = os.Stat(filepath.Join(dir, "escaped"))
+		require.True(os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(dir, "root", "escaped"))
+		require.NoError(err)
+	})
+
+	t.Run("SymlinkTraversal", func(t *testing.T) {
+		require := require.New(t)
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		require.NoError(os.Mkdir(filepath.Join(dir, "root"), 0755))
+		data := writeTestTar(t, []testTarEntry{
+			{tar.Header{Name: "out", Typeflag: tar.TypeSymlink, Linkname: ".."}, ""},
+			{tar.Header{Name: "out/escaped", Typeflag: tar.TypeReg, Mode: 0644}, "x"},
+		})
+		require.Error(Untar(bytes.NewReader(data), filepath.Join(dir, "root"), true))
+		_, err = os.Stat(filepath.Join(dir, "escaped"))
+		require.True(os.IsNotExist(err))
+	})
+}
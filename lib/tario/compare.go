@@ -18,6 +18,8 @@ import (
 	"archive/tar"
 	"fmt"
 	"time"
+
+	"github.com/uber/makisu/lib/utils"
 )
 
 // IsSimilarHeader returns if the given headers are describing similar entries.
@@ -40,6 +42,8 @@ func IsSimilarHeader(h *tar.Header, nh *tar.Header) (bool, error) {
 		return isSimilarDirectory(h, nh)
 	case tar.TypeReg, tar.TypeRegA:
 		return isSimilarRegularFile(h, nh)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return isSimilarSpecialFile(h, nh)
 	default:
 		return false, fmt.Errorf("unsupported type %b", h.Typeflag)
 	}
@@ -58,8 +62,7 @@ func isSimilarHardLink(h *tar.Header, nh *tar.Header) (bool, error) {
 	nhMtime := nh.ModTime.Truncate(1 * time.Second)
 	if hMtime.Equal(nhMtime) &&
 		h.Linkname == nh.Linkname &&
-		h.Uid == nh.Uid &&
-		h.Gid == nh.Gid &&
+		isSimilarOwner(h, nh) &&
 		h.Mode == nh.Mode {
 		return true, nil
 	}
@@ -72,8 +75,7 @@ func isSimilarDirectory(h *tar.Header, nh *tar.Header) (bool, error) {
 	hMtime := h.ModTime.Truncate(1 * time.Second)
 	nhMtime := nh.ModTime.Truncate(1 * time.Second)
 	if hMtime.Equal(nhMtime) &&
-		h.Uid == nh.Uid &&
-		h.Gid == nh.Gid &&
+		isSimilarOwner(h, nh) &&
 		h.Mode == nh.Mode {
 		return true, nil
 	}
@@ -86,11 +88,25 @@ func isSimilarRegularFile(h *tar.Header, nh *tar.Header) (bool, error) {
 	hMtime := h.ModTime.Truncate(1 * time.Second)
 	nhMtime := nh.ModTime.Truncate(1 * time.Second)
 	if hMtime.Equal(nhMtime) &&
-		h.Uid == nh.Uid &&
-		h.Gid == nh.Gid &&
+		isSimilarOwner(h, nh) &&
 		h.Size == nh.Size &&
 		h.Mode == nh.Mode {
 		return true, nil
 	}
 	return false, nil
 }
+
+// isSimilarSpecialFile returns if the given headers are describing similar
+// device nodes or named pipes. It checks mtime, owner, mode and device numbers.
+func isSimilarSpecialFile(h *tar.Header, nh *tar.Header) (bool, error) {
+	if h.Devmajor != nh.Devmajor || h.Devminor != nh.Devminor {
+		return false, nil
+	}
+	return isSimilarDirectory(h, nh)
+}
+
+// isSimilarOwner returns if the given headers have the same owner. Owners are
+// not applied on disk in rootless mode, so they are not compared either.
+func isSimilarOwner(h *tar.Header, nh *tar.Header) bool {
+	return utils.Rootless || (h.Uid == nh.Uid && h.Gid == nh.Gid)
+}
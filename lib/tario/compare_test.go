@@ -22,6 +22,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/uber/makisu/lib/utils"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -643,4 +645,56 @@ func TestIsSimilarRegularFile(t *testing.T) {
 		require.False(similar)
 		require.NoError(err)
 	})
+	t.Run("OwnersIgnoredWhenRootless", func(t *testing.T) {
+		require := require.New(t)
+
+		mtime := time.Now()
+		h := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Uid: 0}
+		newH := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Uid: 1000}
+		similar, err := IsSimilarHeader(h, newH)
+		require.NoError(err)
+		require.False(similar)
+
+		utils.Rootless = true
+		defer func() { utils.Rootless = false }()
+		similar, err = IsSimilarHeader(h, newH)
+		require.NoError(err)
+		require.True(similar)
+	})
+}
+
+func TestIsSimilarSpecialFile(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	device := func(typeflag byte, major, minor int64) *tar.Header {
+		return &tar.Header{
+			Name:     "dev/special",
+			Typeflag: typeflag,
+			Mode:     0644,
+			Devmajor: major,
+			Devminor: minor,
+			ModTime:  mtime,
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		h       *tar.Header
+		newH    *tar.Header
+		similar bool
+	}{
+		{"SameFifo", device(tar.TypeFifo, 0, 0), device(tar.TypeFifo, 0, 0), true},
+		{"SameCharDevice", device(tar.TypeChar, 1, 3), device(tar.TypeChar, 1, 3), true},
+		{"DifferentMinor", device(tar.TypeChar, 1, 3), device(tar.TypeChar, 1, 5), false},
+		{"DifferentMajor", device(tar.TypeBlock, 7, 0), device(tar.TypeBlock, 8, 0), false},
+		{"DifferentType", device(tar.TypeBlock, 1, 3), device(tar.TypeChar, 1, 3), false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			similar, err := IsSimilarHeader(test.h, test.newH)
+			require.NoError(err)
+			require.Equal(test.similar, similar)
+		})
+	}
 }
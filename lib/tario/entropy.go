@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	_entropySampleSize     = 4 << 10
+	_entropySampleInterval = 64 << 10
+)
+
+// SetIncompressibleEntropy sets the IncompressibleEntropy of opts after
+// checking that it is a valid entropy.
+func SetIncompressibleEntropy(opts *Options, entropy float64) error {
+	if entropy < 0 || entropy > 8 {
+		return fmt.Errorf("invalid entropy %v, must be between 0 and 8 bits per byte", entropy)
+	}
+	opts.IncompressibleEntropy = entropy
+	return nil
+}
+
+// EntropySampler is a writer that estimates the entropy of the bytes written to
+// it from the first 4KB of every 64KB, which is much cheaper than compressing
+// them to find out whether they are compressible. Already compressed content,
+// like videos or zip files, is close to 8 bits per byte, while text and
+// binaries are usually under 6.
+type EntropySampler struct {
+	counts  [256]int64
+	sampled int64
+	offset  int64
+}
+
+// Write counts the bytes of p that are part of a sample.
+func (s *EntropySampler) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		pos := s.offset % _entropySampleInterval
+		skip := pos >= _entropySampleSize
+		end := _entropySampleSize - pos
+		if skip {
+			end = _entropySampleInterval - pos
+		}
+		if int64(len(p)) < end {
+			end = int64(len(p))
+		}
+		if !skip {
+			for _, b := range p[:end] {
+				s.counts[b]++
+			}
+			s.sampled += end
+		}
+		p = p[end:]
+		s.offset += end
+	}
+	return n, nil
+}
+
+// Entropy returns the Shannon entropy of the sampled bytes, in bits per byte.
+func (s *EntropySampler) Entropy() float64 {
+	if s.sampled == 0 {
+		return 0
+	}
+	var entropy float64
+	for _, count := range s.counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(s.sampled)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
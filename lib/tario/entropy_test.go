@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntropySampler(t *testing.T) {
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(random)
+	uniform := make([]byte, 1<<20)
+	for i := range uniform {
+		uniform[i] = byte(i % 256)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		min     float64
+		max     float64
+		sampled int64
+	}{
+		{"empty", nil, 0, 0, 0},
+		{"zeros", make([]byte, 1<<20), 0, 0, 16 * _entropySampleSize},
+		{"text", bytes.Repeat([]byte("hello world\n"), 100000), 3, 3.5, 19 * _entropySampleSize},
+		{"uniform", uniform, 8, 8, 16 * _entropySampleSize},
+		{"random", random, 7.9, 8, 16 * _entropySampleSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require := require.New(t)
+
+			// Write in uneven chunks, so that samples span several writes.
+			s := &EntropySampler{}
+			for data := test.data; len(data) > 0; {
+				n := 1000
+				if len(data) < n {
+					n = len(data)
+				}
+				written, err := s.Write(data[:n])
+				require.NoError(err)
+				require.Equal(n, written)
+				data = data[n:]
+			}
+			require.InDelta((test.min+test.max)/2, s.Entropy(), (test.max-test.min)/2+1e-9)
+			require.Equal(test.sampled, s.sampled)
+		})
+	}
+}
+
+func TestSetIncompressibleEntropy(t *testing.T) {
+	require := require.New(t)
+
+	opts := DefaultOptions()
+	require.NoError(SetIncompressibleEntropy(&opts, 7.5))
+	require.Equal(7.5, opts.IncompressibleEntropy)
+	require.Error(SetIncompressibleEntropy(&opts, -1))
+	require.Error(SetIncompressibleEntropy(&opts, 8.5))
+	require.Equal(7.5, opts.IncompressibleEntropy)
+}
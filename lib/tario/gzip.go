@@ -15,16 +15,15 @@
 package tario
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/klauspost/pgzip"
 )
 
-// CompressionLevel is the compression level of image layers.
-// Default is pgzip.DefaultCompression.
-var CompressionLevel = pgzip.DefaultCompression
-
 var _compressionLevelMap = map[string]int{
 	"no":      pgzip.NoCompression,
 	"speed":   pgzip.BestSpeed,
@@ -32,22 +31,42 @@ var _compressionLevelMap = map[string]int{
 	"default": pgzip.DefaultCompression,
 }
 
-// SetCompressionLevel sets global var CompressionLevel.
-func SetCompressionLevel(compressionLevelStr string) error {
+// SetCompressionLevel sets the CompressionLevel of opts to the level named
+// no, speed, size or default.
+func SetCompressionLevel(opts *Options, compressionLevelStr string) error {
 	level, ok := _compressionLevelMap[compressionLevelStr]
 	if !ok {
 		return fmt.Errorf("invalid compression level %s", compressionLevelStr)
 	}
-	CompressionLevel = level
+	opts.CompressionLevel = level
 	return nil
 }
 
-// NewGzipWriter returns a new gzip writer with compression level.
-func NewGzipWriter(w io.Writer) (io.WriteCloser, error) {
-	return pgzip.NewWriterLevel(w, CompressionLevel)
+// NewGzipWriter returns a new gzip writer with the compression level of opts.
+func NewGzipWriter(w io.Writer, opts Options) (io.WriteCloser, error) {
+	return pgzip.NewWriterLevel(w, opts.CompressionLevel)
 }
 
 // NewGzipReader returns a new gzip reader.
 func NewGzipReader(r io.Reader) (io.ReadCloser, error) {
 	return pgzip.NewReader(r)
 }
+
+// NewLayerReader returns a reader of the tar of a layer, which is gzipped
+// unless it was stored uncompressed because its content is incompressible, or
+// converted to zstd.
+func NewLayerReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(_zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read magic bytes: %s", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, _gzipMagic):
+		return NewGzipReader(br)
+	case bytes.HasPrefix(magic, _zstdMagic):
+		return NewZstdReader(br)
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
@@ -15,13 +15,74 @@
 package tario
 
 import (
+	"bytes"
+	"io/ioutil"
 	"testing"
 
+	"github.com/klauspost/pgzip"
 	"github.com/stretchr/testify/require"
 )
 
-func TestSetCompressionLevelFail(t *testing.T) {
+func TestSetCompressionLevel(t *testing.T) {
 	require := require.New(t)
 
-	require.Error(SetCompressionLevel("invalid"))
+	opts := DefaultOptions()
+	require.Error(SetCompressionLevel(&opts, "invalid"))
+	require.NoError(SetCompressionLevel(&opts, "speed"))
+	require.Equal(pgzip.BestSpeed, opts.CompressionLevel)
+}
+
+func TestNewLayerReader(t *testing.T) {
+	content := []byte("tar content")
+
+	t.Run("gzipped", func(t *testing.T) {
+		require := require.New(t)
+
+		var buf bytes.Buffer
+		w, err := NewGzipWriter(&buf, DefaultOptions())
+		require.NoError(err)
+		_, err = w.Write(content)
+		require.NoError(err)
+		require.NoError(w.Close())
+
+		r, err := NewLayerReader(&buf)
+		require.NoError(err)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(content, result)
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		require := require.New(t)
+
+		var buf bytes.Buffer
+		w, err := NewZstdWriter(&buf, DefaultOptions())
+		require.NoError(err)
+		_, err = w.Write(content)
+		require.NoError(err)
+		require.NoError(w.Close())
+
+		ok, err := IsZstd(bytes.NewReader(buf.Bytes()))
+		require.NoError(err)
+		require.True(ok)
+
+		r, err := NewLayerReader(&buf)
+		require.NoError(err)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(content, result)
+	})
+
+	t.Run("uncompressed", func(t *testing.T) {
+		require := require.New(t)
+
+		r, err := NewLayerReader(bytes.NewReader(content))
+		require.NoError(err)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(content, result)
+	})
 }
@@ -0,0 +1,55 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"github.com/klauspost/pgzip"
+)
+
+// Options are the settings of the tars of the layers of a build, so that
+// builds with different settings can write layers in the same process.
+type Options struct {
+	// CompressionLevel is the compression level of image layers, one of the
+	// levels of pgzip. Zstd layers use the zstd level closest to it.
+	CompressionLevel int
+	// IncompressibleEntropy is the entropy, in bits per byte, from which
+	// layers are stored as plain tars instead of being gzipped. 0 means
+	// layers are always gzipped.
+	IncompressibleEntropy float64
+	// SparseFiles controls whether holes of sparse files are preserved, by
+	// writing them as GNU PAX 1.0 sparse entries and by skipping blocks of
+	// zeros when extracting files.
+	SparseFiles bool
+	// BlockingFactor is the number of 512-byte blocks per record of the tars
+	// written by Writer. Archives are padded with zeros to a whole number of
+	// records on Close. 1, like docker, only adds the two zero blocks marking
+	// the end of the archive; GNU tar uses 20.
+	BlockingFactor int
+	// KeepSpecialFiles controls whether device nodes and named pipes are
+	// written to layers as tar entries, with the major and minor numbers of
+	// devices, and created again when layers are extracted, instead of being
+	// skipped. Sockets can't be stored in tars and are always skipped.
+	KeepSpecialFiles bool
+}
+
+// DefaultOptions returns the options of layers without flags, which are
+// gzipped at the default level and keep the holes of sparse files.
+func DefaultOptions() Options {
+	return Options{
+		CompressionLevel: pgzip.DefaultCompression,
+		SparseFiles:      true,
+		BlockingFactor:   1,
+	}
+}
@@ -0,0 +1,291 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/uber/makisu/lib/utils"
+)
+
+const (
+	_blockSize = 512
+
+	// _maxSparseMapSize is the largest sparse map accepted by archive/tar.
+	_maxSparseMapSize = 1 << 20
+
+	// _sparseZeroBlockSize is the size of the zero blocks turned into holes
+	// when files are extracted.
+	_sparseZeroBlockSize = 4096
+)
+
+// sparseEntry is a data region of a sparse file.
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// sparseRegions returns the data regions of the first size bytes of f, or nil
+// if f has no holes or the filesystem can't report them.
+func sparseRegions(f *os.File, fi os.FileInfo, size int64) ([]sparseEntry, error) {
+	// Files using as many blocks as their size can't have holes.
+	if size == 0 || utils.FileInfoStat(fi).Blocks*_blockSize >= size {
+		return nil, nil
+	}
+
+	var regions []sparseEntry
+	var covered int64
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, _seekData)
+		if isSeekError(err, syscall.ENXIO) {
+			break // A hole up to the end of the file.
+		} else if err != nil {
+			// SEEK_DATA is not supported by the filesystem.
+			return nil, nil
+		} else if data >= size {
+			break
+		}
+		hole, err := f.Seek(data, _seekHole)
+		if err != nil {
+			return nil, nil
+		}
+		if hole > size {
+			hole = size
+		}
+		regions = append(regions, sparseEntry{data, hole - data})
+		covered += hole - data
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek to start: %s", err)
+	}
+	if covered == size {
+		return nil, nil
+	}
+	// Like GNU tar, end the map with an empty region at the real size so that
+	// trailing holes are kept.
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < size {
+		regions = append(regions, sparseEntry{size, 0})
+	}
+	return regions, nil
+}
+
+func isSeekError(err error, errno syscall.Errno) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == errno
+}
+
+// encodeSparseMap encodes regions as the map that precedes the data of a PAX
+// 1.0 sparse entry, padded to a whole number of blocks.
+func encodeSparseMap(regions []sparseEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d\n", len(regions))
+	for _, r := range regions {
+		fmt.Fprintf(&b, "%d\n%d\n", r.offset, r.length)
+	}
+	if pad := b.Len() % _blockSize; pad != 0 {
+		b.Write(make([]byte, _blockSize-pad))
+	}
+	return b.Bytes()
+}
+
+// formatPAXRecord formats a record of a PAX extended header, whose length
+// prefix includes itself.
+func formatPAXRecord(k, v string) string {
+	const padding = 3 // Extra padding for ' ', '=', and '\n'
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	// Final adjustment if adding size field increased the record size.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// sparseHeaderName returns the name of a header preceding or replacing the
+// header of name, in the dir GNU tar uses for them.
+func sparseHeaderName(dir, name string) string {
+	n := dir + "/" + path.Base(name)
+	if len(n) > 100 {
+		n = n[:100]
+	}
+	return n
+}
+
+// formatUSTARHeader returns the block of h encoded as USTAR by archive/tar.
+func formatUSTARHeader(h *tar.Header) ([]byte, error) {
+	var b bytes.Buffer
+	h.Format = tar.FormatUSTAR
+	if err := tar.NewWriter(&b).WriteHeader(h); err != nil {
+		return nil, err
+	}
+	return b.Bytes()[:_blockSize], nil
+}
+
+// setTypeflag changes the type of a header block and updates its checksum.
+func setTypeflag(blk []byte, typeflag byte) {
+	blk[156] = typeflag
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+// writeSparseEntry writes the file at src as a GNU PAX 1.0 sparse entry
+// directly to w, which must be the writer under tw. It returns false without
+// writing anything if the file has no holes or h can't be encoded this way.
+func writeSparseEntry(tw *tar.Writer, w io.Writer, f *os.File, h *tar.Header) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat: %s", err)
+	}
+	if len(h.Xattrs) > 0 || len(h.PAXRecords) > 0 {
+		return false, nil
+	}
+	regions, err := sparseRegions(f, fi, h.Size)
+	if err != nil || regions == nil {
+		return false, err
+	}
+	sparseMap := encodeSparseMap(regions)
+	if len(sparseMap) > _maxSparseMapSize {
+		return false, nil
+	}
+	var dataSize int64
+	for _, r := range regions {
+		dataSize += r.length
+	}
+
+	var records bytes.Buffer
+	records.WriteString(formatPAXRecord("GNU.sparse.major", "1"))
+	records.WriteString(formatPAXRecord("GNU.sparse.minor", "0"))
+	records.WriteString(formatPAXRecord("GNU.sparse.name", h.Name))
+	records.WriteString(formatPAXRecord("GNU.sparse.realsize", strconv.FormatInt(h.Size, 10)))
+	recordsSize := int64(records.Len())
+	if pad := records.Len() % _blockSize; pad != 0 {
+		records.Write(make([]byte, _blockSize-pad))
+	}
+
+	paxHdr, err := formatUSTARHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     sparseHeaderName("PaxHeaders.0", h.Name),
+		Mode:     0644,
+		Size:     recordsSize,
+		ModTime:  h.ModTime,
+	})
+	if err != nil {
+		return false, nil
+	}
+	setTypeflag(paxHdr, tar.TypeXHeader)
+
+	sparseHdr := *h
+	sparseHdr.Typeflag = tar.TypeReg
+	sparseHdr.Name = sparseHeaderName("GNUSparseFile.0", h.Name)
+	sparseHdr.Size = int64(len(sparseMap)) + dataSize
+	sparseHdr.AccessTime = time.Time{}
+	sparseHdr.ChangeTime = time.Time{}
+	mainHdr, err := formatUSTARHeader(&sparseHdr)
+	if err != nil {
+		// Headers that need PAX records of their own are written in full.
+		return false, nil
+	}
+
+	// Pad the previous entry before writing past the tar writer.
+	if err := tw.Flush(); err != nil {
+		return false, fmt.Errorf("flush tar writer: %s", err)
+	}
+	for _, b := range [][]byte{paxHdr, records.Bytes(), mainHdr, sparseMap} {
+		if _, err := w.Write(b); err != nil {
+			return false, fmt.Errorf("write sparse header: %s", err)
+		}
+	}
+	for _, r := range regions {
+		if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+			return false, fmt.Errorf("seek to %d: %s", r.offset, err)
+		}
+		if _, err := io.CopyN(w, f, r.length); err != nil {
+			return false, fmt.Errorf("copy data at %d: %s", r.offset, err)
+		}
+	}
+	if pad := dataSize % _blockSize; pad != 0 {
+		if _, err := w.Write(make([]byte, _blockSize-pad)); err != nil {
+			return false, fmt.Errorf("write padding: %s", err)
+		}
+	}
+	return true, nil
+}
+
+// copySparse copies r to f like io.Copy, but seeks over blocks of zeros
+// instead of writing them, so that they become holes of f.
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, _sparseZeroBlockSize)
+	var written int64
+	var skipped bool
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZeros(buf[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return written, err
+				}
+				skipped = true
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return written, err
+		}
+	}
+	if skipped {
+		// Seeking past the end doesn't extend the file.
+		if err := f.Truncate(written); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CopyFileContent copies r to f, keeping blocks of zeros as holes if sparse is
+// true.
+func CopyFileContent(f *os.File, r io.Reader, sparse bool) (int64, error) {
+	if !sparse {
+		return io.Copy(f, r)
+	}
+	return copySparse(f, r)
+}
+
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// createSparseFile creates a file of 4MiB with two small data regions, and
+// skips the test if the filesystem doesn't support holes.
+func createSparseFile(t *testing.T, path string) []byte {
+	require := require.New(t)
+
+	f, err := os.Create(path)
+	require.NoError(err)
+	defer f.Close()
+	require.NoError(f.Truncate(4 << 20))
+	_, err = f.WriteAt([]byte("head"), 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("middle"), 2<<20)
+	require.NoError(err)
+
+	fi, err := f.Stat()
+	require.NoError(err)
+	if utils.FileInfoStat(fi).Blocks*512 >= fi.Size() {
+		t.Skip("filesystem doesn't support sparse files")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	return content
+}
+
+func TestWriterWriteEntrySparse(t *testing.T) {
+	tests := []struct {
+		desc        string
+		sparseFiles bool
+	}{
+		{"sparse", true},
+		{"dense", false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			opts := DefaultOptions()
+			opts.SparseFiles = test.sparseFiles
+
+			tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+			require.NoError(err)
+			defer os.RemoveAll(tmpRoot)
+
+			src := filepath.Join(tmpRoot, "db")
+			content := createSparseFile(t, src)
+			fi, err := os.Lstat(src)
+			require.NoError(err)
+			h, err := tar.FileInfoHeader(fi, "")
+			require.NoError(err)
+			h.Name = "/var/lib/db"
+
+			var b bytes.Buffer
+			w := NewWriter(&b, opts)
+			require.NoError(w.WriteEntry(src, h))
+			require.NoError(WriteHeader(w.Writer, &tar.Header{
+				Name: "next", Typeflag: tar.TypeReg, Mode: 0644}))
+			require.NoError(w.Close())
+
+			if test.sparseFiles {
+				require.True(b.Len() < 64<<10)
+			} else {
+				require.True(b.Len() > 4<<20)
+			}
+
+			r := tar.NewReader(&b)
+			hdr, err := r.Next()
+			require.NoError(err)
+			require.Equal("var/lib/db", hdr.Name)
+			require.Equal(int64(4<<20), hdr.Size)
+			require.Equal(h.Mode, hdr.Mode)
+			data, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.True(bytes.Equal(content, data))
+
+			hdr, err = r.Next()
+			require.NoError(err)
+			require.Equal("next", hdr.Name)
+		})
+	}
+}
+
+func TestWriterWriteEntrySparseGNUTar(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+	outRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(outRoot)
+
+	src := filepath.Join(tmpRoot, "db")
+	content := createSparseFile(t, src)
+	fi, err := os.Lstat(src)
+	require.NoError(err)
+	h, err := tar.FileInfoHeader(fi, "")
+	require.NoError(err)
+
+	tarFile, err := ioutil.TempFile(tmpRoot, "test.tar")
+	require.NoError(err)
+	w := NewWriter(tarFile, DefaultOptions())
+	require.NoError(w.WriteEntry(src, h))
+	require.NoError(w.Close())
+
+	require.NoError(untarHelper(tarFile.Name(), outRoot))
+	data, err := ioutil.ReadFile(filepath.Join(outRoot, "db"))
+	require.NoError(err)
+	require.True(bytes.Equal(content, data))
+}
+
+func TestCopyFileContentSparse(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	src := filepath.Join(tmpRoot, "src")
+	content := createSparseFile(t, src)
+
+	f, err := os.Create(filepath.Join(tmpRoot, "dst"))
+	require.NoError(err)
+	defer f.Close()
+	n, err := CopyFileContent(f, bytes.NewReader(content), true)
+	require.NoError(err)
+	require.Equal(int64(len(content)), n)
+
+	fi, err := f.Stat()
+	require.NoError(err)
+	require.Equal(int64(len(content)), fi.Size())
+	require.True(utils.FileInfoStat(fi).Blocks*512 < fi.Size())
+	data, err := ioutil.ReadFile(f.Name())
+	require.NoError(err)
+	require.True(bytes.Equal(content, data))
+}
+
+func TestCopyFileContentTrailingZeros(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	content := append([]byte("data"), make([]byte, 3*_sparseZeroBlockSize)...)
+	f, err := os.Create(filepath.Join(tmpRoot, "dst"))
+	require.NoError(err)
+	defer f.Close()
+	_, err = CopyFileContent(f, bytes.NewReader(content), true)
+	require.NoError(err)
+
+	data, err := ioutil.ReadFile(f.Name())
+	require.NoError(err)
+	require.True(bytes.Equal(content, data))
+}
@@ -0,0 +1,61 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/uber/makisu/lib/utils"
+)
+
+// IsKeptSpecialFile returns true if fi is a device node or a named pipe and
+// KeepSpecialFiles is true.
+func (o Options) IsKeptSpecialFile(fi os.FileInfo) bool {
+	return o.KeepSpecialFiles && utils.IsSpecialFile(fi) && fi.Mode()&os.ModeSocket == 0
+}
+
+// IsSpecialHeader returns true if h describes a device node or a named pipe,
+// which only consist of a header.
+func IsSpecialHeader(h *tar.Header) bool {
+	switch h.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// MakeSpecialFile creates the device node or named pipe described by the
+// header at path, and applies the metadata of the header. Creating devices
+// requires root.
+func MakeSpecialFile(path string, h *tar.Header) error {
+	mode := uint32(h.Mode & 07777)
+	switch h.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	default:
+		return fmt.Errorf("not a special file: %s", h.Name)
+	}
+	if err := syscall.Mknod(path, mode, mkdev(h.Devmajor, h.Devminor)); err != nil {
+		return fmt.Errorf("mknod %s: %s", path, err)
+	}
+	return ApplyHeader(path, h)
+}
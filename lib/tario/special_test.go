@@ -0,0 +1,133 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeSpecialFile(t *testing.T) {
+	tests := []struct {
+		desc     string
+		typeflag byte
+		mode     os.FileMode
+		major    int64
+		minor    int64
+		root     bool
+	}{
+		{"fifo", tar.TypeFifo, os.ModeNamedPipe, 0, 0, false},
+		{"char device", tar.TypeChar, os.ModeDevice | os.ModeCharDevice, 1, 3, true},
+		{"block device", tar.TypeBlock, os.ModeDevice, 7, 300, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			if test.root && os.Geteuid() != 0 {
+				t.Skip("creating devices requires root")
+			}
+
+			dir, err := ioutil.TempDir("/tmp", "makisu-test")
+			require.NoError(err)
+			defer os.RemoveAll(dir)
+
+			mtime := time.Unix(1500000000, 0)
+			p := filepath.Join(dir, "special")
+			require.NoError(MakeSpecialFile(p, &tar.Header{
+				Name:     "special",
+				Typeflag: test.typeflag,
+				Mode:     0640,
+				Uid:      os.Geteuid(),
+				Gid:      os.Getegid(),
+				Devmajor: test.major,
+				Devminor: test.minor,
+				ModTime:  mtime,
+			}))
+
+			fi, err := os.Lstat(p)
+			require.NoError(err)
+			require.Equal(test.mode|0640, fi.Mode())
+			require.True(mtime.Equal(fi.ModTime()))
+
+			// The header of the created file describes it the same way.
+			h, err := tar.FileInfoHeader(fi, "")
+			require.NoError(err)
+			require.Equal(test.typeflag, h.Typeflag)
+			require.Equal(test.major, h.Devmajor)
+			require.Equal(test.minor, h.Devminor)
+		})
+	}
+}
+
+func TestWriteEntrySpecialFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Nothing writes to the fifo, so reading it would block forever.
+	p := filepath.Join(dir, "fifo")
+	require.NoError(syscall.Mkfifo(p, 0644))
+	fi, err := os.Lstat(p)
+	require.NoError(err)
+	h, err := tar.FileInfoHeader(fi, "")
+	require.NoError(err)
+
+	var b bytes.Buffer
+	w := NewWriter(&b, DefaultOptions())
+	require.NoError(w.WriteEntry(p, h))
+	require.NoError(w.Close())
+
+	r := tar.NewReader(&b)
+	rh, err := r.Next()
+	require.NoError(err)
+	require.Equal(byte(tar.TypeFifo), rh.Typeflag)
+	require.Equal(int64(0), rh.Size)
+	_, err = r.Next()
+	require.Equal(io.EOF, err)
+}
+
+func TestIsKeptSpecialFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fifo := filepath.Join(dir, "fifo")
+	require.NoError(syscall.Mkfifo(fifo, 0644))
+	fifoInfo, err := os.Lstat(fifo)
+	require.NoError(err)
+	file := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(file, nil, 0644))
+	fileInfo, err := os.Lstat(file)
+	require.NoError(err)
+
+	opts := DefaultOptions()
+	require.False(opts.IsKeptSpecialFile(fifoInfo))
+	opts.KeepSpecialFiles = true
+	require.True(opts.IsKeptSpecialFile(fifoInfo))
+	require.False(opts.IsKeptSpecialFile(fileInfo))
+}
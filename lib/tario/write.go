@@ -18,11 +18,79 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 	"time"
+
+	"github.com/uber/makisu/lib/fileio"
 )
 
+// Writer is a tar writer that keeps the writer under it, so that entries that
+// archive/tar can't encode, like sparse files, can be written directly.
+type Writer struct {
+	*tar.Writer
+	w    *countingWriter
+	opts Options
+}
+
+// NewWriter creates a new Writer writing to w, with the sparse files and the
+// blocking factor of opts.
+func NewWriter(w io.Writer, opts Options) *Writer {
+	cw := &countingWriter{w: w}
+	return &Writer{tar.NewWriter(cw), cw, opts}
+}
+
+// Close writes the end of the archive, and pads it to a multiple of
+// BlockingFactor blocks.
+func (w *Writer) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	recordSize := int64(w.opts.BlockingFactor) * _blockSize
+	if recordSize <= _blockSize || w.w.n%recordSize == 0 {
+		return nil
+	}
+	padding := make([]byte, recordSize-w.w.n%recordSize)
+	if _, err := w.w.Write(padding); err != nil {
+		return fmt.Errorf("write record padding: %s", err)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to the writer under it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteEntry is like the WriteEntry function, but writes regular files with
+// holes as sparse entries if SparseFiles is true.
+func (w *Writer) WriteEntry(src string, h *tar.Header) error {
+	if !w.opts.SparseFiles || (h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA) || h.Size == 0 {
+		return WriteEntry(w.Writer, src, h)
+	}
+
+	f, err := fileio.Open(src)
+	if err != nil {
+		return fmt.Errorf("open src file %s: %s", src, err)
+	}
+	normalizeHeader(h)
+	ok, err := writeSparseEntry(w.Writer, w.w, f.File, h)
+	// The file is closed before WriteEntry opens it again.
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("write sparse file %s: %s", src, err)
+	} else if ok {
+		return nil
+	}
+	return WriteEntry(w.Writer, src, h)
+}
+
 // WriteEntry write the file from the local filesystem into the tar writer.
 // This function doesn't handle parent directories.
 func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
@@ -31,10 +99,11 @@ func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
 	}
 
 	switch h.Typeflag {
-	case tar.TypeDir, tar.TypeLink, tar.TypeSymlink:
+	case tar.TypeDir, tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// Only the header is written, the file is never opened.
 		return nil
 	case tar.TypeReg, tar.TypeRegA:
-		f, err := os.Open(src)
+		f, err := fileio.Open(src)
 		if err != nil {
 			return fmt.Errorf("open src file %s: %s", src, err)
 		}
@@ -53,6 +122,16 @@ func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
 
 // WriteHeader writes the header given to the tar writer.
 func WriteHeader(w *tar.Writer, h *tar.Header) error {
+	normalizeHeader(h)
+	if err := w.WriteHeader(h); err != nil {
+		return fmt.Errorf("write header %s: %s", h.Name, err)
+	}
+	return nil
+}
+
+// normalizeHeader makes the name and modtime of h match tars produced by
+// docker and GNU tar.
+func normalizeHeader(h *tar.Header) {
 	// Remove leading "/" in dst. Tars produced by docker doesn't have it.
 	h.Name = strings.TrimLeft(h.Name, "/")
 
@@ -60,9 +139,4 @@ func WriteHeader(w *tar.Writer, h *tar.Header) error {
 	// the GNU tar program _truncates_ that modtime. Manually truncate the time
 	// to avoid inconsistency.
 	h.ModTime = h.ModTime.Truncate(1 * time.Second)
-
-	if err := w.WriteHeader(h); err != nil {
-		return fmt.Errorf("write header %s: %s", h.Name, err)
-	}
-	return nil
 }
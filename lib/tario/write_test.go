@@ -16,12 +16,15 @@ package tario
 
 import (
 	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -211,3 +214,64 @@ func TestWriteEntry(t *testing.T) {
 		require.Equal([]byte("test data"), b)
 	})
 }
+
+func TestWriterBlocking(t *testing.T) {
+	content := []byte("test data")
+	h := &tar.Header{
+		Name:     "test",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Unix(1500000000, 0),
+		Format:   tar.FormatUSTAR,
+	}
+
+	// Reference header block, as written by archive/tar.
+	var hb bytes.Buffer
+	require.NoError(t, tar.NewWriter(&hb).WriteHeader(h))
+	require.Equal(t, _blockSize, hb.Len())
+
+	tests := []struct {
+		desc   string
+		factor int
+		size   int
+	}{
+		{"docker", 1, 4 * _blockSize},
+		{"two blocks", 2, 4 * _blockSize},
+		{"three blocks", 3, 6 * _blockSize},
+		{"gnu tar", 20, 20 * _blockSize},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			opts := DefaultOptions()
+			opts.BlockingFactor = test.factor
+
+			// Header, content padded to a block, two zero blocks, then zeros
+			// up to the end of the record.
+			reference := make([]byte, test.size)
+			copy(reference, hb.Bytes())
+			copy(reference[_blockSize:], content)
+
+			var b bytes.Buffer
+			w := NewWriter(&b, opts)
+			hc := *h
+			require.NoError(WriteHeader(w.Writer, &hc))
+			_, err := w.Write(content)
+			require.NoError(err)
+			require.NoError(w.Close())
+			require.Equal(reference, b.Bytes())
+
+			r := tar.NewReader(&b)
+			rh, err := r.Next()
+			require.NoError(err)
+			require.Equal(h.Name, rh.Name)
+			data, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(content, data)
+			_, err = r.Next()
+			require.Equal(io.EOF, err)
+		})
+	}
+}
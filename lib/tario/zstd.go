@@ -0,0 +1,59 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+var _zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// NewZstdWriter returns a new zstd writer, at the zstd level closest to the
+// CompressionLevel of opts.
+func NewZstdWriter(w io.Writer, opts Options) (io.WriteCloser, error) {
+	level := zstd.SpeedDefault
+	switch opts.CompressionLevel {
+	case pgzip.NoCompression, pgzip.BestSpeed:
+		level = zstd.SpeedFastest
+	case pgzip.BestCompression:
+		level = zstd.SpeedBestCompression
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+}
+
+// NewZstdReader returns a new zstd reader.
+func NewZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// IsZstd returns true if the content read from r starts with the zstd magic
+// bytes.
+func IsZstd(r io.Reader) (bool, error) {
+	magic, err := bufio.NewReader(r).Peek(len(_zstdMagic))
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("read magic bytes: %s", err)
+	}
+	return bytes.Equal(magic, _zstdMagic), nil
+}
@@ -0,0 +1,264 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// ExportTimeout is the maximum time to wait for the collector when the spans
+// are exported.
+var ExportTimeout = 10 * time.Second
+
+// Kinds of spans, with the values of the SpanKind enum of OTLP.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// Tracer collects the spans of a build, and exports them to an OTLP/HTTP
+// collector. All the spans of a tracer belong to the same trace.
+type Tracer struct {
+	sync.Mutex
+
+	endpoint string
+	service  string
+	traceID  string
+	root     *Span
+	spans    []*Span
+}
+
+// NewTracer returns a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// "http://localhost:4318". The spans are posted to its /v1/traces path, unless
+// the endpoint already ends with it.
+func NewTracer(endpoint, service string) *Tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	return &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		traceID:  randomID(16),
+	}
+}
+
+// Span is a timed operation of the build. A nil span is valid and does
+// nothing, which is what the Start functions return when tracing is disabled.
+type Span struct {
+	sync.Mutex
+
+	tracer   *Tracer
+	id       string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+// StartRoot starts a span that the spans started without parent belong to,
+// until the next call.
+func (t *Tracer) StartRoot(name string) *Span {
+	s := t.newSpan(nil, name, KindInternal)
+	t.Lock()
+	t.root = s
+	t.Unlock()
+	return s
+}
+
+// Start starts a span under parent, or under the root span if parent is nil.
+func (t *Tracer) Start(parent *Span, name string, kind int) *Span {
+	if parent == nil {
+		t.Lock()
+		parent = t.root
+		t.Unlock()
+	}
+	return t.newSpan(parent, name, kind)
+}
+
+func (t *Tracer) newSpan(parent *Span, name string, kind int) *Span {
+	s := &Span{
+		tracer: t,
+		id:     randomID(8),
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+	if parent != nil {
+		s.parentID = parent.id
+	}
+	return s
+}
+
+// SetAttribute sets an attribute of the span. The value is a string, a bool,
+// an integer or a float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attrs[key] = value
+}
+
+// End ends the span, with an error status if err is not nil. Only ended spans
+// are exported.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.end, s.err = time.Now(), err
+	s.Unlock()
+
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// Flush exports the spans that ended since the last call.
+func (t *Tracer) Flush() error {
+	t.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return fmt.Errorf("marshal spans: %s", err)
+	}
+	resp, err := httputil.Post(
+		t.endpoint,
+		httputil.SendBody(bytes.NewReader(payload)),
+		httputil.SendHeaders(map[string]string{"Content-Type": "application/json"}),
+		httputil.SendTimeout(ExportTimeout),
+		httputil.DisableHTTPFallback())
+	if err != nil {
+		return fmt.Errorf("export %d spans to %s: %s", len(spans), t.endpoint, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request returns the ExportTraceServiceRequest of the spans, in the JSON
+// encoding of OTLP.
+func (t *Tracer) request(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "makisu"}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp(t.traceID))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: attributeValue(t.service)},
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func (s *Span) otlp(traceID string) otlpSpan {
+	s.Lock()
+	defer s.Unlock()
+
+	span := otlpSpan{
+		TraceID:      traceID,
+		SpanID:       s.id,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Kind:         s.kind,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:       otlpStatus{Code: statusOK},
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+	}
+	for _, key := range sortedKeys(s.attrs) {
+		span.Attributes = append(span.Attributes, otlpKeyValue{key, attributeValue(s.attrs[key])})
+	}
+	return span
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("read random id: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+var (
+	mu     sync.RWMutex
+	tracer *Tracer
+)
+
+// SetTracer sets the tracer that spans are started with. A nil tracer disables
+// tracing.
+func SetTracer(t *Tracer) {
+	mu.Lock()
+	defer mu.Unlock()
+	tracer = t
+}
+
+func getTracer() *Tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return tracer
+}
+
+// StartRoot starts a root span with the current tracer, or returns nil if
+// tracing is disabled.
+func StartRoot(name string) *Span {
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	return t.StartRoot(name)
+}
+
+// Start starts a span with the current tracer, or returns nil if tracing is
+// disabled.
+func Start(parent *Span, name string, kind int) *Span {
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	return t.Start(parent, name, kind)
+}
+
+// Flush exports the spans of the current tracer, if tracing is enabled.
+func Flush() error {
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	return t.Flush()
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracerFlush(t *testing.T) {
+	require := require.New(t)
+
+	var requests []otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/v1/traces", r.URL.Path)
+		require.Equal("application/json", r.Header.Get("Content-Type"))
+		var req otlpRequest
+		require.NoError(json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL, "makisu")
+	root := tracer.StartRoot("build")
+	stage := tracer.Start(nil, "stage", KindInternal)
+	step := tracer.Start(stage, "step", KindInternal)
+	step.SetAttribute("makisu.cache", "hit")
+	step.SetAttribute("makisu.layers.bytes", int64(42))
+	step.End(nil)
+	stage.End(errors.New("stage failed"))
+	root.End(nil)
+	require.NoError(tracer.Flush())
+
+	require.Len(requests, 1)
+	require.Len(requests[0].ResourceSpans, 1)
+	resource := requests[0].ResourceSpans[0]
+	require.Equal("service.name", resource.Resource.Attributes[0].Key)
+	require.Equal("makisu", *resource.Resource.Attributes[0].Value.StringValue)
+	spans := resource.ScopeSpans[0].Spans
+	require.Len(spans, 3)
+
+	s, st, b := spans[0], spans[1], spans[2]
+	require.Equal([]string{"step", "stage", "build"}, []string{s.Name, st.Name, b.Name})
+	for _, span := range spans {
+		require.Equal(tracer.traceID, span.TraceID)
+		require.Len(span.TraceID, 32)
+		require.Len(span.SpanID, 16)
+	}
+	require.Equal(st.SpanID, s.ParentSpanID)
+	require.Equal(b.SpanID, st.ParentSpanID)
+	require.Empty(b.ParentSpanID)
+
+	require.Equal([]otlpKeyValue{
+		{"makisu.cache", attributeValue("hit")},
+		{"makisu.layers.bytes", attributeValue(42)},
+	}, s.Attributes)
+	require.Equal("42", *s.Attributes[1].Value.IntValue)
+	require.Equal(otlpStatus{Code: statusOK}, s.Status)
+	require.Equal(otlpStatus{Code: statusError, Message: "stage failed"}, st.Status)
+
+	// Spans are only exported once.
+	require.NoError(tracer.Flush())
+	require.Len(requests, 1)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	require := require.New(t)
+
+	SetTracer(nil)
+	span := Start(StartRoot("build"), "step", KindInternal)
+	require.Nil(span)
+	span.SetAttribute("makisu.cache", "miss")
+	span.End(nil)
+	require.NoError(Flush())
+}
+
+func TestNewTracerEndpoint(t *testing.T) {
+	for _, endpoint := range []string{
+		"http://localhost:4318",
+		"http://localhost:4318/",
+		"http://localhost:4318/v1/traces",
+	} {
+		t.Run(endpoint, func(t *testing.T) {
+			require := require.New(t)
+			require.Equal("http://localhost:4318/v1/traces", NewTracer(endpoint, "makisu").endpoint)
+		})
+	}
+}
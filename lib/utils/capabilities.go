@@ -0,0 +1,115 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Capability is a linux capability, identified by its bit in capability sets.
+type Capability uint
+
+// Capabilities that builds may need.
+const (
+	CapChown       Capability = 0
+	CapDacOverride Capability = 1
+	CapFowner      Capability = 3
+	CapSetgid      Capability = 6
+	CapSetuid      Capability = 7
+	CapMknod       Capability = 27
+)
+
+var capabilityNames = map[Capability]string{
+	CapChown:       "CAP_CHOWN",
+	CapDacOverride: "CAP_DAC_OVERRIDE",
+	CapFowner:      "CAP_FOWNER",
+	CapSetgid:      "CAP_SETGID",
+	CapSetuid:      "CAP_SETUID",
+	CapMknod:       "CAP_MKNOD",
+}
+
+func (c Capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("capability %d", uint(c))
+}
+
+// CapabilitySet is a set of capabilities, as a bit mask.
+type CapabilitySet uint64
+
+// Has returns true if c is in the set.
+func (s CapabilitySet) Has(c Capability) bool {
+	return s&(1<<c) != 0
+}
+
+// EffectiveCapabilities returns the effective capability set of the process.
+// It fails on systems without /proc, like darwin.
+func EffectiveCapabilities() (CapabilitySet, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("open process status: %s", err)
+	}
+	defer f.Close()
+	return parseEffectiveCapabilities(f)
+}
+
+// parseEffectiveCapabilities reads the CapEff line of a /proc/<pid>/status
+// file.
+func parseEffectiveCapabilities(r io.Reader) (CapabilitySet, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse effective capabilities: %s", err)
+		}
+		return CapabilitySet(caps), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read process status: %s", err)
+	}
+	return 0, fmt.Errorf("no effective capabilities in process status")
+}
+
+// _accessWrite is the W_OK mode of access(2).
+const _accessWrite = 2
+
+// CheckWritable returns an error if the process can't write to the dir at
+// path, or to its closest existing ancestor if it doesn't exist yet, e.g.
+// because the filesystem is mounted read-only.
+func CheckWritable(path string) error {
+	for {
+		if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+			break
+		} else if path == filepath.Dir(path) {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if err := syscall.Access(path, _accessWrite); err != nil {
+		return fmt.Errorf("%s is not writable: %s", path, err)
+	}
+	return nil
+}
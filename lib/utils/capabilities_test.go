@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEffectiveCapabilities(t *testing.T) {
+	t.Run("Root", func(t *testing.T) {
+		require := require.New(t)
+
+		caps, err := parseEffectiveCapabilities(strings.NewReader(
+			"Name:\tmakisu\nCapInh:\t0000000000000000\nCapPrm:\t000001ffffffffff\nCapEff:\t000001ffffffffff\n"))
+		require.NoError(err)
+		require.True(caps.Has(CapChown))
+		require.True(caps.Has(CapMknod))
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		require := require.New(t)
+
+		// CAP_CHOWN, CAP_SETGID and CAP_SETUID.
+		caps, err := parseEffectiveCapabilities(strings.NewReader("CapEff:\t00000000000000c1\n"))
+		require.NoError(err)
+		require.True(caps.Has(CapChown))
+		require.False(caps.Has(CapDacOverride))
+		require.False(caps.Has(CapFowner))
+		require.True(caps.Has(CapSetgid))
+		require.True(caps.Has(CapSetuid))
+		require.False(caps.Has(CapMknod))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		require := require.New(t)
+
+		_, err := parseEffectiveCapabilities(strings.NewReader("Name:\tmakisu\n"))
+		require.Error(err)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require := require.New(t)
+
+		_, err := parseEffectiveCapabilities(strings.NewReader("CapEff:\tnothex\n"))
+		require.Error(err)
+	})
+}
+
+func TestCapabilityString(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("CAP_DAC_OVERRIDE", CapDacOverride.String())
+	require.Equal("capability 40", Capability(40).String())
+}
+
+func TestCheckWritable(t *testing.T) {
+	t.Run("Exists", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		require.NoError(CheckWritable(dir))
+	})
+
+	t.Run("NotExists", func(t *testing.T) {
+		require := require.New(t)
+
+		dir, err := ioutil.TempDir("", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+
+		require.NoError(CheckWritable(filepath.Join(dir, "a/b")))
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		require := require.New(t)
+
+		if os.Geteuid() == 0 {
+			t.Skip("root can write to read-only dirs")
+		}
+		dir, err := ioutil.TempDir("", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		require.NoError(os.Chmod(dir, 0500))
+		defer os.Chmod(dir, 0700)
+
+		require.Error(CheckWritable(filepath.Join(dir, "a")))
+	})
+}
@@ -91,6 +91,12 @@ func IsForbidden(err error) bool {
 	return IsStatus(err, http.StatusForbidden)
 }
 
+// IsServerError returns true if err is a StatusError of a 5xx status.
+func IsServerError(err error) bool {
+	statusErr, ok := err.(StatusError)
+	return ok && statusErr.Status >= http.StatusInternalServerError
+}
+
 // NetworkError occurs on any Send error which occurred while trying to send
 // the HTTP request, e.g. the given host is unresponsive.
 type NetworkError struct {
@@ -304,6 +310,10 @@ func Send(method, rawurl string, options ...SendOption) (resp *http.Response, er
 				opts.retry.backoffMax)
 		}
 		resp, err = client.Do(req)
+		if err != nil && opts.ctx.Err() != nil {
+			// The request was canceled, retrying it would fail too.
+			break
+		}
 		// Retry without tls. During migration there would be a time when the
 		// component receiving the tls request does not serve https response.
 		// TODO (@evelynl): disable retry after tls migration.
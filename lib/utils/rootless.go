@@ -0,0 +1,55 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"os"
+)
+
+// Rootless is true if makisu runs without the privileges to change the owner
+// of files, e.g. as a non-root user in an unprivileged container. Ownership is
+// then still recorded in layers from tar headers and COPY --chown, but not
+// applied on disk, and ignored when comparing files.
+var Rootless bool
+
+// DetectRootless returns true if the process is neither root nor has
+// CAP_CHOWN.
+func DetectRootless() bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	caps, err := EffectiveCapabilities()
+	if err != nil {
+		return true
+	}
+	return !caps.Has(CapChown)
+}
+
+// Chown changes the owner of the file, unless makisu runs rootless.
+func Chown(path string, uid, gid int) error {
+	if Rootless {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Lchown changes the owner of the file without following symlinks, unless
+// makisu runs rootless.
+func Lchown(path string, uid, gid int) error {
+	if Rootless {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
@@ -0,0 +1,48 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectRootless(t *testing.T) {
+	if os.Geteuid() == 0 {
+		require.False(t, DetectRootless())
+	}
+}
+
+func TestChownRootless(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("", "makisu-test")
+	require.NoError(err)
+	f.Close()
+	defer os.Remove(f.Name())
+	before, err := os.Lstat(f.Name())
+	require.NoError(err)
+
+	Rootless = true
+	defer func() { Rootless = false }()
+	require.NoError(Chown(f.Name(), 12345, 12345))
+	require.NoError(Lchown(f.Name(), 12345, 12345))
+	after, err := os.Lstat(f.Name())
+	require.NoError(err)
+	require.Equal(FileInfoStat(before).Uid, FileInfoStat(after).Uid)
+}
@@ -21,6 +21,10 @@ const (
 	// SampleImageTag is the tag of the sample image.
 	SampleImageTag = "latest"
 
+	// SampleImageManifestDigest is the digest of the manifest of the sample
+	// image.
+	SampleImageManifestDigest = "8643296b6b8c94953173d4b13d94cabdfdf790b25ec57623f907f4d986379f2c"
+
 	// SampleImageConfigDigest is the digest of the data layer in sample image.
 	SampleImageConfigDigest = "a052f56e596097698ac74bb4b03607f2dd6bc026751878ff5d57a74bb043f098"
 
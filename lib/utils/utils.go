@@ -15,11 +15,13 @@
 package utils
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -34,6 +36,7 @@ type MultiErrors struct {
 	sync.Mutex
 
 	errStr string
+	first  error
 }
 
 // NewMultiErrors returns a new MultiErrors obj.
@@ -48,6 +51,7 @@ func (e *MultiErrors) Add(err error) {
 
 	if e.errStr == "" {
 		e.errStr = err.Error()
+		e.first = err
 		return
 	}
 
@@ -55,17 +59,29 @@ func (e *MultiErrors) Add(err error) {
 }
 
 // Collect returns the result error.
+// It unwraps to the first error that was added.
 func (e *MultiErrors) Collect() error {
 	e.Lock()
 	defer e.Unlock()
 
 	if e.errStr == "" {
 		return nil
+	} else if e.errStr == e.first.Error() {
+		return e.first
 	}
 
-	return fmt.Errorf(e.errStr)
+	return multiError{e.errStr, e.first}
 }
 
+type multiError struct {
+	errStr string
+	first  error
+}
+
+func (e multiError) Error() string { return e.errStr }
+
+func (e multiError) Unwrap() error { return e.first }
+
 // Must ensures that the condition passed in is true.
 // If condition is true this function NO-OPS; Otherwise it logs the message
 // formatted with the arguments passed in
@@ -85,6 +101,27 @@ func DefaultEnv(key string, _default string) string {
 	return val
 }
 
+// ExpandEnvStrict replaces ${var} or $var in the string according to the
+// values of the environment variables, like os.ExpandEnv, but returns an error
+// naming the variables that are not set instead of replacing them with empty
+// strings.
+func ExpandEnvStrict(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(key string) string {
+		val, found := os.LookupEnv(key)
+		if !found {
+			missing = append(missing, key)
+		}
+		return val
+	})
+	if len(missing) == 1 {
+		return "", fmt.Errorf("environment variable %s is not set", missing[0])
+	} else if len(missing) > 1 {
+		return "", fmt.Errorf("environment variables %s are not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
 // ConvertStringSliceToMap parses a string slice as "=" separated key value
 // pairs, and returns a map.
 func ConvertStringSliceToMap(values []string) map[string]string {
@@ -104,17 +141,49 @@ func ConvertStringSliceToMap(values []string) map[string]string {
 // MergeEnv merges a new env key value pair into existing list.
 // This is needed because Docker image config defines Env as []string, but
 // actually uses it as map[string]string.
+// Like Docker, existing entries keep their position (with updated values), and
+// new keys are appended at the end, sorted to keep the output deterministic.
 func MergeEnv(envList []string, newEnvMap map[string]string) []string {
+	return MergeEnvOrdered(envList, newEnvMap, nil)
+}
+
+// MergeEnvOrdered is like MergeEnv, but appends new keys in the order they
+// appear in keys, which is usually the order they were declared in. New keys
+// missing from keys are appended after them, sorted.
+func MergeEnvOrdered(envList []string, newEnvMap map[string]string, keys []string) []string {
 	envMap := ConvertStringSliceToMap(envList)
 	for newK, newV := range newEnvMap {
 		envMap[newK] = newV
 	}
 
 	result := []string{}
-	for k, v := range envMap {
-		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	seen := make(map[string]bool)
+	for _, env := range envList {
+		k := strings.SplitN(env, "=", 2)[0]
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		result = append(result, fmt.Sprintf("%s=%s", k, envMap[k]))
+	}
+
+	for _, newK := range keys {
+		if _, ok := newEnvMap[newK]; ok && !seen[newK] {
+			seen[newK] = true
+			result = append(result, fmt.Sprintf("%s=%s", newK, envMap[newK]))
+		}
+	}
+
+	newKeys := []string{}
+	for newK := range newEnvMap {
+		if !seen[newK] {
+			newKeys = append(newKeys, newK)
+		}
+	}
+	sort.Strings(newKeys)
+	for _, newK := range newKeys {
+		result = append(result, fmt.Sprintf("%s=%s", newK, envMap[newK]))
 	}
-	sort.Strings(result)
 	return result
 }
 
@@ -177,6 +246,41 @@ func GetUIDGID() (int, int, error) {
 	return os.Geteuid(), os.Getegid(), nil
 }
 
+// OutOfDiskError is returned by operations that failed because the filesystem
+// of Path is full.
+type OutOfDiskError struct {
+	Path string
+	Err  error
+}
+
+func (e *OutOfDiskError) Error() string {
+	return fmt.Sprintf("out of disk at %s: %s", e.Path, e.Err)
+}
+
+func (e *OutOfDiskError) Unwrap() error { return e.Err }
+
+// CheckOutOfDisk returns an OutOfDiskError for path if err was caused by a
+// full filesystem or an exhausted quota, and err otherwise.
+func CheckOutOfDisk(err error, path string) error {
+	var outOfDisk *OutOfDiskError
+	if errors.As(err, &outOfDisk) {
+		return err
+	} else if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return &OutOfDiskError{path, err}
+	}
+	return err
+}
+
+// FreeDiskSpace returns the number of bytes available to unprivileged users on
+// the filesystem of path.
+func FreeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("statfs %s: %s", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
 // IsValidJSON returns true if the blob passed in is a valid json object.
 func IsValidJSON(blob []byte) bool {
 	into := map[string]interface{}{}
@@ -226,3 +330,68 @@ func ResolveChown(chown string) (uid, gid int, err error) {
 	}
 	return uid, gid, nil
 }
+
+// ResolveChownInRoot is like ResolveChown, but looks up user and group names
+// in the /etc/passwd and /etc/group files under rootDir instead of the host's.
+// This is needed to resolve names against the image being built.
+func ResolveChownInRoot(chown, rootDir string) (uid, gid int, err error) {
+	if chown == "" {
+		return 0, 0, nil
+	}
+
+	split := strings.Split(chown, ":")
+	if len(split) < 1 || len(split) > 2 {
+		return 0, 0, errors.New("failed to split on ':'")
+	}
+
+	uid, err = strconv.Atoi(split[0])
+	if err != nil {
+		uid, err = lookupIDInFile(filepath.Join(rootDir, "etc/passwd"), split[0])
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to look up user '%s': %s", split[0], err)
+		}
+	}
+
+	if len(split) == 1 {
+		return uid, uid, nil
+	} else if gid, err := strconv.Atoi(split[1]); err == nil {
+		return uid, gid, nil
+	}
+
+	gid, err = lookupIDInFile(filepath.Join(rootDir, "etc/group"), split[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to look up group '%s': %s", split[1], err)
+	}
+	return uid, gid, nil
+}
+
+// lookupIDInFile returns the id of the given name from a passwd or group
+// formatted file, in which the name is the first field and the id the third.
+func lookupIDInFile(path, name string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse id to int '%s': %s", fields[2], err)
+		}
+		return id, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read %s: %s", path, err)
+	}
+	return 0, fmt.Errorf("%s not found in %s", name, path)
+}
@@ -15,6 +15,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -23,6 +24,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -80,6 +82,29 @@ func TestMust(t *testing.T) {
 	Must(true, "Should not exit and fail the tests")
 }
 
+func TestExpandEnvStrict(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(os.Setenv("MAKISU_TEST_DIR", "/ctx"))
+	defer os.Unsetenv("MAKISU_TEST_DIR")
+	require.NoError(os.Setenv("MAKISU_TEST_EMPTY", ""))
+	defer os.Unsetenv("MAKISU_TEST_EMPTY")
+
+	expanded, err := ExpandEnvStrict("${MAKISU_TEST_DIR}/Dockerfile$MAKISU_TEST_EMPTY")
+	require.NoError(err)
+	require.Equal("/ctx/Dockerfile", expanded)
+
+	expanded, err = ExpandEnvStrict("Dockerfile")
+	require.NoError(err)
+	require.Equal("Dockerfile", expanded)
+
+	_, err = ExpandEnvStrict("${MAKISU_TEST_UNSET}/Dockerfile")
+	require.EqualError(err, "environment variable MAKISU_TEST_UNSET is not set")
+
+	_, err = ExpandEnvStrict("$MAKISU_TEST_UNSET/${MAKISU_TEST_UNSET2}")
+	require.EqualError(err, "environment variables MAKISU_TEST_UNSET, MAKISU_TEST_UNSET2 are not set")
+}
+
 func TestConvertStringSlice(t *testing.T) {
 	require := require.New(t)
 
@@ -111,6 +136,28 @@ func TestMergeEnv(t *testing.T) {
 	require.NotNil(out)
 	require.Contains(out, "a=e")
 	require.Contains(out, "g=h")
+
+	// Existing entries keep their position, new ones are appended.
+	env3 := []string{"PATH=/bin", "c=d"}
+	env4 := map[string]string{"b": "x", "a": "y", "PATH": "/usr/bin:/bin"}
+	out = MergeEnv(env3, env4)
+	require.Equal([]string{"PATH=/usr/bin:/bin", "c=d", "a=y", "b=x"}, out)
+}
+
+func TestMergeEnvOrdered(t *testing.T) {
+	require := require.New(t)
+
+	env1 := []string{"PATH=/bin", "c=d"}
+	env2 := map[string]string{"b": "x", "a": "y", "z": "w", "PATH": "/usr/bin:/bin"}
+
+	// New keys are appended in the given order, the ones not listed sorted
+	// after them.
+	out := MergeEnvOrdered(env1, env2, []string{"b", "PATH", "a", "missing"})
+	require.Equal([]string{"PATH=/usr/bin:/bin", "c=d", "b=x", "a=y", "z=w"}, out)
+
+	// Duplicated keys are only added once.
+	out = MergeEnvOrdered(nil, env2, []string{"z", "z", "b", "a", "PATH"})
+	require.Equal([]string{"z=w", "b=x", "a=y", "PATH=/usr/bin:/bin"}, out)
 }
 
 func TestMergeStringMaps(t *testing.T) {
@@ -208,3 +255,82 @@ func TestResolveChown(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveChownInRoot(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test-resolve-chown")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootDir)
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootDir, "etc/passwd"),
+		[]byte("# comment\nroot:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/app:/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootDir, "etc/group"),
+		[]byte("root:x:0:\nstaff:x:50:app\n"), 0644))
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		chown   string
+		uid     int
+		gid     int
+	}{
+		{"empty", true, "", 0, 0},
+		{"uid and gid", true, "1:2", 1, 2},
+		{"user no group", true, "app", 1000, 1000},
+		{"user and group", true, "app:staff", 1000, 50},
+		{"uid and group", true, "7:staff", 7, 50},
+		{"unknown user", false, "nobody", 0, 0},
+		{"unknown group", false, "app:nogroup", 0, 0},
+		{"missing group", false, "app:", 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			uid, gid, err := ResolveChownInRoot(test.chown, rootDir)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.uid, uid)
+				require.Equal(test.gid, gid)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckOutOfDisk(t *testing.T) {
+	require := require.New(t)
+
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("open /dev/full: %s", err)
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("data"))
+	require.Error(err)
+
+	err = CheckOutOfDisk(err, "/storage")
+	var outOfDisk *OutOfDiskError
+	require.True(errors.As(err, &outOfDisk))
+	require.Equal("/storage", outOfDisk.Path)
+	require.True(errors.Is(err, syscall.ENOSPC))
+	require.True(strings.HasPrefix(err.Error(), "out of disk at /storage: "))
+
+	// Already checked errors keep their path.
+	require.Equal(err, CheckOutOfDisk(err, "/other"))
+
+	other := errors.New("other error")
+	require.Equal(other, CheckOutOfDisk(other, "/storage"))
+	require.NoError(CheckOutOfDisk(nil, "/storage"))
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	require := require.New(t)
+
+	free, err := FreeDiskSpace(os.TempDir())
+	require.NoError(err)
+	require.True(free > 0)
+
+	_, err = FreeDiskSpace("/nonexistent/dir")
+	require.Error(err)
+}
@@ -80,7 +80,7 @@ func pullAndExtract(registryURL, repository, tag, destination string) {
 		panic(fmt.Errorf("failed to create destination rootfs directory: %s", err))
 	}
 
-	memfs, err := snapshot.NewMemFS(clock.New(), destination, nil)
+	memfs, err := snapshot.NewMemFS(clock.New(), destination, nil, snapshot.DefaultOptions())
 	if err != nil {
 		panic(err)
 	}